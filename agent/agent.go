@@ -15,6 +15,7 @@ import (
 
 	"github.com/percona/percona-backup-mongodb/pbm"
 	"github.com/percona/percona-backup-mongodb/pbm/log"
+	"github.com/percona/percona-backup-mongodb/pbm/restore"
 	"github.com/percona/percona-backup-mongodb/pbm/storage"
 	"github.com/percona/percona-backup-mongodb/version"
 )
@@ -32,15 +33,29 @@ type Agent struct {
 
 	// prevOO is previous pitr.oplogOnly value
 	prevOO *bool
+	// bcpCfgGen is the config generation the last backup nomination
+	// was based on
+	bcpCfgGen int64
+
+	// prefetchBudget is the oplog prefetch memory shared by restores
+	prefetchBudget *restore.MemBudget
 }
 
 func New(pbm *pbm.PBM) *Agent {
 	return &Agent{
-		pbm:      pbm,
-		closeCMD: make(chan struct{}),
+		pbm:            pbm,
+		closeCMD:       make(chan struct{}),
+		prefetchBudget: restore.NewMemBudget(0),
 	}
 }
 
+// newRestore returns the logical restore sharing agent's resources
+func (a *Agent) newRestore(rsMap map[string]string) *restore.Restore {
+	r := restore.New(a.pbm, a.node, rsMap)
+	r.SetPrefetchBudget(a.prefetchBudget)
+	return r
+}
+
 func (a *Agent) AddNode(ctx context.Context, curi string, dumpConns int) error {
 	var err error
 	a.node, err = pbm.NewNode(ctx, curi, dumpConns)
@@ -333,6 +348,16 @@ func (a *Agent) Cleanup(d *pbm.CleanupCmd, opid pbm.OPID, ep pbm.Epoch) {
 		l.Error("make cleanup report: " + err.Error())
 		return
 	}
+	if err := a.pbm.CheckChunksDelete(cr.Chunks); err != nil {
+		var perr pbm.ProtectedChunksError
+		if !errors.As(err, &perr) {
+			l.Error("check chunks: " + err.Error())
+			return
+		}
+		// the rest of the cleanup still goes on
+		l.Warning("skip chunks: %v", perr)
+		cr.Chunks = perr.Unprotected(cr.Chunks)
+	}
 
 	for i := range cr.Chunks {
 		name := cr.Chunks[i].FName
@@ -541,6 +566,8 @@ func (a *Agent) HbStatus() {
 
 		hb.Hidden = false
 		hb.Passive = false
+		hb.Arbiter = false
+		hb.Region = ""
 
 		inf, err := a.node.GetInfo()
 		if err != nil {
@@ -549,8 +576,14 @@ func (a *Agent) HbStatus() {
 		} else {
 			hb.Hidden = inf.Hidden
 			hb.Passive = inf.Passive
+			hb.Arbiter = inf.ArbiterOnly
+			hb.Region = inf.Tags[pbm.RegionTag]
+		}
+
+		hb.Busy, err = a.pbm.NodeBusy(hb.RS, hb.Node)
+		if err != nil {
+			l.Error("get node locks: %v", err)
 		}
-		hb.Arbiter = inf.ArbiterOnly
 
 		err = a.pbm.SetAgentStatus(hb)
 		if err != nil {
@@ -2,6 +2,7 @@ package agent
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -111,6 +112,7 @@ func (a *Agent) Backup(cmd *pbm.BackupCmd, opid pbm.OPID, ep pbm.Epoch) {
 		return
 	}
 	bcp.SetTimeouts(cfg.Backup.Timeouts)
+	bcp.SetMetaCompression(cfg.Backup.MetaCompression)
 
 	if isClusterLeader {
 		balancer := pbm.BalancerModeOff
@@ -175,11 +177,21 @@ func (a *Agent) Backup(cmd *pbm.BackupCmd, opid pbm.OPID, ep pbm.Epoch) {
 			l.Error("get nodes priority: %v", err)
 			return
 		}
+		a.logBcpPriorityChange(nodes, l)
 		shards, err := a.pbm.ClusterMembers()
 		if err != nil {
 			l.Error("get cluster members: %v", err)
 			return
 		}
+		rss := make([]string, len(shards))
+		for i, sh := range shards {
+			rss[i] = sh.RS
+		}
+		if err := nodes.CheckCandidates(rss); err != nil {
+			ferr := a.pbm.ChangeBackupState(cmd.Name, pbm.StatusError, err.Error())
+			l.Info("mark backup as %s `%v`: %v", pbm.StatusError, err, ferr)
+			return
+		}
 		for _, sh := range shards {
 			go func(rs string) {
 				err := a.nominateRS(cmd.Name, rs, nodes.RS(rs), l)
@@ -322,3 +334,15 @@ func (a *Agent) waitNomination(bcp, rs, node string, l *log.Event) (bool, error)
 		}
 	}
 }
+
+// logBcpPriorityChange logs when the config the nodes priority is
+// based on has changed since the previous backup
+func (a *Agent) logBcpPriorityChange(nodes *pbm.NodesPriority, l *log.Event) {
+	prev := atomic.SwapInt64(&a.bcpCfgGen, nodes.Generation)
+	if prev == 0 || prev == nodes.Generation {
+		return
+	}
+
+	l.Info("config generation changed %d -> %d, backup priority: %v",
+		prev, nodes.Generation, nodes.Priority)
+}
@@ -19,10 +19,11 @@ func (a *Agent) OplogReplay(r *pbm.ReplayCmd, opID pbm.OPID, ep pbm.Epoch) {
 
 	l := a.log.NewEvent(string(pbm.CmdReplay), r.Name, opID.String(), ep.TS())
 
-	l.Info("time: %s-%s",
-		time.Unix(int64(r.Start.T), 0).UTC().Format(time.RFC3339),
-		time.Unix(int64(r.End.T), 0).UTC().Format(time.RFC3339),
-	)
+	end := "latest"
+	if !r.End.IsZero() {
+		end = time.Unix(int64(r.End.T), 0).UTC().Format(time.RFC3339)
+	}
+	l.Info("time: %s-%s", time.Unix(int64(r.Start.T), 0).UTC().Format(time.RFC3339), end)
 
 	nodeInfo, err := a.node.GetInfo()
 	if err != nil {
@@ -60,7 +61,7 @@ func (a *Agent) OplogReplay(r *pbm.ReplayCmd, opID pbm.OPID, ep pbm.Epoch) {
 	}()
 
 	l.Info("oplog replay started")
-	if err := restore.New(a.pbm, a.node, r.RSMap).ReplayOplog(r, opID, l); err != nil {
+	if err := a.newRestore(r.RSMap).ReplayOplog(r, opID, l); err != nil {
 		if errors.Is(err, restore.ErrNoDataForShard) {
 			l.Info("no oplog for the shard, skipping")
 		} else {
@@ -119,6 +119,10 @@ func (a *Agent) pitr() error {
 
 	// already do the job
 	if p != nil {
+		if p.slicer != nil {
+			p.slicer.SetPipelineDepth(cfg.PITR.PipelineDepth)
+			p.slicer.SetChunkMaxBytes(cfg.PITR.ChunkMaxBytes)
+		}
 		// update slicer span
 		cspan := p.slicer.GetSpan()
 		if p.slicer != nil && cspan != spant {
@@ -188,6 +192,9 @@ func (a *Agent) pitr() error {
 
 	ibcp := pitr.NewSlicer(a.node.RS(), a.pbm, a.node, stg, ep)
 	ibcp.SetSpan(spant)
+	ibcp.SetPipelineDepth(cfg.PITR.PipelineDepth)
+	ibcp.SetChunkMaxBytes(cfg.PITR.ChunkMaxBytes)
+	ibcp.SetZstdDictSize(cfg.PITR.ZstdDictSize)
 
 	if cfg.PITR.OplogOnly {
 		err = ibcp.OplogOnlyCatchup()
@@ -309,7 +316,7 @@ func (a *Agent) Restore(r *pbm.RestoreCmd, opid pbm.OPID, ep pbm.Epoch) {
 		}()
 	}
 
-	stg, err := a.pbm.GetStorage(l)
+	stg, err := a.pbm.GetStorageOverride(r.Storage, l)
 	if err != nil {
 		l.Error("get storage: %v", err)
 		return
@@ -322,7 +329,11 @@ func (a *Agent) Restore(r *pbm.RestoreCmd, opid pbm.OPID, ep pbm.Epoch) {
 		bcpType = pbm.ExternalBackup
 	} else {
 		l.Info("backup: %s", r.BackupName)
-		bcp, err = restore.SnapshotMeta(a.pbm, r.BackupName, stg)
+		if r.Storage != nil {
+			bcp, err = restore.GetMetaFromStore(a.pbm.Context(), stg, r.BackupName)
+		} else {
+			bcp, err = restore.SnapshotMeta(a.pbm, r.BackupName, stg)
+		}
 		if err != nil {
 			l.Error("define base backup: %v", err)
 			return
@@ -335,6 +346,10 @@ func (a *Agent) Restore(r *pbm.RestoreCmd, opid pbm.OPID, ep pbm.Epoch) {
 		}
 		bcpType = bcp.Type
 	}
+	if r.Storage != nil && bcpType != pbm.LogicalBackup {
+		l.Error("storage override is only allowed for logical restore")
+		return
+	}
 
 	l.Info("recovery started")
 
@@ -345,9 +360,9 @@ func (a *Agent) Restore(r *pbm.RestoreCmd, opid pbm.OPID, ep pbm.Epoch) {
 			return
 		}
 		if r.OplogTS.IsZero() {
-			err = restore.New(a.pbm, a.node, r.RSMap).Snapshot(r, opid, l)
+			err = a.newRestore(r.RSMap).Snapshot(r, opid, l)
 		} else {
-			err = restore.New(a.pbm, a.node, r.RSMap).PITR(r, opid, l)
+			err = a.newRestore(r.RSMap).PITR(r, opid, l)
 		}
 	case pbm.PhysicalBackup, pbm.IncrementalBackup, pbm.ExternalBackup:
 		if lock != nil {
@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+
+	"github.com/percona/percona-backup-mongodb/version"
+)
+
+// SetupTracing registers the TracerProvider that exports the agent's spans
+// (e.g. the restore ones) as JSON lines to `out`: a file path, "stdout" or
+// "stderr". Tracing is off if `out` is empty. The returned func flushes
+// the pending spans and stops the exporter.
+func SetupTracing(out string) (func(context.Context) error, error) {
+	if out == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exp, err := newJSONExporter(out)
+	if err != nil {
+		return nil, errors.Wrap(err, "create exporter")
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName("pbm-agent"),
+			semconv.ServiceVersion(version.Current().Version),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// jsonSpan is the exported span
+type jsonSpan struct {
+	Name     string                 `json:"name"`
+	TraceID  string                 `json:"traceID"`
+	SpanID   string                 `json:"spanID"`
+	ParentID string                 `json:"parentID,omitempty"`
+	Start    time.Time              `json:"start"`
+	End      time.Time              `json:"end"`
+	Status   string                 `json:"status"`
+	Error    string                 `json:"error,omitempty"`
+	Attrs    map[string]interface{} `json:"attrs,omitempty"`
+}
+
+// jsonExporter writes the spans as JSON lines
+type jsonExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	c   io.Closer
+}
+
+func newJSONExporter(out string) (*jsonExporter, error) {
+	switch out {
+	case "stdout":
+		return &jsonExporter{enc: json.NewEncoder(os.Stdout)}, nil
+	case "stderr":
+		return &jsonExporter{enc: json.NewEncoder(os.Stderr)}, nil
+	}
+
+	f, err := os.OpenFile(out, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %s", out)
+	}
+	return &jsonExporter{enc: json.NewEncoder(f), c: f}, nil
+}
+
+func (e *jsonExporter) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, s := range spans {
+		js := jsonSpan{
+			Name:    s.Name(),
+			TraceID: s.SpanContext().TraceID().String(),
+			SpanID:  s.SpanContext().SpanID().String(),
+			Start:   s.StartTime(),
+			End:     s.EndTime(),
+			Status:  s.Status().Code.String(),
+			Error:   s.Status().Description,
+		}
+		if s.Parent().IsValid() {
+			js.ParentID = s.Parent().SpanID().String()
+		}
+		if attrs := s.Attributes(); len(attrs) > 0 {
+			js.Attrs = make(map[string]interface{}, len(attrs))
+			for _, a := range attrs {
+				js.Attrs[string(a.Key)] = a.Value.AsInterface()
+			}
+		}
+
+		if err := e.enc.Encode(js); err != nil {
+			return errors.Wrap(err, "write span")
+		}
+	}
+
+	return nil
+}
+
+func (e *jsonExporter) Shutdown(context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.c == nil {
+		return nil
+	}
+	return e.c.Close()
+}
@@ -68,8 +68,9 @@ func (b externBcpOut) String() string {
 }
 
 type descBcp struct {
-	name string
-	coll bool
+	name  string
+	coll  bool
+	codec bool
 }
 
 func runBackup(cn *pbm.PBM, b *backupOpts, outf outFormat) (fmt.Stringer, error) {
@@ -107,7 +108,7 @@ func runBackup(cn *pbm.PBM, b *backupOpts, outf outFormat) (fmt.Stringer, error)
 		return nil, errors.Wrap(err, "get remote-store")
 	}
 
-	compression := cfg.Backup.Compression
+	compression := cfg.Backup.CompressionFor(cfg.Storage.Type)
 	if b.compression != "" {
 		compression = compress.CompressionType(b.compression)
 	}
@@ -293,6 +294,8 @@ type bcpDesc struct {
 	HSize              string         `json:"size_h" yaml:"size_h"`
 	Err                *string        `json:"error,omitempty" yaml:"error,omitempty"`
 	Replsets           []bcpReplDesc  `json:"replsets" yaml:"replsets"`
+
+	Compression compress.CompressionType `json:"compression" yaml:"compression"`
 }
 
 type bcpReplDesc struct {
@@ -308,6 +311,43 @@ type bcpReplDesc struct {
 	SecurityOpts       *pbm.MongodOptsSec `json:"security,omitempty" yaml:"security,omitempty"`
 	Error              *string            `json:"error,omitempty" yaml:"error,omitempty"`
 	Collections        []string           `json:"collections,omitempty" yaml:"collections,omitempty"`
+
+	OplogCompression *bcpCodecDesc `json:"oplog_compression,omitempty" yaml:"oplog_compression,omitempty"`
+}
+
+// bcpCodecDesc is the compression of a backup file declared in the
+// metadata and the one detected by the file content
+type bcpCodecDesc struct {
+	Declared compress.CompressionType `json:"declared" yaml:"declared"`
+	Detected compress.CompressionType `json:"detected" yaml:"detected"`
+	Mismatch bool                     `json:"mismatch" yaml:"mismatch"`
+}
+
+// fileCodec detects the compression of the file and compares it with
+// the declared one
+func fileCodec(stg storage.Storage, name string, declared compress.CompressionType) (*bcpCodecDesc, error) {
+	c, err := pbm.DetectFileCompression(stg, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bcpCodecDesc{
+		Declared: declared,
+		Detected: c,
+		Mismatch: !sameCodec(declared, c),
+	}, nil
+}
+
+// sameCodec returns true if the data compressed with `a` can be read as `b`
+func sameCodec(a, b compress.CompressionType) bool {
+	gz := func(c compress.CompressionType) bool {
+		return c == compress.CompressionTypeGZIP || c == compress.CompressionTypePGZIP
+	}
+	none := func(c compress.CompressionType) bool {
+		return c == "" || c == compress.CompressionTypeNone
+	}
+
+	return a == b || gz(a) && gz(b) || none(a) && none(b)
 }
 
 func (b *bcpDesc) String() string {
@@ -342,7 +382,7 @@ func describeBackup(cn *pbm.PBM, b *descBcp) (fmt.Stringer, error) {
 	}
 
 	var stg storage.Storage
-	if b.coll {
+	if b.coll || b.codec {
 		stg, err = cn.GetStorage(nil)
 		if err != nil {
 			return nil, errors.WithMessage(err, "get storage")
@@ -369,6 +409,7 @@ func describeBackup(cn *pbm.PBM, b *descBcp) (fmt.Stringer, error) {
 		Status:             bcp.Status,
 		Size:               bcp.Size,
 		HSize:              byteCountIEC(bcp.Size),
+		Compression:        bcp.Compression,
 	}
 	if bcp.Err != "" {
 		rv.Err = &bcp.Err
@@ -413,7 +454,18 @@ func describeBackup(cn *pbm.PBM, b *descBcp) (fmt.Stringer, error) {
 			rv.Replsets[i].Files = r.Files
 		}
 
-		if !b.coll || bcp.Type != pbm.LogicalBackup {
+		if bcp.Type != pbm.LogicalBackup {
+			continue
+		}
+
+		if b.codec && r.OplogName != "" {
+			rv.Replsets[i].OplogCompression, err = fileCodec(stg, r.OplogName, bcp.Compression)
+			if err != nil {
+				return nil, errors.WithMessage(err, "detect oplog compression")
+			}
+		}
+
+		if !b.coll {
 			continue
 		}
 
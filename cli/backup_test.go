@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"sort"
@@ -8,6 +9,8 @@ import (
 	"testing"
 
 	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/storage/fs"
 	"github.com/percona/percona-backup-mongodb/version"
 )
 
@@ -313,6 +316,79 @@ func TestBcpMatchRemappedCluster(t *testing.T) {
 	}
 }
 
+func TestDescribeBackupCompression(t *testing.T) {
+	stg, err := fs.New(fs.Conf{Path: t.TempDir()})
+	if err != nil {
+		t.Fatalf("create storage: %v", err)
+	}
+	save := func(name string, c compress.CompressionType) {
+		buf := &bytes.Buffer{}
+		w, err := compress.Compress(buf, c, nil)
+		if err != nil {
+			t.Fatalf("create %s writer: %v", c, err)
+		}
+		if _, err = w.Write([]byte("oplog")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		if err = stg.Save(name, buf, int64(buf.Len())); err != nil {
+			t.Fatalf("save %s: %v", name, err)
+		}
+	}
+
+	save("rs0.snappy", compress.CompressionTypeSNAPPY)
+	save("rs1.snappy", compress.CompressionTypeS2) // mislabeled by old versions
+	save("rs2.gz", compress.CompressionTypeGZIP)
+	save("rs3", compress.CompressionTypeNone)
+
+	cases := []struct {
+		file     string
+		declared compress.CompressionType
+		detected compress.CompressionType
+		mismatch bool
+	}{
+		{"rs0.snappy", compress.CompressionTypeSNAPPY, compress.CompressionTypeSNAPPY, false},
+		{"rs1.snappy", compress.CompressionTypeSNAPPY, compress.CompressionTypeS2, true},
+		{"rs2.gz", compress.CompressionTypeGZIP, compress.CompressionTypePGZIP, false},
+		{"rs3", compress.CompressionTypeNone, compress.CompressionTypeNone, false},
+	}
+	for _, c := range cases {
+		got, err := fileCodec(stg, c.file, c.declared)
+		if err != nil {
+			t.Fatalf("%s: %v", c.file, err)
+		}
+		want := bcpCodecDesc{Declared: c.declared, Detected: c.detected, Mismatch: c.mismatch}
+		if *got != want {
+			t.Errorf("%s: expected %+v, got %+v", c.file, want, *got)
+		}
+	}
+
+	if _, err = fileCodec(stg, "missing", compress.CompressionTypeS2); err == nil {
+		t.Errorf("expected error on missing file")
+	}
+
+	desc := &bcpDesc{
+		Name:        "bcp",
+		Compression: compress.CompressionTypeS2,
+		Replsets: []bcpReplDesc{{
+			Name: "rs1",
+			OplogCompression: &bcpCodecDesc{
+				Declared: compress.CompressionTypeSNAPPY,
+				Detected: compress.CompressionTypeS2,
+				Mismatch: true,
+			},
+		}},
+	}
+	out := desc.String()
+	for _, s := range []string{"compression: s2", "declared: snappy", "detected: s2", "mismatch: true"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected %q in the output:\n%s", s, out)
+		}
+	}
+}
+
 func checkBcpMatchClusterError(err, target error) string {
 	if err == nil && target == nil {
 		return ""
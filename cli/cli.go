@@ -130,10 +130,18 @@ func Main() {
 
 	cancelBcpCmd := pbmCmd.Command("cancel-backup", "Cancel backup")
 
+	abortRestoreCmd := pbmCmd.Command("abort-restore", "Abort running logical restore")
+	abortRestoreName := ""
+	abortRestoreCmd.Arg("name", "Restore name").
+		Required().
+		StringVar(&abortRestoreName)
+
 	descBcpCmd := pbmCmd.Command("describe-backup", "Describe backup")
 	descBcp := descBcp{}
 	descBcpCmd.Flag("with-collections", "Show collections in backup").
 		BoolVar(&descBcp.coll)
+	descBcpCmd.Flag("with-compression", "Detect compression of the oplog files by their content").
+		BoolVar(&descBcp.codec)
 	descBcpCmd.Arg("backup_name", "Backup name").
 		StringVar(&descBcp.name)
 
@@ -155,7 +163,9 @@ func Main() {
 	restore := restoreOpts{}
 	restoreCmd.Arg("backup_name", "Backup name to restore").
 		StringVar(&restore.bcp)
-	restoreCmd.Flag("time", fmt.Sprintf("Restore to the point-in-time. Set in format %s", datetimeFormat)).
+	restoreCmd.Flag("time",
+		fmt.Sprintf("Restore to the point-in-time. Set in format %s or `latest` for the latest recoverable time",
+			datetimeFormat)).
 		StringVar(&restore.pitr)
 	restoreCmd.Flag("base-snapshot",
 		"Override setting: Name of older snapshot that PITR will be based on during restore.").
@@ -177,21 +187,53 @@ func Main() {
 	restoreCmd.Flag(RSMappingFlag, RSMappingDoc).
 		Envar(RSMappingEnvVar).
 		StringVar(&restore.rsMap)
+	restoreCmd.Flag("replsets",
+		`Replsets to restore (e.g. "rs1,rs2"). Others are skipped. If not set, restore all`).
+		StringVar(&restore.replsets)
+	restoreCmd.Flag("skip-version-check",
+		"Replay the oplog even if the backup mongo version or FCV is incompatible with the running one").
+		BoolVar(&restore.skipVersionCheck)
+	restoreCmd.Flag("rerun", "Name of the finished restore to run again. The previous run is kept. Logical restore only").
+		StringVar(&restore.rerun)
+	restoreCmd.Flag("storage-config",
+		"Path to a PBM config file which storage to restore from instead of the configured one. "+
+			"The storage credentials have to be env:, file: or vault: secret references, "+
+			"they are resolved on the agents' hosts. Logical restore only").
+		StringVar(&restore.storageConf)
+	restoreCmd.Flag("index-build-concurrency",
+		"Num of collections to build indexes for at once. Overrides the config value. 1 builds them one by one").
+		IntVar(&restore.indexBuildConcurrency)
+	restoreCmd.Flag("allow-gaps",
+		"Replay the oplog chunks there are despite gaps between them. Ops in the gaps are LOST. Logical restore only").
+		BoolVar(&restore.allowGaps)
+	restoreCmd.Flag("stop-before",
+		"Oplog op to restore the point-in-time right before, the op itself isn't applied. "+
+			"In <T,I> or <T,I>:<hash> format, the hash is for MongoDB < 4.2 (e.g. 1682093090,9). Logical restore only").
+		StringVar(&restore.stopBefore)
 
 	replayCmd := pbmCmd.Command("oplog-replay", "Replay oplog")
 	replayOpts := replayOptions{}
 	replayCmd.Flag("start", fmt.Sprintf("Replay oplog from the time. Set in format %s", datetimeFormat)).
 		Required().
 		StringVar(&replayOpts.start)
-	replayCmd.Flag("end", "Replay oplog to the time. Set in format %s").
-		Required().
+	replayCmd.Flag("end",
+		fmt.Sprintf("Replay oplog to the time. Set in format %s. The latest recoverable time if not set", datetimeFormat)).
 		StringVar(&replayOpts.end)
 	replayCmd.Flag("wait", "Wait for the restore to finish.").
 		Short('w').
 		BoolVar(&replayOpts.wait)
+	replayCmd.Flag("force", "Replay even if the node's oplog is already past the start time").
+		BoolVar(&replayOpts.force)
+	replayCmd.Flag("rerun", "Name of the finished replay to run again. The previous run is kept").
+		StringVar(&replayOpts.rerun)
 	replayCmd.Flag(RSMappingFlag, RSMappingDoc).
 		Envar(RSMappingEnvVar).
 		StringVar(&replayOpts.rsMap)
+	replayCmd.Flag("rs-fan-in", "Allow several replsets mapped onto one. "+
+		"Their oplogs are merged by the cluster time and replayed on that replset").
+		BoolVar(&replayOpts.fanIn)
+	replayCmd.Flag("allow-gaps", "Replay the oplog chunks there are despite gaps between them. Ops in the gaps are LOST").
+		BoolVar(&replayOpts.allowGaps)
 	// todo(add oplog cancel)
 
 	listCmd := pbmCmd.Command("list", "Backup list")
@@ -313,6 +355,29 @@ func Main() {
 		Short('c').
 		StringVar(&describeRestoreOpts.cfg)
 
+	storageCmd := pbmCmd.Command("storage", "Storage operations")
+	storageCheckCmd := storageCmd.Command("check",
+		"Check the storage is reachable, writable and readable by a round trip of a tiny object. "+
+			"The check runs from the CLI host, not from the agents")
+
+	standaloneCmd := pbmCmd.Command("restore-standalone",
+		"Restore logical backup onto the standalone mongod of --mongodb-uri. It's run by the CLI, not agents")
+	standalone := standaloneOpts{}
+	standaloneCmd.Arg("backup_name", "Backup name to restore").
+		Required().
+		StringVar(&standalone.bcp)
+	standaloneCmd.Flag("config", "Path to PBM config with the storage of the backup").
+		Short('c').
+		Required().
+		StringVar(&standalone.cfg)
+	standaloneCmd.Flag("replset", "Replset of the backup to restore. Required for backups of sharded clusters").
+		StringVar(&standalone.rs)
+	standaloneCmd.Flag("ns", `Namespaces to restore (e.g. "db1.*,db2.collection2"). If not set, restore all ("*.*")`).
+		StringVar(&standalone.ns)
+	standaloneCmd.Flag("skip-version-check",
+		"Replay the oplog even if the backup mongo version or FCV is incompatible with the running one").
+		BoolVar(&standalone.skipVersionCheck)
+
 	cmd, err := pbmCmd.DefaultEnvars().Parse(os.Args[1:])
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error: parse command line parameters:", err)
@@ -347,9 +412,9 @@ func Main() {
 	defer cancel()
 
 	var pbmClient *pbm.PBM
-	// we don't need pbm connection if it is `pbm describe-restore -c ...`
-	// or `pbm restore-finish `
-	if describeRestoreOpts.cfg == "" && finishRestore.cfg == "" {
+	// we don't need pbm connection if it is `pbm describe-restore -c ...`,
+	// `pbm restore-finish ` or `pbm restore-standalone`
+	if describeRestoreOpts.cfg == "" && finishRestore.cfg == "" && cmd != standaloneCmd.FullCommand() {
 		pbmClient, err = pbm.New(ctx, *mURL, "pbm-ctl")
 		if err != nil {
 			exitErr(errors.Wrap(err, "connect to mongodb"), pbmOutF)
@@ -373,6 +438,8 @@ func Main() {
 		out, err = runBackup(pbmClient, &backup, pbmOutF)
 	case cancelBcpCmd.FullCommand():
 		out, err = cancelBcp(pbmClient)
+	case abortRestoreCmd.FullCommand():
+		out, err = abortRestore(pbmClient, abortRestoreName)
 	case backupFinishCmd.FullCommand():
 		out, err = runFinishBcp(pbmClient, finishBackupName)
 	case restoreFinishCmd.FullCommand():
@@ -397,6 +464,10 @@ func Main() {
 		out, err = status(pbmClient, *mURL, statusOpts, pbmOutF == outJSONpretty)
 	case describeRestoreCmd.FullCommand():
 		out, err = describeRestore(pbmClient, describeRestoreOpts)
+	case storageCheckCmd.FullCommand():
+		out, err = checkStorage(pbmClient)
+	case standaloneCmd.FullCommand():
+		out, err = restoreStandalone(ctx, *mURL, standalone)
 	}
 
 	if err != nil {
@@ -100,10 +100,13 @@ func runConfig(cn *pbm.PBM, c *configOpts) (fmt.Stringer, error) {
 			return nil, errors.Wrap(err, "unable to get current config")
 		}
 
-		err = cn.SetConfigByte(buf)
+		warnings, err := cn.SetConfigByte(buf)
 		if err != nil {
 			return nil, errors.Wrap(err, "unable to set config")
 		}
+		for _, w := range warnings {
+			fmt.Fprintf(os.Stderr, "WARNING: %s\n", w)
+		}
 
 		// provider value may differ as it set automatically after config parsing
 		cCfg.Storage.S3.Provider = cfg.Storage.S3.Provider
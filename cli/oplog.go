@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/percona/percona-backup-mongodb/pbm"
 )
@@ -14,7 +15,12 @@ type replayOptions struct {
 	start string
 	end   string
 	wait  bool
+	force bool
+	rerun string
 	rsMap string
+	fanIn bool
+
+	allowGaps bool
 }
 
 type oplogReplayResult struct {
@@ -42,14 +48,21 @@ func replayOplog(cn *pbm.PBM, o replayOptions, outf outFormat) (fmt.Stringer, er
 	if err != nil {
 		return nil, errors.WithMessage(err, "cannot parse replset mapping")
 	}
+	if o.fanIn && len(rsMap) == 0 {
+		return nil, errors.Errorf("--rs-fan-in requires --%s", RSMappingFlag)
+	}
 
 	startTS, err := parseTS(o.start)
 	if err != nil {
 		return nil, errors.Wrap(err, "parse start time")
 	}
-	endTS, err := parseTS(o.end)
-	if err != nil {
-		return nil, errors.Wrap(err, "parse end time")
+	// zero end is the latest recoverable time
+	var endTS primitive.Timestamp
+	if o.end != "" {
+		endTS, err = parseTS(o.end)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse end time")
+		}
 	}
 
 	err = checkConcurrentOp(cn)
@@ -58,6 +71,17 @@ func replayOplog(cn *pbm.PBM, o replayOptions, outf outFormat) (fmt.Stringer, er
 	}
 
 	name := time.Now().UTC().Format(time.RFC3339Nano)
+	getfn := cn.GetRestoreMeta
+	if o.rerun != "" {
+		prev, err := checkRerun(cn, o.rerun)
+		if err != nil {
+			return nil, err
+		}
+		name = o.rerun
+		getfn = skipRun(getfn, prev.OPID)
+	}
+	// for the audit only, so no user is fine
+	user, _ := cn.CurrentUser()
 	cmd := pbm.Cmd{
 		Cmd: pbm.CmdReplay,
 		Replay: &pbm.ReplayCmd{
@@ -65,6 +89,12 @@ func replayOplog(cn *pbm.PBM, o replayOptions, outf outFormat) (fmt.Stringer, er
 			Start: startTS,
 			End:   endTS,
 			RSMap: rsMap,
+			Force: o.force,
+			Rerun: o.rerun != "",
+			User:  user,
+			FanIn: o.fanIn,
+
+			AllowGaps: o.allowGaps,
 		},
 	}
 	if err := cn.SendCmd(cmd); err != nil {
@@ -75,12 +105,16 @@ func replayOplog(cn *pbm.PBM, o replayOptions, outf outFormat) (fmt.Stringer, er
 		return oplogReplayResult{Name: name}, nil
 	}
 
-	fmt.Printf("Starting oplog replay '%s - %s'", o.start, o.end)
+	end := o.end
+	if end == "" {
+		end = "latest"
+	}
+	fmt.Printf("Starting oplog replay '%s - %s'", o.start, end)
 
 	ctx, cancel := context.WithTimeout(context.Background(), pbm.WaitActionStart)
 	defer cancel()
 
-	m, err := waitForRestoreStatus(ctx, name, cn.GetRestoreMeta)
+	m, err := waitForRestoreStatus(ctx, name, getfn)
 	if err != nil {
 		return nil, err
 	}
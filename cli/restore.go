@@ -18,6 +18,7 @@ import (
 
 	"github.com/percona/percona-backup-mongodb/pbm"
 	"github.com/percona/percona-backup-mongodb/pbm/log"
+	prestore "github.com/percona/percona-backup-mongodb/pbm/restore"
 	"github.com/percona/percona-backup-mongodb/pbm/storage"
 )
 
@@ -29,8 +30,17 @@ type restoreOpts struct {
 	extern   bool
 	ns       string
 	rsMap    string
+	replsets string
 	conf     string
 	ts       string
+
+	skipVersionCheck bool
+	rerun            string
+	storageConf      string
+
+	indexBuildConcurrency int
+	allowGaps             bool
+	stopBefore            string
 }
 
 type restoreRet struct {
@@ -100,10 +110,29 @@ func runRestore(cn *pbm.PBM, o *restoreOpts, outf outFormat) (fmt.Stringer, erro
 		return nil, errors.WithMessage(err, "cannot parse replset mapping")
 	}
 
+	if o.stopBefore != "" {
+		if o.pitr != "" {
+			return nil, errors.New("either --time or --stop-before should be set, not both")
+		}
+		// the restore is to the point-in-time of the op
+		ts, _, err := parseStopBefore(o.stopBefore)
+		if err != nil {
+			return nil, errors.WithMessage(err, "parse --stop-before option")
+		}
+		o.pitr = fmt.Sprintf("%d,%d", ts.T, ts.I)
+	}
+
 	if o.pitr != "" && o.bcp != "" {
 		return nil, errors.New("either a backup name or point in time should be set, non both together!")
 	}
 
+	if o.pitr == pitrLatest {
+		o.pitr, err = latestPITR(cn, rsMap)
+		if err != nil {
+			return nil, errors.Wrap(err, "resolve the latest point-in-time")
+		}
+	}
+
 	clusterTime, err := cn.ClusterTime()
 	if err != nil {
 		return nil, errors.Wrap(err, "read cluster time")
@@ -232,7 +261,12 @@ func (e restoreFailedError) Is(err error) bool {
 	return ok
 }
 
-func checkBackup(cn *pbm.PBM, o *restoreOpts, nss []string) (string, pbm.BackupType, error) {
+func checkBackup(
+	cn *pbm.PBM,
+	o *restoreOpts,
+	nss []string,
+	stgConf *pbm.StorageConf,
+) (string, pbm.BackupType, error) {
 	if o.extern && o.bcp == "" {
 		return "", pbm.ExternalBackup, nil
 	}
@@ -244,7 +278,31 @@ func checkBackup(cn *pbm.PBM, o *restoreOpts, nss []string) (string, pbm.BackupT
 
 	var err error
 	var bcp *pbm.BackupMeta
-	if b != "" {
+	if stgConf != nil {
+		// the backup may be unknown to the cluster, so it's read from the storage
+		if b == "" {
+			return "", "", errors.New("backup name (or --base-snapshot) is required with --storage-config")
+		}
+		// fail before the agents are sent to the storage
+		rep := prestore.RestorePreflight(cn, b, prestore.PreflightOptions{Storage: stgConf})
+		if !rep.OK() {
+			return "", "", errors.Errorf("check the storage override from the CLI host:\n%s", rep)
+		}
+
+		var stg storage.Storage
+		l := log.New(nil, "cli", "").NewEvent("", "", "", primitive.Timestamp{})
+		stg, err = cn.GetStorageOverride(stgConf, l)
+		if err != nil {
+			return "", "", errors.Wrap(err, "get storage")
+		}
+		bcp, err = prestore.GetMetaFromStore(cn.Context(), stg, b)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "get backup '%s' from the storage", b)
+		}
+		if bcp.Type != pbm.LogicalBackup {
+			return "", "", errors.New("--storage-config is only allowed for logical restore")
+		}
+	} else if b != "" {
 		bcp, err = cn.GetBackupMeta(b)
 		if errors.Is(err, pbm.ErrNotFound) {
 			return "", "", errors.Errorf("backup '%s' not found", b)
@@ -281,7 +339,21 @@ func restore(
 	rsMapping map[string]string,
 	outf outFormat,
 ) (*pbm.RestoreMeta, error) {
-	bcp, bcpType, err := checkBackup(cn, o, nss)
+	var stgConf *pbm.StorageConf
+	if o.storageConf != "" {
+		var err error
+		stgConf, err = pbm.ReadStorageConf(o.storageConf)
+		if err != nil {
+			return nil, err
+		}
+		// the conf is sent to the agents along with the command
+		err = pbm.CheckStorageSecretRefs(stgConf)
+		if err != nil {
+			return nil, errors.Wrap(err, "storage config")
+		}
+	}
+
+	bcp, bcpType, err := checkBackup(cn, o, nss, stgConf)
 	if err != nil {
 		return nil, err
 	}
@@ -291,6 +363,19 @@ func restore(
 	}
 
 	name := time.Now().UTC().Format(time.RFC3339Nano)
+	var prev *pbm.RestoreMeta
+	if o.rerun != "" {
+		if bcpType != pbm.LogicalBackup {
+			return nil, errors.New("--rerun flag is only allowed for logical restore")
+		}
+		prev, err = checkRerun(cn, o.rerun)
+		if err != nil {
+			return nil, err
+		}
+		name = o.rerun
+	}
+	// for the audit only, so no user is fine
+	user, _ := cn.CurrentUser()
 
 	cmd := pbm.Cmd{
 		Cmd: pbm.CmdRestore,
@@ -300,14 +385,54 @@ func restore(
 			Namespaces: nss,
 			RSMap:      rsMapping,
 			External:   o.extern,
+
+			SkipVersionCheck: o.skipVersionCheck,
+			Rerun:            o.rerun != "",
+			Storage:          stgConf,
+
+			IndexBuildConcurrency: o.indexBuildConcurrency,
+			AllowGaps:             o.allowGaps,
+
+			User: user,
 		},
 	}
+	if o.allowGaps && bcpType != pbm.LogicalBackup {
+		return nil, errors.New("--allow-gaps flag is only allowed for logical restore")
+	}
+	if o.replsets != "" {
+		if bcpType != pbm.LogicalBackup {
+			return nil, errors.New("--replsets flag is only allowed for logical restore")
+		}
+		for _, rs := range strings.Split(o.replsets, ",") {
+			if rs = strings.TrimSpace(rs); rs != "" {
+				cmd.Restore.Replsets = append(cmd.Restore.Replsets, rs)
+			}
+		}
+	}
+	if o.indexBuildConcurrency != 0 {
+		if bcpType != pbm.LogicalBackup {
+			return nil, errors.New("--index-build-concurrency flag is only allowed for logical restore")
+		}
+		if o.indexBuildConcurrency < 0 {
+			return nil, errors.New("--index-build-concurrency should be positive")
+		}
+	}
 	if o.pitr != "" {
 		cmd.Restore.OplogTS, err = parseTS(o.pitr)
 		if err != nil {
 			return nil, err
 		}
 	}
+	if o.stopBefore != "" {
+		if bcpType != pbm.LogicalBackup {
+			return nil, errors.New("--stop-before flag is only allowed for logical restore")
+		}
+		cmd.Restore.OplogStopBefore = true
+		_, cmd.Restore.OplogStopHash, err = parseStopBefore(o.stopBefore)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	if o.ts != "" {
 		cmd.Restore.ExtTS, err = parseTS(o.ts)
@@ -367,6 +492,9 @@ func restore(
 	const waitPhysRestoreStart = time.Second * 120
 	if bcpType == pbm.LogicalBackup {
 		fn = cn.GetRestoreMeta
+		if prev != nil {
+			fn = skipRun(fn, prev.OPID)
+		}
 		ctx, cancel = context.WithTimeout(context.Background(), pbm.WaitActionStart)
 	} else {
 		ep, _ := cn.GetEpoch()
@@ -399,6 +527,31 @@ func runFinishRestore(o descrRestoreOpts) (fmt.Stringer, error) {
 			)), -1)
 }
 
+// pitrLatest is the --time value to restore to the latest recoverable time
+const pitrLatest = "latest"
+
+// latestPITR returns the latest time the oplog of all shards is recoverable
+// up to in the "T,I" format. So all shards are restored to the same point.
+func latestPITR(cn *pbm.PBM, rsMapping map[string]string) (string, error) {
+	shards, err := cn.ClusterMembers()
+	if err != nil {
+		return "", errors.Wrap(err, "get cluster members")
+	}
+
+	mapRS := pbm.MakeReverseRSMapFunc(rsMapping)
+	rss := make([]string, len(shards))
+	for i, s := range shards {
+		rss[i] = mapRS(s.RS)
+	}
+
+	ts, err := cn.PITRLatestTS(rss)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d,%d", ts.T, ts.I), nil
+}
+
 func parseTS(t string) (primitive.Timestamp, error) {
 	var ts primitive.Timestamp
 	if si := strings.SplitN(t, ",", 2); len(si) == 2 {
@@ -422,8 +575,63 @@ func parseTS(t string) (primitive.Timestamp, error) {
 	return primitive.Timestamp{T: uint32(tsto.Unix()), I: 0}, nil
 }
 
+// parseStopBefore parses the op to stop the restore before
+// in <T,I> or <T,I>:<hash> format
+func parseStopBefore(s string) (primitive.Timestamp, *int64, error) {
+	t, h, hasHash := strings.Cut(s, ":")
+	if !strings.Contains(t, ",") {
+		return primitive.Timestamp{}, nil, errors.Errorf("invalid op %q, expected <T,I> or <T,I>:<hash>", s)
+	}
+
+	ts, err := parseTS(t)
+	if err != nil {
+		return primitive.Timestamp{}, nil, err
+	}
+	if !hasHash {
+		return ts, nil, nil
+	}
+
+	hash, err := strconv.ParseInt(h, 10, 64)
+	if err != nil {
+		return primitive.Timestamp{}, nil, errors.Wrap(err, "parse op hash")
+	}
+
+	return ts, &hash, nil
+}
+
 type getRestoreMetaFn func(name string) (*pbm.RestoreMeta, error)
 
+// checkRerun checks the restore `name` can be run again and returns it
+func checkRerun(cn *pbm.PBM, name string) (*pbm.RestoreMeta, error) {
+	meta, err := cn.GetRestoreMeta(name)
+	if errors.Is(err, pbm.ErrNotFound) {
+		return nil, errors.Errorf("no restore %q to run again", name)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "get restore meta")
+	}
+	if meta.Type != pbm.LogicalBackup {
+		return nil, errors.Errorf("restore %q is %s, only logical restores can be run again", name, meta.Type)
+	}
+	if meta.Status != pbm.StatusDone && meta.Status != pbm.StatusError {
+		return nil, errors.Errorf("restore %q is %s, only finished restores can be run again", name, meta.Status)
+	}
+
+	return meta, nil
+}
+
+// skipRun makes getfn return pbm.ErrNotFound for the run `opid`, so the
+// previous run of the rerun restore isn't taken for the new one
+func skipRun(getfn getRestoreMetaFn, opid string) getRestoreMetaFn {
+	return func(name string) (*pbm.RestoreMeta, error) {
+		meta, err := getfn(name)
+		if err == nil && meta.OPID == opid {
+			return nil, pbm.ErrNotFound
+		}
+		return meta, err
+	}
+}
+
 func waitForRestoreStatus(ctx context.Context, name string, getfn getRestoreMetaFn) (*pbm.RestoreMeta, error) {
 	tk := time.NewTicker(time.Second * 1)
 	defer tk.Stop()
@@ -477,6 +685,18 @@ func waitForRestoreStatus(ctx context.Context, name string, getfn getRestoreMeta
 	}
 }
 
+func abortRestore(cn *pbm.PBM, name string) (fmt.Stringer, error) {
+	err := cn.AbortRestore(name)
+	if err != nil {
+		if errors.Is(err, pbm.ErrNotFound) {
+			return nil, errors.Errorf("no running restore %q found", name)
+		}
+		return nil, errors.Wrap(err, "abort restore")
+	}
+
+	return outMsg{"Restore abort has been requested"}, nil
+}
+
 type descrRestoreOpts struct {
 	restore string
 	cfg     string
@@ -497,17 +717,28 @@ type describeRestoreResult struct {
 	LastTransitionTS   int64            `json:"last_transition_ts" yaml:"-"`
 	LastTransitionTime string           `json:"last_transition_time" yaml:"last_transition_time"`
 	Replsets           []RestoreReplset `json:"replsets" yaml:"replsets"`
+	Warning            *string          `json:"warning,omitempty" yaml:"warning,omitempty"`
 }
 
 type RestoreReplset struct {
 	Name               string        `json:"name" yaml:"name"`
 	Status             pbm.Status    `json:"status" yaml:"status"`
+	Node               string        `json:"node,omitempty" yaml:"node,omitempty"`
 	PartialTxn         []db.Oplog    `json:"partial_txn,omitempty" yaml:"-"`
 	PartialTxnStr      *string       `json:"-" yaml:"partial_txn,omitempty"`
 	LastTransitionTS   int64         `json:"last_transition_ts" yaml:"-"`
 	LastTransitionTime string        `json:"last_transition_time" yaml:"last_transition_time"`
+	ETA                *string       `json:"eta,omitempty" yaml:"eta,omitempty"`
+	Progress           *string       `json:"progress,omitempty" yaml:"progress,omitempty"`
 	Nodes              []RestoreNode `json:"nodes,omitempty" yaml:"nodes,omitempty"`
 	Error              *string       `json:"error,omitempty" yaml:"error,omitempty"`
+
+	// SkippedGaps are oplog gaps the restore went past, see --allow-gaps
+	SkippedGaps []pbm.OplogGap `json:"skipped_gaps,omitempty" yaml:"skipped_gaps,omitempty"`
+	// Oplog is the replayed oplog range and ops and DistTxn are leftovers
+	// of distributed transactions, see pbm.RestoreSummary
+	Oplog   *string `json:"oplog,omitempty" yaml:"oplog,omitempty"`
+	DistTxn *string `json:"dist_txn,omitempty" yaml:"dist_txn,omitempty"`
 }
 
 type RestoreNode struct {
@@ -528,19 +759,28 @@ func (r describeRestoreResult) String() string {
 }
 
 func getRestoreMetaStg(cfgPath string) (storage.Storage, error) {
+	cfg, err := readConfigFile(cfgPath)
+	if err != nil {
+		return nil, err
+	}
+
+	l := log.New(nil, "cli", "").NewEvent("", "", "", primitive.Timestamp{})
+	return pbm.Storage(cfg, l)
+}
+
+func readConfigFile(cfgPath string) (pbm.Config, error) {
 	buf, err := os.ReadFile(cfgPath)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to read config file")
+		return pbm.Config{}, errors.Wrap(err, "unable to read config file")
 	}
 
 	var cfg pbm.Config
 	err = yaml.UnmarshalStrict(buf, &cfg)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to  unmarshal config file")
+		return pbm.Config{}, errors.Wrap(err, "unable to  unmarshal config file")
 	}
 
-	l := log.New(nil, "cli", "").NewEvent("", "", "", primitive.Timestamp{})
-	return pbm.Storage(cfg, l)
+	return cfg, nil
 }
 
 func describeRestore(cn *pbm.PBM, o descrRestoreOpts) (fmt.Stringer, error) {
@@ -592,14 +832,41 @@ func describeRestore(cn *pbm.PBM, o descrRestoreOpts) (fmt.Stringer, error) {
 		res.PITRTime = &s
 	}
 
-	for _, rs := range meta.Replsets {
+	// there is no cluster to resolve the range by when
+	// the meta is read from the storage
+	var sum *pbm.RestoreSummary
+	if o.cfg == "" {
+		sum, err = cn.SummarizeRestore(meta)
+		if err != nil {
+			return nil, errors.Wrap(err, "summarize restore")
+		}
+		if sum.Warning != "" {
+			res.Warning = &sum.Warning
+		}
+	}
+
+	for i, rs := range meta.Replsets {
 		mrs := RestoreReplset{
 			Name:               rs.Name,
 			Status:             rs.Status,
+			Node:               rs.Node,
+			SkippedGaps:        rs.SkippedGaps,
 			LastTransitionTS:   rs.LastTransitionTS,
 			PartialTxn:         rs.PartialTxn,
 			LastTransitionTime: time.Unix(rs.LastTransitionTS, 0).UTC().Format(time.RFC3339),
 		}
+		if rs.ETA != 0 && (rs.Status == pbm.StatusRunning || rs.Status == pbm.StatusDumpDone) {
+			eta := time.Unix(rs.ETA, 0).UTC().Format(time.RFC3339)
+			mrs.ETA = &eta
+		}
+		if p := rs.Progress; p != nil && p.Chunks > 0 {
+			prg := fmt.Sprintf("%d/%d chunks, %d ops applied, %d filtered",
+				p.Chunk, p.Chunks, p.Ops.Applied, p.Ops.Filtered)
+			mrs.Progress = &prg
+		}
+		if sum != nil {
+			mrs.Oplog, mrs.DistTxn = describeRSSummary(sum.Replsets[i])
+		}
 		if rs.Status == pbm.StatusError {
 			mrs.Error = &rs.Error
 		} else if len(mrs.PartialTxn) > 0 {
@@ -640,3 +907,21 @@ func describeRestore(cn *pbm.PBM, o descrRestoreOpts) (fmt.Stringer, error) {
 
 	return res, nil
 }
+
+// describeRSSummary returns the replayed oplog and dist txns leftovers
+// of the replset. Nil if there are none.
+func describeRSSummary(s pbm.RestoreRSSummary) (*string, *string) {
+	var oplog, txn *string
+	if !s.To.IsZero() {
+		o := fmt.Sprintf("%d.%d - %d.%d, %d ops applied, %d filtered",
+			s.From.T, s.From.I, s.To.T, s.To.I, s.Ops.Applied, s.Ops.Filtered)
+		oplog = &o
+	}
+	if s.Txn != (pbm.RestoreTxnSummary{}) {
+		t := fmt.Sprintf("%d uncommitted on the shard, %d left uncommitted, %d partial, %d split",
+			s.Txn.ShardUncommitted, s.Txn.LeftUncommitted, s.Txn.Partial, s.Txn.Split)
+		txn = &t
+	}
+
+	return oplog, txn
+}
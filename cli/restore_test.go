@@ -0,0 +1,42 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+func TestSkipRun(t *testing.T) {
+	meta := &pbm.RestoreMeta{Name: "r1", OPID: "op1", Status: pbm.StatusDone}
+	get := skipRun(func(string) (*pbm.RestoreMeta, error) { return meta, nil }, "op1")
+
+	if _, err := get("r1"); !errors.Is(err, pbm.ErrNotFound) {
+		t.Errorf("expected the previous run skipped, got %v", err)
+	}
+
+	meta = &pbm.RestoreMeta{Name: "r1", OPID: "op2", Status: pbm.StatusRunning}
+	if got, err := get("r1"); err != nil || got != meta {
+		t.Errorf("expected the new run, got %v, %v", got, err)
+	}
+}
+
+func TestParseStopBefore(t *testing.T) {
+	ts, hash, err := parseStopBefore("1682093090,9")
+	if err != nil || ts != (primitive.Timestamp{T: 1682093090, I: 9}) || hash != nil {
+		t.Errorf("unexpected op %v, %v, %v", ts, hash, err)
+	}
+
+	ts, hash, err = parseStopBefore("1682093090,9:-42")
+	if err != nil || ts != (primitive.Timestamp{T: 1682093090, I: 9}) || hash == nil || *hash != -42 {
+		t.Errorf("unexpected op with hash %v, %v, %v", ts, hash, err)
+	}
+
+	for _, s := range []string{"2023-04-21T16:04:50", "1682093090,9:h", "1682093090"} {
+		if _, _, err = parseStopBefore(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
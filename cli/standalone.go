@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+	prestore "github.com/percona/percona-backup-mongodb/pbm/restore"
+)
+
+type standaloneOpts struct {
+	bcp              string
+	cfg              string
+	rs               string
+	ns               string
+	skipVersionCheck bool
+}
+
+// restoreStandalone restores the backup onto the standalone mongod of the
+// connection URI. There are no agents there, so the CLI runs the restore.
+func restoreStandalone(ctx context.Context, curi string, o standaloneOpts) (fmt.Stringer, error) {
+	nss, err := parseCLINSOption(o.ns)
+	if err != nil {
+		return nil, errors.WithMessage(err, "parse --ns option")
+	}
+
+	cfg, err := readConfigFile(o.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	l := log.New(nil, "", "").NewEvent(string(pbm.CmdRestore), o.bcp, "", primitive.Timestamp{})
+	stg, err := pbm.Storage(cfg, l)
+	if err != nil {
+		return nil, errors.Wrap(err, "get storage")
+	}
+	bcp, err := prestore.GetMetaFromStore(ctx, stg, o.bcp)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get backup '%s' from the storage", o.bcp)
+	}
+
+	node, err := pbm.NewNode(ctx, curi, 1)
+	if err != nil {
+		return nil, errors.Wrap(err, "connect to mongod")
+	}
+	defer node.Session().Disconnect(context.Background()) //nolint:errcheck
+
+	err = prestore.RestoreStandalone(ctx, node, cfg, bcp, prestore.StandaloneOptions{
+		Replset:          o.rs,
+		Namespaces:       nss,
+		SkipVersionCheck: o.skipVersionCheck,
+	}, l)
+	if err != nil {
+		return nil, err
+	}
+
+	return outMsg{fmt.Sprintf("Backup %q is restored onto the standalone", o.bcp)}, nil
+}
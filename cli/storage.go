@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+)
+
+type storageCheckResult struct {
+	Type      storage.Type `json:"type"`
+	Path      string       `json:"path"`
+	Object    string       `json:"object,omitempty"`
+	WriteMs   int64        `json:"writeMs"`
+	ReadMs    int64        `json:"readMs"`
+	DeleteMs  int64        `json:"deleteMs"`
+	LatencyMs int64        `json:"latencyMs"`
+	Err       string       `json:"error,omitempty"`
+	// CheckedFrom is the host the check was run from. It's the CLI one,
+	// not the agents' hosts that actually use the storage.
+	CheckedFrom string `json:"checkedFrom"`
+}
+
+func (r storageCheckResult) HasError() bool {
+	return r.Err != ""
+}
+
+func (r storageCheckResult) String() string {
+	s := fmt.Sprintf("Storage %s %s\n", r.Type, r.Path)
+	if r.Err != "" {
+		s += "  FAILED: " + r.Err
+	} else {
+		s += fmt.Sprintf("  OK: write %dms, read %dms, delete %dms, total %dms",
+			r.WriteMs, r.ReadMs, r.DeleteMs, r.LatencyMs)
+	}
+
+	return s + fmt.Sprintf("\nChecked from the CLI host %s. Agents may reach the storage differently "+
+		"(network, IAM role, mounts)", r.CheckedFrom)
+}
+
+// checkStorage makes a round trip of a probe object to the configured storage.
+// It's run from the CLI host, not from the agents.
+func checkStorage(cn *pbm.PBM) (fmt.Stringer, error) {
+	cfg, err := cn.GetConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "get config")
+	}
+	stg, err := cn.GetStorage(cn.Logger().NewEvent("", "", "", primitive.Timestamp{}))
+	if err != nil {
+		return nil, errors.Wrap(err, "get storage")
+	}
+
+	hc, err := storage.HealthCheck(stg)
+	r := storageCheckResult{
+		Type:      cfg.Storage.Type,
+		Path:      cfg.Storage.Path(),
+		Object:    hc.Object,
+		WriteMs:   hc.Write.Milliseconds(),
+		ReadMs:    hc.Read.Milliseconds(),
+		DeleteMs:  hc.Delete.Milliseconds(),
+		LatencyMs: hc.Latency().Milliseconds(),
+	}
+	r.CheckedFrom, _ = os.Hostname()
+	if err != nil {
+		r.Err = err.Error()
+	}
+
+	return r, nil
+}
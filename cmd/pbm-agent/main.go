@@ -37,6 +37,10 @@ func main() {
 				Envar("PBM_DUMP_PARALLEL_COLLECTIONS").
 				Default(strconv.Itoa(runtime.NumCPU() / 2)).
 				Int()
+		traceOut = pbmAgentCmd.Flag("trace-output",
+			"Export tracing spans as JSON lines to the file, stdout or stderr. Tracing is off if not set").
+			Envar("PBM_TRACE_OUTPUT").
+			String()
 
 		versionCmd   = pbmCmd.Command("version", "PBM version info")
 		versionShort = versionCmd.Flag("short", "Only version info").
@@ -73,20 +77,30 @@ func main() {
 
 	hidecreds()
 
-	err = runAgent(url, *dumpConns)
+	err = runAgent(url, *dumpConns, *traceOut)
 	log.Println("Exit:", err)
 	if err != nil {
 		os.Exit(1)
 	}
 }
 
-func runAgent(mongoURI string, dumpConns int) error {
+func runAgent(mongoURI string, dumpConns int, traceOut string) error {
 	mlog.SetDateFormat(plog.LogTimeFormat)
 	mlog.SetVerbosity(&options.Verbosity{VLevel: mlog.DebugLow})
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	stopTracing, err := agent.SetupTracing(traceOut)
+	if err != nil {
+		return errors.Wrap(err, "setup tracing")
+	}
+	defer func() {
+		if err := stopTracing(context.Background()); err != nil {
+			log.Println("Stop tracing:", err)
+		}
+	}()
+
 	pbmClient, err := pbm.New(ctx, mongoURI, "pbm-agent")
 	if err != nil {
 		return errors.Wrap(err, "connect to PBM")
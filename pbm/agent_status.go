@@ -22,6 +22,7 @@ type AgentStat struct {
 	Hidden        bool                `bson:"hdn"`
 	Passive       bool                `bson:"psv"`
 	Arbiter       bool                `bson:"arb"`
+	Region        string              `bson:"rg,omitempty"`
 	AgentVer      string              `bson:"v"`
 	MongoVer      string              `bson:"mv"`
 	PerconaVer    string              `bson:"pv,omitempty"`
@@ -30,6 +31,9 @@ type AgentStat struct {
 	StorageStatus SubsysStatus        `bson:"stors"`
 	Heartbeat     primitive.Timestamp `bson:"hb"`
 	Err           string              `bson:"e"`
+
+	// Busy is the operation the node holds the lock of. Empty if idle.
+	Busy Command `bson:"busy,omitempty"`
 }
 
 type SubsysStatus struct {
@@ -81,12 +81,23 @@ func Decompose(r io.Reader, newWriter NewWriter, nsFilter NSFilterFn, docFilter
 	return errors.WithMessage(err, "metadata")
 }
 
-func Compose(w io.Writer, nsFilter NSFilterFn, newReader NewReader) error {
+// Compose writes the archive of the selected namespaces into w. Up to
+// concurrency namespaces are written at once and the archive header is
+// set to it so the restore consumes them with the same num of workers.
+// Zero or less keeps the concurrency the archive was made with.
+func Compose(w io.Writer, nsFilter NSFilterFn, newReader NewReader, concurrency int) error {
 	meta, err := readMetadata(newReader)
 	if err != nil {
 		return errors.WithMessage(err, "metadata")
 	}
 
+	if concurrency > 0 {
+		meta.Header.ConcurrentCollections = int32(concurrency)
+	}
+	if meta.Header.ConcurrentCollections < 1 {
+		meta.Header.ConcurrentCollections = 1
+	}
+
 	nss := make([]*Namespace, 0, len(meta.Namespaces))
 	for _, ns := range meta.Namespaces {
 		if nsFilter(NSify(ns.Database, ns.Collection)) {
@@ -0,0 +1,171 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mongodb/mongo-tools/common/archive"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type memFiles struct {
+	mu sync.Mutex
+	m  map[string]*bytes.Buffer
+}
+
+func (f *memFiles) writer(ns string) (io.WriteCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b := &bytes.Buffer{}
+	f.m[ns] = b
+	return nopWriteCloser{b}, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// countingReader tracks the num of namespaces being read at once
+type countingReader struct {
+	io.Reader
+	curr *int32
+	once sync.Once
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	// give other namespaces a chance to be opened concurrently
+	time.Sleep(time.Millisecond)
+	return r.Reader.Read(p)
+}
+
+func (r *countingReader) Close() error {
+	r.once.Do(func() { atomic.AddInt32(r.curr, -1) })
+	return nil
+}
+
+func testFiles(t *testing.T, colls, docs int) map[string][]byte {
+	t.Helper()
+
+	files := make(map[string][]byte)
+	meta := &archiveMeta{Header: &archive.Header{ConcurrentCollections: 1}}
+	for i := 0; i < colls; i++ {
+		coll := fmt.Sprintf("c%d", i)
+
+		data := []byte{}
+		for j := 0; j < docs; j++ {
+			d, err := bson.Marshal(bson.D{{"_id", j}, {"coll", coll}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = append(data, d...)
+		}
+
+		files[NSify("db", coll)] = data
+		meta.Namespaces = append(meta.Namespaces, &Namespace{
+			CollectionMetadata: &archive.CollectionMetadata{Database: "db", Collection: coll},
+			Size:               int64(len(data)),
+		})
+	}
+
+	m, err := bson.MarshalExtJSON(meta, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files[MetaFile] = m
+
+	return files
+}
+
+func compose(t *testing.T, files map[string][]byte, concurrency int) ([]byte, int32) {
+	t.Helper()
+
+	var curr, max int32
+	newReader := func(ns string) (io.ReadCloser, error) {
+		if ns == MetaFile {
+			return io.NopCloser(bytes.NewReader(files[ns])), nil
+		}
+
+		n := atomic.AddInt32(&curr, 1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+
+		return &countingReader{Reader: bytes.NewReader(files[ns]), curr: &curr}, nil
+	}
+
+	buf := &bytes.Buffer{}
+	err := Compose(buf, DefaultNSFilter, newReader, concurrency)
+	if err != nil {
+		t.Fatalf("compose: %v", err)
+	}
+
+	return buf.Bytes(), atomic.LoadInt32(&max)
+}
+
+func TestComposeConcurrency(t *testing.T) {
+	files := testFiles(t, 8, 10)
+
+	serial, maxSerial := compose(t, files, 1)
+	if maxSerial != 1 {
+		t.Errorf("serial: expected 1 namespace at once, got %d", maxSerial)
+	}
+
+	parallel, maxParallel := compose(t, files, 3)
+	if maxParallel > 3 {
+		t.Errorf("parallel: expected up to 3 namespaces at once, got %d", maxParallel)
+	}
+
+	prelude := archive.Prelude{}
+	err := prelude.Read(bytes.NewReader(parallel))
+	if err != nil {
+		t.Fatalf("read prelude: %v", err)
+	}
+	if prelude.Header.ConcurrentCollections != 3 {
+		t.Errorf("expected archive concurrency 3, got %d", prelude.Header.ConcurrentCollections)
+	}
+
+	decompose := func(a []byte) map[string]*bytes.Buffer {
+		f := &memFiles{m: make(map[string]*bytes.Buffer)}
+		err := Decompose(bytes.NewReader(a), f.writer, nil, nil)
+		if err != nil {
+			t.Fatalf("decompose: %v", err)
+		}
+		return f.m
+	}
+
+	s, p := decompose(serial), decompose(parallel)
+	for ns, data := range files {
+		if ns == MetaFile {
+			continue
+		}
+		if !bytes.Equal(s[ns].Bytes(), data) {
+			t.Errorf("serial: %s differs from the source", ns)
+		}
+		if !bytes.Equal(p[ns].Bytes(), s[ns].Bytes()) {
+			t.Errorf("parallel: %s differs from serial", ns)
+		}
+	}
+}
+
+func TestComposeArchiveConcurrency(t *testing.T) {
+	files := testFiles(t, 2, 1)
+
+	a, _ := compose(t, files, 0)
+	prelude := archive.Prelude{}
+	err := prelude.Read(bytes.NewReader(a))
+	if err != nil {
+		t.Fatalf("read prelude: %v", err)
+	}
+	if prelude.Header.ConcurrentCollections != 1 {
+		t.Errorf("expected the archive's own concurrency 1, got %d", prelude.Header.ConcurrentCollections)
+	}
+}
@@ -3,13 +3,13 @@ package backup
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"io"
 	"time"
 
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/percona/percona-backup-mongodb/pbm"
 	"github.com/percona/percona-backup-mongodb/pbm/compress"
@@ -24,6 +24,8 @@ type Backup struct {
 	typ      pbm.BackupType
 	incrBase bool
 	timeouts *pbm.BackupTimeouts
+	// metaCompression is the compression of the metadata file on the storage
+	metaCompression compress.CompressionType
 }
 
 func New(cn *pbm.PBM, node *pbm.Node) *Backup {
@@ -63,6 +65,12 @@ func (b *Backup) SetTimeouts(t *pbm.BackupTimeouts) {
 	b.timeouts = t
 }
 
+// SetMetaCompression sets the compression of the metadata file
+// saved on the storage. The file is plain JSON by default.
+func (b *Backup) SetMetaCompression(c compress.CompressionType) {
+	b.metaCompression = c
+}
+
 func (b *Backup) Init(
 	bcp *pbm.BackupCmd,
 	opid pbm.OPID,
@@ -76,15 +84,16 @@ func (b *Backup) Init(
 	}
 
 	meta := &pbm.BackupMeta{
-		Type:        b.typ,
-		OPID:        opid.String(),
-		Name:        bcp.Name,
-		Namespaces:  bcp.Namespaces,
-		Compression: bcp.Compression,
-		Store:       store,
-		StartTS:     time.Now().Unix(),
-		Status:      pbm.StatusStarting,
-		Replsets:    []pbm.BackupReplset{},
+		SchemaVersion: pbm.BackupMetaSchemaVersion,
+		Type:          b.typ,
+		OPID:          opid.String(),
+		Name:          bcp.Name,
+		Namespaces:    bcp.Namespaces,
+		Compression:   bcp.Compression,
+		Store:         store,
+		StartTS:       time.Now().Unix(),
+		Status:        pbm.StatusStarting,
+		Replsets:      []pbm.BackupReplset{},
 		// the driver (mongo?) sets TS to the current wall clock if TS was 0, so have to init with 1
 		LastWriteTS: primitive.Timestamp{T: 1, I: 1},
 		// the driver (mongo?) sets TS to the current wall clock if TS was 0, so have to init with 1
@@ -293,7 +302,7 @@ func (b *Backup) Run(ctx context.Context, bcp *pbm.BackupCmd, opid pbm.OPID, l *
 			return errors.Wrap(err, "get backup metadata")
 		}
 
-		err = writeMeta(stg, bcpm)
+		err = writeMeta(stg, bcpm, b.metaCompression)
 		if err != nil {
 			return errors.Wrap(err, "dump metadata")
 		}
@@ -418,11 +427,46 @@ func Upload(
 	fname string,
 	sizeb int64,
 ) (int64, error) {
-	r, pw := io.Pipe()
+	n, _, err := UploadWithChecksum(ctx, src, dst, compression, compressLevel, fname, sizeb)
+	return n, err
+}
 
-	w, err := compress.Compress(pw, compression, compressLevel)
+// UploadWithChecksum is Upload that also returns the checksum of the stored
+// (compressed) file
+func UploadWithChecksum(
+	ctx context.Context,
+	src Source,
+	dst storage.Storage,
+	compression compress.CompressionType,
+	compressLevel *int,
+	fname string,
+	sizeb int64,
+) (int64, string, error) {
+	return UploadWithDict(ctx, src, dst, compression, compressLevel, nil, fname, sizeb)
+}
+
+// UploadWithDict is UploadWithChecksum that compresses with the zstd
+// dictionary (see compress.CompressWithDict)
+func UploadWithDict(
+	ctx context.Context,
+	src Source,
+	dst storage.Storage,
+	compression compress.CompressionType,
+	compressLevel *int,
+	dict []byte,
+	fname string,
+	sizeb int64,
+) (int64, string, error) {
+	pr, pw := io.Pipe()
+	h := storage.NewChecksum()
+	r := struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(pr, h), pr}
+
+	w, err := compress.CompressWithDict(pw, compression, compressLevel, dict)
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 
 	var rwErr rwError
@@ -447,19 +491,19 @@ func Upload(
 
 		err := r.Close()
 		if err != nil {
-			return 0, errors.Wrap(err, "cancel backup: close reader")
+			return 0, "", errors.Wrap(err, "cancel backup: close reader")
 		}
-		return 0, ErrCancelled
+		return 0, "", ErrCancelled
 	case <-saveDone:
 	}
 
 	r.Close()
 
 	if !rwErr.nil() {
-		return 0, rwErr
+		return 0, "", rwErr
 	}
 
-	return n, nil
+	return n, storage.FormatChecksum(h), nil
 }
 
 func (b *Backup) toState(status pbm.Status, bcp, opid string, inf *pbm.NodeInfo, wait *time.Duration) error {
@@ -555,8 +599,10 @@ func (b *Backup) convergeClusterWithTimeout(
 	}
 }
 
+// convergeWorkers is the max number of shards locks read concurrently
+const convergeWorkers = 16
+
 func (b *Backup) converged(bcpName, opid string, shards []pbm.Shard, status pbm.Status) (bool, error) {
-	shardsToFinish := len(shards)
 	bmeta, err := b.cn.GetBackupMeta(bcpName)
 	if err != nil {
 		return false, errors.Wrap(err, "get backup metadata")
@@ -567,49 +613,109 @@ func (b *Backup) converged(bcpName, opid string, shards []pbm.Shard, status pbm.
 		return false, errors.Wrap(err, "read cluster time")
 	}
 
-	for _, sh := range shards {
-		for _, shard := range bmeta.Replsets {
-			if shard.Name == sh.RS {
-				// check if node alive
-				lock, err := b.cn.GetLockData(&pbm.LockHeader{
-					Type:    pbm.CmdBackup,
-					OPID:    opid,
-					Replset: shard.Name,
-				})
-
-				// nodes are cleaning its locks moving to the done status
-				// so no lock is ok and no need to ckech the heartbeats
-				if status != pbm.StatusDone && !errors.Is(err, mongo.ErrNoDocuments) {
-					if err != nil {
-						return false, errors.Wrapf(err, "unable to read lock for shard %s", shard.Name)
-					}
-					if lock.Heartbeat.T+pbm.StaleFrameSec < clusterTime.T {
-						return false, errors.Errorf("lost shard %s, last beat ts: %d", shard.Name, lock.Heartbeat.T)
-					}
-				}
+	readLock := func(rs string) (pbm.LockData, error) {
+		return b.cn.GetLockData(&pbm.LockHeader{
+			Type:    pbm.CmdBackup,
+			OPID:    opid,
+			Replset: rs,
+		})
+	}
 
-				// check status
-				switch shard.Status {
-				case status:
-					shardsToFinish--
-				case pbm.StatusCancelled:
-					return false, ErrCancelled
-				case pbm.StatusError:
-					return false, errors.Errorf("backup on shard %s failed with: %s", shard.Name, bmeta.Error())
-				}
+	ok, err := shardsReached(bmeta, shards, status, clusterTime, readLock, convergeWorkers)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	err = b.cn.ChangeBackupState(bcpName, status, "")
+	if err != nil {
+		return false, errors.Wrapf(err, "update backup meta with %s", status)
+	}
+	return true, nil
+}
+
+// shardsReached checks if all `shards` are alive and reached the `status`.
+// Locks are read by up to `workers` concurrently. Still, shards are
+// inspected in the order of `shards`, so the first failed shard wins.
+//
+// Shards are running once their nominees acknowledged the nomination. So
+// the nominations are complete by then and are checked for duplicates
+// (see pbm.CheckNominations) before the backup moves on.
+func shardsReached(
+	bmeta *pbm.BackupMeta,
+	shards []pbm.Shard,
+	status pbm.Status,
+	clusterTime primitive.Timestamp,
+	readLock func(rs string) (pbm.LockData, error),
+	workers int,
+) (bool, error) {
+	var rss []*pbm.BackupReplset
+	for _, sh := range shards {
+		for i := range bmeta.Replsets {
+			if bmeta.Replsets[i].Name == sh.RS {
+				rss = append(rss, &bmeta.Replsets[i])
 			}
 		}
 	}
 
-	if shardsToFinish == 0 {
-		err := b.cn.ChangeBackupState(bcpName, status, "")
-		if err != nil {
-			return false, errors.Wrapf(err, "update backup meta with %s", status)
+	beats := make([]error, len(rss))
+	// nodes are cleaning its locks moving to the done status
+	// so no need to ckech the heartbeats
+	if status != pbm.StatusDone {
+		var eg errgroup.Group
+		eg.SetLimit(workers)
+		for i, rs := range rss {
+			i, rs := i, rs
+			eg.Go(func() error {
+				beats[i] = checkBeat(rs.Name, clusterTime, readLock)
+				return nil
+			})
 		}
-		return true, nil
+		_ = eg.Wait()
 	}
 
-	return false, nil
+	shardsToFinish := len(shards)
+	for i, shard := range rss {
+		if beats[i] != nil {
+			return false, beats[i]
+		}
+
+		switch shard.Status {
+		case status:
+			shardsToFinish--
+		case pbm.StatusCancelled:
+			return false, ErrCancelled
+		case pbm.StatusError:
+			return false, errors.Errorf("backup on shard %s failed with: %s", shard.Name, bmeta.Error())
+		}
+	}
+	if shardsToFinish != 0 {
+		return false, nil
+	}
+
+	if status == pbm.StatusRunning {
+		if err := pbm.CheckNominations(bmeta.Nomination); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// checkBeat returns an error if the shard's lock heartbeat is stale
+func checkBeat(rs string, clusterTime primitive.Timestamp, readLock func(rs string) (pbm.LockData, error)) error {
+	lock, err := readLock(rs)
+	// no lock is ok, the node may have already cleaned it
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "unable to read lock for shard %s", rs)
+	}
+	if lock.Heartbeat.T+pbm.StaleFrameSec < clusterTime.T {
+		return errors.Errorf("lost shard %s, last beat ts: %d", rs, lock.Heartbeat.T)
+	}
+
+	return nil
 }
 
 func (b *Backup) waitForStatus(bcpName string, status pbm.Status, waitFor *time.Duration) error {
@@ -691,10 +797,10 @@ func (b *Backup) waitForFirstLastWrite(bcpName string) (first, last primitive.Ti
 	}
 }
 
-func writeMeta(stg storage.Storage, meta *pbm.BackupMeta) error {
-	b, err := json.MarshalIndent(meta, "", "\t")
+func writeMeta(stg storage.Storage, meta *pbm.BackupMeta, c compress.CompressionType) error {
+	b, err := pbm.EncodeBackupMeta(meta, c)
 	if err != nil {
-		return errors.Wrap(err, "marshal data")
+		return errors.Wrap(err, "encode")
 	}
 
 	err = stg.Save(meta.Name+pbm.MetadataFileSuffix, bytes.NewReader(b), -1)
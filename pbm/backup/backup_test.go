@@ -0,0 +1,114 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+func manyShards(n int, status pbm.Status) (*pbm.BackupMeta, []pbm.Shard) {
+	bmeta := &pbm.BackupMeta{}
+	shards := make([]pbm.Shard, n)
+	for i := range shards {
+		rs := fmt.Sprintf("rs%d", i)
+		shards[i] = pbm.Shard{RS: rs}
+		bmeta.Replsets = append(bmeta.Replsets, pbm.BackupReplset{Name: rs, Status: status})
+	}
+
+	return bmeta, shards
+}
+
+func TestShardsReachedConcurrent(t *testing.T) {
+	const n = 50
+	const delay = 20 * time.Millisecond
+
+	bmeta, shards := manyShards(n, pbm.StatusRunning)
+	clusterTime := primitive.Timestamp{T: 1000}
+	readLock := func(string) (pbm.LockData, error) {
+		time.Sleep(delay)
+		return pbm.LockData{Heartbeat: clusterTime}, nil
+	}
+
+	start := time.Now()
+	ok, err := shardsReached(bmeta, shards, pbm.StatusRunning, clusterTime, readLock, convergeWorkers)
+	if err != nil || !ok {
+		t.Fatalf("expected all shards to reach the status, got %v, %v", ok, err)
+	}
+	if elapsed := time.Since(start); elapsed >= n*delay/2 {
+		t.Errorf("expected locks to be read concurrently, took %v", elapsed)
+	}
+
+	bmeta.Replsets[n-1].Status = pbm.StatusDumpDone
+	ok, err = shardsReached(bmeta, shards, pbm.StatusRunning, clusterTime, readLock, convergeWorkers)
+	if err != nil || ok {
+		t.Errorf("expected one shard to be waited for, got %v, %v", ok, err)
+	}
+}
+
+func TestShardsReachedLostShard(t *testing.T) {
+	bmeta, shards := manyShards(50, pbm.StatusRunning)
+	clusterTime := primitive.Timestamp{T: 1000}
+	stale := primitive.Timestamp{T: clusterTime.T - pbm.StaleFrameSec - 1}
+	readLock := func(rs string) (pbm.LockData, error) {
+		switch rs {
+		case "rs10":
+			// the slowest to read, but the first of the lost ones
+			time.Sleep(50 * time.Millisecond)
+			return pbm.LockData{Heartbeat: stale}, nil
+		case "rs30":
+			return pbm.LockData{Heartbeat: stale}, nil
+		}
+		return pbm.LockData{Heartbeat: clusterTime}, nil
+	}
+
+	for i := 0; i < 5; i++ {
+		_, err := shardsReached(bmeta, shards, pbm.StatusRunning, clusterTime, readLock, convergeWorkers)
+		if err == nil || !strings.Contains(err.Error(), "lost shard rs10,") {
+			t.Fatalf("expected rs10 to be lost, got %v", err)
+		}
+	}
+
+	// heartbeats aren't checked on done
+	ok, err := shardsReached(bmeta, shards, pbm.StatusDone, clusterTime, readLock, convergeWorkers)
+	if err != nil || ok {
+		t.Errorf("expected no lost shards on done, got %v, %v", ok, err)
+	}
+}
+
+func TestShardsReachedDuplicateNominee(t *testing.T) {
+	bmeta, shards := manyShards(2, pbm.StatusRunning)
+	bmeta.Replsets[1].Status = pbm.StatusStarting
+	bmeta.Nomination = []pbm.BackupRsNomination{
+		{RS: "rs0", Nodes: []string{"node0"}, Ack: "node0"},
+		{RS: "rs1", Nodes: []string{"node0", "node1"}},
+	}
+	clusterTime := primitive.Timestamp{T: 1000}
+	readLock := func(string) (pbm.LockData, error) {
+		return pbm.LockData{Heartbeat: clusterTime}, nil
+	}
+
+	// rs1 hasn't acknowledged yet, the nomination is incomplete
+	ok, err := shardsReached(bmeta, shards, pbm.StatusRunning, clusterTime, readLock, convergeWorkers)
+	if err != nil || ok {
+		t.Errorf("expected rs1 to be waited for, got %v, %v", ok, err)
+	}
+
+	bmeta.Replsets[1].Status = pbm.StatusRunning
+	bmeta.Nomination[1].Ack = "node0"
+	_, err = shardsReached(bmeta, shards, pbm.StatusRunning, clusterTime, readLock, convergeWorkers)
+	if !errors.Is(err, pbm.ErrDuplicateNominee) {
+		t.Errorf("expected duplicate nominee, got %v", err)
+	}
+
+	bmeta.Nomination[1] = pbm.BackupRsNomination{RS: "rs1", Nodes: []string{"node1"}, Ack: "node1"}
+	ok, err = shardsReached(bmeta, shards, pbm.StatusRunning, clusterTime, readLock, convergeWorkers)
+	if err != nil || !ok {
+		t.Errorf("expected all shards to reach the status, got %v, %v", ok, err)
+	}
+}
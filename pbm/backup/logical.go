@@ -202,11 +202,17 @@ func (b *Backup) doLogical(
 	l.Debug("set oplog span to %v / %v", fwTS, lwTS)
 	oplog.SetTailingSpan(fwTS, lwTS)
 	// size -1 - we're assuming oplog never exceed 97Gb (see comments in s3.Save method)
-	oplogSize, err := Upload(ctx, oplog, stg, bcp.Compression, bcp.CompressionLevel, rsMeta.OplogName, -1)
+	oplogSize, oplogSum, err := UploadWithChecksum(ctx, oplog, stg,
+		bcp.Compression, bcp.CompressionLevel, rsMeta.OplogName, -1)
 	if err != nil {
 		return errors.Wrap(err, "oplog")
 	}
 
+	err = b.cn.SetRSOplogChecksum(ctx, bcp.Name, rsMeta.Name, oplogSum)
+	if err != nil {
+		return errors.Wrap(err, "set oplog checksum")
+	}
+
 	err = b.cn.IncBackupSize(ctx, bcp.Name, snapshotSize+oplogSize)
 	if err != nil {
 		return errors.Wrap(err, "inc backup size")
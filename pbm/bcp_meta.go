@@ -0,0 +1,125 @@
+package pbm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+)
+
+// BackupMetaSchemaVersion is the current version of the BackupMeta schema.
+// Bump it along with adding a migration to backupMetaMigrations on
+// changes that older versions can't read properly.
+const BackupMetaSchemaVersion = 1
+
+// ErrMetaSchemaTooNew means the metadata was written by a newer PBM
+var ErrMetaSchemaTooNew = errors.New("metadata written by a newer PBM, upgrade required")
+
+// backupMetaMigrations are upgrades of the BackupMeta from the version
+// (key) to the next one
+var backupMetaMigrations = map[int]func(*BackupMeta) error{
+	// v0 is metadata made before the schema versioning
+	0: func(m *BackupMeta) error {
+		if m.Type == "" {
+			m.Type = LogicalBackup
+		}
+		return nil
+	},
+}
+
+// UpgradeBackupMeta brings the metadata to the current schema version.
+// It fails with ErrMetaSchemaTooNew if the version is newer than the current.
+func UpgradeBackupMeta(m *BackupMeta) error {
+	if m.SchemaVersion > BackupMetaSchemaVersion {
+		return errors.Wrapf(ErrMetaSchemaTooNew, "backup %q has schema v%d, supported up to v%d",
+			m.Name, m.SchemaVersion, BackupMetaSchemaVersion)
+	}
+
+	for m.SchemaVersion < BackupMetaSchemaVersion {
+		up, ok := backupMetaMigrations[m.SchemaVersion]
+		if !ok {
+			return errors.Errorf("no migration for the backup meta schema v%d", m.SchemaVersion)
+		}
+		if err := up(m); err != nil {
+			return errors.Wrapf(err, "migrate from schema v%d", m.SchemaVersion)
+		}
+		m.SchemaVersion++
+	}
+
+	return nil
+}
+
+// EncodeBackupMeta encodes the backup metadata to be saved on the storage.
+// The JSON is compressed unless c is empty or `none`.
+func EncodeBackupMeta(meta *BackupMeta, c compress.CompressionType) ([]byte, error) {
+	b, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal data")
+	}
+	if c == "" || c == compress.CompressionTypeNone {
+		return b, nil
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := compress.Compress(buf, c, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create %s writer", c)
+	}
+	if _, err = w.Write(b); err != nil {
+		return nil, errors.Wrap(err, "compress")
+	}
+	if err = w.Close(); err != nil {
+		return nil, errors.Wrap(err, "close writer")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeBackupMeta decodes the backup metadata read from the storage.
+// Compressed metadata is detected by its leading bytes, so both plain
+// (made by previous versions) and compressed files are handled.
+func DecodeBackupMeta(r io.Reader) (*BackupMeta, error) {
+	br := bufio.NewReader(r)
+	// io.EOF is ok here, the file is just shorter than the peek
+	head, err := br.Peek(compress.DetectPeekLen)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, errors.Wrap(err, "read")
+	}
+
+	var rd io.Reader = br
+	if c := compress.Detect(head); c != compress.CompressionTypeNone {
+		dr, err := compress.Decompress(br, c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "create %s reader", c)
+		}
+		defer dr.Close()
+		rd = dr
+	}
+
+	m := &BackupMeta{}
+	err = json.NewDecoder(rd).Decode(m)
+	return m, errors.Wrap(err, "decode")
+}
+
+// DetectFileCompression returns the compression of the file on the storage
+// by its content, regardless of the file extension
+func DetectFileCompression(stg storage.Storage, name string) (compress.CompressionType, error) {
+	r, err := stg.SourceReader(name)
+	if err != nil {
+		return "", errors.Wrapf(err, "open %q", name)
+	}
+	defer r.Close()
+
+	head := make([]byte, compress.DetectPeekLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", errors.Wrapf(err, "read %q", name)
+	}
+
+	return compress.Detect(head[:n]), nil
+}
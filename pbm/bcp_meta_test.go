@@ -0,0 +1,77 @@
+package pbm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+)
+
+func TestBackupMetaCompression(t *testing.T) {
+	meta := &BackupMeta{
+		Type:         LogicalBackup,
+		Name:         "2023-01-01T00:00:00Z",
+		Compression:  compress.CompressionTypeS2,
+		MongoVersion: "6.0.5",
+		Status:       StatusDone,
+		LastWriteTS:  primitive.Timestamp{T: 1672531200, I: 3},
+		Conditions:   []Condition{{Timestamp: 1672531200, Status: StatusDone}},
+	}
+	for _, rs := range []string{"rs0", "rs1", "cfg"} {
+		meta.Replsets = append(meta.Replsets, BackupReplset{
+			Name:         rs,
+			DumpName:     meta.Name + "/" + rs + "/dump.s2",
+			OplogName:    meta.Name + "/" + rs + "/oplog",
+			Status:       StatusDone,
+			LastWriteTS:  primitive.Timestamp{T: 1672531200, I: 1},
+			MongodOpts:   &MongodOpts{},
+			Conditions:   []Condition{{Timestamp: 1672531200, Status: StatusDone}},
+			FirstWriteTS: primitive.Timestamp{T: 1672531100, I: 1},
+		})
+	}
+
+	plain, err := EncodeBackupMeta(meta, compress.CompressionTypeNone)
+	if err != nil {
+		t.Fatalf("encode plain: %v", err)
+	}
+	want, err := DecodeBackupMeta(bytes.NewReader(plain))
+	if err != nil {
+		t.Fatalf("decode plain: %v", err)
+	}
+	if !reflect.DeepEqual(want, meta) {
+		t.Fatalf("plain meta mismatch:\n%+v\n%+v", want, meta)
+	}
+
+	for _, c := range []compress.CompressionType{
+		compress.CompressionTypeGZIP,
+		compress.CompressionTypePGZIP,
+		compress.CompressionTypeSNAPPY,
+		compress.CompressionTypeLZ4,
+		compress.CompressionTypeS2,
+		compress.CompressionTypeZstandard,
+	} {
+		t.Run(string(c), func(t *testing.T) {
+			b, err := EncodeBackupMeta(meta, c)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if bytes.Equal(b, plain) {
+				t.Fatal("expected compressed meta")
+			}
+			if d := compress.Detect(b); d == compress.CompressionTypeNone {
+				t.Fatal("compression is not detected")
+			}
+
+			got, err := DecodeBackupMeta(bytes.NewReader(b))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("meta mismatch:\n%+v\n%+v", got, want)
+			}
+		})
+	}
+}
@@ -1,7 +1,9 @@
 package pbm
 
 import (
+	"fmt"
 	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
@@ -9,15 +11,33 @@ import (
 
 const defaultScore = 1.0
 
+// RegionTag is the replset member tag with the node's region
+const RegionTag = "region"
+
+// crossRegionFactor demotes nodes outside of the preferred region. It's
+// low enough to outweigh the default preferences (e.g. hidden nodes).
+const crossRegionFactor = 0.1
+
+// busyFactor demotes nodes busy with another operation, so idle ones of
+// the same score are preferred
+const busyFactor = 0.5
+
 // NodesPriority groups nodes by priority according to
 // provided scores. Basically nodes are grouped and sorted by
 // descending order by score
 type NodesPriority struct {
 	m map[string]nodeScores
+	// excluded are not eligible nodes of the replset with the reasons
+	excluded map[string][]string
+
+	// Generation is the generation of the config the scores are based on
+	Generation int64
+	// Priority is the backup.priority of that config
+	Priority map[string]float64
 }
 
 func NewNodesPriority() *NodesPriority {
-	return &NodesPriority{make(map[string]nodeScores)}
+	return &NodesPriority{m: make(map[string]nodeScores), excluded: make(map[string][]string)}
 }
 
 // Add node with its score
@@ -35,6 +55,61 @@ func (n *NodesPriority) RS(rs string) [][]string {
 	return n.m[rs].list()
 }
 
+// RankedRS returns nodes of the replset one by one from the highest score.
+// Nodes with the same score are in lexicographic order.
+func (n *NodesPriority) RankedRS(rs string) []string {
+	var rv []string
+	for _, nodes := range n.RS(rs) {
+		b := append([]string{}, nodes...)
+		sort.Strings(b)
+		rv = append(rv, b...)
+	}
+
+	return rv
+}
+
+// exclude records the node as not eligible
+func (n *NodesPriority) exclude(rs, node string, reasons []string) {
+	n.excluded[rs] = append(n.excluded[rs], fmt.Sprintf("%s: %s", node, strings.Join(reasons, ", ")))
+}
+
+// ErrNoBackupCandidates means some replsets have no node to make a backup on
+var ErrNoBackupCandidates = errors.New("no backup candidates")
+
+// NoCandidates returns replsets among the given ones that have no eligible
+// nodes. Nomination for such replsets would have nobody to pick.
+func (n *NodesPriority) NoCandidates(rss []string) []string {
+	var rv []string
+	for _, rs := range rss {
+		if len(n.m[rs].idx) == 0 {
+			rv = append(rv, rs)
+		}
+	}
+
+	return rv
+}
+
+// CheckCandidates returns ErrNoBackupCandidates naming replsets without
+// eligible nodes along with the reasons nodes were excluded
+func (n *NodesPriority) CheckCandidates(rss []string) error {
+	no := n.NoCandidates(rss)
+	if len(no) == 0 {
+		return nil
+	}
+
+	desc := make([]string, len(no))
+	for i, rs := range no {
+		reasons := n.excluded[rs]
+		if len(reasons) == 0 {
+			desc[i] = rs + " (no agents)"
+			continue
+		}
+		desc[i] = fmt.Sprintf("%s (%s)", rs, strings.Join(reasons, "; "))
+	}
+
+	return errors.Wrap(ErrNoBackupCandidates, strings.Join(desc, ", "))
+}
+
 type agentScore func(AgentStat) float64
 
 // BcpNodesPriority returns list nodes grouped by backup preferences
@@ -47,6 +122,15 @@ func (p *PBM) BcpNodesPriority(c map[string]float64, agents []AgentStat) (*Nodes
 		return nil, errors.Wrap(err, "get config")
 	}
 
+	nodes := bcpNodesPriority(agents, bcpScore(&cfg, c))
+	nodes.Generation = cfg.Generation
+	nodes.Priority = cfg.Backup.Priority
+
+	return nodes, nil
+}
+
+// bcpScore returns the agent scoring defined by the config
+func bcpScore(cfg *Config, c map[string]float64) agentScore {
 	// if cfg.Backup.Priority doesn't set apply defaults
 	f := func(a AgentStat) float64 {
 		if coeff, ok := c[a.Node]; ok && c != nil {
@@ -68,16 +152,56 @@ func (p *PBM) BcpNodesPriority(c map[string]float64, agents []AgentStat) (*Nodes
 
 			return sc
 		}
+	} else if cfg.Backup.PreferRegion != "" {
+		// the explicit priority is the user's choice of the nodes already
+		f = preferRegion(cfg.Backup.PreferRegion, c, f)
 	}
 
-	return bcpNodesPriority(agents, f), nil
+	return demoteBusy(f)
+}
+
+// preferRegion demotes nodes outside of the region. Nodes without
+// the region tag are considered to be outside as well. Nodes with the
+// custom coefficient `c` (e.g. the source of the incremental backup)
+// keep their score.
+func preferRegion(region string, c map[string]float64, f agentScore) agentScore {
+	return func(a AgentStat) float64 {
+		sc := f(a)
+		if _, ok := c[a.Node]; ok {
+			return sc
+		}
+		if a.Region != region {
+			sc *= crossRegionFactor
+		}
+
+		return sc
+	}
+}
+
+// demoteBusy demotes nodes busy with another operation. They are still
+// candidates, so the replset with only busy nodes gets a backup as well.
+func demoteBusy(f agentScore) agentScore {
+	return func(a AgentStat) float64 {
+		sc := f(a)
+		if a.Busy != CmdUndefined {
+			sc *= busyFactor
+		}
+
+		return sc
+	}
 }
 
 func bcpNodesPriority(agents []AgentStat, f agentScore) *NodesPriority {
 	scores := NewNodesPriority()
 
 	for _, a := range agents {
-		if ok, _ := a.OK(); !ok {
+		// arbiters have no data to back up regardless of the priority
+		if a.Arbiter || a.State == NodeStateArbiter {
+			scores.exclude(a.RS, a.Node, []string{"arbiter"})
+			continue
+		}
+		if ok, errs := a.OK(); !ok {
+			scores.exclude(a.RS, a.Node, errs)
 			continue
 		}
 
@@ -111,6 +235,39 @@ func (s nodeScores) list() [][]string {
 	return ret
 }
 
+// ErrDuplicateNominee means a node is nominated for more than one replset
+var ErrDuplicateNominee = errors.New("node nominated for more than one replset")
+
+// CheckNominations ensures no node is a nominee or acknowledged the
+// nomination for more than one replset. It'd mean the topology or the
+// agents are misconfigured, so the backup shouldn't proceed.
+func CheckNominations(nms []BackupRsNomination) error {
+	byNode := make(map[string][]string)
+	for _, n := range nms {
+		seen := make(map[string]bool)
+		for _, node := range append([]string{n.Ack}, n.Nodes...) {
+			if node == "" || seen[node] {
+				continue
+			}
+			seen[node] = true
+			byNode[node] = append(byNode[node], n.RS)
+		}
+	}
+
+	var dup []string
+	for node, rss := range byNode {
+		if len(rss) > 1 {
+			dup = append(dup, fmt.Sprintf("%s (%s)", node, strings.Join(rss, ", ")))
+		}
+	}
+	if len(dup) == 0 {
+		return nil
+	}
+
+	sort.Strings(dup)
+	return errors.Wrap(ErrDuplicateNominee, strings.Join(dup, "; "))
+}
+
 func (p *PBM) SetRSNomination(bcpName, rs string) error {
 	n := BackupRsNomination{RS: rs, Nodes: []string{}}
 	_, err := p.Conn.Database(DB).Collection(BcpCollection).
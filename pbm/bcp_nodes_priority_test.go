@@ -0,0 +1,269 @@
+package pbm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func okAgent(rs, node string) AgentStat {
+	return AgentStat{
+		RS:            rs,
+		Node:          node,
+		PBMStatus:     SubsysStatus{OK: true},
+		NodeStatus:    SubsysStatus{OK: true},
+		StorageStatus: SubsysStatus{OK: true},
+	}
+}
+
+func TestBcpNodesPriorityNoCandidates(t *testing.T) {
+	broken := okAgent("rs1", "rs1-a:27017")
+	broken.StorageStatus = SubsysStatus{OK: false, Err: "access denied"}
+	down := okAgent("rs1", "rs1-b:27017")
+	down.NodeStatus = SubsysStatus{OK: false, Err: "connection refused"}
+
+	agents := []AgentStat{
+		okAgent("rs0", "rs0-a:27017"),
+		okAgent("rs0", "rs0-b:27017"),
+		broken,
+		down,
+	}
+
+	nodes := bcpNodesPriority(agents, func(AgentStat) float64 { return defaultScore })
+
+	if len(nodes.RS("rs0")) == 0 {
+		t.Errorf("expected candidates for rs0")
+	}
+	if len(nodes.RS("rs1")) != 0 {
+		t.Errorf("expected no candidates for rs1, got %v", nodes.RS("rs1"))
+	}
+
+	no := nodes.NoCandidates([]string{"rs0", "rs1", "rs2"})
+	if len(no) != 2 || no[0] != "rs1" || no[1] != "rs2" {
+		t.Errorf("expected rs1 and rs2 to be flagged, got %v", no)
+	}
+
+	err := nodes.CheckCandidates([]string{"rs0", "rs1", "rs2"})
+	if !errors.Is(err, ErrNoBackupCandidates) {
+		t.Fatalf("expected ErrNoBackupCandidates, got %v", err)
+	}
+	for _, s := range []string{"rs1 (", "access denied", "connection refused", "rs2 (no agents)"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected %q in %q", s, err)
+		}
+	}
+
+	if err := nodes.CheckCandidates([]string{"rs0"}); err != nil {
+		t.Errorf("expected no error for rs0, got %v", err)
+	}
+}
+
+func TestRankedRS(t *testing.T) {
+	n := NewNodesPriority()
+	n.Add("rs0", "c:27017", 1)
+	n.Add("rs0", "b:27017", 2)
+	n.Add("rs0", "z:27017", 0.5)
+	n.Add("rs0", "a:27017", 1)
+	n.Add("rs0", "d:27017", 2)
+	n.Add("rs1", "x:27017", 1)
+
+	want := []string{"b:27017", "d:27017", "a:27017", "c:27017", "z:27017"}
+	if got := n.RankedRS("rs0"); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// the buckets are left as they are
+	buckets := [][]string{{"b:27017", "d:27017"}, {"c:27017", "a:27017"}, {"z:27017"}}
+	if got := n.RS("rs0"); !reflect.DeepEqual(got, buckets) {
+		t.Errorf("expected buckets %v, got %v", buckets, got)
+	}
+
+	if got := n.RankedRS("rs2"); len(got) != 0 {
+		t.Errorf("expected no nodes for unknown replset, got %v", got)
+	}
+}
+
+func TestBcpNodesPriorityArbiter(t *testing.T) {
+	p := okAgent("rs0", "p:27017")
+	p.State = NodeStatePrimary
+	s := okAgent("rs0", "s:27017")
+	s.State = NodeStateSecondary
+	a := okAgent("rs0", "a:27017")
+	a.State = NodeStateArbiter
+	a.Arbiter = true
+
+	// arbiter would be the most preferred one by the score
+	score := func(st AgentStat) float64 {
+		if st.Arbiter {
+			return 10
+		}
+		return defaultScore
+	}
+	nodes := bcpNodesPriority([]AgentStat{p, s, a}, score)
+
+	var got []string
+	for _, group := range nodes.RS("rs0") {
+		got = append(got, group...)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 candidates, got %v", got)
+	}
+	for _, n := range got {
+		if n == "a:27017" {
+			t.Errorf("arbiter must not be a candidate: %v", got)
+		}
+	}
+
+	// arbiter-only replset has no candidates
+	nodes = bcpNodesPriority([]AgentStat{a}, score)
+	err := nodes.CheckCandidates([]string{"rs0"})
+	if err == nil || !strings.Contains(err.Error(), "a:27017: arbiter") {
+		t.Errorf("expected arbiter to be excluded, got %v", err)
+	}
+}
+
+func TestBcpNodesPriorityRegion(t *testing.T) {
+	p := okAgent("rs0", "p:27017")
+	p.State = NodeStatePrimary
+	p.Region = "eu-west"
+	near := okAgent("rs0", "near:27017")
+	near.State = NodeStateSecondary
+	near.Region = "eu-west"
+	far := okAgent("rs0", "far:27017")
+	far.State = NodeStateSecondary
+	far.Region = "us-east"
+	farHidden := okAgent("rs0", "far-hidden:27017")
+	farHidden.State = NodeStateSecondary
+	farHidden.Hidden = true
+	farHidden.Region = "us-east"
+
+	def := func(a AgentStat) float64 {
+		if a.State == NodeStatePrimary {
+			return defaultScore / 2
+		} else if a.Hidden {
+			return defaultScore * 2
+		}
+		return defaultScore
+	}
+
+	nodes := bcpNodesPriority([]AgentStat{far, farHidden, p, near}, preferRegion("eu-west", nil, def))
+	list := nodes.RS("rs0")
+	if len(list) == 0 || len(list[0]) != 1 || list[0][0] != "near:27017" {
+		t.Fatalf("expected same-region secondary first, got %v", list)
+	}
+
+	var got []string
+	for _, group := range list {
+		got = append(got, group...)
+	}
+	if len(got) != 4 {
+		t.Errorf("expected cross-region nodes to be demoted, not excluded, got %v", got)
+	}
+
+	// only cross-region nodes are available
+	nodes = bcpNodesPriority([]AgentStat{far}, preferRegion("eu-west", nil, def))
+	if l := nodes.RS("rs0"); len(l) != 1 || l[0][0] != "far:27017" {
+		t.Errorf("expected cross-region node as the only candidate, got %v", l)
+	}
+}
+
+func TestBcpScorePreferRegion(t *testing.T) {
+	near := okAgent("rs0", "near:27017")
+	near.Region = "eu-west"
+	far := okAgent("rs0", "far:27017")
+	far.Region = "us-east"
+	agents := []AgentStat{near, far}
+
+	// the explicit priority isn't demoted
+	cfg := Config{Backup: BackupConf{
+		Priority:     map[string]float64{"far:27017": 2},
+		PreferRegion: "eu-west",
+	}}
+	nodes := bcpNodesPriority(agents, bcpScore(&cfg, nil))
+	if list := nodes.RS("rs0"); len(list) == 0 || list[0][0] != "far:27017" {
+		t.Errorf("expected the explicit priority to win, got %v", list)
+	}
+
+	// neither is the custom coefficient
+	cfg = Config{Backup: BackupConf{PreferRegion: "eu-west"}}
+	f := bcpScore(&cfg, map[string]float64{"far:27017": 3})
+	if sc := f(far); sc != 3*defaultScore {
+		t.Errorf("expected the custom coefficient score %v, got %v", 3*defaultScore, sc)
+	}
+	if sc := f(near); sc != defaultScore {
+		t.Errorf("expected the default score %v for the same-region node, got %v", defaultScore, sc)
+	}
+}
+
+func TestBcpScoreConfigChange(t *testing.T) {
+	agents := []AgentStat{
+		okAgent("rs0", "a:27017"),
+		okAgent("rs0", "b:27017"),
+	}
+
+	cfg := Config{Backup: BackupConf{Priority: map[string]float64{"a:27017": 2}}}
+	nodes := bcpNodesPriority(agents, bcpScore(&cfg, nil))
+	if list := nodes.RS("rs0"); len(list) == 0 || list[0][0] != "a:27017" {
+		t.Fatalf("expected a:27017 first, got %v", list)
+	}
+
+	next := Config{Backup: BackupConf{Priority: map[string]float64{"b:27017": 2}}}
+	nodes = bcpNodesPriority(agents, bcpScore(&next, nil))
+	if list := nodes.RS("rs0"); len(list) == 0 || list[0][0] != "b:27017" {
+		t.Fatalf("expected b:27017 first after the config change, got %v", list)
+	}
+}
+
+func TestBcpNodesPriorityBusy(t *testing.T) {
+	busy := okAgent("rs0", "busy:27017")
+	busy.State = NodeStateSecondary
+	busy.Busy = CmdRestore
+	idle := okAgent("rs0", "idle:27017")
+	idle.State = NodeStateSecondary
+
+	score := bcpScore(&Config{}, nil)
+
+	nodes := bcpNodesPriority([]AgentStat{busy, idle}, score)
+	list := nodes.RS("rs0")
+	if len(list) != 2 || len(list[0]) != 1 || list[0][0] != "idle:27017" || list[1][0] != "busy:27017" {
+		t.Fatalf("expected the idle secondary first and the busy one demoted, got %v", list)
+	}
+
+	// the busy node is still a candidate if it's the only one
+	nodes = bcpNodesPriority([]AgentStat{busy}, score)
+	if l := nodes.RS("rs0"); len(l) != 1 || l[0][0] != "busy:27017" {
+		t.Errorf("expected the busy node as the only candidate, got %v", l)
+	}
+
+	// it doesn't override the configured priority
+	cfg := &Config{Backup: BackupConf{Priority: map[string]float64{"busy:27017": 3}}}
+	nodes = bcpNodesPriority([]AgentStat{busy, idle}, bcpScore(cfg, nil))
+	if l := nodes.RS("rs0"); len(l) != 2 || l[0][0] != "busy:27017" {
+		t.Errorf("expected the higher priority to win over busyness, got %v", l)
+	}
+}
+
+func TestCheckNominations(t *testing.T) {
+	ok := []BackupRsNomination{
+		{RS: "rs0", Nodes: []string{"rs0-a:27017", "rs0-b:27017"}, Ack: "rs0-a:27017"},
+		{RS: "rs1", Nodes: []string{"rs1-a:27017"}, Ack: "rs1-a:27017"},
+		{RS: "cfg", Nodes: []string{"cfg-a:27017"}},
+	}
+	if err := CheckNominations(ok); err != nil {
+		t.Errorf("expected no error for distinct nodes, got %v", err)
+	}
+
+	dup := []BackupRsNomination{
+		{RS: "rs0", Nodes: []string{"rs0-a:27017"}, Ack: "rs0-a:27017"},
+		{RS: "rs1", Nodes: []string{"rs1-a:27017"}, Ack: "rs0-a:27017"},
+	}
+	err := CheckNominations(dup)
+	if !errors.Is(err, ErrDuplicateNominee) {
+		t.Fatalf("expected ErrDuplicateNominee, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "rs0-a:27017 (rs0, rs1)") {
+		t.Errorf("expected the node and its replsets in %q", err)
+	}
+}
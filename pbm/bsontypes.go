@@ -39,6 +39,7 @@ type NodeInfo struct {
 	Hidden                       bool                 `bson:"hidden,omitempty"`
 	Passive                      bool                 `bson:"passive,omitempty"`
 	ArbiterOnly                  bool                 `bson:"arbiterOnly"`
+	Tags                         map[string]string    `bson:"tags,omitempty"`
 	SecondaryDelayOld            int                  `bson:"slaveDelay"`
 	SecondaryDelaySecs           int                  `bson:"secondaryDelaySecs"`
 	ConfigSvr                    int                  `bson:"configsvr,omitempty"`
@@ -1,9 +1,11 @@
 package compress
 
 import (
+	"bytes"
 	"compress/gzip"
 	"io"
 	"runtime"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/golang/snappy"
@@ -26,22 +28,74 @@ const (
 	CompressionTypeZstandard CompressionType = "zstd"
 )
 
+// types are the known compression types
+var types = []CompressionType{
+	CompressionTypeNone,
+	CompressionTypeGZIP,
+	CompressionTypePGZIP,
+	CompressionTypeSNAPPY,
+	CompressionTypeLZ4,
+	CompressionTypeS2,
+	CompressionTypeZstandard,
+}
+
+// ParseType returns the compression type of the string. It's either the
+// name of the type (case insensitive) or the file suffix with the leading
+// dot (see Suffix). Empty string is none. Unknown values are errors.
+func ParseType(s string) (CompressionType, error) {
+	if s == "" {
+		return CompressionTypeNone, nil
+	}
+
+	if strings.HasPrefix(s, ".") {
+		switch s {
+		case ".gz":
+			return CompressionTypePGZIP, nil
+		case ".lz4":
+			return CompressionTypeLZ4, nil
+		case ".snappy":
+			return CompressionTypeSNAPPY, nil
+		case ".s2":
+			return CompressionTypeS2, nil
+		case ".zst":
+			return CompressionTypeZstandard, nil
+		}
+		return "", errors.Errorf("unknown compression file suffix %q", s)
+	}
+
+	c := CompressionType(strings.ToLower(s))
+	for _, t := range types {
+		if c == t {
+			return t, nil
+		}
+	}
+
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = string(t)
+	}
+	return "", errors.Errorf("unknown compression type %q, expected one of: %s", s, strings.Join(names, ", "))
+}
+
 func IsValidCompressionType(s string) bool {
-	switch CompressionType(s) {
-	case
-		CompressionTypeNone,
-		CompressionTypeGZIP,
-		CompressionTypePGZIP,
-		CompressionTypeSNAPPY,
-		CompressionTypeLZ4,
-		CompressionTypeS2,
-		CompressionTypeZstandard:
-		return true
+	for _, t := range types {
+		if CompressionType(s) == t {
+			return true
+		}
 	}
 
 	return false
 }
 
+func (c CompressionType) String() string {
+	if c == "" {
+		return string(CompressionTypeNone)
+	}
+	return string(c)
+}
+
+// Suffix returns the suffix (with the dot) of the files compressed
+// with the type. Uncompressed files and unknown types have no suffix.
 func (c CompressionType) Suffix() string {
 	switch c {
 	case CompressionTypeGZIP, CompressionTypePGZIP:
@@ -61,22 +115,40 @@ func (c CompressionType) Suffix() string {
 	}
 }
 
-// FileCompression return compression alg based on given file extension
+// FileCompression return compression alg based on given file extension.
+// Unknown extensions are none, see ParseType to tell them apart.
 func FileCompression(ext string) CompressionType {
-	switch ext {
-	default:
+	if ext == "" {
 		return CompressionTypeNone
-	case "gz":
+	}
+
+	c, err := ParseType("." + ext)
+	if err != nil {
+		return CompressionTypeNone
+	}
+	return c
+}
+
+// DetectPeekLen is the num of leading bytes Detect needs
+const DetectPeekLen = 10
+
+// Detect returns the compression of the data by its leading bytes (magic
+// numbers of the formats). CompressionTypeNone if nothing matched.
+func Detect(b []byte) CompressionType {
+	switch {
+	case bytes.HasPrefix(b, []byte{0x1f, 0x8b}):
 		return CompressionTypePGZIP
-	case "lz4":
+	case bytes.HasPrefix(b, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return CompressionTypeZstandard
+	case bytes.HasPrefix(b, []byte{0x04, 0x22, 0x4d, 0x18}):
 		return CompressionTypeLZ4
-	case "snappy":
+	case bytes.HasPrefix(b, []byte("\xff\x06\x00\x00sNaPpY")):
 		return CompressionTypeSNAPPY
-	case "s2":
+	case bytes.HasPrefix(b, []byte("\xff\x06\x00\x00S2sTwO")):
 		return CompressionTypeS2
-	case "zst":
-		return CompressionTypeZstandard
 	}
+
+	return CompressionTypeNone
 }
 
 // Compress makes a compressed writer from the given one
@@ -168,6 +240,46 @@ func Decompress(r io.Reader, c CompressionType) (io.ReadCloser, error) {
 	}
 }
 
+// DecompressWithMaxMemory is like Decompress but limits the memory
+// the decoder may allocate for its buffers to maxMem bytes (if supported by
+// the codec). Data that can't be decoded within the limit results in an
+// error rather than unbounded allocation. maxMem <= 0 means no limit.
+func DecompressWithMaxMemory(r io.Reader, c CompressionType, maxMem int64) (io.ReadCloser, error) {
+	if maxMem <= 0 {
+		return Decompress(r, c)
+	}
+
+	switch c {
+	case CompressionTypeS2:
+		if maxMem >= s2MaxBlockSize {
+			return Decompress(r, c)
+		}
+		return io.NopCloser(s2.NewReader(r, s2.ReaderMaxBlockSize(int(maxMem)))), nil
+	case CompressionTypeZstandard:
+		rr, err := zstd.NewReader(r,
+			zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(uint64(maxMem)))
+		if err != nil {
+			return nil, errors.Wrap(err, "zstandard reader")
+		}
+		return zstdReadCloser{rr}, nil
+	default:
+		// other codecs have small fixed size buffers
+		return Decompress(r, c)
+	}
+}
+
+// s2MaxBlockSize is the max block size of s2 stream
+const s2MaxBlockSize = 4 << 20
+
+type zstdReadCloser struct{ *zstd.Decoder }
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
 type nopWriteCloser struct{ io.Writer }
 
 func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,94 @@
+package compress
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseType(t *testing.T) {
+	for _, c := range types {
+		got, err := ParseType(string(c))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c, err)
+			continue
+		}
+		if got != c {
+			t.Errorf("%s: parsed as %s", c, got)
+		}
+		if !IsValidCompressionType(string(c)) {
+			t.Errorf("%s: expected to be valid", c)
+		}
+	}
+
+	cases := map[string]CompressionType{
+		"":        CompressionTypeNone,
+		"ZSTD":    CompressionTypeZstandard,
+		"Snappy":  CompressionTypeSNAPPY,
+		".gz":     CompressionTypePGZIP,
+		".lz4":    CompressionTypeLZ4,
+		".snappy": CompressionTypeSNAPPY,
+		".s2":     CompressionTypeS2,
+		".zst":    CompressionTypeZstandard,
+	}
+	for s, want := range cases {
+		got, err := ParseType(s)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", s, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%q: expected %s, got %s", s, want, got)
+		}
+	}
+
+	for _, s := range []string{"brotli", "zst", ".zstd", ".bz2", " s2"} {
+		_, err := ParseType(s)
+		if err == nil {
+			t.Errorf("%q: expected an error", s)
+			continue
+		}
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("%q: expected the value in the error, got %v", s, err)
+		}
+	}
+}
+
+func TestSuffix(t *testing.T) {
+	for _, c := range types {
+		suffix := c.Suffix()
+		if c == CompressionTypeNone {
+			if suffix != "" {
+				t.Errorf("none: expected no suffix, got %q", suffix)
+			}
+			continue
+		}
+
+		got, err := ParseType(suffix)
+		if err != nil {
+			t.Errorf("%s: parse suffix %q: %v", c, suffix, err)
+			continue
+		}
+		// gzip and pgzip files are the same
+		if got != c && !(c == CompressionTypeGZIP && got == CompressionTypePGZIP) {
+			t.Errorf("%s: suffix %q parsed as %s", c, suffix, got)
+		}
+	}
+
+	for ext, want := range map[string]CompressionType{
+		"":       CompressionTypeNone,
+		"gz":     CompressionTypePGZIP,
+		"zst":    CompressionTypeZstandard,
+		"brotli": CompressionTypeNone,
+	} {
+		if c := FileCompression(ext); c != want {
+			t.Errorf("file extension %q: expected %s, got %s", ext, want, c)
+		}
+	}
+
+	if s := CompressionType("brotli").Suffix(); s != "" {
+		t.Errorf("unknown type: expected no suffix, got %q", s)
+	}
+	if s := CompressionType("").String(); s != "none" {
+		t.Errorf("empty type: expected none, got %q", s)
+	}
+}
@@ -0,0 +1,111 @@
+package compress
+
+import (
+	"hash/crc32"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// TrainZstdDict makes a raw (content only) zstd dictionary of up to size
+// bytes from the samples. Zstd finds repeated sequences in the dictionary
+// like in the already seen data, so distinct samples are packed from the
+// most recent one and the recent ones end up closer to the data.
+// Nil if there is nothing to train on.
+func TrainZstdDict(samples [][]byte, size int) []byte {
+	var picked [][]byte
+	left := size
+	seen := make(map[string]struct{})
+	for i := len(samples) - 1; i >= 0 && left > 0; i-- {
+		s := samples[i]
+		if len(s) == 0 || len(s) > left {
+			continue
+		}
+		if _, ok := seen[string(s)]; ok {
+			continue
+		}
+		seen[string(s)] = struct{}{}
+		picked = append(picked, s)
+		left -= len(s)
+	}
+	if len(picked) == 0 {
+		return nil
+	}
+
+	dict := make([]byte, 0, size-left)
+	for i := len(picked) - 1; i >= 0; i-- {
+		dict = append(dict, picked[i]...)
+	}
+	return dict
+}
+
+// ZstdDictID returns the id of the dictionary. It's written into the
+// frames compressed with the dictionary, so a wrong one is detected.
+func ZstdDictID(dict []byte) uint32 {
+	id := crc32.ChecksumIEEE(dict)
+	if id == 0 {
+		// zero means no dictionary in the frame header
+		id = 1
+	}
+	return id
+}
+
+// CompressWithDict is Compress that uses the zstd dictionary (see
+// TrainZstdDict). Other codecs and an empty dictionary fall back to Compress.
+func CompressWithDict(w io.Writer, c CompressionType, level *int, dict []byte) (io.WriteCloser, error) {
+	if c != CompressionTypeZstandard || len(dict) == 0 {
+		return Compress(w, c, level)
+	}
+
+	encLevel := zstd.SpeedDefault
+	if level != nil {
+		encLevel = zstd.EncoderLevelFromZstd(*level)
+	}
+	return zstd.NewWriter(w,
+		zstd.WithEncoderLevel(encLevel),
+		zstd.WithEncoderDictRaw(ZstdDictID(dict), dict))
+}
+
+// DecompressWithDict is DecompressWithMaxMemory for the data compressed
+// with the zstd dictionary. Other codecs and an empty dictionary fall back
+// to DecompressWithMaxMemory.
+func DecompressWithDict(r io.Reader, c CompressionType, maxMem int64, dict []byte) (io.ReadCloser, error) {
+	if c != CompressionTypeZstandard || len(dict) == 0 {
+		return DecompressWithMaxMemory(r, c, maxMem)
+	}
+
+	opts := []zstd.DOption{zstd.WithDecoderDictRaw(ZstdDictID(dict), dict)}
+	if maxMem > 0 {
+		opts = append(opts,
+			zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(uint64(maxMem)))
+	}
+	rr, err := zstd.NewReader(r, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "zstandard reader")
+	}
+	return zstdReadCloser{rr}, nil
+}
+
+// ZstdFrameHeaderSize is the max size of the zstd frame header,
+// enough to read for ZstdFrameDictID
+const ZstdFrameHeaderSize = zstd.HeaderMaxSize
+
+// ZstdFrameDictID reads the header of the zstd frame the data starts with
+// and returns the id of its dictionary (see ZstdDictID). Zero if the
+// frame was compressed without a dictionary.
+func ZstdFrameDictID(r io.Reader) (uint32, error) {
+	b := make([]byte, zstd.HeaderMaxSize)
+	n, err := io.ReadFull(r, b)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, errors.Wrap(err, "read frame header")
+	}
+
+	var h zstd.Header
+	if err := h.Decode(b[:n]); err != nil {
+		return 0, errors.Wrap(err, "decode frame header")
+	}
+	return h.DictionaryID, nil
+}
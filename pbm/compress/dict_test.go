@@ -0,0 +1,150 @@
+package compress
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// oplogLike returns n small docs that share namespaces and field names
+// like the oplog entries do
+func oplogLike(n, from int) [][]byte {
+	docs := make([][]byte, n)
+	for i := range docs {
+		docs[i] = []byte(fmt.Sprintf(
+			`{"op":"u","ns":"shop.orders","ui":"9b2f1c7e","o":{"$v":2,"diff":{"u":{"status":"shipped","updatedAt":%d}}},"o2":{"_id":%d},"ts":%d,"t":3,"v":2,"wall":%d}`,
+			from+i*7, from+i, from+i*3, from+i*11))
+	}
+	return docs
+}
+
+func compressDocs(t *testing.T, docs [][]byte, dict []byte) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	w, err := CompressWithDict(buf, CompressionTypeZstandard, nil, dict)
+	if err != nil {
+		t.Fatalf("create writer: %v", err)
+	}
+	for _, d := range docs {
+		if _, err := w.Write(d); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestZstdDictRoundTrip(t *testing.T) {
+	dict := TrainZstdDict(oplogLike(200, 0), 16<<10)
+	if len(dict) == 0 || len(dict) > 16<<10 {
+		t.Fatalf("expected a dictionary of up to 16KB, got %d bytes", len(dict))
+	}
+
+	docs := oplogLike(20, 1000)
+	data := compressDocs(t, docs, dict)
+
+	for _, maxMem := range []int64{0, 64 << 20} {
+		r, err := DecompressWithDict(bytes.NewReader(data), CompressionTypeZstandard, maxMem, dict)
+		if err != nil {
+			t.Fatalf("maxMem %d: create reader: %v", maxMem, err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("maxMem %d: read: %v", maxMem, err)
+		}
+		if !bytes.Equal(got, bytes.Join(docs, nil)) {
+			t.Errorf("maxMem %d: decompressed data doesn't match the source", maxMem)
+		}
+	}
+
+	r, err := DecompressWithDict(bytes.NewReader(data), CompressionTypeZstandard, 0, nil)
+	if err == nil {
+		_, err = io.ReadAll(r)
+		r.Close()
+	}
+	if err == nil {
+		t.Error("expected an error on reading without the dictionary")
+	}
+}
+
+func TestZstdFrameDictID(t *testing.T) {
+	dict := TrainZstdDict(oplogLike(200, 0), 16<<10)
+	docs := oplogLike(5, 5000)
+
+	id, err := ZstdFrameDictID(bytes.NewReader(compressDocs(t, docs, dict)))
+	if err != nil {
+		t.Fatalf("read dict id: %v", err)
+	}
+	if id != ZstdDictID(dict) {
+		t.Errorf("expected dict id %d, got %d", ZstdDictID(dict), id)
+	}
+
+	id, err = ZstdFrameDictID(bytes.NewReader(compressDocs(t, docs, nil)))
+	if err != nil {
+		t.Fatalf("read dict id without dict: %v", err)
+	}
+	if id != 0 {
+		t.Errorf("expected no dict id, got %d", id)
+	}
+
+	if _, err := ZstdFrameDictID(bytes.NewReader([]byte("not zstd"))); err == nil {
+		t.Error("expected an error on non zstd data")
+	}
+}
+
+func TestZstdDictNoDict(t *testing.T) {
+	docs := oplogLike(20, 0)
+	data := compressDocs(t, docs, nil)
+
+	r, err := Decompress(bytes.NewReader(data), CompressionTypeZstandard)
+	if err != nil {
+		t.Fatalf("create reader: %v", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, bytes.Join(docs, nil)) {
+		t.Error("decompressed data doesn't match the source")
+	}
+}
+
+func TestZstdDictSmaller(t *testing.T) {
+	dict := TrainZstdDict(oplogLike(200, 0), 16<<10)
+	// a small chunk gains the most, there is little to refer to in it
+	docs := oplogLike(5, 5000)
+
+	plain := compressDocs(t, docs, nil)
+	withDict := compressDocs(t, docs, dict)
+	if len(withDict) >= len(plain)*3/4 {
+		t.Errorf("expected the dictionary to save at least a quarter: plain %d, with dict %d",
+			len(plain), len(withDict))
+	}
+}
+
+func TestTrainZstdDict(t *testing.T) {
+	samples := [][]byte{[]byte("aaaa"), []byte("bbbb"), []byte("cccc"), []byte("bbbb"), nil}
+
+	cases := []struct {
+		size int
+		want string
+	}{
+		{0, ""},
+		{3, ""},
+		{4, "bbbb"},
+		{8, "ccccbbbb"},
+		{100, "aaaaccccbbbb"},
+	}
+	for _, c := range cases {
+		got := TrainZstdDict(samples, c.size)
+		if string(got) != c.want {
+			t.Errorf("size %d: expected %q, got %q", c.size, c.want, got)
+		}
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -14,6 +16,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 	"gopkg.in/yaml.v2"
 
 	"github.com/percona/percona-backup-mongodb/pbm/compress"
@@ -32,6 +35,9 @@ type Config struct {
 	Restore RestoreConf         `bson:"restore" json:"restore,omitempty" yaml:"restore,omitempty"`
 	Backup  BackupConf          `bson:"backup" json:"backup,omitempty" yaml:"backup,omitempty"`
 	Epoch   primitive.Timestamp `bson:"epoch" json:"-" yaml:"-"`
+	// Generation is bumped on every config change. Agents use it
+	// to detect that the config they've seen before is outdated.
+	Generation int64 `bson:"generation,omitempty" json:"-" yaml:"-"`
 }
 
 func (c Config) String() string {
@@ -75,6 +81,21 @@ type PITRConf struct {
 	OplogOnly        bool                     `bson:"oplogOnly,omitempty" json:"oplogOnly,omitempty" yaml:"oplogOnly,omitempty"`
 	Compression      compress.CompressionType `bson:"compression,omitempty" json:"compression,omitempty" yaml:"compression,omitempty"`
 	CompressionLevel *int                     `bson:"compressionLevel,omitempty" json:"compressionLevel,omitempty" yaml:"compressionLevel,omitempty"`
+	// RestoreWindowMin is the span (in minutes) back from now that has to
+	// stay restorable. Deletion of chunks that would make a gap within it
+	// is refused. Zero disables the check.
+	RestoreWindowMin float64 `bson:"restoreWindowMin,omitempty" json:"restoreWindowMin,omitempty" yaml:"restoreWindowMin,omitempty"`
+	// PipelineDepth is the num of chunks read ahead while the previous
+	// ones are being uploaded when the slicer falls behind. Zero or one
+	// means chunks are made one by one.
+	PipelineDepth int `bson:"pipelineDepth,omitempty" json:"pipelineDepth,omitempty" yaml:"pipelineDepth,omitempty"`
+	// ChunkMaxBytes caps the size of the oplog in a chunk. A chunk is cut
+	// on the span or on the size, whichever comes first. Zero means no cap.
+	ChunkMaxBytes int64 `bson:"chunkMaxBytes,omitempty" json:"chunkMaxBytes,omitempty" yaml:"chunkMaxBytes,omitempty"`
+	// ZstdDictSize is the max size of the dictionary trained from a sample
+	// of the oplog when the slicing starts. Zstd chunks are compressed with
+	// it. Zero means no dictionary.
+	ZstdDictSize int `bson:"zstdDictSize,omitempty" json:"zstdDictSize,omitempty" yaml:"zstdDictSize,omitempty"`
 }
 
 // StorageConf is a configuration of the backup storage
@@ -137,6 +158,11 @@ type RestoreConf struct {
 	// num of documents to buffer
 	BatchSize           int `bson:"batchSize" json:"batchSize,omitempty" yaml:"batchSize,omitempty"`
 	NumInsertionWorkers int `bson:"numInsertionWorkers" json:"numInsertionWorkers,omitempty" yaml:"numInsertionWorkers,omitempty"`
+	// NumParallelCollections is the num of collections restored at once
+	// during the snapshot restore. Indexes are built afterwards, so
+	// collections don't depend on each other. By default, it's the num of
+	// collections the backup was made with.
+	NumParallelCollections int `bson:"numParallelCollections,omitempty" json:"numParallelCollections,omitempty" yaml:"numParallelCollections,omitempty"`
 
 	// NumDownloadWorkers sets the num of goroutine would be requesting chunks
 	// during the download. By default, it's set to GOMAXPROCS.
@@ -150,6 +176,200 @@ type RestoreConf struct {
 	// physical restore. Will try $PATH/mongod if not set.
 	MongodLocation    string            `bson:"mongodLocation" json:"mongodLocation,omitempty" yaml:"mongodLocation,omitempty"`
 	MongodLocationMap map[string]string `bson:"mongodLocationMap" json:"mongodLocationMap,omitempty" yaml:"mongodLocationMap,omitempty"`
+
+	// OplogOpsPerSec and OplogBytesPerSec limit the oplog apply rate during
+	// logical restore to lessen the load on the node. Zero means no limit.
+	OplogOpsPerSec   int64 `bson:"oplogOpsPerSec,omitempty" json:"oplogOpsPerSec,omitempty" yaml:"oplogOpsPerSec,omitempty"`
+	OplogBytesPerSec int64 `bson:"oplogBytesPerSec,omitempty" json:"oplogBytesPerSec,omitempty" yaml:"oplogBytesPerSec,omitempty"`
+
+	// MaxDecompressBufferMb limits the memory the oplog chunk decompressor
+	// may use. Zero means codec defaults.
+	MaxDecompressBufferMb int `bson:"maxDecompressBufferMb,omitempty" json:"maxDecompressBufferMb,omitempty" yaml:"maxDecompressBufferMb,omitempty"`
+	// OplogReadBufferKb is the size of the buffer the oplog chunk is read
+	// from the storage through. Larger reads suit high-latency storages.
+	// Zero means no extra buffering.
+	OplogReadBufferKb int `bson:"oplogReadBufferKb,omitempty" json:"oplogReadBufferKb,omitempty" yaml:"oplogReadBufferKb,omitempty"`
+	// OplogPrefetch is the num of oplog chunks to download ahead of the apply.
+	// Zero disables prefetch. OplogPrefetchBufferMb is the memory budget for
+	// prefetched chunks shared by all restores in the agent. Prefetch waits
+	// when the budget is exhausted. Chunks bigger than the whole budget
+	// aren't prefetched but read from the storage as they're applied.
+	OplogPrefetch         int `bson:"oplogPrefetch,omitempty" json:"oplogPrefetch,omitempty" yaml:"oplogPrefetch,omitempty"`
+	OplogPrefetchBufferMb int `bson:"oplogPrefetchBufferMb,omitempty" json:"oplogPrefetchBufferMb,omitempty" yaml:"oplogPrefetchBufferMb,omitempty"`
+	// OplogPreDownload downloads all oplog chunks to a local temp dir
+	// before the replay, so storage failures abort the restore before any
+	// data is changed. The temp dir is created in OplogPreDownloadDir
+	// (the system temp dir if not set) and removed after the replay.
+	// It takes precedence over OplogPrefetch.
+	OplogPreDownload    bool   `bson:"oplogPreDownload,omitempty" json:"oplogPreDownload,omitempty" yaml:"oplogPreDownload,omitempty"`
+	OplogPreDownloadDir string `bson:"oplogPreDownloadDir,omitempty" json:"oplogPreDownloadDir,omitempty" yaml:"oplogPreDownloadDir,omitempty"`
+	// DownloadBytesPerSec limits the storage download rate during logical
+	// restore. The limit is shared by all downloads of the agent. Zero
+	// means no limit.
+	DownloadBytesPerSec int64 `bson:"downloadBytesPerSec,omitempty" json:"downloadBytesPerSec,omitempty" yaml:"downloadBytesPerSec,omitempty"`
+
+	// IndexBuildConcurrency is the num of collections to build indexes for
+	// at once after the oplog replay. Default is 1.
+	IndexBuildConcurrency int `bson:"indexBuildConcurrency,omitempty" json:"indexBuildConcurrency,omitempty" yaml:"indexBuildConcurrency,omitempty"`
+	// InlineIndexBuild makes the oplog replay build indexes as soon as
+	// their ops are applied instead of a single pass after the last chunk.
+	InlineIndexBuild bool `bson:"inlineIndexBuild,omitempty" json:"inlineIndexBuild,omitempty" yaml:"inlineIndexBuild,omitempty"`
+	// SkipIncompatibleIndexes skips indexes the server refuses to create
+	// (e.g. because of options it doesn't support anymore) instead of
+	// failing the restore. Skipped indexes are listed in the restore meta.
+	SkipIncompatibleIndexes bool `bson:"skipIncompatibleIndexes,omitempty" json:"skipIncompatibleIndexes,omitempty" yaml:"skipIncompatibleIndexes,omitempty"`
+
+	// ProgressFlushSec is how often (in seconds) the oplog replay progress
+	// is written to the restore metadata. Default is 5 sec.
+	ProgressFlushSec int `bson:"progressFlushSec,omitempty" json:"progressFlushSec,omitempty" yaml:"progressFlushSec,omitempty"`
+
+	// DistTxnRetention is the num of the last committed distributed
+	// transactions each shard shares with others to reconcile the ones
+	// left uncommitted by the end of the oplog. Default is 100.
+	DistTxnRetention int `bson:"distTxnRetention,omitempty" json:"distTxnRetention,omitempty" yaml:"distTxnRetention,omitempty"`
+	// TxnSyncTimeoutSec is the max time (in seconds) to wait for other shards
+	// to share their committed distributed transactions after the oplog
+	// replay. Not set or zero means without limit.
+	TxnSyncTimeoutSec int `bson:"txnSyncTimeoutSec,omitempty" json:"txnSyncTimeoutSec,omitempty" yaml:"txnSyncTimeoutSec,omitempty"`
+
+	// OplogWriteConcern is the write concern of the ops applied during
+	// the oplog replay. Not set means the server default. The physical
+	// restore replays the oplog with w: 1 regardless.
+	OplogWriteConcern *WriteConcernConf `bson:"oplogWriteConcern,omitempty" json:"oplogWriteConcern,omitempty" yaml:"oplogWriteConcern,omitempty"`
+	// OplogSkipSystemNS skips ops of the `config` and `local` databases
+	// and `admin.system.*` collections during the oplog replay not to
+	// clobber the config of the live cluster. It's not applied on the
+	// config server as its `config` database is the cluster metadata.
+	OplogSkipSystemNS bool `bson:"oplogSkipSystemNS,omitempty" json:"oplogSkipSystemNS,omitempty" yaml:"oplogSkipSystemNS,omitempty"`
+	// OplogContinueOnApplyError skips ops the server rejects (e.g. with
+	// a duplicate key) during the oplog replay instead of failing the
+	// restore. Connection, write concern and not primary errors still
+	// fail it. Skipped ops are logged and listed in the restore meta.
+	// For the best-effort recovery only.
+	OplogContinueOnApplyError bool `bson:"oplogContinueOnApplyError,omitempty" json:"oplogContinueOnApplyError,omitempty" yaml:"oplogContinueOnApplyError,omitempty"`
+
+	// SlowChunkWarnSec warns if applying a single oplog chunk takes longer
+	// (in seconds). Zero disables the warning.
+	SlowChunkWarnSec int `bson:"slowChunkWarnSec,omitempty" json:"slowChunkWarnSec,omitempty" yaml:"slowChunkWarnSec,omitempty"`
+
+	// ChunksWarnThreshold is the num of oplog chunks of the restore to warn
+	// on, as replaying that many chunks is slow. Default is 10000.
+	// Negative disables the warning.
+	ChunksWarnThreshold int `bson:"chunksWarnThreshold,omitempty" json:"chunksWarnThreshold,omitempty" yaml:"chunksWarnThreshold,omitempty"`
+
+	// ClockSkewWarnSec is the spread of shards heartbeats (in seconds) to
+	// warn on as the clocks may be skewed. Default is 10 sec.
+	ClockSkewWarnSec int `bson:"clockSkewWarnSec,omitempty" json:"clockSkewWarnSec,omitempty" yaml:"clockSkewWarnSec,omitempty"`
+	// RelaxStaleOnSkew extends the stale heartbeat frame by the observed
+	// skew (up to twice) instead of failing with "lost shard".
+	RelaxStaleOnSkew bool `bson:"relaxStaleOnSkew,omitempty" json:"relaxStaleOnSkew,omitempty" yaml:"relaxStaleOnSkew,omitempty"`
+	// StatusPollMs is how often (in milliseconds) shards statuses are polled
+	// while the cluster moves to the next status. Default is 1 sec.
+	StatusPollMs int `bson:"statusPollMs,omitempty" json:"statusPollMs,omitempty" yaml:"statusPollMs,omitempty"`
+	// StaleCheckSec is how often (in seconds) shards heartbeats are checked
+	// for staleness during the status polls. Default is on every poll.
+	StaleCheckSec int `bson:"staleCheckSec,omitempty" json:"staleCheckSec,omitempty" yaml:"staleCheckSec,omitempty"`
+
+	// Timeouts sets the max time (in seconds) for all shards to reach the
+	// given status during logical restore (e.g. `running: 600`). Not set or
+	// zero means the default behavior: wait for the start for WaitActionStart,
+	// for other statuses - without limit.
+	Timeouts map[Status]uint32 `bson:"timeouts,omitempty" json:"timeouts,omitempty" yaml:"timeouts,omitempty"`
+
+	// OnShardError is the policy of the logical restore when a shard fails,
+	// see ShardErrorFailFast (default) and ShardErrorDrain.
+	OnShardError string `bson:"onShardError,omitempty" json:"onShardError,omitempty" yaml:"onShardError,omitempty"`
+}
+
+// Policies of the restore on a shard failure
+const (
+	// ShardErrorFailFast fails the restore as soon as any shard fails
+	ShardErrorFailFast = "failFast"
+	// ShardErrorDrain lets other shards reach the status (or fail) and then
+	// fails the restore naming all failed shards. So healthy shards keep
+	// the progress they could make. The failure of the config server
+	// (the restore leader) still fails the restore at once.
+	ShardErrorDrain = "drain"
+)
+
+// WriteConcernConf is a write concern setting
+//
+//nolint:lll
+type WriteConcernConf struct {
+	// W is the num of nodes, "majority" or a custom write concern name
+	W string `bson:"w,omitempty" json:"w,omitempty" yaml:"w,omitempty"`
+	// J requests acknowledgment the write is written to the on-disk journal
+	J *bool `bson:"j,omitempty" json:"j,omitempty" yaml:"j,omitempty"`
+	// WTimeoutMs is the time limit for the write concern (in milliseconds)
+	WTimeoutMs int `bson:"wtimeoutMs,omitempty" json:"wtimeoutMs,omitempty" yaml:"wtimeoutMs,omitempty"`
+}
+
+// WriteConcern returns the driver write concern. Nil if nothing is set,
+// meaning the server default. Returns an error on settings that make no
+// sense for the restore.
+func (c *WriteConcernConf) WriteConcern() (*writeconcern.WriteConcern, error) {
+	if c == nil || (c.W == "" && c.J == nil && c.WTimeoutMs == 0) {
+		return nil, nil //nolint:nilnil
+	}
+
+	wc := &writeconcern.WriteConcern{Journal: c.J}
+	if c.W != "" {
+		n, err := strconv.Atoi(c.W)
+		switch {
+		case err != nil:
+			wc.W = c.W
+		case n < 0:
+			return nil, errors.Errorf("negative w: %d", n)
+		case n == 0:
+			// applyOps result has to be checked
+			return nil, errors.New("w: 0 (unacknowledged) isn't allowed for the restore")
+		default:
+			wc.W = n
+		}
+	}
+
+	if c.WTimeoutMs < 0 {
+		return nil, errors.Errorf("negative wtimeout: %d", c.WTimeoutMs)
+	}
+	if c.WTimeoutMs > 0 && wc.W == 1 {
+		return nil, errors.New("wtimeout has no effect with w: 1")
+	}
+	wc.WTimeout = time.Duration(c.WTimeoutMs) * time.Millisecond
+
+	return wc, nil
+}
+
+// defaultChunksWarnThreshold is the default num of oplog chunks to warn on
+const defaultChunksWarnThreshold = 10000
+
+// ChunksWarnAt returns the num of oplog chunks to warn on. Zero means no warning.
+func (c RestoreConf) ChunksWarnAt() int {
+	switch {
+	case c.ChunksWarnThreshold < 0:
+		return 0
+	case c.ChunksWarnThreshold == 0:
+		return defaultChunksWarnThreshold
+	}
+
+	return c.ChunksWarnThreshold
+}
+
+// DrainOnShardError returns true if the restore should let healthy
+// shards reach the status before failing, see ShardErrorDrain
+func (c RestoreConf) DrainOnShardError() bool {
+	return c.OnShardError == ShardErrorDrain
+}
+
+// StatusTimeouts returns transition timeouts set for restore statuses
+func (c RestoreConf) StatusTimeouts() map[Status]time.Duration {
+	t := make(map[Status]time.Duration, len(c.Timeouts))
+	for s, sec := range c.Timeouts {
+		if sec > 0 {
+			t[s] = time.Duration(sec) * time.Second
+		}
+	}
+
+	return t
 }
 
 //nolint:lll
@@ -158,6 +378,27 @@ type BackupConf struct {
 	Timeouts         *BackupTimeouts          `bson:"timeouts,omitempty" json:"timeouts,omitempty" yaml:"timeouts,omitempty"`
 	Compression      compress.CompressionType `bson:"compression,omitempty" json:"compression,omitempty" yaml:"compression,omitempty"`
 	CompressionLevel *int                     `bson:"compressionLevel,omitempty" json:"compressionLevel,omitempty" yaml:"compressionLevel,omitempty"`
+	// CompressionByStorage is the default compression of backups to the
+	// storage type. backup.compression is used for storages that aren't set.
+	// The --compression of the backup command overrides both.
+	CompressionByStorage map[storage.Type]compress.CompressionType `bson:"compressionByStorage,omitempty" json:"compressionByStorage,omitempty" yaml:"compressionByStorage,omitempty"`
+	// MetaCompression is the compression of the backup metadata file on
+	// the storage. Plain JSON if not set.
+	MetaCompression compress.CompressionType `bson:"metaCompression,omitempty" json:"metaCompression,omitempty" yaml:"metaCompression,omitempty"`
+	// PreferRegion is the region (the "region" replset member tag) to
+	// prefer nodes from. Usually the one of the storage. Nodes from other
+	// regions are demoted but still may run a backup. It's ignored if
+	// Priority is set.
+	PreferRegion string `bson:"preferRegion,omitempty" json:"preferRegion,omitempty" yaml:"preferRegion,omitempty"`
+}
+
+// CompressionFor returns the default compression of backups to the storage type
+func (c *BackupConf) CompressionFor(t storage.Type) compress.CompressionType {
+	if ct, ok := c.CompressionByStorage[t]; ok && ct != "" {
+		return ct
+	}
+
+	return c.Compression
 }
 
 type BackupTimeouts struct {
@@ -205,21 +446,26 @@ func keys(t reflect.Type) confMap {
 	return v
 }
 
-func (p *PBM) SetConfigByte(buf []byte) error {
+func (p *PBM) SetConfigByte(buf []byte) ([]string, error) {
 	var cfg Config
 	err := yaml.UnmarshalStrict(buf, &cfg)
 	if err != nil {
-		return errors.Wrap(err, "unmarshal yaml")
+		return nil, errors.Wrap(err, "unmarshal yaml")
 	}
-	return errors.Wrap(p.SetConfig(cfg), "write to db")
+
+	warnings, err := p.SetConfig(cfg)
+	return warnings, errors.Wrap(err, "write to db")
 }
 
-func (p *PBM) SetConfig(cfg Config) error {
+// SetConfig validates and writes the config. Returned warnings are about
+// settings that are likely mistakes but don't prevent the config from
+// being set.
+func (p *PBM) SetConfig(cfg Config) ([]string, error) {
 	switch cfg.Storage.Type {
 	case storage.S3:
 		err := cfg.Storage.S3.Cast()
 		if err != nil {
-			return errors.Wrap(err, "cast storage")
+			return nil, errors.Wrap(err, "cast storage")
 		}
 
 		// call the function for notification purpose.
@@ -228,17 +474,27 @@ func (p *PBM) SetConfig(cfg Config) error {
 	case storage.Filesystem:
 		err := cfg.Storage.Filesystem.Cast()
 		if err != nil {
-			return errors.Wrap(err, "check config")
+			return nil, errors.Wrap(err, "check config")
 		}
 	}
 
-	if c := string(cfg.PITR.Compression); c != "" && !compress.IsValidCompressionType(c) {
-		return errors.Errorf("unsupported compression type: %q", c)
+	// nodes are unknown until agents are started. no check then
+	var nodes []string
+	agents, err := p.ListAgents()
+	if err == nil {
+		for _, a := range agents {
+			nodes = append(nodes, a.Node)
+		}
+	}
+
+	warnings, err := ValidateConfig(&cfg, nodes)
+	if err != nil {
+		return nil, err
 	}
 
 	ct, err := p.ClusterTime()
 	if err != nil {
-		return errors.Wrap(err, "get cluster time")
+		return nil, errors.Wrap(err, "get cluster time")
 	}
 
 	cfg.Epoch = ct
@@ -250,10 +506,10 @@ func (p *PBM) SetConfig(cfg Config) error {
 	_, err = p.Conn.Database(DB).Collection(ConfigCollection).UpdateOne(
 		p.ctx,
 		bson.D{},
-		bson.M{"$set": cfg},
+		configUpdate(cfg),
 		options.Update().SetUpsert(true),
 	)
-	return errors.Wrap(err, "mongo ConfigCollection UpdateOne")
+	return warnings, errors.Wrap(err, "mongo ConfigCollection UpdateOne")
 }
 
 func (p *PBM) SetConfigVar(key, val string) error {
@@ -297,9 +553,9 @@ func (p *PBM) SetConfigVar(key, val string) error {
 	switch key {
 	case "pitr.enabled":
 		return errors.Wrap(p.confSetPITR(key, v.(bool)), "write to db")
-	case "pitr.compression":
-		if c := v.(string); c != "" && !compress.IsValidCompressionType(c) {
-			return errors.Errorf("unsupported compression type: %q", c)
+	case "pitr.compression", "backup.metaCompression":
+		if err := checkCompression(compress.CompressionType(v.(string))); err != nil {
+			return errors.Wrap(err, key)
 		}
 	case "storage.filesystem.path":
 		if v.(string) == "" {
@@ -312,7 +568,7 @@ func (p *PBM) SetConfigVar(key, val string) error {
 	_, err = p.Conn.Database(DB).Collection(ConfigCollection).UpdateOne(
 		p.ctx,
 		bson.D{},
-		bson.M{"$set": bson.M{key: v}},
+		bson.M{"$set": bson.M{key: v}, "$inc": bson.M{"generation": 1}},
 	)
 
 	return errors.Wrap(err, "write to db")
@@ -334,7 +590,7 @@ func (p *PBM) DeleteConfigVar(key string) error {
 	_, err = p.Conn.Database(DB).Collection(ConfigCollection).UpdateOne(
 		p.ctx,
 		bson.D{},
-		bson.M{"$unset": bson.M{key: 1}},
+		bson.M{"$unset": bson.M{key: 1}, "$inc": bson.M{"generation": 1}},
 	)
 
 	return errors.Wrap(err, "write to db")
@@ -348,12 +604,22 @@ func (p *PBM) confSetPITR(k string, v bool) error {
 	_, err = p.Conn.Database(DB).Collection(ConfigCollection).UpdateOne(
 		p.ctx,
 		bson.D{},
-		bson.M{"$set": bson.M{k: v, "pitr.changed": time.Now().Unix(), "epoch": ct}},
+		bson.M{
+			"$set": bson.M{k: v, "pitr.changed": time.Now().Unix(), "epoch": ct},
+			"$inc": bson.M{"generation": 1},
+		},
 	)
 
 	return err
 }
 
+// configUpdate is the update replacing the config with cfg. The generation
+// is incremented by the db, so concurrent updates don't lose bumps.
+func configUpdate(cfg Config) bson.M {
+	cfg.Generation = 0
+	return bson.M{"$set": cfg, "$inc": bson.M{"generation": 1}}
+}
+
 // GetConfigVar returns value of given config vaiable
 func (p *PBM) GetConfigVar(key string) (interface{}, error) {
 	if !ValidateConfigKey(key) {
@@ -385,6 +651,82 @@ func (p *PBM) GetConfigVar(key string) (interface{}, error) {
 	}
 }
 
+// checkCompression checks the compression type of the config. Empty means
+// the default one. Only the exact type names are accepted as the config
+// value is used as is.
+func checkCompression(c compress.CompressionType) error {
+	if c == "" {
+		return nil
+	}
+	ct, err := compress.ParseType(string(c))
+	if err != nil {
+		return err
+	}
+	if ct != c {
+		return errors.Errorf("unsupported compression type %q, did you mean %q?", string(c), ct)
+	}
+	return nil
+}
+
+// ValidateConfig checks the config. Errors make it invalid while warnings
+// are about settings that are ignored or fall back to defaults. `nodes`
+// are agents' nodes (host:port) to check the backup priority against.
+// Nil nodes are not checked.
+func ValidateConfig(cfg *Config, nodes []string) ([]string, error) {
+	compressions := []struct {
+		name string
+		c    compress.CompressionType
+	}{
+		{"backup.compression", cfg.Backup.Compression},
+		{"backup.metaCompression", cfg.Backup.MetaCompression},
+		{"pitr.compression", cfg.PITR.Compression},
+	}
+	for _, c := range compressions {
+		if err := checkCompression(c.c); err != nil {
+			return nil, errors.Wrap(err, c.name)
+		}
+	}
+	for t, c := range cfg.Backup.CompressionByStorage {
+		if err := checkCompression(c); err != nil {
+			return nil, errors.Wrapf(err, "backup.compressionByStorage.%s", t)
+		}
+	}
+	if _, err := cfg.Restore.OplogWriteConcern.WriteConcern(); err != nil {
+		return nil, errors.Wrap(err, "restore.oplogWriteConcern")
+	}
+	switch cfg.Restore.OnShardError {
+	case "", ShardErrorFailFast, ShardErrorDrain:
+	default:
+		return nil, errors.Errorf("restore.onShardError: unknown policy %q, expected %q or %q",
+			cfg.Restore.OnShardError, ShardErrorFailFast, ShardErrorDrain)
+	}
+
+	known := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		known[n] = true
+	}
+
+	prio := make([]string, 0, len(cfg.Backup.Priority))
+	for n := range cfg.Backup.Priority {
+		prio = append(prio, n)
+	}
+	sort.Strings(prio)
+
+	var warnings []string
+	for _, n := range prio {
+		if sc := cfg.Backup.Priority[n]; sc < 0 {
+			warnings = append(warnings,
+				fmt.Sprintf("backup.priority: %q has negative priority %v, the default one is used instead", n, sc))
+		}
+		if nodes != nil && !known[n] {
+			warnings = append(warnings,
+				fmt.Sprintf("backup.priority: %q is not a known node, it's ignored", n))
+		}
+	}
+
+	return warnings, nil
+}
+
 // ValidateConfigKey checks if a config key valid
 func ValidateConfigKey(k string) bool {
 	_, ok := _confmap[k]
@@ -464,8 +806,46 @@ func (p *PBM) GetStorage(l *log.Event) (storage.Storage, error) {
 	return Storage(c, l)
 }
 
+// GetStorageOverride returns the storage of the given conf if set or
+// the configured one otherwise. The config itself isn't changed.
+func (p *PBM) GetStorageOverride(s *StorageConf, l *log.Event) (storage.Storage, error) {
+	c, err := p.GetConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "get config")
+	}
+	if s != nil {
+		c.Storage = *s
+	}
+
+	return Storage(c, l)
+}
+
+// ReadStorageConf reads the storage section of the PBM config file
+func ReadStorageConf(cfgPath string) (*StorageConf, error) {
+	buf, err := os.ReadFile(cfgPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read storage config file")
+	}
+
+	var cfg Config
+	err = yaml.UnmarshalStrict(buf, &cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to  unmarshal storage config file")
+	}
+	if cfg.Storage.Type == storage.Undef {
+		return nil, errors.Errorf("no storage defined in %s", cfgPath)
+	}
+
+	return &cfg.Storage, nil
+}
+
 // Storage creates and returns a storage object based on a given config
 func Storage(c Config, l *log.Event) (storage.Storage, error) {
+	err := resolveStorageSecrets(&c.Storage, c.Epoch)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve storage credentials")
+	}
+
 	switch c.Storage.Type {
 	case storage.S3:
 		return s3.New(c.Storage.S3, l)
@@ -481,3 +861,112 @@ func Storage(c Config, l *log.Event) (storage.Storage, error) {
 		return nil, errors.Errorf("unknown storage type %s", c.Storage.Type)
 	}
 }
+
+// storageCreds returns the storage credentials by their config keys
+func storageCreds(c *StorageConf) map[string]*string {
+	switch c.Type {
+	case storage.S3:
+		return map[string]*string{
+			"storage.s3.credentials.access-key-id":     &c.S3.Credentials.AccessKeyID,
+			"storage.s3.credentials.secret-access-key": &c.S3.Credentials.SecretAccessKey,
+			"storage.s3.credentials.session-token":     &c.S3.Credentials.SessionToken,
+		}
+	case storage.Azure:
+		return map[string]*string{
+			"storage.azure.credentials.key": &c.Azure.Credentials.Key,
+		}
+	}
+
+	return nil
+}
+
+// CheckStorageSecretRefs fails if any of the storage credentials is set
+// as is rather than as a reference to the secret (see storage.IsSecretRef).
+// Such a storage conf can be passed along with a command as the secrets
+// are resolved only where the storage is used.
+func CheckStorageSecretRefs(c *StorageConf) error {
+	var plain []string
+	for k, v := range storageCreds(c) {
+		if *v != "" && !storage.IsSecretRef(*v) {
+			plain = append(plain, k)
+		}
+	}
+	if len(plain) != 0 {
+		sort.Strings(plain)
+		return errors.Errorf("credentials have to be secret references (%s, %s or %s): %s",
+			storage.SecretEnv, storage.SecretFile, storage.SecretVault, strings.Join(plain, ", "))
+	}
+
+	return nil
+}
+
+// resolveStorageSecrets replaces references to external secrets
+// in the storage credentials with the secrets themselves
+func resolveStorageSecrets(c *StorageConf, epoch primitive.Timestamp) error {
+	for k, v := range storageCreds(c) {
+		if !storage.IsSecretRef(*v) {
+			continue
+		}
+
+		s, err := vaultSecrets.resolve(epoch, *v)
+		if err != nil {
+			return errors.WithMessage(err, k)
+		}
+		*v = s
+	}
+
+	return nil
+}
+
+// vaultSecrets keeps the Vault secrets of the current config epoch.
+// The storage is created for each chunk and going to Vault
+// each time is too costly.
+var vaultSecrets = &secretCache{ttl: vaultSecretTTL, now: time.Now}
+
+// vaultSecretTTL is how long a resolved Vault secret is used before it is
+// read again, so the secret rotated in Vault is picked up without
+// a config change.
+const vaultSecretTTL = 5 * time.Minute
+
+type secretCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	epoch   primitive.Timestamp
+	secrets map[string]cachedSecret
+}
+
+type cachedSecret struct {
+	val string
+	at  time.Time
+}
+
+// resolve returns the secret referenced by ref. Vault secrets are taken from
+// the cache if they were already resolved in the same config epoch and
+// not longer than ttl ago.
+func (c *secretCache) resolve(epoch primitive.Timestamp, ref string) (string, error) {
+	if !strings.HasPrefix(ref, storage.SecretVault) {
+		return storage.ResolveSecret(ref)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.epoch.Equal(epoch) || c.secrets == nil {
+		c.epoch = epoch
+		c.secrets = make(map[string]cachedSecret)
+	}
+	now := c.now()
+	if s, ok := c.secrets[ref]; ok && now.Sub(s.at) < c.ttl {
+		return s.val, nil
+	}
+
+	s, err := storage.ResolveSecret(ref)
+	if err != nil {
+		return "", err
+	}
+	c.secrets[ref] = cachedSecret{val: s, at: now}
+
+	return s, nil
+}
@@ -0,0 +1,392 @@
+package pbm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+)
+
+func TestWriteConcernConf(t *testing.T) {
+	yes := true
+
+	cases := []struct {
+		name     string
+		conf     *WriteConcernConf
+		w        interface{}
+		wtimeout time.Duration
+		err      bool
+	}{
+		{name: "not set"},
+		{name: "empty", conf: &WriteConcernConf{}},
+		{name: "majority", conf: &WriteConcernConf{W: "majority", WTimeoutMs: 1000}, w: "majority", wtimeout: time.Second},
+		{name: "num", conf: &WriteConcernConf{W: "2", J: &yes}, w: 2},
+		{name: "custom", conf: &WriteConcernConf{W: "dc"}, w: "dc"},
+		{name: "journal only", conf: &WriteConcernConf{J: &yes}},
+		{name: "unacknowledged", conf: &WriteConcernConf{W: "0"}, err: true},
+		{name: "negative w", conf: &WriteConcernConf{W: "-1"}, err: true},
+		{name: "negative wtimeout", conf: &WriteConcernConf{W: "majority", WTimeoutMs: -1}, err: true},
+		{name: "wtimeout with w1", conf: &WriteConcernConf{W: "1", WTimeoutMs: 1000}, err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			wc, err := c.conf.WriteConcern()
+			if c.err {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", wc)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if wc == nil {
+				if c.conf != nil && (c.conf.W != "" || c.conf.J != nil) {
+					t.Fatal("expected write concern, got nil")
+				}
+				return
+			}
+			if wc.W != c.w {
+				t.Errorf("expected w %v, got %v", c.w, wc.W)
+			}
+			if wc.WTimeout != c.wtimeout {
+				t.Errorf("expected wtimeout %v, got %v", c.wtimeout, wc.WTimeout)
+			}
+			if wc.Journal != c.conf.J {
+				t.Errorf("expected j %v, got %v", c.conf.J, wc.Journal)
+			}
+		})
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	nodes := []string{"rs0-0:27017", "rs0-1:27017"}
+
+	t.Run("valid", func(t *testing.T) {
+		cfg := &Config{
+			Backup: BackupConf{
+				Priority:    map[string]float64{"rs0-0:27017": 2, "rs0-1:27017": 0.5},
+				Compression: compress.CompressionTypeZstandard,
+			},
+			PITR: PITRConf{Compression: compress.CompressionTypeS2},
+		}
+		warnings, err := ValidateConfig(cfg, nodes)
+		if err != nil || len(warnings) != 0 {
+			t.Errorf("expected no warnings and errors, got %v, %v", warnings, err)
+		}
+	})
+
+	t.Run("unknown node", func(t *testing.T) {
+		cfg := &Config{Backup: BackupConf{Priority: map[string]float64{"rs0-0:27017": 1, "rs0-2:27017": 1}}}
+		warnings, err := ValidateConfig(cfg, nodes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(warnings) != 1 || !strings.Contains(warnings[0], "rs0-2:27017") {
+			t.Errorf("expected warning about rs0-2:27017, got %v", warnings)
+		}
+
+		// agents aren't started yet
+		warnings, _ = ValidateConfig(cfg, nil)
+		if len(warnings) != 0 {
+			t.Errorf("expected no warnings without known nodes, got %v", warnings)
+		}
+	})
+
+	t.Run("negative priority", func(t *testing.T) {
+		cfg := &Config{Backup: BackupConf{Priority: map[string]float64{"rs0-1:27017": -1}}}
+		warnings, err := ValidateConfig(cfg, nodes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(warnings) != 1 || !strings.Contains(warnings[0], "negative") {
+			t.Errorf("expected warning about negative priority, got %v", warnings)
+		}
+	})
+
+	compressions := map[string]*Config{
+		"backup.compression":     {Backup: BackupConf{Compression: "zip"}},
+		"backup.metaCompression": {Backup: BackupConf{MetaCompression: "zip"}},
+		"pitr.compression":       {PITR: PITRConf{Compression: "zip"}},
+	}
+	for name, cfg := range compressions {
+		t.Run(name, func(t *testing.T) {
+			_, err := ValidateConfig(cfg, nodes)
+			if err == nil || !strings.Contains(err.Error(), name) {
+				t.Errorf("expected %s error, got %v", name, err)
+			}
+		})
+	}
+
+	t.Run("restore.onShardError", func(t *testing.T) {
+		cfg := &Config{Restore: RestoreConf{OnShardError: "ignore"}}
+		_, err := ValidateConfig(cfg, nodes)
+		if err == nil || !strings.Contains(err.Error(), `unknown policy "ignore"`) {
+			t.Errorf("expected unknown policy error, got %v", err)
+		}
+
+		cfg.Restore.OnShardError = ShardErrorDrain
+		if _, err = ValidateConfig(cfg, nodes); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("not exact type name", func(t *testing.T) {
+		cfg := &Config{PITR: PITRConf{Compression: "ZSTD"}}
+		_, err := ValidateConfig(cfg, nodes)
+		if err == nil || !strings.Contains(err.Error(), `did you mean "zstd"`) {
+			t.Errorf("expected the hint on the type name, got %v", err)
+		}
+	})
+}
+
+func TestResolveStorageSecrets(t *testing.T) {
+	t.Setenv("PBM_TEST_KEY_ID", "key-id")
+	t.Setenv("PBM_TEST_SECRET_KEY", "secret-key")
+
+	c := StorageConf{Type: storage.S3}
+	c.S3.Credentials.AccessKeyID = "env:PBM_TEST_KEY_ID"
+	c.S3.Credentials.SecretAccessKey = "env:PBM_TEST_SECRET_KEY"
+	c.S3.Credentials.SessionToken = "inline-token"
+	if err := resolveStorageSecrets(&c, primitive.Timestamp{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.S3.Credentials.AccessKeyID != "key-id" ||
+		c.S3.Credentials.SecretAccessKey != "secret-key" ||
+		c.S3.Credentials.SessionToken != "inline-token" {
+		t.Errorf("unexpected credentials: %+v", c.S3.Credentials)
+	}
+
+	c = StorageConf{Type: storage.Azure}
+	c.Azure.Credentials.Key = "env:PBM_TEST_NO_SUCH_KEY"
+	err := resolveStorageSecrets(&c, primitive.Timestamp{})
+	if err == nil || !strings.Contains(err.Error(), "storage.azure.credentials.key") {
+		t.Errorf("expected error naming the field, got %v", err)
+	}
+
+	_, err = Storage(Config{Storage: c}, nil)
+	if err == nil || !strings.Contains(err.Error(), "resolve storage credentials") {
+		t.Errorf("expected storage construction to fail, got %v", err)
+	}
+}
+
+func TestVaultSecretsCache(t *testing.T) {
+	var hits int32
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		_, _ = w.Write([]byte(`{"data":{"data":{"key":"from-vault"}}}`))
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "tkn")
+
+	resolve := func(epoch primitive.Timestamp) {
+		t.Helper()
+		c := StorageConf{Type: storage.S3}
+		c.S3.Credentials.SecretAccessKey = "vault:secret/data/pbm#key"
+		if err := resolveStorageSecrets(&c, epoch); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if c.S3.Credentials.SecretAccessKey != "from-vault" {
+			t.Errorf("unexpected secret %q", c.S3.Credentials.SecretAccessKey)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		resolve(primitive.Timestamp{T: 1})
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("expected one vault request in the epoch, got %d", n)
+	}
+
+	resolve(primitive.Timestamp{T: 2})
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("expected the new epoch to request vault again, got %d requests", n)
+	}
+}
+
+func TestCheckStorageSecretRefs(t *testing.T) {
+	c := &StorageConf{Type: storage.S3}
+	c.S3.Credentials.AccessKeyID = "env:AWS_ACCESS_KEY_ID"
+	c.S3.Credentials.SecretAccessKey = "vault:secret/data/pbm#key"
+	if err := CheckStorageSecretRefs(c); err != nil {
+		t.Errorf("unexpected error for secret refs: %v", err)
+	}
+
+	c.S3.Credentials.SecretAccessKey = "plain-secret"
+	err := CheckStorageSecretRefs(c)
+	if err == nil || !strings.Contains(err.Error(), "storage.s3.credentials.secret-access-key") {
+		t.Errorf("expected the plain secret error, got %v", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "plain-secret") {
+		t.Errorf("the secret is leaked in the error: %v", err)
+	}
+
+	fs := &StorageConf{Type: storage.Filesystem}
+	if err := CheckStorageSecretRefs(fs); err != nil {
+		t.Errorf("unexpected error for the filesystem storage: %v", err)
+	}
+}
+
+func TestVaultSecretRotated(t *testing.T) {
+	var secret atomic.Value
+	secret.Store("old")
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"data":{"data":{"key":%q}}}`, secret.Load())
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "tkn")
+
+	now := time.Unix(1000, 0)
+	c := &secretCache{ttl: time.Minute, now: func() time.Time { return now }}
+	epoch := primitive.Timestamp{T: 1}
+	resolve := func() string {
+		t.Helper()
+		s, err := c.resolve(epoch, "vault:secret/data/pbm#key")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return s
+	}
+
+	if s := resolve(); s != "old" {
+		t.Fatalf("expected the old secret, got %q", s)
+	}
+
+	secret.Store("new")
+	now = now.Add(30 * time.Second)
+	if s := resolve(); s != "old" {
+		t.Errorf("expected the cached secret within ttl, got %q", s)
+	}
+
+	now = now.Add(time.Minute)
+	if s := resolve(); s != "new" {
+		t.Errorf("expected the rotated secret after ttl, got %q", s)
+	}
+}
+
+func TestBackupCompressionFor(t *testing.T) {
+	c := BackupConf{
+		Compression: compress.CompressionTypeS2,
+		CompressionByStorage: map[storage.Type]compress.CompressionType{
+			storage.S3:         compress.CompressionTypeZstandard,
+			storage.Filesystem: "",
+		},
+	}
+
+	if ct := c.CompressionFor(storage.S3); ct != compress.CompressionTypeZstandard {
+		t.Errorf("s3: expected %s, got %s", compress.CompressionTypeZstandard, ct)
+	}
+	if ct := c.CompressionFor(storage.Filesystem); ct != compress.CompressionTypeS2 {
+		t.Errorf("filesystem: expected %s, got %s", compress.CompressionTypeS2, ct)
+	}
+	if ct := c.CompressionFor(storage.Azure); ct != compress.CompressionTypeS2 {
+		t.Errorf("azure: expected %s, got %s", compress.CompressionTypeS2, ct)
+	}
+
+	c.CompressionByStorage[storage.Azure] = "brotli"
+	_, err := ValidateConfig(&Config{Backup: c}, nil)
+	if err == nil || !strings.Contains(err.Error(), "backup.compressionByStorage.azure") {
+		t.Errorf("expected invalid compression error, got %v", err)
+	}
+}
+
+func TestReadStorageConf(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(data), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		return p
+	}
+
+	c, err := ReadStorageConf(write("fs.yaml", "storage:\n  type: filesystem\n  filesystem:\n    path: /backups\n"))
+	if err != nil {
+		t.Fatalf("read storage conf: %v", err)
+	}
+	if c.Type != storage.Filesystem || c.Filesystem.Path != "/backups" {
+		t.Errorf("unexpected storage conf %+v", c)
+	}
+
+	if _, err = ReadStorageConf(write("none.yaml", "pitr:\n  enabled: false\n")); err == nil {
+		t.Error("expected an error on the config without storage")
+	}
+	if _, err = ReadStorageConf(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("expected an error on the missing file")
+	}
+}
+
+// configDoc applies config updates the way the db does, one at a time
+type configDoc struct {
+	mu  sync.Mutex
+	doc bson.M
+}
+
+func (d *configDoc) update(t *testing.T, upd bson.M) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b, err := bson.Marshal(upd["$set"])
+	if err != nil {
+		t.Errorf("marshal $set: %v", err)
+		return
+	}
+	var set bson.M
+	if err := bson.Unmarshal(b, &set); err != nil {
+		t.Errorf("unmarshal $set: %v", err)
+		return
+	}
+	inc, _ := upd["$inc"].(bson.M)
+	for k := range inc {
+		if _, ok := set[k]; ok {
+			t.Errorf("both $set and $inc of %q conflict", k)
+			return
+		}
+	}
+
+	for k, v := range set {
+		d.doc[k] = v
+	}
+	for k, v := range inc {
+		n, _ := d.doc[k].(int64)
+		d.doc[k] = n + int64(v.(int))
+	}
+}
+
+func TestConfigUpdateGeneration(t *testing.T) {
+	d := &configDoc{doc: bson.M{}}
+
+	// all writers have read the same config before the update
+	const writers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			cfg := Config{Generation: 5, Backup: BackupConf{Priority: map[string]float64{"a:27017": float64(i)}}}
+			d.update(t, configUpdate(cfg))
+		}()
+	}
+	wg.Wait()
+
+	if g := d.doc["generation"]; g != int64(writers) {
+		t.Errorf("expected generation %d after %d concurrent updates, got %v", writers, writers, g)
+	}
+}
@@ -2,6 +2,8 @@ package pbm
 
 import (
 	"fmt"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -301,6 +303,10 @@ func (p *PBM) deleteChunks(start, until primitive.Timestamp, stg storage.Storage
 		l.Debug("nothing to delete")
 	}
 
+	if err = p.CheckChunksDelete(chunks); err != nil {
+		return err
+	}
+
 	for _, chnk := range chunks {
 		err = stg.Delete(chnk.FName)
 		if err != nil && !errors.Is(err, storage.ErrNotExist) {
@@ -323,5 +329,169 @@ func (p *PBM) deleteChunks(start, until primitive.Timestamp, stg storage.Storage
 		l.Debug("deleted %s", chnk.FName)
 	}
 
+	return p.deleteUnusedDicts(stg, l)
+}
+
+// deleteUnusedDicts deletes the zstd dictionaries no chunk refers to
+// (see OplogChunk.Dict) from the storage.
+func (p *PBM) deleteUnusedDicts(stg storage.Storage, l *log.Event) error {
+	files, err := stg.List(PITRfsPrefix, zstdDictExt)
+	if err != nil {
+		return errors.Wrap(err, "list zstd dictionaries")
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	res, err := p.Conn.Database(DB).Collection(PITRChunksCollection).
+		Distinct(p.ctx, "dict", bson.M{"dict": bson.M{"$exists": true}})
+	if err != nil {
+		return errors.Wrap(err, "get zstd dictionaries of chunks")
+	}
+	used := make(map[string]bool, len(res))
+	for _, d := range res {
+		if name, ok := d.(string); ok {
+			used[name] = true
+		}
+	}
+
+	for _, name := range unusedDicts(files, used) {
+		err = stg.Delete(name)
+		if err != nil && !errors.Is(err, storage.ErrNotExist) {
+			return errors.Wrapf(err, "delete zstd dictionary '%s' from storage", name)
+		}
+		l.Debug("deleted %s", name)
+	}
+
+	return nil
+}
+
+// unusedDicts returns the names of the dictionary `files` listed in
+// PITRfsPrefix that aren't `used`
+func unusedDicts(files []storage.FileInfo, used map[string]bool) []string {
+	var rv []string
+	for _, f := range files {
+		name := path.Join(PITRfsPrefix, f.Name)
+		if !used[name] {
+			rv = append(rv, name)
+		}
+	}
+
+	return rv
+}
+
+// ProtectedChunksError means the chunks can't be deleted since it would
+// make a gap within the restore window (see PITRConf.RestoreWindowMin)
+type ProtectedChunksError struct {
+	Chunks      []OplogChunk
+	WindowStart primitive.Timestamp
+}
+
+func (e ProtectedChunksError) Error() string {
+	names := make([]string, 0, len(e.Chunks))
+	for _, c := range e.Chunks {
+		names = append(names, c.FName)
+	}
+
+	return fmt.Sprintf("%d chunk(s) are needed for the restore window since %v: %s",
+		len(e.Chunks), e.WindowStart, strings.Join(names, ", "))
+}
+
+func (ProtectedChunksError) Is(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	_, ok := err.(ProtectedChunksError) //nolint:errorlint
+	return ok
+}
+
+// Unprotected returns the chunks of `del` but the protected ones
+func (e ProtectedChunksError) Unprotected(del []OplogChunk) []OplogChunk {
+	prot := make(map[string]bool, len(e.Chunks))
+	for _, c := range e.Chunks {
+		prot[c.FName] = true
+	}
+
+	rv := make([]OplogChunk, 0, len(del))
+	for _, c := range del {
+		if !prot[c.FName] {
+			rv = append(rv, c)
+		}
+	}
+
+	return rv
+}
+
+// CheckChunksDelete returns ProtectedChunksError if deletion of the chunks
+// would make a gap within the configured restore window.
+func (p *PBM) CheckChunksDelete(del []OplogChunk) error {
+	if len(del) == 0 {
+		return nil
+	}
+
+	cfg, err := p.GetConfig()
+	if err != nil {
+		return errors.Wrap(err, "get config")
+	}
+	if cfg.PITR.RestoreWindowMin <= 0 {
+		return nil
+	}
+
+	all, err := p.PITRGetChunksSlice("", primitive.Timestamp{}, primitive.Timestamp{})
+	if err != nil {
+		return errors.Wrap(err, "get pitr chunks")
+	}
+
+	window := time.Duration(cfg.PITR.RestoreWindowMin * float64(time.Minute))
+	start := primitive.Timestamp{T: uint32(time.Now().Add(-window).Unix())}
+	if prot := protectedChunks(all, del, start); len(prot) > 0 {
+		return ProtectedChunksError{Chunks: prot, WindowStart: start}
+	}
+
 	return nil
 }
+
+// protectedChunks returns chunks of `del` whose deletion makes a gap
+// in the timeline of `all` chunks since windowStart. Chunks that end
+// before the window aren't protected.
+func protectedChunks(all, del []OplogChunk, windowStart primitive.Timestamp) []OplogChunk {
+	type chunkID struct {
+		rs         string
+		start, end primitive.Timestamp
+	}
+	id := func(c *OplogChunk) chunkID { return chunkID{c.RS, c.StartTS, c.EndTS} }
+
+	deleted := make(map[chunkID]bool, len(del))
+	for i := range del {
+		deleted[id(&del[i])] = true
+	}
+
+	keep := make(map[string][]OplogChunk)
+	end := make(map[string]primitive.Timestamp)
+	for i := range all {
+		c := &all[i]
+		if c.EndTS.After(end[c.RS]) {
+			end[c.RS] = c.EndTS
+		}
+		if !deleted[id(c)] {
+			keep[c.RS] = append(keep[c.RS], *c)
+		}
+	}
+
+	var prot []OplogChunk
+	for _, c := range del {
+		if !c.EndTS.After(windowStart) || !end[c.RS].After(windowStart) {
+			continue
+		}
+
+		for _, seg := range ChunksTimeline(keep[c.RS], windowStart, end[c.RS]) {
+			if seg.Gap && c.StartTS.Before(seg.End) && c.EndTS.After(seg.Start) {
+				prot = append(prot, c)
+				break
+			}
+		}
+	}
+
+	return prot
+}
@@ -0,0 +1,116 @@
+package pbm
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+)
+
+func TestProtectedChunks(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t} }
+	chunk := func(rs string, start, end uint32) OplogChunk {
+		return OplogChunk{RS: rs, FName: rs + "/" + string(rune('a'+start/10)), StartTS: ts(start), EndTS: ts(end)}
+	}
+	all := []OplogChunk{
+		chunk("rs0", 0, 10),
+		chunk("rs0", 10, 20),
+		chunk("rs0", 20, 30),
+		chunk("rs0", 30, 40),
+		chunk("rs1", 0, 15),
+		chunk("rs1", 15, 40),
+	}
+
+	cases := []struct {
+		name   string
+		del    []OplogChunk
+		window uint32
+		expect []OplogChunk
+	}{
+		{
+			name:   "expired",
+			del:    []OplogChunk{all[0], all[1], all[4]},
+			window: 25,
+		},
+		{
+			name:   "window boundary",
+			del:    []OplogChunk{all[0], all[1], all[2]},
+			window: 25,
+			expect: []OplogChunk{all[2]},
+		},
+		{
+			name:   "window boundary other rs",
+			del:    []OplogChunk{all[4], all[5]},
+			window: 25,
+			expect: []OplogChunk{all[5]},
+		},
+		{
+			name:   "within window",
+			del:    []OplogChunk{all[2]},
+			window: 5,
+			expect: []OplogChunk{all[2]},
+		},
+		{
+			name:   "ends at window start",
+			del:    []OplogChunk{all[0], all[1]},
+			window: 20,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := protectedChunks(all, c.del, ts(c.window))
+			if !reflect.DeepEqual(got, c.expect) {
+				t.Errorf("expected protected %v, got %v", c.expect, got)
+			}
+		})
+	}
+}
+
+func TestProtectedChunksError(t *testing.T) {
+	err := error(ProtectedChunksError{Chunks: []OplogChunk{{FName: "c1"}}})
+	if !errors.Is(err, ProtectedChunksError{}) {
+		t.Errorf("expected ProtectedChunksError, got %v", err)
+	}
+
+	var pe ProtectedChunksError
+	if !errors.As(err, &pe) || len(pe.Chunks) != 1 {
+		t.Errorf("expected protected chunks in the error, got %v", err)
+	}
+}
+
+func TestUnusedDicts(t *testing.T) {
+	files := []storage.FileInfo{
+		{Name: "rs0/dict-00000001.zdict"},
+		{Name: "rs0/dict-00000002.zdict"},
+		{Name: "rs1/dict-00000003.zdict"},
+	}
+	used := map[string]bool{
+		ZstdDictName("rs0", 2): true,
+		ZstdDictName("rs1", 3): true,
+	}
+
+	got := unusedDicts(files, used)
+	want := []string{ZstdDictName("rs0", 1)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestProtectedChunksUnprotected(t *testing.T) {
+	del := []OplogChunk{
+		{RS: "rs0", FName: "rs0/a"},
+		{RS: "rs0", FName: "rs0/b"},
+		{RS: "rs1", FName: "rs1/a"},
+	}
+	perr := ProtectedChunksError{Chunks: []OplogChunk{del[1]}}
+
+	got := perr.Unprotected(del)
+	want := []OplogChunk{del[0], del[2]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
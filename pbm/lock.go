@@ -334,6 +334,21 @@ func (l *Lock) beat() error {
 	return errors.Wrap(err, "set timestamp")
 }
 
+// LockBeat refreshes the heartbeat of the lock(s) matching the given header
+func (p *PBM) LockBeat(lh *LockHeader) error {
+	ts, err := p.ClusterTime()
+	if err != nil {
+		return errors.Wrap(err, "read cluster time")
+	}
+
+	_, err = p.Conn.Database(DB).Collection(LockCollection).UpdateMany(
+		p.ctx,
+		lh,
+		bson.M{"$set": bson.M{"hb": ts}},
+	)
+	return errors.Wrap(err, "set timestamp")
+}
+
 func (p *PBM) GetLockData(lh *LockHeader) (LockData, error) {
 	return p.getLockData(lh, p.Conn.Database(DB).Collection(LockCollection))
 }
@@ -360,10 +375,38 @@ func (p *PBM) GetOpLocks(lh *LockHeader) ([]LockData, error) {
 	return p.getLocks(lh, p.Conn.Database(DB).Collection(LockOpCollection))
 }
 
-func (p *PBM) getLocks(lh *LockHeader, cl *mongo.Collection) ([]LockData, error) {
+// GetReplsetsLocks returns the locks of the operation held by any of
+// the replsets. Replsets without the lock are missing in the result.
+func (p *PBM) GetReplsetsLocks(t Command, opid string, rss []string) ([]LockData, error) {
+	return p.getLocks(bson.M{
+		"type":    t,
+		"opid":    opid,
+		"replset": bson.M{"$in": rss},
+	}, p.Conn.Database(DB).Collection(LockCollection))
+}
+
+// NodeBusy returns the type of the operation the node holds the lock of,
+// CmdUndefined if none. PITR slicing isn't counted as backups stop it.
+func (p *PBM) NodeBusy(rs, node string) (Command, error) {
+	for _, get := range []func(*LockHeader) ([]LockData, error){p.GetLocks, p.GetOpLocks} {
+		locks, err := get(&LockHeader{Replset: rs, Node: node})
+		if err != nil {
+			return CmdUndefined, err
+		}
+		for _, l := range locks {
+			if l.Type != CmdPITR {
+				return l.Type, nil
+			}
+		}
+	}
+
+	return CmdUndefined, nil
+}
+
+func (p *PBM) getLocks(filter interface{}, cl *mongo.Collection) ([]LockData, error) {
 	var locks []LockData
 
-	cur, err := cl.Find(p.ctx, lh)
+	cur, err := cl.Find(p.ctx, filter)
 	if err != nil {
 		return nil, errors.Wrap(err, "get locks")
 	}
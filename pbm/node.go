@@ -3,6 +3,7 @@ package pbm
 import (
 	"context"
 	"fmt"
+	"regexp"
 	"strings"
 	"time"
 
@@ -303,6 +304,95 @@ func LastWrite(cn *mongo.Client, majority bool) (primitive.Timestamp, error) {
 	return lw, nil
 }
 
+// systemNSRe matches the namespaces of the admin, config and local databases
+var systemNSRe = regexp.MustCompile(`^(admin|config|local)\.`)
+
+// UserWriteAfter returns the timestamp of the first write to the user
+// namespaces in the node's oplog after the `after` timestamp. Noops and
+// writes to the admin, config and local databases (e.g. PBM's own metadata)
+// aren't counted, transactions are (see isUserWrite). It returns ErrNotFound
+// if there are no such writes. Only the oplog past `after` is scanned.
+func UserWriteAfter(cn *mongo.Client, after primitive.Timestamp) (primitive.Timestamp, error) {
+	ctx := context.TODO()
+	cur, err := cn.Database("local").Collection("oplog.rs").Find(
+		ctx,
+		bson.D{
+			{"ts", bson.M{"$gt": after}},
+			{"op", bson.M{"$ne": "n"}},
+			// transactions are logged as admin.$cmd commands
+			{"$or", bson.A{
+				bson.M{"ns": bson.M{"$not": primitive.Regex{Pattern: systemNSRe.String()}}},
+				bson.M{"ns": "admin.$cmd"},
+			}},
+		},
+		options.Find().SetSort(bson.D{{"$natural", 1}}).SetProjection(bson.D{{"ts", 1}, {"ns", 1}, {"o", 1}}),
+	)
+	if err != nil {
+		return primitive.Timestamp{}, errors.Wrap(err, "query oplog")
+	}
+	defer cur.Close(ctx)
+
+	return firstUserWrite(ctx, cur)
+}
+
+// firstUserWrite returns the timestamp of the first user write (see
+// isUserWrite) among the oplog entries of the cursor
+func firstUserWrite(ctx context.Context, cur *mongo.Cursor) (primitive.Timestamp, error) {
+	for cur.Next(ctx) {
+		var op struct {
+			TS primitive.Timestamp `bson:"ts"`
+			NS string              `bson:"ns"`
+			O  bson.Raw            `bson:"o"`
+		}
+		if err := cur.Decode(&op); err != nil {
+			return primitive.Timestamp{}, errors.Wrap(err, "decode oplog entry")
+		}
+		if isUserWrite(op.NS, op.O) {
+			return op.TS, nil
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return primitive.Timestamp{}, errors.Wrap(err, "read oplog")
+	}
+
+	return primitive.Timestamp{}, ErrNotFound
+}
+
+// isUserWrite returns true if the oplog entry of the `ns` with the `o`
+// object writes to the user namespaces. Transactions are admin.$cmd
+// commands: applyOps counts if any of its ops does, the commit of a
+// prepared transaction always counts as its ops were logged before.
+func isUserWrite(ns string, o bson.Raw) bool {
+	if ns != "admin.$cmd" {
+		return !systemNSRe.MatchString(ns)
+	}
+	if _, err := o.LookupErr("commitTransaction"); err == nil {
+		return true
+	}
+
+	ops, ok := o.Lookup("applyOps").ArrayOK()
+	if !ok {
+		return false
+	}
+	vals, err := ops.Values()
+	if err != nil {
+		return false
+	}
+	for _, v := range vals {
+		op, ok := v.DocumentOK()
+		if !ok {
+			continue
+		}
+		ns, _ := op.Lookup("ns").StringValueOK()
+		inner, _ := op.Lookup("o").DocumentOK()
+		if isUserWrite(ns, inner) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // OplogStartTime returns either the oldest active transaction timestamp or the
 // current oplog time if there are no active transactions.
 // taken from https://github.com/mongodb/mongo-tools/blob/1b496c4a8ff7415abc07b9621166d8e1fac00c91/mongodump/oplog_dump.go#L68
@@ -0,0 +1,87 @@
+package pbm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestIsUserWrite(t *testing.T) {
+	raw := func(d bson.D) bson.Raw {
+		t.Helper()
+		b, err := bson.Marshal(d)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		return b
+	}
+	applyOps := func(nss ...string) bson.Raw {
+		ops := bson.A{}
+		for _, ns := range nss {
+			ops = append(ops, bson.D{{"op", "i"}, {"ns", ns}, {"o", bson.D{{"_id", 1}}}})
+		}
+		return raw(bson.D{{"applyOps", ops}})
+	}
+
+	cases := []struct {
+		name string
+		ns   string
+		o    bson.Raw
+		user bool
+	}{
+		{"user insert", "db.c", raw(bson.D{{"_id", 1}}), true},
+		{"pbm meta", "admin.pbmLock", raw(bson.D{{"_id", 1}}), false},
+		{"config", "config.system.sessions", raw(bson.D{{"_id", 1}}), false},
+		{"txn of user writes", "admin.$cmd", applyOps("admin.pbmLock", "db.c"), true},
+		{"txn of system writes", "admin.$cmd", applyOps("config.transactions"), false},
+		{"nested txn", "admin.$cmd", raw(bson.D{{"applyOps", bson.A{
+			bson.D{{"op", "c"}, {"ns", "admin.$cmd"}, {"o", applyOps("db.c")}},
+		}}}), true},
+		{"prepared txn commit", "admin.$cmd", raw(bson.D{{"commitTransaction", 1}}), true},
+		{"txn abort", "admin.$cmd", raw(bson.D{{"abortTransaction", 1}}), false},
+		{"admin command", "admin.$cmd", raw(bson.D{{"create", "pbmLog"}}), false},
+	}
+
+	for _, c := range cases {
+		if got := isUserWrite(c.ns, c.o); got != c.user {
+			t.Errorf("%s: expected user write %v, got %v", c.name, c.user, got)
+		}
+	}
+}
+
+func TestFirstUserWriteTxnTail(t *testing.T) {
+	entry := func(ts uint32, ns string, o bson.D) interface{} {
+		return bson.D{{"ts", primitive.Timestamp{T: ts, I: 1}}, {"ns", ns}, {"o", o}}
+	}
+	// the user data is only written in transactions
+	tail := []interface{}{
+		entry(101, "admin.pbmLock", bson.D{{"hb", 1}}),
+		entry(102, "admin.$cmd", bson.D{{"create", "pbmLog"}}),
+		entry(103, "admin.$cmd", bson.D{{"applyOps", bson.A{
+			bson.D{{"op", "i"}, {"ns", "db.c"}, {"o", bson.D{{"_id", 1}}}},
+		}}}),
+		entry(104, "db.c", bson.D{{"_id", 2}}),
+	}
+
+	first := func(docs []interface{}) (primitive.Timestamp, error) {
+		t.Helper()
+		cur, err := mongo.NewCursorFromDocuments(docs, nil, nil)
+		if err != nil {
+			t.Fatalf("create cursor: %v", err)
+		}
+		return firstUserWrite(context.Background(), cur)
+	}
+
+	ts, err := first(tail)
+	if err != nil || ts != (primitive.Timestamp{T: 103, I: 1}) {
+		t.Errorf("expected the transaction at 103, got %v, %v", ts, err)
+	}
+
+	if _, err = first(tail[:2]); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected no user writes, got %v", err)
+	}
+}
@@ -20,6 +20,10 @@ type OplogBackup struct {
 	stopC chan struct{}
 	start primitive.Timestamp
 	end   primitive.Timestamp
+	// maxBytes, if set, cuts the slice once that much is written
+	maxBytes int64
+	// cut is the ts of the last written op if the slice was cut
+	cut primitive.Timestamp
 }
 
 // NewOplogBackup creates a new Oplog instance
@@ -31,6 +35,22 @@ func NewOplogBackup(m *mongo.Client) *OplogBackup {
 func (ot *OplogBackup) SetTailingSpan(start, end primitive.Timestamp) {
 	ot.start = start
 	ot.end = end
+	ot.cut = primitive.Timestamp{}
+}
+
+// SetMaxBytes makes WriteTo stop once n bytes are written, so the slice
+// may end before the end of the tailing span (see End). Zero means no limit.
+func (ot *OplogBackup) SetMaxBytes(n int64) {
+	ot.maxBytes = n
+}
+
+// End returns the end of the slice written by the last WriteTo. It's the
+// end of the tailing span unless the slice was cut by the max bytes.
+func (ot *OplogBackup) End() primitive.Timestamp {
+	if !ot.cut.IsZero() {
+		return ot.cut
+	}
+	return ot.end
 }
 
 type InsuffRangeError struct {
@@ -79,13 +99,10 @@ func (ot *OplogBackup) WriteTo(w io.Writer) (int64, error) {
 	}
 	defer cur.Close(ctx)
 
-	opts := primitive.Timestamp{}
-	var ok, rcheck bool
-	var written int64
-	for cur.Next(ctx) {
-		opts.T, opts.I, ok = cur.Current.Lookup("ts").TimestampOK()
-		if !ok {
-			return written, errors.Errorf("get the timestamp of record %v", cur.Current)
+	var rcheck bool
+	return ot.writeOps(w, func() (bson.Raw, error) {
+		if !cur.Next(ctx) {
+			return nil, cur.Err()
 		}
 		// Before processing the first oplog record we check if oplog has sufficient range,
 		// i.e. if there are no gaps between the ts of the last backup or slice and
@@ -103,31 +120,62 @@ func (ot *OplogBackup) WriteTo(w io.Writer) (int64, error) {
 		if !rcheck {
 			ok, err := ot.IsSufficient(ot.start)
 			if err != nil {
-				return 0, errors.Wrap(err, "check oplog sufficiency")
+				return nil, errors.Wrap(err, "check oplog sufficiency")
 			}
 			if !ok {
-				return 0, InsuffRangeError{ot.start}
+				return nil, InsuffRangeError{ot.start}
 			}
 			rcheck = true
 		}
 
+		return cur.Current, nil
+	})
+}
+
+// writeOps writes ops returned by next until the end of the tailing span
+// or the max bytes. next returns nil when there are no more ops.
+func (ot *OplogBackup) writeOps(w io.Writer, next func() (bson.Raw, error)) (int64, error) {
+	ot.cut = primitive.Timestamp{}
+
+	opts := primitive.Timestamp{}
+	var ok bool
+	var written int64
+	for {
+		op, err := next()
+		if err != nil {
+			return written, err
+		}
+		if op == nil {
+			return written, nil
+		}
+
+		opts.T, opts.I, ok = op.Lookup("ts").TimestampOK()
+		if !ok {
+			return written, errors.Errorf("get the timestamp of record %v", op)
+		}
+
 		if primitive.CompareTimestamp(ot.end, opts) == -1 {
 			return written, nil
 		}
 
 		// skip noop operations
-		if cur.Current.Lookup("op").String() == string(pbm.OperationNoop) {
+		if op.Lookup("op").String() == string(pbm.OperationNoop) {
 			continue
 		}
 
-		n, err := w.Write(cur.Current)
+		n, err := w.Write(op)
 		if err != nil {
 			return written, errors.Wrap(err, "write to pipe")
 		}
 		written += int64(n)
-	}
 
-	return written, cur.Err()
+		// the next slice starts from the last op, so the cut has to
+		// be after the start. Otherwise, slicing wouldn't move on
+		if ot.maxBytes > 0 && written >= ot.maxBytes && opts.After(ot.start) && opts.Before(ot.end) {
+			ot.cut = opts
+			return written, nil
+		}
+	}
 }
 
 func (ot *OplogBackup) Cancel() {
@@ -155,6 +203,31 @@ func (ot *OplogBackup) IsSufficient(from primitive.Timestamp) (bool, error) {
 	return c != 0, nil
 }
 
+// Sample returns up to n most recent oplog entries, the oldest first
+func (ot *OplogBackup) Sample(n int64) ([][]byte, error) {
+	ctx := context.Background()
+	cur, err := ot.cl.Database("local").Collection("oplog.rs").Find(ctx,
+		bson.D{},
+		options.Find().SetSort(bson.D{{"$natural", -1}}).SetLimit(n))
+	if err != nil {
+		return nil, errors.Wrap(err, "get the oplog cursor")
+	}
+	defer cur.Close(ctx)
+
+	var ops [][]byte
+	for cur.Next(ctx) {
+		ops = append(ops, append([]byte(nil), cur.Current...))
+	}
+	if err := cur.Err(); err != nil {
+		return nil, errors.Wrap(err, "read the oplog")
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops, nil
+}
+
 // LastWrite returns a timestamp of the last write operation readable by majority reads
 func (ot *OplogBackup) LastWrite() (primitive.Timestamp, error) {
 	return pbm.LastWrite(ot.cl, true)
@@ -0,0 +1,74 @@
+package oplog
+
+import (
+	"bytes"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestWriteOpsCut(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+
+	var ops []bson.Raw
+	for i := uint32(10); i <= 30; i++ {
+		b, err := bson.Marshal(bson.D{
+			{Key: "ts", Value: ts(i)},
+			{Key: "op", Value: "i"},
+			{Key: "ns", Value: "test.c"},
+			{Key: "o", Value: bson.D{{Key: "_id", Value: int32(i)}}},
+		})
+		if err != nil {
+			t.Fatalf("marshal op: %v", err)
+		}
+		ops = append(ops, b)
+	}
+	opSize := int64(len(ops[0]))
+
+	cases := []struct {
+		name       string
+		start, end uint32
+		maxBytes   int64
+		expectEnd  uint32
+		expectOps  int
+	}{
+		{name: "no cap", start: 10, end: 20, expectEnd: 20, expectOps: 11},
+		{name: "span first", start: 10, end: 20, maxBytes: 100 * opSize, expectEnd: 20, expectOps: 11},
+		{name: "size first", start: 10, end: 20, maxBytes: 6 * opSize, expectEnd: 15, expectOps: 6},
+		{name: "size at the end", start: 10, end: 20, maxBytes: 11 * opSize, expectEnd: 20, expectOps: 11},
+		// the first op is the last one of the previous chunk
+		{name: "size at the start", start: 10, end: 20, maxBytes: 1, expectEnd: 11, expectOps: 2},
+		{name: "next chunk", start: 16, end: 20, maxBytes: 3 * opSize, expectEnd: 18, expectOps: 3},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ot := &OplogBackup{}
+			ot.SetTailingSpan(ts(c.start), ts(c.end))
+			ot.SetMaxBytes(c.maxBytes)
+
+			// ops are read from the start, as by the tailing cursor
+			next := ops[c.start-10:]
+			var buf bytes.Buffer
+			n, err := ot.writeOps(&buf, func() (bson.Raw, error) {
+				if len(next) == 0 {
+					return nil, nil
+				}
+				op := next[0]
+				next = next[1:]
+				return op, nil
+			})
+			if err != nil {
+				t.Fatalf("write ops: %v", err)
+			}
+
+			if ot.End() != ts(c.expectEnd) {
+				t.Errorf("expected end %v, got %v", ts(c.expectEnd), ot.End())
+			}
+			if n != int64(c.expectOps)*opSize || int64(buf.Len()) != n {
+				t.Errorf("expected %d ops written, got %d bytes (%d per op)", c.expectOps, n, opSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package oplog
+
+import (
+	"context"
+	"sync"
+
+	"github.com/mongodb/mongo-tools/common/idx"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// IndexBuilder creates and drops indexes on the restore destination
+type IndexBuilder interface {
+	// CreateIndexes builds given indexes for the collection
+	CreateIndexes(db, coll string, indexes []*idx.IndexDocument) error
+	// DropIndexes runs dropIndexes command (as it is in the oplog)
+	DropIndexes(db string, cmd bson.D) error
+}
+
+type mongoIndexBuilder struct {
+	ctx context.Context
+	cn  *mongo.Client
+	wc  *writeconcern.WriteConcern
+}
+
+// NewMongoIndexBuilder returns IndexBuilder that runs commands on cn
+// with the given write concern. Nil wc means the server default.
+func NewMongoIndexBuilder(ctx context.Context, cn *mongo.Client, wc *writeconcern.WriteConcern) IndexBuilder {
+	return &mongoIndexBuilder{ctx: ctx, cn: cn, wc: wc}
+}
+
+func (b *mongoIndexBuilder) CreateIndexes(db, coll string, indexes []*idx.IndexDocument) error {
+	for _, index := range indexes {
+		index.Options["ns"] = db + "." + coll
+		// remove the index version, forcing an update
+		delete(index.Options, "v")
+	}
+
+	cmd := bson.D{
+		{"createIndexes", coll},
+		{"indexes", indexes},
+		{"ignoreUnknownIndexOptions", true},
+	}
+	err := b.cn.Database(db).RunCommand(b.ctx, withWriteConcern(cmd, b.wc)).Err()
+	return errors.Wrapf(err, "createIndexes for %s.%s", db, coll)
+}
+
+func (b *mongoIndexBuilder) DropIndexes(db string, cmd bson.D) error {
+	err := b.cn.Database(db).RunCommand(b.ctx, withWriteConcern(cmd, b.wc)).Err()
+	if err != nil {
+		var cmdErr mongo.CommandError
+		// IndexNotFound and NamespaceNotFound
+		if errors.As(err, &cmdErr) && (cmdErr.Code == 27 || cmdErr.Code == 26) {
+			return nil
+		}
+		return errors.Wrapf(err, "dropIndexes in %s", db)
+	}
+
+	return nil
+}
+
+// isIncompatibleIndex reports whether the server refused to create the
+// index because of its spec or options rather than a transient failure
+func isIncompatibleIndex(err error) bool {
+	var cmdErr mongo.CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+
+	switch cmdErr.Code {
+	case 2, // BadValue
+		9,   // FailedToParse
+		67,  // CannotCreateIndex
+		197: // InvalidIndexSpecificationOption
+		return true
+	}
+
+	return false
+}
+
+// IncompatibleIndexes is IndexBuilder that records indexes the server
+// refused to create. They are skipped if `skip` is set, otherwise the
+// build fails as before.
+type IncompatibleIndexes struct {
+	IndexBuilder
+
+	skip bool
+	mu   sync.Mutex
+	list []pbm.IncompatibleIndex
+}
+
+func NewIncompatibleIndexes(b IndexBuilder, skip bool) *IncompatibleIndexes {
+	return &IncompatibleIndexes{IndexBuilder: b, skip: skip}
+}
+
+func (b *IncompatibleIndexes) CreateIndexes(db, coll string, indexes []*idx.IndexDocument) error {
+	err := b.IndexBuilder.CreateIndexes(db, coll, indexes)
+	if err == nil || !isIncompatibleIndex(err) {
+		return err
+	}
+
+	// the whole command fails because of any of the indexes,
+	// so find out which ones the server refuses
+	var failed error
+	for _, index := range indexes {
+		if len(indexes) > 1 {
+			err = b.IndexBuilder.CreateIndexes(db, coll, []*idx.IndexDocument{index})
+			if err == nil {
+				continue
+			}
+			if !isIncompatibleIndex(err) {
+				return err
+			}
+		}
+
+		name, _ := index.Options["name"].(string)
+		b.add(pbm.IncompatibleIndex{NS: db + "." + coll, Name: name, Reason: err.Error()})
+		if failed == nil {
+			failed = errors.Wrapf(err, "incompatible index %q", name)
+		}
+	}
+
+	if b.skip {
+		return nil
+	}
+
+	return failed
+}
+
+func (b *IncompatibleIndexes) add(i pbm.IncompatibleIndex) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.list = append(b.list, i)
+}
+
+// List returns indexes the server refused to create so far
+func (b *IncompatibleIndexes) List() []pbm.IncompatibleIndex {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]pbm.IncompatibleIndex(nil), b.list...)
+}
+
+// withWriteConcern returns the cmd with the write concern set. RunCommand
+// doesn't inherit it from the client or db options, hence it has to be
+// a part of the command. The cmd is returned as is if wc is nil.
+func withWriteConcern(cmd bson.D, wc *writeconcern.WriteConcern) bson.D {
+	if wc == nil {
+		return cmd
+	}
+
+	rv := make(bson.D, 0, len(cmd)+1)
+	rv = append(rv, cmd...)
+	return append(rv, bson.E{"writeConcern", wc})
+}
@@ -0,0 +1,122 @@
+package oplog
+
+import (
+	"testing"
+
+	"github.com/mongodb/mongo-tools/common/idx"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// legacyIndexBuilder refuses indexes with the `bucketSize` option
+// the same way mongo 5.0+ does for geoHaystack indexes
+type legacyIndexBuilder struct {
+	calls   int
+	created []string
+}
+
+func (b *legacyIndexBuilder) CreateIndexes(db, coll string, indexes []*idx.IndexDocument) error {
+	b.calls++
+	for _, index := range indexes {
+		if _, ok := index.Options["bucketSize"]; ok {
+			return mongo.CommandError{Code: 67, Message: "geoHaystack indexes are not supported"}
+		}
+	}
+	for _, index := range indexes {
+		b.created = append(b.created, index.Options["name"].(string))
+	}
+
+	return nil
+}
+
+func (b *legacyIndexBuilder) DropIndexes(string, bson.D) error { return nil }
+
+func testIndex(name string, opts bson.M) *idx.IndexDocument {
+	o := bson.M{"name": name}
+	for k, v := range opts {
+		o[k] = v
+	}
+
+	return &idx.IndexDocument{Key: bson.D{{Key: name, Value: 1}}, Options: o}
+}
+
+func TestIncompatibleIndexes(t *testing.T) {
+	indexes := func() []*idx.IndexDocument {
+		return []*idx.IndexDocument{
+			testIndex("a", nil),
+			testIndex("geo", bson.M{"bucketSize": 1}),
+			testIndex("b", nil),
+		}
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		lb := &legacyIndexBuilder{}
+		b := NewIncompatibleIndexes(lb, true)
+
+		err := b.CreateIndexes("db", "c", indexes())
+		if err != nil {
+			t.Fatalf("expected incompatible index to be skipped, got %v", err)
+		}
+		if len(lb.created) != 2 || lb.created[0] != "a" || lb.created[1] != "b" {
+			t.Errorf("expected compatible indexes [a b] to be created, got %v", lb.created)
+		}
+
+		list := b.List()
+		if len(list) != 1 || list[0].NS != "db.c" || list[0].Name != "geo" || list[0].Reason == "" {
+			t.Errorf("expected db.c geo to be recorded, got %+v", list)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		lb := &legacyIndexBuilder{}
+		b := NewIncompatibleIndexes(lb, false)
+
+		err := b.CreateIndexes("db", "c", indexes())
+		var cmdErr mongo.CommandError
+		if !errors.As(err, &cmdErr) || cmdErr.Code != 67 {
+			t.Fatalf("expected CannotCreateIndex error, got %v", err)
+		}
+
+		list := b.List()
+		if len(list) != 1 || list[0].Name != "geo" {
+			t.Errorf("expected geo to be recorded, got %+v", list)
+		}
+	})
+
+	t.Run("single index", func(t *testing.T) {
+		lb := &legacyIndexBuilder{}
+		b := NewIncompatibleIndexes(lb, true)
+
+		err := b.CreateIndexes("db", "c", []*idx.IndexDocument{testIndex("geo", bson.M{"bucketSize": 1})})
+		if err != nil {
+			t.Fatalf("expected incompatible index to be skipped, got %v", err)
+		}
+		if lb.calls != 1 {
+			t.Errorf("expected no retry of a single index, got %d calls", lb.calls)
+		}
+		if len(b.List()) != 1 {
+			t.Errorf("expected geo to be recorded, got %+v", b.List())
+		}
+	})
+
+	t.Run("other errors", func(t *testing.T) {
+		b := NewIncompatibleIndexes(failingIndexBuilder{}, true)
+
+		err := b.CreateIndexes("db", "c", indexes())
+		if err == nil {
+			t.Fatal("expected the error to be returned")
+		}
+		if len(b.List()) != 0 {
+			t.Errorf("expected nothing recorded, got %+v", b.List())
+		}
+	})
+}
+
+type failingIndexBuilder struct{}
+
+func (failingIndexBuilder) CreateIndexes(string, string, []*idx.IndexDocument) error {
+	return mongo.CommandError{Code: 91, Message: "shutdown in progress"}
+}
+
+func (failingIndexBuilder) DropIndexes(string, bson.D) error { return nil }
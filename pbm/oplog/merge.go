@@ -0,0 +1,95 @@
+package oplog
+
+import (
+	"io"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MergeReader merges oplog streams of several replsets into one stream
+// ordered by the cluster time of ops. Ops with the same timestamp keep
+// the order of the sources. Each source should be ordered on its own.
+type MergeReader struct {
+	srcs  []*db.BSONSource
+	heads []bson.Raw
+	ts    []primitive.Timestamp
+	buf   []byte
+	err   error
+}
+
+// NewMergeReader creates MergeReader of the given oplog streams
+func NewMergeReader(srcs ...io.ReadCloser) *MergeReader {
+	m := &MergeReader{
+		srcs:  make([]*db.BSONSource, len(srcs)),
+		heads: make([]bson.Raw, len(srcs)),
+		ts:    make([]primitive.Timestamp, len(srcs)),
+	}
+	for i, s := range srcs {
+		m.srcs[i] = db.NewBufferlessBSONSource(s)
+	}
+	for i := range m.srcs {
+		if m.err = m.load(i); m.err != nil {
+			break
+		}
+	}
+
+	return m
+}
+
+// load reads the next op of the i-th source
+func (m *MergeReader) load(i int) error {
+	m.heads[i] = m.srcs[i].LoadNext()
+	if m.heads[i] == nil {
+		return errors.Wrapf(m.srcs[i].Err(), "read source %d", i)
+	}
+
+	t, inc, ok := m.heads[i].Lookup("ts").TimestampOK()
+	if !ok {
+		return errors.Errorf("read source %d: no timestamp in op", i)
+	}
+	m.ts[i] = primitive.Timestamp{T: t, I: inc}
+
+	return nil
+}
+
+func (m *MergeReader) Read(p []byte) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+
+	if len(m.buf) == 0 {
+		next := -1
+		for i, h := range m.heads {
+			if h != nil && (next == -1 || m.ts[i].Before(m.ts[next])) {
+				next = i
+			}
+		}
+		if next == -1 {
+			return 0, io.EOF
+		}
+
+		m.buf = m.heads[next]
+		if m.err = m.load(next); m.err != nil {
+			return 0, m.err
+		}
+	}
+
+	n := copy(p, m.buf)
+	m.buf = m.buf[n:]
+	return n, nil
+}
+
+// Close closes all sources
+func (m *MergeReader) Close() error {
+	var err error
+	for i, s := range m.srcs {
+		if cerr := s.Close(); cerr != nil && err == nil {
+			err = errors.Wrapf(cerr, "close source %d", i)
+		}
+	}
+
+	return err
+}
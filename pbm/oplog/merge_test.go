@@ -0,0 +1,66 @@
+package oplog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMergeReader(t *testing.T) {
+	op := func(t, i uint32, ns string) db.Oplog {
+		return db.Oplog{Timestamp: primitive.Timestamp{T: t, I: i}, Operation: "n", Namespace: ns}
+	}
+
+	m := NewMergeReader(
+		oplogChunk(t, op(1, 1, "rs0"), op(3, 1, "rs0"), op(3, 2, "rs0"), op(7, 1, "rs0")),
+		oplogChunk(t, op(2, 1, "rs1"), op(3, 1, "rs1"), op(5, 1, "rs1")),
+		oplogChunk(t),
+	)
+	defer m.Close()
+
+	src := db.NewBufferlessBSONSource(io.NopCloser(m))
+	var got []string
+	for raw := src.LoadNext(); raw != nil; raw = src.LoadNext() {
+		o := db.Oplog{}
+		if err := bson.Unmarshal(raw, &o); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		got = append(got, fmt.Sprintf("%s@%v", o.Namespace, o.Timestamp))
+	}
+	if err := src.Err(); err != nil {
+		t.Fatalf("read merged: %v", err)
+	}
+
+	want := []string{
+		"rs0@{1 1}", "rs1@{2 1}", "rs0@{3 1}", "rs1@{3 1}",
+		"rs0@{3 2}", "rs1@{5 1}", "rs0@{7 1}",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("op %d: expected %s, got %s", i, want[i], got[i])
+		}
+	}
+}
+
+func TestMergeReaderNoTS(t *testing.T) {
+	b, err := bson.Marshal(bson.M{"op": "n"})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	m := NewMergeReader(
+		oplogChunk(t, db.Oplog{Timestamp: primitive.Timestamp{T: 1, I: 1}, Operation: "n"}),
+		io.NopCloser(bytes.NewReader(b)),
+	)
+	if _, err = io.ReadAll(m); err == nil {
+		t.Errorf("expected error on op without timestamp")
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"sort"
 	"strings"
 	"sync/atomic"
 
@@ -26,6 +27,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 
 	"github.com/percona/percona-backup-mongodb/pbm"
 	"github.com/percona/percona-backup-mongodb/pbm/snapshot"
@@ -39,6 +41,82 @@ type OpFilter func(*Record) bool
 
 func DefaultOpFilter(*Record) bool { return true }
 
+// CombineFilters returns the filter that passes the op only if all of
+// the filters pass it. Filters are called in the given order until the
+// first one rejecting the op, so cheaper filters should go first.
+// Nil filters are ignored.
+func CombineFilters(filters ...OpFilter) OpFilter {
+	fs := make([]OpFilter, 0, len(filters))
+	for _, f := range filters {
+		if f != nil {
+			fs = append(fs, f)
+		}
+	}
+
+	switch len(fs) {
+	case 0:
+		return DefaultOpFilter
+	case 1:
+		return fs[0]
+	}
+
+	return func(r *Record) bool {
+		for _, f := range fs {
+			if !f(r) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// IsSystemOp reports whether the op targets the `config` or `local`
+// database or system collections of the `admin` database. Collections
+// of other databases are user ones even if named `system.*` (e.g. views).
+// Commands of the `admin` database are checked by their target, so
+// transactions (applyOps) and renames of user collections are not.
+func IsSystemOp(r *Record) bool {
+	dbName, coll, _ := strings.Cut(r.Namespace, ".")
+	if coll != "$cmd" || r.Operation != "c" {
+		return isSystemNS(dbName, coll)
+	}
+
+	if dbName == "config" || dbName == "local" {
+		return true
+	}
+	if dbName != "admin" || len(r.Object) == 0 {
+		return false
+	}
+
+	switch cmd := r.Object[0]; cmd.Key {
+	case "applyOps":
+		return false
+	case "renameCollection":
+		from, _ := cmd.Value.(string)
+		to, _ := r.Object.Map()["to"].(string)
+		return isSystemFullNS(from) || isSystemFullNS(to)
+	default:
+		coll, _ := cmd.Value.(string)
+		return isSystemNS(dbName, coll)
+	}
+}
+
+func isSystemFullNS(ns string) bool {
+	dbName, coll, _ := strings.Cut(ns, ".")
+	return isSystemNS(dbName, coll)
+}
+
+func isSystemNS(dbName, coll string) bool {
+	switch dbName {
+	case "config", "local":
+		return true
+	case "admin":
+		return strings.HasPrefix(coll, "system.")
+	}
+
+	return false
+}
+
 var excludeFromOplog = []string{
 	"config.rangeDeletions",
 	pbm.DB + "." + pbm.TmpUsersCollection,
@@ -86,9 +164,22 @@ var dontPreserveUUID = []string{
 	"*.system.buckets.*", // timeseries
 }
 
+// CommandRunner runs db commands on the restore destination
+type CommandRunner interface {
+	RunCommand(ctx context.Context, db string, cmd bson.D) *mongo.SingleResult
+}
+
+type clientRunner struct {
+	cn *mongo.Client
+}
+
+func (r clientRunner) RunCommand(ctx context.Context, db string, cmd bson.D) *mongo.SingleResult {
+	return r.cn.Database(db).RunCommand(ctx, cmd)
+}
+
 // OplogRestore is the oplog applyer
 type OplogRestore struct {
-	dst               *mongo.Client
+	dst               CommandRunner
 	ver               *db.Version
 	needIdxWorkaround bool
 	preserveUUIDopt   bool
@@ -118,9 +209,66 @@ type OplogRestore struct {
 	unsafe bool
 
 	filter OpFilter
+	// limiter, if set, throttles applied ops
+	limiter OpLimiter
+	// chunkN is the num of Apply calls
+	chunkN int
+	// indexBuilder, if set, builds indexes as soon as their ops are
+	// replayed. Otherwise, indexes are only collected in the indexCatalog
+	indexBuilder IndexBuilder
+	// writeConcern of the applied ops. Nil means the server default
+	writeConcern *writeconcern.WriteConcern
+	// uuids, if set, rewrites collection UUIDs to the destination's ones
+	uuids *uuidMap
+	// stopBefore, if set, is the op the replay stops right before
+	stopBefore *StopBefore
+	// stopped is set once the stopBefore op is reached
+	stopped bool
+	// onApplyError, if set, gets ops failed to apply instead of failing Apply
+	onApplyError ApplyErrorFn
+	// nsOps is the num of applied ops by namespace, see NSOps
+	nsOps map[string]int
+}
+
+// NSOpsOther is the key of NSOps that counts the ops of namespaces
+// beyond the first maxNSOps ones
+const NSOpsOther = "other"
+
+// maxNSOps is the num of distinct namespaces counted by NSOps
+var maxNSOps = 1000
+
+// ApplyErrorFn gets the op that failed to apply and the error
+type ApplyErrorFn func(op *db.Oplog, err error)
+
+// StopBefore identifies the op the replay stops right before. The op
+// and everything after it isn't applied.
+type StopBefore struct {
+	TS primitive.Timestamp
+	// Hash, if set, has to match the op's `h` as well. Ops with the TS
+	// but a different hash are applied. Only MongoDB < 4.2 has hashes.
+	Hash *int64
+}
+
+func (s *StopBefore) reached(oe *db.Oplog) bool {
+	switch primitive.CompareTimestamp(oe.Timestamp, s.TS) {
+	case 1:
+		return true
+	case 0:
+		return s.Hash == nil || (oe.Hash != nil && *oe.Hash == *s.Hash)
+	}
+
+	return false
+}
+
+// OpLimiter limits the rate of applied ops
+type OpLimiter interface {
+	// Wait blocks until n more ops are allowed to be applied
+	Wait(n int)
 }
 
-const saveLastDistTxns = 100
+// DefaultDistTxnRetention is the default num of the last committed
+// dist transactions kept for the cross-shard sync
+const DefaultDistTxnRetention = 100
 
 // NewOplogRestore creates an object for an oplog applying
 func NewOplogRestore(
@@ -152,7 +300,7 @@ func NewOplogRestore(
 	}
 	ver := &db.Version{v[0], v[1], v[2]}
 	return &OplogRestore{
-		dst:               dst,
+		dst:               clientRunner{cn: dst},
 		ver:               ver,
 		preserveUUIDopt:   preserveUUID,
 		preserveUUID:      preserveUUID,
@@ -165,7 +313,7 @@ func NewOplogRestore(
 		unsafe:            unsafe,
 		filter:            DefaultOpFilter,
 		txnData:           make(map[string]Txn),
-		txnCommit:         newCQueue(saveLastDistTxns),
+		txnCommit:         newCQueue(DefaultDistTxnRetention),
 	}, nil
 }
 
@@ -178,6 +326,51 @@ func (o *OplogRestore) SetOpFilter(f OpFilter) {
 	o.filter = f
 }
 
+// SetOpLimiter sets the limiter for the ops apply rate. Nil means no limit.
+func (o *OplogRestore) SetOpLimiter(l OpLimiter) {
+	o.limiter = l
+}
+
+// SetCommandRunner sets the runner of commands applying ops. By default,
+// commands run on the client given to NewOplogRestore.
+func (o *OplogRestore) SetCommandRunner(r CommandRunner) {
+	o.dst = r
+}
+
+// SetWriteConcern sets the write concern of the applied ops.
+// Nil means the server default.
+func (o *OplogRestore) SetWriteConcern(wc *writeconcern.WriteConcern) {
+	o.writeConcern = wc
+}
+
+// SetUUIDLookup makes collection UUIDs of ops match the destination's
+// ones found by l. Collections created within the replay get UUIDs of
+// their create ops. Nil keeps UUIDs as they are in the oplog.
+func (o *OplogRestore) SetUUIDLookup(l UUIDLookup) {
+	o.uuids = nil
+	if l != nil {
+		o.uuids = newUUIDMap(l)
+	}
+}
+
+// SetDistTxnRetention sets the num of the last committed dist transactions
+// to keep for the cross-shard sync. Zero or less means the default. Must be
+// called before the first Apply.
+func (o *OplogRestore) SetDistTxnRetention(n int) {
+	if n <= 0 {
+		n = DefaultDistTxnRetention
+	}
+
+	o.txnCommit = newCQueue(n)
+}
+
+// SetIndexBuilder sets the builder for the inline index build. With nil,
+// index ops only update the index catalog and indexes are supposed to be
+// built after the replay.
+func (o *OplogRestore) SetIndexBuilder(b IndexBuilder) {
+	o.indexBuilder = b
+}
+
 // SetTimeframe sets boundaries for the replayed operations. All operations
 // that happened before `start` and after `end` are going to be discarded.
 // Zero `end` (primitive.Timestamp{T:0}) means all chunks will be replayed
@@ -187,21 +380,59 @@ func (o *OplogRestore) SetTimeframe(start, end primitive.Timestamp) {
 	o.endTS = end
 }
 
-// Apply applys an oplog from a given source
-func (o *OplogRestore) Apply(src io.ReadCloser) (primitive.Timestamp, error) {
+// SetStopBefore makes the replay stop right before the given op within
+// the timeframe. Nil means replay till the end of the timeframe.
+func (o *OplogRestore) SetStopBefore(s *StopBefore) {
+	o.stopBefore = s
+	o.stopped = false
+}
+
+// SetApplyErrorHandler makes Apply skip ops that fail to apply and pass
+// them to f instead of failing. Only the errors of the op itself are
+// skipped, see IsOpError. Nil means failing on the first such op.
+func (o *OplogRestore) SetApplyErrorHandler(f ApplyErrorFn) {
+	o.onApplyError = f
+}
+
+// Stopped returns true if the replay has reached the op set by
+// SetStopBefore. Further Apply calls are no-ops.
+func (o *OplogRestore) Stopped() bool {
+	return o.stopped
+}
+
+// ApplyStat is the num of oplog entries handled by Apply
+type ApplyStat struct {
+	// Applied is the num of entries applied (or buffered as a part of txn)
+	Applied int64
+	// Filtered is the num of entries skipped by namespace or op filters
+	Filtered int64
+	// Failed is the num of entries skipped as they failed to apply,
+	// see SetApplyErrorHandler
+	Failed int64
+}
+
+// Apply applies oplog entries from src within the timeframe. It returns the
+// timestamp of the last applied entry and the num of applied and filtered out
+// entries. No-ops and entries out of the timeframe aren't counted.
+//
+//nolint:nonamedreturns
+func (o *OplogRestore) Apply(src io.ReadCloser) (lts primitive.Timestamp, stat ApplyStat, err error) {
 	bsonSource := db.NewDecodedBSONSource(db.NewBufferlessBSONSource(src))
 	defer bsonSource.Close()
 
-	var lts primitive.Timestamp
+	o.chunkN++
+	if o.stopped {
+		return lts, stat, nil
+	}
 	for {
 		rawOplogEntry := bsonSource.LoadNext()
 		if rawOplogEntry == nil {
 			break
 		}
 		oe := db.Oplog{}
-		err := bson.Unmarshal(rawOplogEntry, &oe)
+		err = bson.Unmarshal(rawOplogEntry, &oe)
 		if err != nil {
-			return lts, errors.Wrap(err, "reading oplog")
+			return lts, stat, errors.Wrap(err, "reading oplog")
 		}
 
 		// skip if operation happened before the desired time frame
@@ -211,12 +442,31 @@ func (o *OplogRestore) Apply(src io.ReadCloser) (primitive.Timestamp, error) {
 
 		// finish if operation happened after the desired time frame (oe.Timestamp > to)
 		if o.endTS.T > 0 && primitive.CompareTimestamp(oe.Timestamp, o.endTS) == 1 {
-			return lts, nil
+			return lts, stat, nil
+		}
+
+		if o.stopBefore != nil && o.stopBefore.reached(&oe) {
+			o.stopped = true
+			return lts, stat, nil
 		}
 
-		err = o.handleOp(oe)
+		if o.limiter != nil {
+			o.limiter.Wait(1)
+		}
+
+		res, err := o.handleOp(oe)
 		if err != nil {
-			return lts, err
+			if o.onApplyError == nil || !IsOpError(err) {
+				return lts, stat, err
+			}
+			o.onApplyError(&oe, err)
+			stat.Failed++
+		}
+		switch res {
+		case opApplied:
+			stat.Applied++
+		case opFiltered:
+			stat.Filtered++
 		}
 
 		lts = oe.Timestamp
@@ -224,7 +474,30 @@ func (o *OplogRestore) Apply(src io.ReadCloser) (primitive.Timestamp, error) {
 		atomic.StoreUint32(&o.lastOpT, oe.Timestamp.T)
 	}
 
-	return lts, bsonSource.Err()
+	return lts, stat, bsonSource.Err()
+}
+
+func (o *OplogRestore) countNSOp(ns string) {
+	if o.nsOps == nil {
+		o.nsOps = make(map[string]int)
+	}
+	if _, ok := o.nsOps[ns]; !ok && len(o.nsOps) >= maxNSOps {
+		ns = NSOpsOther
+	}
+	o.nsOps[ns]++
+}
+
+// NSOps returns the num of ops applied by all Apply calls by namespace,
+// sorted by the namespace. Namespaces seen after the first 1000 ones are
+// counted under NSOpsOther. Transactions are counted by the ops inside
+// once committed.
+func (o *OplogRestore) NSOps() []pbm.NSOpsCount {
+	rv := make([]pbm.NSOpsCount, 0, len(o.nsOps))
+	for ns, n := range o.nsOps {
+		rv = append(rv, pbm.NSOpsCount{NS: ns, N: n})
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].NS < rv[j].NS })
+	return rv
 }
 
 func (o *OplogRestore) SetIncludeNS(nss []string) {
@@ -284,32 +557,41 @@ func (o *OplogRestore) LastOpTS() uint32 {
 	return atomic.LoadUint32(&o.lastOpT)
 }
 
-func (o *OplogRestore) handleOp(oe db.Oplog) error {
+// opResult is the outcome of handleOp
+type opResult int
+
+const (
+	opSkipped opResult = iota
+	opFiltered
+	opApplied
+)
+
+func (o *OplogRestore) handleOp(oe db.Oplog) (opResult, error) {
 	// skip if operation happened after the desired time frame (oe.Timestamp > o.lastTS)
 	if o.endTS.T > 0 && primitive.CompareTimestamp(oe.Timestamp, o.endTS) == 1 {
-		return nil
-	}
-
-	if o.excludeNS.Has(oe.Namespace) {
-		return nil
+		return opSkipped, nil
 	}
 
 	// skip no-ops
 	if oe.Operation == "n" {
-		return nil
+		return opSkipped, nil
+	}
+
+	if o.excludeNS.Has(oe.Namespace) {
+		return opFiltered, nil
 	}
 
 	if !o.isOpSelected(&oe) {
-		return nil
+		return opFiltered, nil
 	}
 
 	if !o.filter(&oe) {
-		return nil
+		return opFiltered, nil
 	}
 
 	if oe.Operation == "c" && len(oe.Object) > 0 &&
 		(oe.Object[0].Key == "startIndexBuild" || oe.Object[0].Key == "abortIndexBuild") {
-		return nil
+		return opSkipped, nil
 	}
 
 	// optimization - not to parse namespace if it remains the same
@@ -320,7 +602,7 @@ func (o *OplogRestore) handleOp(oe db.Oplog) error {
 		// inside the object to create
 		if oe.Operation == "c" {
 			if len(oe.Object) == 0 {
-				return errors.Errorf("empty object value for op: %v", oe)
+				return opSkipped, errors.Errorf("empty object value for op: %v", oe)
 			}
 			if oe.Object[0].Key == "create" && o.noUUIDns.Has(oe.Namespace+"."+oe.Object[0].Value.(string)) {
 				o.preserveUUID = false
@@ -336,22 +618,23 @@ func (o *OplogRestore) handleOp(oe db.Oplog) error {
 
 	meta, err := txn.NewMeta(oe)
 	if err != nil {
-		return errors.Wrap(err, "get op metadata")
+		return opSkipped, errors.Wrap(err, "get op metadata")
 	}
 
 	if meta.IsTxn() {
 		err = o.handleTxnOp(meta, oe)
 		if err != nil {
-			return errors.Wrap(err, "applying a transaction entry")
+			return opSkipped, errors.Wrap(err, "applying a transaction entry")
 		}
 	} else {
 		err = o.handleNonTxnOp(oe)
 		if err != nil {
-			return errors.Wrap(err, "applying an entry")
+			return opSkipped, errors.Wrap(err, "applying an entry")
 		}
+		o.countNSOp(oe.Namespace)
 	}
 
-	return nil
+	return opApplied, nil
 }
 
 func isTxnOps(op *db.Oplog) bool {
@@ -379,6 +662,9 @@ type Txn struct {
 	meta     txn.Meta
 	applyOps []db.Oplog
 	allOps   bool
+	// the first and the last Apply call (chunk) the txn messages were seen in
+	firstChunk int
+	lastChunk  int
 }
 
 // handleTxnOp accumulates transaction's ops in a buffer and then applies
@@ -413,6 +699,10 @@ func (o *OplogRestore) handleTxnOp(meta txn.Meta, op db.Oplog) error {
 		}
 
 		t := o.txnData[txnID]
+		if len(t.Oplog) == 0 {
+			t.firstChunk = o.chunkN
+		}
+		t.lastChunk = o.chunkN
 		t.meta = meta
 		t.allOps = !isPartial(&op)
 		t.Oplog = append(t.Oplog, op)
@@ -433,8 +723,9 @@ func (o *OplogRestore) handleTxnOp(meta txn.Meta, op db.Oplog) error {
 	// idempotent, if the duplication gonna be a commit message of the distributed
 	// txn, the second commit gonna fail since we're clearing committed tnxs out
 	// of the buffer. So just skip if it is a commit duplication.
-	lastc := o.txnCommit.last()
-	if lastc != nil && txnID == lastc.ID {
+	// The same goes for the oplog of several replsets merged into one (fan-in),
+	// each of them has its own commit message of the distributed txn.
+	if _, ok := o.txnData[txnID]; !ok && o.txnCommit.has(txnID) {
 		return nil
 	}
 
@@ -574,45 +865,93 @@ func (o *OplogRestore) applyTxn(id string) error {
 		if err != nil {
 			return errors.Wrap(err, "applying transaction op")
 		}
+		if !o.excludeNS.Has(op.Namespace) {
+			o.countNSOp(op.Namespace)
+		}
 	}
 
 	delete(o.txnData, id)
 	return nil
 }
 
+// TxnLeftovers returns uncommitted dist transactions and the last committed
+// ones. overflow is true if older commits were evicted from the retention
+// window, so other shards might miss some of the commits.
+//
 //nolint:nonamedreturns
-func (o *OplogRestore) TxnLeftovers() (uncommitted map[string]Txn, lastCommits []pbm.RestoreTxn) {
-	return o.txnData, o.txnCommit.s
+func (o *OplogRestore) TxnLeftovers() (uncommitted map[string]Txn, lastCommits []pbm.RestoreTxn, overflow bool) {
+	return o.txnData, o.txnCommit.s, o.txnCommit.evicted > 0
 }
 
+// OpenTxns returns the num of transactions which ops are buffered and
+// not applied yet
+func (o *OplogRestore) OpenTxns() int {
+	return len(o.txnData)
+}
+
+// SplitTxns returns uncommitted transactions which prepared messages were
+// observed in several chunks or which last prepared message wasn't observed
+// (e.g. cut off by the end of the replay).
+func (o *OplogRestore) SplitTxns() []pbm.SplitTxn {
+	var rv []pbm.SplitTxn
+	for id, t := range o.txnData {
+		if len(t.Oplog) == 0 || (t.allOps && t.firstChunk == t.lastChunk) {
+			continue
+		}
+
+		st := pbm.SplitTxn{
+			ID:     id,
+			Seen:   len(t.Oplog),
+			Chunks: t.lastChunk - t.firstChunk + 1,
+		}
+		if t.allOps {
+			st.Expected = st.Seen
+		}
+		rv = append(rv, st)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].ID < rv[j].ID })
+
+	return rv
+}
+
+// HandleUncommittedTxn applies uncommitted transactions that are committed
+// on other shards. Along with partial and left uncommitted transactions,
+// it returns decisions on each of them sorted by id.
+//
 //nolint:nonamedreturns
 func (o *OplogRestore) HandleUncommittedTxn(
 	commits map[string]primitive.Timestamp,
-) (partial, uncommitted []Txn, err error) {
+) (partial, uncommitted []Txn, decisions []pbm.TxnDecision, err error) {
 	if len(o.txnData) == 0 {
-		return nil, nil, nil
+		return nil, nil, nil, nil
 	}
 
 	for id, t := range o.txnData {
 		if _, ok := commits[id]; ok {
 			if !t.allOps {
 				partial = append(partial, t)
+				decisions = append(decisions, pbm.TxnDecision{ID: id, Decision: pbm.TxnPartial, Parts: len(t.Oplog)})
 				continue
 			}
 
 			err := o.applyTxn(id)
 			if err != nil {
-				return partial, uncommitted, errors.Wrapf(err, "applying uncommitted txn %s", id)
+				return partial, uncommitted, decisions, errors.Wrapf(err, "applying uncommitted txn %s", id)
 			}
+			decisions = append(decisions, pbm.TxnDecision{ID: id, Decision: pbm.TxnCommitted, Parts: len(t.Oplog)})
 			delete(o.txnData, id)
 		}
 	}
 
-	for _, t := range o.txnData {
+	for id, t := range o.txnData {
 		uncommitted = append(uncommitted, t)
+		if _, ok := commits[id]; !ok {
+			decisions = append(decisions, pbm.TxnDecision{ID: id, Decision: pbm.TxnDropped, Parts: len(t.Oplog)})
+		}
 	}
+	sort.Slice(decisions, func(i, j int) bool { return decisions[i].ID < decisions[j].ID })
 
-	return partial, uncommitted, nil
+	return partial, uncommitted, decisions, nil
 }
 
 func (o *OplogRestore) handleNonTxnOp(op db.Oplog) error {
@@ -655,6 +994,12 @@ func (o *OplogRestore) handleNonTxnOp(op db.Oplog) error {
 			}
 
 			o.indexCatalog.AddIndexes(dbName, collName, indexes)
+			if o.indexBuilder != nil {
+				err = o.indexBuilder.CreateIndexes(dbName, collName, indexes)
+				if err != nil {
+					return errors.Wrap(err, "build indexes")
+				}
+			}
 			return nil
 
 		case "createIndexes":
@@ -671,6 +1016,12 @@ func (o *OplogRestore) handleNonTxnOp(op db.Oplog) error {
 			}
 
 			o.indexCatalog.AddIndex(dbName, collName, index)
+			if o.indexBuilder != nil {
+				err = o.indexBuilder.CreateIndexes(dbName, collName, []*idx.IndexDocument{index})
+				if err != nil {
+					return errors.Wrap(err, "build index")
+				}
+			}
 			return nil
 
 		case "dropDatabase":
@@ -700,7 +1051,7 @@ func (o *OplogRestore) handleNonTxnOp(op db.Oplog) error {
 					return errors.Wrapf(err, "could not unmarshal applyOps command: %v", rawOp)
 				}
 
-				err = o.handleOp(nestedOp)
+				_, err = o.handleOp(nestedOp)
 				if err != nil {
 					return errors.Wrap(err, "error applying nested op from applyOps")
 				}
@@ -714,6 +1065,12 @@ func (o *OplogRestore) handleNonTxnOp(op db.Oplog) error {
 				return errors.Errorf("could not parse collection name from op: %v", op)
 			}
 			_ = o.indexCatalog.DeleteIndexes(dbName, collName, op.Object)
+			if o.indexBuilder != nil {
+				err = o.indexBuilder.DropIndexes(dbName, op.Object)
+				if err != nil {
+					return errors.Wrap(err, "drop indexes")
+				}
+			}
 			return nil
 		case "collMod":
 			if o.ver.GTE(db.Version{4, 1, 11}) {
@@ -780,6 +1137,8 @@ func (o *OplogRestore) handleNonTxnOp(op db.Oplog) error {
 type cqueue struct {
 	s []pbm.RestoreTxn
 	c int
+	// evicted is the num of elements pushed out of the queue
+	evicted int
 }
 
 func newCQueue(capacity int) *cqueue {
@@ -789,17 +1148,20 @@ func newCQueue(capacity int) *cqueue {
 func (c *cqueue) push(v pbm.RestoreTxn) {
 	if len(c.s) == c.c {
 		c.s = c.s[1:]
+		c.evicted++
 	}
 
 	c.s = append(c.s, v)
 }
 
-func (c *cqueue) last() *pbm.RestoreTxn {
-	if len(c.s) == 0 {
-		return nil
+func (c *cqueue) has(id string) bool {
+	for i := range c.s {
+		if c.s[i].ID == id {
+			return true
+		}
 	}
 
-	return &c.s[len(c.s)-1]
+	return false
 }
 
 // extractIndexDocumentFromCommitIndexBuilds extracts the index specs out of
@@ -863,10 +1225,63 @@ func extractIndexDocumentFromCommitIndexBuilds(op db.Oplog) (string, []*idx.Inde
 	return collectionName, nil
 }
 
+// notPrimaryCodes are codes of the errors the node isn't (or stops being)
+// the primary or is shutting down
+var notPrimaryCodes = map[int32]bool{
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	10107: true, // NotWritablePrimary
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotPrimaryNoSecondaryOk
+	13436: true, // NotPrimaryOrSecondary
+}
+
+// writeConcernCodes are codes of the write concern errors
+var writeConcernCodes = map[int32]bool{
+	64:  true, // WriteConcernFailed
+	79:  true, // UnknownReplWriteConcern
+	100: true, // UnsatisfiableWriteConcern
+}
+
+// IsOpError returns true if the error is the server's rejection of the op
+// itself, e.g. a duplicate key. The replay can go on without such op.
+// Errors of the connection, the context, the write concern or the node
+// not being the primary aren't of the op, as well as errors of the op
+// that didn't get to the server.
+func IsOpError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return false
+	}
+
+	var we mongo.WriteException
+	if errors.As(err, &we) {
+		if we.WriteConcernError != nil || len(we.WriteErrors) == 0 {
+			return false
+		}
+		for _, e := range we.WriteErrors {
+			if notPrimaryCodes[int32(e.Code)] {
+				return false
+			}
+		}
+		return true
+	}
+
+	var ce mongo.CommandError
+	if errors.As(err, &ce) {
+		return ce.Code != 0 && !notPrimaryCodes[ce.Code] && !writeConcernCodes[ce.Code] &&
+			!ce.HasErrorLabel("RetryableWriteError")
+	}
+
+	return false
+}
+
 // applyOps is a wrapper for the applyOps database command, we pass in
 // a session to avoid opening a new connection for a few inserts at a time.
 func (o *OplogRestore) applyOps(entries []interface{}) error {
-	singleRes := o.dst.Database("admin").RunCommand(context.TODO(), bson.D{{"applyOps", entries}})
+	cmd := withWriteConcern(bson.D{{"applyOps", entries}}, o.writeConcern)
+	singleRes := o.dst.RunCommand(context.TODO(), "admin", cmd)
 	if err := singleRes.Err(); err != nil {
 		return errors.Wrap(err, "applyOps")
 	}
@@ -894,6 +1309,10 @@ func (o *OplogRestore) filterUUIDs(op db.Oplog) (db.Oplog, error) {
 		if op.Operation == "c" && op.Object[0].Key == "createIndexes" && o.needIdxWorkaround {
 			return convertCreateIndexToIndexInsert(op)
 		}
+	} else if o.uuids != nil {
+		if err := o.uuids.remap(&op); err != nil {
+			return db.Oplog{}, err
+		}
 	}
 
 	// Check for and filter nested applyOps ops
@@ -0,0 +1,825 @@
+package oplog
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+func TestApplyStat(t *testing.T) {
+	lsid, err := bson.Marshal(bson.M{"id": "session"})
+	if err != nil {
+		t.Fatalf("marshal lsid: %v", err)
+	}
+	txnN := int64(1)
+
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	ops := []db.Oplog{
+		{Timestamp: ts(1), Operation: "n", Object: bson.D{{Key: "msg", Value: "noop"}}},
+		// txn ops are only buffered until commit, so no db is needed
+		{Timestamp: ts(2), Operation: "c", Namespace: "admin.$cmd", LSID: lsid, TxnNumber: &txnN,
+			Object: bson.D{
+				{Key: "applyOps", Value: bson.A{bson.D{
+					{Key: "op", Value: "i"},
+					{Key: "ns", Value: "test.c"},
+					{Key: "o", Value: bson.D{{Key: "_id", Value: 1}}},
+				}}},
+				{Key: "partialTxn", Value: true},
+			}},
+		{Timestamp: ts(3), Operation: "i", Namespace: "test.skip", Object: bson.D{{Key: "_id", Value: 1}}},
+		{Timestamp: ts(4), Operation: "i", Namespace: "config.system.sessions", Object: bson.D{{Key: "_id", Value: 1}}},
+		{Timestamp: ts(5), Operation: "c", Namespace: "admin.$cmd", LSID: lsid, TxnNumber: &txnN,
+			Object: bson.D{
+				{Key: "applyOps", Value: bson.A{bson.D{
+					{Key: "op", Value: "i"},
+					{Key: "ns", Value: "test.c"},
+					{Key: "o", Value: bson.D{{Key: "_id", Value: 2}}},
+				}}},
+				{Key: "partialTxn", Value: true},
+			}},
+		{Timestamp: ts(6), Operation: "d", Namespace: "test.skip", Object: bson.D{{Key: "_id", Value: 1}}},
+		// out of the timeframe
+		{Timestamp: ts(10), Operation: "i", Namespace: "test.skip", Object: bson.D{{Key: "_id", Value: 2}}},
+	}
+
+	var buf bytes.Buffer
+	for _, op := range ops {
+		b, err := bson.Marshal(op)
+		if err != nil {
+			t.Fatalf("marshal op: %v", err)
+		}
+		buf.Write(b)
+	}
+
+	o, err := NewOplogRestore(nil, nil, &pbm.MongoVersion{Version: []int{6, 0, 0}}, true, true, nil, nil)
+	if err != nil {
+		t.Fatalf("create oplog restore: %v", err)
+	}
+	o.SetTimeframe(primitive.Timestamp{}, ts(6))
+	o.SetOpFilter(func(r *Record) bool { return r.Namespace != "test.skip" })
+
+	lts, stat, err := o.Apply(io.NopCloser(&buf))
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	if !lts.Equal(ts(6)) {
+		t.Errorf("expected last ts %v, got %v", ts(6), lts)
+	}
+	if stat.Applied != 2 {
+		t.Errorf("expected 2 applied ops, got %d", stat.Applied)
+	}
+	if stat.Filtered != 3 {
+		t.Errorf("expected 3 filtered ops, got %d", stat.Filtered)
+	}
+}
+
+func txnPartOp(t *testing.T, ts uint32, lsid bson.Raw, txnN *int64, id int, last bool) db.Oplog {
+	t.Helper()
+
+	o := bson.D{
+		{Key: "applyOps", Value: bson.A{bson.D{
+			{Key: "op", Value: "i"},
+			{Key: "ns", Value: "test.c"},
+			{Key: "o", Value: bson.D{{Key: "_id", Value: id}}},
+		}}},
+	}
+	if last {
+		o = append(o, bson.E{Key: "prepare", Value: true})
+	} else {
+		o = append(o, bson.E{Key: "partialTxn", Value: true})
+	}
+
+	return db.Oplog{
+		Timestamp: primitive.Timestamp{T: ts, I: 1},
+		Operation: "c",
+		Namespace: "admin.$cmd",
+		LSID:      lsid,
+		TxnNumber: txnN,
+		Object:    o,
+	}
+}
+
+func oplogChunk(t *testing.T, ops ...db.Oplog) io.ReadCloser {
+	t.Helper()
+
+	var buf bytes.Buffer
+	for _, op := range ops {
+		b, err := bson.Marshal(op)
+		if err != nil {
+			t.Fatalf("marshal op: %v", err)
+		}
+		buf.Write(b)
+	}
+
+	return io.NopCloser(&buf)
+}
+
+func TestSplitTxns(t *testing.T) {
+	lsid1, _ := bson.Marshal(bson.M{"id": "split"})
+	lsid2, _ := bson.Marshal(bson.M{"id": "whole"})
+	lsid3, _ := bson.Marshal(bson.M{"id": "straddle"})
+	txnN := int64(1)
+
+	o, err := NewOplogRestore(nil, nil, &pbm.MongoVersion{Version: []int{6, 0, 0}}, true, true, nil, nil)
+	if err != nil {
+		t.Fatalf("create oplog restore: %v", err)
+	}
+	o.SetTimeframe(primitive.Timestamp{}, primitive.Timestamp{T: 30, I: 1})
+
+	// chunk 1: first parts of the "split" and "straddle" txns,
+	// and the whole prepared (but not committed) "whole" txn
+	_, _, err = o.Apply(oplogChunk(t,
+		txnPartOp(t, 1, lsid1, &txnN, 1, false),
+		txnPartOp(t, 2, lsid1, &txnN, 2, false),
+		txnPartOp(t, 3, lsid2, &txnN, 3, true),
+		txnPartOp(t, 4, lsid3, &txnN, 4, false),
+	))
+	if err != nil {
+		t.Fatalf("apply chunk 1: %v", err)
+	}
+	// chunk 2: one more part of "split" and the last one of "straddle",
+	// the rest of "split" and the commits are cut off by the replay end
+	_, _, err = o.Apply(oplogChunk(t,
+		txnPartOp(t, 20, lsid1, &txnN, 5, false),
+		txnPartOp(t, 21, lsid3, &txnN, 6, true),
+		txnPartOp(t, 40, lsid1, &txnN, 7, true),
+	))
+	if err != nil {
+		t.Fatalf("apply chunk 2: %v", err)
+	}
+
+	split := o.SplitTxns()
+	if len(split) != 2 {
+		t.Fatalf("expected 2 split txns, got %+v", split)
+	}
+
+	byID := make(map[string]pbm.SplitTxn)
+	for _, s := range split {
+		byID[s.ID] = s
+	}
+	uc, _, _ := o.TxnLeftovers()
+	if len(uc) != 3 {
+		t.Fatalf("expected 3 uncommitted txns, got %d", len(uc))
+	}
+	for id, tx := range uc {
+		s, ok := byID[id]
+		switch {
+		case bytes.Equal(tx.Oplog[0].LSID, lsid2):
+			if ok {
+				t.Errorf("whole txn reported as split: %+v", s)
+			}
+		case bytes.Equal(tx.Oplog[0].LSID, lsid1):
+			if !ok || s.Seen != 3 || s.Expected != 0 || s.Chunks != 2 {
+				t.Errorf("cut off txn: expected 3 of unknown in 2 chunks, got %+v", s)
+			}
+		case bytes.Equal(tx.Oplog[0].LSID, lsid3):
+			if !ok || s.Seen != 2 || s.Expected != 2 || s.Chunks != 2 {
+				t.Errorf("straddling txn: expected 2 of 2 in 2 chunks, got %+v", s)
+			}
+		}
+	}
+}
+
+// distTxnOps returns prepare and commit ops of a dist txn. Txn ops touch
+// an excluded namespace, so no db is needed to commit it.
+func distTxnOps(t *testing.T, ts uint32, lsid bson.Raw, txnN *int64) []db.Oplog {
+	t.Helper()
+
+	return []db.Oplog{
+		{
+			Timestamp: primitive.Timestamp{T: ts, I: 1},
+			Operation: "c",
+			Namespace: "admin.$cmd",
+			LSID:      lsid,
+			TxnNumber: txnN,
+			Object: bson.D{
+				{Key: "applyOps", Value: bson.A{bson.D{
+					{Key: "op", Value: "i"},
+					{Key: "ns", Value: "config.system.sessions"},
+					{Key: "o", Value: bson.D{{Key: "_id", Value: 1}}},
+				}}},
+				{Key: "prepare", Value: true},
+			},
+		},
+		{
+			Timestamp: primitive.Timestamp{T: ts, I: 2},
+			Operation: "c",
+			Namespace: "admin.$cmd",
+			LSID:      lsid,
+			TxnNumber: txnN,
+			Object: bson.D{
+				{Key: "commitTransaction", Value: 1},
+				{Key: "commitTimestamp", Value: primitive.Timestamp{T: ts, I: 1}},
+			},
+		},
+	}
+}
+
+func TestTxnLeftoversOverflow(t *testing.T) {
+	lsid, err := bson.Marshal(bson.M{"id": "session"})
+	if err != nil {
+		t.Fatalf("marshal lsid: %v", err)
+	}
+
+	const txns = 5
+	var ops []db.Oplog
+	for i := 1; i <= txns; i++ {
+		txnN := int64(i)
+		ops = append(ops, distTxnOps(t, uint32(i), lsid, &txnN)...)
+	}
+
+	cases := []struct {
+		name      string
+		retention int
+		expect    int
+		overflow  bool
+	}{
+		{name: "default", retention: 0, expect: txns, overflow: false},
+		{name: "exact", retention: txns, expect: txns, overflow: false},
+		{name: "overflow", retention: 3, expect: 3, overflow: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			o, err := NewOplogRestore(nil, nil, &pbm.MongoVersion{Version: []int{6, 0, 0}}, true, true, nil, nil)
+			if err != nil {
+				t.Fatalf("create oplog restore: %v", err)
+			}
+			o.SetDistTxnRetention(c.retention)
+			o.SetTimeframe(primitive.Timestamp{}, primitive.Timestamp{T: 100, I: 1})
+
+			if _, _, err = o.Apply(oplogChunk(t, ops...)); err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+
+			uc, commits, overflow := o.TxnLeftovers()
+			if len(uc) != 0 {
+				t.Errorf("expected no uncommitted txns, got %d", len(uc))
+			}
+			if overflow != c.overflow {
+				t.Errorf("expected overflow %v, got %v", c.overflow, overflow)
+			}
+			if len(commits) != c.expect {
+				t.Fatalf("expected %d commits, got %d", c.expect, len(commits))
+			}
+			// the latest commits are kept
+			last := commits[len(commits)-1]
+			if last.Ctime.T != txns {
+				t.Errorf("expected the last commit at %d, got %v", txns, last.Ctime)
+			}
+			if first := commits[0]; first.Ctime.T != uint32(txns-c.expect+1) {
+				t.Errorf("expected the oldest kept commit at %d, got %v", txns-c.expect+1, first.Ctime)
+			}
+		})
+	}
+}
+
+// cmdRecorder records commands instead of running them
+type cmdRecorder struct {
+	cmds []bson.D
+}
+
+func (r *cmdRecorder) RunCommand(_ context.Context, _ string, cmd bson.D) *mongo.SingleResult {
+	r.cmds = append(r.cmds, cmd)
+	return mongo.NewSingleResultFromDocument(bson.D{{Key: "ok", Value: 1}}, nil, nil)
+}
+
+func TestWriteConcernApplied(t *testing.T) {
+	ops := []db.Oplog{
+		{Timestamp: primitive.Timestamp{T: 1, I: 1}, Operation: "i", Namespace: "test.c",
+			Object: bson.D{{Key: "_id", Value: 1}}},
+	}
+
+	cases := []struct {
+		name   string
+		wc     *writeconcern.WriteConcern
+		expect bson.M
+	}{
+		{name: "default"},
+		{
+			name:   "majority",
+			wc:     &writeconcern.WriteConcern{W: "majority", WTimeout: 5 * time.Second},
+			expect: bson.M{"w": "majority", "wtimeout": int64(5000)},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			o, err := NewOplogRestore(nil, nil, &pbm.MongoVersion{Version: []int{6, 0, 0}}, true, true, nil, nil)
+			if err != nil {
+				t.Fatalf("create oplog restore: %v", err)
+			}
+			rec := &cmdRecorder{}
+			o.SetCommandRunner(rec)
+			o.SetWriteConcern(c.wc)
+
+			if _, _, err = o.Apply(oplogChunk(t, ops...)); err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			if len(rec.cmds) != 1 {
+				t.Fatalf("expected 1 command, got %d", len(rec.cmds))
+			}
+
+			var wc bson.M
+			for _, e := range rec.cmds[0] {
+				if e.Key != "writeConcern" {
+					continue
+				}
+				b, err := bson.Marshal(bson.D{e})
+				if err != nil {
+					t.Fatalf("marshal write concern: %v", err)
+				}
+				var doc struct {
+					WC bson.M `bson:"writeConcern"`
+				}
+				if err = bson.Unmarshal(b, &doc); err != nil {
+					t.Fatalf("unmarshal write concern: %v", err)
+				}
+				wc = doc.WC
+			}
+			if !reflect.DeepEqual(wc, c.expect) {
+				t.Errorf("expected write concern %v, got %v", c.expect, wc)
+			}
+		})
+	}
+}
+
+func TestIsSystemOp(t *testing.T) {
+	cmd := func(ns string, o ...bson.E) *Record {
+		return &Record{Operation: "c", Namespace: ns, Object: o}
+	}
+	insert := func(ns string) *Record {
+		return &Record{Operation: "i", Namespace: ns, Object: bson.D{{Key: "_id", Value: 1}}}
+	}
+
+	cases := []struct {
+		name   string
+		op     *Record
+		system bool
+	}{
+		{"config insert", insert("config.settings"), true},
+		{"local insert", insert("local.startup_log"), true},
+		{"admin system insert", insert("admin.system.users"), true},
+		{"admin user insert", insert("admin.data"), false},
+		{"user insert", insert("test.c"), false},
+		{"user system prefix", insert("test.systemLogs"), false},
+		{"user views", insert("test.system.views"), false},
+		{"config command", cmd("config.$cmd", bson.E{Key: "create", Value: "x"}), true},
+		{"admin system command", cmd("admin.$cmd", bson.E{Key: "create", Value: "system.roles"}), true},
+		{"admin user command", cmd("admin.$cmd", bson.E{Key: "create", Value: "data"}), false},
+		{"user command", cmd("test.$cmd", bson.E{Key: "drop", Value: "c"}), false},
+		{"txn", cmd("admin.$cmd", bson.E{Key: "applyOps", Value: bson.A{}}), false},
+		{
+			"user rename",
+			cmd("admin.$cmd", bson.E{Key: "renameCollection", Value: "test.a"}, bson.E{Key: "to", Value: "test.b"}),
+			false,
+		},
+		{
+			"rename to config",
+			cmd("admin.$cmd", bson.E{Key: "renameCollection", Value: "test.a"}, bson.E{Key: "to", Value: "config.b"}),
+			true,
+		},
+	}
+
+	for _, c := range cases {
+		if got := IsSystemOp(c.op); got != c.system {
+			t.Errorf("%s: expected %v, got %v", c.name, c.system, got)
+		}
+	}
+}
+
+func TestCombineFilters(t *testing.T) {
+	includeNS := func(r *Record) bool { return r.Namespace == "db.a" || r.Namespace == "db.b" }
+	excludeOp := func(r *Record) bool { return r.Operation != "d" }
+
+	f := CombineFilters(includeNS, nil, excludeOp)
+	cases := []struct {
+		op, ns string
+		pass   bool
+	}{
+		{"i", "db.a", true},
+		{"u", "db.b", true},
+		{"d", "db.a", false},
+		{"i", "db.c", false},
+		{"d", "db.c", false},
+	}
+	for _, c := range cases {
+		if got := f(&Record{Operation: c.op, Namespace: c.ns}); got != c.pass {
+			t.Errorf("%s %s: expected %v, got %v", c.op, c.ns, c.pass, got)
+		}
+	}
+
+	// filters are called in order until the first rejecting one
+	var called []string
+	track := func(name string, pass bool) OpFilter {
+		return func(*Record) bool {
+			called = append(called, name)
+			return pass
+		}
+	}
+	CombineFilters(track("a", true), track("b", false), track("c", true))(&Record{})
+	if !reflect.DeepEqual(called, []string{"a", "b"}) {
+		t.Errorf("expected a, b to be called, got %v", called)
+	}
+
+	if !CombineFilters()(&Record{}) || !CombineFilters(nil)(&Record{}) {
+		t.Error("expected the empty combination to pass all ops")
+	}
+}
+
+func TestStopBefore(t *testing.T) {
+	h := func(v int64) *int64 { return &v }
+	insert := func(ts primitive.Timestamp, id int, hash *int64) db.Oplog {
+		return db.Oplog{Timestamp: ts, Hash: hash, Operation: "i", Namespace: "test.c",
+			Object: bson.D{{Key: "_id", Value: id}}}
+	}
+	ops := []db.Oplog{
+		insert(primitive.Timestamp{T: 10, I: 1}, 1, h(11)),
+		insert(primitive.Timestamp{T: 10, I: 2}, 2, h(12)),
+		insert(primitive.Timestamp{T: 10, I: 3}, 3, h(13)),
+		insert(primitive.Timestamp{T: 10, I: 4}, 4, h(14)),
+	}
+
+	cases := []struct {
+		name   string
+		stop   *StopBefore
+		expect []int
+	}{
+		{name: "none", expect: []int{1, 2, 3, 4, 5}},
+		{name: "ts", stop: &StopBefore{TS: primitive.Timestamp{T: 10, I: 3}}, expect: []int{1, 2}},
+		{name: "ts and hash", stop: &StopBefore{TS: primitive.Timestamp{T: 10, I: 2}, Hash: h(12)}, expect: []int{1}},
+		{name: "hash mismatch", stop: &StopBefore{TS: primitive.Timestamp{T: 10, I: 2}, Hash: h(99)}, expect: []int{1, 2}},
+		{name: "first op", stop: &StopBefore{TS: primitive.Timestamp{T: 10, I: 1}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			o, err := NewOplogRestore(nil, nil, &pbm.MongoVersion{Version: []int{6, 0, 0}}, true, true, nil, nil)
+			if err != nil {
+				t.Fatalf("create oplog restore: %v", err)
+			}
+			rec := &cmdRecorder{}
+			o.SetCommandRunner(rec)
+			o.SetStopBefore(c.stop)
+
+			lts, _, err := o.Apply(oplogChunk(t, ops...))
+			if err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			// nothing is applied after the stop
+			_, stat, err := o.Apply(oplogChunk(t, insert(primitive.Timestamp{T: 11, I: 1}, 5, nil)))
+			if err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			if c.stop != nil && stat.Applied != 0 {
+				t.Errorf("expected no ops applied after the stop, got %d", stat.Applied)
+			}
+			if o.Stopped() != (c.stop != nil) {
+				t.Errorf("expected stopped %v", c.stop != nil)
+			}
+
+			if got := appliedIDs(t, rec.cmds); !reflect.DeepEqual(got, c.expect) {
+				t.Errorf("expected applied %v, got %v", c.expect, got)
+			}
+			if c.stop != nil && len(c.expect) > 0 && lts != ops[len(c.expect)-1].Timestamp {
+				t.Errorf("expected last ts %v, got %v", ops[len(c.expect)-1].Timestamp, lts)
+			}
+		})
+	}
+}
+
+// appliedIDs returns _id of the docs inserted by applyOps commands
+func appliedIDs(t *testing.T, cmds []bson.D) []int {
+	t.Helper()
+
+	var ids []int
+	for _, cmd := range cmds {
+		b, err := bson.Marshal(cmd)
+		if err != nil {
+			t.Fatalf("marshal command: %v", err)
+		}
+		var doc struct {
+			ApplyOps []struct {
+				O struct {
+					ID int `bson:"_id"`
+				} `bson:"o"`
+			} `bson:"applyOps"`
+		}
+		if err = bson.Unmarshal(b, &doc); err != nil {
+			t.Fatalf("unmarshal command: %v", err)
+		}
+		for _, op := range doc.ApplyOps {
+			ids = append(ids, op.O.ID)
+		}
+	}
+
+	return ids
+}
+
+func TestHandleUncommittedTxnDecisions(t *testing.T) {
+	lsidC, _ := bson.Marshal(bson.M{"id": "committed"})
+	lsidD, _ := bson.Marshal(bson.M{"id": "dropped"})
+	lsidP, _ := bson.Marshal(bson.M{"id": "partial"})
+	txnN := int64(1)
+
+	o, err := NewOplogRestore(nil, nil, &pbm.MongoVersion{Version: []int{6, 0, 0}}, true, true, nil, nil)
+	if err != nil {
+		t.Fatalf("create oplog restore: %v", err)
+	}
+	o.SetCommandRunner(&cmdRecorder{})
+	o.SetTimeframe(primitive.Timestamp{}, primitive.Timestamp{T: 30, I: 1})
+
+	// prepared but the commits are cut off by the replay end, the "partial"
+	// txn misses the last prepared message
+	_, _, err = o.Apply(oplogChunk(t,
+		distTxnOps(t, 1, lsidC, &txnN)[0],
+		distTxnOps(t, 2, lsidD, &txnN)[0],
+		txnPartOp(t, 3, lsidP, &txnN, 1, false),
+		txnPartOp(t, 4, lsidP, &txnN, 2, false),
+	))
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	uc, _, _ := o.TxnLeftovers()
+	ids := make(map[string]string)
+	for id, tx := range uc {
+		switch {
+		case bytes.Equal(tx.Oplog[0].LSID, lsidC):
+			ids["committed"] = id
+		case bytes.Equal(tx.Oplog[0].LSID, lsidD):
+			ids["dropped"] = id
+		case bytes.Equal(tx.Oplog[0].LSID, lsidP):
+			ids["partial"] = id
+		}
+	}
+	if len(ids) != 3 {
+		t.Fatalf("expected 3 uncommitted txns, got %v", ids)
+	}
+
+	// committed on other shards
+	commits := map[string]primitive.Timestamp{
+		ids["committed"]: {T: 1, I: 2},
+		ids["partial"]:   {T: 4, I: 2},
+	}
+	partial, uncomm, decisions, err := o.HandleUncommittedTxn(commits)
+	if err != nil {
+		t.Fatalf("handle uncommitted txns: %v", err)
+	}
+	if len(partial) != 1 || len(uncomm) != 2 {
+		t.Errorf("expected 1 partial and 2 uncommitted txns, got %d and %d", len(partial), len(uncomm))
+	}
+
+	got := make(map[string]pbm.TxnDecision)
+	for _, d := range decisions {
+		got[d.ID] = d
+	}
+	expect := map[string]pbm.TxnDecision{
+		ids["committed"]: {ID: ids["committed"], Decision: pbm.TxnCommitted, Parts: 1},
+		ids["dropped"]:   {ID: ids["dropped"], Decision: pbm.TxnDropped, Parts: 1},
+		ids["partial"]:   {ID: ids["partial"], Decision: pbm.TxnPartial, Parts: 2},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("expected decisions %v, got %v", expect, got)
+	}
+	for i := 1; i < len(decisions); i++ {
+		if decisions[i-1].ID > decisions[i].ID {
+			t.Errorf("decisions are not sorted by id: %v", decisions)
+		}
+	}
+}
+
+// failingRunner records commands and fails the ones applying the op
+// with the `_id` by err
+type failingRunner struct {
+	cmdRecorder
+	t   *testing.T
+	id  int
+	err error
+}
+
+func (r *failingRunner) RunCommand(ctx context.Context, db string, cmd bson.D) *mongo.SingleResult {
+	for _, id := range appliedIDs(r.t, []bson.D{cmd}) {
+		if id == r.id {
+			return mongo.NewSingleResultFromDocument(bson.D{}, r.err, nil)
+		}
+	}
+
+	return r.cmdRecorder.RunCommand(ctx, db, cmd)
+}
+
+func TestApplyErrorHandler(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	ops := []db.Oplog{
+		{Timestamp: ts(1), Operation: "i", Namespace: "test.c", Object: bson.D{{Key: "_id", Value: 1}}},
+		{Timestamp: ts(2), Operation: "i", Namespace: "test.c", Object: bson.D{{Key: "_id", Value: 2}}},
+		{Timestamp: ts(3), Operation: "i", Namespace: "test.c", Object: bson.D{{Key: "_id", Value: 3}}},
+	}
+	dupKey := mongo.CommandError{Code: 11000, Name: "DuplicateKey", Message: "E11000 duplicate key"}
+
+	t.Run("fail", func(t *testing.T) {
+		o, err := NewOplogRestore(nil, nil, &pbm.MongoVersion{Version: []int{6, 0, 0}}, true, true, nil, nil)
+		if err != nil {
+			t.Fatalf("create oplog restore: %v", err)
+		}
+		rec := &failingRunner{t: t, id: 2, err: dupKey}
+		o.SetCommandRunner(rec)
+
+		lts, _, err := o.Apply(oplogChunk(t, ops...))
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if !lts.Equal(ts(1)) {
+			t.Errorf("expected last ts %v, got %v", ts(1), lts)
+		}
+		if got := appliedIDs(t, rec.cmds); !reflect.DeepEqual(got, []int{1}) {
+			t.Errorf("expected applied [1], got %v", got)
+		}
+	})
+
+	t.Run("continue", func(t *testing.T) {
+		o, err := NewOplogRestore(nil, nil, &pbm.MongoVersion{Version: []int{6, 0, 0}}, true, true, nil, nil)
+		if err != nil {
+			t.Fatalf("create oplog restore: %v", err)
+		}
+		rec := &failingRunner{t: t, id: 2, err: dupKey}
+		o.SetCommandRunner(rec)
+		var failed []primitive.Timestamp
+		o.SetApplyErrorHandler(func(op *db.Oplog, err error) {
+			if err == nil {
+				t.Error("expected an error for the failed op")
+			}
+			failed = append(failed, op.Timestamp)
+		})
+
+		lts, stat, err := o.Apply(oplogChunk(t, ops...))
+		if err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+		if !lts.Equal(ts(3)) {
+			t.Errorf("expected last ts %v, got %v", ts(3), lts)
+		}
+		if stat.Applied != 2 || stat.Failed != 1 {
+			t.Errorf("expected 2 applied and 1 failed ops, got %+v", stat)
+		}
+		if !reflect.DeepEqual(failed, []primitive.Timestamp{ts(2)}) {
+			t.Errorf("expected the op at %v failed, got %v", ts(2), failed)
+		}
+		if got := appliedIDs(t, rec.cmds); !reflect.DeepEqual(got, []int{1, 3}) {
+			t.Errorf("expected applied [1 3], got %v", got)
+		}
+	})
+}
+
+func TestNSOps(t *testing.T) {
+	insert := func(ts uint32, ns string) db.Oplog {
+		return db.Oplog{Timestamp: primitive.Timestamp{T: ts, I: 1}, Operation: "i", Namespace: ns,
+			Object: bson.D{{Key: "_id", Value: int(ts)}}}
+	}
+	ops := []db.Oplog{
+		insert(1, "db1.c1"),
+		insert(2, "db1.c2"),
+		insert(3, "db2.c1"),
+		insert(4, "db1.c1"),
+		{Timestamp: primitive.Timestamp{T: 5, I: 1}, Operation: "n", Object: bson.D{{Key: "msg", Value: "noop"}}},
+		insert(6, "db3.c1"),
+		insert(7, "db1.c2"),
+		insert(8, "db1.c1"),
+	}
+
+	t.Run("include", func(t *testing.T) {
+		o, err := NewOplogRestore(nil, nil, &pbm.MongoVersion{Version: []int{6, 0, 0}}, true, true, nil, nil)
+		if err != nil {
+			t.Fatalf("create oplog restore: %v", err)
+		}
+		o.SetCommandRunner(&cmdRecorder{})
+		o.SetIncludeNS([]string{"db1.*", "db3.c1"})
+
+		// counted across chunks
+		for _, c := range [][]db.Oplog{ops[:4], ops[4:]} {
+			if _, _, err = o.Apply(oplogChunk(t, c...)); err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+		}
+
+		want := []pbm.NSOpsCount{{NS: "db1.c1", N: 3}, {NS: "db1.c2", N: 2}, {NS: "db3.c1", N: 1}}
+		if got := o.NSOps(); !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+	})
+
+	t.Run("capped", func(t *testing.T) {
+		defer func(n int) { maxNSOps = n }(maxNSOps)
+		maxNSOps = 2
+
+		o, err := NewOplogRestore(nil, nil, &pbm.MongoVersion{Version: []int{6, 0, 0}}, true, true, nil, nil)
+		if err != nil {
+			t.Fatalf("create oplog restore: %v", err)
+		}
+		o.SetCommandRunner(&cmdRecorder{})
+
+		_, stat, err := o.Apply(oplogChunk(t, ops...))
+		if err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+
+		want := []pbm.NSOpsCount{{NS: "db1.c1", N: 3}, {NS: "db1.c2", N: 2}, {NS: NSOpsOther, N: 2}}
+		got := o.NSOps()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+		sum := 0
+		for _, c := range got {
+			sum += c.N
+		}
+		if int64(sum) != stat.Applied {
+			t.Errorf("expected %d ops counted, got %d", stat.Applied, sum)
+		}
+	})
+
+	t.Run("txn", func(t *testing.T) {
+		lsid, err := bson.Marshal(bson.M{"id": "session"})
+		if err != nil {
+			t.Fatalf("marshal lsid: %v", err)
+		}
+		txnN := int64(1)
+		txnOps := func(ts uint32, ns string, partial bool) db.Oplog {
+			o := bson.D{{Key: "applyOps", Value: bson.A{bson.D{
+				{Key: "op", Value: "i"},
+				{Key: "ns", Value: ns},
+				{Key: "o", Value: bson.D{{Key: "_id", Value: int(ts)}}},
+			}}}}
+			if partial {
+				o = append(o, bson.E{Key: "partialTxn", Value: true})
+			}
+			return db.Oplog{Timestamp: primitive.Timestamp{T: ts, I: 1}, Operation: "c", Namespace: "admin.$cmd",
+				LSID: lsid, TxnNumber: &txnN, Object: o}
+		}
+
+		o, err := NewOplogRestore(nil, nil, &pbm.MongoVersion{Version: []int{6, 0, 0}}, true, true, nil, nil)
+		if err != nil {
+			t.Fatalf("create oplog restore: %v", err)
+		}
+		o.SetCommandRunner(&cmdRecorder{})
+
+		_, _, err = o.Apply(oplogChunk(t, insert(1, "db1.c1"), txnOps(2, "db1.c1", true), txnOps(3, "db2.c1", false)))
+		if err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+
+		want := []pbm.NSOpsCount{{NS: "db1.c1", N: 2}, {NS: "db2.c1", N: 1}}
+		if got := o.NSOps(); !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+	})
+}
+
+func TestApplyErrorHandlerNotOpError(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	ops := []db.Oplog{
+		{Timestamp: ts(1), Operation: "i", Namespace: "test.c", Object: bson.D{{Key: "_id", Value: 1}}},
+		{Timestamp: ts(2), Operation: "i", Namespace: "test.c", Object: bson.D{{Key: "_id", Value: 2}}},
+	}
+
+	cases := []struct {
+		name string
+		err  error
+	}{
+		{name: "not primary", err: mongo.CommandError{Code: 10107, Name: "NotWritablePrimary"}},
+		{name: "write concern", err: mongo.CommandError{Code: 64, Name: "WriteConcernFailed"}},
+		{name: "network", err: mongo.CommandError{Labels: []string{"NetworkError"}}},
+		{name: "context", err: context.DeadlineExceeded},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			o, err := NewOplogRestore(nil, nil, &pbm.MongoVersion{Version: []int{6, 0, 0}}, true, true, nil, nil)
+			if err != nil {
+				t.Fatalf("create oplog restore: %v", err)
+			}
+			o.SetCommandRunner(&failingRunner{t: t, id: 2, err: c.err})
+			o.SetApplyErrorHandler(func(op *db.Oplog, err error) {
+				t.Errorf("unexpected skip of op %v: %v", op.Timestamp, err)
+			})
+
+			lts, _, err := o.Apply(oplogChunk(t, ops...))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !lts.Equal(ts(1)) {
+				t.Errorf("expected last ts %v, got %v", ts(1), lts)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package oplog
+
+import (
+	"context"
+	"strings"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// UUIDLookup returns the UUID of the collection on the restore
+// destination. Nil means there is no such collection.
+type UUIDLookup func(db, coll string) (*primitive.Binary, error)
+
+// NewMongoUUIDLookup returns UUIDLookup that lists collections on cn
+func NewMongoUUIDLookup(ctx context.Context, cn *mongo.Client) UUIDLookup {
+	return func(dbName, coll string) (*primitive.Binary, error) {
+		cur, err := cn.Database(dbName).ListCollections(ctx, bson.D{{"name", coll}})
+		if err != nil {
+			return nil, errors.Wrap(err, "list collections")
+		}
+		defer cur.Close(ctx)
+
+		if !cur.Next(ctx) {
+			return nil, errors.Wrap(cur.Err(), "list collections")
+		}
+
+		var c struct {
+			Info struct {
+				UUID *primitive.Binary `bson:"uuid"`
+			} `bson:"info"`
+		}
+		err = cur.Decode(&c)
+		return c.Info.UUID, errors.Wrap(err, "decode collection info")
+	}
+}
+
+// uuidMap rewrites collection UUIDs of ops to the destination's ones.
+// Collections restored from the snapshot keep their UUIDs, but the
+// replay onto another cluster meets collections created independently.
+type uuidMap struct {
+	lookup UUIDLookup
+	// known UUIDs by namespace. Nil value means no collection
+	uuids map[string]*primitive.Binary
+}
+
+func newUUIDMap(l UUIDLookup) *uuidMap {
+	return &uuidMap{lookup: l, uuids: make(map[string]*primitive.Binary)}
+}
+
+// remap sets the op's UUID to the one of the destination's collection.
+// It's removed if there is no such collection.
+func (m *uuidMap) remap(op *db.Oplog) error {
+	if op.Operation == "c" && len(op.Object) > 0 && op.Object[0].Key == "dropDatabase" {
+		dbName, _, _ := strings.Cut(op.Namespace, ".")
+		m.forgetDB(dbName)
+		return nil
+	}
+	if op.UI == nil {
+		return nil
+	}
+
+	ns := op.Namespace
+	if op.Operation == "c" && len(op.Object) > 0 {
+		dbName, _, _ := strings.Cut(op.Namespace, ".")
+
+		switch cmd := op.Object[0]; cmd.Key {
+		case "create":
+			// the collection is created within the replay, hence it
+			// gets the UUID of the op the following ops refer to
+			coll, _ := cmd.Value.(string)
+			m.uuids[dbName+"."+coll] = op.UI
+			return nil
+		case "renameCollection":
+			// the namespace is the full name of the source collection
+			ns, _ = cmd.Value.(string)
+			defer m.forget(ns)
+			if to, ok := op.Object.Map()["to"].(string); ok {
+				defer m.forget(to)
+			}
+		case "drop":
+			coll, _ := cmd.Value.(string)
+			ns = dbName + "." + coll
+			defer m.forget(ns)
+		default:
+			coll, ok := cmd.Value.(string)
+			if !ok {
+				return nil
+			}
+			ns = dbName + "." + coll
+		}
+	}
+
+	uuid, ok := m.uuids[ns]
+	if !ok {
+		dbName, coll, _ := strings.Cut(ns, ".")
+		var err error
+		uuid, err = m.lookup(dbName, coll)
+		if err != nil {
+			return errors.Wrapf(err, "get uuid of %s", ns)
+		}
+		m.uuids[ns] = uuid
+	}
+
+	op.UI = uuid
+	return nil
+}
+
+func (m *uuidMap) forget(ns string) {
+	delete(m.uuids, ns)
+}
+
+// forgetDB drops known UUIDs of the database's collections
+func (m *uuidMap) forgetDB(dbName string) {
+	for ns := range m.uuids {
+		if strings.HasPrefix(ns, dbName+".") {
+			delete(m.uuids, ns)
+		}
+	}
+}
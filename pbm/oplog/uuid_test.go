@@ -0,0 +1,121 @@
+package oplog
+
+import (
+	"testing"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+func uuid(b byte) *primitive.Binary {
+	return &primitive.Binary{Subtype: 4, Data: []byte{b, b, b, b, b, b, b, b, b, b, b, b, b, b, b, b}}
+}
+
+func sameUUID(u *primitive.Binary, b byte) bool {
+	return u != nil && u.Equal(*uuid(b))
+}
+
+func TestRemapUUID(t *testing.T) {
+	// UUIDs of collections on the destination
+	target := map[string]*primitive.Binary{"test.old": uuid(2)}
+	lookups := map[string]int{}
+
+	o, err := NewOplogRestore(nil, nil, &pbm.MongoVersion{Version: []int{6, 0, 0}}, true, true, nil, nil)
+	if err != nil {
+		t.Fatalf("new oplog restore: %v", err)
+	}
+	o.SetUUIDLookup(func(dbName, coll string) (*primitive.Binary, error) {
+		lookups[dbName+"."+coll]++
+		return target[dbName+"."+coll], nil
+	})
+
+	filter := func(op db.Oplog) *primitive.Binary {
+		t.Helper()
+
+		op, err := o.filterUUIDs(op)
+		if err != nil {
+			t.Fatalf("filter uuids: %v", err)
+		}
+		return op.UI
+	}
+	insert := func(ns string, ui *primitive.Binary) db.Oplog {
+		return db.Oplog{Operation: "i", Namespace: ns, Object: bson.D{{Key: "_id", Value: 1}}, UI: ui}
+	}
+
+	t.Run("pre-existing collection", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			if got := filter(insert("test.old", uuid(1))); !sameUUID(got, 2) {
+				t.Errorf("expected the destination's uuid, got %v", got)
+			}
+		}
+		if lookups["test.old"] != 1 {
+			t.Errorf("expected the uuid to be looked up once, got %d", lookups["test.old"])
+		}
+	})
+
+	t.Run("create within the replay", func(t *testing.T) {
+		create := db.Oplog{
+			Operation: "c", Namespace: "test.$cmd",
+			Object: bson.D{{Key: "create", Value: "new"}}, UI: uuid(3),
+		}
+		if got := filter(create); !sameUUID(got, 3) {
+			t.Errorf("expected create to keep its uuid, got %v", got)
+		}
+		if got := filter(insert("test.new", uuid(3))); !sameUUID(got, 3) {
+			t.Errorf("expected the uuid of create, got %v", got)
+		}
+		if lookups["test.new"] != 0 {
+			t.Errorf("expected no lookup of the created collection, got %d", lookups["test.new"])
+		}
+	})
+
+	t.Run("missing collection", func(t *testing.T) {
+		if got := filter(insert("test.none", uuid(4))); got != nil {
+			t.Errorf("expected uuid to be removed, got %v", got)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		drop := db.Oplog{
+			Operation: "c", Namespace: "test.$cmd",
+			Object: bson.D{{Key: "drop", Value: "new"}}, UI: uuid(3),
+		}
+		if got := filter(drop); !sameUUID(got, 3) {
+			t.Errorf("expected drop to refer the created collection, got %v", got)
+		}
+
+		// it's a new collection with the same name
+		target["test.new"] = uuid(5)
+		if got := filter(insert("test.new", uuid(6))); !sameUUID(got, 5) {
+			t.Errorf("expected the destination's uuid after drop, got %v", got)
+		}
+	})
+
+	t.Run("nested applyOps", func(t *testing.T) {
+		op := db.Oplog{
+			Operation: "c", Namespace: "admin.$cmd",
+			Object: bson.D{{Key: "applyOps", Value: bson.A{
+				bson.D{
+					{Key: "op", Value: "i"},
+					{Key: "ns", Value: "test.old"},
+					{Key: "ui", Value: *uuid(1)},
+					{Key: "o", Value: bson.D{{Key: "_id", Value: 2}}},
+				},
+			}}},
+		}
+		op, err := o.filterUUIDs(op)
+		if err != nil {
+			t.Fatalf("filter uuids: %v", err)
+		}
+		nested, err := unwrapNestedApplyOps(op.Object)
+		if err != nil {
+			t.Fatalf("unwrap applyOps: %v", err)
+		}
+		if len(nested) != 1 || !sameUUID(nested[0].UI, 2) {
+			t.Errorf("expected nested op to get the destination's uuid, got %+v", nested)
+		}
+	})
+}
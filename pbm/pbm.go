@@ -50,6 +50,8 @@ const (
 	PBMOpLogCollection = "pbmOpLog"
 	// AgentsStatusCollection is an agents registry with its status/health checks
 	AgentsStatusCollection = "pbmAgents"
+	// RestoreAuditCollection is the audit trail of restores
+	RestoreAuditCollection = "pbmRestoreAudit"
 
 	// MetadataFileSuffix is a suffix for the metadata file on a storage
 	MetadataFileSuffix = ".pbm.json"
@@ -176,7 +178,43 @@ type RestoreCmd struct {
 	Namespaces []string          `bson:"nss,omitempty"`
 	RSMap      map[string]string `bson:"rsMap,omitempty"`
 
+	// Replsets to restore. All replsets from the backup if empty.
+	Replsets []string `bson:"replsets,omitempty"`
+
+	// SkipVersionCheck allows to replay the oplog onto mongo version
+	// (or featureCompatibilityVersion) incompatible with the backup one.
+	SkipVersionCheck bool `bson:"skipVersionCheck,omitempty"`
+
+	// Rerun runs the restore again under the name of the previous run.
+	// The previous run is kept, see ArchivedRestoreName.
+	Rerun bool `bson:"rerun,omitempty"`
+
+	// Storage overrides the configured storage to read the backup and
+	// oplog chunks from. Logical restores only. Its credentials are secret
+	// references (see CheckStorageSecretRefs) resolved by the agents, so
+	// no secrets are stored along with the command.
+	Storage *StorageConf `bson:"storage,omitempty"`
+
+	// IndexBuildConcurrency overrides the configured num of collections
+	// to build indexes for at once. Zero means the configured one.
+	IndexBuildConcurrency int `bson:"indexBuildConcurrency,omitempty"`
+
+	// AllowGaps replays the oplog chunks there are despite gaps between
+	// them. Ops in the gaps are lost, gaps are recorded in the restore
+	// meta (see RestoreReplset.SkippedGaps). Logical restores only.
+	AllowGaps bool `bson:"allowGaps,omitempty"`
+
 	OplogTS primitive.Timestamp `bson:"oplogTS,omitempty"`
+	// OplogStopBefore makes the point-in-time restore stop right before
+	// the op at OplogTS instead of replaying all ops up to it.
+	// Logical restores only.
+	OplogStopBefore bool `bson:"oplogStopBefore,omitempty"`
+	// OplogStopHash, if set, is the hash (`h`) of the op to stop before,
+	// see OplogStopBefore. Only MongoDB < 4.2 has hashes.
+	OplogStopHash *int64 `bson:"oplogStopHash,omitempty"`
+
+	// User is the user who requested the restore, for the audit
+	User string `bson:"user,omitempty"`
 
 	External bool                `bson:"external"`
 	ExtConf  ExternOpts          `bson:"extConf"`
@@ -196,6 +234,12 @@ func (r RestoreCmd) String() string {
 	}
 	if r.OplogTS.T > 0 {
 		bcp += fmt.Sprintf(" point-in-time: <%d,%d>", r.OplogTS.T, r.OplogTS.I)
+		if r.OplogStopBefore {
+			bcp += " (stop before the op)"
+		}
+	}
+	if len(r.Replsets) > 0 {
+		bcp += " replsets: " + strings.Join(r.Replsets, ",")
 	}
 
 	return fmt.Sprintf("name: %s, %s", r.Name, bcp)
@@ -206,6 +250,20 @@ type ReplayCmd struct {
 	Start primitive.Timestamp `bson:"start,omitempty"`
 	End   primitive.Timestamp `bson:"end,omitempty"`
 	RSMap map[string]string   `bson:"rsMap,omitempty"`
+	// Force allows to replay oplog onto the node which last write
+	// is already past the Start
+	Force bool `bson:"force,omitempty"`
+	// Rerun runs the replay again under the name of the previous run,
+	// see RestoreCmd.Rerun
+	Rerun bool `bson:"rerun,omitempty"`
+	// User is the user who requested the replay, for the audit
+	User string `bson:"user,omitempty"`
+	// FanIn allows several replsets of the oplog mapped onto one
+	// by RSMap. Their oplogs are merged by the cluster time.
+	FanIn bool `bson:"fanIn,omitempty"`
+	// AllowGaps replays the oplog chunks there are despite gaps,
+	// see RestoreCmd.AllowGaps
+	AllowGaps bool `bson:"allowGaps,omitempty"`
 }
 
 func (c ReplayCmd) String() string {
@@ -471,6 +529,10 @@ const (
 
 // BackupMeta is a backup's metadata
 type BackupMeta struct {
+	// SchemaVersion is the version of the metadata schema.
+	// See BackupMetaSchemaVersion.
+	SchemaVersion int `bson:"schema_version,omitempty" json:"schema_version,omitempty"`
+
 	Type BackupType `bson:"type" json:"type"`
 	OPID string     `bson:"opid" json:"opid"`
 	Name string     `bson:"name" json:"name"`
@@ -543,6 +605,7 @@ type BackupReplset struct {
 	Files            []File              `bson:"files,omitempty" json:"files,omitempty"`
 	DumpName         string              `bson:"dump_name,omitempty" json:"backup_name,omitempty"`
 	OplogName        string              `bson:"oplog_name,omitempty" json:"oplog_name,omitempty"`
+	OplogChecksum    string              `bson:"oplog_checksum,omitempty" json:"oplog_checksum,omitempty"`
 	StartTS          int64               `bson:"start_ts" json:"start_ts"`
 	Status           Status              `bson:"status" json:"status"`
 	IsConfigSvr      *bool               `bson:"iscs,omitempty" json:"iscs,omitempty"`
@@ -609,6 +672,9 @@ const (
 	StatusCancelled  Status = "canceled"
 	StatusError      Status = "error"
 
+	// replset isn't among the restore targets
+	StatusSkipped Status = "skipped"
+
 	// status to communicate last op timestamp if it's not set
 	// during external restore
 	StatusExtTS Status = "lastTS"
@@ -766,6 +832,18 @@ func (p *PBM) RSSetPhyFiles(bcpName, rsName string, rs *BackupReplset) error {
 	return err
 }
 
+func (p *PBM) SetRSOplogChecksum(ctx context.Context, bcpName, rsName, sum string) error {
+	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
+		ctx,
+		bson.D{{"name", bcpName}, {"replsets.name", rsName}},
+		bson.D{
+			{"$set", bson.M{"replsets.$.oplog_checksum": sum}},
+		},
+	)
+
+	return err
+}
+
 func (p *PBM) SetRSLastWrite(bcpName, rsName string, ts primitive.Timestamp) error {
 	_, err := p.Conn.Database(DB).Collection(BcpCollection).UpdateOne(
 		p.ctx,
@@ -1057,6 +1135,21 @@ func (p *PBM) ClusterTime() (primitive.Timestamp, error) {
 	return inf.ClusterTime.ClusterTime, nil
 }
 
+// CurrentUser returns the user of the PBM connection as `user@db`.
+// Empty if the connection isn't authenticated.
+func (p *PBM) CurrentUser() (string, error) {
+	c := &ConnectionStatus{}
+	err := p.Conn.Database(DB).RunCommand(p.ctx, bson.D{{"connectionStatus", 1}}).Decode(c)
+	if err != nil {
+		return "", errors.Wrap(err, "run mongo command connectionStatus")
+	}
+	if len(c.AuthInfo.Users) == 0 {
+		return "", nil
+	}
+
+	return c.AuthInfo.Users[0].User + "@" + c.AuthInfo.Users[0].DB, nil
+}
+
 func (p *PBM) LogGet(r *log.LogRequest, limit int64) (*log.Entries, error) {
 	return log.Get(p.Conn.Database(DB).Collection(LogCollection), r, limit, false)
 }
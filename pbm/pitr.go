@@ -3,6 +3,7 @@ package pbm
 import (
 	"context"
 	"fmt"
+	"io"
 	"path"
 	"sort"
 	"strconv"
@@ -16,6 +17,7 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
 )
 
 const (
@@ -33,6 +35,15 @@ type OplogChunk struct {
 	StartTS     primitive.Timestamp      `bson:"start_ts"`
 	EndTS       primitive.Timestamp      `bson:"end_ts"`
 	Size        int64                    `bson:"size"`
+	// Checksum of the stored (compressed) chunk. Empty for chunks
+	// made before checksums were added
+	Checksum string `bson:"checksum,omitempty"`
+	// Dict is the file of the zstd dictionary the chunk was compressed
+	// with. Empty if there is none
+	Dict string `bson:"dict,omitempty"`
+	// CompactedFrom are files of the chunks merged into this one. It's set
+	// until they are removed, see pitr.Compact
+	CompactedFrom []string `bson:"compacted_from,omitempty"`
 }
 
 // IsPITR checks if PITR is enabled
@@ -90,6 +101,33 @@ func (p *PBM) PITRFirstChunkMeta(rs string) (*OplogChunk, error) {
 	return p.pitrChunk(rs, 1)
 }
 
+// PITRLatestTS returns the latest time the oplog of all `rss` is
+// recoverable up to, the earliest of the ends of their last chunks.
+// So the oplog of all replsets is replayed up to the same point.
+func (p *PBM) PITRLatestTS(rss []string) (primitive.Timestamp, error) {
+	lasts := make([]OplogChunk, 0, len(rss))
+	for _, rs := range rss {
+		c, err := p.PITRLastChunkMeta(rs)
+		if err != nil {
+			return primitive.Timestamp{}, errors.Wrapf(err, "get the last chunk of %s", rs)
+		}
+		lasts = append(lasts, *c)
+	}
+
+	return earliestEnd(lasts), nil
+}
+
+// earliestEnd returns the earliest end of the chunks
+func earliestEnd(chunks []OplogChunk) primitive.Timestamp {
+	var ts primitive.Timestamp
+	for i, c := range chunks {
+		if i == 0 || c.EndTS.Before(ts) {
+			ts = c.EndTS
+		}
+	}
+	return ts
+}
+
 func (p *PBM) pitrChunk(rs string, sort int) (*OplogChunk, error) {
 	res := p.Conn.Database(DB).Collection(PITRChunksCollection).FindOne(
 		p.ctx,
@@ -109,8 +147,9 @@ func (p *PBM) pitrChunk(rs string, sort int) (*OplogChunk, error) {
 }
 
 func (p *PBM) AllOplogRSNames(ctx context.Context, from, to primitive.Timestamp) ([]string, error) {
-	q := bson.M{
-		"start_ts": bson.M{"$lte": to},
+	q := bson.M{}
+	if !to.IsZero() {
+		q["start_ts"] = bson.M{"$lte": to}
 	}
 	if !from.IsZero() {
 		q["end_ts"] = bson.M{"$gte": from}
@@ -130,8 +169,12 @@ func (p *PBM) AllOplogRSNames(ctx context.Context, from, to primitive.Timestamp)
 }
 
 // PITRGetChunksSlice returns slice of PITR oplog chunks which Start TS
-// lies in a given time frame. Returns all chunks if `to` is 0.
+// lies in a given time frame. Returns all chunks since `from` if `to` is 0.
 func (p *PBM) PITRGetChunksSlice(rs string, from, to primitive.Timestamp) ([]OplogChunk, error) {
+	return p.pitrGetChunksSlice(chunksSliceQuery(rs, from, to))
+}
+
+func chunksSliceQuery(rs string, from, to primitive.Timestamp) bson.D {
 	q := bson.D{}
 	if rs != "" {
 		q = bson.D{{"rs", rs}}
@@ -142,9 +185,116 @@ func (p *PBM) PITRGetChunksSlice(rs string, from, to primitive.Timestamp) ([]Opl
 			{"start_ts", bson.M{"$lte": to}},
 			{"end_ts", bson.M{"$gte": from}},
 		}...)
+	} else if from.T > 0 {
+		q = append(q, bson.E{"end_ts", bson.M{"$gte": from}})
 	}
 
-	return p.pitrGetChunksSlice(q)
+	return q
+}
+
+// chunksIterPage is the num of chunks ChunksIter reads from the db at once
+const chunksIterPage = 1000
+
+// PITRIterChunks is PITRGetChunksSlice that returns an iterator over the
+// chunks instead of loading all of them at once.
+func (p *PBM) PITRIterChunks(rs string, from, to primitive.Timestamp) *ChunksIter {
+	q := chunksSliceQuery(rs, from, to)
+	return NewChunksIter(p.ctx, chunksIterPage, func(after *OplogChunk, limit int) (*mongo.Cursor, error) {
+		f := q
+		if after != nil {
+			// chunks may start at the same time (e.g. re-sliced ones),
+			// so the file name breaks the tie
+			f = append(bson.D{{"$or", bson.A{
+				bson.M{"start_ts": bson.M{"$gt": after.StartTS}},
+				bson.M{"start_ts": after.StartTS, "fname": bson.M{"$gt": after.FName}},
+			}}}, q...)
+		}
+
+		cur, err := p.Conn.Database(DB).Collection(PITRChunksCollection).Find(
+			p.ctx,
+			f,
+			options.Find().SetSort(bson.D{{"start_ts", 1}, {"fname", 1}}).SetLimit(int64(limit)),
+		)
+		return cur, errors.Wrap(err, "get cursor")
+	})
+}
+
+// ChunksPageFn returns the cursor over the next `limit` chunks after the
+// given one (from the first one if nil) in the timeline order.
+type ChunksPageFn func(after *OplogChunk, limit int) (*mongo.Cursor, error)
+
+// ChunksIter iterates oplog chunks in the timeline order. The chunks are
+// read page by page, each by its own query. So no cursor is held open
+// while the chunks are processed, which may take longer than the cursor
+// (or its session) lives on the server.
+type ChunksIter struct {
+	ctx   context.Context
+	size  int
+	page  ChunksPageFn
+	buf   []OplogChunk
+	i     int
+	last  bool
+	chunk OplogChunk
+	err   error
+}
+
+func NewChunksIter(ctx context.Context, size int, page ChunksPageFn) *ChunksIter {
+	return &ChunksIter{ctx: ctx, size: size, page: page}
+}
+
+// Next moves to the next chunk. It returns false when there are no more
+// chunks or on error, see Err.
+func (i *ChunksIter) Next() bool {
+	if i.err != nil {
+		return false
+	}
+	if i.i == len(i.buf) {
+		if i.last {
+			return false
+		}
+		if i.err = i.readPage(); i.err != nil || len(i.buf) == 0 {
+			return false
+		}
+	}
+
+	i.chunk = i.buf[i.i]
+	i.i++
+	return true
+}
+
+func (i *ChunksIter) readPage() error {
+	var after *OplogChunk
+	if len(i.buf) != 0 {
+		after = &i.chunk
+	}
+
+	cur, err := i.page(after, i.size)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(i.ctx)
+
+	i.buf, i.i = i.buf[:0], 0
+	for cur.Next(i.ctx) {
+		var c OplogChunk
+		if err := cur.Decode(&c); err != nil {
+			return errors.Wrap(err, "decode chunk")
+		}
+		i.buf = append(i.buf, c)
+	}
+	i.last = len(i.buf) < i.size
+
+	return cur.Err()
+}
+
+// Chunk returns the current chunk
+func (i *ChunksIter) Chunk() OplogChunk {
+	return i.chunk
+}
+
+// Err returns the error of the iteration, if any
+func (i *ChunksIter) Err() error {
+	return i.err
 }
 
 // PITRGetChunksSliceUntil returns slice of PITR oplog chunks that starts up until timestamp (exclusively)
@@ -210,6 +360,33 @@ func (p *PBM) PITRAddChunk(c OplogChunk) error {
 	return err
 }
 
+// PITRRemoveChunkMetaByName deletes PITR chunk metadata of the file
+func (p *PBM) PITRRemoveChunkMetaByName(rs, fname string) error {
+	_, err := p.Conn.Database(DB).Collection(PITRChunksCollection).DeleteOne(
+		p.ctx,
+		bson.D{{"rs", rs}, {"fname", fname}},
+	)
+
+	return err
+}
+
+// PITRGetCompactingChunks returns merged chunks which sources aren't
+// removed yet, see OplogChunk.CompactedFrom
+func (p *PBM) PITRGetCompactingChunks() ([]OplogChunk, error) {
+	return p.pitrGetChunksSlice(bson.D{{"compacted_from", bson.M{"$exists": true}}})
+}
+
+// PITRUnsetCompactedFrom marks the compaction of the chunk as done
+func (p *PBM) PITRUnsetCompactedFrom(c OplogChunk) error {
+	_, err := p.Conn.Database(DB).Collection(PITRChunksCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"rs", c.RS}, {"fname", c.FName}},
+		bson.D{{"$unset", bson.M{"compacted_from": 1}}},
+	)
+
+	return err
+}
+
 type Timeline struct {
 	Start uint32 `json:"start"`
 	End   uint32 `json:"end"`
@@ -273,6 +450,194 @@ func (p *PBM) PITRTimelines() ([]Timeline, error) {
 	return MergeTimelines(tlns...), nil
 }
 
+// TimelineSegment is a part of the replset's oplog timeline that is either
+// fully covered by chunks (hence recoverable) or is a gap between chunks.
+type TimelineSegment struct {
+	RS    string              `json:"rs"`
+	Start primitive.Timestamp `json:"start"`
+	End   primitive.Timestamp `json:"end"`
+	Gap   bool                `json:"gap"`
+}
+
+// PITRTimeline returns recoverable segments and gaps between them for
+// the [from, to] time range. If rs is empty, segments for all replsets
+// of the cluster are returned, ordered by replset name.
+// Each replset has its own segments so a gap on one shard is reported
+// even if other shards have the range covered.
+func (p *PBM) PITRTimeline(rs string, from, to primitive.Timestamp) ([]TimelineSegment, error) {
+	rss := []string{rs}
+	if rs == "" {
+		shards, err := p.ClusterMembers()
+		if err != nil {
+			return nil, errors.Wrap(err, "get cluster members")
+		}
+
+		rss = make([]string, 0, len(shards))
+		for _, s := range shards {
+			rss = append(rss, s.RS)
+		}
+	}
+
+	chunks, err := p.PITRGetChunksSlice(rs, from, to)
+	if err != nil {
+		return nil, errors.Wrap(err, "get chunks")
+	}
+
+	return rsTimelines(chunks, rss, from, to), nil
+}
+
+// rsTimelines returns segments of each of the replsets `rss` and other
+// replsets that have chunks. The whole range is the gap for the replset
+// without chunks (unless the range is open).
+func rsTimelines(chunks []OplogChunk, rss []string, from, to primitive.Timestamp) []TimelineSegment {
+	byRS := make(map[string][]OplogChunk)
+	for _, rs := range rss {
+		byRS[rs] = nil
+	}
+	for _, c := range chunks {
+		byRS[c.RS] = append(byRS[c.RS], c)
+	}
+
+	names := make([]string, 0, len(byRS))
+	for rs := range byRS {
+		names = append(names, rs)
+	}
+	sort.Strings(names)
+
+	segs := []TimelineSegment{}
+	for _, rs := range names {
+		if len(byRS[rs]) == 0 {
+			if !from.IsZero() && !to.IsZero() {
+				segs = append(segs, TimelineSegment{RS: rs, Start: from, End: to, Gap: true})
+			}
+			continue
+		}
+		segs = append(segs, ChunksTimeline(byRS[rs], from, to)...)
+	}
+
+	return segs
+}
+
+// ChunksTimeline splits the [from, to] time range into segments covered by
+// the given chunks and gaps between them. Chunks should belong to the same
+// replset and be sorted by start_ts. Zero `from` means from the start of
+// the first chunk and zero `to` - till the end of the last one.
+// Adjacent (the start of a chunk equals the end of the previous one) and
+// overlapping chunks make the covered segment, chunks contained in the
+// previous ones are skipped. A gap is only where a chunk starts after the
+// end of all previous ones.
+func ChunksTimeline(chunks []OplogChunk, from, to primitive.Timestamp) []TimelineSegment {
+	segs := []TimelineSegment{}
+	if len(chunks) == 0 {
+		if !from.IsZero() && !to.IsZero() {
+			segs = append(segs, TimelineSegment{Start: from, End: to, Gap: true})
+		}
+		return segs
+	}
+
+	rs := chunks[0].RS
+	if from.IsZero() {
+		from = chunks[0].StartTS
+	}
+
+	tl := TimelineCursor{Last: from, To: to}
+	cur := TimelineSegment{RS: rs, Start: from}
+	covered := false
+	for _, c := range chunks {
+		if !to.IsZero() && c.StartTS.After(to) {
+			break
+		}
+		if c.EndTS.Before(tl.Last) {
+			continue
+		}
+
+		if gap := tl.Add(c); gap != nil {
+			if covered {
+				cur.End = gap.From
+				segs = append(segs, cur)
+			}
+			segs = append(segs, TimelineSegment{RS: rs, Start: gap.From, End: gap.To, Gap: true})
+			cur = TimelineSegment{RS: rs, Start: gap.To}
+		}
+		covered = true
+	}
+
+	last := tl.Last
+	if !to.IsZero() && last.After(to) {
+		last = to
+	}
+	if covered {
+		cur.End = last
+		segs = append(segs, cur)
+	}
+	if !to.IsZero() && last.Before(to) {
+		segs = append(segs, TimelineSegment{RS: rs, Start: last, End: to, Gap: true})
+	}
+
+	return segs
+}
+
+// TimelineCursor follows chunks of a replset as they come in the start_ts
+// order and finds gaps between them. Last is the end of the time range
+// covered so far, zero means from the start of the first chunk. Gaps
+// starting at or after `To` (unless zero) don't matter and aren't reported.
+type TimelineCursor struct {
+	Last primitive.Timestamp
+	To   primitive.Timestamp
+
+	started bool
+}
+
+// Add moves the cursor past the chunk and returns the gap before the chunk
+// if any. Adjacent and overlapping chunks make no gap, chunks contained in
+// the covered range don't move the cursor.
+func (t *TimelineCursor) Add(c OplogChunk) *OplogGap {
+	if !t.started && t.Last.IsZero() {
+		t.Last = c.StartTS
+	}
+	t.started = true
+
+	var gap *OplogGap
+	if c.StartTS.After(t.Last) && (t.To.IsZero() || t.Last.Before(t.To)) {
+		gap = &OplogGap{RS: c.RS, From: t.Last, To: c.StartTS}
+	}
+	if c.EndTS.After(t.Last) {
+		t.Last = c.EndTS
+	}
+
+	return gap
+}
+
+// ChunksSummary is the time range covered by oplog chunks and their totals
+type ChunksSummary struct {
+	From       primitive.Timestamp `json:"from"`
+	To         primitive.Timestamp `json:"to"`
+	Count      int                 `json:"count"`
+	TotalBytes int64               `json:"totalBytes"`
+}
+
+func (s ChunksSummary) String() string {
+	return fmt.Sprintf("%d chunks, %d bytes, %d.%d - %d.%d",
+		s.Count, s.TotalBytes, s.From.T, s.From.I, s.To.T, s.To.I)
+}
+
+// SummarizeChunks returns the range covered by the chunks and their totals.
+// It doesn't check the chunks for gaps, see ChunksTimeline for that.
+func SummarizeChunks(chunks []OplogChunk) ChunksSummary {
+	s := ChunksSummary{Count: len(chunks)}
+	for i, c := range chunks {
+		if i == 0 || c.StartTS.Before(s.From) {
+			s.From = c.StartTS
+		}
+		if c.EndTS.After(s.To) {
+			s.To = c.EndTS
+		}
+		s.TotalBytes += c.Size
+	}
+
+	return s
+}
+
 func gettimelines(slices []OplogChunk) []Timeline {
 	var tl Timeline
 	var prevEnd primitive.Timestamp
@@ -416,6 +781,62 @@ func MergeTimelines(tlns ...[]Timeline) []Timeline {
 	return ret
 }
 
+const zstdDictExt = ".zdict"
+
+// ZstdDictName returns the file name of the replset's zstd dictionary with
+// the given id. The name doesn't parse as a chunk (see PITRmetaFromFName).
+func ZstdDictName(rs string, id uint32) string {
+	return path.Join(PITRfsPrefix, rs, fmt.Sprintf("dict-%08x"+zstdDictExt, id))
+}
+
+// ReadZstdDict reads the zstd dictionary of the chunk. It's nil if the
+// chunk was compressed without a dictionary.
+func ReadZstdDict(stg storage.Storage, chnk *OplogChunk) ([]byte, error) {
+	if chnk.Dict == "" {
+		return nil, nil
+	}
+
+	r, err := stg.SourceReader(chnk.Dict)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get dictionary %s", chnk.Dict)
+	}
+	defer r.Close()
+
+	dict, err := io.ReadAll(r)
+	return dict, errors.Wrapf(err, "read dictionary %s", chnk.Dict)
+}
+
+// SetChunkDict sets the zstd dictionary of the chunk by its id in the
+// chunk's frame header. The dictionary isn't in the chunk name, so it's
+// for the chunks found on the storage (see ListPITRChunks).
+func SetChunkDict(stg storage.Storage, c *OplogChunk) error {
+	if c.Compression != compress.CompressionTypeZstandard {
+		return nil
+	}
+
+	// only the frame header is needed, not the whole chunk
+	r, err := storage.SourceHead(stg, c.FName, compress.ZstdFrameHeaderSize)
+	if err != nil {
+		return errors.Wrapf(err, "get object %s form the storage", c.FName)
+	}
+	defer r.Close()
+
+	id, err := compress.ZstdFrameDictID(r)
+	if err != nil {
+		return errors.Wrapf(err, "object %s", c.FName)
+	}
+	if id == 0 {
+		return nil
+	}
+
+	c.Dict = ZstdDictName(c.RS, id)
+	if _, err := stg.FileStat(c.Dict); err != nil {
+		return errors.Wrapf(err, "dictionary %s of chunk %s", c.Dict, c.FName)
+	}
+
+	return nil
+}
+
 // PITRmetaFromFName parses given file name and returns PITRChunk metadata
 // it returns nil if file wasn't parse successfully (e.g. wrong format)
 // current fromat is 20200715155939-0.20200715160029-1.oplog.snappy
@@ -435,11 +856,15 @@ func PITRmetaFromFName(f string) *OplogChunk {
 	if len(fparts) < 3 || fparts[2] != "oplog" {
 		return nil
 	}
+	var ext string
 	if len(fparts) == 4 {
-		chnk.Compression = compress.FileCompression(fparts[3])
-	} else {
-		chnk.Compression = compress.CompressionTypeNone
+		ext = "." + fparts[3]
 	}
+	c, err := compress.ParseType(ext)
+	if err != nil {
+		return nil
+	}
+	chnk.Compression = c
 
 	start := pitrParseTS(fparts[0])
 	if start == nil {
@@ -456,6 +881,54 @@ func PITRmetaFromFName(f string) *OplogChunk {
 	return chnk
 }
 
+// ListPITRChunks lists the oplog chunks of the replset `rs` (all replsets
+// if empty) on the storage, parsing their names (see PITRmetaFromFName).
+// So the chunks can be found without the chunks index, e.g. if it's lost.
+// Empty chunks are skipped. Chunks are sorted by the replset and the start.
+// It also returns the names of the files that don't parse as chunks,
+// but the zstd dictionaries.
+func ListPITRChunks(stg storage.Storage, rs string) ([]OplogChunk, []string, error) {
+	prefix := PITRfsPrefix
+	if rs != "" {
+		prefix = path.Join(PITRfsPrefix, rs)
+	}
+	files, err := stg.List(prefix, "")
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "list %s", prefix)
+	}
+
+	var chunks []OplogChunk
+	var unparsed []string
+	for _, f := range files {
+		if f.Size == 0 {
+			continue
+		}
+		name := f.Name
+		if rs != "" {
+			name = path.Join(rs, f.Name)
+		}
+		chnk := PITRmetaFromFName(name)
+		if chnk == nil {
+			if path.Ext(name) != zstdDictExt {
+				unparsed = append(unparsed, path.Join(PITRfsPrefix, name))
+			}
+			continue
+		}
+		chnk.Size = f.Size
+		chunks = append(chunks, *chnk)
+	}
+
+	sort.Slice(chunks, func(i, j int) bool {
+		if chunks[i].RS != chunks[j].RS {
+			return chunks[i].RS < chunks[j].RS
+		}
+		return chunks[i].StartTS.Before(chunks[j].StartTS)
+	})
+	sort.Strings(unparsed)
+
+	return chunks, unparsed, nil
+}
+
 func pitrParseTS(tstr string) *primitive.Timestamp {
 	tparts := strings.Split(tstr, "-")
 	t, err := time.Parse("20060102150405", tparts[0])
@@ -0,0 +1,280 @@
+package pitr
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/backup"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+)
+
+// compactIndex is the chunks index the compaction works with, see pbm.PBM
+type compactIndex interface {
+	PITRGetChunksSlice(rs string, from, to primitive.Timestamp) ([]pbm.OplogChunk, error)
+	PITRAddChunk(c pbm.OplogChunk) error
+	PITRRemoveChunkMetaByName(rs, fname string) error
+	PITRGetCompactingChunks() ([]pbm.OplogChunk, error)
+	PITRUnsetCompactedFrom(c pbm.OplogChunk) error
+}
+
+// Compact merges contiguous PITR chunks of the given replset within
+// [from, to] into fewer larger ones. Uncompressed size of a merged chunk
+// won't exceed maxSize unless a single chunk is already bigger. maxSize <= 0
+// means no limit.
+//
+// The decompressed oplog of the source chunks is concatenated as is, so
+// restore from the merged chunk replays exactly the same ops. The merged
+// chunk and its metadata are saved first and only after that the source
+// chunks are removed. Thus at any moment the timeline remains contiguous.
+// The merged chunk is marked with its sources until they're removed, so
+// a compaction interrupted in between is finished by the next one (see
+// ReconcileCompaction). Until then, the merged chunk overlaps its sources
+// which restore replays idempotently.
+//
+// It returns the merged chunks metadata.
+func Compact(
+	ctx context.Context,
+	cn *pbm.PBM,
+	stg storage.Storage,
+	rs string,
+	from,
+	to primitive.Timestamp,
+	maxSize int64,
+	compression compress.CompressionType,
+	level *int,
+	l *log.Event,
+) ([]pbm.OplogChunk, error) {
+	return compact(ctx, cn, stg, rs, from, to, maxSize, compression, level, l)
+}
+
+func compact(
+	ctx context.Context,
+	idx compactIndex,
+	stg storage.Storage,
+	rs string,
+	from,
+	to primitive.Timestamp,
+	maxSize int64,
+	compression compress.CompressionType,
+	level *int,
+	l *log.Event,
+) ([]pbm.OplogChunk, error) {
+	if err := reconcileCompaction(ctx, idx, stg, l); err != nil {
+		return nil, errors.Wrap(err, "finish interrupted compaction")
+	}
+
+	chunks, err := idx.PITRGetChunksSlice(rs, from, to)
+	if err != nil {
+		return nil, errors.Wrap(err, "get chunks")
+	}
+
+	var merged []pbm.OplogChunk
+	for _, group := range planCompaction(chunks, maxSize) {
+		if err := ctx.Err(); err != nil {
+			return merged, err
+		}
+
+		c, err := mergeChunks(ctx, stg, group, compression, level)
+		if err != nil {
+			return merged, errors.Wrapf(err, "merge chunks %v - %v",
+				group[0].StartTS, group[len(group)-1].EndTS)
+		}
+
+		c.CompactedFrom = make([]string, len(group))
+		for i, old := range group {
+			c.CompactedFrom[i] = old.FName
+		}
+		err = idx.PITRAddChunk(c)
+		if err != nil {
+			derr := stg.Delete(c.FName)
+			if derr != nil {
+				l.Error("remove %s: %v", c.FName, derr)
+			}
+			return merged, errors.Wrapf(err, "save chunk meta %v", c)
+		}
+
+		// the merged chunk is in the index, so the sources are removed
+		// regardless of the ctx. Otherwise, it's left for the next run.
+		err = removeSources(context.Background(), idx, stg, c)
+		if err != nil {
+			return merged, err
+		}
+
+		l.Info("compacted %d chunks into %s", len(group), c.FName)
+		merged = append(merged, c)
+	}
+
+	return merged, nil
+}
+
+// ReconcileCompaction finishes compactions interrupted after the merged
+// chunk was saved: its source chunks are removed.
+func ReconcileCompaction(ctx context.Context, cn *pbm.PBM, stg storage.Storage, l *log.Event) error {
+	return reconcileCompaction(ctx, cn, stg, l)
+}
+
+func reconcileCompaction(ctx context.Context, idx compactIndex, stg storage.Storage, l *log.Event) error {
+	chunks, err := idx.PITRGetCompactingChunks()
+	if err != nil {
+		return errors.Wrap(err, "get compacting chunks")
+	}
+
+	for _, c := range chunks {
+		if err := removeSources(ctx, idx, stg, c); err != nil {
+			return err
+		}
+		l.Info("finished compaction of %d chunks into %s", len(c.CompactedFrom), c.FName)
+	}
+
+	return nil
+}
+
+// removeSources removes chunks the chunk is merged from and then
+// marks the compaction as done
+func removeSources(ctx context.Context, idx compactIndex, stg storage.Storage, c pbm.OplogChunk) error {
+	for _, f := range c.CompactedFrom {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := idx.PITRRemoveChunkMetaByName(c.RS, f)
+		if err != nil {
+			return errors.Wrapf(err, "remove chunk meta %s", f)
+		}
+		err = stg.Delete(f)
+		if err != nil && !errors.Is(err, storage.ErrNotExist) {
+			return errors.Wrapf(err, "delete chunk %s", f)
+		}
+	}
+
+	err := idx.PITRUnsetCompactedFrom(c)
+	return errors.Wrapf(err, "mark %s compacted", c.FName)
+}
+
+// planCompaction splits chunks (sorted by start_ts) into groups of
+// contiguous chunks of the same replset that can be merged. Groups of
+// a single chunk are omitted as there is nothing to merge.
+func planCompaction(chunks []pbm.OplogChunk, maxSize int64) [][]pbm.OplogChunk {
+	var (
+		groups [][]pbm.OplogChunk
+		cur    []pbm.OplogChunk
+		size   int64
+	)
+
+	flush := func() {
+		if len(cur) > 1 {
+			groups = append(groups, cur)
+		}
+		cur, size = nil, 0
+	}
+
+	for _, c := range chunks {
+		if len(cur) > 0 {
+			prev := cur[len(cur)-1]
+			if c.RS != prev.RS ||
+				!c.StartTS.Equal(prev.EndTS) ||
+				(maxSize > 0 && size+c.Size > maxSize) {
+				flush()
+			}
+		}
+
+		cur = append(cur, c)
+		size += c.Size
+	}
+	flush()
+
+	return groups
+}
+
+// mergeChunks writes the concatenated oplog of the given contiguous chunks
+// into a new chunk and returns its metadata.
+func mergeChunks(
+	ctx context.Context,
+	stg storage.Storage,
+	chunks []pbm.OplogChunk,
+	compression compress.CompressionType,
+	level *int,
+) (pbm.OplogChunk, error) {
+	first, last := chunks[0], chunks[len(chunks)-1]
+	c := pbm.OplogChunk{
+		RS:          first.RS,
+		FName:       ChunkName(first.RS, first.StartTS, last.EndTS, compression),
+		Compression: compression,
+		StartTS:     first.StartTS,
+		EndTS:       last.EndTS,
+	}
+
+	size, sum, err := backup.UploadWithChecksum(ctx, &chunksSource{ctx: ctx, stg: stg, chunks: chunks},
+		stg, compression, level, c.FName, -1)
+	if err != nil {
+		derr := stg.Delete(c.FName)
+		if derr != nil && !errors.Is(derr, storage.ErrNotExist) {
+			err = errors.Wrapf(err, "remove %s: %v", c.FName, derr)
+		}
+		return c, err
+	}
+	c.Size = size
+	c.Checksum = sum
+
+	return c, nil
+}
+
+// chunksSource reads decompressed oplog of chunks one by one
+type chunksSource struct {
+	ctx    context.Context
+	stg    storage.Storage
+	chunks []pbm.OplogChunk
+}
+
+func (s *chunksSource) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for _, c := range s.chunks {
+		if err := s.ctx.Err(); err != nil {
+			return written, err
+		}
+
+		n, err := s.copyChunk(w, c)
+		written += n
+		if err != nil {
+			return written, errors.Wrapf(err, "chunk %s", c.FName)
+		}
+	}
+
+	return written, nil
+}
+
+//nolint:nonamedreturns
+func (s *chunksSource) copyChunk(w io.Writer, c pbm.OplogChunk) (n int64, err error) {
+	sr, err := s.stg.SourceReader(c.FName)
+	if err != nil {
+		return 0, errors.Wrap(err, "get from the storage")
+	}
+	r, err := storage.VerifyReader(sr, c.Checksum)
+	if err != nil {
+		sr.Close()
+		return 0, err
+	}
+	defer func() {
+		if cerr := r.Close(); err == nil && cerr != nil {
+			err = cerr
+		}
+	}()
+
+	dict, err := pbm.ReadZstdDict(s.stg, &c)
+	if err != nil {
+		return 0, err
+	}
+	data, err := compress.DecompressWithDict(r, c.Compression, 0, dict)
+	if err != nil {
+		return 0, errors.Wrap(err, "decompress")
+	}
+	defer data.Close()
+
+	return io.Copy(w, data)
+}
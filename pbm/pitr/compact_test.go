@@ -0,0 +1,325 @@
+package pitr
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+	"github.com/percona/percona-backup-mongodb/pbm/storage/fs"
+)
+
+func TestPlanCompaction(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", StartTS: ts(1), EndTS: ts(10), Size: 10},
+		{RS: "rs0", StartTS: ts(10), EndTS: ts(20), Size: 10},
+		{RS: "rs0", StartTS: ts(20), EndTS: ts(30), Size: 10},
+		// gap
+		{RS: "rs0", StartTS: ts(40), EndTS: ts(50), Size: 10},
+		{RS: "rs0", StartTS: ts(50), EndTS: ts(60), Size: 100},
+		{RS: "rs0", StartTS: ts(60), EndTS: ts(70), Size: 10},
+		{RS: "rs0", StartTS: ts(70), EndTS: ts(80), Size: 10},
+		// single
+		{RS: "rs0", StartTS: ts(90), EndTS: ts(100), Size: 10},
+	}
+
+	groups := planCompaction(chunks, 50)
+	expect := [][2]uint32{{1, 30}, {60, 80}}
+	if len(groups) != len(expect) {
+		t.Fatalf("expected %d groups, got %d: %v", len(expect), len(groups), groups)
+	}
+	for i, g := range groups {
+		if g[0].StartTS.T != expect[i][0] || g[len(g)-1].EndTS.T != expect[i][1] {
+			t.Errorf("group %d: expected [%d - %d], got [%d - %d]", i,
+				expect[i][0], expect[i][1], g[0].StartTS.T, g[len(g)-1].EndTS.T)
+		}
+	}
+
+	if groups := planCompaction(chunks, 0); len(groups) != 2 {
+		t.Errorf("expected 2 groups without size limit, got %d", len(groups))
+	}
+}
+
+func TestMergeChunks(t *testing.T) {
+	stg, err := fs.New(fs.Conf{Path: t.TempDir()})
+	if err != nil {
+		t.Fatalf("create storage: %v", err)
+	}
+
+	cmprs := []compress.CompressionType{
+		compress.CompressionTypeS2,
+		compress.CompressionTypeGZIP,
+		compress.CompressionTypeNone,
+		compress.CompressionTypeZstandard,
+	}
+
+	var (
+		chunks []pbm.OplogChunk
+		orig   bytes.Buffer
+		ts     uint32 = 1000
+	)
+	for i, c := range cmprs {
+		start := primitive.Timestamp{T: ts, I: 1}
+		ts += 10
+		end := primitive.Timestamp{T: ts, I: 1}
+
+		data := oplogData(t, start.T, end.T, i)
+		orig.Write(data)
+
+		chunk := pbm.OplogChunk{
+			RS:          "rs0",
+			FName:       ChunkName("rs0", start, end, c),
+			Compression: c,
+			StartTS:     start,
+			EndTS:       end,
+			Size:        int64(len(data)),
+		}
+		saveChunk(t, stg, chunk, data)
+		chunks = append(chunks, chunk)
+	}
+
+	groups := planCompaction(chunks, 0)
+	if len(groups) != 1 || len(groups[0]) != len(chunks) {
+		t.Fatalf("expected all chunks in one group, got %v", groups)
+	}
+
+	c, err := mergeChunks(context.Background(), stg, groups[0], compress.CompressionTypeS2, nil)
+	if err != nil {
+		t.Fatalf("merge chunks: %v", err)
+	}
+
+	if !c.StartTS.Equal(chunks[0].StartTS) || !c.EndTS.Equal(chunks[len(chunks)-1].EndTS) {
+		t.Errorf("merged chunk breaks the timeline: [%v - %v], expected [%v - %v]",
+			c.StartTS, c.EndTS, chunks[0].StartTS, chunks[len(chunks)-1].EndTS)
+	}
+	if c.Size != int64(orig.Len()) {
+		t.Errorf("expected size %d, got %d", orig.Len(), c.Size)
+	}
+
+	r, err := stg.SourceReader(c.FName)
+	if err != nil {
+		t.Fatalf("read merged chunk: %v", err)
+	}
+	defer r.Close()
+	dr, err := compress.Decompress(r, c.Compression)
+	if err != nil {
+		t.Fatalf("decompress merged chunk: %v", err)
+	}
+	defer dr.Close()
+
+	got, err := io.ReadAll(dr)
+	if err != nil {
+		t.Fatalf("read merged chunk: %v", err)
+	}
+	if !bytes.Equal(got, orig.Bytes()) {
+		t.Errorf("merged oplog differs from the original chunks")
+	}
+}
+
+func TestCompactCanceled(t *testing.T) {
+	stg, err := fs.New(fs.Conf{Path: t.TempDir()})
+	if err != nil {
+		t.Fatalf("create storage: %v", err)
+	}
+	idx := &memIndex{chunks: testChunks(t, stg, 3)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = compact(ctx, idx, stg, "rs0", primitive.Timestamp{}, primitive.Timestamp{T: 1 << 31},
+		0, compress.CompressionTypeS2, nil, testEvent())
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if len(idx.chunks) != 3 {
+		t.Errorf("expected the chunks index untouched, got %v", idx.chunks)
+	}
+	files, err := stg.List("", "")
+	if err != nil {
+		t.Fatalf("list storage: %v", err)
+	}
+	if len(files) != 3 {
+		t.Errorf("expected only source chunks on storage, got %v", files)
+	}
+}
+
+func TestCompactReconcile(t *testing.T) {
+	stg, err := fs.New(fs.Conf{Path: t.TempDir()})
+	if err != nil {
+		t.Fatalf("create storage: %v", err)
+	}
+	chunks := testChunks(t, stg, 3)
+	idx := &memIndex{chunks: append([]pbm.OplogChunk{}, chunks...), failRemove: 2}
+
+	from, to := chunks[0].StartTS, chunks[len(chunks)-1].EndTS
+	_, err = compact(context.Background(), idx, stg, "rs0", from, to,
+		0, compress.CompressionTypeS2, nil, testEvent())
+	if err == nil {
+		t.Fatal("expected the compaction to be interrupted")
+	}
+
+	pending, _ := idx.PITRGetCompactingChunks()
+	if len(pending) != 1 {
+		t.Fatalf("expected the merged chunk marked as compacting, got %v", pending)
+	}
+
+	err = reconcileCompaction(context.Background(), idx, stg, testEvent())
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	if len(idx.chunks) != 1 || len(idx.chunks[0].CompactedFrom) != 0 {
+		t.Fatalf("expected only the merged chunk in the index, got %v", idx.chunks)
+	}
+	c := idx.chunks[0]
+	if !c.StartTS.Equal(from) || !c.EndTS.Equal(to) {
+		t.Errorf("merged chunk breaks the timeline: [%v - %v], expected [%v - %v]", c.StartTS, c.EndTS, from, to)
+	}
+	files, err := stg.List("", "")
+	if err != nil {
+		t.Fatalf("list storage: %v", err)
+	}
+	if len(files) != 1 || files[0].Name != c.FName {
+		t.Errorf("expected only the merged chunk on storage, got %v", files)
+	}
+}
+
+// memIndex is the in-memory chunks index. It fails the failRemove-th
+// chunk meta removal to simulate an interrupted compaction.
+type memIndex struct {
+	chunks     []pbm.OplogChunk
+	removed    int
+	failRemove int
+}
+
+func (m *memIndex) PITRGetChunksSlice(rs string, from, to primitive.Timestamp) ([]pbm.OplogChunk, error) {
+	var rv []pbm.OplogChunk
+	for _, c := range m.chunks {
+		if c.RS == rs && primitive.CompareTimestamp(c.EndTS, from) >= 0 &&
+			primitive.CompareTimestamp(c.StartTS, to) <= 0 {
+			rv = append(rv, c)
+		}
+	}
+	return rv, nil
+}
+
+func (m *memIndex) PITRAddChunk(c pbm.OplogChunk) error {
+	m.chunks = append(m.chunks, c)
+	return nil
+}
+
+func (m *memIndex) PITRRemoveChunkMetaByName(rs, fname string) error {
+	m.removed++
+	if m.removed == m.failRemove {
+		return errors.New("connection lost")
+	}
+
+	for i, c := range m.chunks {
+		if c.RS == rs && c.FName == fname {
+			m.chunks = append(m.chunks[:i], m.chunks[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *memIndex) PITRGetCompactingChunks() ([]pbm.OplogChunk, error) {
+	var rv []pbm.OplogChunk
+	for _, c := range m.chunks {
+		if len(c.CompactedFrom) != 0 {
+			rv = append(rv, c)
+		}
+	}
+	return rv, nil
+}
+
+func (m *memIndex) PITRUnsetCompactedFrom(c pbm.OplogChunk) error {
+	for i := range m.chunks {
+		if m.chunks[i].FName == c.FName {
+			m.chunks[i].CompactedFrom = nil
+		}
+	}
+	return nil
+}
+
+func testChunks(t *testing.T, stg storage.Storage, n int) []pbm.OplogChunk {
+	t.Helper()
+
+	var chunks []pbm.OplogChunk
+	ts := uint32(1000)
+	for i := 0; i < n; i++ {
+		start := primitive.Timestamp{T: ts, I: 1}
+		ts += 10
+		end := primitive.Timestamp{T: ts, I: 1}
+
+		data := oplogData(t, start.T, end.T, i)
+		c := pbm.OplogChunk{
+			RS:          "rs0",
+			FName:       ChunkName("rs0", start, end, compress.CompressionTypeS2),
+			Compression: compress.CompressionTypeS2,
+			StartTS:     start,
+			EndTS:       end,
+			Size:        int64(len(data)),
+		}
+		saveChunk(t, stg, c, data)
+		chunks = append(chunks, c)
+	}
+
+	return chunks
+}
+
+func testEvent() *log.Event {
+	return log.New(nil, "rs0", "node").NewEvent("compact", "test", "", primitive.Timestamp{})
+}
+
+func oplogData(t *testing.T, from, to uint32, n int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	for ts := from; ts <= to; ts++ {
+		b, err := bson.Marshal(bson.M{
+			"ts": primitive.Timestamp{T: ts, I: 1},
+			"op": "i",
+			"ns": "test.c",
+			"o":  bson.M{"_id": int(ts), "chunk": n},
+		})
+		if err != nil {
+			t.Fatalf("marshal oplog entry: %v", err)
+		}
+		buf.Write(b)
+	}
+
+	return buf.Bytes()
+}
+
+func saveChunk(t *testing.T, stg storage.Storage, c pbm.OplogChunk, data []byte) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := compress.Compress(&buf, c.Compression, nil)
+	if err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+
+	err = stg.Save(c.FName, &buf, int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("save chunk: %v", err)
+	}
+}
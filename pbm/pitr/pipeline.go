@@ -0,0 +1,173 @@
+package pitr
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/backup"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+)
+
+// sliceRange is the [from, to] oplog range of a chunk
+type sliceRange struct {
+	from, to primitive.Timestamp
+}
+
+// splitRange splits [from, to] into contiguous ranges of `span` seconds.
+// The last range ends at `to`.
+func splitRange(from, to primitive.Timestamp, span uint32) []sliceRange {
+	if span == 0 {
+		return []sliceRange{{from, to}}
+	}
+
+	var rs []sliceRange
+	for cur := from; ; {
+		next := primitive.Timestamp{T: cur.T + span}
+		if !next.Before(to) {
+			return append(rs, sliceRange{cur, to})
+		}
+		rs = append(rs, sliceRange{cur, next})
+		cur = next
+	}
+}
+
+// chunkSource reads the oplog of a chunk. End is the end of the read
+// oplog, it's before the requested one if the chunk was cut by size.
+type chunkSource interface {
+	backup.Source
+	End() primitive.Timestamp
+}
+
+// zstdDict is the dictionary the chunks are compressed with, see Slicer.trainDict
+type zstdDict struct {
+	name string
+	data []byte
+}
+
+// slice is a compressed oplog chunk waiting for the upload
+type slice struct {
+	sliceRange
+	data []byte
+	size int64
+	sum  string
+	err  error
+}
+
+// readSlice reads and compresses the oplog of the range into memory
+func readSlice(src chunkSource, r sliceRange, c compress.CompressionType, level *int, dict []byte) slice {
+	s := slice{sliceRange: r}
+
+	buf := &bytes.Buffer{}
+	h := storage.NewChecksum()
+	w, err := compress.CompressWithDict(io.MultiWriter(buf, h), c, level, dict)
+	if err != nil {
+		s.err = errors.Wrapf(err, "create %s writer", c)
+		return s
+	}
+
+	s.size, err = src.WriteTo(w)
+	if err != nil {
+		s.err = errors.Wrap(err, "read oplog")
+		return s
+	}
+	if err = w.Close(); err != nil {
+		s.err = errors.Wrap(err, "compress")
+		return s
+	}
+
+	if end := src.End(); !end.IsZero() {
+		s.to = end
+	}
+	s.data = buf.Bytes()
+	s.sum = storage.FormatChecksum(h)
+	return s
+}
+
+// pipelineSlices makes chunks of the ranges. The oplog of the next chunk
+// is read and compressed while the previous ones are uploaded, up to
+// `depth` compressed chunks are kept in memory waiting for the upload.
+// Chunks are uploaded and saved by `add` in order and the first failure
+// stops the pipeline, so the saved chunks stay contiguous. A range cut by
+// the source (see chunkSource) is continued with the next chunk. It returns
+// the end of the last saved chunk.
+func pipelineSlices(
+	ctx context.Context,
+	rs string,
+	ranges []sliceRange,
+	depth int,
+	read func(r sliceRange) chunkSource,
+	c compress.CompressionType,
+	level *int,
+	dict zstdDict,
+	stg storage.Storage,
+	add func(pbm.OplogChunk) error,
+) (primitive.Timestamp, error) {
+	var last primitive.Timestamp
+	if depth < 1 {
+		depth = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	slices := make(chan slice, depth)
+	go func() {
+		defer close(slices)
+		for _, r := range ranges {
+			for cur := r; ; {
+				s := readSlice(read(cur), cur, c, level, dict.data)
+				select {
+				case slices <- s:
+				case <-ctx.Done():
+					return
+				}
+				if s.err != nil {
+					return
+				}
+				if !s.to.Before(r.to) {
+					break
+				}
+				cur.from = s.to
+			}
+		}
+	}()
+
+	for s := range slices {
+		if s.err != nil {
+			return last, errors.Wrapf(s.err, "unable to read chunk %v.%v", s.from, s.to)
+		}
+
+		fname := ChunkName(rs, s.from, s.to, c)
+		err := stg.Save(fname, bytes.NewReader(s.data), int64(len(s.data)))
+		if err != nil {
+			// see Slicer.upload
+			if derr := stg.Delete(fname); derr != nil && !errors.Is(derr, storage.ErrNotExist) {
+				err = errors.Wrapf(err, "remove %s: %v", fname, derr)
+			}
+			return last, errors.Wrapf(err, "unable to upload chunk %v.%v", s.from, s.to)
+		}
+
+		err = add(pbm.OplogChunk{
+			RS:          rs,
+			FName:       fname,
+			Compression: c,
+			StartTS:     s.from,
+			EndTS:       s.to,
+			Size:        s.size,
+			Checksum:    s.sum,
+			Dict:        dict.name,
+		})
+		if err != nil {
+			return last, errors.Wrapf(err, "unable to save chunk meta %v.%v", s.from, s.to)
+		}
+		last = s.to
+	}
+
+	return last, ctx.Err()
+}
@@ -0,0 +1,222 @@
+package pitr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/backup"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+	"github.com/percona/percona-backup-mongodb/pbm/storage/fs"
+)
+
+// bytesSource is a chunk of the whole requested range
+type bytesSource []byte
+
+func (s bytesSource) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(s)
+	return int64(n), err
+}
+
+func (bytesSource) End() primitive.Timestamp { return primitive.Timestamp{} }
+
+func TestSplitRange(t *testing.T) {
+	ts := func(t, i uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: i} }
+
+	got := splitRange(ts(100, 3), ts(125, 2), 10)
+	expect := []sliceRange{
+		{ts(100, 3), ts(110, 0)},
+		{ts(110, 0), ts(120, 0)},
+		{ts(120, 0), ts(125, 2)},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	if got := splitRange(ts(100, 3), ts(105, 2), 10); len(got) != 1 {
+		t.Errorf("expected a single range, got %v", got)
+	}
+}
+
+func TestPipelineSlices(t *testing.T) {
+	from := primitive.Timestamp{T: 1000, I: 1}
+	to := primitive.Timestamp{T: 1095, I: 7}
+	ranges := splitRange(from, to, 10)
+	// oplogData isn't stable since bson.M has no order
+	data := make(map[sliceRange][]byte)
+	for _, r := range ranges {
+		data[r] = oplogData(t, r.from.T, r.to.T, int(r.from.T))
+	}
+	read := func(r sliceRange) chunkSource { return bytesSource(data[r]) }
+
+	for _, c := range []compress.CompressionType{compress.CompressionTypeS2, compress.CompressionTypeZstandard} {
+		t.Run(string(c), func(t *testing.T) {
+			serialStg := newFS(t)
+			var serial []pbm.OplogChunk
+			for _, r := range ranges {
+				fname := ChunkName("rs0", r.from, r.to, c)
+				size, sum, err := backup.UploadWithChecksum(context.Background(), read(r),
+					serialStg, c, nil, fname, -1)
+				if err != nil {
+					t.Fatalf("upload: %v", err)
+				}
+				serial = append(serial, pbm.OplogChunk{
+					RS: "rs0", FName: fname, Compression: c,
+					StartTS: r.from, EndTS: r.to, Size: size, Checksum: sum,
+				})
+			}
+
+			pipeStg := newFS(t)
+			var piped []pbm.OplogChunk
+			last, err := pipelineSlices(context.Background(), "rs0", ranges, 3, read, c, nil, zstdDict{}, pipeStg,
+				func(c pbm.OplogChunk) error {
+					piped = append(piped, c)
+					return nil
+				})
+			if err != nil {
+				t.Fatalf("pipeline: %v", err)
+			}
+			if last != to {
+				t.Errorf("expected last ts %v, got %v", to, last)
+			}
+
+			if !reflect.DeepEqual(piped, serial) {
+				t.Fatalf("expected chunks %v, got %v", serial, piped)
+			}
+			for _, seg := range pbm.ChunksTimeline(piped, from, to) {
+				if seg.Gap {
+					t.Errorf("gap in chunks %v - %v", seg.Start, seg.End)
+				}
+			}
+			for _, ch := range piped {
+				if !bytes.Equal(readFile(t, pipeStg, ch.FName), readFile(t, serialStg, ch.FName)) {
+					t.Errorf("%s differs from the serial one", ch.FName)
+				}
+			}
+		})
+	}
+}
+
+func TestPipelineSlicesStopsOnError(t *testing.T) {
+	ranges := splitRange(primitive.Timestamp{T: 1000}, primitive.Timestamp{T: 1050}, 10)
+	read := func(r sliceRange) chunkSource {
+		return bytesSource(oplogData(t, r.from.T, r.to.T, 0))
+	}
+
+	errSave := errors.New("save failed")
+	var saved []pbm.OplogChunk
+	last, err := pipelineSlices(context.Background(), "rs0", ranges, 2, read,
+		compress.CompressionTypeNone, nil, zstdDict{}, newFS(t),
+		func(c pbm.OplogChunk) error {
+			if len(saved) == 2 {
+				return errSave
+			}
+			saved = append(saved, c)
+			return nil
+		})
+	if !errors.Is(err, errSave) {
+		t.Fatalf("expected save error, got %v", err)
+	}
+	if len(saved) != 2 || last != ranges[1].to {
+		t.Errorf("expected 2 chunks saved up to %v, got %d up to %v", ranges[1].to, len(saved), last)
+	}
+}
+
+func newFS(t *testing.T) storage.Storage {
+	t.Helper()
+
+	stg, err := fs.New(fs.Conf{Path: t.TempDir()})
+	if err != nil {
+		t.Fatalf("create storage: %v", err)
+	}
+	return stg
+}
+
+func readFile(t *testing.T, stg storage.Storage, name string) []byte {
+	t.Helper()
+
+	r, err := stg.SourceReader(name)
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	return b
+}
+
+// cutSource has an op of 10 bytes per second and cuts the chunk
+// after maxOps ops
+type cutSource struct {
+	r      sliceRange
+	maxOps uint32
+	end    primitive.Timestamp
+}
+
+func (s *cutSource) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	for t := s.r.from.T; t <= s.r.to.T; t++ {
+		m, err := w.Write(bytes.Repeat([]byte{byte(t)}, 10))
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+		if uint32(n/10) >= s.maxOps && t > s.r.from.T && t < s.r.to.T {
+			s.end = primitive.Timestamp{T: t}
+			break
+		}
+	}
+	return n, nil
+}
+
+func (s *cutSource) End() primitive.Timestamp { return s.end }
+
+func TestPipelineSlicesCut(t *testing.T) {
+	from := primitive.Timestamp{T: 1000}
+	to := primitive.Timestamp{T: 1050}
+	const span, maxOps = 20, 7
+
+	var chunks []pbm.OplogChunk
+	last, err := pipelineSlices(context.Background(), "rs0", splitRange(from, to, span), 2,
+		func(r sliceRange) chunkSource { return &cutSource{r: r, maxOps: maxOps} },
+		compress.CompressionTypeNone, nil, zstdDict{}, newFS(t),
+		func(c pbm.OplogChunk) error {
+			chunks = append(chunks, c)
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("pipeline: %v", err)
+	}
+	if last != to {
+		t.Errorf("expected last ts %v, got %v", to, last)
+	}
+
+	for _, seg := range pbm.ChunksTimeline(chunks, from, to) {
+		if seg.Gap {
+			t.Errorf("gap in chunks %v - %v", seg.Start, seg.End)
+		}
+	}
+	for _, c := range chunks {
+		if c.EndTS.T-c.StartTS.T > span {
+			t.Errorf("chunk %v - %v is longer than the span", c.StartTS, c.EndTS)
+		}
+		if c.Size > maxOps*10 {
+			t.Errorf("chunk %v - %v is bigger than the cap: %d", c.StartTS, c.EndTS, c.Size)
+		}
+	}
+	// 20s spans are cut into chunks of 7 ops, each starts with the last
+	// op of the previous one: 4 + 4 + 2 for [1040, 1050]
+	if len(chunks) != 10 {
+		t.Errorf("expected 10 chunks, got %d", len(chunks))
+	}
+}
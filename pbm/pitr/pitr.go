@@ -1,6 +1,7 @@
 package pitr
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"strconv"
@@ -27,11 +28,19 @@ type Slicer struct {
 	node    *pbm.Node
 	rs      string
 	span    int64
+	depth   int64
 	lastTS  primitive.Timestamp
 	storage storage.Storage
 	oplog   *oplog.OplogBackup
 	l       *log.Event
 	ep      pbm.Epoch
+
+	// maxBytes caps the size of a chunk, see SetChunkMaxBytes
+	maxBytes int64
+
+	// dictSize is the max size of the zstd dictionary, see SetZstdDictSize
+	dictSize int
+	dict     zstdDict
 }
 
 // NewSlicer creates an incremental backup object
@@ -57,6 +66,26 @@ func (s *Slicer) GetSpan() time.Duration {
 	return time.Duration(atomic.LoadInt64(&s.span))
 }
 
+// SetChunkMaxBytes caps the size of the oplog in a chunk. A chunk that hits
+// the cap ends on the last written op and the next one continues from it.
+// Zero means chunks are cut only by the span.
+func (s *Slicer) SetChunkMaxBytes(n int64) {
+	atomic.StoreInt64(&s.maxBytes, n)
+}
+
+// SetPipelineDepth sets the num of chunks that are read ahead while the
+// previous ones are being uploaded if the slicer falls behind (see uploadRange).
+// Depth of 1 or less means the chunks are made one by one.
+func (s *Slicer) SetPipelineDepth(n int) {
+	atomic.StoreInt64(&s.depth, int64(n))
+}
+
+// SetZstdDictSize sets the max size of the zstd dictionary trained when
+// the streaming starts. Zero means zstd chunks are made without a dictionary.
+func (s *Slicer) SetZstdDictSize(n int) {
+	s.dictSize = n
+}
+
 // Catchup seeks for the last saved (backed up) TS - the starting point. It should be run only
 // if the timeline was lost (e.g. on (re)start, restart after backup, node's fail).
 // The starting point sets to the last backup's or last PITR chunk's TS whichever is the most recent.
@@ -135,7 +164,7 @@ func (s *Slicer) Catchup() error {
 			return errors.Wrap(err, "get config")
 		}
 
-		err = s.upload(chnk.EndTS, baseBcp.FirstWriteTS, cfg.PITR.Compression, cfg.PITR.CompressionLevel)
+		err = s.uploadRange(chnk.EndTS, baseBcp.FirstWriteTS, cfg.PITR.Compression, cfg.PITR.CompressionLevel)
 		if err != nil {
 			s.l.Warning("create last_chunk<->sanpshot slice: %v", err)
 			// duplicate key means chunk is already created by probably another routine
@@ -294,6 +323,12 @@ func (s *Slicer) Stream(
 	if !ok {
 		return oplog.InsuffRangeError{s.lastTS}
 	}
+	if compression == compress.CompressionTypeZstandard && s.dictSize > 0 {
+		if err := s.setDict(); err != nil {
+			s.l.Warning("zstd dictionary: %v. Chunks are compressed without it", err)
+		}
+	}
+
 	s.l.Debug(LogStartMsg)
 
 	lastSlice := false
@@ -401,7 +436,11 @@ func (s *Slicer) Stream(
 			}
 		}
 
-		err = s.upload(s.lastTS, sliceTo, compression, level)
+		if err = s.saveDict(); err != nil {
+			return errors.Wrap(err, "zstd dictionary")
+		}
+
+		err = s.uploadRange(s.lastTS, sliceTo, compression, level)
 		if err != nil {
 			return err
 		}
@@ -430,7 +469,8 @@ func (s *Slicer) upload(from, to primitive.Timestamp, compression compress.Compr
 	s.oplog.SetTailingSpan(from, to)
 	fname := s.chunkPath(from, to, compression)
 	// if use parent ctx, upload will be canceled on the "done" signal
-	size, err := backup.Upload(context.Background(), s.oplog, s.storage, compression, level, fname, -1)
+	size, sum, err := backup.UploadWithDict(context.Background(), s.oplog, s.storage,
+		compression, level, s.dict.data, fname, -1)
 	if err != nil {
 		// PITR chunks have no metadata to indicate any failed state and if something went
 		// wrong during the data read we may end up with an already created file. Although
@@ -451,6 +491,8 @@ func (s *Slicer) upload(from, to primitive.Timestamp, compression compress.Compr
 		StartTS:     from,
 		EndTS:       to,
 		Size:        size,
+		Checksum:    sum,
+		Dict:        s.dict.name,
 	}
 	err = s.pbm.PITRAddChunk(meta)
 	if err != nil {
@@ -460,6 +502,104 @@ func (s *Slicer) upload(from, to primitive.Timestamp, compression compress.Compr
 	return nil
 }
 
+// uploadRange makes chunks of the [from, to] range. If the slicer fell
+// behind so the range spans more than two chunks and the pipeline depth
+// is set, the range is split into span-long chunks made by the pipeline.
+// Chunks are also cut by the max chunk size, whichever comes first.
+// Otherwise, it's a single chunk.
+func (s *Slicer) uploadRange(from, to primitive.Timestamp, compression compress.CompressionType, level *int) error {
+	depth := int(atomic.LoadInt64(&s.depth))
+	maxBytes := atomic.LoadInt64(&s.maxBytes)
+	span := uint32(s.GetSpan().Seconds())
+
+	ranges := []sliceRange{{from, to}}
+	if depth > 1 && span > 0 && to.T-from.T > 2*span {
+		ranges = splitRange(from, to, span)
+		s.l.Debug("slicer is behind, making %d chunks with pipeline depth %d", len(ranges), depth)
+	} else if maxBytes <= 0 {
+		return s.upload(from, to, compression, level)
+	}
+
+	read := func(r sliceRange) chunkSource {
+		ob := oplog.NewOplogBackup(s.node.Session())
+		ob.SetTailingSpan(r.from, r.to)
+		ob.SetMaxBytes(maxBytes)
+		return ob
+	}
+	// if use parent ctx, upload will be canceled on the "done" signal
+	_, err := pipelineSlices(context.Background(), s.rs, ranges, depth, read,
+		compression, level, s.dict, s.storage, s.pbm.PITRAddChunk)
+	return err
+}
+
+// dictSampleOps is the num of the recent oplog entries the dictionary is trained on
+const dictSampleOps = 1000
+
+// setDict sets the zstd dictionary the chunks are compressed with. It's
+// the one of the last chunk if any, so the stream goes on with it rather
+// than leaving a new dictionary on the storage on each start. Otherwise,
+// it's trained, see trainDict.
+func (s *Slicer) setDict() error {
+	c, err := s.pbm.PITRLastChunkMeta(s.rs)
+	if err != nil && !errors.Is(err, pbm.ErrNotFound) {
+		return errors.Wrap(err, "get the last chunk")
+	}
+	if c == nil || c.Dict == "" {
+		return s.trainDict()
+	}
+
+	data, err := pbm.ReadZstdDict(s.storage, c)
+	if err != nil {
+		s.l.Warning("reuse zstd dictionary: %v. Training a new one", err)
+		return s.trainDict()
+	}
+
+	s.dict = zstdDict{name: c.Dict, data: data}
+	s.l.Info("reuse zstd dictionary %s of %d bytes", c.Dict, len(data))
+	return nil
+}
+
+// saveDict saves the dictionary again if it's gone from the storage. The
+// PITR cleanup deletes the dictionaries no chunk refers to, so it may delete
+// the one of the stream before its first chunk.
+func (s *Slicer) saveDict() error {
+	if s.dict.name == "" {
+		return nil
+	}
+
+	_, err := s.storage.FileStat(s.dict.name)
+	if !errors.Is(err, storage.ErrNotExist) {
+		return err
+	}
+
+	err = s.storage.Save(s.dict.name, bytes.NewReader(s.dict.data), int64(len(s.dict.data)))
+	return errors.Wrapf(err, "save %s", s.dict.name)
+}
+
+// trainDict trains the zstd dictionary on the recent oplog and saves it
+// on the storage once. The chunks made afterwards are compressed with it
+// and refer to its file (see pbm.OplogChunk.Dict).
+func (s *Slicer) trainDict() error {
+	samples, err := s.oplog.Sample(dictSampleOps)
+	if err != nil {
+		return errors.Wrap(err, "sample oplog")
+	}
+	data := compress.TrainZstdDict(samples, s.dictSize)
+	if len(data) == 0 {
+		return errors.New("no oplog to train on")
+	}
+
+	name := pbm.ZstdDictName(s.rs, compress.ZstdDictID(data))
+	err = s.storage.Save(name, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return errors.Wrapf(err, "save %s", name)
+	}
+
+	s.dict = zstdDict{name: name, data: data}
+	s.l.Info("zstd dictionary %s of %d bytes", name, len(data))
+	return nil
+}
+
 func formatts(t primitive.Timestamp) string {
 	return time.Unix(int64(t.T), 0).UTC().Format("2006-01-02T15:04:05")
 }
@@ -1,11 +1,18 @@
 package pbm
 
 import (
+	"context"
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/storage/fs"
 )
 
 func TestPITRTimelines(t *testing.T) {
@@ -387,3 +394,336 @@ func printttl(tlns ...Timeline) string {
 
 	return strings.Join(ret, ", ")
 }
+
+func TestPITRChunksTimeline(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	chunk := func(rs string, s, e uint32) OplogChunk { return OplogChunk{RS: rs, StartTS: ts(s), EndTS: ts(e)} }
+	seg := func(rs string, s, e uint32, gap bool) TimelineSegment {
+		return TimelineSegment{RS: rs, Start: ts(s), End: ts(e), Gap: gap}
+	}
+
+	tests := []struct {
+		name     string
+		chunks   []OplogChunk
+		rss      []string
+		from, to primitive.Timestamp
+		expect   []TimelineSegment
+	}{
+		{
+			name: "contiguous",
+			chunks: []OplogChunk{
+				chunk("rs0", 1, 10),
+				chunk("rs0", 10, 20),
+				chunk("rs0", 20, 30),
+			},
+			from:   ts(5),
+			to:     ts(25),
+			expect: []TimelineSegment{seg("rs0", 5, 25, false)},
+		},
+		{
+			name: "single gap",
+			chunks: []OplogChunk{
+				chunk("rs0", 1, 10),
+				chunk("rs0", 15, 20),
+			},
+			from: ts(1),
+			to:   ts(20),
+			expect: []TimelineSegment{
+				seg("rs0", 1, 10, false),
+				seg("rs0", 10, 15, true),
+				seg("rs0", 15, 20, false),
+			},
+		},
+		{
+			name: "multi gap",
+			chunks: []OplogChunk{
+				chunk("rs0", 5, 10),
+				chunk("rs0", 10, 12),
+				chunk("rs0", 15, 20),
+				chunk("rs0", 30, 40),
+			},
+			from: ts(1),
+			to:   ts(50),
+			expect: []TimelineSegment{
+				seg("rs0", 1, 5, true),
+				seg("rs0", 5, 12, false),
+				seg("rs0", 12, 15, true),
+				seg("rs0", 15, 20, false),
+				seg("rs0", 20, 30, true),
+				seg("rs0", 30, 40, false),
+				seg("rs0", 40, 50, true),
+			},
+		},
+		{
+			name: "gap on one replset",
+			chunks: []OplogChunk{
+				chunk("rs1", 1, 10),
+				chunk("rs0", 1, 10),
+				chunk("rs0", 10, 20),
+				chunk("rs1", 12, 20),
+			},
+			from: ts(1),
+			to:   ts(20),
+			expect: []TimelineSegment{
+				seg("rs0", 1, 20, false),
+				seg("rs1", 1, 10, false),
+				seg("rs1", 10, 12, true),
+				seg("rs1", 12, 20, false),
+			},
+		},
+		{
+			name: "replset without chunks",
+			chunks: []OplogChunk{
+				chunk("rs0", 1, 20),
+			},
+			rss:  []string{"cfg", "rs0", "rs1"},
+			from: ts(5),
+			to:   ts(15),
+			expect: []TimelineSegment{
+				seg("cfg", 5, 15, true),
+				seg("rs0", 5, 15, false),
+				seg("rs1", 5, 15, true),
+			},
+		},
+		{
+			name: "no chunks at all",
+			rss:  []string{"rs0"},
+			from: ts(5),
+			to:   ts(15),
+			expect: []TimelineSegment{
+				seg("rs0", 5, 15, true),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := rsTimelines(test.chunks, test.rss, test.from, test.to)
+			if len(got) != len(test.expect) {
+				t.Fatalf("expect %v, got %v", test.expect, got)
+			}
+			for i := range got {
+				if got[i] != test.expect[i] {
+					t.Errorf("segment %d: expect %v, got %v", i, test.expect[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTimelineCursor(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	chunk := func(s, e uint32) OplogChunk { return OplogChunk{RS: "rs0", StartTS: ts(s), EndTS: ts(e)} }
+
+	tl := TimelineCursor{To: ts(40)}
+	var gaps []OplogGap
+	for _, c := range []OplogChunk{
+		chunk(5, 10),
+		chunk(10, 15), // adjacent
+		chunk(11, 12), // contained
+		chunk(14, 20), // overlapping
+		chunk(25, 40),
+		chunk(45, 50), // past the target
+	} {
+		if g := tl.Add(c); g != nil {
+			gaps = append(gaps, *g)
+		}
+	}
+
+	expect := []OplogGap{{RS: "rs0", From: ts(20), To: ts(25)}}
+	if len(gaps) != len(expect) || gaps[0] != expect[0] {
+		t.Errorf("expected gaps %v, got %v", expect, gaps)
+	}
+	if tl.Last != ts(50) {
+		t.Errorf("expected the cursor at %v, got %v", ts(50), tl.Last)
+	}
+}
+
+func TestSummarizeChunks(t *testing.T) {
+	chunks := []OplogChunk{
+		{RS: "rs0", StartTS: primitive.Timestamp{T: 100, I: 3}, EndTS: primitive.Timestamp{T: 200, I: 1}, Size: 1024},
+		{RS: "rs0", StartTS: primitive.Timestamp{T: 200, I: 1}, EndTS: primitive.Timestamp{T: 300, I: 7}, Size: 2048},
+		{RS: "rs0", StartTS: primitive.Timestamp{T: 300, I: 7}, EndTS: primitive.Timestamp{T: 300, I: 9}, Size: 10},
+	}
+
+	expect := ChunksSummary{
+		From:       primitive.Timestamp{T: 100, I: 3},
+		To:         primitive.Timestamp{T: 300, I: 9},
+		Count:      3,
+		TotalBytes: 3082,
+	}
+	if got := SummarizeChunks(chunks); got != expect {
+		t.Errorf("expected %+v, got %+v", expect, got)
+	}
+
+	if got := SummarizeChunks(nil); got != (ChunksSummary{}) {
+		t.Errorf("expected empty summary, got %+v", got)
+	}
+}
+
+func TestChunksIter(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	docs := []OplogChunk{
+		{RS: "rs0", FName: "c1", StartTS: ts(1), EndTS: ts(10)},
+		{RS: "rs0", FName: "c2", StartTS: ts(10), EndTS: ts(20)},
+		{RS: "rs0", FName: "c3", StartTS: ts(10), EndTS: ts(25)},
+		{RS: "rs0", FName: "c4", StartTS: ts(20), EndTS: ts(30)},
+		{RS: "rs0", FName: "c5", StartTS: ts(30), EndTS: ts(40)},
+	}
+
+	var pages []string
+	page := func(after *OplogChunk, limit int) (*mongo.Cursor, error) {
+		n := 0
+		if after != nil {
+			for docs[n].FName != after.FName {
+				n++
+			}
+			n++
+		}
+		var rv []interface{}
+		for _, c := range docs[n:] {
+			if len(rv) == limit {
+				break
+			}
+			rv = append(rv, c)
+		}
+		from := "-"
+		if after != nil {
+			from = after.FName
+		}
+		pages = append(pages, from)
+		return mongo.NewCursorFromDocuments(rv, nil, nil)
+	}
+
+	for size, expect := range map[int]string{2: "-,c2,c4", 5: "-,c5", 10: "-"} {
+		pages = nil
+		it := NewChunksIter(context.Background(), size, page)
+
+		var got []string
+		for it.Next() {
+			got = append(got, it.Chunk().FName)
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("page of %d: iterate: %v", size, err)
+		}
+		if strings.Join(got, ",") != "c1,c2,c3,c4,c5" {
+			t.Errorf("page of %d: expected chunks in order, got %v", size, got)
+		}
+		if strings.Join(pages, ",") != expect {
+			t.Errorf("page of %d: expected pages after %s, got %v", size, expect, pages)
+		}
+	}
+
+	it := NewChunksIter(context.Background(), 2, func(*OplogChunk, int) (*mongo.Cursor, error) {
+		return mongo.NewCursorFromDocuments([]interface{}{bson.M{"start_ts": "bad"}}, nil, nil)
+	})
+	if it.Next() || it.Err() == nil {
+		t.Errorf("expected decode error")
+	}
+}
+
+func TestPITRmetaFromFNameCompression(t *testing.T) {
+	cases := map[string]string{
+		"rs0/20200715/20200715155939-0.20200715160029-1.oplog":        "none",
+		"rs0/20200715/20200715155939-0.20200715160029-1.oplog.gz":     "pgzip",
+		"rs0/20200715/20200715155939-0.20200715160029-1.oplog.snappy": "snappy",
+		"rs0/20200715/20200715155939-0.20200715160029-1.oplog.s2":     "s2",
+		"rs0/20200715/20200715155939-0.20200715160029-1.oplog.zst":    "zstd",
+		"rs0/20200715/20200715155939-0.20200715160029-1.oplog.lz4":    "lz4",
+	}
+	for f, want := range cases {
+		c := PITRmetaFromFName(f)
+		if c == nil {
+			t.Errorf("%s: not parsed", f)
+			continue
+		}
+		if c.Compression.String() != want {
+			t.Errorf("%s: expected %s, got %s", f, want, c.Compression)
+		}
+	}
+
+	if c := PITRmetaFromFName("rs0/20200715/20200715155939-0.20200715160029-1.oplog.bz2"); c != nil {
+		t.Errorf("expected a chunk with unknown suffix to be skipped, got %v", c)
+	}
+}
+
+func TestListPITRChunks(t *testing.T) {
+	stg, err := fs.New(fs.Conf{Path: t.TempDir()})
+	if err != nil {
+		t.Fatalf("create storage: %v", err)
+	}
+
+	files := map[string]string{
+		"rs0/20200715/20200715155939-0.20200715160029-1.oplog.s2":  "c2",
+		"rs0/20200715/20200715155839-3.20200715155939-0.oplog.s2":  "c1",
+		"rs0/20200715/20200715160029-1.20200715160129-0.oplog.s2":  "",
+		"rs0/dict-0000000a.zdict":                                  "dict",
+		"rs0/20200715/20200715155939-0.20200715160029-1.oplog.bz2": "bad",
+		"rs1/20200715/20200715155939-0.20200715160029-1.oplog":     "c3",
+		"rs10/20200715/20200715155939-0.20200715160029-1.oplog.gz": "c4",
+	}
+	for f, data := range files {
+		err := stg.Save(PITRfsPrefix+"/"+f, strings.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("save %s: %v", f, err)
+		}
+	}
+
+	chunks, unparsed, err := ListPITRChunks(stg, "rs0")
+	if err != nil {
+		t.Fatalf("list chunks: %v", err)
+	}
+	badName := PITRfsPrefix + "/rs0/20200715/20200715155939-0.20200715160029-1.oplog.bz2"
+	if len(unparsed) != 1 || unparsed[0] != badName {
+		t.Errorf("expected unparsed %s, got %v", badName, unparsed)
+	}
+	want := []OplogChunk{
+		{
+			RS:          "rs0",
+			FName:       PITRfsPrefix + "/rs0/20200715/20200715155839-3.20200715155939-0.oplog.s2",
+			Compression: compress.CompressionTypeS2,
+			StartTS:     primitive.Timestamp{T: 1594828719, I: 3},
+			EndTS:       primitive.Timestamp{T: 1594828779},
+			Size:        2,
+		},
+		{
+			RS:          "rs0",
+			FName:       PITRfsPrefix + "/rs0/20200715/20200715155939-0.20200715160029-1.oplog.s2",
+			Compression: compress.CompressionTypeS2,
+			StartTS:     primitive.Timestamp{T: 1594828779},
+			EndTS:       primitive.Timestamp{T: 1594828829, I: 1},
+			Size:        2,
+		},
+	}
+	if !reflect.DeepEqual(chunks, want) {
+		t.Errorf("expected chunks\n%+v\ngot\n%+v", want, chunks)
+	}
+
+	chunks, _, err = ListPITRChunks(stg, "")
+	if err != nil {
+		t.Fatalf("list all chunks: %v", err)
+	}
+	var got []string
+	for _, c := range chunks {
+		got = append(got, fmt.Sprintf("%s:%d-%d", c.RS, c.StartTS.T, c.EndTS.T))
+	}
+	if s := strings.Join(got, ","); s != "rs0:1594828719-1594828779,rs0:1594828779-1594828829,"+
+		"rs1:1594828779-1594828829,rs10:1594828779-1594828829" {
+		t.Errorf("unexpected chunks of all replsets: %s", s)
+	}
+}
+
+func TestEarliestEnd(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	chunks := []OplogChunk{
+		{RS: "rs0", EndTS: ts(30)},
+		{RS: "rs1", EndTS: ts(20)},
+		{RS: "rs2", EndTS: ts(25)},
+	}
+	if end := earliestEnd(chunks); end != ts(20) {
+		t.Errorf("expected %v, got %v", ts(20), end)
+	}
+	if end := earliestEnd(nil); !end.IsZero() {
+		t.Errorf("expected zero end for no chunks, got %v", end)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/idx"
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -37,6 +38,50 @@ type RestoreMeta struct {
 	Type             BackupType          `bson:"type" json:"type"`
 	Leader           string              `bson:"l,omitempty" json:"l,omitempty"`
 	Stat             *RestoreStat        `bson:"stat,omitempty" json:"stat,omitempty"`
+	// Abort is set when the user requested to abort the restore
+	Abort bool `bson:"abort,omitempty" json:"abort,omitempty"`
+	// ClockSkew is the max observed spread (in seconds) of shards
+	// heartbeats above the warning threshold
+	ClockSkew int64 `bson:"clock_skew,omitempty" json:"clock_skew,omitempty"`
+	// OplogEnd is the resolved end of the open-ended oplog replay, the
+	// same for all replsets, see PBM.PITRLatestTS
+	OplogEnd primitive.Timestamp `bson:"oplog_end,omitempty" json:"oplog_end,omitempty"`
+	// PrevOPID is the opid of the previous run of the rerun restore.
+	// The previous run is kept under ArchivedRestoreName.
+	PrevOPID string `bson:"prev_opid,omitempty" json:"prev_opid,omitempty"`
+	// RSMap is the mapping of the backup replset names to the restored ones
+	RSMap map[string]string `bson:"rs_map,omitempty" json:"rs_map,omitempty"`
+}
+
+// Events of the restore audit trail
+const (
+	RestoreAuditStart  = "start"
+	RestoreAuditFinish = "finish"
+)
+
+// RestoreAudit is a record of the restore audit trail. Records are only
+// added: each replset of the restore adds one on start and one on finish.
+type RestoreAudit struct {
+	Name    string              `bson:"name" json:"name"`
+	OPID    string              `bson:"opid" json:"opid"`
+	Event   string              `bson:"event" json:"event"`
+	RS      string              `bson:"rs" json:"rs"`
+	Node    string              `bson:"node" json:"node"`
+	Backup  string              `bson:"backup,omitempty" json:"backup,omitempty"`
+	From    primitive.Timestamp `bson:"from" json:"from"`
+	To      primitive.Timestamp `bson:"to" json:"to"`
+	RSMap   map[string]string   `bson:"rsMap,omitempty" json:"rsMap,omitempty"`
+	User    string              `bson:"user,omitempty" json:"user,omitempty"`
+	Status  Status              `bson:"status,omitempty" json:"status,omitempty"`
+	Error   string              `bson:"error,omitempty" json:"error,omitempty"`
+	DistTxn *DistTxnStat        `bson:"txn,omitempty" json:"txn,omitempty"`
+	TS      int64               `bson:"ts" json:"ts"`
+}
+
+// AddRestoreAudit adds the record to the restore audit trail
+func (p *PBM) AddRestoreAudit(a *RestoreAudit) error {
+	_, err := p.Conn.Database(DB).Collection(RestoreAuditCollection).InsertOne(p.ctx, a)
+	return errors.Wrap(err, "insert")
 }
 
 type RestoreStat struct {
@@ -44,9 +89,21 @@ type RestoreStat struct {
 }
 type RestoreRSMetrics struct {
 	DistTxn  DistTxnStat     `bson:"txn,omitempty" json:"txn,omitempty"`
+	Ops      OplogOpsStat    `bson:"ops,omitempty" json:"ops,omitempty"`
 	Download s3.DownloadStat `bson:"download,omitempty" json:"download,omitempty"`
 }
 
+type OplogOpsStat struct {
+	// Applied is the num of oplog entries applied during the replay
+	Applied int64 `bson:"applied" json:"applied"`
+	// Filtered is the num of oplog entries skipped by namespace and
+	// op filters
+	Filtered int64 `bson:"filtered" json:"filtered"`
+	// Failed is the num of oplog entries skipped as they failed to apply
+	// (see RestoreConf.OplogContinueOnApplyError)
+	Failed int64 `bson:"failed,omitempty" json:"failed,omitempty"`
+}
+
 type DistTxnStat struct {
 	// Partial is the num of transactions that were allied on other shards
 	// but can't be applied on this one since not all prepare messages got
@@ -60,11 +117,97 @@ type DistTxnStat struct {
 	// after the sync. The transaction is full but no commit message in the
 	// oplog of any shard.
 	LeftUncommitted int `bson:"left_uncommitted" json:"left_uncommitted"`
+	// Split are uncommitted transactions which prepared messages were
+	// observed in several chunks or cut off by the end of the replay.
+	Split []SplitTxn `bson:"split,omitempty" json:"split,omitempty"`
+	// Decisions are what was done with transactions uncommitted before
+	// the sync. The list may be truncated, see the counters for totals.
+	Decisions []TxnDecision `bson:"decisions,omitempty" json:"decisions,omitempty"`
+}
+
+// Decisions on transactions left uncommitted in the oplog of a shard
+const (
+	// TxnCommitted is committed since other shards have the commit
+	TxnCommitted = "committed"
+	// TxnPartial is committed elsewhere but not all its prepare
+	// messages are in the oplog of the shard, so it can't be applied
+	TxnPartial = "partial"
+	// TxnDropped is committed nowhere, so it's not applied
+	TxnDropped = "dropped"
+)
+
+// TxnDecision is what the replay did with the uncommitted transaction
+type TxnDecision struct {
+	ID       string `bson:"id" json:"id"`
+	Decision string `bson:"decision" json:"decision"`
+	// Parts is the num of prepared messages observed
+	Parts int `bson:"parts" json:"parts"`
+}
+
+// SplitTxn is a transaction split into several prepared messages
+// which wasn't committed by the end of the replay
+type SplitTxn struct {
+	ID string `bson:"id" json:"id"`
+	// Seen is the num of prepared messages observed
+	Seen int `bson:"seen" json:"seen"`
+	// Expected is the num of prepared messages of the txn. Zero if unknown,
+	// i.e. the last message wasn't observed.
+	Expected int `bson:"expected" json:"expected"`
+	// Chunks is the num of oplog chunks the messages were found in
+	Chunks int `bson:"chunks" json:"chunks"`
 }
 
 type RestoreShardStat struct {
 	Txn DistTxnStat      `json:"txn"`
+	Ops OplogOpsStat     `json:"ops"`
 	D   *s3.DownloadStat `json:"d"`
+
+	// Chunks is the num of fully replayed oplog chunks and LastTS is the
+	// last op of them. Set if the replay failed too, so it tells how far
+	// the replay got. Ops are counted for these chunks only.
+	Chunks int                 `json:"chunks,omitempty"`
+	LastTS primitive.Timestamp `json:"lastTS,omitempty"`
+
+	// Timing is the wall-clock time of the replayed chunks
+	Timing ReplayTiming `json:"timing"`
+
+	// NSOps is the num of applied ops by namespace (see
+	// oplog.OplogRestore.NSOps). It's a list as namespaces have dots
+	// that aren't allowed in the field names on older servers.
+	NSOps []NSOpsCount `json:"nsOps,omitempty"`
+
+	// ApplyErrors are the first of the oplog entries skipped as they
+	// failed to apply. Ops.Failed is the num of all of them.
+	ApplyErrors []ApplyError `json:"applyErrors,omitempty"`
+}
+
+// NSOpsCount is the num of ops applied to the namespace
+type NSOpsCount struct {
+	NS string `json:"ns"`
+	N  int    `json:"n"`
+}
+
+// ApplyError is an oplog entry skipped by the replay as it failed to apply
+type ApplyError struct {
+	TS    primitive.Timestamp `json:"ts"`
+	NS    string              `json:"ns"`
+	Op    string              `json:"op"`
+	Error string              `json:"error"`
+}
+
+// ReplayTiming is the time the oplog replay spent on reading
+// (with decompression) and applying the chunks
+type ReplayTiming struct {
+	Read  time.Duration `json:"read"`
+	Apply time.Duration `json:"apply"`
+	// Bytes is the size of the decompressed oplog
+	Bytes int64 `json:"bytes"`
+}
+
+func (t *ReplayTiming) Add(read, apply time.Duration, bytes int64) {
+	t.Read += read
+	t.Apply += apply
+	t.Bytes += bytes
 }
 
 type RestoreReplset struct {
@@ -75,13 +218,69 @@ type RestoreReplset struct {
 	CommittedTxnSet  bool                `bson:"txn_set" json:"txn_set"`
 	PartialTxn       []db.Oplog          `bson:"partial_txn" json:"partial_txn"`
 	CurrentOp        primitive.Timestamp `bson:"op" json:"op"`
+	ETA              int64               `bson:"eta,omitempty" json:"eta,omitempty"` // estimated oplog replay finish (unix time)
 	LastTransitionTS int64               `bson:"last_transition_ts" json:"last_transition_ts"`
 	LastWriteTS      primitive.Timestamp `bson:"last_write_ts" json:"last_write_ts"`
-	Nodes            []RestoreNode       `bson:"nodes,omitempty" json:"nodes,omitempty"`
-	Error            string              `bson:"error,omitempty" json:"error,omitempty"`
-	Conditions       Conditions          `bson:"conditions" json:"conditions"`
-	Hb               primitive.Timestamp `bson:"hb" json:"hb"`
-	Stat             RestoreShardStat    `bson:"stat" json:"stat"`
+	Progress         *RestoreProgress    `bson:"progress,omitempty" json:"progress,omitempty"`
+	Checkpoint       *ReplayCheckpoint   `bson:"checkpoint,omitempty" json:"checkpoint,omitempty"`
+	// IncompatibleIndexes are indexes the server refused to create
+	IncompatibleIndexes []IncompatibleIndex `bson:"incompatible_indexes,omitempty" json:"incompatible_indexes,omitempty"`
+	Nodes               []RestoreNode       `bson:"nodes,omitempty" json:"nodes,omitempty"`
+	Error               string              `bson:"error,omitempty" json:"error,omitempty"`
+	Conditions          Conditions          `bson:"conditions" json:"conditions"`
+	Hb                  primitive.Timestamp `bson:"hb" json:"hb"`
+	Stat                RestoreShardStat    `bson:"stat" json:"stat"`
+
+	// Node is the node (host:port) that restored the replset. Empty for
+	// physical restores, all nodes restore there, see Nodes.
+	Node string `bson:"node,omitempty" json:"node,omitempty"`
+
+	// SkippedGaps are oplog gaps the restore went past, see
+	// RestoreCmd.AllowGaps. Ops in there are not restored.
+	SkippedGaps []OplogGap `bson:"skipped_gaps,omitempty" json:"skipped_gaps,omitempty"`
+}
+
+// OplogGap is the range of the replset's oplog not covered by chunks
+type OplogGap struct {
+	RS   string              `bson:"rs" json:"rs"`
+	From primitive.Timestamp `bson:"from" json:"from"`
+	To   primitive.Timestamp `bson:"to" json:"to"`
+}
+
+// RestoreProgress is the oplog replay progress of the replset
+type RestoreProgress struct {
+	// Chunk is the num of replayed oplog chunks out of Chunks
+	Chunk  int `bson:"chunk" json:"chunk"`
+	Chunks int `bson:"chunks" json:"chunks"`
+	// Ops is the num of ops replayed so far
+	Ops OplogOpsStat `bson:"ops" json:"ops"`
+	// Updated is the time (unix) of the last update
+	Updated int64 `bson:"updated" json:"updated"`
+}
+
+// ReplayCheckpoint is the oplog replay state after the last replayed
+// chunk. A rerun of the failed replay continues from it.
+type ReplayCheckpoint struct {
+	// LastTS is the timestamp of the last applied op
+	LastTS primitive.Timestamp `bson:"last_ts" json:"last_ts"`
+	// Indexes are collected by the replay so far. They are not built
+	// yet if index builds are deferred until the end of the replay.
+	Indexes []CatalogIndexes `bson:"indexes,omitempty" json:"indexes,omitempty"`
+}
+
+// IncompatibleIndex is the index the server refused to create
+// because of its spec or options
+type IncompatibleIndex struct {
+	NS     string `bson:"ns" json:"ns"`
+	Name   string `bson:"name" json:"name"`
+	Reason string `bson:"reason" json:"reason"`
+}
+
+// CatalogIndexes are indexes of the collection in the index catalog
+type CatalogIndexes struct {
+	DB      string               `bson:"db" json:"db"`
+	Coll    string               `bson:"coll" json:"coll"`
+	Indexes []*idx.IndexDocument `bson:"indexes" json:"indexes"`
 }
 
 type Conditions []*Condition
@@ -167,6 +366,18 @@ func (p *PBM) RestoreSetRSTxn(name, rsName string, txn []RestoreTxn) error {
 	return err
 }
 
+// RestoreClearTxn removes the committed txns the replsets of the restore
+// shared with each other (see RestoreSetRSTxn)
+func (p *PBM) RestoreClearTxn(name string) error {
+	_, err := p.Conn.Database(DB).Collection(RestoresCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", name}},
+		bson.D{{"$set", bson.M{"replsets.$[].committed_txn": []RestoreTxn{}}}},
+	)
+
+	return err
+}
+
 func (p *PBM) RestoreSetRSStat(name, rsName string, stat RestoreShardStat) error {
 	_, err := p.Conn.Database(DB).Collection(RestoresCollection).UpdateOne(
 		p.ctx,
@@ -207,6 +418,58 @@ func (p *PBM) SetCurrentOp(name, rsName string, ts primitive.Timestamp) error {
 	return err
 }
 
+// SetRestoreRSProgress sets the last applied oplog timestamp,
+// the estimated time of the oplog replay finish and the replay progress
+// for the replset
+func (p *PBM) SetRestoreRSProgress(name, rsName string, ts primitive.Timestamp, eta int64, prg *RestoreProgress) error {
+	_, err := p.Conn.Database(DB).Collection(RestoresCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", name}, {"replsets.name", rsName}},
+		bson.D{{"$set", bson.M{
+			"replsets.$.op":       ts,
+			"replsets.$.eta":      eta,
+			"replsets.$.progress": prg,
+		}}},
+	)
+
+	return err
+}
+
+// RestoreAddRSIncompatibleIndexes adds indexes the server refused
+// to create to the replset's metadata
+func (p *PBM) RestoreAddRSIncompatibleIndexes(name, rsName string, indexes []IncompatibleIndex) error {
+	_, err := p.Conn.Database(DB).Collection(RestoresCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", name}, {"replsets.name", rsName}},
+		bson.D{{"$push", bson.M{"replsets.$.incompatible_indexes": bson.M{"$each": indexes}}}},
+	)
+
+	return err
+}
+
+// RestoreAddRSSkippedGaps adds oplog gaps the restore went past
+// to the replset's metadata
+func (p *PBM) RestoreAddRSSkippedGaps(name, rsName string, gaps []OplogGap) error {
+	_, err := p.Conn.Database(DB).Collection(RestoresCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", name}, {"replsets.name", rsName}},
+		bson.D{{"$push", bson.M{"replsets.$.skipped_gaps": bson.M{"$each": gaps}}}},
+	)
+
+	return err
+}
+
+// SetRestoreCheckpoint sets the oplog replay checkpoint for the replset
+func (p *PBM) SetRestoreCheckpoint(name, rsName string, cp *ReplayCheckpoint) error {
+	_, err := p.Conn.Database(DB).Collection(RestoresCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", name}, {"replsets.name", rsName}},
+		bson.D{{"$set", bson.M{"replsets.$.checkpoint": cp}}},
+	)
+
+	return err
+}
+
 func (p *PBM) SetRestoreMeta(m *RestoreMeta) error {
 	m.LastTransitionTS = m.StartTS
 	m.Conditions = append(m.Conditions, &Condition{
@@ -219,6 +482,22 @@ func (p *PBM) SetRestoreMeta(m *RestoreMeta) error {
 	return err
 }
 
+// ArchivedRestoreName is the name the run `opid` of the restore `name`
+// is kept under once the restore is run again
+func ArchivedRestoreName(name, opid string) string {
+	return name + "." + opid
+}
+
+// ArchiveRestoreMeta renames the run `opid` of the restore `name`, so the
+// name refers to the next run. The run is still found by its opid.
+func (p *PBM) ArchiveRestoreMeta(name, opid string) error {
+	_, err := p.Conn.Database(DB).Collection(RestoresCollection).UpdateOne(p.ctx,
+		bson.D{{"name", name}, {"opid", opid}},
+		bson.D{{"$set", bson.M{"name": ArchivedRestoreName(name, opid)}}},
+	)
+	return errors.Wrap(err, "update")
+}
+
 func (p *PBM) GetRestoreMetaByOPID(opid string) (*RestoreMeta, error) {
 	return p.getRestoreMeta(bson.D{{"opid", opid}})
 }
@@ -296,6 +575,39 @@ func (p *PBM) ChangeRestoreStateOPID(opid string, s Status, msg string) error {
 	return p.changeRestoreState(bson.D{{"name", opid}}, s, msg)
 }
 
+// AbortRestore requests to abort the running restore. Participating nodes
+// stop at the next check (e.g. oplog chunk boundary) and fail the restore.
+func (p *PBM) AbortRestore(name string) error {
+	res, err := p.Conn.Database(DB).Collection(RestoresCollection).UpdateOne(
+		p.ctx,
+		bson.D{
+			{"name", name},
+			{"status", bson.M{"$nin": []Status{StatusDone, StatusError, StatusCancelled}}},
+		},
+		bson.D{{"$set", bson.M{"abort": true}}},
+	)
+	if err != nil {
+		return errors.Wrap(err, "update restore meta")
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// SetRestoreClockSkew records the observed clock skew if it's
+// bigger than the already recorded one
+func (p *PBM) SetRestoreClockSkew(name string, skew int64) error {
+	_, err := p.Conn.Database(DB).Collection(RestoresCollection).UpdateOne(
+		p.ctx,
+		bson.D{{"name", name}},
+		bson.D{{"$max", bson.M{"clock_skew": skew}}},
+	)
+
+	return err
+}
+
 func (p *PBM) ChangeRestoreState(name string, s Status, msg string) error {
 	return p.changeRestoreState(bson.D{{"name", name}}, s, msg)
 }
@@ -341,6 +653,17 @@ func (p *PBM) SetOplogTimestamps(name string, start, end int64) error {
 	return err
 }
 
+// SetRestoreOplogEnd sets the resolved end of the open-ended oplog replay
+func (p *PBM) SetRestoreOplogEnd(name string, end primitive.Timestamp) error {
+	_, err := p.Conn.Database(DB).Collection(RestoresCollection).UpdateOne(
+		p.ctx,
+		bson.M{"name": name},
+		bson.M{"$set": bson.M{"pitr": int64(end.T), "oplog_end": end}},
+	)
+
+	return err
+}
+
 func (p *PBM) ChangeRestoreRSState(name, rsName string, s Status, msg string) error {
 	ts := time.Now().UTC().Unix()
 	_, err := p.Conn.Database(DB).Collection(RestoresCollection).UpdateOne(
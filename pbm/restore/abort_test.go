@@ -0,0 +1,85 @@
+package restore
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+)
+
+func TestAbortMidReplay(t *testing.T) {
+	stg := memStorage{
+		"c1": noopChunk(t, 1, 2),
+		"c2": noopChunk(t, 2, 3),
+		"c3": noopChunk(t, 3, 4),
+	}
+	var chunks []pbm.OplogChunk
+	for _, f := range []string{"c1", "c2", "c3"} {
+		chunks = append(chunks, pbm.OplogChunk{RS: "rs", FName: f, Compression: compress.CompressionTypeNone})
+	}
+
+	// restore meta shared by all shards
+	meta := &pbm.RestoreMeta{Name: "test"}
+	var mx sync.Mutex
+	aborted := func() error {
+		mx.Lock()
+		defer mx.Unlock()
+		return checkAborted(meta)
+	}
+
+	shards := []string{"rs0", "rs1", "rs2"}
+	applied := make([]int32, len(shards))
+	errs := make([]error, len(shards))
+
+	var wg sync.WaitGroup
+	for i, rs := range shards {
+		wg.Add(1)
+		go func(i int, rs string) {
+			defer wg.Done()
+
+			_, errs[i] = applyOplog(context.Background(), nil, chunkList(chunks),
+				&applyOplogOption{
+					aborted: aborted,
+					progress: func(replayProgress) {
+						// the user aborts the restore once the first chunk is applied
+						if atomic.AddInt32(&applied[i], 1) == 1 {
+							mx.Lock()
+							meta.Abort = true
+							mx.Unlock()
+						}
+					},
+				}, false,
+				nil, nil, nil, &pbm.RestoreShardStat{},
+				&pbm.MongoVersion{Version: []int{6, 0, 0}}, stg,
+				log.New(nil, rs, "node").NewEvent("restore", "test", "", primitive.Timestamp{}))
+		}(i, rs)
+	}
+	wg.Wait()
+
+	for i, rs := range shards {
+		if !errors.Is(errs[i], ErrAborted) {
+			t.Errorf("%s: expected abort error, got %v", rs, errs[i])
+		}
+		if n := atomic.LoadInt32(&applied[i]); n >= int32(len(chunks)) {
+			t.Errorf("%s: expected replay to stop before the last chunk, applied %d", rs, n)
+		}
+	}
+
+	meta.Replsets = []pbm.RestoreReplset{
+		{Name: "rs0", Status: pbm.StatusDone},
+		{Name: "rs1", Status: pbm.StatusDone},
+		{Name: "rs2", Status: pbm.StatusDone},
+	}
+	// even if all shards have reached the status, aborted restore must not converge
+	ok, err := restoreConverged(meta, []pbm.Shard{{RS: "rs0"}, {RS: "rs1"}, {RS: "rs2"}}, pbm.StatusDone)
+	if ok || !errors.Is(err, ErrAborted) {
+		t.Errorf("expected aborted restore not to converge, got %v, %v", ok, err)
+	}
+}
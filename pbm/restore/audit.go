@@ -0,0 +1,59 @@
+package restore
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// auditFn adds the record to the restore audit trail
+type auditFn func(a *pbm.RestoreAudit) error
+
+// auditStart records the restore start. The record is the template for
+// the finish one. Audit failures don't fail the restore, only warned about.
+func (r *Restore) auditStart(a pbm.RestoreAudit) {
+	a.Name = r.name
+	a.OPID = r.opid
+	a.RS = r.nodeInfo.SetName
+	a.Node = r.nodeInfo.Me
+	if len(r.rsMap) > 0 {
+		a.RSMap = r.rsMap
+	}
+	r.audit = &a
+
+	rec := a
+	rec.Event = pbm.RestoreAuditStart
+	rec.TS = time.Now().UTC().Unix()
+	r.writeAudit(&rec)
+}
+
+// auditFinish records the restore outcome. No-op if the start
+// wasn't recorded.
+func (r *Restore) auditFinish(err error) {
+	if r.audit == nil {
+		return
+	}
+
+	rec := *r.audit
+	rec.Event = pbm.RestoreAuditFinish
+	rec.Status = pbm.StatusDone
+	if err != nil && !errors.Is(err, ErrNoDataForShard) {
+		rec.Status = pbm.StatusError
+		rec.Error = err.Error()
+	}
+	rec.DistTxn = r.txnStat
+	rec.TS = time.Now().UTC().Unix()
+	r.writeAudit(&rec)
+}
+
+func (r *Restore) writeAudit(a *pbm.RestoreAudit) {
+	if r.auditFn == nil {
+		return
+	}
+
+	if err := r.auditFn(a); err != nil {
+		r.log.Warning("write restore audit on %s: %v", a.Event, err)
+	}
+}
@@ -0,0 +1,96 @@
+package restore
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+)
+
+func auditRestore(records *[]pbm.RestoreAudit) *Restore {
+	return &Restore{
+		name:     "2023-10-15T10:00:00Z",
+		opid:     "652bb8a0e0f6c0a1b2c3d4e5",
+		nodeInfo: &pbm.NodeInfo{SetName: "rs0", Me: "rs0-a:27017"},
+		rsMap:    map[string]string{"rs0": "rsX"},
+		log:      log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{}),
+		events:   NewEventBus(),
+		auditFn: func(a *pbm.RestoreAudit) error {
+			*records = append(*records, *a)
+			return nil
+		},
+	}
+}
+
+func TestAuditCompletedRestore(t *testing.T) {
+	var records []pbm.RestoreAudit
+	r := auditRestore(&records)
+
+	from, to := primitive.Timestamp{T: 100}, primitive.Timestamp{T: 200}
+	r.auditStart(pbm.RestoreAudit{From: from, To: to, User: "admin@admin"})
+	r.txnStat = &pbm.DistTxnStat{ShardUncommitted: 2}
+	r.exit(nil, r.log)
+
+	if len(records) != 2 {
+		t.Fatalf("expected start and finish records, got %d", len(records))
+	}
+
+	start, finish := records[0], records[1]
+	if start.Event != pbm.RestoreAuditStart || finish.Event != pbm.RestoreAuditFinish {
+		t.Errorf("unexpected events: %q, %q", start.Event, finish.Event)
+	}
+	for _, a := range records {
+		if a.Name != r.name || a.OPID != r.opid || a.RS != "rs0" || a.Node != "rs0-a:27017" ||
+			a.From != from || a.To != to || a.User != "admin@admin" || a.RSMap["rs0"] != "rsX" {
+			t.Errorf("unexpected record: %+v", a)
+		}
+	}
+	if start.Status != "" || start.DistTxn != nil {
+		t.Errorf("expected no outcome on start, got %+v", start)
+	}
+	if finish.Status != pbm.StatusDone || finish.Error != "" {
+		t.Errorf("expected done, got %s: %s", finish.Status, finish.Error)
+	}
+	if finish.DistTxn == nil || finish.DistTxn.ShardUncommitted != 2 {
+		t.Errorf("expected dist txn stat, got %+v", finish.DistTxn)
+	}
+}
+
+func TestAuditFailedRestore(t *testing.T) {
+	var records []pbm.RestoreAudit
+	r := auditRestore(&records)
+
+	r.auditStart(pbm.RestoreAudit{Backup: "2023-10-14T00:00:00Z"})
+	r.auditFinish(errors.Wrap(ErrChunkGap, "replay"))
+
+	if len(records) != 2 {
+		t.Fatalf("expected start and finish records, got %d", len(records))
+	}
+	finish := records[1]
+	if finish.Status != pbm.StatusError || finish.Error != "replay: oplog chunks gap" {
+		t.Errorf("expected error, got %s: %s", finish.Status, finish.Error)
+	}
+	if finish.Backup != "2023-10-14T00:00:00Z" {
+		t.Errorf("expected backup name, got %q", finish.Backup)
+	}
+}
+
+func TestAuditUnavailable(t *testing.T) {
+	var records []pbm.RestoreAudit
+	r := auditRestore(&records)
+	r.auditFn = func(*pbm.RestoreAudit) error { return errors.New("not authorized") }
+
+	// only warns
+	r.auditStart(pbm.RestoreAudit{})
+	r.auditFinish(nil)
+
+	// no start, no finish
+	r = auditRestore(&records)
+	r.auditFinish(errors.New("init failed"))
+	if len(records) != 0 {
+		t.Errorf("expected no records without the start, got %v", records)
+	}
+}
@@ -0,0 +1,160 @@
+package restore
+
+import (
+	"time"
+
+	"github.com/mongodb/mongo-tools/common/idx"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// checkpointFn is called with the replay checkpoint, see checkpointer
+type checkpointFn func(cp *pbm.ReplayCheckpoint)
+
+// defaultCheckpointInterval is how often the replay checkpoint is saved
+// if no interval is configured
+const defaultCheckpointInterval = 30 * time.Second
+
+// checkpointer saves the replay checkpoint at most once per `every`, so
+// the index catalog isn't rewritten after each chunk. The checkpoint of
+// the last chunk that isn't saved yet is kept and saved by flush.
+//
+// A chunk that leaves open transactions (their ops are buffered in the
+// memory until the commit) isn't a checkpoint: the resumed replay would
+// lose the buffered ops. The previous checkpoint stays then.
+type checkpointer struct {
+	fn    checkpointFn
+	ic    *idx.IndexCatalog
+	clk   Clock
+	every time.Duration
+	saved time.Time
+	last  primitive.Timestamp
+}
+
+func newCheckpointer(fn checkpointFn, ic *idx.IndexCatalog, clk Clock, every time.Duration) *checkpointer {
+	if every <= 0 {
+		every = defaultCheckpointInterval
+	}
+	return &checkpointer{fn: fn, ic: ic, clk: clk, every: every}
+}
+
+// chunkDone is called after the chunk is replayed up to lts
+func (c *checkpointer) chunkDone(lts primitive.Timestamp, openTxns int) {
+	if c.fn == nil || lts.IsZero() {
+		return
+	}
+	if openTxns > 0 {
+		c.last = primitive.Timestamp{}
+		return
+	}
+
+	c.last = lts
+	if c.saved.IsZero() || c.clk.Now().Sub(c.saved) >= c.every {
+		c.flush()
+	}
+}
+
+// flush saves the checkpoint of the last chunk if it isn't saved yet
+func (c *checkpointer) flush() {
+	if c.fn == nil || c.last.IsZero() {
+		return
+	}
+
+	c.fn(&pbm.ReplayCheckpoint{LastTS: c.last, Indexes: catalogIndexes(c.ic)})
+	c.last = primitive.Timestamp{}
+	c.saved = c.clk.Now()
+}
+
+// replayCheckpoint returns the checkpoint of the replset left by
+// the previous unfinished run of the restore
+func replayCheckpoint(prev *pbm.RestoreMeta, rsName string) *pbm.ReplayCheckpoint {
+	if prev == nil || prev.Status == pbm.StatusDone {
+		return nil
+	}
+
+	for _, rs := range prev.Replsets {
+		if rs.Name == rsName && rs.Checkpoint != nil && !rs.Checkpoint.LastTS.IsZero() {
+			return rs.Checkpoint
+		}
+	}
+
+	return nil
+}
+
+// resumedWrites returns the timestamp the node's writes of the previous
+// run of the restore go up to if the run left the checkpoint to resume from.
+// Both the ops applied up to the checkpoint and the ones past it, until the
+// run stopped heartbeating, are of that run. Zero if there is nothing to resume.
+func resumedWrites(prev *pbm.RestoreMeta, rsName string) primitive.Timestamp {
+	cp := replayCheckpoint(prev, rsName)
+	if cp == nil {
+		return primitive.Timestamp{}
+	}
+
+	ts := cp.LastTS
+	for _, rs := range prev.Replsets {
+		if rs.Name == rsName && rs.Hb.After(ts) {
+			ts = rs.Hb
+		}
+	}
+
+	return ts
+}
+
+// catalogIndexes returns all indexes of the catalog
+func catalogIndexes(ic *idx.IndexCatalog) []pbm.CatalogIndexes {
+	if ic == nil {
+		return nil
+	}
+
+	var rv []pbm.CatalogIndexes
+	for _, ns := range ic.Namespaces() {
+		indexes := ic.GetIndexes(ns.DB, ns.Collection)
+		if len(indexes) == 0 {
+			continue
+		}
+
+		rv = append(rv, pbm.CatalogIndexes{DB: ns.DB, Coll: ns.Collection, Indexes: indexes})
+	}
+
+	return rv
+}
+
+// loadCatalog adds indexes of the checkpoint to the catalog
+func loadCatalog(ic *idx.IndexCatalog, indexes []pbm.CatalogIndexes) {
+	if ic == nil {
+		return
+	}
+
+	for _, c := range indexes {
+		ic.AddIndexes(c.DB, c.Coll, c.Indexes)
+	}
+}
+
+// resumeChunks skips chunks replayed before the checkpoint and returns
+// the replay start right after it
+func resumeChunks(it chunksIter, cp *pbm.ReplayCheckpoint) (*resumeIter, primitive.Timestamp) {
+	return &resumeIter{chunksIter: it, lts: cp.LastTS}, primitive.Timestamp{T: cp.LastTS.T, I: cp.LastTS.I + 1}
+}
+
+// resumeIter skips leading chunks that end before or at `lts`
+type resumeIter struct {
+	chunksIter
+	lts     primitive.Timestamp
+	skipped int
+	started bool
+}
+
+func (r *resumeIter) Next() bool {
+	for r.chunksIter.Next() {
+		if !r.started && primitive.CompareTimestamp(r.Chunk().EndTS, r.lts) <= 0 {
+			r.skipped++
+			continue
+		}
+		r.started = true
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,261 @@
+package restore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mongodb/mongo-tools/common/idx"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+)
+
+// countingIndexBuilder counts index builds on top of fakeIndexBuilder
+type countingIndexBuilder struct {
+	fakeIndexBuilder
+
+	builds int
+}
+
+func (b *countingIndexBuilder) CreateIndexes(db, coll string, indexes []*idx.IndexDocument) error {
+	b.builds += len(indexes)
+	return b.fakeIndexBuilder.CreateIndexes(db, coll, indexes)
+}
+
+func TestResumeReplay(t *testing.T) {
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+	mgoV := &pbm.MongoVersion{Version: []int{6, 0, 0}}
+
+	c1 := indexOpsChunkAt(t, 10, createIndexOp("c", "a"), createIndexOp("c", "b"))
+	c2 := indexOpsChunkAt(t, 12, dropIndexOp("c", "b"), createIndexOp("d", "x"))
+	chunks := []pbm.OplogChunk{
+		{
+			RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone,
+			StartTS: primitive.Timestamp{T: 10, I: 1}, EndTS: primitive.Timestamp{T: 11, I: 1},
+		},
+		{
+			RS: "rs0", FName: "c2", Compression: compress.CompressionTypeNone,
+			StartTS: primitive.Timestamp{T: 12, I: 1}, EndTS: primitive.Timestamp{T: 13, I: 1},
+		},
+	}
+	full := memStorage{"c1": c1, "c2": c2}
+	// the resumed replay must not touch chunks before the checkpoint
+	rest := memStorage{"c2": c2}
+
+	replay := func(o *applyOplogOption, ic *idx.IndexCatalog, chunks []pbm.OplogChunk, stg memStorage) {
+		t.Helper()
+
+		_, err := applyOplog(context.Background(), nil, chunkList(chunks), o, false,
+			ic, nil, nil, &pbm.RestoreShardStat{}, mgoV, stg, l)
+		if err != nil {
+			t.Fatalf("replay: %v", err)
+		}
+	}
+	// interrupted replays the first chunk only and returns its
+	// checkpoint as it's read back from the restore meta
+	interrupted := func(o *applyOplogOption, ic *idx.IndexCatalog) *pbm.ReplayCheckpoint {
+		t.Helper()
+
+		var last *pbm.ReplayCheckpoint
+		o.checkpoint = func(cp *pbm.ReplayCheckpoint) { last = cp }
+		replay(o, ic, chunks[:1], full)
+		if last == nil {
+			t.Fatal("no checkpoint")
+		}
+
+		b, err := bson.Marshal(last)
+		if err != nil {
+			t.Fatalf("marshal checkpoint: %v", err)
+		}
+		cp := &pbm.ReplayCheckpoint{}
+		if err = bson.Unmarshal(b, cp); err != nil {
+			t.Fatalf("unmarshal checkpoint: %v", err)
+		}
+
+		return cp
+	}
+
+	t.Run("deferred", func(t *testing.T) {
+		clean := idx.NewIndexCatalog()
+		replay(&applyOplogOption{unsafe: true}, clean, chunks, full)
+		want := &fakeIndexBuilder{}
+		if err := buildIndexes(context.Background(), clean, nil, 1, want, l); err != nil {
+			t.Fatalf("build indexes: %v", err)
+		}
+
+		cp := interrupted(&applyOplogOption{unsafe: true}, idx.NewIndexCatalog())
+		if cp.LastTS != (primitive.Timestamp{T: 11, I: 1}) {
+			t.Errorf("expected checkpoint at {11 1}, got %v", cp.LastTS)
+		}
+
+		// a new process has an empty catalog
+		resumed := idx.NewIndexCatalog()
+		replay(&applyOplogOption{unsafe: true, resume: cp}, resumed, chunks, rest)
+		got := &countingIndexBuilder{}
+		if err := buildIndexes(context.Background(), resumed, nil, 1, got, l); err != nil {
+			t.Fatalf("build indexes: %v", err)
+		}
+
+		if !reflect.DeepEqual(got.indexes, want.indexes) {
+			t.Errorf("expected %v, got %v", want.indexes, got.indexes)
+		}
+		if got.builds != 2 {
+			t.Errorf("expected 2 index builds, got %d", got.builds)
+		}
+	})
+
+	t.Run("inline", func(t *testing.T) {
+		want := &countingIndexBuilder{}
+		replay(&applyOplogOption{unsafe: true, indexBuilder: want}, nil, chunks, full)
+
+		got := &countingIndexBuilder{}
+		cp := interrupted(&applyOplogOption{unsafe: true, indexBuilder: got}, nil)
+		replay(&applyOplogOption{unsafe: true, indexBuilder: got, resume: cp}, nil, chunks, rest)
+
+		if !reflect.DeepEqual(got.indexes, want.indexes) {
+			t.Errorf("expected %v, got %v", want.indexes, got.indexes)
+		}
+		if got.builds != want.builds {
+			t.Errorf("expected %d index builds, got %d", want.builds, got.builds)
+		}
+	})
+}
+
+func TestReplayCheckpoint(t *testing.T) {
+	cp := &pbm.ReplayCheckpoint{LastTS: primitive.Timestamp{T: 5, I: 1}}
+	meta := &pbm.RestoreMeta{
+		Status: pbm.StatusError,
+		Replsets: []pbm.RestoreReplset{
+			{Name: "rs0"},
+			{Name: "rs1", Checkpoint: cp},
+		},
+	}
+
+	if got := replayCheckpoint(meta, "rs1"); got != cp {
+		t.Errorf("expected checkpoint of rs1, got %v", got)
+	}
+	if got := replayCheckpoint(meta, "rs0"); got != nil {
+		t.Errorf("expected no checkpoint of rs0, got %v", got)
+	}
+
+	meta.Status = pbm.StatusDone
+	if got := replayCheckpoint(meta, "rs1"); got != nil {
+		t.Errorf("expected no checkpoint of the done restore, got %v", got)
+	}
+	if got := replayCheckpoint(nil, "rs1"); got != nil {
+		t.Errorf("expected no checkpoint without the previous run, got %v", got)
+	}
+}
+
+func TestReplayResumeGuard(t *testing.T) {
+	start := primitive.Timestamp{T: 100, I: 1}
+	prev := &pbm.RestoreMeta{
+		Status: pbm.StatusError,
+		Replsets: []pbm.RestoreReplset{{
+			Name:       "rs0",
+			Checkpoint: &pbm.ReplayCheckpoint{LastTS: primitive.Timestamp{T: 150, I: 1}},
+			// the run went on past the checkpoint until it failed
+			Hb: primitive.Timestamp{T: 300, I: 1},
+		}},
+	}
+
+	after := replayGuardStart(start, resumedWrites(prev, "rs0"))
+	if after != (primitive.Timestamp{T: 300, I: 1}) {
+		t.Fatalf("expected the guard after the previous run, got %v", after)
+	}
+	// the previous run's own writes don't need --force
+	if err := checkReplayStart(primitive.Timestamp{T: 250, I: 1}, after); err != nil {
+		t.Errorf("expected the resume to pass the guard, got %v", err)
+	}
+	if err := checkReplayStart(primitive.Timestamp{T: 350, I: 1}, after); err == nil {
+		t.Error("expected the guard to fail on writes after the previous run")
+	}
+
+	// no checkpoint, nothing to resume
+	prev.Replsets[0].Checkpoint = nil
+	if after := replayGuardStart(start, resumedWrites(prev, "rs0")); after != start {
+		t.Errorf("expected the guard at the replay start, got %v", after)
+	}
+	if after := replayGuardStart(start, resumedWrites(nil, "rs0")); after != start {
+		t.Errorf("expected the guard at the replay start without the previous run, got %v", after)
+	}
+}
+
+func TestReplayProgressOnFailure(t *testing.T) {
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone, StartTS: ts(1), EndTS: ts(3)},
+		{RS: "rs0", FName: "c2", Compression: compress.CompressionTypeNone, StartTS: ts(3), EndTS: ts(6)},
+		{RS: "rs0", FName: "c3", Compression: compress.CompressionTypeNone, StartTS: ts(6), EndTS: ts(9)},
+	}
+	// c3 is corrupted
+	stg := memStorage{"c1": noopChunk(t, 1, 2, 3), "c2": noopChunk(t, 4, 5, 6), "c3": []byte("garbage")}
+
+	var cp *pbm.ReplayCheckpoint
+	stat := &pbm.RestoreShardStat{}
+	_, err := applyOplog(context.Background(), nil, chunkList(chunks),
+		&applyOplogOption{checkpoint: func(c *pbm.ReplayCheckpoint) { cp = c }}, false,
+		nil, nil, nil, stat, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+	if err == nil {
+		t.Fatal("expected the replay to fail on c3")
+	}
+
+	if stat.Chunks != 2 {
+		t.Errorf("expected 2 replayed chunks, got %d", stat.Chunks)
+	}
+	if stat.LastTS != ts(6) {
+		t.Errorf("expected last applied %v from c2, got %v", ts(6), stat.LastTS)
+	}
+	if cp == nil || cp.LastTS != stat.LastTS {
+		t.Errorf("expected the checkpoint at %v, got %+v", stat.LastTS, cp)
+	}
+}
+
+func TestCheckpointer(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	clk := &fakeClock{now: time.Unix(1000, 0)}
+
+	var saved []primitive.Timestamp
+	c := newCheckpointer(func(cp *pbm.ReplayCheckpoint) { saved = append(saved, cp.LastTS) },
+		nil, clk, time.Minute)
+	check := func(want ...primitive.Timestamp) {
+		t.Helper()
+		if !reflect.DeepEqual(saved, want) {
+			t.Fatalf("expected checkpoints %v, got %v", want, saved)
+		}
+	}
+
+	c.chunkDone(ts(1), 0)
+	check(ts(1))
+
+	// not saved until the interval passes
+	c.chunkDone(ts(2), 0)
+	clk.advance(30 * time.Second)
+	c.chunkDone(ts(3), 0)
+	check(ts(1))
+	clk.advance(30 * time.Second)
+	c.chunkDone(ts(4), 0)
+	check(ts(1), ts(4))
+
+	// open txns drop the pending one, the previous checkpoint stays
+	c.chunkDone(ts(5), 0)
+	c.chunkDone(ts(6), 2)
+	c.flush()
+	check(ts(1), ts(4))
+	clk.advance(time.Minute)
+	c.chunkDone(ts(7), 1)
+	check(ts(1), ts(4))
+
+	// the pending one is saved by flush
+	c.chunkDone(ts(8), 0)
+	c.chunkDone(ts(9), 0)
+	c.flush()
+	c.flush()
+	check(ts(1), ts(4), ts(8), ts(9))
+}
@@ -0,0 +1,31 @@
+package restore
+
+import "time"
+
+// Clock is the time source of the convergence and wait loops.
+// Tests and simulations may replace the real one, see Restore.SetClock.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the time.Ticker made by the Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// wallClock is the real clock
+var wallClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
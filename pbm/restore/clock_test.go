@@ -0,0 +1,224 @@
+package restore
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// fakeClock doesn't wait, each tick of its tickers advances the clock
+// by the ticker's duration. A tick happens on each C() call, so the
+// tickers are only for loops selecting on C() on each iteration.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker { return &fakeTicker{clock: c, d: d} }
+
+type fakeTicker struct {
+	clock *fakeClock
+	d     time.Duration
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	c := make(chan time.Time, 1)
+	c <- t.clock.advance(t.d)
+	return c
+}
+
+func (t *fakeTicker) Stop() {}
+
+// tickClock is the fakeClock whose tickers tick only on tick()
+type tickClock struct {
+	fakeClock
+	c chan time.Time
+}
+
+func newTickClock() *tickClock { return &tickClock{c: make(chan time.Time)} }
+
+func (c *tickClock) NewTicker(time.Duration) Ticker { return tickClockTicker{c.c} }
+
+// tick waits until one of the tickers gets the tick
+func (c *tickClock) tick() { c.c <- c.Now() }
+
+type tickClockTicker struct{ c chan time.Time }
+
+func (t tickClockTicker) C() <-chan time.Time { return t.c }
+
+func (tickClockTicker) Stop() {}
+
+func TestConvergeFakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	shards := []pbm.Shard{{RS: "rs0"}, {RS: "rs1"}}
+	clusterTS := func(c Clock) primitive.Timestamp { return primitive.Timestamp{T: uint32(c.Now().Unix())} }
+
+	// converge simulates shards reaching the status after the given num
+	// of seconds and beating until `beatsTill` seconds from the start
+	converge := func(clk Clock, reach map[string]int, beatsTill int, timeout *time.Duration) (int, error) {
+		polls := 0
+		poll := func() (bool, error) {
+			polls++
+			elapsed := int(clk.Now().Sub(start) / time.Second)
+			meta := &pbm.RestoreMeta{}
+			var beats []shardBeat
+			for _, sh := range shards {
+				rs := pbm.RestoreReplset{Name: sh.RS, Status: pbm.StatusRunning}
+				if elapsed >= reach[sh.RS] {
+					rs.Status = pbm.StatusDumpDone
+				}
+				meta.Replsets = append(meta.Replsets, rs)
+
+				hb := elapsed
+				if hb > beatsTill {
+					hb = beatsTill
+				}
+				beats = append(beats, shardBeat{rs: sh.RS, hb: primitive.Timestamp{T: uint32(start.Unix()) + uint32(hb)}})
+			}
+			ok, _, err := reachedStatus(meta, beats, clusterTS(clk), shards, pbm.StatusDumpDone, beatsCheck{})
+			return ok, err
+		}
+
+		err := pollStatus(context.Background(), clk, time.Second, timeout, poll, func() error {
+			return convergeTimeoutError(pbm.StatusDumpDone, *timeout)
+		})
+		return polls, err
+	}
+
+	wall := time.Now()
+	hour := time.Hour
+
+	clk := &fakeClock{now: start}
+	polls, err := converge(clk, map[string]int{"rs0": 60, "rs1": 600}, 1<<20, &hour)
+	if err != nil {
+		t.Fatalf("expected convergence, got %v", err)
+	}
+	if polls != 600 || clk.Now().Sub(start) != 10*time.Minute {
+		t.Errorf("expected to converge in 600 ticks (10m), got %d ticks (%v)", polls, clk.Now().Sub(start))
+	}
+
+	clk = &fakeClock{now: start}
+	polls, err = converge(clk, map[string]int{"rs0": 60, "rs1": 1 << 20}, 1<<20, &hour)
+	if !errors.Is(err, ErrConvergeTimeout) {
+		t.Fatalf("expected converge timeout, got %v", err)
+	}
+	if polls != 3600 {
+		t.Errorf("expected to time out after 3600 ticks, got %d", polls)
+	}
+
+	// shards stop beating after 10s
+	clk = &fakeClock{now: start}
+	polls, err = converge(clk, map[string]int{"rs0": 60, "rs1": 1 << 20}, 10, nil)
+	if !errors.Is(err, ErrShardLost) {
+		t.Fatalf("expected lost shard, got %v", err)
+	}
+	if lost := 10 + int(pbm.StaleFrameSec) + 1; polls != lost {
+		t.Errorf("expected the shard lost after %d ticks, got %d", lost, polls)
+	}
+
+	if took := time.Since(wall); took > 5*time.Second {
+		t.Errorf("the fake clock is expected to take no wall time, took %v", took)
+	}
+}
+
+func TestStaleCheckCadence(t *testing.T) {
+	start := time.Unix(1000, 0)
+	shards := []pbm.Shard{{RS: "rs0"}, {RS: "rs1"}}
+
+	// converge polls shards that reach the status after 100s. rs1 beats
+	// with the given heartbeat at the elapsed seconds
+	converge := func(conf pbm.RestoreConf, rs1Beat func(elapsed int) int) (time.Duration, error) {
+		clk := &fakeClock{now: start}
+		bc := newBeatsCheck(conf, clk, nil)
+		ts := func(sec int) primitive.Timestamp { return primitive.Timestamp{T: uint32(start.Unix()) + uint32(sec)} }
+
+		poll := func() (bool, error) {
+			elapsed := int(clk.Now().Sub(start) / time.Second)
+			meta := &pbm.RestoreMeta{}
+			for _, sh := range shards {
+				rs := pbm.RestoreReplset{Name: sh.RS, Status: pbm.StatusRunning}
+				if elapsed >= 100 {
+					rs.Status = pbm.StatusDumpDone
+				}
+				meta.Replsets = append(meta.Replsets, rs)
+			}
+			beats := []shardBeat{
+				{rs: "rs0", hb: ts(elapsed)},
+				{rs: "rs1", hb: ts(rs1Beat(elapsed))},
+			}
+			ok, _, err := reachedStatus(meta, beats, ts(elapsed), shards, pbm.StatusDumpDone, bc)
+			return ok, err
+		}
+
+		err := pollStatus(context.Background(), clk, bc.pollInterval(), nil, poll, nil)
+		return clk.Now().Sub(start), err
+	}
+
+	// rs1 misses beats between 40s and 45s, its last beat is 35s behind
+	late := func(elapsed int) int {
+		if elapsed >= 40 && elapsed < 45 {
+			return 5
+		}
+		return elapsed
+	}
+	// rs1 stops beating after 10s
+	dead := func(elapsed int) int {
+		if elapsed > 10 {
+			return 10
+		}
+		return elapsed
+	}
+
+	frequent := pbm.RestoreConf{StatusPollMs: 100}
+	relaxed := pbm.RestoreConf{StatusPollMs: 100, StaleCheckSec: 60}
+
+	took, err := converge(frequent, late)
+	if !errors.Is(err, ErrShardLost) {
+		t.Fatalf("expected the late shard lost checking on every poll, got %v", err)
+	}
+	if took >= 41*time.Second {
+		t.Errorf("expected the shard lost right on the first late poll, took %v", took)
+	}
+
+	took, err = converge(relaxed, late)
+	if err != nil {
+		t.Fatalf("expected convergence with the relaxed stale check, got %v", err)
+	}
+	if took != 100*time.Second {
+		t.Errorf("expected to converge in 100s, took %v", took)
+	}
+
+	// a genuinely lost shard is caught on the next stale check
+	took, err = converge(relaxed, dead)
+	if !errors.Is(err, ErrShardLost) {
+		t.Fatalf("expected the dead shard lost, got %v", err)
+	}
+	if took != 60*time.Second {
+		t.Errorf("expected the shard lost on the stale check at 60s, took %v", took)
+	}
+
+	if d := (beatsCheck{}).pollInterval(); d != time.Second {
+		t.Errorf("expected default poll interval 1s, got %v", d)
+	}
+}
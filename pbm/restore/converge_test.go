@@ -0,0 +1,795 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+)
+
+func TestSubsetConverged(t *testing.T) {
+	cluster := []pbm.Shard{{RS: "rs0"}, {RS: "rs1"}, {RS: "rs2"}}
+	replsets := []pbm.RestoreReplset{
+		{Name: "rs0", Status: pbm.StatusDone},
+		{Name: "rs1", Status: pbm.StatusDone},
+		{Name: "rs2", Status: pbm.StatusSkipped},
+	}
+
+	shards, unknown := filterShards(cluster, []string{"rs0", "rs1"})
+	if len(unknown) != 0 {
+		t.Fatalf("unexpected unknown targets: %v", unknown)
+	}
+	if len(shards) != 2 {
+		t.Fatalf("expected 2 shards, got %v", shards)
+	}
+
+	ok, err := shardsConverged(replsets, shards, pbm.StatusDone)
+	if err != nil {
+		t.Fatalf("converge: %v", err)
+	}
+	if !ok {
+		t.Errorf("expected two targeted shards to converge without the skipped one")
+	}
+
+	ok, err = shardsConverged(replsets, cluster, pbm.StatusDone)
+	if err != nil {
+		t.Fatalf("converge: %v", err)
+	}
+	if ok {
+		t.Errorf("expected full cluster not to converge while rs2 is skipped")
+	}
+
+	replsets[1].Status = pbm.StatusRunning
+	ok, _ = shardsConverged(replsets, shards, pbm.StatusDone)
+	if ok {
+		t.Errorf("expected not to converge while rs1 is running")
+	}
+
+	replsets[1].Status = pbm.StatusError
+	if _, err = shardsConverged(replsets, shards, pbm.StatusDone); err == nil {
+		t.Errorf("expected error for the failed target shard")
+	}
+}
+
+func TestFilterShardsUnknown(t *testing.T) {
+	cluster := []pbm.Shard{{RS: "rs0"}, {RS: "rs1"}}
+
+	_, unknown := filterShards(cluster, []string{"rs1", "rs5"})
+	if len(unknown) != 1 || unknown[0] != "rs5" {
+		t.Errorf("expected rs5 to be unknown, got %v", unknown)
+	}
+}
+
+func TestStatusTimeout(t *testing.T) {
+	cfg := pbm.RestoreConf{
+		Timeouts: map[pbm.Status]uint32{
+			pbm.StatusStarting: 5,
+			pbm.StatusDumpDone: 0,
+		},
+	}
+	timeouts := cfg.StatusTimeouts()
+	def := time.Minute
+
+	if to := statusTimeout(timeouts, pbm.StatusStarting, nil); to == nil || *to != 5*time.Second {
+		t.Errorf("expected 5s timeout for %s, got %v", pbm.StatusStarting, to)
+	}
+	if to := statusTimeout(timeouts, pbm.StatusStarting, &def); to == nil || *to != 5*time.Second {
+		t.Errorf("expected configured timeout to override the default, got %v", to)
+	}
+	if to := statusTimeout(timeouts, pbm.StatusRunning, &def); to != &def {
+		t.Errorf("expected default timeout for %s, got %v", pbm.StatusRunning, to)
+	}
+	if to := statusTimeout(timeouts, pbm.StatusDumpDone, nil); to != nil {
+		t.Errorf("expected %s to remain unbounded, got %v", pbm.StatusDumpDone, *to)
+	}
+	if to := statusTimeout(timeouts, pbm.StatusDone, nil); to != nil {
+		t.Errorf("expected %s to remain unbounded, got %v", pbm.StatusDone, *to)
+	}
+}
+
+func TestConvergeTimeoutNamesStatus(t *testing.T) {
+	timeouts := map[pbm.Status]time.Duration{pbm.StatusStarting: 10 * time.Millisecond}
+
+	wait := statusTimeout(timeouts, pbm.StatusStarting, nil)
+	if wait == nil {
+		t.Fatalf("expected timeout for %s", pbm.StatusStarting)
+	}
+
+	err := convergeTimeoutError(pbm.StatusStarting, *wait)
+	if !errors.Is(err, ErrConvergeTimeout) {
+		t.Fatalf("expected converge timeout, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "`"+string(pbm.StatusStarting)+"`") {
+		t.Errorf("expected error to name the status, got %q", err)
+	}
+
+	if wait = statusTimeout(timeouts, pbm.StatusRunning, nil); wait != nil {
+		t.Errorf("expected %s to be unbounded, got %v", pbm.StatusRunning, *wait)
+	}
+}
+
+func TestBeatsCheckSkew(t *testing.T) {
+	ct := primitive.Timestamp{T: 1000}
+	skewed := []shardBeat{
+		{rs: "rs0", hb: primitive.Timestamp{T: 998}},
+		{rs: "rs1", hb: primitive.Timestamp{T: 960}},
+	}
+
+	skew, err := beatsCheck{skewWarn: 10}.check(skewed, ct)
+	if skew != 38 {
+		t.Errorf("expected skew 38, got %d", skew)
+	}
+	if err == nil || !strings.Contains(err.Error(), "lost shard rs1") {
+		t.Errorf("expected lost shard rs1 without relax, got %v", err)
+	}
+
+	skew, err = beatsCheck{skewWarn: 10, relax: true}.check(skewed, ct)
+	if err != nil {
+		t.Errorf("expected no error with relaxed frame, got %v", err)
+	}
+	if skew != 38 {
+		t.Errorf("expected skew 38, got %d", skew)
+	}
+
+	dead := []shardBeat{
+		{rs: "rs0", hb: primitive.Timestamp{T: 999}},
+		{rs: "rs1", hb: primitive.Timestamp{T: 900}},
+	}
+	_, err = beatsCheck{skewWarn: 10, relax: true}.check(dead, ct)
+	if err == nil || !strings.Contains(err.Error(), "lost shard rs1") {
+		t.Errorf("expected dead shard to be lost even with relax, got %v", err)
+	}
+
+	aligned := []shardBeat{
+		{rs: "rs0", hb: primitive.Timestamp{T: 999}},
+		{rs: "rs1", hb: primitive.Timestamp{T: 997}},
+	}
+	skew, err = beatsCheck{skewWarn: 10}.check(aligned, ct)
+	if err != nil || skew != 2 {
+		t.Errorf("expected skew 2 and no error, got %d, %v", skew, err)
+	}
+}
+
+func TestBeatsCheckSkewWarned(t *testing.T) {
+	ct := primitive.Timestamp{T: 1000}
+	beats := func(spread uint32) []shardBeat {
+		return []shardBeat{
+			{rs: "rs0", hb: primitive.Timestamp{T: 999}},
+			{rs: "rs1", hb: primitive.Timestamp{T: 999 - spread}},
+		}
+	}
+
+	w := &skewWarned{}
+	c := beatsCheck{skewWarn: 10, relax: true, warned: w,
+		l: log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})}
+	// polls with the same or a smaller spread don't warn again
+	for i, s := range []uint32{15, 15, 12, 2, 15} {
+		if _, err := c.check(beats(s), ct); err != nil {
+			t.Fatalf("poll %d: %v", i, err)
+		}
+		if w.max != 15 {
+			t.Errorf("poll %d: expected the warned spread 15, got %d", i, w.max)
+		}
+	}
+
+	if w.grown(15) || !w.grown(20) || w.grown(20) {
+		t.Errorf("expected to warn on the grown spread only")
+	}
+}
+
+func TestRecordSkewOnGrowth(t *testing.T) {
+	c := beatsCheck{skewWarn: 10, recorded: &skewWarned{}}
+
+	var writes []uint32
+	for _, s := range []uint32{2, 15, 15, 12, 15, 20, 20} {
+		if c.recordSkew(s) {
+			writes = append(writes, s)
+		}
+	}
+	if len(writes) != 2 || writes[0] != 15 || writes[1] != 20 {
+		t.Errorf("expected the spread recorded as it grows (15, 20), got %v", writes)
+	}
+}
+
+func TestLocksBeats(t *testing.T) {
+	locks := []pbm.LockData{
+		{LockHeader: pbm.LockHeader{Replset: "rs2"}, Heartbeat: primitive.Timestamp{T: 3}},
+		{LockHeader: pbm.LockHeader{Replset: "rs0"}, Heartbeat: primitive.Timestamp{T: 1}},
+	}
+
+	// rs1 has already cleaned its lock
+	beats := locksBeats(locks, []string{"rs0", "rs1", "rs2"})
+	expect := []shardBeat{
+		{rs: "rs0", hb: primitive.Timestamp{T: 1}},
+		{rs: "rs2", hb: primitive.Timestamp{T: 3}},
+	}
+	if !reflect.DeepEqual(beats, expect) {
+		t.Errorf("expected beats %v, got %v", expect, beats)
+	}
+}
+
+func TestReachedStatus(t *testing.T) {
+	shards := []pbm.Shard{{RS: "rs0"}, {RS: "rs1"}}
+	ct := primitive.Timestamp{T: 1000}
+	alive := []shardBeat{
+		{rs: "rs0", hb: primitive.Timestamp{T: 999}},
+		{rs: "rs1", hb: primitive.Timestamp{T: 998}},
+	}
+
+	meta := &pbm.RestoreMeta{Replsets: []pbm.RestoreReplset{
+		{Name: "rs0", Status: pbm.StatusDumpDone},
+		{Name: "rs1", Status: pbm.StatusDumpDone},
+	}}
+	ok, _, err := reachedStatus(meta, alive, ct, shards, pbm.StatusDumpDone, beatsCheck{})
+	if err != nil || !ok {
+		t.Errorf("all reached: expected true, nil, got %v, %v", ok, err)
+	}
+
+	meta.Replsets[1].Status = pbm.StatusRunning
+	ok, _, err = reachedStatus(meta, alive, ct, shards, pbm.StatusDumpDone, beatsCheck{})
+	if err != nil || ok {
+		t.Errorf("one running: expected false, nil, got %v, %v", ok, err)
+	}
+
+	meta.Replsets[1].Status = pbm.StatusError
+	meta.Replsets[1].Error = "boom"
+	ok, _, err = reachedStatus(meta, alive, ct, shards, pbm.StatusDumpDone, beatsCheck{})
+	if ok || err == nil || !strings.Contains(err.Error(), "shard rs1 failed with: boom") {
+		t.Errorf("one errored: expected failure of rs1, got %v, %v", ok, err)
+	}
+
+	meta.Replsets[1] = pbm.RestoreReplset{Name: "rs1", Status: pbm.StatusDumpDone}
+	lost := []shardBeat{alive[0], {rs: "rs1", hb: primitive.Timestamp{T: 900}}}
+	ok, _, err = reachedStatus(meta, lost, ct, shards, pbm.StatusDumpDone, beatsCheck{})
+	if ok || err == nil || !strings.Contains(err.Error(), "lost shard rs1") {
+		t.Errorf("one lost: expected lost rs1, got %v, %v", ok, err)
+	}
+}
+
+func TestConvergeOnShardError(t *testing.T) {
+	shards := []pbm.Shard{{RS: "rs0"}, {RS: "rs1"}, {RS: "rs2"}}
+	ct := primitive.Timestamp{T: 1000}
+	meta := &pbm.RestoreMeta{Replsets: []pbm.RestoreReplset{
+		{Name: "rs0", Status: pbm.StatusDumpDone},
+		{Name: "rs1", Status: pbm.StatusError, Error: "boom"},
+		{Name: "rs2", Status: pbm.StatusRunning},
+	}}
+
+	failFast := newBeatsCheck(pbm.RestoreConf{}, nil, nil)
+	drain := newBeatsCheck(pbm.RestoreConf{OnShardError: pbm.ShardErrorDrain}, nil, nil)
+
+	ok, _, err := reachedStatus(meta, nil, ct, shards, pbm.StatusDumpDone, failFast)
+	if ok || err == nil || !strings.Contains(err.Error(), "shard rs1 failed with: boom") {
+		t.Errorf("fail-fast: expected failure of rs1 at once, got %v, %v", ok, err)
+	}
+
+	// rs2 is still running, so it's waited for
+	ok, _, err = reachedStatus(meta, nil, ct, shards, pbm.StatusDumpDone, drain)
+	if ok || err != nil {
+		t.Errorf("drain: expected to wait for rs2, got %v, %v", ok, err)
+	}
+
+	meta.Replsets[2].Status = pbm.StatusDumpDone
+	ok, _, err = reachedStatus(meta, nil, ct, shards, pbm.StatusDumpDone, drain)
+	if ok || err == nil || !strings.Contains(err.Error(), "shard rs1 failed with: boom") {
+		t.Errorf("drain: expected failure of rs1 after others reached the status, got %v, %v", ok, err)
+	}
+	if !errors.Is(err, errShardsDrained) {
+		t.Errorf("drain: expected the restore to be failed for the cluster, got %v", err)
+	}
+
+	meta.Replsets[2] = pbm.RestoreReplset{Name: "rs2", Status: pbm.StatusError, Error: "bang"}
+	_, _, err = reachedStatus(meta, nil, ct, shards, pbm.StatusDumpDone, drain)
+	if err == nil || !strings.Contains(err.Error(), "restore failed on 2 shards: rs1: boom, rs2: bang") {
+		t.Errorf("drain: expected failure of rs1 and rs2, got %v", err)
+	}
+
+	meta.Abort = true
+	if _, _, err = reachedStatus(meta, nil, ct, shards, pbm.StatusDumpDone, drain); !errors.Is(err, ErrAborted) {
+		t.Errorf("drain: expected abort, got %v", err)
+	}
+}
+
+func TestAllShardsFailed(t *testing.T) {
+	replsets := []pbm.RestoreReplset{
+		{Name: "rs0", Status: pbm.StatusError},
+		{Name: "rs1", Status: pbm.StatusRunning},
+	}
+	if allShardsFailed(replsets) {
+		t.Errorf("expected rs1 to go on")
+	}
+
+	replsets[1].Status = pbm.StatusError
+	if !allShardsFailed(replsets) {
+		t.Errorf("expected all shards failed")
+	}
+
+	if allShardsFailed(nil) {
+		t.Errorf("expected no shards not to fail")
+	}
+}
+
+func TestWaitStatusTimeout(t *testing.T) {
+	ctx := context.Background()
+	timeout := 200 * time.Millisecond
+
+	polls := 0
+	err := waitStatus(ctx, wallClock, 5*time.Millisecond, &timeout, pbm.StatusRunning, func() (bool, error) {
+		polls++
+		return polls == 3, nil
+	})
+	if err != nil {
+		t.Errorf("expected status reached before the deadline, got %v", err)
+	}
+
+	timeout = 30 * time.Millisecond
+	err = waitStatus(ctx, wallClock, 5*time.Millisecond, &timeout, pbm.StatusRunning, func() (bool, error) {
+		return false, nil
+	})
+	if !errors.Is(err, errWaitStatusTimeOut) {
+		t.Fatalf("expected wait status timeout, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "`"+string(pbm.StatusRunning)+"`") {
+		t.Errorf("expected error to name the status, got %q", err)
+	}
+
+	boom := errors.New("boom")
+	err = waitStatus(ctx, wallClock, 5*time.Millisecond, &timeout, pbm.StatusRunning, func() (bool, error) {
+		return false, boom
+	})
+	if !errors.Is(err, boom) {
+		t.Errorf("expected poll error, got %v", err)
+	}
+}
+
+func TestCheckChunksBoundaries(t *testing.T) {
+	ts := func(t, i uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: i} }
+	chunk := func(name string, s, e primitive.Timestamp) pbm.OplogChunk {
+		return pbm.OplogChunk{RS: "rs0", FName: name, StartTS: s, EndTS: e}
+	}
+	stg := memStorage{"c1": {0}, "c2": {0}, "c3": {0}}
+
+	cases := []struct {
+		name   string
+		chunks []pbm.OplogChunk
+		gap    bool
+	}{
+		{
+			name:   "exact boundary",
+			chunks: []pbm.OplogChunk{chunk("c1", ts(1, 1), ts(5, 3)), chunk("c2", ts(5, 3), ts(10, 1))},
+		},
+		{
+			name:   "overlap",
+			chunks: []pbm.OplogChunk{chunk("c1", ts(1, 1), ts(6, 1)), chunk("c2", ts(4, 1), ts(10, 1))},
+		},
+		{
+			name: "contained",
+			chunks: []pbm.OplogChunk{
+				chunk("c1", ts(1, 1), ts(8, 1)),
+				chunk("c2", ts(3, 1), ts(5, 1)),
+				chunk("c3", ts(7, 1), ts(10, 1)),
+			},
+		},
+		{
+			name:   "gap by increment",
+			chunks: []pbm.OplogChunk{chunk("c1", ts(1, 1), ts(5, 3)), chunk("c2", ts(5, 4), ts(10, 1))},
+			gap:    true,
+		},
+		{
+			name:   "gap",
+			chunks: []pbm.OplogChunk{chunk("c1", ts(1, 1), ts(5, 1)), chunk("c2", ts(7, 1), ts(10, 1))},
+			gap:    true,
+		},
+		{
+			name: "gap after contained",
+			chunks: []pbm.OplogChunk{
+				chunk("c1", ts(1, 1), ts(8, 1)),
+				chunk("c2", ts(3, 1), ts(5, 1)),
+				chunk("c3", ts(9, 1), ts(10, 1)),
+			},
+			gap: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkChunks(stg, c.chunks, ts(1, 1), ts(10, 1))
+			if c.gap != errors.Is(err, ErrChunkGap) {
+				t.Errorf("expected gap: %v, got %v", c.gap, err)
+			}
+			if !c.gap && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// countingChunksIter counts chunks read from it
+type countingChunksIter struct {
+	sliceChunksIter
+	read int
+}
+
+func (c *countingChunksIter) Next() bool {
+	ok := c.sliceChunksIter.Next()
+	if ok {
+		c.read++
+	}
+	return ok
+}
+
+func TestCollectChunks(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	chunk := func(name string, s, e uint32) pbm.OplogChunk {
+		return pbm.OplogChunk{RS: "rs0", FName: name, StartTS: ts(s), EndTS: ts(e)}
+	}
+	stg := memStorage{"c1": {0}, "c2": {0}, "c3": {0}, "c4": {0}, "c5": {0}}
+
+	it := &countingChunksIter{sliceChunksIter: sliceChunksIter{chunks: []pbm.OplogChunk{
+		chunk("c1", 1, 5), chunk("c2", 5, 10), chunk("c3", 8, 15), chunk("c4", 15, 20),
+	}}}
+	got, _, err := collectChunks(stg, it, ts(2), ts(18), false)
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	var names []string
+	for _, c := range got {
+		names = append(names, c.FName)
+	}
+	if strings.Join(names, ",") != "c1,c2,c3,c4" {
+		t.Errorf("expected chunks in the timeline order, got %v", names)
+	}
+
+	// the gap is detected without reading the rest of the chunks
+	it = &countingChunksIter{sliceChunksIter: sliceChunksIter{chunks: []pbm.OplogChunk{
+		chunk("c1", 1, 5), chunk("c2", 5, 10), chunk("c3", 12, 15), chunk("c4", 15, 20), chunk("c5", 20, 25),
+	}}}
+	_, _, err = collectChunks(stg, it, ts(1), ts(25), false)
+	if !errors.Is(err, ErrChunkGap) || !strings.Contains(err.Error(), "start_ts {10 1}, but got {12 1}") {
+		t.Errorf("expected gap at 10, got %v", err)
+	}
+	if it.read != 3 {
+		t.Errorf("expected to stop on the 3rd chunk, read %d", it.read)
+	}
+
+	// chunks after the target time don't make a gap
+	it = &countingChunksIter{sliceChunksIter: sliceChunksIter{chunks: []pbm.OplogChunk{
+		chunk("c1", 1, 5), chunk("c2", 7, 10),
+	}}}
+	if _, _, err = collectChunks(stg, it, ts(1), ts(5), false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCollectChunksAllowGaps(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	chunk := func(name string, s, e uint32) pbm.OplogChunk {
+		return pbm.OplogChunk{RS: "rs0", FName: name, StartTS: ts(s), EndTS: ts(e)}
+	}
+	stg := memStorage{"c1": {0}, "c2": {0}, "c3": {0}}
+	gapped := []pbm.OplogChunk{chunk("c1", 1, 5), chunk("c2", 7, 10), chunk("c3", 12, 15)}
+
+	_, _, err := collectChunks(stg, &sliceChunksIter{chunks: gapped}, ts(1), ts(15), false)
+	if !errors.Is(err, ErrChunkGap) {
+		t.Errorf("expected gap error without allowGaps, got %v", err)
+	}
+
+	got, gaps, err := collectChunks(stg, &sliceChunksIter{chunks: gapped}, ts(1), ts(15), true)
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	if len(got) != 3 {
+		t.Errorf("expected all 3 chunks, got %d", len(got))
+	}
+	expect := []pbm.OplogGap{{RS: "rs0", From: ts(5), To: ts(7)}, {RS: "rs0", From: ts(10), To: ts(12)}}
+	if !reflect.DeepEqual(gaps, expect) {
+		t.Errorf("expected gaps %v, got %v", expect, gaps)
+	}
+
+	// the target time has to be covered anyway
+	_, _, err = collectChunks(stg, &sliceChunksIter{chunks: gapped}, ts(1), ts(20), true)
+	if !errors.Is(err, ErrMissingChunk) {
+		t.Errorf("expected missing chunk error, got %v", err)
+	}
+}
+
+func TestCompressionCheck(t *testing.T) {
+	chunk := func(name string, c compress.CompressionType) pbm.OplogChunk {
+		return pbm.OplogChunk{RS: "rs0", FName: name, Compression: c}
+	}
+	check := func(chunks []pbm.OplogChunk) error {
+		var cc compressionCheck
+		for _, c := range chunks {
+			cc.add(c)
+		}
+		return cc.err()
+	}
+
+	ok := []pbm.OplogChunk{
+		chunk("c1", compress.CompressionTypeS2),
+		chunk("c2", compress.CompressionTypeZstandard),
+		chunk("c3", ""),
+	}
+	if err := check(ok); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	err := check(append(ok, chunk("c4", "brotli"), chunk("c5", "xz")))
+	if !errors.Is(err, ErrUnsupportedCompression) {
+		t.Fatalf("expected unsupported compression, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "c4 (brotli), c5 (xz)") || strings.Contains(err.Error(), "c1") {
+		t.Errorf("expected only c4 and c5 listed, got %q", err)
+	}
+
+	var many []pbm.OplogChunk
+	for i := 0; i < maxListedChunks+3; i++ {
+		many = append(many, chunk(fmt.Sprintf("c%d", i), "brotli"))
+	}
+	if err = check(many); !strings.Contains(err.Error(), "c9 (brotli), and 3 more:") {
+		t.Errorf("expected the list to be cut, got %q", err)
+	}
+}
+
+func TestErrorCategories(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	stg := memStorage{"c1": noopChunk(t, 1, 2), "c2": noopChunk(t, 5, 6)}
+	c1 := pbm.OplogChunk{RS: "rs0", FName: "c1", StartTS: ts(1), EndTS: ts(2)}
+	c2 := pbm.OplogChunk{RS: "rs0", FName: "c2", StartTS: ts(5), EndTS: ts(6)}
+
+	cases := []struct {
+		name   string
+		err    error
+		expect error
+		msg    string
+	}{
+		{
+			name:   "gap",
+			err:    checkChunks(stg, []pbm.OplogChunk{c1, c2}, ts(1), ts(6)),
+			expect: ErrChunkGap,
+			msg:    "integrity vilolated",
+		},
+		{
+			name:   "no chunks",
+			err:    checkChunks(stg, nil, ts(1), ts(6)),
+			expect: ErrMissingChunk,
+			msg:    "no chunks found",
+		},
+		{
+			name:   "no target chunk",
+			err:    checkChunks(stg, []pbm.OplogChunk{c1}, ts(1), ts(6)),
+			expect: ErrMissingChunk,
+			msg:    "no chunk with the target time",
+		},
+		{
+			name:   "not on storage",
+			err:    checkChunks(memStorage{}, []pbm.OplogChunk{c1}, ts(1), ts(2)),
+			expect: ErrMissingChunk,
+			msg:    "failed to ensure chunk",
+		},
+		{
+			name: "shard lost",
+			err: func() error {
+				_, err := beatsCheck{}.check([]shardBeat{{rs: "rs0", hb: ts(1)}}, ts(1000))
+				return err
+			}(),
+			expect: ErrShardLost,
+			msg:    "lost shard rs0",
+		},
+		{
+			name:   "converge timeout",
+			err:    convergeTimeoutError(pbm.StatusRunning, time.Second),
+			expect: ErrConvergeTimeout,
+			msg:    "status `running`",
+		},
+		{
+			name:   "oplog version",
+			err:    checkOplogVersion("5.0.1", "7.0.2"),
+			expect: ErrIncompatibleVersion,
+			msg:    "cannot restore 5.0.1 oplog onto 7.0.2",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if !errors.Is(c.err, c.expect) {
+				t.Fatalf("expected %v, got %v", c.expect, c.err)
+			}
+			if !strings.Contains(c.err.Error(), c.msg) {
+				t.Errorf("expected message to contain %q, got %q", c.msg, c.err.Error())
+			}
+		})
+	}
+}
+
+func TestTransitStateLeaderTimeout(t *testing.T) {
+	const status = pbm.StatusRunning
+	wait := 5 * time.Minute
+
+	var mu sync.Mutex
+	meta := &pbm.RestoreMeta{Status: pbm.StatusStarting}
+	poll := func() (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return metaReachedStatus(meta, status)
+	}
+
+	// a follower waits with no bound of its own
+	clk := &fakeClock{now: time.Unix(1000, 0)}
+	waitFor := func() error {
+		return waitStatus(context.Background(), clk, time.Second, nil, status, poll)
+	}
+	follower := make(chan error, 1)
+	go func() {
+		follower <- transitState(status, false, &wait, nil, waitFor)
+	}()
+
+	leaderErr := transitState(status, true, &wait,
+		func(s pbm.Status, timeout *time.Duration) error { return convergeTimeoutError(s, *timeout) },
+		waitFor)
+	if !errors.Is(leaderErr, ErrConvergeTimeout) {
+		t.Fatalf("leader: expected converge timeout, got %v", leaderErr)
+	}
+	// the leader fails the restore on exit, even with the drain policy
+	if !failsCluster(leaderErr, true, false) {
+		t.Fatalf("leader: expected the restore to be failed for the cluster, got %v", leaderErr)
+	}
+	mu.Lock()
+	meta.Status, meta.Error = pbm.StatusError, leaderErr.Error()
+	mu.Unlock()
+
+	select {
+	case err := <-follower:
+		if err == nil || !strings.Contains(err.Error(), leaderErr.Error()) {
+			t.Errorf("follower: expected the leader's error %q, got %v", leaderErr, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("follower is still waiting after the leader timed out")
+	}
+}
+
+func TestTransitStateConverged(t *testing.T) {
+	const status = pbm.StatusRunning
+	meta := &pbm.RestoreMeta{Status: pbm.StatusStarting}
+
+	err := transitState(status, true, nil,
+		func(s pbm.Status, _ *time.Duration) error {
+			meta.Status = s
+			return nil
+		},
+		func() error {
+			return waitStatus(context.Background(), &fakeClock{}, time.Second, nil, status, func() (bool, error) {
+				return metaReachedStatus(meta, status)
+			})
+		})
+	if err != nil {
+		t.Fatalf("expected the status reached, got %v", err)
+	}
+}
+
+func TestFailsCluster(t *testing.T) {
+	shardErr := errors.New("apply oplog")
+	if !failsCluster(shardErr, false, false) {
+		t.Error("fail-fast: expected any error to fail the cluster")
+	}
+	if failsCluster(shardErr, true, false) {
+		t.Error("drain: expected the shard error to fail the replset only")
+	}
+	if !failsCluster(errors.Wrap(errShardsDrained, "rs1: boom"), true, false) {
+		t.Error("drain: expected drained shards to fail the cluster")
+	}
+	if !failsCluster(errors.Wrap(reconcileError{errors.New("boom")}, "to state"), true, false) {
+		t.Error("drain: expected the reconcile error to fail the cluster")
+	}
+}
+
+func TestFailsClusterLeader(t *testing.T) {
+	cfgsrv := &pbm.NodeInfo{SetName: "cfg", ConfigSvr: 2}
+	shard := &pbm.NodeInfo{SetName: "rs0", ConfigServerState: &pbm.ConfigServerState{}}
+	if !cfgsrv.IsLeader() || shard.IsLeader() {
+		t.Fatalf("unexpected leaders: config server %v, shard %v", cfgsrv.IsLeader(), shard.IsLeader())
+	}
+
+	// the failing leader doesn't reconcile the cluster anymore, so other
+	// shards would wait for it till the timeout
+	shardErr := errors.New("apply oplog")
+	if !failsCluster(shardErr, true, cfgsrv.IsLeader()) {
+		t.Error("drain: expected the leader error to fail the cluster")
+	}
+	if failsCluster(shardErr, true, shard.IsLeader()) {
+		t.Error("drain: expected the shard error to fail the replset only")
+	}
+}
+
+func TestClusterStateShardBehind(t *testing.T) {
+	ct := primitive.Timestamp{T: 1000}
+	meta := &pbm.RestoreMeta{
+		Name:   "2023-05-01T10:00:00Z",
+		Status: pbm.StatusRunning,
+		Replsets: []pbm.RestoreReplset{
+			{Name: "rs0", Status: pbm.StatusDumpDone, CurrentOp: primitive.Timestamp{T: 990}},
+			{Name: "rs1", Status: pbm.StatusRunning, CurrentOp: primitive.Timestamp{T: 900}},
+			{Name: "rs2", Status: pbm.StatusDumpDone, CurrentOp: primitive.Timestamp{T: 995}},
+		},
+	}
+	beats := []shardBeat{
+		{rs: "rs0", hb: primitive.Timestamp{T: 998}},
+		{rs: "rs1", hb: primitive.Timestamp{T: 900}},
+	}
+
+	s := clusterState(meta, beats, ct)
+	if s.Status != pbm.StatusRunning || s.Target != pbm.StatusDumpDone || !s.Waiting {
+		t.Fatalf("expected waiting for %s in %s, got %s/%s waiting %v",
+			pbm.StatusDumpDone, pbm.StatusRunning, s.Status, s.Target, s.Waiting)
+	}
+	if len(s.Shards) != 3 {
+		t.Fatalf("expected 3 shards, got %d", len(s.Shards))
+	}
+
+	want := []ShardState{
+		{Name: "rs0", Status: pbm.StatusDumpDone, Heartbeat: primitive.Timestamp{T: 998},
+			AppliedTS: primitive.Timestamp{T: 990}},
+		{Name: "rs1", Status: pbm.StatusRunning, Heartbeat: primitive.Timestamp{T: 900},
+			Stale: true, AppliedTS: primitive.Timestamp{T: 900}, Behind: true},
+		// no lock, already cleaned
+		{Name: "rs2", Status: pbm.StatusDumpDone, AppliedTS: primitive.Timestamp{T: 995}},
+	}
+	if !reflect.DeepEqual(s.Shards, want) {
+		t.Errorf("expected shards\n%+v\ngot\n%+v", want, s.Shards)
+	}
+
+	// all shards caught up, nothing to wait for
+	meta.Status = pbm.StatusDumpDone
+	meta.Replsets[1].Status = pbm.StatusDumpDone
+	s = clusterState(meta, beats, ct)
+	if s.Waiting || s.Target != pbm.StatusDumpDone {
+		t.Errorf("expected no waiting, got target %s waiting %v", s.Target, s.Waiting)
+	}
+	for _, sh := range s.Shards {
+		if sh.Behind {
+			t.Errorf("shard %s: unexpected behind", sh.Name)
+		}
+	}
+}
+
+func TestConvergedShardsFailed(t *testing.T) {
+	shards := []pbm.Shard{{RS: "rs2"}, {RS: "rs0"}, {RS: "rs1"}}
+	replsets := []pbm.RestoreReplset{
+		{Name: "rs1", Status: pbm.StatusError, Error: "apply oplog: duplicate key"},
+		{Name: "rs0", Status: pbm.StatusDumpDone},
+		{Name: "rs2", Status: pbm.StatusError, Error: "download: connection reset"},
+	}
+	want := "restore failed on 2 shards: rs1: apply oplog: duplicate key, rs2: download: connection reset"
+
+	// the same error whatever the order the shards are listed in
+	for i := 0; i < 3; i++ {
+		ok, err := shardsConverged(replsets, shards, pbm.StatusDumpDone)
+		if ok || err == nil {
+			t.Fatalf("expected an error, got converged %v", ok)
+		}
+		if err.Error() != want {
+			t.Errorf("expected %q, got %q", want, err.Error())
+		}
+
+		ok, err = shardsDrained(replsets, shards, pbm.StatusDumpDone)
+		if ok || err == nil {
+			t.Fatalf("drain: expected an error, got drained %v", ok)
+		}
+		if !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("drain: expected %q, got %q", want, err.Error())
+		}
+
+		shards = append(shards[1:], shards[0])
+		replsets = append(replsets[1:], replsets[0])
+	}
+}
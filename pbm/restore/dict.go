@@ -0,0 +1,41 @@
+package restore
+
+import (
+	"sync"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+)
+
+// chunkDicts loads the zstd dictionaries of the chunks (see
+// pbm.OplogChunk.Dict). Each one is read from the storage once.
+type chunkDicts struct {
+	stg storage.Storage
+
+	mu sync.Mutex
+	m  map[string][]byte
+}
+
+func newChunkDicts(stg storage.Storage) *chunkDicts {
+	return &chunkDicts{stg: stg, m: make(map[string][]byte)}
+}
+
+// get returns the dictionary of the chunk, nil if it has none
+func (d *chunkDicts) get(chnk *pbm.OplogChunk) ([]byte, error) {
+	if chnk.Dict == "" {
+		return nil, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if dict, ok := d.m[chnk.Dict]; ok {
+		return dict, nil
+	}
+	dict, err := pbm.ReadZstdDict(d.stg, chnk)
+	if err != nil {
+		return nil, err
+	}
+	d.m[chnk.Dict] = dict
+	return dict, nil
+}
@@ -0,0 +1,78 @@
+package restore
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// etaSmoothing is the weight of the latest sample in the exponentially
+// weighted moving averages of the apply rate. Chunks may vary a lot in
+// density (e.g. a burst of writes vs. noops only), so the instantaneous
+// rate alone would make ETA jump back and forth.
+const etaSmoothing = 0.3
+
+// etaEstimator estimates when the oplog replay reaches the end of the
+// [start, end] window based on the rolling apply rate, i.e. how many
+// seconds of the oplog are applied per wall clock second.
+type etaEstimator struct {
+	end uint32
+
+	// smoothed oplog-seconds applied and wall clock seconds spent.
+	// Averaging both separately rather than the rate itself keeps fast
+	// cheap chunks from outweighing the slow ones.
+	applied float64
+	wall    float64
+	lastTS  uint32
+	lastT   time.Time
+}
+
+func newETAEstimator(start, end primitive.Timestamp, now time.Time) *etaEstimator {
+	return &etaEstimator{
+		end:    end.T,
+		lastTS: start.T,
+		lastT:  now,
+	}
+}
+
+// observe registers that oplog has been applied up to lts by the wall clock
+// time now and returns the estimated remaining time. ok is false if there is
+// no end of the window or not enough data to estimate the rate yet.
+//
+//nolint:nonamedreturns
+func (e *etaEstimator) observe(lts primitive.Timestamp, now time.Time) (eta time.Duration, ok bool) {
+	if e.end == 0 {
+		return 0, false
+	}
+	if lts.T >= e.end || e.lastTS >= e.end {
+		return 0, true
+	}
+
+	wall := now.Sub(e.lastT).Seconds()
+	if wall > 0 {
+		var applied float64
+		if lts.T > e.lastTS {
+			applied = float64(lts.T - e.lastTS)
+		}
+
+		if e.wall == 0 {
+			e.applied, e.wall = applied, wall
+		} else {
+			e.applied = etaSmoothing*applied + (1-etaSmoothing)*e.applied
+			e.wall = etaSmoothing*wall + (1-etaSmoothing)*e.wall
+		}
+
+		e.lastT = now
+		if lts.T > e.lastTS {
+			e.lastTS = lts.T
+		}
+	}
+
+	if e.wall == 0 || e.applied <= 0 {
+		return 0, false
+	}
+
+	rate := e.applied / e.wall
+	left := float64(e.end - e.lastTS)
+	return time.Duration(left / rate * float64(time.Second)), true
+}
@@ -0,0 +1,105 @@
+package restore
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestETASteadyRate(t *testing.T) {
+	now := time.Unix(1000, 0)
+	e := newETAEstimator(primitive.Timestamp{T: 0}, primitive.Timestamp{T: 1000}, now)
+
+	// 100 oplog-seconds per 10 wall seconds, i.e. rate 10
+	for i := 1; i <= 5; i++ {
+		now = now.Add(10 * time.Second)
+		eta, ok := e.observe(primitive.Timestamp{T: uint32(i * 100)}, now)
+		if !ok {
+			t.Fatalf("step %d: expected eta", i)
+		}
+		expect := time.Duration(1000-i*100) / 10 * time.Second
+		if eta != expect {
+			t.Errorf("step %d: expected eta %v, got %v", i, expect, eta)
+		}
+	}
+}
+
+func TestETABurstyChunks(t *testing.T) {
+	now := time.Unix(1000, 0)
+	e := newETAEstimator(primitive.Timestamp{T: 0}, primitive.Timestamp{T: 10000}, now)
+
+	// alternate cheap (noop only) and heavy chunks, each covers 100
+	// oplog-seconds. the average rate is 200/11 oplog-sec per wall sec.
+	var (
+		ts   uint32
+		last time.Duration
+	)
+	for i := 0; i < 60; i++ {
+		wall := 1 * time.Second
+		if i%2 == 1 {
+			wall = 10 * time.Second
+		}
+		now = now.Add(wall)
+		ts += 100
+
+		eta, ok := e.observe(primitive.Timestamp{T: ts}, now)
+		if !ok {
+			t.Fatalf("step %d: expected eta", i)
+		}
+		if eta < 0 {
+			t.Fatalf("step %d: negative eta %v", i, eta)
+		}
+
+		if i > 10 {
+			avg := time.Duration(float64(10000-ts) / (200.0 / 11) * float64(time.Second))
+			// smoothed rate must not swing between the instantaneous
+			// extremes (100 and 10 oplog-sec per wall sec)
+			if eta < avg/3 || eta > avg*3 {
+				t.Errorf("step %d: eta %v is too far from the average %v", i, eta, avg)
+			}
+		}
+		last = eta
+	}
+
+	if last == 0 {
+		t.Errorf("expected non-zero eta before the end")
+	}
+}
+
+func TestETANeverNegative(t *testing.T) {
+	now := time.Unix(1000, 0)
+	e := newETAEstimator(primitive.Timestamp{T: 100}, primitive.Timestamp{T: 200}, now)
+
+	steps := []struct {
+		ts   uint32
+		wall time.Duration
+	}{
+		{150, time.Second},
+		{150, 0},                // same moment
+		{140, time.Second},      // lts went back
+		{250, time.Second},      // beyond the end
+		{300, 10 * time.Second}, // way beyond the end
+	}
+	for i, s := range steps {
+		now = now.Add(s.wall)
+		eta, _ := e.observe(primitive.Timestamp{T: s.ts}, now)
+		if eta < 0 {
+			t.Errorf("step %d: negative eta %v", i, eta)
+		}
+	}
+
+	eta, ok := e.observe(primitive.Timestamp{T: 300}, now.Add(time.Second))
+	if !ok || eta != 0 {
+		t.Errorf("expected zero eta after the end, got %v (%v)", eta, ok)
+	}
+}
+
+func TestETANoEnd(t *testing.T) {
+	now := time.Unix(1000, 0)
+	e := newETAEstimator(primitive.Timestamp{T: 100}, primitive.Timestamp{}, now)
+
+	if _, ok := e.observe(primitive.Timestamp{T: 150}, now.Add(time.Second)); ok {
+		t.Errorf("expected no eta without the end of the window")
+	}
+}
@@ -0,0 +1,115 @@
+package restore
+
+import (
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// defaultEventsBuffer is the num of events a subscriber may lag behind
+// before new ones are dropped for it
+const defaultEventsBuffer = 64
+
+// Event is published by the restore as it goes. It's one of
+// ChunkApplied, ChunkSlow, StatusChanged or RestoreFinished.
+type Event interface {
+	restoreEvent()
+}
+
+// ChunkApplied is published after each replayed oplog chunk
+type ChunkApplied struct {
+	RS         string
+	StartTS    primitive.Timestamp
+	EndTS      primitive.Timestamp
+	OpsApplied int64
+}
+
+// ChunkSlow is published when the chunk takes longer than
+// restore.slowChunkWarnSec to apply. The chunk is still being applied.
+type ChunkSlow struct {
+	RS      string
+	StartTS primitive.Timestamp
+	EndTS   primitive.Timestamp
+	Elapsed time.Duration
+}
+
+// StatusChanged is published when the replset moves to the next status
+type StatusChanged struct {
+	RS   string
+	From pbm.Status
+	To   pbm.Status
+}
+
+// RestoreFinished is published on the restore exit. Err is nil if
+// the restore on the node succeeded.
+type RestoreFinished struct {
+	Name string
+	Err  error
+}
+
+func (ChunkApplied) restoreEvent()    {}
+func (ChunkSlow) restoreEvent()       {}
+func (StatusChanged) restoreEvent()   {}
+func (RestoreFinished) restoreEvent() {}
+
+// EventBus delivers restore events to subscribers. Publish never blocks
+// the restore: events that don't fit into the subscriber's buffer are
+// dropped for it. Nil EventBus discards all events.
+type EventBus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[chan Event]struct{})}
+}
+
+// Subscribe returns the channel of events published from now on and
+// the func to unsubscribe. The channel is closed on unsubscribe.
+// Zero or less buffer means the default one.
+// The channel of nil EventBus is closed right away as it never has events.
+func (b *EventBus) Subscribe(buffer int) (<-chan Event, func()) {
+	if b == nil {
+		c := make(chan Event)
+		close(c)
+		return c, func() {}
+	}
+
+	if buffer <= 0 {
+		buffer = defaultEventsBuffer
+	}
+
+	c := make(chan Event, buffer)
+	b.mu.Lock()
+	b.subs[c] = struct{}{}
+	b.mu.Unlock()
+
+	once := sync.Once{}
+	return c, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, c)
+			close(c)
+			b.mu.Unlock()
+		})
+	}
+}
+
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for c := range b.subs {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package restore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+	"github.com/percona/percona-backup-mongodb/pbm/oplog"
+)
+
+func TestChunkAppliedEvents(t *testing.T) {
+	stg := memStorage{
+		"c1": indexOpsChunkAt(t, 10, createIndexOp("c", "a"), createIndexOp("c", "b")),
+		"c2": indexOpsChunkAt(t, 12, createIndexOp("d", "a"), createIndexOp("d", "b"), createIndexOp("d", "c")),
+		"c3": indexOpsChunkAt(t, 15, dropIndexOp("c", "a")),
+	}
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone, StartTS: ts(10), EndTS: ts(11)},
+		{RS: "rs0", FName: "c2", Compression: compress.CompressionTypeNone, StartTS: ts(12), EndTS: ts(14)},
+		{RS: "rs0", FName: "c3", Compression: compress.CompressionTypeNone, StartTS: ts(15), EndTS: ts(15)},
+	}
+
+	bus := NewEventBus()
+	events, unsubscribe := bus.Subscribe(0)
+
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+	_, err := applyOplog(context.Background(), nil, chunkList(chunks), &applyOplogOption{unsafe: true, events: bus}, false,
+		nil, nil, nil, &pbm.RestoreShardStat{}, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	unsubscribe()
+
+	var got []Event
+	for e := range events {
+		got = append(got, e)
+	}
+
+	want := []Event{
+		ChunkApplied{RS: "rs0", StartTS: ts(10), EndTS: ts(11), OpsApplied: 2},
+		ChunkApplied{RS: "rs0", StartTS: ts(12), EndTS: ts(14), OpsApplied: 3},
+		ChunkApplied{RS: "rs0", StartTS: ts(15), EndTS: ts(15), OpsApplied: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestEventBusNonBlocking(t *testing.T) {
+	bus := NewEventBus()
+	// no subscribers
+	bus.Publish(StatusChanged{To: pbm.StatusRunning})
+
+	events, unsubscribe := bus.Subscribe(1)
+	defer unsubscribe()
+
+	done := make(chan struct{})
+	go func() {
+		bus.Publish(StatusChanged{From: pbm.StatusStarting, To: pbm.StatusRunning})
+		// doesn't fit into the buffer
+		bus.Publish(StatusChanged{From: pbm.StatusRunning, To: pbm.StatusDone})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked")
+	}
+
+	e := <-events
+	if e != (StatusChanged{From: pbm.StatusStarting, To: pbm.StatusRunning}) {
+		t.Errorf("expected the first event, got %v", e)
+	}
+	select {
+	case e := <-events:
+		t.Errorf("expected the overflow event to be dropped, got %v", e)
+	default:
+	}
+
+	var nilBus *EventBus
+	nilBus.Publish(RestoreFinished{})
+	nilEvents, nilUnsubscribe := nilBus.Subscribe(0)
+	if _, ok := <-nilEvents; ok {
+		t.Error("expected the closed channel of nil bus")
+	}
+	nilUnsubscribe()
+}
+
+func TestStopBeforeSkipsChunks(t *testing.T) {
+	stg := memStorage{
+		"c1": indexOpsChunkAt(t, 10, createIndexOp("c", "a"), createIndexOp("c", "b"), createIndexOp("c", "c")),
+		"c2": indexOpsChunkAt(t, 13, createIndexOp("d", "a")),
+	}
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone, StartTS: ts(10), EndTS: ts(12)},
+		{RS: "rs0", FName: "c2", Compression: compress.CompressionTypeNone, StartTS: ts(13), EndTS: ts(13)},
+	}
+
+	bus := NewEventBus()
+	events, unsubscribe := bus.Subscribe(16)
+
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+	opt := &applyOplogOption{unsafe: true, events: bus, stopBefore: &oplog.StopBefore{TS: ts(12)}}
+	_, err := applyOplog(context.Background(), nil, chunkList(chunks), opt, false,
+		nil, nil, nil, &pbm.RestoreShardStat{}, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	unsubscribe()
+
+	var got []Event
+	for e := range events {
+		got = append(got, e)
+	}
+	want := []Event{ChunkApplied{RS: "rs0", StartTS: ts(10), EndTS: ts(12), OpsApplied: 2}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,204 @@
+package restore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/oplog"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+)
+
+// fanInChunks returns the oplog chunks of the source replsets mapped onto
+// the node's replset merged into one chunk. The replay reads such a chunk
+// through the storage wrapped by fanInChunks.over.
+func (r *Restore) fanInChunks(sources []string, from, to primitive.Timestamp) (oplogChunks, error) {
+	r.log.Warning("oplogs of %s are merged by the cluster time and replayed onto %s. "+
+		"Documents with the same _id in several replsets and their sharding metadata (chunks "+
+		"ranges and hashes) can't be reconciled, the later op overwrites the earlier one",
+		strings.Join(sources, ", "), r.nodeInfo.SetName)
+
+	bySource := make([][]pbm.OplogChunk, 0, len(sources))
+	for _, rs := range sources {
+		c, gaps, err := chunks(r.ctx, r.chunksIndex(), r.stg, from, to, rs, nil, r.conf.ChunksWarnAt(), r.allowGaps, r.log)
+		if err != nil {
+			return nil, errors.Wrapf(err, "replset %s", rs)
+		}
+		if err = r.addSkippedGaps(gaps); err != nil {
+			return nil, err
+		}
+		r.log.Debug("oplog chunks of %s: %s", rs, c.summary())
+		// merged chunks are read all at once
+		l, err := collect(c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "replset %s", rs)
+		}
+		bySource = append(bySource, l)
+	}
+
+	return newFanInChunks(r.nodeInfo.SetName, bySource, int64(r.conf.MaxDecompressBufferMb)<<20), nil
+}
+
+// fanInChunks is the single chunk merged from the oplog chunks of several
+// replsets. It's read through the restore storage wrapped by over.
+type fanInChunks struct {
+	chunk    pbm.OplogChunk
+	bySource [][]pbm.OplogChunk
+	maxMem   int64
+}
+
+// newFanInChunks returns the chunk merged from the sources chunks. The
+// chunk spans from the earliest start to the latest end of the sources,
+// so none of them is cut off. The sources that end earlier are checked
+// for gaps against the replay range on their own, see chunks().
+func newFanInChunks(rs string, bySource [][]pbm.OplogChunk, maxMem int64) *fanInChunks {
+	c := pbm.OplogChunk{RS: rs, Compression: compress.CompressionTypeNone}
+	for i, chunks := range bySource {
+		s := pbm.SummarizeChunks(chunks)
+		if i == 0 || s.From.Before(c.StartTS) {
+			c.StartTS = s.From
+		}
+		if i == 0 || s.To.After(c.EndTS) {
+			c.EndTS = s.To
+		}
+	}
+	c.FName = fmt.Sprintf("fanin/%s.%d.%d-%d.%d", rs, c.StartTS.T, c.StartTS.I, c.EndTS.T, c.EndTS.I)
+
+	return &fanInChunks{chunk: c, bySource: bySource, maxMem: maxMem}
+}
+
+func (f *fanInChunks) iter() chunksIter {
+	return chunkList{f.chunk}.iter()
+}
+
+func (f *fanInChunks) summary() pbm.ChunksSummary {
+	return chunkList{f.chunk}.summary()
+}
+
+// over returns the storage that serves the merged chunk over stg
+func (f *fanInChunks) over(stg storage.Storage) *fanInStorage {
+	return &fanInStorage{Storage: stg, chunks: f}
+}
+
+// fanInStorage serves the chunk merged from the oplog chunks of several
+// replsets. The merged chunk is uncompressed and ordered by the cluster
+// time. Other files are read from the underlying storage.
+type fanInStorage struct {
+	storage.Storage
+
+	chunks *fanInChunks
+}
+
+func (s *fanInStorage) SourceReader(name string) (io.ReadCloser, error) {
+	if name != s.chunks.chunk.FName {
+		return s.Storage.SourceReader(name)
+	}
+
+	dicts := newChunkDicts(s.Storage)
+	srcs := make([]io.ReadCloser, len(s.chunks.bySource))
+	for i, chunks := range s.chunks.bySource {
+		srcs[i] = &chunksReader{stg: s.Storage, dicts: dicts, chunks: chunks, maxMem: s.chunks.maxMem}
+	}
+	return oplog.NewMergeReader(srcs...), nil
+}
+
+// SourceReaderWithStat is SourceReader. The size of the merged chunk
+// isn't known until it's read, so it's zero.
+func (s *fanInStorage) SourceReaderWithStat(name string) (io.ReadCloser, storage.FileInfo, error) {
+	if name != s.chunks.chunk.FName {
+		return storage.SourceReaderWithStat(s.Storage, name)
+	}
+
+	r, err := s.SourceReader(name)
+	return r, storage.FileInfo{Name: name}, err
+}
+
+// chunksReader reads decompressed oplog chunks one after another
+type chunksReader struct {
+	stg    storage.Storage
+	dicts  *chunkDicts
+	chunks []pbm.OplogChunk
+	maxMem int64
+	cur    io.ReadCloser
+}
+
+func (c *chunksReader) Read(p []byte) (int, error) {
+	for {
+		if c.cur == nil {
+			if len(c.chunks) == 0 {
+				return 0, io.EOF
+			}
+			dict, err := c.dicts.get(&c.chunks[0])
+			if err != nil {
+				return 0, err
+			}
+			r, err := openChunk(c.stg, c.chunks[0], c.maxMem, dict)
+			if err != nil {
+				return 0, err
+			}
+			c.cur, c.chunks = r, c.chunks[1:]
+		}
+
+		n, err := c.cur.Read(p)
+		if !errors.Is(err, io.EOF) {
+			return n, err
+		}
+		err = c.cur.Close()
+		c.cur = nil
+		if err != nil || n > 0 {
+			return n, err
+		}
+	}
+}
+
+func (c *chunksReader) Close() error {
+	if c.cur == nil {
+		return nil
+	}
+	return c.cur.Close()
+}
+
+// openChunk returns the decompressed oplog of the chunk (with its zstd
+// dictionary if any), see replayChunk. Old `.snappy` chunks that are S2
+// in fact (see applyOplog) are detected by the content.
+func openChunk(stg storage.Storage, chnk pbm.OplogChunk, maxMem int64, dict []byte) (io.ReadCloser, error) {
+	or, err := openChunkObject(context.Background(), stg, chnk.FName, chnk.Checksum, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(or)
+	c := chnk.Compression
+	if c == compress.CompressionTypeSNAPPY {
+		head, _ := br.Peek(compress.DetectPeekLen)
+		if compress.Detect(head) == compress.CompressionTypeS2 {
+			c = compress.CompressionTypeS2
+		}
+	}
+
+	return decompressChunk(&chunkReadCloser{Reader: br, closers: []io.Closer{or}, name: chnk.FName},
+		chnk.FName, c, dict, maxMem)
+}
+
+type chunkReadCloser struct {
+	io.Reader
+	closers []io.Closer
+	name    string
+}
+
+func (c *chunkReadCloser) Close() error {
+	var err error
+	for _, cl := range c.closers {
+		if cerr := cl.Close(); cerr != nil && err == nil {
+			err = errors.Wrapf(cerr, "object %s", c.name)
+		}
+	}
+	return err
+}
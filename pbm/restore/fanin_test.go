@@ -0,0 +1,263 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+)
+
+// rsNoopChunk is noopChunk with ops marked by the replset
+func rsNoopChunk(t *testing.T, rs string, c compress.CompressionType, ts ...uint32) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := compress.Compress(&buf, c, nil)
+	if err != nil {
+		t.Fatalf("create %s writer: %v", c, err)
+	}
+	for _, s := range ts {
+		b, err := bson.Marshal(bson.M{
+			"ts": primitive.Timestamp{T: s, I: 1},
+			"op": "n",
+			"ns": "",
+			"o":  bson.M{"msg": rs},
+		})
+		if err != nil {
+			t.Fatalf("marshal oplog entry: %v", err)
+		}
+		if _, err = w.Write(b); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestFanInMerge(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	stg := memStorage{
+		"rs0.1": rsNoopChunk(t, "rs0", compress.CompressionTypeNone, 1, 3),
+		// mislabeled by old versions
+		"rs0.2": rsNoopChunk(t, "rs0", compress.CompressionTypeS2, 4, 6),
+		"rs1.1": rsNoopChunk(t, "rs1", compress.CompressionTypeNone, 2, 3, 5),
+		"rs1.2": rsNoopChunk(t, "rs1", compress.CompressionTypeNone, 7, 8),
+	}
+	bySource := [][]pbm.OplogChunk{
+		{
+			{RS: "rs0", FName: "rs0.1", Compression: compress.CompressionTypeNone, StartTS: ts(1), EndTS: ts(3)},
+			{RS: "rs0", FName: "rs0.2", Compression: compress.CompressionTypeSNAPPY, StartTS: ts(3), EndTS: ts(6)},
+		},
+		{
+			{RS: "rs1", FName: "rs1.1", Compression: compress.CompressionTypeNone, StartTS: ts(2), EndTS: ts(5)},
+			{RS: "rs1", FName: "rs1.2", Compression: compress.CompressionTypeNone, StartTS: ts(5), EndTS: ts(8)},
+		},
+	}
+
+	fc := newFanInChunks("rsA", bySource, 0)
+	fstg, chnk := fc.over(stg), fc.chunk
+	if chnk.RS != "rsA" || chnk.StartTS != ts(1) || chnk.EndTS != ts(8) {
+		t.Fatalf("expected merged chunk of rsA 1-8, got %+v", chnk)
+	}
+
+	r, err := fstg.SourceReader(chnk.FName)
+	if err != nil {
+		t.Fatalf("open merged chunk: %v", err)
+	}
+	src := db.NewBufferlessBSONSource(r)
+	defer src.Close()
+
+	type op struct {
+		TS primitive.Timestamp `bson:"ts"`
+		O  struct {
+			Msg string `bson:"msg"`
+		} `bson:"o"`
+	}
+	var got []op
+	for raw := src.LoadNext(); raw != nil; raw = src.LoadNext() {
+		o := op{}
+		if err := bson.Unmarshal(raw, &o); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		got = append(got, o)
+	}
+	if err := src.Err(); err != nil {
+		t.Fatalf("read merged chunk: %v", err)
+	}
+
+	want := []op{
+		{TS: ts(1)}, {TS: ts(2)}, {TS: ts(3)}, {TS: ts(3)}, {TS: ts(4)},
+		{TS: ts(5)}, {TS: ts(6)}, {TS: ts(7)}, {TS: ts(8)},
+	}
+	for i, rs := range []string{"rs0", "rs1", "rs0", "rs1", "rs0", "rs1", "rs0", "rs1", "rs1"} {
+		want[i].O.Msg = rs
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("op %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+
+	// other files are read from the underlying storage
+	if _, err = fstg.SourceReader("rs1.2"); err != nil {
+		t.Errorf("read underlying file: %v", err)
+	}
+
+	l := log.New(nil, "rsA", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+	end := chnk.EndTS
+	var lts primitive.Timestamp
+	opts := &applyOplogOption{end: &end, progress: func(p replayProgress) { lts = p.lts }}
+	_, err = applyOplog(context.Background(), nil, fc, opts, false,
+		nil, nil, nil, &pbm.RestoreShardStat{}, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+	if err != nil {
+		t.Fatalf("replay merged chunk: %v", err)
+	}
+	if lts != end {
+		t.Errorf("expected the replay up to %v, got %v", end, lts)
+	}
+}
+
+func TestFanInChecksum(t *testing.T) {
+	stg := memStorage{"c": rsNoopChunk(t, "rs0", compress.CompressionTypeNone, 1)}
+	chunks := []pbm.OplogChunk{{
+		RS: "rs0", FName: "c", Compression: compress.CompressionTypeNone,
+		StartTS: primitive.Timestamp{T: 1}, EndTS: primitive.Timestamp{T: 1, I: 1},
+		Checksum: "crc32c:00000000",
+	}}
+
+	fc := newFanInChunks("rsA", [][]pbm.OplogChunk{chunks}, 0)
+	r, err := fc.over(stg).SourceReader(fc.chunk.FName)
+	if err != nil {
+		t.Fatalf("open merged chunk: %v", err)
+	}
+	defer r.Close()
+	if _, err = io.ReadAll(r); err == nil {
+		t.Errorf("expected checksum mismatch")
+	}
+}
+
+// appliedRunner records `_id`s of the applied docs
+type appliedRunner struct {
+	ids []int
+	err error
+}
+
+func (r *appliedRunner) RunCommand(_ context.Context, _ string, cmd bson.D) *mongo.SingleResult {
+	var doc struct {
+		ApplyOps []struct {
+			O struct {
+				ID int `bson:"_id"`
+			} `bson:"o"`
+		} `bson:"applyOps"`
+	}
+	b, err := bson.Marshal(cmd)
+	if err == nil {
+		err = bson.Unmarshal(b, &doc)
+	}
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	for _, op := range doc.ApplyOps {
+		r.ids = append(r.ids, op.O.ID)
+	}
+
+	return mongo.NewSingleResultFromDocument(bson.D{{Key: "ok", Value: 1}}, nil, nil)
+}
+
+func TestFanInDistTxn(t *testing.T) {
+	ts := func(t, i uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: i} }
+	lsid := func(id string) bson.Raw {
+		b, err := bson.Marshal(bson.M{"id": id})
+		if err != nil {
+			t.Fatalf("marshal lsid: %v", err)
+		}
+		return b
+	}
+	// each replset has its part of the txn and its own commit message
+	prepare := func(at primitive.Timestamp, txn string, id int) bson.M {
+		return bson.M{
+			"ts": at, "op": "c", "ns": "admin.$cmd", "lsid": lsid(txn), "txnNumber": int64(1),
+			"o": bson.D{
+				{Key: "applyOps", Value: bson.A{bson.D{
+					{Key: "op", Value: "i"},
+					{Key: "ns", Value: "test.c"},
+					{Key: "o", Value: bson.D{{Key: "_id", Value: int32(id)}}},
+				}}},
+				{Key: "prepare", Value: true},
+			},
+		}
+	}
+	commit := func(at primitive.Timestamp, txn string, cts primitive.Timestamp) bson.M {
+		return bson.M{
+			"ts": at, "op": "c", "ns": "admin.$cmd", "lsid": lsid(txn), "txnNumber": int64(1),
+			"o": bson.D{{Key: "commitTransaction", Value: 1}, {Key: "commitTimestamp", Value: cts}},
+		}
+	}
+	chunk := func(ops ...bson.M) []byte {
+		var buf bytes.Buffer
+		for _, op := range ops {
+			b, err := bson.Marshal(op)
+			if err != nil {
+				t.Fatalf("marshal oplog entry: %v", err)
+			}
+			buf.Write(b)
+		}
+		return buf.Bytes()
+	}
+
+	// commits of t1 on rs0 and rs1 are apart, t2 commits in between
+	stg := memStorage{
+		"rs0": chunk(
+			prepare(ts(10, 1), "t1", 1),
+			commit(ts(12, 1), "t1", ts(11, 1)),
+			prepare(ts(13, 1), "t2", 3),
+			commit(ts(14, 1), "t2", ts(13, 3)),
+		),
+		"rs1": chunk(
+			prepare(ts(11, 1), "t1", 2),
+			prepare(ts(13, 2), "t2", 4),
+			commit(ts(15, 1), "t1", ts(11, 1)),
+			commit(ts(16, 1), "t2", ts(13, 3)),
+		),
+	}
+	bySource := [][]pbm.OplogChunk{
+		{{RS: "rs0", FName: "rs0", Compression: compress.CompressionTypeNone, StartTS: ts(10, 1), EndTS: ts(14, 1)}},
+		{{RS: "rs1", FName: "rs1", Compression: compress.CompressionTypeNone, StartTS: ts(11, 1), EndTS: ts(16, 1)}},
+	}
+
+	l := log.New(nil, "rsA", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+	rec := &appliedRunner{}
+	stat := &pbm.RestoreShardStat{}
+	_, err := applyOplog(context.Background(), nil, newFanInChunks("rsA", bySource, 0),
+		&applyOplogOption{runner: rec}, false, nil, nil, nil, stat,
+		&pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+	if err != nil {
+		t.Fatalf("replay merged chunk: %v", err)
+	}
+
+	if rec.err != nil {
+		t.Fatalf("decode applied ops: %v", rec.err)
+	}
+	if !reflect.DeepEqual(rec.ids, []int{1, 2, 3, 4}) {
+		t.Errorf("expected both parts of each txn applied once, got %v", rec.ids)
+	}
+	if !stat.LastTS.Equal(ts(16, 1)) {
+		t.Errorf("expected the replay up to the latest source end %v, got %v", ts(16, 1), stat.LastTS)
+	}
+}
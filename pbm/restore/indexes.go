@@ -0,0 +1,83 @@
+package restore
+
+import (
+	"context"
+	"strings"
+
+	"github.com/mongodb/mongo-tools/common/idx"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/percona/percona-backup-mongodb/pbm/archive"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+	"github.com/percona/percona-backup-mongodb/pbm/oplog"
+	"github.com/percona/percona-backup-mongodb/pbm/sel"
+)
+
+type nsIndexes struct {
+	db, coll string
+	indexes  []*idx.IndexDocument
+}
+
+// buildIndexes builds indexes from the catalog for the selected namespaces
+// in a single pass. Up to `concurrency` collections are processed at once.
+func buildIndexes(
+	ctx context.Context,
+	ic *idx.IndexCatalog,
+	nss []string,
+	concurrency int,
+	b oplog.IndexBuilder,
+	l *log.Event,
+) error {
+	isSelected := sel.MakeSelectedPred(nss)
+
+	var builds []nsIndexes
+	for _, ns := range ic.Namespaces() {
+		if ns := archive.NSify(ns.DB, ns.Collection); !isSelected(ns) {
+			l.Debug("skip restore indexes for %q", ns)
+			continue
+		}
+
+		indexes := ic.GetIndexes(ns.DB, ns.Collection)
+		for i, index := range indexes {
+			if len(index.Key) == 1 && index.Key[0].Key == "_id" {
+				// The _id index is already created with the collection
+				indexes = append(indexes[:i], indexes[i+1:]...)
+				break
+			}
+		}
+
+		if len(indexes) == 0 {
+			l.Debug("no indexes for %s.%s", ns.DB, ns.Collection)
+			continue
+		}
+
+		builds = append(builds, nsIndexes{db: ns.DB, coll: ns.Collection, indexes: indexes})
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(concurrency)
+	for _, ns := range builds {
+		ns := ns
+		eg.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			var indexNames []string
+			for _, index := range ns.indexes {
+				name, _ := index.Options["name"].(string)
+				indexNames = append(indexNames, name)
+			}
+			l.Info("restoring indexes for %s.%s: %s",
+				ns.db, ns.coll, strings.Join(indexNames, ", "))
+
+			return b.CreateIndexes(ns.db, ns.coll, ns.indexes)
+		})
+	}
+
+	return eg.Wait()
+}
@@ -0,0 +1,231 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mongodb/mongo-tools/common/idx"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+)
+
+// fakeIndexBuilder keeps the set of index names per namespace
+type fakeIndexBuilder struct {
+	mx      sync.Mutex
+	indexes map[string]map[string]bool
+}
+
+func (b *fakeIndexBuilder) CreateIndexes(db, coll string, indexes []*idx.IndexDocument) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.indexes == nil {
+		b.indexes = make(map[string]map[string]bool)
+	}
+	ns := db + "." + coll
+	if b.indexes[ns] == nil {
+		b.indexes[ns] = make(map[string]bool)
+	}
+	for _, index := range indexes {
+		b.indexes[ns][index.Options["name"].(string)] = true
+	}
+
+	return nil
+}
+
+func (b *fakeIndexBuilder) DropIndexes(db string, cmd bson.D) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	m := cmd.Map()
+	ns := db + "." + m["dropIndexes"].(string)
+	name, _ := m["index"].(string)
+	if name == "*" {
+		delete(b.indexes, ns)
+		return nil
+	}
+	delete(b.indexes[ns], name)
+	if len(b.indexes[ns]) == 0 {
+		delete(b.indexes, ns)
+	}
+
+	return nil
+}
+
+func indexOpsChunk(t *testing.T, ops ...bson.D) []byte {
+	t.Helper()
+
+	return indexOpsChunkAt(t, 10, ops...)
+}
+
+// indexOpsChunkAt makes the chunk of ops starting at `from` timestamp
+func indexOpsChunkAt(t *testing.T, from uint32, ops ...bson.D) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	for i, op := range ops {
+		b, err := bson.Marshal(bson.M{
+			"ts": primitive.Timestamp{T: from + uint32(i), I: 1},
+			"op": "c",
+			"ns": "test.$cmd",
+			"o":  op,
+		})
+		if err != nil {
+			t.Fatalf("marshal oplog entry: %v", err)
+		}
+		buf.Write(b)
+	}
+
+	return buf.Bytes()
+}
+
+// command name has to be the first field in the op
+func createIndexOp(coll, name string) bson.D {
+	return bson.D{
+		{Key: "createIndexes", Value: coll},
+		{Key: "v", Value: 2},
+		{Key: "key", Value: bson.D{{Key: name, Value: 1}}},
+		{Key: "name", Value: name},
+	}
+}
+
+func dropIndexOp(coll, name string) bson.D {
+	return bson.D{{Key: "dropIndexes", Value: coll}, {Key: "index", Value: name}}
+}
+
+func TestDeferredIndexBuild(t *testing.T) {
+	cases := []struct {
+		name   string
+		ops    []bson.D
+		expect map[string]map[string]bool
+	}{
+		{
+			name: "create",
+			ops:  []bson.D{createIndexOp("c", "a"), createIndexOp("d", "b")},
+			expect: map[string]map[string]bool{
+				"test.c": {"a": true},
+				"test.d": {"b": true},
+			},
+		},
+		{
+			name: "create then drop",
+			ops: []bson.D{
+				createIndexOp("c", "a"),
+				createIndexOp("c", "b"),
+				dropIndexOp("c", "b"),
+				createIndexOp("d", "x"),
+				dropIndexOp("d", "x"),
+			},
+			expect: map[string]map[string]bool{
+				"test.c": {"a": true},
+			},
+		},
+	}
+
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+	mgoV := &pbm.MongoVersion{Version: []int{6, 0, 0}}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stg := memStorage{"c1": indexOpsChunk(t, c.ops...)}
+			chunks := []pbm.OplogChunk{{
+				RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone,
+				StartTS: primitive.Timestamp{T: 10, I: 1},
+				EndTS:   primitive.Timestamp{T: uint32(10 + len(c.ops)), I: 1},
+			}}
+
+			inline := &fakeIndexBuilder{}
+			_, err := applyOplog(context.Background(), nil, chunkList(chunks),
+				&applyOplogOption{unsafe: true, indexBuilder: inline}, false,
+				nil, nil, nil, &pbm.RestoreShardStat{}, mgoV, stg, l)
+			if err != nil {
+				t.Fatalf("inline replay: %v", err)
+			}
+
+			ic := idx.NewIndexCatalog()
+			_, err = applyOplog(context.Background(), nil, chunkList(chunks),
+				&applyOplogOption{unsafe: true}, false,
+				ic, nil, nil, &pbm.RestoreShardStat{}, mgoV, stg, l)
+			if err != nil {
+				t.Fatalf("deferred replay: %v", err)
+			}
+			deferred := &fakeIndexBuilder{}
+			if err = buildIndexes(context.Background(), ic, nil, 2, deferred, l); err != nil {
+				t.Fatalf("build indexes: %v", err)
+			}
+
+			if !reflect.DeepEqual(inline.indexes, c.expect) {
+				t.Errorf("inline: expected %v, got %v", c.expect, inline.indexes)
+			}
+			if !reflect.DeepEqual(deferred.indexes, inline.indexes) {
+				t.Errorf("deferred build differs from inline: %v vs %v", deferred.indexes, inline.indexes)
+			}
+		})
+	}
+}
+
+// slowIndexBuilder tracks the num of builds in flight
+type slowIndexBuilder struct {
+	fakeIndexBuilder
+
+	curr int32
+	max  int32
+}
+
+func (b *slowIndexBuilder) CreateIndexes(db, coll string, indexes []*idx.IndexDocument) error {
+	n := atomic.AddInt32(&b.curr, 1)
+	defer atomic.AddInt32(&b.curr, -1)
+
+	for {
+		m := atomic.LoadInt32(&b.max)
+		if n <= m || atomic.CompareAndSwapInt32(&b.max, m, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	return b.fakeIndexBuilder.CreateIndexes(db, coll, indexes)
+}
+
+func TestBuildIndexesConcurrency(t *testing.T) {
+	const colls = 8
+
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+
+	for _, k := range []int{0, 1, 3} {
+		ic := idx.NewIndexCatalog()
+		for i := 0; i < colls; i++ {
+			ic.AddIndex("test", fmt.Sprintf("c%d", i), &idx.IndexDocument{
+				Key:     bson.D{{Key: "a", Value: 1}},
+				Options: bson.M{"name": "a_1"},
+			})
+		}
+
+		b := &slowIndexBuilder{}
+		err := buildIndexes(context.Background(), ic, nil, k, b, l)
+		if err != nil {
+			t.Fatalf("concurrency %d: build indexes: %v", k, err)
+		}
+
+		limit := int32(k)
+		if limit < 1 {
+			limit = 1
+		}
+		if b.max > limit {
+			t.Errorf("concurrency %d: expected up to %d builds at once, got %d", k, limit, b.max)
+		}
+		if len(b.indexes) != colls {
+			t.Errorf("concurrency %d: expected indexes for %d collections, got %d", k, colls, len(b.indexes))
+		}
+	}
+}
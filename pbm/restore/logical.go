@@ -17,6 +17,9 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/percona/percona-backup-mongodb/pbm"
 	"github.com/percona/percona-backup-mongodb/pbm/archive"
@@ -49,11 +52,60 @@ type Restore struct {
 	// sMap is mapping between old and new shard names. used for router config update.
 	// empty if all shard names are the same
 	sMap map[string]string
+	// timeouts are per status transition timeouts from the config
+	timeouts map[pbm.Status]time.Duration
+	// conf is the restore section of the config
+	conf pbm.RestoreConf
+	// stgConf overrides the configured storage to read the backup from
+	stgConf *pbm.StorageConf
+	// indexBuildConcurrency overrides the configured one if set
+	indexBuildConcurrency int
+	// resume is the replay checkpoint left by the previous unfinished
+	// run of the restore for the replset
+	resume *pbm.ReplayCheckpoint
+	// resumedWrites is the end of the node's writes of the resumed run,
+	// see resumedWrites
+	resumedWrites primitive.Timestamp
+	// targets are replsets to restore. If set, other replsets are skipped
+	// and not awaited. Empty means all replsets from the backup.
+	targets []string
+	// fanIn allows several oplog replsets mapped onto one,
+	// see pbm.ReplayCmd.FanIn
+	fanIn bool
+	// allowGaps replays oplog chunks despite gaps between them,
+	// see pbm.RestoreCmd.AllowGaps
+	allowGaps bool
+	// txnShards are replsets expected to share their committed dist txns:
+	// replsets of the backup (or of the oplog for the replay) mapped
+	// onto the cluster ones
+	txnShards []string
 
 	log  *log.Event
 	opid string
 
+	// ctx carries the restore's root tracing span
+	ctx  context.Context
+	span trace.Span
+
 	indexCatalog *idx.IndexCatalog
+
+	// meta caches the restore meta for the convergence and wait loops
+	meta *metaCache
+	// clock drives the convergence and wait loops
+	clock Clock
+	// prefetchBudget is the memory of the oplog prefetch, it may be
+	// shared with other restores
+	prefetchBudget *MemBudget
+
+	// events of the restore progress and the last published status
+	events *EventBus
+	status pbm.Status
+
+	// audit is the record of the restore start, auditFn writes records
+	// to the audit trail. txnStat is the dist txns stat of the replay.
+	audit   *pbm.RestoreAudit
+	auditFn auditFn
+	txnStat *pbm.DistTxnStat
 }
 
 // New creates a new restore object
@@ -66,11 +118,34 @@ func New(cn *pbm.PBM, node *pbm.Node, rsMap map[string]string) *Restore {
 		cn:    cn,
 		node:  node,
 		rsMap: rsMap,
+		ctx:   context.Background(),
 
+		clock:        wallClock,
 		indexCatalog: idx.NewIndexCatalog(),
+		events:       NewEventBus(),
+		auditFn:      cn.AddRestoreAudit,
 	}
 }
 
+// Events returns the bus the restore publishes its events to.
+// Subscribers are supposed to be registered before the restore starts.
+func (r *Restore) Events() *EventBus {
+	return r.events
+}
+
+// SetClock replaces the real clock of the convergence and wait loops,
+// e.g. to run them faster in simulations.
+func (r *Restore) SetClock(c Clock) {
+	r.clock = c
+}
+
+// SetPrefetchBudget sets the memory budget of the oplog prefetch. The
+// budget is resized according to the config of the restore. Without it
+// the restore has its own.
+func (r *Restore) SetPrefetchBudget(b *MemBudget) {
+	r.prefetchBudget = b
+}
+
 // Close releases object resources.
 // Should be run to avoid leaks.
 func (r *Restore) Close() {
@@ -80,13 +155,20 @@ func (r *Restore) Close() {
 }
 
 func (r *Restore) exit(err error, l *log.Event) {
-	if err != nil && !errors.Is(err, ErrNoDataForShard) {
+	// ErrRestoreDone is about the previous run, its meta should stay intact
+	if err != nil && !errors.Is(err, ErrNoDataForShard) && !errors.Is(err, ErrRestoreDone) {
 		ferr := r.MarkFailed(err)
 		if ferr != nil {
 			l.Error("mark restore as failed `%v`: %v", err, ferr)
 		}
 	}
 
+	if r.span != nil {
+		endSpan(r.span, err)
+	}
+
+	r.auditFinish(err)
+	r.events.Publish(RestoreFinished{Name: r.name, Err: err})
 	r.Close()
 }
 
@@ -96,12 +178,15 @@ func (r *Restore) exit(err error, l *log.Event) {
 func (r *Restore) Snapshot(cmd *pbm.RestoreCmd, opid pbm.OPID, l *log.Event) (err error) {
 	defer func() { r.exit(err, l) }()
 
-	bcp, err := SnapshotMeta(r.cn, cmd.BackupName, r.stg)
+	r.stgConf = cmd.Storage
+	r.indexBuildConcurrency = cmd.IndexBuildConcurrency
+	err = r.init(cmd.Name, opid, cmd.Rerun, l)
 	if err != nil {
 		return err
 	}
+	r.auditStart(pbm.RestoreAudit{Backup: cmd.BackupName, User: cmd.User})
 
-	err = r.init(cmd.Name, opid, l)
+	bcp, err := r.snapshotMeta(cmd.BackupName)
 	if err != nil {
 		return err
 	}
@@ -121,11 +206,16 @@ func (r *Restore) Snapshot(cmd *pbm.RestoreCmd, opid pbm.OPID, l *log.Event) (er
 		return err
 	}
 
+	r.targets = cmd.Replsets
 	err = r.setShards(bcp)
 	if err != nil {
 		return err
 	}
 
+	if !r.isTarget() {
+		return r.skip()
+	}
+
 	if r.nodeInfo.IsConfigSrv() {
 		r.sMap = r.getShardMapping(bcp)
 	}
@@ -135,6 +225,20 @@ func (r *Restore) Snapshot(cmd *pbm.RestoreCmd, opid pbm.OPID, l *log.Event) (er
 		return err
 	}
 
+	oplogOption := &applyOplogOption{nss: nss}
+	if r.nodeInfo.IsConfigSrv() && sel.IsSelective(nss) {
+		oplogOption.nss = []string{"config.databases"}
+		oplogOption.filter = newConfigsvrOpFilter(nss)
+	}
+	if !cmd.SkipVersionCheck {
+		oplogOption.srcVersion = bcp.MongoVersion
+		oplogOption.srcFCV = bcp.FCV
+	}
+	err = r.checkFCV(oplogOption)
+	if err != nil {
+		return err
+	}
+
 	err = r.toState(pbm.StatusRunning, &pbm.WaitActionStart)
 	if err != nil {
 		return err
@@ -150,18 +254,13 @@ func (r *Restore) Snapshot(cmd *pbm.RestoreCmd, opid pbm.OPID, l *log.Event) (er
 		return err
 	}
 
-	oplogOption := &applyOplogOption{nss: nss}
-	if r.nodeInfo.IsConfigSrv() && sel.IsSelective(nss) {
-		oplogOption.nss = []string{"config.databases"}
-		oplogOption.filter = newConfigsvrOpFilter(nss)
-	}
-
-	err = r.applyOplog([]pbm.OplogChunk{{
+	err = r.applyOplog(chunkList{{
 		RS:          r.nodeInfo.SetName,
 		FName:       oplog,
 		Compression: bcp.Compression,
 		StartTS:     bcp.FirstWriteTS,
 		EndTS:       bcp.LastWriteTS,
+		Checksum:    r.oplogChecksum(bcp),
 	}}, oplogOption)
 	if err != nil {
 		return err
@@ -208,12 +307,16 @@ func newConfigsvrOpFilter(nss []string) oplog.OpFilter {
 func (r *Restore) PITR(cmd *pbm.RestoreCmd, opid pbm.OPID, l *log.Event) (err error) {
 	defer func() { r.exit(err, l) }()
 
-	err = r.init(cmd.Name, opid, l)
+	r.stgConf = cmd.Storage
+	r.indexBuildConcurrency = cmd.IndexBuildConcurrency
+	r.allowGaps = cmd.AllowGaps
+	err = r.init(cmd.Name, opid, cmd.Rerun, l)
 	if err != nil {
 		return err
 	}
+	r.auditStart(pbm.RestoreAudit{Backup: cmd.BackupName, To: cmd.OplogTS, User: cmd.User})
 
-	bcp, err := SnapshotMeta(r.cn, cmd.BackupName, r.stg)
+	bcp, err := r.snapshotMeta(cmd.BackupName)
 	if err != nil {
 		return errors.Wrap(err, "get base backup")
 	}
@@ -244,11 +347,16 @@ func (r *Restore) PITR(cmd *pbm.RestoreCmd, opid pbm.OPID, l *log.Event) (err er
 		return err
 	}
 
+	r.targets = cmd.Replsets
 	err = r.setShards(bcp)
 	if err != nil {
 		return err
 	}
 
+	if !r.isTarget() {
+		return r.skip()
+	}
+
 	bcpShards := make([]string, len(bcp.Replsets))
 	for i := range bcp.Replsets {
 		bcpShards[i] = bcp.Replsets[i].Name
@@ -272,6 +380,38 @@ func (r *Restore) PITR(cmd *pbm.RestoreCmd, opid pbm.OPID, l *log.Event) (err er
 		return err
 	}
 
+	chunks = &leadingChunks{rest: chunks, first: pbm.OplogChunk{
+		RS:          r.nodeInfo.SetName,
+		FName:       oplog,
+		Compression: bcp.Compression,
+		StartTS:     bcp.FirstWriteTS,
+		EndTS:       bcp.LastWriteTS,
+		Checksum:    r.oplogChecksum(bcp),
+	}}
+
+	oplogOption := applyOplogOption{end: &cmd.OplogTS, nss: nss, stopBefore: stopBeforeOp(cmd)}
+	if !cmd.SkipVersionCheck {
+		oplogOption.srcVersion = bcp.MongoVersion
+		oplogOption.srcFCV = bcp.FCV
+	}
+	err = r.checkFCV(&oplogOption)
+	if err != nil {
+		return err
+	}
+
+	// the oplog is downloaded before the snapshot restore changes the
+	// data, so a storage outage fails the restore before any change
+	if r.conf.OplogPreDownload {
+		stg := storage.NewThrottled(r.stg, sharedDownloadLimit(r.conf.DownloadBytesPerSec))
+		ls, err := preDownload(r.ctx, stg, chunks, r.conf.OplogPreDownloadDir)
+		if err != nil {
+			return errors.Wrap(err, "pre-download chunks")
+		}
+		defer ls.cleanup(l)
+		l.Info("%d chunks are downloaded to %s", len(ls.files), ls.dir)
+		oplogOption.downloaded = ls
+	}
+
 	err = r.toState(pbm.StatusRunning, &pbm.WaitActionStart)
 	if err != nil {
 		return err
@@ -287,21 +427,12 @@ func (r *Restore) PITR(cmd *pbm.RestoreCmd, opid pbm.OPID, l *log.Event) (err er
 		return err
 	}
 
-	snapshotChunk := pbm.OplogChunk{
-		RS:          r.nodeInfo.SetName,
-		FName:       oplog,
-		Compression: bcp.Compression,
-		StartTS:     bcp.FirstWriteTS,
-		EndTS:       bcp.LastWriteTS,
-	}
-
-	oplogOption := applyOplogOption{end: &cmd.OplogTS, nss: nss}
 	if r.nodeInfo.IsConfigSrv() && sel.IsSelective(nss) {
 		oplogOption.nss = []string{"config.databases"}
 		oplogOption.filter = newConfigsvrOpFilter(nss)
 	}
 
-	err = r.applyOplog(append([]pbm.OplogChunk{snapshotChunk}, chunks...), &oplogOption)
+	err = r.applyOplog(chunks, &oplogOption)
 	if err != nil {
 		return err
 	}
@@ -322,9 +453,12 @@ func (r *Restore) PITR(cmd *pbm.RestoreCmd, opid pbm.OPID, l *log.Event) (err er
 func (r *Restore) ReplayOplog(cmd *pbm.ReplayCmd, opid pbm.OPID, l *log.Event) (err error) {
 	defer func() { r.exit(err, l) }()
 
-	if err = r.init(cmd.Name, opid, l); err != nil {
+	if err = r.init(cmd.Name, opid, cmd.Rerun, l); err != nil {
 		return errors.Wrap(err, "init")
 	}
+	r.auditStart(pbm.RestoreAudit{From: cmd.Start, To: cmd.End, User: cmd.User})
+	r.fanIn = cmd.FanIn
+	r.allowGaps = cmd.AllowGaps
 
 	if !r.nodeInfo.IsPrimary {
 		return errors.Errorf("%q is not primary", r.nodeInfo.SetName)
@@ -352,14 +486,44 @@ func (r *Restore) ReplayOplog(cmd *pbm.ReplayCmd, opid pbm.OPID, l *log.Event) (
 		return errors.WithMessage(err, "topology")
 	}
 
-	if !Contains(oplogShards, pbm.MakeReverseRSMapFunc(r.rsMap)(r.nodeInfo.SetName)) {
+	r.txnShards = mapRSNames(r.rsMap, oplogShards)
+
+	if cmd.End.IsZero() {
+		cmd.End, err = r.replayEnd(oplogShards)
+		if err != nil {
+			return errors.Wrap(err, "resolve the replay end")
+		}
+		l.Info("replaying up to the latest recoverable time %d.%d", cmd.End.T, cmd.End.I)
+		r.audit.To = cmd.End
+	}
+
+	sources := pbm.RSMapSources(r.rsMap, oplogShards, r.nodeInfo.SetName)
+	if len(sources) == 0 {
 		return r.Done() // skip. no oplog for current rs
 	}
 
-	opChunks, err := r.chunks(cmd.Start, cmd.End)
+	var opChunks oplogChunks
+	if len(sources) > 1 {
+		opChunks, err = r.fanInChunks(sources, cmd.Start, cmd.End)
+	} else {
+		opChunks, err = r.chunks(cmd.Start, cmd.End)
+	}
 	if err != nil {
 		return err
 	}
+	if !cmd.Force {
+		// PBM's own writes and noops are always ahead of the start,
+		// so only writes of the user data are of concern. The resumed
+		// run's writes are of the replay itself.
+		after := replayGuardStart(cmd.Start, r.resumedWrites)
+		lw, err := pbm.UserWriteAfter(r.node.Session(), after)
+		if err != nil && !errors.Is(err, pbm.ErrNotFound) {
+			return errors.Wrap(err, "get node last write")
+		}
+		if err = checkReplayStart(lw, after); err != nil {
+			return err
+		}
+	}
 
 	err = r.toState(pbm.StatusRunning, &pbm.WaitActionStart)
 	if err != nil {
@@ -370,15 +534,120 @@ func (r *Restore) ReplayOplog(cmd *pbm.ReplayCmd, opid pbm.OPID, l *log.Event) (
 		start:  &cmd.Start,
 		end:    &cmd.End,
 		unsafe: true,
+		// the replay has no snapshot, so the data of the previous run
+		// is still there and the replay can continue from its checkpoint
+		resume: r.resume,
+		// collections might be created on the cluster independently
+		// from the one the oplog was made on
+		remapUUID: true,
 	}
 	if err = r.applyOplog(opChunks, &oplogOption); err != nil {
 		return err
 	}
 
+	if !r.conf.InlineIndexBuild {
+		err = r.restoreIndexes(nil)
+		if err != nil {
+			return errors.WithMessage(err, "restore indexes")
+		}
+	}
+
 	return r.Done()
 }
 
-func (r *Restore) init(name string, opid pbm.OPID, l *log.Event) error {
+// replayEnd resolves the end of the open-ended replay. The leader takes
+// the latest time the oplog of all `rss` is recoverable up to and
+// publishes it, other nodes wait for it. So all replsets replay up to
+// the same point.
+func (r *Restore) replayEnd(rss []string) (primitive.Timestamp, error) {
+	if r.nodeInfo.IsLeader() {
+		end, err := r.cn.PITRLatestTS(rss)
+		if err != nil {
+			return end, err
+		}
+		return end, errors.Wrap(r.cn.SetRestoreOplogEnd(r.name, end), "set the replay end")
+	}
+
+	var end primitive.Timestamp
+	timeout := pbm.WaitActionStart
+	err := pollStatus(r.ctx, r.clock, time.Second, &timeout, func() (bool, error) {
+		meta, err := r.meta.Get()
+		if errors.Is(err, pbm.ErrNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.Wrap(err, "get restore metadata")
+		}
+		if err := checkAborted(meta); err != nil {
+			return false, err
+		}
+		end = meta.OplogEnd
+		return !end.IsZero(), nil
+	}, func() error {
+		return errors.Errorf("no replay end from the leader after %v", timeout)
+	})
+
+	return end, err
+}
+
+// replayGuardStart returns the timestamp the node's user writes are checked
+// against before the replay: the replay start or, when the replay resumes,
+// the end of the previous run's writes (see resumedWrites) if it's later
+func replayGuardStart(start, resumed primitive.Timestamp) primitive.Timestamp {
+	if resumed.After(start) {
+		return resumed
+	}
+
+	return start
+}
+
+// checkReplayStart ensures the node's user write (see pbm.UserWriteAfter)
+// isn't ahead of the replay start. Otherwise, ops between the start and the
+// write would be applied on top of the data that may already contain
+// them. Zero lastWrite means there are no user writes.
+func checkReplayStart(lastWrite, start primitive.Timestamp) error {
+	if lastWrite.After(start) {
+		return errors.Errorf("node's last user write %v is past the replay start %v. "+
+			"Use --force to replay anyway", lastWrite, start)
+	}
+
+	return nil
+}
+
+// ErrRestoreDone means the restore with the same name is already done
+var ErrRestoreDone = errors.New("restore is already done")
+
+// checkRerun returns ErrRestoreDone if prev is a completed run of the
+// restore and it's not the rerun (e.g. the same command delivered again).
+func checkRerun(prev *pbm.RestoreMeta, rerun bool) error {
+	if prev == nil || prev.Status != pbm.StatusDone || rerun {
+		return nil
+	}
+
+	return errors.Wrapf(ErrRestoreDone, "%q finished at %s (opid %s). Use --rerun to run it again",
+		prev.Name, time.Unix(prev.LastTransitionTS, 0).UTC().Format(time.RFC3339), prev.OPID)
+}
+
+// prevRun returns the previous run of the restore `name`. The leader may
+// have already replaced it with the current run `opid`, then it's found
+// by PrevOPID. It returns pbm.ErrNotFound if there is no previous run.
+func prevRun(cn *pbm.PBM, name, opid string) (*pbm.RestoreMeta, error) {
+	meta, err := cn.GetRestoreMeta(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "get restore meta")
+	}
+	if meta.OPID != opid {
+		return meta, nil
+	}
+	if meta.PrevOPID == "" {
+		return nil, pbm.ErrNotFound
+	}
+
+	prev, err := cn.GetRestoreMetaByOPID(meta.PrevOPID)
+	return prev, errors.Wrap(err, "get previous restore meta")
+}
+
+func (r *Restore) init(name string, opid pbm.OPID, rerun bool, l *log.Event) error {
 	r.log = l
 
 	var err error
@@ -392,7 +661,35 @@ func (r *Restore) init(name string, opid pbm.OPID, l *log.Event) error {
 
 	r.name = name
 	r.opid = opid.String()
+	// the name may refer to the previous run until the leader replaces it
+	r.meta = newRunMetaCache(r.cn, r.name, r.opid, restoreMetaTTL)
+	r.ctx, r.span = startSpan(withOPID(r.cn.Context(), r.opid), "restore",
+		attrRS.String(r.nodeInfo.SetName),
+		attribute.String("pbm.restore.name", r.name))
+
+	// guard against applying the same restore (e.g. the oplog) twice
+	prev, err := prevRun(r.cn, r.name, r.opid)
+	if err != nil && !errors.Is(err, pbm.ErrNotFound) {
+		return err
+	}
+	if err = checkRerun(prev, rerun); err != nil {
+		return err
+	}
+	r.resume = replayCheckpoint(prev, r.nodeInfo.SetName)
+	r.resumedWrites = resumedWrites(prev, r.nodeInfo.SetName)
+
 	if r.nodeInfo.IsLeader() {
+		// keep the previous run, so the name refers to the current one.
+		// Other nodes find it by PrevOPID then
+		if prev != nil {
+			l.Warning("restore %q was already run (opid %s, status %s), running it again. "+
+				"The previous run is kept as %q", r.name, prev.OPID, prev.Status,
+				pbm.ArchivedRestoreName(r.name, prev.OPID))
+			if err = r.cn.ArchiveRestoreMeta(r.name, prev.OPID); err != nil {
+				return errors.Wrap(err, "archive previous restore meta")
+			}
+		}
+
 		ts, err := r.cn.ClusterTime()
 		if err != nil {
 			return errors.Wrap(err, "init restore meta, read cluster time")
@@ -406,6 +703,10 @@ func (r *Restore) init(name string, opid pbm.OPID, l *log.Event) error {
 			Status:   pbm.StatusStarting,
 			Replsets: []pbm.RestoreReplset{},
 			Hb:       ts,
+			RSMap:    r.rsMap,
+		}
+		if prev != nil {
+			meta.PrevOPID = prev.OPID
 		}
 		err = r.cn.SetRestoreMeta(meta)
 		if err != nil {
@@ -438,62 +739,120 @@ func (r *Restore) init(name string, opid pbm.OPID, l *log.Event) error {
 		return errors.Wrap(err, "waiting for start")
 	}
 
-	rsMeta := pbm.RestoreReplset{
-		Name:       r.nodeInfo.SetName,
-		StartTS:    time.Now().UTC().Unix(),
-		Status:     pbm.StatusStarting,
-		Conditions: pbm.Conditions{},
+	err = r.cn.AddRestoreRSMeta(r.name, r.rsMeta(time.Now().UTC().Unix()))
+	if err != nil {
+		return errors.Wrap(err, "add shard's metadata")
 	}
+	r.statusChanged(pbm.StatusStarting)
 
-	err = r.cn.AddRestoreRSMeta(r.name, rsMeta)
+	cfg, err := r.config()
 	if err != nil {
-		return errors.Wrap(err, "add shard's metadata")
+		return err
 	}
 
-	r.stg, err = r.cn.GetStorage(r.log)
+	r.stg, err = pbm.Storage(cfg, r.log)
 	if err != nil {
 		return errors.Wrap(err, "get backup storage")
 	}
+	r.timeouts = cfg.Restore.StatusTimeouts()
+	r.conf = cfg.Restore
+	if r.indexBuildConcurrency > 0 {
+		r.conf.IndexBuildConcurrency = r.indexBuildConcurrency
+	}
 
 	return nil
 }
 
-func (r *Restore) checkTopologyForOplog(currShards []pbm.Shard, oplogShards []string) error {
-	mapRS, mapRevRS := pbm.MakeRSMapFunc(r.rsMap), pbm.MakeReverseRSMapFunc(r.rsMap)
-
-	shards := make(map[string]struct{}, len(currShards))
-	for i := range r.shards {
-		shards[r.shards[i].RS] = struct{}{}
+// rsMeta returns the initial restore meta of the node's replset
+func (r *Restore) rsMeta(startTS int64) pbm.RestoreReplset {
+	return pbm.RestoreReplset{
+		Name:       r.nodeInfo.SetName,
+		StartTS:    startTS,
+		Status:     pbm.StatusStarting,
+		Conditions: pbm.Conditions{},
+		Node:       r.nodeInfo.Me,
 	}
+}
 
-	var missed []string
-	for _, rs := range oplogShards {
-		name := mapRS(rs)
-		if _, ok := shards[name]; !ok {
-			missed = append(missed, name)
-		} else if mapRevRS(name) != rs {
-			missed = append(missed, name)
-		}
+func (r *Restore) checkTopologyForOplog(currShards []pbm.Shard, oplogShards []string) error {
+	shards := make([]string, len(currShards))
+	for i := range currShards {
+		shards[i] = currShards[i].RS
 	}
 
-	if len(missed) != 0 {
-		return errors.Errorf("missed replset %s", strings.Join(missed, ", "))
+	if r.fanIn {
+		return pbm.ValidateRSMapFanIn(r.rsMap, oplogShards, shards)
 	}
-
-	return nil
+	return pbm.ValidateRSMap(r.rsMap, oplogShards, shards)
 }
 
 // chunks defines chunks of oplog slice in given range, ensures its integrity (timeline
 // is contiguous - there are no gaps), checks for respective files on storage and returns
 // chunks list if all checks passed
-func (r *Restore) chunks(from, to primitive.Timestamp) ([]pbm.OplogChunk, error) {
-	return chunks(r.cn, r.stg, from, to, r.nodeInfo.SetName, r.rsMap)
+func (r *Restore) chunks(from, to primitive.Timestamp) (oplogChunks, error) {
+	c, gaps, err := chunks(r.ctx, r.chunksIndex(), r.stg, from, to,
+		r.nodeInfo.SetName, r.rsMap, r.conf.ChunksWarnAt(), r.allowGaps, r.log)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.addSkippedGaps(gaps); err != nil {
+		return nil, err
+	}
+
+	r.log.Debug("oplog chunks: %s", c.summary())
+	return c, nil
+}
+
+// addSkippedGaps records oplog gaps the restore goes past in the replset's meta
+func (r *Restore) addSkippedGaps(gaps []pbm.OplogGap) error {
+	if len(gaps) == 0 {
+		return nil
+	}
+
+	err := r.cn.RestoreAddRSSkippedGaps(r.name, r.nodeInfo.SetName, gaps)
+	return errors.Wrap(err, "record skipped oplog gaps")
+}
+
+// chunksIndex returns the index of the oplog chunks. The chunks on the
+// storage override aren't in the cluster's index, so they're listed
+// from the storage. The chunks missing in the cluster's index are
+// looked for on the storage as well.
+func (r *Restore) chunksIndex() chunksIndex {
+	if r.stgConf != nil {
+		return storageChunksIndex(r.stg)
+	}
+
+	return fallbackChunksIndex(dbChunksIndex(r.cn), r.stg, r.log)
+}
+
+// config returns the PBM config with the storage override applied
+func (r *Restore) config() (pbm.Config, error) {
+	cfg, err := r.cn.GetConfig()
+	if err != nil {
+		return pbm.Config{}, errors.Wrap(err, "get config")
+	}
+	if r.stgConf != nil {
+		cfg.Storage = *r.stgConf
+	}
+
+	return cfg, nil
+}
+
+// snapshotMeta returns the backup metadata. With the storage override,
+// it's read from that storage as the backup may be unknown to the cluster.
+func (r *Restore) snapshotMeta(name string) (*pbm.BackupMeta, error) {
+	if r.stgConf == nil {
+		return SnapshotMeta(r.cn, name, r.stg)
+	}
+
+	bcp, err := GetMetaFromStore(r.ctx, r.stg, name)
+	return bcp, errors.Wrap(err, "get backup metadata from the storage override")
 }
 
 func SnapshotMeta(cn *pbm.PBM, backupName string, stg storage.Storage) (*pbm.BackupMeta, error) {
 	bcp, err := cn.GetBackupMeta(backupName)
 	if errors.Is(err, pbm.ErrNotFound) {
-		bcp, err = GetMetaFromStore(stg, backupName)
+		bcp, err = GetMetaFromStore(cn.Context(), stg, backupName)
 	}
 	if err != nil {
 		return nil, errors.Wrap(err, "get backup metadata")
@@ -516,6 +875,20 @@ func (r *Restore) setShards(bcp *pbm.BackupMeta) error {
 		fl[rs.RS] = rs
 	}
 
+	if r.nodeInfo.IsLeader() {
+		bcpRS := make([]string, len(bcp.Replsets))
+		for i := range bcp.Replsets {
+			bcpRS[i] = bcp.Replsets[i].Name
+		}
+		clusterRS := make([]string, len(s))
+		for i := range s {
+			clusterRS[i] = s[i].RS
+		}
+		if err := pbm.ValidateRSMap(r.rsMap, bcpRS, clusterRS); err != nil {
+			return err
+		}
+	}
+
 	mapRS, mapRevRS := pbm.MakeRSMapFunc(r.rsMap), pbm.MakeReverseRSMapFunc(r.rsMap)
 
 	var nors []string
@@ -537,6 +910,105 @@ func (r *Restore) setShards(bcp *pbm.BackupMeta) error {
 		return errors.Errorf("extra/unknown replica set found in the backup: %s", strings.Join(nors, ", "))
 	}
 
+	if len(r.targets) > 0 {
+		var unknown []string
+		r.shards, unknown = filterShards(r.shards, r.targets)
+		if len(unknown) > 0 {
+			return errors.Errorf("target replica set not found in the backup: %s", strings.Join(unknown, ", "))
+		}
+	}
+
+	r.txnShards = make([]string, 0, len(r.shards))
+	for _, s := range r.shards {
+		r.txnShards = append(r.txnShards, s.RS)
+	}
+
+	return nil
+}
+
+// stopBeforeOp returns the op the point-in-time restore stops right before.
+// Nil if the restore replays all ops up to its point-in-time.
+func stopBeforeOp(cmd *pbm.RestoreCmd) *oplog.StopBefore {
+	if !cmd.OplogStopBefore {
+		return nil
+	}
+
+	return &oplog.StopBefore{TS: cmd.OplogTS, Hash: cmd.OplogStopHash}
+}
+
+// mapRSNames returns unique names of the replsets mapped by rsMap
+func mapRSNames(rsMap map[string]string, rss []string) []string {
+	mapRS := pbm.MakeRSMapFunc(rsMap)
+
+	seen := make(map[string]bool, len(rss))
+	names := make([]string, 0, len(rss))
+	for _, rs := range rss {
+		name := mapRS(rs)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// filterShards returns only shards listed in targets and the targets
+// that weren't found among the shards
+//
+//nolint:nonamedreturns
+func filterShards(shards []pbm.Shard, targets []string) (filtered []pbm.Shard, unknown []string) {
+	for _, t := range targets {
+		found := false
+		for _, s := range shards {
+			if s.RS == t {
+				filtered = append(filtered, s)
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, t)
+		}
+	}
+
+	return filtered, unknown
+}
+
+func (r *Restore) isTarget() bool {
+	return len(r.targets) == 0 || Contains(r.targets, r.nodeInfo.SetName)
+}
+
+// skip marks the replset as skipped since it isn't among the restore targets.
+// If the node is the leader, it still has to drive the target replsets
+// through the restore states.
+func (r *Restore) skip() error {
+	r.log.Info("replset is not among the restore targets, skipping")
+
+	err := r.cn.ChangeRestoreRSState(r.name, r.nodeInfo.SetName, pbm.StatusSkipped, "")
+	if err != nil {
+		return errors.Wrap(err, "set shard's StatusSkipped")
+	}
+
+	if !r.nodeInfo.IsLeader() {
+		return nil
+	}
+
+	steps := []struct {
+		status pbm.Status
+		wait   *time.Duration
+	}{
+		{pbm.StatusRunning, &pbm.WaitActionStart},
+		{pbm.StatusDumpDone, nil},
+		{pbm.StatusDone, nil},
+	}
+	for _, s := range steps {
+		err = r.reconcileStatus(s.status, statusTimeout(r.timeouts, s.status, s.wait))
+		if err != nil {
+			return errors.Wrapf(err, "check cluster for the restore %s", s.status)
+		}
+	}
+
 	return nil
 }
 
@@ -577,6 +1049,18 @@ func (r *Restore) snapshotObjects(bcp *pbm.BackupMeta) (dump, oplog string, err
 	return dump, oplog, nil
 }
 
+// oplogChecksum returns the checksum of the backup's oplog of the replset
+func (r *Restore) oplogChecksum(bcp *pbm.BackupMeta) string {
+	mapRS := pbm.MakeRSMapFunc(r.rsMap)
+	for _, v := range bcp.Replsets {
+		if mapRS(v.Name) == r.nodeInfo.SetName {
+			return v.OplogChecksum
+		}
+	}
+
+	return ""
+}
+
 func (r *Restore) checkSnapshot(bcp *pbm.BackupMeta) error {
 	if bcp.Status != pbm.StatusDone {
 		return errors.Errorf("backup wasn't successful: status: %s, error: %s",
@@ -584,7 +1068,7 @@ func (r *Restore) checkSnapshot(bcp *pbm.BackupMeta) error {
 	}
 
 	if !version.CompatibleWith(version.Current().Version, pbm.BreakingChangesMap[bcp.Type]) {
-		return errors.Errorf("backup PBM v%s is incompatible with the running PBM v%s",
+		return errors.Wrapf(ErrIncompatibleVersion, "backup PBM v%s is incompatible with the running PBM v%s",
 			bcp.PBMVersion, version.Current().Version)
 	}
 
@@ -618,81 +1102,41 @@ func (r *Restore) checkSnapshot(bcp *pbm.BackupMeta) error {
 
 func (r *Restore) toState(status pbm.Status, wait *time.Duration) error {
 	r.log.Info("moving to state %s", status)
-	return toState(r.cn, status, r.name, r.nodeInfo, r.reconcileStatus, wait)
-}
+	err := toState(r.ctx, r.clock, r.cn, status, r.name, r.nodeInfo, r.reconcileStatus, wait, r.timeouts, r.meta)
+	if err != nil {
+		return err
+	}
 
-func (r *Restore) RunSnapshot(dump string, bcp *pbm.BackupMeta, nss []string) error {
-	var rdr io.ReadCloser
+	r.statusChanged(status)
+	return nil
+}
 
-	var err error
-	if version.IsLegacyArchive(bcp.PBMVersion) {
-		sr, err := r.stg.SourceReader(dump)
-		if err != nil {
-			return errors.Wrapf(err, "get object %s for the storage", dump)
-		}
-		defer sr.Close()
+func (r *Restore) statusChanged(status pbm.Status) {
+	r.events.Publish(StatusChanged{RS: r.nodeInfo.SetName, From: r.status, To: status})
+	r.status = status
+}
 
-		rdr, err = compress.Decompress(sr, bcp.Compression)
-		if err != nil {
-			return errors.Wrapf(err, "decompress object %s", dump)
-		}
-	} else {
+func (r *Restore) RunSnapshot(dump string, bcp *pbm.BackupMeta, nss []string) error {
+	if !version.IsLegacyArchive(bcp.PBMVersion) {
 		if !sel.IsSelective(nss) {
 			nss = bcp.Namespaces
 		}
-		if !sel.IsSelective(nss) {
-			nss = []string{"*.*"}
-		}
-
-		mapRS := pbm.MakeReverseRSMapFunc(r.rsMap)
 		if r.nodeInfo.IsConfigSrv() && sel.IsSelective(nss) {
 			// restore cluster specific configs only
-			return r.configsvrRestore(bcp, nss, mapRS)
-		}
-
-		var cfg pbm.Config
-		// get pbm.Config for creating a storage.Storage later.
-		// while r.stg is already created storage for the restore,
-		// it triggers data race warnings during concurrent file downloading/reading.
-		// for that, it's better to create a new storage for each file
-		cfg, err = r.cn.GetConfig()
-		if err != nil {
-			return errors.WithMessage(err, "get config")
+			return r.configsvrRestore(bcp, nss, pbm.MakeReverseRSMapFunc(r.rsMap))
 		}
+	}
 
-		rdr, err = snapshot.DownloadDump(
-			func(ns string) (io.ReadCloser, error) {
-				stg, err := pbm.Storage(cfg, r.log)
-				if err != nil {
-					return nil, errors.WithMessage(err, "get storage")
-				}
-				// while importing backup made by RS with another name
-				// that current RS we can't use our r.node.RS() to point files
-				// we have to use mapping passed by --replset-mapping option
-				rdr, err := stg.SourceReader(path.Join(bcp.Name, mapRS(r.node.RS()), ns))
-				if err != nil {
-					return nil, err
-				}
-
-				if ns == archive.MetaFile {
-					data, err := io.ReadAll(rdr)
-					if err != nil {
-						return nil, err
-					}
-
-					err = r.loadIndexesFrom(bytes.NewReader(data))
-					if err != nil {
-						return nil, errors.WithMessage(err, "load indexes")
-					}
-
-					rdr = io.NopCloser(bytes.NewReader(data))
-				}
-
-				return rdr, nil
-			},
-			bcp.Compression,
-			sel.MakeSelectedPred(nss))
+	cfg, err := r.config()
+	if err != nil {
+		return err
 	}
+
+	// while importing backup made by RS with another name
+	// that current RS we can't use our r.node.RS() to point files
+	// we have to use mapping passed by --replset-mapping option
+	rs := pbm.MakeReverseRSMapFunc(r.rsMap)(r.node.RS())
+	rdr, err := downloadDump(cfg, bcp, rs, dump, nss, r.loadIndexesFrom, r.log)
 	if err != nil {
 		return err
 	}
@@ -708,26 +1152,105 @@ func (r *Restore) RunSnapshot(dump string, bcp *pbm.BackupMeta, nss []string) er
 		return nil
 	}
 
-	r.log.Info("restoring users and roles")
-	cusr, err := r.node.CurrentUser()
+	return restoreUsers(r.cn.Context(), r.node, r.log)
+}
+
+// downloadDump returns the dump of the replset `rs` of the backup. The
+// archive metadata is passed to loadIndexes on the way.
+func downloadDump(
+	cfg pbm.Config,
+	bcp *pbm.BackupMeta,
+	rs,
+	dump string,
+	nss []string,
+	loadIndexes func(io.Reader) error,
+	l *log.Event,
+) (io.ReadCloser, error) {
+	limit := sharedDownloadLimit(cfg.Restore.DownloadBytesPerSec)
+	if version.IsLegacyArchive(bcp.PBMVersion) {
+		stg, err := pbm.Storage(cfg, l)
+		if err != nil {
+			return nil, errors.WithMessage(err, "get storage")
+		}
+		sr, err := storage.NewThrottled(stg, limit).SourceReader(dump)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get object %s for the storage", dump)
+		}
+
+		rdr, err := compress.Decompress(sr, bcp.Compression)
+		if err != nil {
+			sr.Close()
+			return nil, errors.Wrapf(err, "decompress object %s", dump)
+		}
+		return &decompressedChunk{ReadCloser: rdr, chunk: sr}, nil
+	}
+
+	if !sel.IsSelective(nss) {
+		nss = []string{"*.*"}
+	}
+
+	return snapshot.DownloadDump(
+		func(ns string) (io.ReadCloser, error) {
+			// a storage created for the restore triggers data race
+			// warnings during concurrent file downloading/reading.
+			// for that, it's better to create a new storage for each file
+			stg, err := pbm.Storage(cfg, l)
+			if err != nil {
+				return nil, errors.WithMessage(err, "get storage")
+			}
+			rdr, err := storage.NewThrottled(stg, limit).SourceReader(path.Join(bcp.Name, rs, ns))
+			if err != nil {
+				return nil, err
+			}
+
+			if ns == archive.MetaFile {
+				data, err := io.ReadAll(rdr)
+				if err != nil {
+					return nil, err
+				}
+
+				err = loadIndexes(bytes.NewReader(data))
+				if err != nil {
+					return nil, errors.WithMessage(err, "load indexes")
+				}
+
+				rdr = io.NopCloser(bytes.NewReader(data))
+			}
+
+			return rdr, nil
+		},
+		bcp.Compression,
+		sel.MakeSelectedPred(nss),
+		cfg.Restore.NumParallelCollections)
+}
+
+// restoreUsers replaces users and roles with the restored ones, see swapUsers
+func restoreUsers(ctx context.Context, node *pbm.Node, l *log.Event) error {
+	l.Info("restoring users and roles")
+	cusr, err := node.CurrentUser()
 	if err != nil {
 		return errors.Wrap(err, "get current user")
 	}
 
-	err = r.swapUsers(r.cn.Context(), cusr)
+	err = swapUsers(ctx, node.Session(), cusr)
 	if err != nil {
 		return errors.Wrap(err, "swap users 'n' roles")
 	}
 
-	err = pbm.DropTMPcoll(r.cn.Context(), r.node.Session())
+	err = pbm.DropTMPcoll(ctx, node.Session())
 	if err != nil {
-		r.log.Warning("drop tmp collections: %v", err)
+		l.Warning("drop tmp collections: %v", err)
 	}
 
 	return nil
 }
 
 func (r *Restore) loadIndexesFrom(rdr io.Reader) error {
+	return loadIndexes(r.indexCatalog, rdr)
+}
+
+// loadIndexes adds indexes from the archive metadata to the catalog
+func loadIndexes(ic *idx.IndexCatalog, rdr io.Reader) error {
 	meta, err := archive.ReadMetadata(rdr)
 	if err != nil {
 		return errors.WithMessage(err, "read metadata")
@@ -741,7 +1264,7 @@ func (r *Restore) loadIndexesFrom(rdr io.Reader) error {
 				ns.Database, ns.Collection)
 		}
 
-		r.indexCatalog.AddIndexes(ns.Database, ns.Collection, md.Indexes)
+		ic.AddIndexes(ns.Database, ns.Collection, md.Indexes)
 
 		simple := true
 		if md.Options != nil {
@@ -754,7 +1277,7 @@ func (r *Restore) loadIndexesFrom(rdr io.Reader) error {
 			}
 		}
 		if simple {
-			r.indexCatalog.SetCollation(ns.Database, ns.Collection, simple)
+			ic.SetCollation(ns.Database, ns.Collection, simple)
 		}
 	}
 
@@ -764,50 +1287,37 @@ func (r *Restore) loadIndexesFrom(rdr io.Reader) error {
 func (r *Restore) restoreIndexes(nss []string) error {
 	r.log.Debug("building indexes up")
 
-	isSelected := sel.MakeSelectedPred(nss)
-	for _, ns := range r.indexCatalog.Namespaces() {
-		if ns := archive.NSify(ns.DB, ns.Collection); !isSelected(ns) {
-			r.log.Debug("skip restore indexes for %q", ns)
-			continue
-		}
+	b := r.indexBuilder(r.cn.Context(), nil)
+	defer r.reportIncompatibleIndexes(b)
 
-		indexes := r.indexCatalog.GetIndexes(ns.DB, ns.Collection)
-		for i, index := range indexes {
-			if len(index.Key) == 1 && index.Key[0].Key == "_id" {
-				// The _id index is already created with the collection
-				indexes = append(indexes[:i], indexes[i+1:]...)
-				break
-			}
-		}
-
-		if len(indexes) == 0 {
-			r.log.Debug("no indexes for %s.%s", ns.DB, ns.Collection)
-			continue
-		}
+	return buildIndexes(r.cn.Context(), r.indexCatalog, nss, r.conf.IndexBuildConcurrency, b, r.log)
+}
 
-		var indexNames []string
-		for _, index := range indexes {
-			index.Options["ns"] = ns.DB + "." + ns.Collection
-			indexNames = append(indexNames, index.Options["name"].(string))
-			// remove the index version, forcing an update
-			delete(index.Options, "v")
-		}
+// indexBuilder returns the builder of indexes on the node that
+// records indexes the server refuses to create
+func (r *Restore) indexBuilder(ctx context.Context, wc *writeconcern.WriteConcern) *oplog.IncompatibleIndexes {
+	b := oplog.NewMongoIndexBuilder(ctx, r.node.Session(), wc)
+	return oplog.NewIncompatibleIndexes(b, r.conf.SkipIncompatibleIndexes)
+}
 
-		rawCommand := bson.D{
-			{"createIndexes", ns.Collection},
-			{"indexes", indexes},
-			{"ignoreUnknownIndexOptions", true},
-		}
+func (r *Restore) reportIncompatibleIndexes(b *oplog.IncompatibleIndexes) {
+	indexes := b.List()
+	if len(indexes) == 0 {
+		return
+	}
 
-		r.log.Info("restoring indexes for %s.%s: %s",
-			ns.DB, ns.Collection, strings.Join(indexNames, ", "))
-		err := r.node.Session().Database(ns.DB).RunCommand(r.cn.Context(), rawCommand).Err()
-		if err != nil {
-			return errors.WithMessagef(err, "createIndexes for %s.%s", ns.DB, ns.Collection)
+	for _, i := range indexes {
+		if r.conf.SkipIncompatibleIndexes {
+			r.log.Warning("skipped incompatible index %q on %s: %s", i.Name, i.NS, i.Reason)
+		} else {
+			r.log.Error("incompatible index %q on %s: %s", i.Name, i.NS, i.Reason)
 		}
 	}
 
-	return nil
+	err := r.cn.RestoreAddRSIncompatibleIndexes(r.name, r.nodeInfo.SetName, indexes)
+	if err != nil {
+		r.log.Warning("failed to set incompatible indexes: %v", err)
+	}
 }
 
 func (r *Restore) updateRouterConfig(ctx context.Context) error {
@@ -934,32 +1444,34 @@ func updateChunksRouterTable(ctx context.Context, m *mongo.Client, sMap map[stri
 }
 
 func (r *Restore) setcommittedTxn(txn []pbm.RestoreTxn) error {
-	return r.cn.RestoreSetRSTxn(r.name, r.nodeInfo.SetName, txn)
+	return r.cn.RestoreSetRSTxn(r.name, r.nodeInfo.SetName, retainTxn(txn, r.conf.DistTxnRetention))
 }
 
+// getcommittedTxn waits until all shards of the restore have published
+// their committed txns (see setcommittedTxn) and returns them. So a shard
+// that finished the replay earlier doesn't miss commits of the others.
 func (r *Restore) getcommittedTxn() (map[string]primitive.Timestamp, error) {
-	txn := make(map[string]primitive.Timestamp)
-
-	shards := make(map[string]struct{})
-	for _, s := range r.shards {
-		shards[s.RS] = struct{}{}
-	}
+	b := newTxnBarrier(r.txnShards)
 
-	for len(shards) > 0 {
+	tout := time.Duration(r.conf.TxnSyncTimeoutSec) * time.Second
+	return b.wait(tout, txnSyncPoll, txnSyncPollMax, func() error {
 		bmeta, err := r.cn.GetRestoreMeta(r.name)
 		if err != nil {
-			return nil, errors.Wrap(err, "get restore metadata")
+			return errors.Wrap(err, "get restore metadata")
+		}
+		if err := checkAborted(bmeta); err != nil {
+			return err
 		}
 
 		clusterTime, err := r.cn.ClusterTime()
 		if err != nil {
-			return nil, errors.Wrap(err, "read cluster time")
+			return errors.Wrap(err, "read cluster time")
 		}
 
 		// not going directly thru bmeta.Replsets to be sure we've heard back
 		// from all participated in the restore shards.
 		for _, shard := range bmeta.Replsets {
-			if _, ok := shards[shard.Name]; !ok {
+			if _, ok := b.pending[shard.Name]; !ok {
 				continue
 			}
 			// check if node alive
@@ -973,43 +1485,124 @@ func (r *Restore) getcommittedTxn() (map[string]primitive.Timestamp, error) {
 			// so no lock is ok, and no need to check the heartbeats
 			if !errors.Is(err, mongo.ErrNoDocuments) {
 				if err != nil {
-					return nil, errors.Wrapf(err, "unable to read lock for shard %s", shard.Name)
+					return errors.Wrapf(err, "unable to read lock for shard %s", shard.Name)
 				}
 				if lock.Heartbeat.T+pbm.StaleFrameSec < clusterTime.T {
-					return nil, errors.Errorf("lost shard %s, last beat ts: %d", shard.Name, lock.Heartbeat.T)
+					return errors.Wrapf(ErrShardLost, "lost shard %s, last beat ts: %d",
+						shard.Name, lock.Heartbeat.T)
 				}
 			}
 
 			if shard.Status == pbm.StatusError {
-				return nil, errors.Errorf("shard %s failed with: %v", shard.Name, shard.Error)
+				return errors.Errorf("shard %s failed with: %v", shard.Name, shard.Error)
 			}
 
 			if shard.CommittedTxnSet {
-				for _, t := range shard.CommittedTxn {
-					if t.State == pbm.TxnCommit {
-						txn[t.ID] = t.Ctime
-					}
-				}
-				delete(shards, shard.Name)
+				b.publish(shard.Name, shard.CommittedTxn)
 			}
 		}
-		time.Sleep(time.Second * 1)
+		return nil
+	})
+}
+
+// checkFCV checks the oplog made with options.srcFCV can be replayed onto
+// the node. It's called before the snapshot restore, so the mismatch fails
+// the restore before any data is changed.
+func (r *Restore) checkFCV(options *applyOplogOption) error {
+	if options.srcFCV == "" {
+		return nil
+	}
+
+	fcv, err := r.node.GetFeatureCompatibilityVersion()
+	if err != nil {
+		return errors.Wrap(err, "get featureCompatibilityVersion")
 	}
+	options.dstFCV = fcv
 
-	return txn, nil
+	return checkOplogFCV(options.srcFCV, options.dstFCV)
 }
 
-func (r *Restore) applyOplog(chunks []pbm.OplogChunk, options *applyOplogOption) error {
+func (r *Restore) applyOplog(chunks oplogChunks, options *applyOplogOption) error {
 	mgoV, err := r.node.GetMongoVersion()
 	if err != nil || len(mgoV.Version) < 1 {
 		return errors.Wrap(err, "define mongo version")
 	}
+	if options.srcFCV != "" && options.dstFCV == "" {
+		options.dstFCV, err = r.node.GetFeatureCompatibilityVersion()
+		if err != nil {
+			return errors.Wrap(err, "get featureCompatibilityVersion")
+		}
+	}
+	if options.progress == nil {
+		interval := time.Duration(r.conf.ProgressFlushSec) * time.Second
+		f := newProgressFlusher(interval, r.writeProgress)
+		options.progress = func(p replayProgress) {
+			if err := f.observe(p); err != nil {
+				r.log.Warning("applyOplog: failed to set progress: %v", err)
+			}
+		}
+	}
+	if options.aborted == nil {
+		options.aborted = r.checkAborted
+	}
+	if options.events == nil {
+		options.events = r.events
+	}
+	if options.checkpoint == nil {
+		options.checkpoint = func(cp *pbm.ReplayCheckpoint) {
+			if err := r.cn.SetRestoreCheckpoint(r.name, r.nodeInfo.SetName, cp); err != nil {
+				r.log.Warning("applyOplog: failed to set checkpoint: %v", err)
+			}
+		}
+	}
+	err = options.setConf(&r.conf)
+	if err != nil {
+		return err
+	}
+	if options.indexBuilder == nil && r.conf.InlineIndexBuild {
+		b := r.indexBuilder(r.ctx, options.writeConcern)
+		defer r.reportIncompatibleIndexes(b)
+		options.indexBuilder = b
+	}
+	if r.conf.OplogSkipSystemNS && !r.nodeInfo.IsConfigSrv() {
+		options.skipSystemNS = true
+	}
+	if options.prefetch == 0 && r.conf.OplogPrefetch > 0 {
+		options.prefetch = r.conf.OplogPrefetch
+		size := int64(r.conf.OplogPrefetchBufferMb) << 20
+		if r.prefetchBudget == nil {
+			r.prefetchBudget = NewMemBudget(size)
+		} else {
+			r.prefetchBudget.Resize(size)
+		}
+		options.prefetchBudget = r.prefetchBudget
+	}
+
+	options.clock = r.clock
+
+	// a single chunk may take longer than pbm.StaleFrameSec to apply
+	ctx, guard := newRoleGuard(r.ctx, r.checkRole)
+	defer guard.stop()
+	stopWatch := guard.watch(r.clock, roleCheckInterval)
+	stopHB := startHeartbeat(r.clock, lockHBInterval, r.beatLock, r.log)
 	stat := pbm.RestoreShardStat{}
-	partial, err := applyOplog(r.node.Session(), chunks, options, r.nodeInfo.IsSharded(),
-		r.indexCatalog, r.setcommittedTxn, r.getcommittedTxn, &stat.Txn,
+	partial, err := applyOplog(ctx, r.node.Session(), chunks, options, r.nodeInfo.IsSharded(),
+		r.indexCatalog, r.setcommittedTxn, r.getcommittedTxn, &stat,
 		mgoV, r.stg, r.log)
+	stopHB()
+	stopWatch()
+	err = guard.wrap(err)
 	if err != nil {
-		return errors.Wrap(err, "reply oplog")
+		if stat.Chunks == 0 {
+			return errors.Wrap(err, "reply oplog")
+		}
+		// tells how far the replay got, a rerun continues
+		// from the checkpoint of the last replayed chunk
+		if serr := r.cn.RestoreSetRSStat(r.name, r.nodeInfo.SetName, stat); serr != nil {
+			r.log.Warning("applyOplog: failed to set stat: %v", serr)
+		}
+		return errors.Wrapf(err, "reply oplog (replayed %d of %d chunks up to %d.%d)",
+			stat.Chunks, chunks.summary().Count, stat.LastTS.T, stat.LastTS.I)
 	}
 
 	if len(partial) > 0 {
@@ -1024,6 +1617,7 @@ func (r *Restore) applyOplog(chunks []pbm.OplogChunk, options *applyOplogOption)
 		}
 	}
 
+	r.txnStat = &stat.Txn
 	err = r.cn.RestoreSetRSStat(r.name, r.nodeInfo.SetName, stat)
 	if err != nil {
 		r.log.Warning("applyOplog: failed to set stat: %v", err)
@@ -1032,6 +1626,38 @@ func (r *Restore) applyOplog(chunks []pbm.OplogChunk, options *applyOplogOption)
 	return nil
 }
 
+func (r *Restore) beatLock() error {
+	return r.cn.LockBeat(&pbm.LockHeader{
+		Replset: r.nodeInfo.SetName,
+		OPID:    r.opid,
+	})
+}
+
+// checkRole fails if the node is no longer the restore target, see
+// nodeRoleChanged. Failures to get the node info are only logged.
+func (r *Restore) checkRole() error {
+	inf, err := r.node.GetInfo()
+	if err != nil {
+		r.log.Warning("check node role: %v", err)
+		return nil
+	}
+
+	return nodeRoleChanged(r.nodeInfo, inf)
+}
+
+func (r *Restore) checkAborted() error {
+	meta, err := r.cn.GetRestoreMeta(r.name)
+	if err != nil {
+		return errors.Wrap(err, "get restore metadata")
+	}
+
+	return checkAborted(meta)
+}
+
+func (r *Restore) writeProgress(lts primitive.Timestamp, eta int64, p *pbm.RestoreProgress) error {
+	return r.cn.SetRestoreRSProgress(r.name, r.nodeInfo.SetName, lts, eta, p)
+}
+
 func (r *Restore) snapshot(input io.Reader) error {
 	cfg, err := r.cn.GetConfig()
 	if err != nil {
@@ -1054,6 +1680,7 @@ func (r *Restore) Done() error {
 	if err != nil {
 		return errors.Wrap(err, "set shard's StatusDone")
 	}
+	r.statusChanged(pbm.StatusDone)
 
 	if r.nodeInfo.IsLeader() {
 		err = r.reconcileStatus(pbm.StatusDone, nil)
@@ -1061,6 +1688,11 @@ func (r *Restore) Done() error {
 			return errors.Wrap(err, "check cluster for the restore done")
 		}
 
+		// all shards are past the txns sync
+		if err := r.cn.RestoreClearTxn(r.name); err != nil {
+			r.log.Warning("clear committed txns: %v", err)
+		}
+
 		m, err := r.cn.GetRestoreMeta(r.name)
 		if err != nil {
 			return errors.Wrap(err, "update stat: get restore meta")
@@ -1073,11 +1705,15 @@ func (r *Restore) Done() error {
 
 		for _, rs := range m.Replsets {
 			stat[rs.Name] = map[string]pbm.RestoreRSMetrics{
-				"_primary": {DistTxn: pbm.DistTxnStat{
-					Partial:          rs.Stat.Txn.Partial,
-					ShardUncommitted: rs.Stat.Txn.ShardUncommitted,
-					LeftUncommitted:  rs.Stat.Txn.LeftUncommitted,
-				}},
+				"_primary": {
+					DistTxn: pbm.DistTxnStat{
+						Partial:          rs.Stat.Txn.Partial,
+						ShardUncommitted: rs.Stat.Txn.ShardUncommitted,
+						LeftUncommitted:  rs.Stat.Txn.LeftUncommitted,
+						Split:            rs.Stat.Txn.Split,
+					},
+					Ops: rs.Stat.Ops,
+				},
 			}
 		}
 
@@ -1090,15 +1726,17 @@ func (r *Restore) Done() error {
 	return nil
 }
 
-func (r *Restore) swapUsers(ctx context.Context, exclude *pbm.AuthInfo) error {
-	rolesC := r.node.Session().Database("admin").Collection("system.roles")
+// swapUsers replaces users and roles with the restored ones from the
+// temporary collections except ones of the `exclude` user
+func swapUsers(ctx context.Context, m *mongo.Client, exclude *pbm.AuthInfo) error {
+	rolesC := m.Database("admin").Collection("system.roles")
 
 	eroles := []string{}
 	for _, r := range exclude.UserRoles {
 		eroles = append(eroles, r.DB+"."+r.Role)
 	}
 
-	curr, err := r.node.Session().Database(pbm.DB).Collection(pbm.TmpRolesCollection).
+	curr, err := m.Database(pbm.DB).Collection(pbm.TmpRolesCollection).
 		Find(ctx, bson.M{"_id": bson.M{"$nin": eroles}})
 	if err != nil {
 		return errors.Wrap(err, "create cursor for tmpRoles")
@@ -1126,14 +1764,14 @@ func (r *Restore) swapUsers(ctx context.Context, exclude *pbm.AuthInfo) error {
 	if len(exclude.Users) > 0 {
 		user = exclude.Users[0].DB + "." + exclude.Users[0].User
 	}
-	cur, err := r.node.Session().Database(pbm.DB).Collection(pbm.TmpUsersCollection).
+	cur, err := m.Database(pbm.DB).Collection(pbm.TmpUsersCollection).
 		Find(ctx, bson.M{"_id": bson.M{"$ne": user}})
 	if err != nil {
 		return errors.Wrap(err, "create cursor for tmpUsers")
 	}
 	defer cur.Close(ctx)
 
-	usersC := r.node.Session().Database("admin").Collection("system.users")
+	usersC := m.Database("admin").Collection("system.users")
 	_, err = usersC.DeleteMany(ctx, bson.M{"_id": bson.M{"$ne": user}})
 	if err != nil {
 		return errors.Wrap(err, "delete current users")
@@ -1156,20 +1794,28 @@ func (r *Restore) swapUsers(ctx context.Context, exclude *pbm.AuthInfo) error {
 
 func (r *Restore) reconcileStatus(status pbm.Status, timeout *time.Duration) error {
 	if timeout != nil {
-		err := convergeClusterWithTimeout(r.cn, r.name, r.opid, r.shards, status, *timeout)
+		err := convergeClusterWithTimeout(r.clock, r.cn, r.meta, r.opid, r.shards, status, *timeout,
+			newBeatsCheck(r.conf, r.clock, r.log))
 		return errors.Wrap(err, "convergeClusterWithTimeout")
 	}
-	err := convergeCluster(r.cn, r.name, r.opid, r.shards, status)
+	err := convergeCluster(r.clock, r.cn, r.meta, r.opid, r.shards, status, newBeatsCheck(r.conf, r.clock, r.log))
 	return errors.Wrap(err, "convergeCluster")
 }
 
 func (r *Restore) waitForStatus(status pbm.Status) error {
 	r.log.Debug("waiting for '%s' status", status)
-	return waitForStatus(r.cn, r.name, status)
+	if t := statusTimeout(r.timeouts, status, nil); t != nil {
+		return waitForStatusTimeout(r.clock, r.cn, r.meta, status, *t)
+	}
+	return waitForStatus(r.clock, r.cn, r.meta, status)
 }
 
 // MarkFailed sets the restore and rs state as failed with the given message
 func (r *Restore) MarkFailed(e error) error {
+	if !failsCluster(e, r.conf.DrainOnShardError(), r.nodeInfo.IsLeader()) {
+		return r.markShardFailed(e)
+	}
+
 	err := r.cn.ChangeRestoreState(r.name, pbm.StatusError, e.Error())
 	if err != nil {
 		return errors.Wrap(err, "set restore state")
@@ -1177,3 +1823,24 @@ func (r *Restore) MarkFailed(e error) error {
 	err = r.cn.ChangeRestoreRSState(r.name, r.nodeInfo.SetName, pbm.StatusError, e.Error())
 	return errors.Wrap(err, "set replset state")
 }
+
+// markShardFailed fails the replset only, so other shards go on (see
+// pbm.ShardErrorDrain). They fail the restore once drained. Unless all
+// shards have failed on their own, then there is no one left to do it.
+func (r *Restore) markShardFailed(e error) error {
+	err := r.cn.ChangeRestoreRSState(r.name, r.nodeInfo.SetName, pbm.StatusError, e.Error())
+	if err != nil {
+		return errors.Wrap(err, "set replset state")
+	}
+
+	meta, err := r.cn.GetRestoreMeta(r.name)
+	if err != nil {
+		return errors.Wrap(err, "get restore metadata")
+	}
+	if !allShardsFailed(meta.Replsets) {
+		return nil
+	}
+
+	err = r.cn.ChangeRestoreState(r.name, pbm.StatusError, e.Error())
+	return errors.Wrap(err, "set restore state")
+}
@@ -0,0 +1,181 @@
+package restore
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+)
+
+func TestGetMetaFromStoreSchema(t *testing.T) {
+	stg := memStorage{
+		// made before the schema versioning, no type as well
+		"old" + pbm.MetadataFileSuffix: []byte(`{"name":"old","status":"done"}`),
+		"new" + pbm.MetadataFileSuffix: []byte(`{"schema_version":1000,"name":"new","type":"logical"}`),
+	}
+
+	m, err := GetMetaFromStore(context.Background(), stg, "old")
+	if err != nil {
+		t.Fatalf("get old meta: %v", err)
+	}
+	if m.SchemaVersion != pbm.BackupMetaSchemaVersion {
+		t.Errorf("expected schema v%d, got v%d", pbm.BackupMetaSchemaVersion, m.SchemaVersion)
+	}
+	if m.Type != pbm.LogicalBackup {
+		t.Errorf("expected %s backup type, got %q", pbm.LogicalBackup, m.Type)
+	}
+
+	_, err = GetMetaFromStore(context.Background(), stg, "new")
+	if !errors.Is(err, pbm.ErrMetaSchemaTooNew) {
+		t.Errorf("expected too new schema error, got %v", err)
+	}
+}
+
+func TestRSMetaNode(t *testing.T) {
+	r := &Restore{nodeInfo: &pbm.NodeInfo{SetName: "rs0", Me: "rs0-1:27017"}}
+
+	m := r.rsMeta(100)
+	if m.Name != "rs0" || m.Status != pbm.StatusStarting || m.StartTS != 100 {
+		t.Errorf("unexpected replset meta %+v", m)
+	}
+	if m.Node != "rs0-1:27017" {
+		t.Errorf("expected the replset restored by rs0-1:27017, got %q", m.Node)
+	}
+
+	// the node stays in the meta of the done restore
+	b, err := bson.Marshal(pbm.RestoreMeta{Name: "r", Status: pbm.StatusDone, Replsets: []pbm.RestoreReplset{m}})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var done pbm.RestoreMeta
+	if err = bson.Unmarshal(b, &done); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if len(done.Replsets) != 1 || done.Replsets[0].Node != "rs0-1:27017" {
+		t.Errorf("expected the node in the restore meta, got %+v", done.Replsets)
+	}
+}
+
+// hangStorage serves the first `serve` bytes of files and then hangs
+// reads until the reader is closed. With hangOpen, it hangs opening
+// files until the test ends.
+type hangStorage struct {
+	memStorage
+	serve    int
+	hangOpen chan struct{}
+
+	mx     sync.Mutex
+	closed int
+}
+
+func (s *hangStorage) SourceReader(name string) (io.ReadCloser, error) {
+	if s.hangOpen != nil {
+		<-s.hangOpen
+	}
+	r, err := s.memStorage.SourceReader(name)
+	if err != nil {
+		return nil, err
+	}
+	return &hangReader{r: io.LimitReader(r, int64(s.serve)), s: s, done: make(chan struct{})}, nil
+}
+
+type hangReader struct {
+	r    io.Reader
+	s    *hangStorage
+	done chan struct{}
+	once sync.Once
+}
+
+func (h *hangReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	if errors.Is(err, io.EOF) {
+		<-h.done
+		return n, errors.New("closed")
+	}
+	return n, err
+}
+
+func (h *hangReader) Close() error {
+	h.once.Do(func() {
+		close(h.done)
+		h.s.mx.Lock()
+		h.s.closed++
+		h.s.mx.Unlock()
+	})
+	return nil
+}
+
+func (s *hangStorage) closedReaders() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.closed
+}
+
+func TestStorageReadDeadline(t *testing.T) {
+	data := noopChunk(t, 1, 2, 3)
+	meta := []byte(`{"name":"bcp","type":"logical","status":"done"}`)
+
+	t.Run("meta", func(t *testing.T) {
+		stg := &hangStorage{memStorage: memStorage{"bcp" + pbm.MetadataFileSuffix: meta}, serve: 10}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := GetMetaFromStore(ctx, stg, "bcp")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline error, got %v", err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("read is cancelled after %v", d)
+		}
+		if stg.closedReaders() != 1 {
+			t.Errorf("expected the reader to be closed")
+		}
+	})
+
+	t.Run("meta open", func(t *testing.T) {
+		hang := make(chan struct{})
+		defer close(hang)
+		stg := &hangStorage{memStorage: memStorage{"bcp" + pbm.MetadataFileSuffix: meta}, hangOpen: hang}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := GetMetaFromStore(ctx, stg, "bcp")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline error, got %v", err)
+		}
+	})
+
+	t.Run("chunk", func(t *testing.T) {
+		stg := &hangStorage{memStorage: memStorage{"c1": data}, serve: len(data) / 2}
+		chunks := []pbm.OplogChunk{{
+			RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone,
+			StartTS: primitive.Timestamp{T: 1, I: 1}, EndTS: primitive.Timestamp{T: 3, I: 1},
+		}}
+		l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := applyOplog(ctx, nil, chunkList(chunks), &applyOplogOption{}, false,
+			nil, nil, nil, &pbm.RestoreShardStat{}, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline error, got %v", err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("replay is cancelled after %v", d)
+		}
+		if stg.closedReaders() != 1 {
+			t.Errorf("expected the chunk reader to be closed")
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package restore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// restoreMetaTTL is how long the restore meta is served from the cache.
+// It's well below the stale frame, so heartbeat checks stay accurate.
+const restoreMetaTTL = 2 * time.Second
+
+// metaCache coalesces reads of the restore meta done by the convergence
+// and status waiting loops of the node. Errors aren't cached.
+// The returned meta is shared and must not be modified.
+type metaCache struct {
+	name string
+	ttl  time.Duration
+	get  func() (*pbm.RestoreMeta, error)
+	now  func() time.Time
+
+	mu   sync.Mutex
+	meta *pbm.RestoreMeta
+	at   time.Time
+}
+
+// newMetaCache creates the cache of the restore `name` meta.
+// Zero ttl means reading the meta on every call.
+func newMetaCache(cn *pbm.PBM, name string, ttl time.Duration) *metaCache {
+	return &metaCache{
+		name: name,
+		ttl:  ttl,
+		get:  func() (*pbm.RestoreMeta, error) { return cn.GetRestoreMeta(name) },
+		now:  time.Now,
+	}
+}
+
+// newRunMetaCache is newMetaCache of the run `opid` of the restore. Until
+// the leader replaces the previous run of the restore with this one, the
+// meta is not found.
+func newRunMetaCache(cn *pbm.PBM, name, opid string, ttl time.Duration) *metaCache {
+	c := newMetaCache(cn, name, ttl)
+	c.get = runMeta(c.get, opid)
+	return c
+}
+
+func runMeta(get func() (*pbm.RestoreMeta, error), opid string) func() (*pbm.RestoreMeta, error) {
+	return func() (*pbm.RestoreMeta, error) {
+		meta, err := get()
+		if err == nil && meta.OPID != opid {
+			return nil, pbm.ErrNotFound
+		}
+		return meta, err
+	}
+}
+
+// Get returns the cached meta if it's not older than ttl
+// or reads it otherwise
+func (c *metaCache) Get() (*pbm.RestoreMeta, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.meta != nil && c.now().Sub(c.at) < c.ttl {
+		return c.meta, nil
+	}
+
+	meta, err := c.get()
+	if err != nil {
+		c.meta = nil
+		return nil, err
+	}
+
+	c.meta, c.at = meta, c.now()
+	return meta, nil
+}
+
+// Invalidate drops the cached meta. It should be called after the node
+// changed the meta itself, so it sees own changes on the next read.
+func (c *metaCache) Invalidate() {
+	c.mu.Lock()
+	c.meta = nil
+	c.mu.Unlock()
+}
@@ -0,0 +1,98 @@
+package restore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+func TestMetaCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	reads := 0
+	status := pbm.StatusRunning
+	var readErr error
+
+	mc := &metaCache{
+		name: "test",
+		ttl:  2 * time.Second,
+		get: func() (*pbm.RestoreMeta, error) {
+			reads++
+			if readErr != nil {
+				return nil, readErr
+			}
+			return &pbm.RestoreMeta{Name: "test", Status: status}, nil
+		},
+		now: func() time.Time { return now },
+	}
+
+	for i := 0; i < 5; i++ {
+		m, err := mc.Get()
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if m.Status != pbm.StatusRunning {
+			t.Fatalf("expected %s, got %s", pbm.StatusRunning, m.Status)
+		}
+		now = now.Add(300 * time.Millisecond)
+	}
+	if reads != 1 {
+		t.Errorf("expected reads to be coalesced into 1, got %d", reads)
+	}
+
+	status = pbm.StatusError
+	now = now.Add(time.Second)
+	m, err := mc.Get()
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if m.Status != pbm.StatusError {
+		t.Errorf("expected %s after ttl, got %s", pbm.StatusError, m.Status)
+	}
+	if reads != 2 {
+		t.Errorf("expected 2 reads, got %d", reads)
+	}
+
+	status = pbm.StatusDone
+	mc.Invalidate()
+	m, err = mc.Get()
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if m.Status != pbm.StatusDone {
+		t.Errorf("expected %s after invalidate, got %s", pbm.StatusDone, m.Status)
+	}
+
+	readErr = errors.New("boom")
+	now = now.Add(3 * time.Second)
+	if _, err = mc.Get(); !errors.Is(err, readErr) {
+		t.Fatalf("expected read error, got %v", err)
+	}
+	readErr = nil
+	reads = 0
+	if _, err = mc.Get(); err != nil || reads != 1 {
+		t.Errorf("expected error not to be cached, got %v after %d reads", err, reads)
+	}
+}
+
+func TestMetaCacheNoTTL(t *testing.T) {
+	reads := 0
+	mc := &metaCache{
+		get: func() (*pbm.RestoreMeta, error) {
+			reads++
+			return &pbm.RestoreMeta{}, nil
+		},
+		now: time.Now,
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := mc.Get(); err != nil {
+			t.Fatalf("get: %v", err)
+		}
+	}
+	if reads != 3 {
+		t.Errorf("expected every call to read with zero ttl, got %d reads", reads)
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 	"golang.org/x/mod/semver"
 	"gopkg.in/yaml.v2"
 
@@ -47,6 +48,10 @@ const (
 	tryConnTimeout = 5 * time.Minute
 )
 
+// physTxnSyncPoll is how often committed txns of other shards are
+// checked in the storage
+var physTxnSyncPoll = 5 * time.Second
+
 type files struct {
 	BcpName string
 	Cmpr    compress.CompressionType
@@ -475,6 +480,19 @@ func (n nodeError) Error() string {
 	return fmt.Sprintf("%s failed: %s", n.node, n.msg)
 }
 
+func mapKeys[K comparable, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// rsFromSyncPath returns the replset name out of its sync path
+func rsFromSyncPath(p string) string {
+	return strings.TrimPrefix(path.Base(path.Dir(p)), "rs.")
+}
+
 func copyMap[K comparable, V any](m map[K]V) map[K]V {
 	cp := make(map[K]V)
 	for k, v := range m {
@@ -702,8 +720,10 @@ func (r *PhysRestore) Snapshot(
 	var progress nodeStatus
 	defer func() {
 		// set failed status of node on error, but
-		// don't mark node as failed after the local restore succeed
-		if err != nil && !progress.is(restoreDone) && !errors.Is(err, ErrNoDataForShard) {
+		// don't mark node as failed after the local restore succeed,
+		// nor the done restore that is run again
+		if err != nil && !progress.is(restoreDone) &&
+			!errors.Is(err, ErrNoDataForShard) && !errors.Is(err, ErrRestoreDone) {
 			r.MarkFailed(meta, err, !progress.is(restoreStared))
 		}
 
@@ -737,7 +757,14 @@ func (r *PhysRestore) Snapshot(
 
 	var opChunks []pbm.OplogChunk
 	if !pitr.IsZero() {
-		opChunks, err = chunks(r.cn, r.stg, r.restoreTS, pitr, r.rsConf.ID, r.rsMap)
+		c, _, err := chunks(withOPID(r.cn.Context(), r.opid), dbChunksIndex(r.cn), r.stg, r.restoreTS, pitr,
+			r.rsConf.ID, r.rsMap, r.confOpts.ChunksWarnAt(), false, r.log)
+		if err != nil {
+			return err
+		}
+		// the chunks index is unreachable once the node is shut down
+		// for the restore, so the chunks are read beforehand
+		opChunks, err = collect(c)
 		if err != nil {
 			return err
 		}
@@ -901,6 +928,11 @@ func (r *PhysRestore) Snapshot(
 		return errors.Wrapf(err, "moving to state %s", pbm.StatusDone)
 	}
 
+	// all shards are past the txns sync
+	if err := r.clearcommittedTxn(); err != nil {
+		r.log.Warning("clear committed txns: %v", err)
+	}
+
 	err = r.writeStat(stats)
 	if err != nil {
 		r.log.Warning("write download stat: %v", err)
@@ -1308,13 +1340,17 @@ func (r *PhysRestore) replayOplog(
 		return errors.Wrap(err, "define mongo version")
 	}
 
+	// the oplog is applied on the temporary single-node replset, so
+	// the configured write concern (e.g. w: 3) can't be satisfied there
 	oplogOption := applyOplogOption{
-		start:  &from,
-		end:    &to,
-		unsafe: true,
-	}
-	partial, err := applyOplog(c, opChunks, &oplogOption, r.nodeInfo.IsSharded(),
-		nil, r.setcommittedTxn, r.getcommittedTxn, &stat.Txn,
+		start:        &from,
+		end:          &to,
+		unsafe:       true,
+		txnRetention: r.confOpts.DistTxnRetention,
+		writeConcern: writeconcern.New(writeconcern.W(1)),
+	}
+	partial, err := applyOplog(withOPID(ctx, r.opid), c, chunkList(opChunks), &oplogOption, r.nodeInfo.IsSharded(),
+		nil, r.setcommittedTxn, r.getcommittedTxn, stat,
 		&mgoV, r.stg, r.log)
 	if err != nil {
 		return errors.Wrap(err, "reply oplog")
@@ -1580,6 +1616,7 @@ func (r *PhysRestore) agreeCommonRestoreTS() (primitive.Timestamp, error) {
 }
 
 func (r *PhysRestore) setcommittedTxn(txn []pbm.RestoreTxn) error {
+	txn = retainTxn(txn, r.confOpts.DistTxnRetention)
 	if txn == nil {
 		txn = []pbm.RestoreTxn{}
 	}
@@ -1593,17 +1630,33 @@ func (r *PhysRestore) setcommittedTxn(txn []pbm.RestoreTxn) error {
 	)
 }
 
+// clearcommittedTxn removes the committed txns of the replset shared by
+// setcommittedTxn. They are only needed until all shards are done.
+func (r *PhysRestore) clearcommittedTxn() error {
+	err := r.stg.Delete(r.syncPathRS + ".txn")
+	if err != nil && !errors.Is(err, storage.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
 func (r *PhysRestore) getcommittedTxn() (map[string]primitive.Timestamp, error) {
-	shards := copyMap(r.syncPathShards)
-	txn := make(map[string]primitive.Timestamp)
-	for len(shards) > 0 {
-		for f := range shards {
+	paths := make(map[string]string, len(r.syncPathShards))
+	for f := range r.syncPathShards {
+		paths[rsFromSyncPath(f)] = f
+	}
+	b := newTxnBarrier(mapKeys(paths))
+
+	tout := time.Duration(r.confOpts.TxnSyncTimeoutSec) * time.Second
+	return b.wait(tout, physTxnSyncPoll, physTxnSyncPoll, func() error {
+		for rs := range b.pending {
+			f := paths[rs]
 			dr, err := r.stg.FileStat(f + "." + string(pbm.StatusDone))
 			if err != nil && !errors.Is(err, storage.ErrNotExist) {
-				return nil, errors.Wrapf(err, "check done for <%s>", f)
+				return errors.Wrapf(err, "check done for <%s>", f)
 			}
 			if err == nil && dr.Size != 0 {
-				delete(shards, f)
+				b.publish(rs, nil)
 				continue
 			}
 
@@ -1612,24 +1665,17 @@ func (r *PhysRestore) getcommittedTxn() (map[string]primitive.Timestamp, error)
 				continue
 			}
 			if err != nil {
-				return nil, errors.Wrapf(err, "get txns <%s>", f)
+				return errors.Wrapf(err, "get txns <%s>", f)
 			}
 			txns := []pbm.RestoreTxn{}
 			err = json.NewDecoder(txnr).Decode(&txns)
 			if err != nil {
-				return nil, errors.Wrapf(err, "deconde txns <%s>", f)
-			}
-			for _, t := range txns {
-				if t.State == pbm.TxnCommit {
-					txn[t.ID] = t.Ctime
-				}
+				return errors.Wrapf(err, "deconde txns <%s>", f)
 			}
-			delete(shards, f)
+			b.publish(rs, txns)
 		}
-		time.Sleep(time.Second * 5)
-	}
-
-	return txn, nil
+		return nil
+	})
 }
 
 // Tries to connect to mongo n times, timeout is applied for each try.
@@ -1777,6 +1823,14 @@ func (r *PhysRestore) init(name string, opid pbm.OPID, l *log.Event) error {
 	r.syncPathNodeStat = fmt.Sprintf("%s/%s/rs.%s/stat.%s", pbm.PhysRestoresDir, r.name, r.rsConf.ID, r.nodeInfo.Me)
 	r.syncPathRS = fmt.Sprintf("%s/%s/rs.%s/rs", pbm.PhysRestoresDir, r.name, r.rsConf.ID)
 	r.syncPathCluster = fmt.Sprintf("%s/%s/cluster", pbm.PhysRestoresDir, r.name)
+
+	// guard against applying the same restore twice (e.g. the same command
+	// delivered again). Unlike the logical one, it can't be rerun under the
+	// same name as its state is kept in the files of the restore.
+	if _, err := r.stg.FileStat(r.syncPathCluster + "." + string(pbm.StatusDone)); err == nil {
+		return errors.Wrapf(ErrRestoreDone, "physical restore %q is done, start a new one to restore again", r.name)
+	}
+
 	r.syncPathPeers = make(map[string]struct{})
 	for _, m := range r.rsConf.Members {
 		if !m.ArbiterOnly {
@@ -2077,7 +2131,7 @@ func (r *PhysRestore) prepareBackup(backupName string) error {
 	var err error
 	r.bcp, err = r.cn.GetBackupMeta(backupName)
 	if errors.Is(err, pbm.ErrNotFound) {
-		r.bcp, err = GetMetaFromStore(r.stg, backupName)
+		r.bcp, err = GetMetaFromStore(r.cn.Context(), r.stg, backupName)
 	}
 	if err != nil {
 		return errors.Wrap(err, "get backup metadata")
@@ -2097,7 +2151,7 @@ func (r *PhysRestore) prepareBackup(backupName string) error {
 	}
 
 	if !version.CompatibleWith(r.bcp.PBMVersion, pbm.BreakingChangesMap[r.bcp.Type]) {
-		return errors.Errorf("backup version (v%s) is not compatible with PBM v%s",
+		return errors.Wrapf(ErrIncompatibleVersion, "backup version (v%s) is not compatible with PBM v%s",
 			r.bcp.PBMVersion, version.Current().Version)
 	}
 
@@ -2107,7 +2161,7 @@ func (r *PhysRestore) prepareBackup(backupName string) error {
 	}
 
 	if semver.Compare(majmin(r.bcp.MongoVersion), majmin(mgoV.VersionString)) != 0 {
-		return errors.Errorf("backup's Mongo version (%s) is not compatible with Mongo %s",
+		return errors.Wrapf(ErrIncompatibleVersion, "backup's Mongo version (%s) is not compatible with Mongo %s",
 			r.bcp.MongoVersion, mgoV.VersionString)
 	}
 
@@ -2127,6 +2181,18 @@ func (r *PhysRestore) prepareBackup(backupName string) error {
 		return errors.Wrap(err, "get cluster members")
 	}
 
+	bcpRS := make([]string, len(r.bcp.Replsets))
+	for i := range r.bcp.Replsets {
+		bcpRS[i] = r.bcp.Replsets[i].Name
+	}
+	clusterRS := make([]string, len(s))
+	for i := range s {
+		clusterRS[i] = s[i].RS
+	}
+	if err := pbm.ValidateRSMap(r.rsMap, bcpRS, clusterRS); err != nil {
+		return err
+	}
+
 	mapRevRS := pbm.MakeReverseRSMapFunc(r.rsMap)
 	fl := make(map[string]pbm.Shard, len(s))
 	for _, rs := range s {
@@ -2186,7 +2252,8 @@ func (r *PhysRestore) checkMongod(needVersion string) (version string, err error
 	}
 
 	if semver.Compare(majmin(needVersion), majmin(v)) != 0 {
-		return "", errors.Errorf("backup's Mongo version (%s) is not compatible with mongod %s", needVersion, v)
+		return "", errors.Wrapf(ErrIncompatibleVersion,
+			"backup's Mongo version (%s) is not compatible with mongod %s", needVersion, v)
 	}
 
 	return v, nil
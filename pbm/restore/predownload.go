@@ -0,0 +1,143 @@
+package restore
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+)
+
+// localStorage serves oplog chunks downloaded to the local dir. Any other
+// reads go to the underlying storage.
+type localStorage struct {
+	storage.Storage
+
+	dir string
+	// files are local paths of downloaded chunks
+	files map[string]string
+}
+
+// preDownload downloads chunks to a new temp dir in `parent` verifying
+// their checksums (if any). The dir is removed if any download fails.
+func preDownload(
+	ctx context.Context,
+	stg storage.Storage,
+	chunks oplogChunks,
+	parent string,
+) (*localStorage, error) {
+	dir, err := os.MkdirTemp(parent, "pbm-oplog-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create temp dir")
+	}
+
+	ls := &localStorage{Storage: stg, dir: dir, files: make(map[string]string)}
+	it := chunks.iter()
+	for i := 0; it.Next(); i++ {
+		c := it.Chunk()
+		if _, ok := ls.files[c.FName]; ok {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+
+		p := filepath.Join(dir, strconv.Itoa(i))
+		if err := downloadChunk(stg, c, p); err != nil {
+			os.RemoveAll(dir)
+			return nil, errors.Wrapf(err, "download %s", c.FName)
+		}
+		ls.files[c.FName] = p
+	}
+	if err := it.Err(); err != nil {
+		os.RemoveAll(dir)
+		return nil, errors.Wrap(err, "read chunks")
+	}
+
+	return ls, nil
+}
+
+//nolint:nonamedreturns
+func downloadChunk(stg storage.Storage, c pbm.OplogChunk, p string) (err error) {
+	sr, err := stg.SourceReader(c.FName)
+	if err != nil {
+		return errors.Wrap(err, "get object")
+	}
+	r, err := storage.VerifyReader(sr, c.Checksum)
+	if err != nil {
+		sr.Close()
+		return err
+	}
+	defer func() {
+		if cerr := r.Close(); err == nil && cerr != nil {
+			err = cerr
+		}
+	}()
+
+	f, err := os.Create(p)
+	if err != nil {
+		return errors.Wrap(err, "create file")
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil && cerr != nil {
+			err = errors.Wrap(cerr, "close file")
+		}
+	}()
+
+	_, err = io.Copy(f, r)
+	return errors.Wrap(err, "copy")
+}
+
+// over returns the local copies of the chunks served over stg
+func (s *localStorage) over(stg storage.Storage) *localStorage {
+	return &localStorage{Storage: stg, dir: s.dir, files: s.files}
+}
+
+// SourceReader returns the local copy of the chunk if there is one
+func (s *localStorage) SourceReader(name string) (io.ReadCloser, error) {
+	p, ok := s.files[name]
+	if !ok {
+		return s.Storage.SourceReader(name)
+	}
+
+	return os.Open(p)
+}
+
+// SourceReaderWithStat returns the local copy of the chunk along with its
+// info if there is one. So the remote storage isn't reached for it.
+func (s *localStorage) SourceReaderWithStat(name string) (io.ReadCloser, storage.FileInfo, error) {
+	p, ok := s.files[name]
+	if !ok {
+		return storage.SourceReaderWithStat(s.Storage, name)
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, storage.FileInfo{}, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, storage.FileInfo{}, err
+	}
+	if st.Size() == 0 {
+		f.Close()
+		return nil, storage.FileInfo{}, storage.ErrEmpty
+	}
+
+	return f, storage.FileInfo{Name: name, Size: st.Size()}, nil
+}
+
+// cleanup removes downloaded chunks
+func (s *localStorage) cleanup(l *log.Event) {
+	if err := os.RemoveAll(s.dir); err != nil {
+		l.Warning("remove downloaded chunks %s: %v", s.dir, err)
+	}
+}
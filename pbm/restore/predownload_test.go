@@ -0,0 +1,149 @@
+package restore
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+)
+
+// readCountStorage counts reads of each file
+type readCountStorage struct {
+	memStorage
+	reads map[string]int
+}
+
+func (s *readCountStorage) SourceReader(name string) (io.ReadCloser, error) {
+	s.reads[name]++
+	return s.memStorage.SourceReader(name)
+}
+
+func preDownloadReplay(t *testing.T, stg *readCountStorage, dir string) (int64, error) {
+	t.Helper()
+
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone},
+		{RS: "rs0", FName: "c2", Compression: compress.CompressionTypeNone},
+	}
+
+	bus := NewEventBus()
+	events, unsubscribe := bus.Subscribe(len(chunks))
+
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+	o := &applyOplogOption{unsafe: true, events: bus, preDownload: true, preDownloadDir: dir}
+	_, err := applyOplog(context.Background(), nil, chunkList(chunks), o, false,
+		nil, nil, nil, &pbm.RestoreShardStat{}, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+	unsubscribe()
+
+	var applied int64
+	for e := range events {
+		if c, ok := e.(ChunkApplied); ok {
+			applied += c.OpsApplied
+		}
+	}
+
+	return applied, err
+}
+
+func TestPreDownloadReplay(t *testing.T) {
+	stg := &readCountStorage{
+		memStorage: memStorage{
+			"c1": indexOpsChunkAt(t, 10, createIndexOp("c", "a")),
+			"c2": indexOpsChunkAt(t, 11, createIndexOp("c", "b"), dropIndexOp("c", "a")),
+		},
+		reads: make(map[string]int),
+	}
+	dir := t.TempDir()
+
+	applied, err := preDownloadReplay(t, stg, dir)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if applied != 3 {
+		t.Errorf("expected 3 ops to be applied, got %d", applied)
+	}
+	// the replay reads local copies, so the storage is read once on download
+	for _, f := range []string{"c1", "c2"} {
+		if stg.reads[f] != 1 {
+			t.Errorf("expected %s to be read from the storage once, got %d", f, stg.reads[f])
+		}
+	}
+
+	left, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("expected temp dir to be removed, got %v", left)
+	}
+}
+
+func TestPreDownloadFailure(t *testing.T) {
+	stg := &readCountStorage{
+		memStorage: memStorage{"c1": indexOpsChunkAt(t, 10, createIndexOp("c", "a"))},
+		reads:      make(map[string]int),
+	}
+	dir := t.TempDir()
+
+	applied, err := preDownloadReplay(t, stg, dir)
+	if err == nil || !strings.Contains(err.Error(), "pre-download") {
+		t.Fatalf("expected pre-download error, got %v", err)
+	}
+	if applied != 0 {
+		t.Errorf("expected nothing to be applied, got %d ops", applied)
+	}
+
+	left, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("expected temp dir to be removed, got %v", left)
+	}
+}
+
+func TestPreDownloadedReplay(t *testing.T) {
+	stg := &readCountStorage{
+		memStorage: memStorage{
+			"c1": indexOpsChunkAt(t, 10, createIndexOp("c", "a")),
+			"c2": indexOpsChunkAt(t, 11, createIndexOp("c", "b")),
+		},
+		reads: make(map[string]int),
+	}
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone},
+		{RS: "rs0", FName: "c2", Compression: compress.CompressionTypeNone},
+	}
+
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+
+	// downloaded by the caller before the snapshot restore
+	ls, err := preDownload(context.Background(), stg, chunkList(chunks), t.TempDir())
+	if err != nil {
+		t.Fatalf("pre-download: %v", err)
+	}
+	defer ls.cleanup(l)
+
+	stat := &pbm.RestoreShardStat{}
+	o := &applyOplogOption{unsafe: true, downloaded: ls}
+	_, err = applyOplog(context.Background(), nil, chunkList(chunks), o, false,
+		nil, nil, nil, stat, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if stat.Chunks != len(chunks) {
+		t.Errorf("expected %d chunks replayed, got %d", len(chunks), stat.Chunks)
+	}
+	for _, f := range []string{"c1", "c2"} {
+		if stg.reads[f] != 1 {
+			t.Errorf("expected %s to be read from the storage once, got %d", f, stg.reads[f])
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+)
+
+// defaultPrefetchBudget is the prefetch memory budget if none is configured
+const defaultPrefetchBudget = 256 << 20
+
+// MemBudget limits the total size of the memory buffers held at once.
+// The agent shares one among its restores, so parallel prefetches stay
+// within it in total, see Restore.SetPrefetchBudget.
+type MemBudget struct {
+	mx   sync.Mutex
+	cond *sync.Cond
+	size int64
+	used int64
+	peak int64
+}
+
+// NewMemBudget returns the budget of `size` bytes. Zero size means
+// the default one.
+func NewMemBudget(size int64) *MemBudget {
+	if size <= 0 {
+		size = defaultPrefetchBudget
+	}
+
+	b := &MemBudget{size: size}
+	b.cond = sync.NewCond(&b.mx)
+	return b
+}
+
+// Resize sets the size of the budget. Buffers already held stay, so the
+// budget may be over the new size until they're released.
+func (b *MemBudget) Resize(size int64) {
+	if size <= 0 {
+		size = defaultPrefetchBudget
+	}
+
+	b.mx.Lock()
+	b.size = size
+	b.mx.Unlock()
+	b.cond.Broadcast()
+}
+
+// errOverBudget means the requested buffer is bigger than the whole budget
+var errOverBudget = errors.New("bigger than the memory budget")
+
+// acquire blocks until n bytes are available in the budget or ctx is done.
+// Requests bigger than the whole budget fail with errOverBudget, such
+// buffers can't be held in memory. Returns the number of bytes taken
+// which should be passed to release.
+func (b *MemBudget) acquire(ctx context.Context, n int64) (int64, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if n > b.size {
+		return 0, errors.Wrapf(errOverBudget, "%d bytes of %d", n, b.size)
+	}
+	for b.used+n > b.size {
+		if n > b.size {
+			return 0, errors.Wrapf(errOverBudget, "%d bytes of %d", n, b.size)
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		b.cond.Wait()
+	}
+	b.used += n
+	if b.used > b.peak {
+		b.peak = b.used
+	}
+
+	return n, nil
+}
+
+func (b *MemBudget) release(n int64) {
+	b.mx.Lock()
+	b.used -= n
+	b.mx.Unlock()
+	b.cond.Broadcast()
+}
+
+// wake wakes up all waiters so they can check their contexts
+func (b *MemBudget) wake() {
+	b.mx.Lock()
+	b.cond.Broadcast()
+	b.mx.Unlock()
+}
+
+var (
+	downloadLimitMx sync.Mutex
+	downloadLimit   *storage.RateLimiter
+	downloadRate    int64
+)
+
+// sharedDownloadLimit returns the storage download limiter shared by all
+// restores of the agent, so parallel downloads (e.g. prefetch) stay within
+// the rate in total. Zero rate means no limit.
+func sharedDownloadLimit(perSec int64) *storage.RateLimiter {
+	if perSec <= 0 {
+		return nil
+	}
+
+	downloadLimitMx.Lock()
+	defer downloadLimitMx.Unlock()
+
+	if downloadLimit == nil || downloadRate != perSec {
+		downloadLimit = storage.NewRateLimiter(perSec)
+		downloadRate = perSec
+	}
+
+	return downloadLimit
+}
+
+type prefetched struct {
+	data []byte
+	size int64 // taken from the budget
+	err  error
+}
+
+type prefetchJob struct {
+	name string
+	size int64
+	// r is the opened chunk, it's opened along with getting the size
+	// for the budget (see storage.SourceReaderWithStat)
+	r   io.ReadCloser
+	res chan<- prefetched
+}
+
+// prefetchStorage downloads oplog chunks of the iterator ahead, up to `n`
+// at once, keeping them in memory within the budget. The chunks are read
+// from the iterator as they are prefetched and are passed on in the same
+// order, see chunks. Each prefetched chunk is served once, any other reads
+// go to the underlying storage.
+type prefetchStorage struct {
+	storage.Storage
+
+	budget *MemBudget
+	ahead  chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// next passes on chunks of the iterator, err is the iteration error
+	// once next is closed
+	next chan pbm.OplogChunk
+	err  error
+
+	mx    sync.Mutex
+	ready map[string]chan prefetched
+}
+
+func newPrefetchStorage(
+	ctx context.Context,
+	stg storage.Storage,
+	it chunksIter,
+	n int,
+	budget *MemBudget,
+) *prefetchStorage {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &prefetchStorage{
+		Storage: stg,
+		budget:  budget,
+		ahead:   make(chan struct{}, n),
+		ctx:     ctx,
+		cancel:  cancel,
+		next:    make(chan pbm.OplogChunk, n),
+		ready:   make(map[string]chan prefetched),
+	}
+
+	jobs := make(chan prefetchJob)
+	for i := 0; i < n; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for j := range jobs {
+				data, err := p.download(j.r)
+				if err != nil {
+					p.budget.release(j.size)
+					j.size = 0
+				}
+				j.res <- prefetched{data: data, size: j.size, err: err}
+			}
+		}()
+	}
+
+	p.wg.Add(2)
+	go func() {
+		defer p.wg.Done()
+		<-ctx.Done()
+		p.budget.wake()
+	}()
+	go func() {
+		defer p.wg.Done()
+		defer close(p.next)
+		defer close(jobs)
+
+		for it.Next() {
+			if p.err = p.prefetch(it.Chunk(), jobs); p.err != nil {
+				return
+			}
+		}
+		p.err = it.Err()
+	}()
+
+	return p
+}
+
+// prefetch passes the chunk on and starts its download unless the same
+// file is already being prefetched
+func (p *prefetchStorage) prefetch(c pbm.OplogChunk, jobs chan<- prefetchJob) error {
+	p.mx.Lock()
+	_, dup := p.ready[c.FName]
+	res := make(chan prefetched, 1)
+	if !dup {
+		p.ready[c.FName] = res
+	}
+	p.mx.Unlock()
+
+	// the chunk is registered before it's passed on,
+	// so its read waits for the download
+	select {
+	case p.next <- c:
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+	if dup {
+		return nil
+	}
+
+	select {
+	case p.ahead <- struct{}{}:
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+
+	// the object is opened once its memory is taken, so no
+	// stream is held open while waiting for the budget
+	fi, err := p.Storage.FileStat(c.FName)
+	if err != nil {
+		res <- prefetched{err: errors.Wrap(err, "get file stat")}
+		return nil
+	}
+
+	j := prefetchJob{name: c.FName, res: res}
+	j.size, err = p.budget.acquire(p.ctx, fi.Size)
+	if errors.Is(err, errOverBudget) {
+		// it's read from the storage as it's replayed
+		res <- prefetched{err: err}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	j.r, err = p.Storage.SourceReader(j.name)
+	if err != nil {
+		p.budget.release(j.size)
+		res <- prefetched{err: errors.Wrap(err, "open file")}
+		return nil
+	}
+
+	select {
+	case jobs <- j:
+	case <-p.ctx.Done():
+		j.r.Close()
+		p.budget.release(j.size)
+		return p.ctx.Err()
+	}
+
+	return nil
+}
+
+// chunks returns the iterator over chunks being prefetched. It should
+// be used instead of the one prefetchStorage is created with.
+func (p *prefetchStorage) chunks() chunksIter {
+	return &prefetchIter{p: p}
+}
+
+type prefetchIter struct {
+	p *prefetchStorage
+	c pbm.OplogChunk
+}
+
+func (i *prefetchIter) Next() bool {
+	c, ok := <-i.p.next
+	i.c = c
+	return ok
+}
+
+func (i *prefetchIter) Chunk() pbm.OplogChunk { return i.c }
+
+func (i *prefetchIter) Err() error { return i.p.err }
+
+func (p *prefetchStorage) download(r io.ReadCloser) ([]byte, error) {
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// SourceReader returns the prefetched chunk, waiting for the download if
+// needed. The budget is released on Close. If the prefetch has failed it
+// falls back to the underlying storage.
+func (p *prefetchStorage) SourceReader(name string) (io.ReadCloser, error) {
+	r, ok, err := p.wait(name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return p.Storage.SourceReader(name)
+	}
+
+	return r, nil
+}
+
+// wait waits for the prefetched chunk. It's not ok if the chunk isn't
+// prefetched or the prefetch has failed.
+func (p *prefetchStorage) wait(name string) (*budgetReader, bool, error) {
+	p.mx.Lock()
+	res, ok := p.ready[name]
+	delete(p.ready, name)
+	p.mx.Unlock()
+
+	if !ok {
+		return nil, false, nil
+	}
+
+	var f prefetched
+	select {
+	case f = <-res:
+		<-p.ahead
+	case <-p.ctx.Done():
+		return nil, false, p.ctx.Err()
+	}
+	if f.err != nil {
+		return nil, false, nil
+	}
+
+	return &budgetReader{Reader: bytes.NewReader(f.data), b: p.budget, n: f.size}, true, nil
+}
+
+// SourceReaderWithStat is SourceReader along with the size of the chunk
+func (p *prefetchStorage) SourceReaderWithStat(name string) (io.ReadCloser, storage.FileInfo, error) {
+	br, ok, err := p.wait(name)
+	if err != nil {
+		return nil, storage.FileInfo{}, err
+	}
+	if !ok {
+		return storage.SourceReaderWithStat(p.Storage, name)
+	}
+	if br.Size() == 0 {
+		br.Close()
+		return nil, storage.FileInfo{}, storage.ErrEmpty
+	}
+
+	return br, storage.FileInfo{Name: name, Size: br.Size()}, nil
+}
+
+// stop cancels the prefetch and releases the memory of chunks that weren't
+// read
+func (p *prefetchStorage) stop() {
+	p.cancel()
+	p.wg.Wait()
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	for name, res := range p.ready {
+		select {
+		case f := <-res:
+			p.budget.release(f.size)
+		default:
+		}
+		delete(p.ready, name)
+	}
+}
+
+type budgetReader struct {
+	*bytes.Reader
+	b    *MemBudget
+	n    int64
+	once sync.Once
+}
+
+func (r *budgetReader) Close() error {
+	r.once.Do(func() { r.b.release(r.n) })
+	return nil
+}
@@ -0,0 +1,421 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+)
+
+// downloadCountStorage counts chunks read to the end
+type downloadCountStorage struct {
+	memStorage
+	downloaded int32
+}
+
+func (s *downloadCountStorage) SourceReader(name string) (io.ReadCloser, error) {
+	r, err := s.memStorage.SourceReader(name)
+	if err != nil {
+		return nil, err
+	}
+	return &downloadCountReader{ReadCloser: r, n: &s.downloaded}, nil
+}
+
+type downloadCountReader struct {
+	io.ReadCloser
+	n    *int32
+	done bool
+}
+
+func (r *downloadCountReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) && !r.done {
+		r.done = true
+		atomic.AddInt32(r.n, 1)
+	}
+	return n, err
+}
+
+func TestPrefetchTightBudget(t *testing.T) {
+	stg := &downloadCountStorage{memStorage: memStorage{}}
+	var chunks []pbm.OplogChunk
+	for i := uint32(0); i < 8; i++ {
+		from, to := 10+i*10, 20+i*10
+		name := fmt.Sprintf("c%d", i)
+		stg.memStorage[name] = noopChunk(t, from, from+1, from+2, from+3, to)
+		chunks = append(chunks, pbm.OplogChunk{
+			RS: "rs0", FName: name, Compression: compress.CompressionTypeNone,
+			StartTS: primitive.Timestamp{T: from, I: 1}, EndTS: primitive.Timestamp{T: to, I: 1},
+		})
+	}
+
+	// fits two chunks only while four are requested ahead
+	budget := NewMemBudget(int64(len(stg.memStorage["c0"])) * 2)
+
+	// downloaded and not yet applied chunks are held in memory
+	var applied, maxHeld int32
+	_, err := applyOplog(context.Background(), nil, chunkList(chunks),
+		&applyOplogOption{
+			unsafe:         true,
+			prefetch:       4,
+			prefetchBudget: budget,
+			progress: func(replayProgress) {
+				applied++
+				// lets the prefetch get ahead of the replay
+				time.Sleep(5 * time.Millisecond)
+				if held := atomic.LoadInt32(&stg.downloaded) - applied; held > maxHeld {
+					maxHeld = held
+				}
+			},
+		}, false,
+		nil, nil, nil, &pbm.RestoreShardStat{},
+		&pbm.MongoVersion{Version: []int{6, 0, 0}}, stg,
+		log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{}))
+	if err != nil {
+		t.Fatalf("apply oplog: %v", err)
+	}
+
+	if applied != int32(len(chunks)) {
+		t.Errorf("expected %d chunks applied, got %d", len(chunks), applied)
+	}
+	if maxHeld == 0 || maxHeld > 2 {
+		t.Errorf("expected up to 2 chunks prefetched within the budget, got %d", maxHeld)
+	}
+	if budget.peak > budget.size {
+		t.Errorf("budget exceeded: peak %d, size %d", budget.peak, budget.size)
+	}
+	if budget.used != 0 {
+		t.Errorf("expected budget to be released, %d still in use", budget.used)
+	}
+}
+
+func TestPrefetchChunkOverBudget(t *testing.T) {
+	stg := &readCountStorage{
+		memStorage: memStorage{
+			"c1": noopChunk(t, 10, 11, 12, 13, 14, 15),
+			"c2": noopChunk(t, 15, 16, 17, 18, 19, 20),
+		},
+		reads: make(map[string]int),
+	}
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone,
+			StartTS: primitive.Timestamp{T: 10, I: 1}, EndTS: primitive.Timestamp{T: 15, I: 1}},
+		{RS: "rs0", FName: "c2", Compression: compress.CompressionTypeNone,
+			StartTS: primitive.Timestamp{T: 15, I: 1}, EndTS: primitive.Timestamp{T: 20, I: 1}},
+	}
+
+	budget := NewMemBudget(16)
+
+	done := make(chan error, 1)
+	stat := &pbm.RestoreShardStat{}
+	go func() {
+		_, err := applyOplog(context.Background(), nil, chunkList(chunks),
+			&applyOplogOption{unsafe: true, prefetch: 2, prefetchBudget: budget}, false,
+			nil, nil, nil, stat,
+			&pbm.MongoVersion{Version: []int{6, 0, 0}}, stg,
+			log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{}))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("apply oplog: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("prefetch stuck on chunks bigger than the budget")
+	}
+
+	if stat.Chunks != 2 {
+		t.Errorf("expected both chunks to be replayed, got %d", stat.Chunks)
+	}
+	// chunks bigger than the budget aren't held in memory
+	// but are streamed from the storage once
+	if budget.peak != 0 {
+		t.Errorf("expected no memory taken, peak %d", budget.peak)
+	}
+	for _, f := range []string{"c1", "c2"} {
+		if stg.reads[f] != 1 {
+			t.Errorf("expected %s to be read from the storage once, got %d", f, stg.reads[f])
+		}
+	}
+}
+
+func TestMemBudgetConcurrent(t *testing.T) {
+	for _, n := range []int64{4, 6} {
+		b := NewMemBudget(10)
+		var (
+			mx       sync.Mutex
+			held     int64
+			maxHeld  int64
+			wg       sync.WaitGroup
+			failures int32
+		)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				got, err := b.acquire(context.Background(), n)
+				if err != nil || got != n {
+					atomic.AddInt32(&failures, 1)
+					return
+				}
+				mx.Lock()
+				held += n
+				if held > maxHeld {
+					maxHeld = held
+				}
+				mx.Unlock()
+
+				runtime.Gosched()
+
+				mx.Lock()
+				held -= n
+				mx.Unlock()
+				b.release(got)
+			}()
+		}
+		wg.Wait()
+
+		if failures != 0 {
+			t.Errorf("%d bytes: %d acquires failed", n, failures)
+		}
+		// waiters are let in only as the budget allows
+		if maxHeld > b.size || b.peak > b.size {
+			t.Errorf("%d bytes: budget exceeded: held %d, peak %d, size %d", n, maxHeld, b.peak, b.size)
+		}
+		if b.used != 0 {
+			t.Errorf("%d bytes: expected budget to be released, %d still in use", n, b.used)
+		}
+	}
+}
+
+func TestMemBudgetOver(t *testing.T) {
+	b := NewMemBudget(10)
+	if _, err := b.acquire(context.Background(), 11); !errors.Is(err, errOverBudget) {
+		t.Errorf("expected over budget, got %v", err)
+	}
+
+	// a waiter fails once the budget shrinks below its request
+	if _, err := b.acquire(context.Background(), 6); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := b.acquire(context.Background(), 8)
+		errc <- err
+	}()
+	b.Resize(7)
+	if err := <-errc; !errors.Is(err, errOverBudget) {
+		t.Errorf("expected over budget after resize, got %v", err)
+	}
+}
+
+func TestMemBudgetCancel(t *testing.T) {
+	b := NewMemBudget(10)
+	if _, err := b.acquire(context.Background(), 10); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := b.acquire(ctx, 1)
+		errc <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	b.wake()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Errorf("expected acquire to fail on canceled context")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acquire wasn't interrupted")
+	}
+}
+
+func TestPrefetchThrottledOnce(t *testing.T) {
+	const (
+		size  = 20 << 10
+		limit = 40 << 10 // bytes per second
+	)
+
+	mem := memStorage{"c0": make([]byte, size)}
+	chunks := []pbm.OplogChunk{{RS: "rs0", FName: "c0"}}
+	stg := storage.NewThrottled(mem, storage.NewRateLimiter(limit))
+	pf := newPrefetchStorage(context.Background(), stg, chunkList(chunks).iter(), 1, NewMemBudget(size))
+	defer pf.stop()
+
+	start := time.Now()
+	if !pf.chunks().Next() {
+		t.Fatal("no chunks to prefetch")
+	}
+	r, err := pf.SourceReader("c0")
+	if err != nil {
+		t.Fatalf("get reader: %v", err)
+	}
+	downloaded := time.Since(start)
+
+	n, err := io.Copy(io.Discard, r)
+	r.Close()
+	if err != nil || n != size {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+	read := time.Since(start) - downloaded
+
+	least := time.Duration(float64(size-limit/10) / limit * float64(time.Second))
+	if downloaded < least*9/10 {
+		t.Errorf("downloaded in %v, expected at least %v with the limit", downloaded, least)
+	}
+	// the prefetched chunk is served from memory
+	if read > least/4 {
+		t.Errorf("reading prefetched chunk took %v, expected it not to be throttled", read)
+	}
+}
+
+// openOrderStorage records stat and open calls of the files
+type openOrderStorage struct {
+	memStorage
+	mx    sync.Mutex
+	calls []string
+}
+
+func (s *openOrderStorage) record(call string) {
+	s.mx.Lock()
+	s.calls = append(s.calls, call)
+	s.mx.Unlock()
+}
+
+func (s *openOrderStorage) called(call string) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for _, c := range s.calls {
+		if c == call {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *openOrderStorage) FileStat(name string) (storage.FileInfo, error) {
+	s.record("stat " + name)
+	return s.memStorage.FileStat(name)
+}
+
+func (s *openOrderStorage) SourceReader(name string) (io.ReadCloser, error) {
+	s.record("open " + name)
+	return s.memStorage.SourceReader(name)
+}
+
+func TestPrefetchOpensWithinBudget(t *testing.T) {
+	stg := &openOrderStorage{memStorage: memStorage{
+		"c1": make([]byte, 10),
+		"c2": make([]byte, 10),
+	}}
+	chunks := []pbm.OplogChunk{{RS: "rs0", FName: "c1"}, {RS: "rs0", FName: "c2"}}
+
+	// fits one chunk only
+	pf := newPrefetchStorage(context.Background(), stg, chunkList(chunks).iter(), 2, NewMemBudget(10))
+	defer pf.stop()
+	pit := pf.chunks()
+
+	pit.Next()
+	r, err := pf.SourceReader("c1")
+	if err != nil {
+		t.Fatalf("get reader: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !stg.called("stat c2"); {
+		if time.Now().After(deadline) {
+			t.Fatal("c2 isn't prefetched")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// c2 waits for the budget taken by c1 without being opened
+	if stg.called("open c2") {
+		t.Errorf("c2 is opened before its memory is taken: %v", stg.calls)
+	}
+	r.Close()
+
+	pit.Next()
+	r, err = pf.SourceReader("c2")
+	if err != nil {
+		t.Fatalf("get reader: %v", err)
+	}
+	r.Close()
+	if !stg.called("open c2") {
+		t.Errorf("expected c2 to be opened, got %v", stg.calls)
+	}
+}
+
+// blockingStatStorage blocks the first FileStat until released
+type blockingStatStorage struct {
+	memStorage
+	once    sync.Once
+	stat    chan string
+	release chan struct{}
+}
+
+func (s *blockingStatStorage) FileStat(name string) (storage.FileInfo, error) {
+	s.once.Do(func() {
+		s.stat <- name
+		<-s.release
+	})
+	return s.memStorage.FileStat(name)
+}
+
+func TestPrefetchStreamsChunks(t *testing.T) {
+	stg := &blockingStatStorage{memStorage: memStorage{}, stat: make(chan string, 1), release: make(chan struct{})}
+	var chunks []pbm.OplogChunk
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("c%d", i)
+		stg.memStorage[name] = []byte{byte(i)}
+		chunks = append(chunks, pbm.OplogChunk{RS: "rs0", FName: name})
+	}
+	it := &countingChunksIter{sliceChunksIter: sliceChunksIter{chunks: chunks}}
+
+	pf := newPrefetchStorage(context.Background(), stg, it, 2, NewMemBudget(10))
+	defer pf.stop()
+
+	// the prefetch of the first chunk holds the rest unread
+	if name := <-stg.stat; name != "c0" {
+		t.Fatalf("expected c0 to be prefetched first, got %s", name)
+	}
+	if it.read != 1 {
+		t.Errorf("expected the first chunk only to be read, got %d", it.read)
+	}
+	close(stg.release)
+
+	var got []string
+	pit := pf.chunks()
+	for pit.Next() {
+		c := pit.Chunk()
+		r, err := pf.SourceReader(c.FName)
+		if err != nil {
+			t.Fatalf("get reader %s: %v", c.FName, err)
+		}
+		r.Close()
+		got = append(got, c.FName)
+	}
+	if err := pit.Err(); err != nil {
+		t.Fatalf("iterate: %v", err)
+	}
+	if len(got) != len(chunks) || got[0] != "c0" || got[9] != "c9" {
+		t.Errorf("expected chunks in order, got %v", got)
+	}
+}
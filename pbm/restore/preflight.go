@@ -0,0 +1,226 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+)
+
+type PreflightStatus string
+
+const (
+	PreflightPassed  PreflightStatus = "passed"
+	PreflightWarning PreflightStatus = "warning"
+	PreflightFailed  PreflightStatus = "failed"
+	PreflightSkipped PreflightStatus = "skipped"
+)
+
+// PreflightFinding is the result of a single preflight check
+type PreflightFinding struct {
+	Check  string          `json:"check"`
+	Status PreflightStatus `json:"status"`
+	Msg    string          `json:"msg,omitempty"`
+}
+
+// PreflightReport is the list of findings in the order of checks
+type PreflightReport []PreflightFinding
+
+// OK returns false if any of the checks failed
+func (r PreflightReport) OK() bool {
+	for _, f := range r {
+		if f.Status == PreflightFailed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Failed returns findings of failed checks
+func (r PreflightReport) Failed() []PreflightFinding {
+	var rv []PreflightFinding
+	for _, f := range r {
+		if f.Status == PreflightFailed {
+			rv = append(rv, f)
+		}
+	}
+
+	return rv
+}
+
+func (r PreflightReport) String() string {
+	var b strings.Builder
+	for _, f := range r {
+		fmt.Fprintf(&b, "%-8s %s", f.Status, f.Check)
+		if f.Msg != "" {
+			fmt.Fprintf(&b, ": %s", f.Msg)
+		}
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// PreflightOptions define what's checked on top of the backup itself.
+// Checks which options aren't set are skipped.
+type PreflightOptions struct {
+	// PITR is the point-in-time target. Zero means no oplog replay
+	PITR primitive.Timestamp
+	// RSMap is the replsets mapping (target to source)
+	RSMap map[string]string
+	// TargetVersion is the mongo version of the cluster to restore onto
+	TargetVersion string
+	// TargetRSets are replsets of the cluster to restore onto
+	TargetRSets []string
+	// DBPath is the mongod dbpath to check the free space on
+	DBPath string
+	// Storage overrides the configured storage to read the backup from
+	Storage *pbm.StorageConf
+}
+
+// chunksSliceFn returns oplog chunks of the (source) replset in the given range
+type chunksSliceFn func(rs string, from, to primitive.Timestamp) ([]pbm.OplogChunk, error)
+
+// RestorePreflight runs checks of the restore of the backup `name` without
+// changing anything. All checks are run, so the report has all problems at
+// once. Checks that rely on the backup metadata are skipped if it's missing.
+func RestorePreflight(cn *pbm.PBM, name string, opts PreflightOptions) PreflightReport {
+	stg, err := cn.GetStorageOverride(opts.Storage, nil)
+	if err != nil {
+		return PreflightReport{{
+			Check:  checkStorage,
+			Status: PreflightFailed,
+			Msg:    errors.Wrap(err, "get storage").Error(),
+		}}
+	}
+
+	return preflight(cn.Context(), stg, cn.PITRGetChunksSlice, name, opts)
+}
+
+const (
+	checkStorage  = "storage"
+	checkMeta     = "backup metadata"
+	checkVersion  = "mongo version"
+	checkRSMap    = "replset mapping"
+	checkOplog    = "oplog chunks"
+	checkFreeDisk = "disk space"
+)
+
+func preflight(
+	ctx context.Context,
+	stg storage.Storage,
+	chunksSlice chunksSliceFn,
+	name string,
+	opts PreflightOptions,
+) PreflightReport {
+	var rv PreflightReport
+	add := func(check string, status PreflightStatus, msg string) {
+		rv = append(rv, PreflightFinding{Check: check, Status: status, Msg: msg})
+	}
+	addErr := func(check string, err error) {
+		if err != nil {
+			add(check, PreflightFailed, err.Error())
+		} else {
+			add(check, PreflightPassed, "")
+		}
+	}
+
+	_, err := stg.List("", pbm.MetadataFileSuffix)
+	addErr(checkStorage, errors.Wrap(err, "list backups"))
+
+	bcp, err := GetMetaFromStore(ctx, stg, name)
+	if err == nil && bcp.Status != pbm.StatusDone {
+		err = errors.Errorf("backup status is %q", bcp.Status)
+	}
+	addErr(checkMeta, err)
+	if err != nil {
+		for _, c := range []string{checkVersion, checkRSMap, checkOplog, checkFreeDisk} {
+			add(c, PreflightSkipped, "no backup metadata")
+		}
+		return rv
+	}
+
+	switch {
+	case opts.TargetVersion == "":
+		add(checkVersion, PreflightSkipped, "target version is not set")
+	case !opts.PITR.IsZero():
+		addErr(checkVersion, checkOplogVersion(bcp.MongoVersion, opts.TargetVersion))
+	case majmin(bcp.MongoVersion) == majmin(opts.TargetVersion):
+		add(checkVersion, PreflightPassed, "")
+	case bcp.Type == pbm.LogicalBackup:
+		add(checkVersion, PreflightWarning, fmt.Sprintf("backup mongo version %q differs from the target %q",
+			bcp.MongoVersion, opts.TargetVersion))
+	default:
+		add(checkVersion, PreflightFailed, fmt.Sprintf("backup mongo version %q is not compatible with the target %q",
+			bcp.MongoVersion, opts.TargetVersion))
+	}
+
+	sources := make([]string, 0, len(bcp.Replsets))
+	for _, rs := range bcp.Replsets {
+		sources = append(sources, rs.Name)
+	}
+	if len(opts.TargetRSets) == 0 {
+		add(checkRSMap, PreflightSkipped, "target replsets are not set")
+	} else {
+		addErr(checkRSMap, pbm.ValidateRSMap(opts.RSMap, sources, opts.TargetRSets))
+	}
+
+	if opts.PITR.IsZero() {
+		add(checkOplog, PreflightSkipped, "no point-in-time target")
+	} else {
+		var errs []string
+		for _, rs := range sources {
+			chunks, err := chunksSlice(rs, bcp.LastWriteTS, opts.PITR)
+			if err == nil {
+				err = checkChunks(stg, chunks, bcp.LastWriteTS, opts.PITR)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", rs, err))
+			}
+		}
+		if len(errs) != 0 {
+			add(checkOplog, PreflightFailed, strings.Join(errs, "; "))
+		} else {
+			add(checkOplog, PreflightPassed, "")
+		}
+	}
+
+	if opts.DBPath == "" {
+		add(checkFreeDisk, PreflightSkipped, "dbpath is not set")
+	} else {
+		addErr(checkFreeDisk, checkFreeSpace(opts.DBPath, bcp.Size))
+	}
+
+	return rv
+}
+
+// freeSpace returns the num of bytes available on the path's filesystem
+var freeSpace = func(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+
+	return int64(st.Bavail) * int64(st.Bsize), nil //nolint:unconvert
+}
+
+// checkFreeSpace checks there is at least `need` bytes available on
+// the path. The backup size is the lower bound as data is compressed.
+func checkFreeSpace(path string, need int64) error {
+	free, err := freeSpace(path)
+	if err != nil {
+		return errors.Wrapf(err, "get free space on %s", path)
+	}
+	if free < need {
+		return errors.Errorf("%d bytes available on %s, the backup size is %d bytes", free, path, need)
+	}
+
+	return nil
+}
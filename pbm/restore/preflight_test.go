@@ -0,0 +1,131 @@
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+func TestPreflight(t *testing.T) {
+	defer func(f func(string) (int64, error)) { freeSpace = f }(freeSpace)
+	freeSpace = func(string) (int64, error) { return 1 << 30, nil }
+
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+
+	bcp := pbm.BackupMeta{
+		Name:         "bcp",
+		Type:         pbm.LogicalBackup,
+		Status:       pbm.StatusDone,
+		MongoVersion: "6.0.5",
+		LastWriteTS:  ts(10),
+		Size:         1 << 20,
+		Replsets:     []pbm.BackupReplset{{Name: "rs0"}, {Name: "rs1"}},
+	}
+	b, err := json.Marshal(bcp)
+	if err != nil {
+		t.Fatalf("marshal meta: %v", err)
+	}
+	stg := memStorage{
+		"bcp" + pbm.MetadataFileSuffix: b,
+		"rs0-c1":                       []byte("c1"),
+		"rs0-c2":                       []byte("c2"),
+		"rs1-c1":                       []byte("c1"),
+		"rs1-c3":                       []byte("c3"),
+	}
+	chunksSlice := func(rs string, _, _ primitive.Timestamp) ([]pbm.OplogChunk, error) {
+		switch rs {
+		case "rs0":
+			return []pbm.OplogChunk{
+				{RS: rs, FName: "rs0-c1", StartTS: ts(10), EndTS: ts(20)},
+				{RS: rs, FName: "rs0-c2", StartTS: ts(20), EndTS: ts(30)},
+			}, nil
+		default:
+			// a gap between 20 and 25
+			return []pbm.OplogChunk{
+				{RS: rs, FName: "rs1-c1", StartTS: ts(10), EndTS: ts(20)},
+				{RS: rs, FName: "rs1-c3", StartTS: ts(25), EndTS: ts(30)},
+			}, nil
+		}
+	}
+
+	t.Run("findings", func(t *testing.T) {
+		r := preflight(context.Background(), stg, chunksSlice, "bcp", PreflightOptions{
+			PITR:          ts(30),
+			TargetVersion: "7.0.2",
+			TargetRSets:   []string{"rs0"},
+			DBPath:        "/data/db",
+		})
+
+		expect := map[string]PreflightStatus{
+			checkStorage:  PreflightPassed,
+			checkMeta:     PreflightPassed,
+			checkVersion:  PreflightPassed,
+			checkRSMap:    PreflightFailed,
+			checkOplog:    PreflightFailed,
+			checkFreeDisk: PreflightPassed,
+		}
+		if len(r) != len(expect) {
+			t.Fatalf("expected %d findings, got:\n%s", len(expect), r)
+		}
+		for _, f := range r {
+			if f.Status != expect[f.Check] {
+				t.Errorf("%s: expected %s, got %s (%s)", f.Check, expect[f.Check], f.Status, f.Msg)
+			}
+		}
+		if r.OK() {
+			t.Error("expected report to fail")
+		}
+		if n := len(r.Failed()); n != 2 {
+			t.Errorf("expected 2 failed checks, got %d", n)
+		}
+		for _, f := range r.Failed() {
+			if f.Check == checkOplog && (!strings.Contains(f.Msg, "rs1") || strings.Contains(f.Msg, "rs0")) {
+				t.Errorf("expected only rs1 oplog to fail, got %q", f.Msg)
+			}
+		}
+	})
+
+	t.Run("unknown codec", func(t *testing.T) {
+		newer := func(rs string, from, to primitive.Timestamp) ([]pbm.OplogChunk, error) {
+			c, err := chunksSlice(rs, from, to)
+			if len(c) > 0 {
+				c[1].Compression = "brotli"
+			}
+			return c, err
+		}
+		r := preflight(context.Background(), stg, newer, "bcp", PreflightOptions{PITR: ts(30)})
+		for _, f := range r {
+			if f.Check == checkOplog && (f.Status != PreflightFailed || !strings.Contains(f.Msg, "rs0-c2 (brotli)")) {
+				t.Errorf("expected rs0 oplog to fail on the codec, got %s: %q", f.Status, f.Msg)
+			}
+		}
+	})
+
+	t.Run("no meta", func(t *testing.T) {
+		r := preflight(context.Background(), stg, chunksSlice, "unknown", PreflightOptions{PITR: ts(30)})
+		if r.OK() {
+			t.Fatal("expected report to fail")
+		}
+		for _, f := range r {
+			switch f.Check {
+			case checkStorage:
+				if f.Status != PreflightPassed {
+					t.Errorf("storage: expected passed, got %s", f.Status)
+				}
+			case checkMeta:
+				if f.Status != PreflightFailed {
+					t.Errorf("meta: expected failed, got %s", f.Status)
+				}
+			default:
+				if f.Status != PreflightSkipped {
+					t.Errorf("%s: expected skipped, got %s", f.Check, f.Status)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package restore
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// defaultProgressFlush is how often the replay progress is written
+// to the restore metadata if not configured
+const defaultProgressFlush = 5 * time.Second
+
+type writeProgressFn func(lts primitive.Timestamp, eta int64, p *pbm.RestoreProgress) error
+
+// progressFlusher writes the replay progress not more often than once
+// per interval. The progress of the last chunk is always written.
+type progressFlusher struct {
+	interval time.Duration
+	write    writeProgressFn
+	now      func() time.Time
+	last     time.Time
+}
+
+func newProgressFlusher(interval time.Duration, write writeProgressFn) *progressFlusher {
+	if interval <= 0 {
+		interval = defaultProgressFlush
+	}
+
+	return &progressFlusher{
+		interval: interval,
+		write:    write,
+		now:      time.Now,
+	}
+}
+
+func (f *progressFlusher) observe(p replayProgress) error {
+	now := f.now()
+	if p.chunk < p.chunks && !f.last.IsZero() && now.Sub(f.last) < f.interval {
+		return nil
+	}
+	f.last = now
+
+	var eta int64
+	if p.eta > 0 {
+		eta = now.Add(p.eta).Unix()
+	}
+
+	return f.write(p.lts, eta, &pbm.RestoreProgress{
+		Chunk:   p.chunk,
+		Chunks:  p.chunks,
+		Ops:     p.ops,
+		Updated: now.Unix(),
+	})
+}
@@ -0,0 +1,150 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+)
+
+// metaStore keeps the restore meta as it would be stored in the db
+type metaStore struct {
+	raw    []byte
+	writes int
+}
+
+func (s *metaStore) write(lts primitive.Timestamp, eta int64, p *pbm.RestoreProgress) error {
+	m := pbm.RestoreMeta{
+		Name: "restore",
+		Replsets: []pbm.RestoreReplset{{
+			Name:      "rs0",
+			CurrentOp: lts,
+			ETA:       eta,
+			Progress:  p,
+		}},
+	}
+
+	b, err := bson.Marshal(m)
+	if err != nil {
+		return err
+	}
+	s.raw = b
+	s.writes++
+
+	return nil
+}
+
+func (s *metaStore) read(t *testing.T) *pbm.RestoreMeta {
+	t.Helper()
+
+	m := &pbm.RestoreMeta{}
+	if err := bson.Unmarshal(s.raw, m); err != nil {
+		t.Fatalf("unmarshal meta: %v", err)
+	}
+
+	return m
+}
+
+func TestProgressPersisted(t *testing.T) {
+	stg := memStorage{}
+	var chunks []pbm.OplogChunk
+	for i := uint32(0); i < 5; i++ {
+		from, to := 10+i*10, 20+i*10
+		name := fmt.Sprintf("c%d", i)
+		stg[name] = noopChunk(t, from, to)
+		chunks = append(chunks, pbm.OplogChunk{
+			RS: "rs0", FName: name, Compression: compress.CompressionTypeNone,
+			StartTS: primitive.Timestamp{T: from, I: 1}, EndTS: primitive.Timestamp{T: to, I: 1},
+		})
+	}
+
+	store := &metaStore{}
+	f := newProgressFlusher(10*time.Second, store.write)
+	clock := time.Unix(1000, 0)
+	f.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	var flushErr error
+	_, err := applyOplog(context.Background(), nil, chunkList(chunks),
+		&applyOplogOption{
+			unsafe: true,
+			progress: func(p replayProgress) {
+				if err := f.observe(p); err != nil {
+					flushErr = err
+				}
+			},
+		}, false,
+		nil, nil, nil, &pbm.RestoreShardStat{},
+		&pbm.MongoVersion{Version: []int{6, 0, 0}}, stg,
+		log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{}))
+	if err != nil {
+		t.Fatalf("apply oplog: %v", err)
+	}
+	if flushErr != nil {
+		t.Fatalf("flush progress: %v", flushErr)
+	}
+
+	// the first chunk and the last one, others are within the interval
+	if store.writes != 2 {
+		t.Errorf("expected 2 writes, got %d", store.writes)
+	}
+
+	m := store.read(t)
+	rs := m.Replsets[0]
+	if rs.Progress == nil {
+		t.Fatal("expected progress in the restore meta")
+	}
+	if rs.Progress.Chunk != len(chunks) || rs.Progress.Chunks != len(chunks) {
+		t.Errorf("expected %d/%d chunks, got %d/%d",
+			len(chunks), len(chunks), rs.Progress.Chunk, rs.Progress.Chunks)
+	}
+	if !rs.CurrentOp.Equal(chunks[len(chunks)-1].EndTS) {
+		t.Errorf("expected applied ts %v, got %v", chunks[len(chunks)-1].EndTS, rs.CurrentOp)
+	}
+	if rs.Progress.Updated != clock.Unix() {
+		t.Errorf("expected updated at %d, got %d", clock.Unix(), rs.Progress.Updated)
+	}
+}
+
+func TestProgressFlushInterval(t *testing.T) {
+	store := &metaStore{}
+	f := newProgressFlusher(0, store.write)
+	clock := time.Unix(1000, 0)
+	f.now = func() time.Time { return clock }
+
+	for i := 1; i <= 3; i++ {
+		p := replayProgress{lts: primitive.Timestamp{T: uint32(i)}, chunk: i, chunks: 10}
+		if err := f.observe(p); err != nil {
+			t.Fatalf("observe: %v", err)
+		}
+	}
+	if store.writes != 1 {
+		t.Errorf("expected a single write within the interval, got %d", store.writes)
+	}
+
+	clock = clock.Add(defaultProgressFlush)
+	p := replayProgress{lts: primitive.Timestamp{T: 4}, chunk: 4, chunks: 10, eta: time.Minute}
+	if err := f.observe(p); err != nil {
+		t.Fatalf("observe: %v", err)
+	}
+	if store.writes != 2 {
+		t.Errorf("expected write after the interval, got %d writes", store.writes)
+	}
+
+	rs := store.read(t).Replsets[0]
+	if rs.Progress.Chunk != 4 || rs.CurrentOp.T != 4 {
+		t.Errorf("unexpected progress %+v at %v", rs.Progress, rs.CurrentOp)
+	}
+	if rs.ETA != clock.Add(time.Minute).Unix() {
+		t.Errorf("expected eta %d, got %d", clock.Add(time.Minute).Unix(), rs.ETA)
+	}
+}
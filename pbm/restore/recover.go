@@ -0,0 +1,133 @@
+package restore
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+)
+
+// ChunksFromStorage rebuilds the oplog chunks of the replset `rs` in
+// [from, to] from the chunk objects on the storage. It's for the case
+// the chunks index is lost, so the chunks can be passed to the replay
+// instead of the ones of the index. They are checked the same way (see
+// checkChunks). Zero `to` means up to the end of the last chunk.
+// It also returns the objects that don't parse as chunks, see
+// pbm.ListPITRChunks.
+func ChunksFromStorage(
+	stg storage.Storage,
+	rs string,
+	from,
+	to primitive.Timestamp,
+) ([]pbm.OplogChunk, []string, error) {
+	if rs == "" {
+		return nil, nil, errors.New("replset is not set")
+	}
+
+	chunks, unparsed, err := storageChunks(stg, rs, from, to)
+	if err != nil {
+		return nil, unparsed, err
+	}
+
+	chunks, _, err = collectChunks(stg, &sliceChunksIter{chunks: chunks}, from, to, false)
+	if err != nil {
+		return nil, unparsed, err
+	}
+
+	return chunks, unparsed, nil
+}
+
+// storageChunks returns the chunks of the replset on the storage that
+// fall into [from, to], see ChunksFromStorage
+func storageChunks(stg storage.Storage, rs string, from, to primitive.Timestamp) ([]pbm.OplogChunk, []string, error) {
+	all, unparsed, err := pbm.ListPITRChunks(stg, rs)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "list chunks")
+	}
+
+	var chunks []pbm.OplogChunk
+	for _, c := range all {
+		// the same range as of the chunks index
+		if (!to.IsZero() && c.StartTS.After(to)) || c.EndTS.Before(from) {
+			continue
+		}
+		if err := pbm.SetChunkDict(stg, &c); err != nil {
+			if errors.Is(err, storage.ErrNotExist) {
+				err = errors.Wrap(ErrMissingChunk, err.Error())
+			}
+			return nil, unparsed, err
+		}
+		chunks = append(chunks, c)
+	}
+
+	return chunks, unparsed, nil
+}
+
+// storageChunksIndex is the chunks index rebuilt from the chunk objects on
+// the storage. E.g. for the storage the cluster doesn't know of, see
+// Restore.stgConf. Chunks of each replset are listed once.
+func storageChunksIndex(stg storage.Storage) chunksIndex {
+	listed := make(map[string][]pbm.OplogChunk)
+	dictSet := make(map[string]bool)
+	return func(rs string, from, to primitive.Timestamp) chunksIter {
+		all, ok := listed[rs]
+		if !ok {
+			var err error
+			all, _, err = pbm.ListPITRChunks(stg, rs)
+			if err != nil {
+				return &sliceChunksIter{err: errors.Wrap(err, "list chunks")}
+			}
+			listed[rs] = all
+		}
+
+		var chunks []pbm.OplogChunk
+		for i := range all {
+			c := &all[i]
+			if (!to.IsZero() && c.StartTS.After(to)) || c.EndTS.Before(from) {
+				continue
+			}
+			if !dictSet[c.FName] {
+				if err := pbm.SetChunkDict(stg, c); err != nil {
+					if errors.Is(err, storage.ErrNotExist) {
+						err = errors.Wrap(ErrMissingChunk, err.Error())
+					}
+					return &sliceChunksIter{err: err}
+				}
+				dictSet[c.FName] = true
+			}
+			chunks = append(chunks, *c)
+		}
+		return &sliceChunksIter{chunks: chunks}
+	}
+}
+
+// fallbackChunksIndex lists the chunks from the storage (see
+// storageChunksIndex) if idx has no chunks of the replset in the range.
+// E.g. the chunks index of the cluster is lost while the chunks are still
+// on the storage.
+func fallbackChunksIndex(idx chunksIndex, stg storage.Storage, l *log.Event) chunksIndex {
+	fromStorage := storageChunksIndex(stg)
+	warned := make(map[string]bool)
+	mu := sync.Mutex{}
+	return func(rs string, from, to primitive.Timestamp) chunksIter {
+		it := idx(rs, from, to)
+		if it.Next() {
+			return &leadingIter{first: it.Chunk(), rest: it}
+		}
+		if it.Err() != nil {
+			return it
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if !warned[rs] {
+			l.Warning("no oplog chunks of %s in the index, looking for them on the storage", rs)
+			warned[rs] = true
+		}
+		return fromStorage(rs, from, to)
+	}
+}
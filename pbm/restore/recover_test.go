@@ -0,0 +1,145 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+	"github.com/percona/percona-backup-mongodb/pbm/pitr"
+)
+
+func TestChunksFromStorage(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: 1594828700 + t, I: 1} }
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+
+	dict := compress.TrainZstdDict([][]byte{noopChunk(t, 1594828700)}, 1<<10)
+	var zchunk bytes.Buffer
+	w, err := compress.CompressWithDict(&zchunk, compress.CompressionTypeZstandard, nil, dict)
+	if err != nil {
+		t.Fatalf("create zstd writer: %v", err)
+	}
+	if _, err = w.Write(noopChunk(t, ts(20).T, ts(25).T, ts(30).T)); err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+
+	c1 := pitr.ChunkName("rs0", ts(1), ts(10), compress.CompressionTypeNone)
+	c2 := pitr.ChunkName("rs0", ts(10), ts(20), compress.CompressionTypeS2)
+	c3 := pitr.ChunkName("rs0", ts(20), ts(30), compress.CompressionTypeZstandard)
+	dictName := pbm.ZstdDictName("rs0", compress.ZstdDictID(dict))
+	bad := pbm.PITRfsPrefix + "/rs0/20200715/2020071516xxxx-1.20200715160129-1.oplog"
+	stg := memStorage{
+		c1:       noopChunk(t, ts(1).T, ts(5).T, ts(10).T),
+		c2:       rsNoopChunk(t, "rs0", compress.CompressionTypeS2, ts(10).T, ts(15).T, ts(20).T),
+		c3:       zchunk.Bytes(),
+		dictName: dict,
+		bad:      []byte("chunk"),
+		// other replset
+		pitr.ChunkName("rs1", ts(1), ts(30), compress.CompressionTypeNone): noopChunk(t, ts(1).T),
+	}
+
+	chunks, unparsed, err := ChunksFromStorage(stg, "rs0", ts(5), ts(30))
+	if err != nil {
+		t.Fatalf("rebuild chunks: %v", err)
+	}
+	if len(unparsed) != 1 || unparsed[0] != bad {
+		t.Errorf("expected unparsed %s, got %v", bad, unparsed)
+	}
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %+v", chunks)
+	}
+	for i, want := range []pbm.OplogChunk{
+		{RS: "rs0", FName: c1, Compression: compress.CompressionTypeNone, StartTS: ts(1), EndTS: ts(10)},
+		{RS: "rs0", FName: c2, Compression: compress.CompressionTypeS2, StartTS: ts(10), EndTS: ts(20)},
+		{RS: "rs0", FName: c3, Compression: compress.CompressionTypeZstandard, StartTS: ts(20), EndTS: ts(30),
+			Dict: dictName},
+	} {
+		c := chunks[i]
+		if c.RS != want.RS || c.FName != want.FName || c.Compression != want.Compression ||
+			c.StartTS != want.StartTS || c.EndTS != want.EndTS || c.Dict != want.Dict {
+			t.Errorf("chunk %d: expected %+v, got %+v", i, want, c)
+		}
+		if c.Size != int64(len(stg[c.FName])) {
+			t.Errorf("chunk %d: expected size %d, got %d", i, len(stg[c.FName]), c.Size)
+		}
+	}
+
+	// the rebuilt chunks are replayed like the ones of the index
+	stat := &pbm.RestoreShardStat{}
+	_, err = applyOplog(context.Background(), nil, chunkList(chunks), &applyOplogOption{}, false,
+		nil, nil, nil, stat, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+	if err != nil {
+		t.Fatalf("apply rebuilt chunks: %v", err)
+	}
+	if stat.Chunks != 3 || stat.LastTS != ts(30) {
+		t.Errorf("expected 3 chunks replayed up to %v, got %d up to %v", ts(30), stat.Chunks, stat.LastTS)
+	}
+
+	delete(stg, c2)
+	_, _, err = ChunksFromStorage(stg, "rs0", ts(5), ts(30))
+	if !errors.Is(err, ErrChunkGap) {
+		t.Errorf("expected gap error, got %v", err)
+	}
+
+	delete(stg, dictName)
+	_, _, err = ChunksFromStorage(stg, "rs0", ts(20), ts(30))
+	if !errors.Is(err, ErrMissingChunk) {
+		t.Errorf("expected missing dictionary error, got %v", err)
+	}
+}
+
+func TestFallbackChunksIndex(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: 1594828700 + t, I: 1} }
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+
+	c0 := pitr.ChunkName("rs0", ts(1), ts(10), compress.CompressionTypeNone)
+	c1 := pitr.ChunkName("rs1", ts(1), ts(10), compress.CompressionTypeNone)
+	stg := memStorage{
+		c0: noopChunk(t, ts(1).T, ts(10).T),
+		c1: noopChunk(t, ts(1).T, ts(10).T),
+		// not in the index
+		pitr.ChunkName("rs1", ts(10), ts(20), compress.CompressionTypeNone): noopChunk(t, ts(10).T, ts(20).T),
+	}
+	// the index has lost the chunks of rs0
+	db := func(rs string, from, to primitive.Timestamp) chunksIter {
+		if rs == "rs1" {
+			return &sliceChunksIter{chunks: []pbm.OplogChunk{{RS: "rs1", FName: c1, StartTS: ts(1), EndTS: ts(10)}}}
+		}
+		return &sliceChunksIter{}
+	}
+
+	names := func(it chunksIter) []string {
+		t.Helper()
+		var n []string
+		for it.Next() {
+			n = append(n, it.Chunk().FName)
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("iterate chunks: %v", err)
+		}
+		return n
+	}
+
+	idx := fallbackChunksIndex(db, stg, l)
+	if got := names(idx("rs0", ts(1), ts(10))); len(got) != 1 || got[0] != c0 {
+		t.Errorf("expected rs0 chunks from the storage, got %v", got)
+	}
+	if got := names(idx("rs1", ts(1), ts(20))); len(got) != 1 || got[0] != c1 {
+		t.Errorf("expected rs1 chunks from the index only, got %v", got)
+	}
+
+	failed := fallbackChunksIndex(func(string, primitive.Timestamp, primitive.Timestamp) chunksIter {
+		return &sliceChunksIter{err: errors.New("db is down")}
+	}, stg, l)
+	if it := failed("rs0", ts(1), ts(10)); it.Next() || it.Err() == nil {
+		t.Error("expected the index error, not the storage fallback")
+	}
+}
@@ -0,0 +1,639 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+	"github.com/percona/percona-backup-mongodb/pbm/oplog"
+)
+
+func TestReplayRollForward(t *testing.T) {
+	stg := memStorage{
+		"c1": noopChunk(t, 10, 11, 12, 13, 14, 15),
+		"c2": noopChunk(t, 15, 16, 17, 18, 19, 20),
+	}
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone,
+			StartTS: primitive.Timestamp{T: 10, I: 1}, EndTS: primitive.Timestamp{T: 15, I: 1}},
+		{RS: "rs0", FName: "c2", Compression: compress.CompressionTypeNone,
+			StartTS: primitive.Timestamp{T: 15, I: 1}, EndTS: primitive.Timestamp{T: 20, I: 1}},
+	}
+
+	lastWrite := primitive.Timestamp{T: 12, I: 1}
+	from := primitive.Timestamp{T: 12, I: 1}
+	to := primitive.Timestamp{T: 18, I: 1}
+	if err := checkReplayStart(lastWrite, from); err != nil {
+		t.Fatalf("unexpected guard error: %v", err)
+	}
+
+	var applied []primitive.Timestamp
+	_, err := applyOplog(context.Background(), nil, chunkList(chunks),
+		&applyOplogOption{
+			start:  &from,
+			end:    &to,
+			unsafe: true,
+			progress: func(p replayProgress) {
+				applied = append(applied, p.lts)
+			},
+		}, false,
+		nil, nil, nil, &pbm.RestoreShardStat{},
+		&pbm.MongoVersion{Version: []int{6, 0, 0}}, stg,
+		log.New(nil, "rs0", "node").NewEvent("replay", "test", "", primitive.Timestamp{}))
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+
+	if len(applied) != len(chunks) {
+		t.Fatalf("expected progress for %d chunks, got %v", len(chunks), applied)
+	}
+	if !applied[len(applied)-1].Equal(to) {
+		t.Errorf("expected replay to stop on %v, got %v", to, applied[len(applied)-1])
+	}
+}
+
+func TestReplayTargetPastStart(t *testing.T) {
+	from := primitive.Timestamp{T: 100, I: 1}
+
+	cases := []struct {
+		lastWrite primitive.Timestamp
+		fail      bool
+	}{
+		// no user writes
+		{primitive.Timestamp{}, false},
+		{primitive.Timestamp{T: 99, I: 5}, false},
+		{primitive.Timestamp{T: 100, I: 1}, false},
+		{primitive.Timestamp{T: 100, I: 2}, true},
+		{primitive.Timestamp{T: 200, I: 1}, true},
+	}
+
+	for _, c := range cases {
+		err := checkReplayStart(c.lastWrite, from)
+		if (err != nil) != c.fail {
+			t.Errorf("last write %v, start %v: expected fail %v, got %v", c.lastWrite, from, c.fail, err)
+		}
+	}
+}
+
+func TestCheckOplogVersion(t *testing.T) {
+	cases := []struct {
+		src, dst string
+		fail     bool
+	}{
+		{"6.0.5", "6.0.9", false},
+		{"4.4.18", "5.0.14", false},
+		{"5.0.14", "6.0.5-4", false},
+		{"4.2.1", "4.4.0", false},
+		{"6.0.5", "4.4.18", true},
+		{"5.0.14", "4.4.18", true},
+		{"4.4.18", "6.0.5", true},
+		{"", "6.0.5", false},
+	}
+
+	for _, c := range cases {
+		err := checkOplogVersion(c.src, c.dst)
+		if (err != nil) != c.fail {
+			t.Errorf("%q onto %q: expected fail %v, got %v", c.src, c.dst, c.fail, err)
+		}
+	}
+}
+
+func TestReplayRejectsIncompatibleVersion(t *testing.T) {
+	stg := memStorage{"c1": noopChunk(t, 10, 11, 12)}
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone,
+			StartTS: primitive.Timestamp{T: 10, I: 1}, EndTS: primitive.Timestamp{T: 12, I: 1}},
+	}
+
+	applied := false
+	_, err := applyOplog(context.Background(), nil, chunkList(chunks),
+		&applyOplogOption{
+			unsafe:     true,
+			srcVersion: "6.0.5",
+			progress: func(replayProgress) {
+				applied = true
+			},
+		}, false,
+		nil, nil, nil, &pbm.RestoreShardStat{},
+		&pbm.MongoVersion{VersionString: "4.4.18", Version: []int{4, 4, 18}}, stg,
+		log.New(nil, "rs0", "node").NewEvent("replay", "test", "", primitive.Timestamp{}))
+	if err == nil || !strings.Contains(err.Error(), "cannot restore 6.0.5 oplog onto 4.4.18") {
+		t.Fatalf("expected version error, got %v", err)
+	}
+	if applied {
+		t.Errorf("expected no chunks applied")
+	}
+}
+
+func TestReplayFCV(t *testing.T) {
+	stg := memStorage{"c1": noopChunk(t, 10, 11, 12)}
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone,
+			StartTS: primitive.Timestamp{T: 10, I: 1}, EndTS: primitive.Timestamp{T: 12, I: 1}},
+	}
+
+	cases := []struct {
+		src, dst string
+		fail     bool
+	}{
+		{"6.0", "6.0", false},
+		{"5.0", "6.0", false},
+		{"", "5.0", false},
+		{"6.0", "5.0", true},
+		{"7.0", "6.0", true},
+	}
+	for _, c := range cases {
+		t.Run(c.src+"/"+c.dst, func(t *testing.T) {
+			applied := false
+			_, err := applyOplog(context.Background(), nil, chunkList(chunks),
+				&applyOplogOption{
+					unsafe: true,
+					srcFCV: c.src,
+					dstFCV: c.dst,
+					progress: func(replayProgress) {
+						applied = true
+					},
+				}, false,
+				nil, nil, nil, &pbm.RestoreShardStat{},
+				&pbm.MongoVersion{VersionString: "6.0.5", Version: []int{6, 0, 5}}, stg,
+				log.New(nil, "rs0", "node").NewEvent("replay", "test", "", primitive.Timestamp{}))
+
+			if !c.fail {
+				if err != nil {
+					t.Fatalf("apply oplog: %v", err)
+				}
+				if !applied {
+					t.Error("expected the chunk applied")
+				}
+				return
+			}
+
+			want := fmt.Sprintf("cannot restore oplog made with FCV %s onto FCV %s", c.src, c.dst)
+			if !errors.Is(err, ErrIncompatibleVersion) || !strings.Contains(err.Error(), want) {
+				t.Fatalf("expected FCV error, got %v", err)
+			}
+			if applied {
+				t.Error("expected no chunks applied")
+			}
+		})
+	}
+}
+
+func TestSkipSystemOps(t *testing.T) {
+	o := &applyOplogOption{
+		skipSystemNS: true,
+		filter:       func(r *oplog.Record) bool { return r.Namespace != "test.skip" },
+	}
+	f := o.opFilter()
+
+	for ns, keep := range map[string]bool{
+		"config.chunks":      false,
+		"local.oplog.rs":     false,
+		"admin.system.users": false,
+		"test.c":             true,
+		"test.skip":          false,
+	} {
+		if got := f(&oplog.Record{Operation: "i", Namespace: ns}); got != keep {
+			t.Errorf("%s: expected %v, got %v", ns, keep, got)
+		}
+	}
+
+	o = &applyOplogOption{skipSystemNS: true}
+	if !o.opFilter()(&oplog.Record{Operation: "i", Namespace: "test.c"}) {
+		t.Error("expected user op to pass without filter")
+	}
+}
+
+func TestReplayOpenEnded(t *testing.T) {
+	stg := memStorage{
+		"c1": indexOpsChunkAt(t, 10, createIndexOp("c", "a"), createIndexOp("c", "b")),
+		"c2": indexOpsChunkAt(t, 12, createIndexOp("d", "a")),
+		"c3": indexOpsChunkAt(t, 13, dropIndexOp("c", "a"), dropIndexOp("d", "a")),
+	}
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone, StartTS: ts(10), EndTS: ts(11)},
+		{RS: "rs0", FName: "c2", Compression: compress.CompressionTypeNone, StartTS: ts(11), EndTS: ts(12)},
+		{RS: "rs0", FName: "c3", Compression: compress.CompressionTypeNone, StartTS: ts(12), EndTS: ts(14)},
+	}
+
+	start := ts(10)
+	if err := checkChunks(stg, chunks, start, primitive.Timestamp{}); err != nil {
+		t.Fatalf("open-ended check: %v", err)
+	}
+	end := pbm.SummarizeChunks(chunks).To
+
+	bus := NewEventBus()
+	events, unsubscribe := bus.Subscribe(len(chunks))
+
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+	o := &applyOplogOption{start: &start, end: &end, unsafe: true, events: bus}
+	_, err := applyOplog(context.Background(), nil, chunkList(chunks), o, false,
+		nil, nil, nil, &pbm.RestoreShardStat{}, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	unsubscribe()
+
+	var applied int64
+	for e := range events {
+		if c, ok := e.(ChunkApplied); ok {
+			applied += c.OpsApplied
+		}
+	}
+	if applied != 5 {
+		t.Errorf("expected all 5 ops to be applied, got %d", applied)
+	}
+
+	// contiguity is still checked
+	gap := []pbm.OplogChunk{chunks[0], chunks[2]}
+	if err := checkChunks(stg, gap, start, primitive.Timestamp{}); err == nil {
+		t.Errorf("expected gap to be reported")
+	}
+}
+
+// streamedChunks are oplogChunks read as of the chunks index: each
+// iteration is read anew and checked for gaps
+type streamedChunks struct {
+	chunks []pbm.OplogChunk
+	from   primitive.Timestamp
+	reads  int
+}
+
+func (s *streamedChunks) iter() chunksIter {
+	s.reads++
+	return &timelineIter{
+		chunksIter: &sliceChunksIter{chunks: s.chunks},
+		tl:         newChunksTimeline(s.from, primitive.Timestamp{}, false),
+	}
+}
+
+func (s *streamedChunks) summary() pbm.ChunksSummary { return pbm.SummarizeChunks(s.chunks) }
+
+func TestReplayStreamedChunks(t *testing.T) {
+	stg := memStorage{
+		"c1": noopChunk(t, 10, 11),
+		"c2": noopChunk(t, 11, 12),
+		"c3": noopChunk(t, 14, 15),
+	}
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	c1 := pbm.OplogChunk{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone, StartTS: ts(10), EndTS: ts(11)}
+	c2 := pbm.OplogChunk{RS: "rs0", FName: "c2", Compression: compress.CompressionTypeNone, StartTS: ts(11), EndTS: ts(12)}
+	c3 := pbm.OplogChunk{RS: "rs0", FName: "c3", Compression: compress.CompressionTypeNone, StartTS: ts(14), EndTS: ts(15)}
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+
+	t.Run("pre-download", func(t *testing.T) {
+		chunks := &streamedChunks{chunks: []pbm.OplogChunk{c1, c2}, from: ts(10)}
+		stat := &pbm.RestoreShardStat{}
+		_, err := applyOplog(context.Background(), nil, chunks,
+			&applyOplogOption{unsafe: true, preDownload: true, preDownloadDir: t.TempDir()}, false,
+			nil, nil, nil, stat, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+		if err != nil {
+			t.Fatalf("replay: %v", err)
+		}
+		if stat.Chunks != 2 {
+			t.Errorf("expected 2 chunks replayed, got %d", stat.Chunks)
+		}
+		if chunks.reads != 2 {
+			t.Errorf("expected chunks to be read for the download and the replay, got %d reads", chunks.reads)
+		}
+	})
+
+	// e.g. the index is changed since chunks() checked it
+	t.Run("gap", func(t *testing.T) {
+		for name, o := range map[string]*applyOplogOption{
+			"direct":   {unsafe: true},
+			"prefetch": {unsafe: true, prefetch: 2, prefetchBudget: NewMemBudget(1 << 20)},
+		} {
+			stat := &pbm.RestoreShardStat{}
+			_, err := applyOplog(context.Background(), nil, &streamedChunks{chunks: []pbm.OplogChunk{c1, c2, c3}}, o, false,
+				nil, nil, nil, stat, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+			if !errors.Is(err, ErrChunkGap) {
+				t.Errorf("%s: expected gap error, got %v", name, err)
+			}
+			if stat.Chunks != 2 {
+				t.Errorf("%s: expected chunks before the gap to be replayed, got %d", name, stat.Chunks)
+			}
+		}
+	})
+}
+
+func TestReplayDictChunk(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	dict := compress.TrainZstdDict([][]byte{noopChunk(t, 1, 2, 3)}, 1<<10)
+
+	var buf bytes.Buffer
+	w, err := compress.CompressWithDict(&buf, compress.CompressionTypeZstandard, nil, dict)
+	if err != nil {
+		t.Fatalf("create writer: %v", err)
+	}
+	if _, err = w.Write(noopChunk(t, 4, 5)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+
+	dictName := pbm.ZstdDictName("rs0", compress.ZstdDictID(dict))
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeZstandard, StartTS: ts(1), EndTS: ts(3)},
+		{RS: "rs0", FName: "c2", Compression: compress.CompressionTypeZstandard, StartTS: ts(3), EndTS: ts(5),
+			Dict: dictName},
+	}
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+
+	t.Run("with dict", func(t *testing.T) {
+		stg := memStorage{
+			"c1":     rsNoopChunk(t, "rs0", compress.CompressionTypeZstandard, 1, 2, 3),
+			"c2":     buf.Bytes(),
+			dictName: dict,
+		}
+
+		var lts []primitive.Timestamp
+		_, err := applyOplog(context.Background(), nil, chunkList(chunks),
+			&applyOplogOption{progress: func(p replayProgress) { lts = append(lts, p.lts) }}, false,
+			nil, nil, nil, &pbm.RestoreShardStat{}, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+		if err != nil {
+			t.Fatalf("apply oplog: %v", err)
+		}
+		if !reflect.DeepEqual(lts, []primitive.Timestamp{ts(3), ts(5)}) {
+			t.Errorf("expected all chunks replayed, got %v", lts)
+		}
+	})
+
+	t.Run("no dict file", func(t *testing.T) {
+		stg := memStorage{
+			"c1": rsNoopChunk(t, "rs0", compress.CompressionTypeZstandard, 1, 2, 3),
+			"c2": buf.Bytes(),
+		}
+
+		_, err := applyOplog(context.Background(), nil, chunkList(chunks), &applyOplogOption{}, false,
+			nil, nil, nil, &pbm.RestoreShardStat{}, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+		if err == nil || !strings.Contains(err.Error(), dictName) {
+			t.Errorf("expected an error on the missing dictionary %s, got %v", dictName, err)
+		}
+	})
+}
+
+// readSizesStorage records the sizes of the reads of the objects
+type readSizesStorage struct {
+	memStorage
+	sizes *[]int
+}
+
+func (s readSizesStorage) SourceReader(name string) (io.ReadCloser, error) {
+	r, err := s.memStorage.SourceReader(name)
+	if err != nil {
+		return nil, err
+	}
+	return readSizesReader{r, s.sizes}, nil
+}
+
+type readSizesReader struct {
+	io.ReadCloser
+	sizes *[]int
+}
+
+func (r readSizesReader) Read(p []byte) (int, error) {
+	*r.sizes = append(*r.sizes, len(p))
+	return r.ReadCloser.Read(p)
+}
+
+func TestReplayReadBuffer(t *testing.T) {
+	const bufSize = 64 << 10
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+
+	for _, c := range []compress.CompressionType{compress.CompressionTypeNone, compress.CompressionTypeS2} {
+		for _, size := range []int{0, bufSize} {
+			t.Run(fmt.Sprintf("%s/%d", c, size), func(t *testing.T) {
+				var sizes []int
+				stg := readSizesStorage{
+					memStorage: memStorage{"c1": rsNoopChunk(t, "rs0", c, 1, 2, 3)},
+					sizes:      &sizes,
+				}
+				chunks := []pbm.OplogChunk{
+					{RS: "rs0", FName: "c1", Compression: c, StartTS: ts(1), EndTS: ts(3)},
+				}
+
+				_, err := applyOplog(context.Background(), nil, chunkList(chunks), &applyOplogOption{readBuffer: size}, false,
+					nil, nil, nil, &pbm.RestoreShardStat{}, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+				if err != nil {
+					t.Fatalf("apply oplog: %v", err)
+				}
+				if len(sizes) == 0 {
+					t.Fatal("no reads from the storage")
+				}
+
+				if size == 0 {
+					if sizes[0] >= bufSize {
+						t.Errorf("expected the decoder's own reads without the buffer, got %v", sizes)
+					}
+					return
+				}
+				for _, n := range sizes {
+					if n != size {
+						t.Errorf("expected all reads of %d bytes, got %v", size, sizes)
+						break
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestReplayTiming(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+
+	stg := memStorage{
+		"c1": rsNoopChunk(t, "rs0", compress.CompressionTypeS2, 1, 2, 3),
+		"c2": rsNoopChunk(t, "rs0", compress.CompressionTypeS2, 4, 5),
+		"c3": rsNoopChunk(t, "rs0", compress.CompressionTypeNone, 6, 7, 8),
+	}
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeS2, StartTS: ts(1), EndTS: ts(3)},
+		{RS: "rs0", FName: "c2", Compression: compress.CompressionTypeS2, StartTS: ts(3), EndTS: ts(5)},
+		{RS: "rs0", FName: "c3", Compression: compress.CompressionTypeNone, StartTS: ts(5), EndTS: ts(8)},
+	}
+
+	stat := &pbm.RestoreShardStat{}
+	_, err := applyOplog(context.Background(), nil, chunkList(chunks), &applyOplogOption{}, false,
+		nil, nil, nil, stat, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+	if err != nil {
+		t.Fatalf("apply oplog: %v", err)
+	}
+
+	want := int64(len(rsNoopChunk(t, "rs0", compress.CompressionTypeNone, 1, 2, 3)) +
+		len(rsNoopChunk(t, "rs0", compress.CompressionTypeNone, 4, 5)) +
+		len(rsNoopChunk(t, "rs0", compress.CompressionTypeNone, 6, 7, 8)))
+	if stat.Timing.Bytes != want {
+		t.Errorf("expected %d decompressed bytes, got %d", want, stat.Timing.Bytes)
+	}
+	if stat.Timing.Read < 0 || stat.Timing.Apply < 0 {
+		t.Errorf("expected non-negative timings, got %+v", stat.Timing)
+	}
+	if stat.Timing.Read+stat.Timing.Apply == 0 {
+		t.Errorf("expected the replay time recorded, got %+v", stat.Timing)
+	}
+}
+
+func TestReplayContinueOnApplyError(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+
+	chunk := noopChunk(t, 1)
+	// the insert is rejected by the server, see dupKeyRunner
+	bad, err := bson.Marshal(bson.M{"ts": ts(2), "op": "i", "ns": "test.c", "o": bson.M{"_id": 2}})
+	if err != nil {
+		t.Fatalf("marshal oplog entry: %v", err)
+	}
+	chunk = append(append(chunk, bad...), noopChunk(t, 3)...)
+
+	stg := memStorage{"c1": chunk}
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone, StartTS: ts(1), EndTS: ts(3)},
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		stat := &pbm.RestoreShardStat{}
+		_, err := applyOplog(context.Background(), nil, chunkList(chunks), &applyOplogOption{runner: dupKeyRunner{}}, false,
+			nil, nil, nil, stat, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if stat.Chunks != 0 || stat.Ops.Failed != 0 {
+			t.Errorf("expected no chunks replayed, got %+v", stat)
+		}
+	})
+
+	t.Run("continue", func(t *testing.T) {
+		stat := &pbm.RestoreShardStat{}
+		o := &applyOplogOption{continueOnApplyError: true, runner: dupKeyRunner{}}
+		_, err := applyOplog(context.Background(), nil, chunkList(chunks), o, false,
+			nil, nil, nil, stat, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+		if err != nil {
+			t.Fatalf("apply oplog: %v", err)
+		}
+		if stat.Chunks != 1 || !stat.LastTS.Equal(ts(3)) {
+			t.Errorf("expected the chunk replayed up to %v, got %d chunks up to %v", ts(3), stat.Chunks, stat.LastTS)
+		}
+		if stat.Ops.Failed != 1 {
+			t.Errorf("expected 1 failed op, got %d", stat.Ops.Failed)
+		}
+		if len(stat.ApplyErrors) != 1 {
+			t.Fatalf("expected 1 apply error, got %v", stat.ApplyErrors)
+		}
+		if e := stat.ApplyErrors[0]; !e.TS.Equal(ts(2)) || e.NS != "test.c" || e.Op != "i" || e.Error == "" {
+			t.Errorf("unexpected apply error %+v", e)
+		}
+	})
+}
+
+// dupKeyRunner fails all commands with the duplicate key error
+type dupKeyRunner struct{}
+
+func (dupKeyRunner) RunCommand(context.Context, string, bson.D) *mongo.SingleResult {
+	return mongo.NewSingleResultFromDocument(bson.D{},
+		mongo.CommandError{Code: 11000, Name: "DuplicateKey", Message: "E11000 duplicate key"}, nil)
+}
+
+func TestReplayChunkReader(t *testing.T) {
+	data := [][]byte{
+		rsNoopChunk(t, "rs0", compress.CompressionTypeS2, 1, 2, 3),
+		rsNoopChunk(t, "rs0", compress.CompressionTypeS2, 4, 5),
+	}
+	stg := memStorage{"c1": data[0], "c2": data[1]}
+
+	newOplog := func() *oplog.OplogRestore {
+		o, err := oplog.NewOplogRestore(nil, nil, &pbm.MongoVersion{Version: []int{6, 0, 0}}, false, true, nil, nil)
+		if err != nil {
+			t.Fatalf("create oplog: %v", err)
+		}
+		return o
+	}
+
+	var want []primitive.Timestamp
+	o := newOplog()
+	for _, f := range []string{"c1", "c2"} {
+		lts, _, err := replayChunk(context.Background(), f, "", o, stg, compress.CompressionTypeS2,
+			nil, 0, 0, nil, &chunkTiming{})
+		if err != nil {
+			t.Fatalf("replay %s: %v", f, err)
+		}
+		if lts.IsZero() {
+			t.Fatalf("replay %s: nothing read", f)
+		}
+		want = append(want, lts)
+	}
+
+	// compressed as stored and decompressed ahead
+	for _, decompressed := range []bool{false, true} {
+		o := newOplog()
+		for i, d := range data {
+			c := compress.CompressionTypeS2
+			var r io.ReadCloser = io.NopCloser(bytes.NewReader(d))
+			if decompressed {
+				dr, err := compress.Decompress(bytes.NewReader(d), c)
+				if err != nil {
+					t.Fatalf("decompress: %v", err)
+				}
+				r, c = dr, compress.CompressionTypeNone
+			}
+
+			lts, _, err := replayChunkReader(r, "c", o, c, nil, 0, nil, &chunkTiming{})
+			if err != nil {
+				t.Fatalf("decompressed %v: replay chunk %d: %v", decompressed, i, err)
+			}
+			if lts != want[i] {
+				t.Errorf("decompressed %v: chunk %d: expected last ts %v, got %v", decompressed, i, want[i], lts)
+			}
+		}
+	}
+}
+
+// slowOpenStorage delays opening objects
+type slowOpenStorage struct {
+	memStorage
+	delay time.Duration
+}
+
+func (s slowOpenStorage) SourceReader(name string) (io.ReadCloser, error) {
+	time.Sleep(s.delay)
+	return s.memStorage.SourceReader(name)
+}
+
+func TestReplayChunkOpenTiming(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	stg := slowOpenStorage{
+		memStorage: memStorage{"c1": rsNoopChunk(t, "rs0", compress.CompressionTypeS2, 1, 2)},
+		delay:      delay,
+	}
+	o, err := oplog.NewOplogRestore(nil, nil, &pbm.MongoVersion{Version: []int{6, 0, 0}}, false, true, nil, nil)
+	if err != nil {
+		t.Fatalf("create oplog: %v", err)
+	}
+
+	var tm chunkTiming
+	_, _, err = replayChunk(context.Background(), "c1", "", o, stg, compress.CompressionTypeS2,
+		nil, 0, 0, nil, &tm)
+	if err != nil {
+		t.Fatalf("replay chunk: %v", err)
+	}
+	if tm.read < delay || tm.total < delay {
+		t.Errorf("expected the open time counted, got read %v, total %v", tm.read, tm.total)
+	}
+}
@@ -0,0 +1,61 @@
+package restore
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+func TestCheckRerun(t *testing.T) {
+	done := &pbm.RestoreMeta{Name: "r1", OPID: "op1", Status: pbm.StatusDone, LastTransitionTS: 1672531200}
+
+	cases := []struct {
+		name  string
+		prev  *pbm.RestoreMeta
+		rerun bool
+		err   error
+	}{
+		{name: "first run"},
+		{name: "done", prev: done, err: ErrRestoreDone},
+		{name: "done rerun", prev: done, rerun: true},
+		{name: "failed", prev: &pbm.RestoreMeta{Name: "r1", OPID: "op1", Status: pbm.StatusError}},
+		// non-leaders may see the current run already started by the leader
+		{name: "running", prev: &pbm.RestoreMeta{Name: "r1", OPID: "op1", Status: pbm.StatusStarting}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkRerun(c.prev, c.rerun)
+			if !errors.Is(err, c.err) || (c.err == nil && err != nil) {
+				t.Errorf("expected %v, got %v", c.err, err)
+			}
+		})
+	}
+}
+
+func TestRunMeta(t *testing.T) {
+	var meta *pbm.RestoreMeta
+	get := runMeta(func() (*pbm.RestoreMeta, error) {
+		if meta == nil {
+			return nil, pbm.ErrNotFound
+		}
+		return meta, nil
+	}, "op2")
+
+	if _, err := get(); !errors.Is(err, pbm.ErrNotFound) {
+		t.Errorf("expected not found without meta, got %v", err)
+	}
+
+	// the leader hasn't replaced the previous run yet
+	meta = &pbm.RestoreMeta{Name: "r1", OPID: "op1", Status: pbm.StatusError}
+	if _, err := get(); !errors.Is(err, pbm.ErrNotFound) {
+		t.Errorf("expected the previous run not found, got %v", err)
+	}
+
+	meta = &pbm.RestoreMeta{Name: "r1", OPID: "op2", Status: pbm.StatusStarting, PrevOPID: "op1"}
+	if got, err := get(); err != nil || got != meta {
+		t.Errorf("expected the current run, got %v, %v", got, err)
+	}
+}
@@ -1,14 +1,24 @@
 package restore
 
 import (
-	"encoding/json"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang/snappy"
+	"github.com/mongodb/mongo-tools/common/db"
 	"github.com/mongodb/mongo-tools/common/idx"
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/mod/semver"
 
 	"github.com/percona/percona-backup-mongodb/pbm"
 	"github.com/percona/percona-backup-mongodb/pbm/compress"
@@ -17,263 +27,1420 @@ import (
 	"github.com/percona/percona-backup-mongodb/pbm/storage"
 )
 
-func GetMetaFromStore(stg storage.Storage, bcpName string) (*pbm.BackupMeta, error) {
-	rd, err := stg.SourceReader(bcpName + pbm.MetadataFileSuffix)
+// GetMetaFromStore reads the backup metadata from the storage. The read
+// is aborted once the ctx is done.
+func GetMetaFromStore(ctx context.Context, stg storage.Storage, bcpName string) (*pbm.BackupMeta, error) {
+	rd, err := storage.SourceReaderContext(ctx, stg, bcpName+pbm.MetadataFileSuffix)
 	if err != nil {
 		return nil, errors.Wrap(err, "get from store")
 	}
 	defer rd.Close()
 
-	b := &pbm.BackupMeta{}
-	err = json.NewDecoder(rd).Decode(b)
+	b, err := pbm.DecodeBackupMeta(rd)
+	if err != nil {
+		return nil, err
+	}
 
-	return b, errors.Wrap(err, "decode")
+	return b, pbm.UpgradeBackupMeta(b)
 }
 
 func toState(
+	ctx context.Context,
+	clk Clock,
 	cn *pbm.PBM,
 	status pbm.Status,
 	bcp string,
 	inf *pbm.NodeInfo,
 	reconcileFn reconcileStatus,
 	wait *time.Duration,
+	timeouts map[pbm.Status]time.Duration,
+	mc *metaCache,
+) error {
+	set := func() error {
+		err := cn.ChangeRestoreRSState(bcp, inf.SetName, status, "")
+		if err != nil {
+			return errors.Wrap(err, "set shard's status")
+		}
+		mc.Invalidate()
+		return nil
+	}
+
+	return traceState(ctx, status, inf, statusTimeout(timeouts, status, wait), set, reconcileFn,
+		func() error { return waitForStatus(clk, cn, mc, status) })
+}
+
+// traceState sets the node status and moves the cluster to it (see
+// transitState) within the toState span, the reconcile and wait steps
+// get their own child spans.
+//
+//nolint:nonamedreturns
+func traceState(
+	ctx context.Context,
+	status pbm.Status,
+	inf *pbm.NodeInfo,
+	wait *time.Duration,
+	set func() error,
+	reconcileFn reconcileStatus,
+	waitForFn func() error,
+) (err error) {
+	ctx, span := startSpan(ctx, "toState", attrStatus.String(string(status)), attrRS.String(inf.SetName))
+	defer func() { endSpan(span, err) }()
+
+	if err := set(); err != nil {
+		return err
+	}
+
+	reconcile := func(status pbm.Status, timeout *time.Duration) error {
+		_, cspan := startSpan(ctx, "convergeCluster", attrStatus.String(string(status)))
+		err := reconcileFn(status, timeout)
+		endSpan(cspan, err)
+		return err
+	}
+	waitFor := func() error {
+		_, wspan := startSpan(ctx, "waitForStatus", attrStatus.String(string(status)))
+		err := waitForFn()
+		endSpan(wspan, err)
+		return err
+	}
+
+	return transitState(status, inf.IsLeader(), wait, reconcile, waitFor)
+}
+
+// transitState moves the cluster to the status. The leader reconciles the
+// cluster and then everyone waits for the restore to reach the status. The
+// leader that failed to reconcile (e.g. timed out) returns reconcileError,
+// so its failure fails the restore for the whole cluster (see MarkFailed)
+// and followers stop waiting with the same error.
+func transitState(
+	status pbm.Status,
+	leader bool,
+	wait *time.Duration,
+	reconcile reconcileStatus,
+	waitFor func() error,
 ) error {
-	err := cn.ChangeRestoreRSState(bcp, inf.SetName, status, "")
+	if leader {
+		err := reconcile(status, wait)
+		if err != nil {
+			if errors.Is(err, ErrConvergeTimeout) {
+				return reconcileError{errors.Wrapf(err, "couldn't get response from all shards for `%s`", status)}
+			}
+			return reconcileError{errors.Wrapf(err, "check cluster for restore `%s`", status)}
+		}
+	}
+
+	err := waitFor()
 	if err != nil {
-		return errors.Wrap(err, "set shard's status")
+		return errors.Wrapf(err, "waiting for %s", status)
+	}
+
+	return nil
+}
+
+// reconcileError is the failure of the leader to move the cluster to
+// the next status
+type reconcileError struct {
+	err error
+}
+
+func (e reconcileError) Error() string { return e.err.Error() }
+
+func (e reconcileError) Unwrap() error { return e.err }
+
+// failsCluster returns true if the error fails the restore for the whole
+// cluster. Otherwise, with the drain policy, only the replset is failed.
+// The failure of the leader always fails the cluster as there is no one
+// else to move the cluster through the restore statuses.
+func failsCluster(e error, drain, leader bool) bool {
+	var re reconcileError
+	return !drain || leader || errors.Is(e, errShardsDrained) || errors.As(e, &re)
+}
+
+type reconcileStatus func(status pbm.Status, timeout *time.Duration) error
+
+// statusTimeout returns the timeout configured for the status transition
+// if any, or the given default one otherwise (nil means no limit)
+func statusTimeout(
+	timeouts map[pbm.Status]time.Duration,
+	status pbm.Status,
+	def *time.Duration,
+) *time.Duration {
+	if t, ok := timeouts[status]; ok && t > 0 {
+		return &t
 	}
 
-	if inf.IsLeader() {
-		err = reconcileFn(status, wait)
+	return def
+}
+
+// convergeCluster waits until all participating shards reached `status` and updates a cluster status
+func convergeCluster(
+	clk Clock,
+	cn *pbm.PBM,
+	mc *metaCache,
+	opid string,
+	shards []pbm.Shard,
+	status pbm.Status,
+	bc beatsCheck,
+) error {
+	return pollStatus(cn.Context(), clk, bc.pollInterval(), nil, func() (bool, error) {
+		return converged(cn, mc, opid, shards, status, bc)
+	}, nil)
+}
+
+// ErrAborted means the restore was aborted by the user via pbm.AbortRestore
+var ErrAborted = errors.New("aborted by user")
+
+// Categories of restore failures. Errors are wrapped with details,
+// use errors.Is to match them.
+var (
+	// ErrChunkGap means oplog chunks don't cover the restore time range
+	ErrChunkGap = errors.New("oplog chunks gap")
+	// ErrMissingChunk means there is no oplog chunk on the storage
+	// or in the chunks index
+	ErrMissingChunk = errors.New("missing oplog chunk")
+	// ErrShardLost means a shard (or the whole restore) stopped
+	// sending heartbeats
+	ErrShardLost = errors.New("shard lost")
+	// ErrConvergeTimeout means not all shards reached the status in time
+	ErrConvergeTimeout = errors.New("reached converge timeout")
+	// ErrIncompatibleVersion means the backup can't be restored onto the
+	// running PBM or mongo version
+	ErrIncompatibleVersion = errors.New("incompatible version")
+	// ErrRoleChanged means the node is no longer a valid restore target
+	// (e.g. stepped down) during the oplog replay
+	ErrRoleChanged = errors.New("node role changed")
+	// ErrUnsupportedCompression means oplog chunks are compressed with
+	// a codec unknown to this PBM version (e.g. made by a newer one)
+	ErrUnsupportedCompression = errors.New("unsupported compression")
+)
+
+func checkAborted(meta *pbm.RestoreMeta) error {
+	if meta != nil && meta.Abort {
+		return ErrAborted
+	}
+
+	return nil
+}
+
+func convergeTimeoutError(status pbm.Status, t time.Duration) error {
+	return errors.Wrapf(ErrConvergeTimeout, "status `%s` after %v", status, t)
+}
+
+// convergeClusterWithTimeout waits up to the geiven timeout until all participating shards reached
+// `status` and then updates the cluster status
+func convergeClusterWithTimeout(
+	clk Clock,
+	cn *pbm.PBM,
+	mc *metaCache,
+	opid string,
+	shards []pbm.Shard,
+	status pbm.Status,
+	t time.Duration,
+	bc beatsCheck,
+) error {
+	return pollStatus(cn.Context(), clk, bc.pollInterval(), &t, func() (bool, error) {
+		return converged(cn, mc, opid, shards, status, bc)
+	}, func() error {
+		return convergeTimeoutError(status, t)
+	})
+}
+
+// defaultSkewWarnSec is the default spread of shards heartbeats (in
+// seconds) to warn on. Nodes beat every few seconds, so a bigger spread
+// most likely means clocks aren't aligned.
+const defaultSkewWarnSec = 10
+
+// beatsCheck checks if shards are alive by their lock heartbeats
+type beatsCheck struct {
+	// skewWarn is the spread of heartbeats (in seconds) to warn on
+	skewWarn uint32
+	// relax extends the stale frame by the spread of heartbeats, but
+	// no more than twice, so the genuinely stale shard is still caught
+	relax bool
+	// drain doesn't fail the convergence on a failed shard until
+	// other shards reached the status, see pbm.ShardErrorDrain
+	drain bool
+	l     *log.Event
+
+	// poll is how often statuses are polled, a second if not set
+	poll time.Duration
+	// stale, if set, limits how often heartbeats are checked for
+	// staleness. Otherwise, they're checked on every poll
+	stale *staleCadence
+	// warned, if set, keeps the spread warned on, so it's warned
+	// only as it grows. Otherwise, it's warned on every poll
+	warned *skewWarned
+	// recorded, if set, keeps the spread recorded to the restore meta,
+	// so it's written only as it grows. Otherwise, it's written on every poll
+	recorded *skewWarned
+}
+
+func newBeatsCheck(conf pbm.RestoreConf, clk Clock, l *log.Event) beatsCheck {
+	c := beatsCheck{
+		skewWarn: defaultSkewWarnSec,
+		relax:    conf.RelaxStaleOnSkew,
+		drain:    conf.DrainOnShardError(),
+		l:        l,
+		poll:     time.Duration(conf.StatusPollMs) * time.Millisecond,
+		warned:   &skewWarned{},
+		recorded: &skewWarned{},
+	}
+	if conf.ClockSkewWarnSec > 0 {
+		c.skewWarn = uint32(conf.ClockSkewWarnSec)
+	}
+	if conf.StaleCheckSec > 0 {
+		c.stale = newStaleCadence(clk, time.Duration(conf.StaleCheckSec)*time.Second)
+	}
+
+	return c
+}
+
+func (c beatsCheck) pollInterval() time.Duration {
+	if c.poll <= 0 {
+		return time.Second
+	}
+	return c.poll
+}
+
+// staleCadence limits how often heartbeats are checked for staleness,
+// so frequent status polls don't catch a shard that's just a bit late
+// with the beat. The first check is after the interval.
+type staleCadence struct {
+	clk   Clock
+	every time.Duration
+	next  time.Time
+}
+
+func newStaleCadence(clk Clock, every time.Duration) *staleCadence {
+	return &staleCadence{clk: clk, every: every, next: clk.Now().Add(every)}
+}
+
+// due returns true if it's time to check and schedules the next check
+func (s *staleCadence) due() bool {
+	now := s.clk.Now()
+	if now.Before(s.next) {
+		return false
+	}
+	s.next = now.Add(s.every)
+	return true
+}
+
+// skewWarned is the biggest heartbeats spread warned on (or recorded)
+type skewWarned struct {
+	max uint32
+}
+
+// grown returns true if the skew is bigger than the one warned on
+// before and keeps it
+func (w *skewWarned) grown(skew uint32) bool {
+	if w == nil {
+		return true
+	}
+	if skew <= w.max {
+		return false
+	}
+	w.max = skew
+	return true
+}
+
+// recordSkew returns true if the spread is worth recording to the restore
+// meta, see pbm.PBM.SetRestoreClockSkew
+func (c beatsCheck) recordSkew(skew uint32) bool {
+	return c.skewWarn > 0 && skew >= c.skewWarn && c.recorded.grown(skew)
+}
+
+// shardBeat is the last heartbeat of the shard
+type shardBeat struct {
+	rs string
+	hb primitive.Timestamp
+}
+
+// stale returns true if the beat is older than the frame (in seconds)
+func (b shardBeat) stale(clusterTime primitive.Timestamp, frame uint32) bool {
+	return b.hb.T+frame < clusterTime.T
+}
+
+// check returns the spread of the heartbeats and an error
+// if any shard is stale comparing to the cluster time
+func (c beatsCheck) check(beats []shardBeat, clusterTime primitive.Timestamp) (uint32, error) {
+	if len(beats) == 0 {
+		return 0, nil
+	}
+
+	oldest, newest := beats[0], beats[0]
+	for _, b := range beats[1:] {
+		if b.hb.T < oldest.hb.T {
+			oldest = b
+		}
+		if b.hb.T > newest.hb.T {
+			newest = b
+		}
+	}
+
+	skew := newest.hb.T - oldest.hb.T
+	frame := uint32(pbm.StaleFrameSec)
+	if c.skewWarn > 0 && skew >= c.skewWarn {
+		if c.l != nil && c.warned.grown(skew) {
+			c.l.Warning("shards heartbeats spread is %ds (%s: %d, %s: %d), clocks may be skewed",
+				skew, oldest.rs, oldest.hb.T, newest.rs, newest.hb.T)
+		}
+		if c.relax {
+			relax := skew
+			if relax > pbm.StaleFrameSec {
+				relax = pbm.StaleFrameSec
+			}
+			frame += relax
+		}
+	}
+
+	if c.stale != nil && !c.stale.due() {
+		return skew, nil
+	}
+	for _, b := range beats {
+		if b.stale(clusterTime, frame) {
+			return skew, errors.Wrapf(ErrShardLost, "lost shard %s, last beat ts: %d", b.rs, b.hb.T)
+		}
+	}
+
+	return skew, nil
+}
+
+func converged(
+	cn *pbm.PBM,
+	mc *metaCache,
+	opid string,
+	shards []pbm.Shard,
+	status pbm.Status,
+	bc beatsCheck,
+) (bool, error) {
+	ok, skew, err := clusterReached(cn, mc, opid, shards, status, bc)
+	if bc.recordSkew(skew) {
+		if err := cn.SetRestoreClockSkew(mc.name, int64(skew)); err != nil && bc.l != nil {
+			bc.l.Warning("set clock skew: %v", err)
+		}
+	}
+	if err != nil || !ok {
+		return false, err
+	}
+
+	err = cn.ChangeRestoreState(mc.name, status, "")
+	if err != nil {
+		return false, errors.Wrapf(err, "update backup meta with %s", status)
+	}
+	mc.Invalidate()
+
+	return true, nil
+}
+
+// ClusterReachedStatus checks if all `shards` of the restore `name` reached
+// the `status`. It fails if the restore was aborted, any of the shards
+// failed or is lost (has a stale heartbeat). Unlike the cluster convergence
+// it doesn't change the restore state.
+func ClusterReachedStatus(cn *pbm.PBM, name, opid string, shards []pbm.Shard, status pbm.Status) (bool, error) {
+	ok, _, err := clusterReached(cn, newMetaCache(cn, name, 0), opid, shards, status, beatsCheck{})
+	return ok, err
+}
+
+// clusterReached reads the restore meta and shards heartbeats and checks
+// if the cluster reached the `status`. It returns the heartbeats spread.
+func clusterReached(
+	cn *pbm.PBM,
+	mc *metaCache,
+	opid string,
+	shards []pbm.Shard,
+	status pbm.Status,
+	bc beatsCheck,
+) (bool, uint32, error) {
+	bmeta, err := mc.Get()
+	if err != nil {
+		return false, 0, errors.Wrap(err, "get backup metadata")
+	}
+	if err := checkAborted(bmeta); err != nil {
+		return false, 0, err
+	}
+
+	clusterTime, err := cn.ClusterTime()
+	if err != nil {
+		return false, 0, errors.Wrap(err, "read cluster time")
+	}
+
+	var beats []shardBeat
+	// nodes are cleaning its locks moving to the done status
+	// so no need to ckech the heartbeats
+	if status != pbm.StatusDone {
+		var rss []string
+		for _, sh := range shards {
+			for _, shard := range bmeta.Replsets {
+				if shard.Name == sh.RS {
+					rss = append(rss, shard.Name)
+				}
+			}
+		}
+		beats, err = shardsBeats(cn, opid, rss)
 		if err != nil {
-			if errors.Is(err, errConvergeTimeOut) {
-				return errors.Wrap(err, "couldn't get response from all shards")
+			return false, 0, err
+		}
+	}
+
+	return reachedStatus(bmeta, beats, clusterTime, shards, status, bc)
+}
+
+// shardsBeats reads the lock heartbeats of the replsets of the restore.
+// Replsets without the lock are skipped, the node may have already
+// cleaned it.
+func shardsBeats(cn *pbm.PBM, opid string, rss []string) ([]shardBeat, error) {
+	if len(rss) == 0 {
+		return nil, nil
+	}
+
+	locks, err := cn.GetReplsetsLocks(pbm.CmdRestore, opid, rss)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read shards locks")
+	}
+
+	return locksBeats(locks, rss), nil
+}
+
+// locksBeats returns the heartbeats of the locks in the order of rss
+func locksBeats(locks []pbm.LockData, rss []string) []shardBeat {
+	hb := make(map[string]primitive.Timestamp, len(locks))
+	for _, l := range locks {
+		hb[l.Replset] = l.Heartbeat
+	}
+
+	var beats []shardBeat
+	for _, rs := range rss {
+		if ts, ok := hb[rs]; ok {
+			beats = append(beats, shardBeat{rs: rs, hb: ts})
+		}
+	}
+
+	return beats
+}
+
+// reachedStatus checks shards heartbeats and if all shards reached the `status`
+func reachedStatus(
+	meta *pbm.RestoreMeta,
+	beats []shardBeat,
+	clusterTime primitive.Timestamp,
+	shards []pbm.Shard,
+	status pbm.Status,
+	bc beatsCheck,
+) (bool, uint32, error) {
+	skew, err := bc.check(beats, clusterTime)
+	if err != nil {
+		return false, skew, err
+	}
+
+	if bc.drain {
+		if err := checkAborted(meta); err != nil {
+			return false, skew, err
+		}
+		ok, err := shardsDrained(meta.Replsets, shards, status)
+		return ok, skew, err
+	}
+
+	ok, err := restoreConverged(meta, shards, status)
+	return ok, skew, err
+}
+
+// restoreConverged checks if the restore isn't aborted and
+// all participating shards reached the `status`
+func restoreConverged(meta *pbm.RestoreMeta, shards []pbm.Shard, status pbm.Status) (bool, error) {
+	if err := checkAborted(meta); err != nil {
+		return false, err
+	}
+
+	return shardsConverged(meta.Replsets, shards, status)
+}
+
+// shardsConverged checks if all participating shards reached the `status`.
+// Replsets that aren't among the shards (e.g. skipped ones) are ignored.
+// It fails if any shard failed, naming all failed shards sorted by name.
+func shardsConverged(replsets []pbm.RestoreReplset, shards []pbm.Shard, status pbm.Status) (bool, error) {
+	shardsToFinish := len(shards)
+	var failed []pbm.RestoreReplset
+	for _, sh := range shards {
+		for _, shard := range replsets {
+			if shard.Name != sh.RS {
+				continue
+			}
+
+			switch shard.Status {
+			case status:
+				shardsToFinish--
+			case pbm.StatusError:
+				failed = append(failed, shard)
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return false, errors.New(shardsFailed(failed))
+	}
+
+	return shardsToFinish == 0, nil
+}
+
+// shardsFailed describes the failed shards, sorted by name. So the
+// error is the same whatever the order the shards are listed in.
+func shardsFailed(failed []pbm.RestoreReplset) string {
+	if len(failed) == 1 {
+		return fmt.Sprintf("restore on the shard %s failed with: %s", failed[0].Name, failed[0].Error)
+	}
+
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Name < failed[j].Name })
+	errs := make([]string, len(failed))
+	for i, f := range failed {
+		errs[i] = f.Name + ": " + f.Error
+	}
+	return fmt.Sprintf("restore failed on %d shards: %s", len(failed), strings.Join(errs, ", "))
+}
+
+// shardsDrained is shardsConverged that waits for all participating
+// shards to either reach the `status` or fail. Then it fails if any
+// shard failed, naming all of them.
+func shardsDrained(replsets []pbm.RestoreReplset, shards []pbm.Shard, status pbm.Status) (bool, error) {
+	pending := len(shards)
+	var failed []pbm.RestoreReplset
+	for _, sh := range shards {
+		for _, shard := range replsets {
+			if shard.Name != sh.RS {
+				continue
+			}
+
+			switch shard.Status {
+			case status:
+				pending--
+			case pbm.StatusError:
+				pending--
+				failed = append(failed, shard)
+			}
+		}
+	}
+
+	if pending > 0 {
+		return false, nil
+	}
+	if len(failed) > 0 {
+		return false, errors.Wrap(errShardsDrained, shardsFailed(failed))
+	}
+
+	return true, nil
+}
+
+// errShardsDrained means the shards are drained (see shardsDrained) and
+// some of them failed. So the restore is failed for the whole cluster.
+var errShardsDrained = errors.New("shards failed")
+
+// allShardsFailed returns true if all replsets of the restore failed.
+func allShardsFailed(replsets []pbm.RestoreReplset) bool {
+	for _, rs := range replsets {
+		if rs.Status != pbm.StatusError {
+			return false
+		}
+	}
+
+	return len(replsets) > 0
+}
+
+func waitForStatus(clk Clock, cn *pbm.PBM, mc *metaCache, status pbm.Status) error {
+	return waitStatus(cn.Context(), clk, time.Second, nil, status, func() (bool, error) {
+		return restoreReachedStatus(cn, mc, status)
+	})
+}
+
+var errWaitStatusTimeOut = errors.New("reached wait status timeout")
+
+func waitStatusTimeoutError(status pbm.Status, t time.Duration) error {
+	return errors.Wrapf(errWaitStatusTimeOut, "status `%s` after %v", status, t)
+}
+
+// waitForStatusTimeout waits up to the given timeout until the restore
+// reached the `status`. It returns errWaitStatusTimeOut on timeout.
+func waitForStatusTimeout(clk Clock, cn *pbm.PBM, mc *metaCache, status pbm.Status, t time.Duration) error {
+	return waitStatus(cn.Context(), clk, time.Second, &t, status, func() (bool, error) {
+		return restoreReachedStatus(cn, mc, status)
+	})
+}
+
+// waitStatus calls `poll` on every tick until it reports the status is
+// reached or fails. No timeout (nil) means waiting until ctx is done.
+func waitStatus(
+	ctx context.Context,
+	clk Clock,
+	tick time.Duration,
+	timeout *time.Duration,
+	status pbm.Status,
+	poll func() (bool, error),
+) error {
+	return pollStatus(ctx, clk, tick, timeout, poll, func() error {
+		return waitStatusTimeoutError(status, *timeout)
+	})
+}
+
+// pollStatus calls `poll` on every tick of the clock until it reports
+// the status is reached or fails. If the status isn't reached within the
+// timeout, it returns the error of `tout`. No timeout (nil) means waiting
+// until ctx is done.
+func pollStatus(
+	ctx context.Context,
+	clk Clock,
+	tick time.Duration,
+	timeout *time.Duration,
+	poll func() (bool, error),
+	tout func() error,
+) error {
+	tk := clk.NewTicker(tick)
+	defer tk.Stop()
+
+	var deadline time.Time
+	if timeout != nil {
+		deadline = clk.Now().Add(*timeout)
+	}
+
+	for {
+		select {
+		case <-tk.C():
+			ok, err := poll()
+			if err != nil {
+				return err
 			}
-			return errors.Wrapf(err, "check cluster for restore `%s`", status)
+			if ok {
+				return nil
+			}
+			if timeout != nil && !clk.Now().Before(deadline) {
+				return tout()
+			}
+		case <-ctx.Done():
+			return nil
 		}
 	}
+}
+
+// restoreReachedStatus checks if the restore `name` has the `status`.
+// It fails if the restore was aborted, failed or is stuck.
+func restoreReachedStatus(cn *pbm.PBM, mc *metaCache, status pbm.Status) (bool, error) {
+	meta, err := mc.Get()
+	if errors.Is(err, pbm.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "get restore metadata")
+	}
+
+	clusterTime, err := cn.ClusterTime()
+	if err != nil {
+		return false, errors.Wrap(err, "read cluster time")
+	}
+
+	if err := checkAborted(meta); err != nil {
+		return false, err
+	}
+
+	if meta.Hb.T+pbm.StaleFrameSec < clusterTime.T {
+		return false, errors.Wrapf(ErrShardLost, "restore stuck, last beat ts: %d", meta.Hb.T)
+	}
+
+	return metaReachedStatus(meta, status)
+}
+
+// metaReachedStatus checks if the restore has the `status`.
+// It fails if the restore failed.
+func metaReachedStatus(meta *pbm.RestoreMeta, status pbm.Status) (bool, error) {
+	switch meta.Status {
+	case status:
+		return true, nil
+	case pbm.StatusError:
+		return false, errors.Errorf("cluster failed: %s", meta.Error)
+	}
+
+	return false, nil
+}
+
+// chunks defines chunks of oplog slice in given range, ensures its integrity (timeline
+// is contiguous - there are no gaps) and checks for respective files on storage.
+// Zero `to` means up to the end of the last chunk.
+// With `allowGaps` gaps are skipped with the warning and returned.
+//
+// The chunks index is streamed, so the chunks aren't held in memory. The
+// returned chunks read the index anew on each iteration, see indexChunks.
+//
+//nolint:nonamedreturns
+func chunks(
+	ctx context.Context,
+	idx chunksIndex,
+	stg storage.Storage,
+	from,
+	to primitive.Timestamp,
+	rsName string,
+	rsMap map[string]string,
+	warnAt int,
+	allowGaps bool,
+	l *log.Event,
+) (_ oplogChunks, _ []pbm.OplogGap, err error) {
+	_, span := startSpan(ctx, "chunks", attrRS.String(rsName))
+	defer func() { endSpan(span, err) }()
+
+	c := &indexChunks{
+		idx:       idx,
+		rs:        pbm.MakeReverseRSMapFunc(rsMap)(rsName),
+		from:      from,
+		to:        to,
+		allowGaps: allowGaps,
+	}
+	sum, gaps, err := scanChunks(stg, idx(c.rs, from, to), from, to, allowGaps, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.sum = sum
+
+	for _, g := range gaps {
+		l.Warning("GAP in the oplog of %s: %d.%d - %d.%d. It is skipped as allowed, "+
+			"ops in there are NOT restored", g.RS, g.From.T, g.From.I, g.To.T, g.To.I)
+	}
+	warnManyChunks(sum, warnAt, l)
+
+	return c, gaps, nil
+}
+
+// warnManyChunks warns if there are more than `warnAt` chunks to replay.
+// Zero `warnAt` disables the warning.
+func warnManyChunks(s pbm.ChunksSummary, warnAt int, l *log.Event) bool {
+	if warnAt <= 0 || s.Count <= warnAt {
+		return false
+	}
+
+	l.Warning("the restore involves %d oplog chunks (%d.%d - %d.%d), it may take long. "+
+		"Consider compacting PITR chunks before the restore", s.Count, s.From.T, s.From.I, s.To.T, s.To.I)
+	return true
+}
+
+// checkChunks ensures chunks cover [from, to] with no gaps
+// and are present on the storage. Zero `to` is the open end,
+// so chunks are checked up to the end of the last one.
+//
+// A chunk starting exactly where the previous one ends is contiguous,
+// as well as a chunk overlapping the previous ones (e.g. after the
+// re-slicing): ops of the overlap are replayed idempotently. Only a chunk
+// starting after the end of all previous ones is a gap, even by one
+// increment of the timestamp, since the ops in between may be lost.
+func checkChunks(stg storage.Storage, chunks []pbm.OplogChunk, from, to primitive.Timestamp) error {
+	_, _, err := scanChunks(stg, &sliceChunksIter{chunks: chunks}, from, to, false, nil)
+	return err
+}
+
+// chunksIter iterates oplog chunks in the timeline order, see pbm.ChunksIter
+type chunksIter interface {
+	Next() bool
+	Chunk() pbm.OplogChunk
+	Err() error
+}
+
+type sliceChunksIter struct {
+	chunks []pbm.OplogChunk
+	i      int
+	err    error
+}
+
+func (s *sliceChunksIter) Next() bool {
+	if s.err != nil || s.i >= len(s.chunks) {
+		return false
+	}
+	s.i++
+	return true
+}
+
+func (s *sliceChunksIter) Chunk() pbm.OplogChunk { return s.chunks[s.i-1] }
+
+func (s *sliceChunksIter) Err() error { return s.err }
+
+// chunksIndex returns the oplog chunks of the replset in [from, to] in the
+// timeline order, see pbm.PBM.PITRIterChunks
+type chunksIndex func(rs string, from, to primitive.Timestamp) chunksIter
+
+// dbChunksIndex is the chunks index of the cluster
+func dbChunksIndex(cn *pbm.PBM) chunksIndex {
+	return func(rs string, from, to primitive.Timestamp) chunksIter {
+		return cn.PITRIterChunks(rs, from, to)
+	}
+}
+
+// oplogChunks are the oplog chunks to replay. They may be read more than
+// once (e.g. to pre-download and then to replay), each iteration reads
+// them anew.
+type oplogChunks interface {
+	iter() chunksIter
+	summary() pbm.ChunksSummary
+}
+
+// chunkList is oplogChunks held in memory
+type chunkList []pbm.OplogChunk
+
+func (c chunkList) iter() chunksIter { return &sliceChunksIter{chunks: c} }
+
+func (c chunkList) summary() pbm.ChunksSummary { return pbm.SummarizeChunks(c) }
+
+// collect reads all the chunks into memory
+func collect(c oplogChunks) (chunkList, error) {
+	if l, ok := c.(chunkList); ok {
+		return l, nil
+	}
+
+	l := make(chunkList, 0, c.summary().Count)
+	it := c.iter()
+	for it.Next() {
+		l = append(l, it.Chunk())
+	}
+
+	return l, errors.Wrap(it.Err(), "read chunks")
+}
+
+// indexChunks are oplogChunks streamed from the chunks index. They are
+// checked once by chunks(). The index may change after (e.g. chunks are
+// compacted), so the timeline is checked again as the chunks are read.
+type indexChunks struct {
+	idx       chunksIndex
+	rs        string
+	from      primitive.Timestamp
+	to        primitive.Timestamp
+	allowGaps bool
+	sum       pbm.ChunksSummary
+}
+
+func (c *indexChunks) iter() chunksIter {
+	return &timelineIter{
+		chunksIter: c.idx(c.rs, c.from, c.to),
+		tl:         newChunksTimeline(c.from, c.to, c.allowGaps),
+	}
+}
+
+func (c *indexChunks) summary() pbm.ChunksSummary { return c.sum }
+
+// timelineIter fails the iteration on a gap in the chunks, see chunksTimeline
+type timelineIter struct {
+	chunksIter
+	tl  chunksTimeline
+	err error
+}
+
+func (t *timelineIter) Next() bool {
+	if t.err != nil || !t.chunksIter.Next() {
+		return false
+	}
+
+	_, t.err = t.tl.add(t.Chunk())
+	return t.err == nil
+}
+
+func (t *timelineIter) Err() error {
+	if t.err != nil {
+		return t.err
+	}
+	return t.chunksIter.Err()
+}
+
+// leadingChunks are oplogChunks preceded by the given chunk
+type leadingChunks struct {
+	first pbm.OplogChunk
+	rest  oplogChunks
+}
+
+func (c *leadingChunks) iter() chunksIter {
+	return &leadingIter{first: c.first, rest: c.rest.iter()}
+}
+
+func (c *leadingChunks) summary() pbm.ChunksSummary {
+	s := c.rest.summary()
+	f := pbm.SummarizeChunks([]pbm.OplogChunk{c.first})
+	if s.Count == 0 || f.From.Before(s.From) {
+		s.From = f.From
+	}
+	if f.To.After(s.To) {
+		s.To = f.To
+	}
+	s.Count++
+	s.TotalBytes += f.TotalBytes
+
+	return s
+}
+
+type leadingIter struct {
+	first pbm.OplogChunk
+	rest  chunksIter
+	n     int
+}
+
+func (l *leadingIter) Next() bool {
+	l.n++
+	return l.n == 1 || l.rest.Next()
+}
+
+func (l *leadingIter) Chunk() pbm.OplogChunk {
+	if l.n == 1 {
+		return l.first
+	}
+	return l.rest.Chunk()
+}
+
+func (l *leadingIter) Err() error { return l.rest.Err() }
+
+// chunksTimeline checks chunks for gaps as they come in the timeline order,
+// see pbm.TimelineCursor
+type chunksTimeline struct {
+	pbm.TimelineCursor
+	allowGaps bool
+}
+
+func newChunksTimeline(from, to primitive.Timestamp, allowGaps bool) chunksTimeline {
+	return chunksTimeline{TimelineCursor: pbm.TimelineCursor{Last: from, To: to}, allowGaps: allowGaps}
+}
+
+// add returns the gap before the chunk if any. Without `allowGaps`
+// the gap is the error.
+func (t *chunksTimeline) add(c pbm.OplogChunk) (*pbm.OplogGap, error) {
+	gap := t.Add(c)
+	if gap != nil && !t.allowGaps {
+		return nil, errors.Wrapf(ErrChunkGap,
+			"integrity vilolated, expect chunk with start_ts %v, but got %v",
+			gap.From, c.StartTS)
+	}
+
+	return gap, nil
+}
+
+// collectChunks reads chunks of the iterator checking them as they come,
+// see scanChunks.
+//
+//nolint:nonamedreturns
+func collectChunks(
+	stg storage.Storage,
+	it chunksIter,
+	from,
+	to primitive.Timestamp,
+	allowGaps bool,
+) (chunks []pbm.OplogChunk, gaps []pbm.OplogGap, err error) {
+	_, gaps, err = scanChunks(stg, it, from, to, allowGaps, func(c pbm.OplogChunk) {
+		chunks = append(chunks, c)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return chunks, gaps, nil
+}
+
+// scanChunks reads chunks of the iterator checking them as they come,
+// see checkChunks and compressionCheck. It stops on the first gap
+// or missing chunk, so the rest of the chunks isn't read. Each checked
+// chunk is passed to `visit`, if set.
+//
+// With `allowGaps` gaps are returned instead of the error and chunks
+// after them are read. The target time still has to be covered.
+func scanChunks(
+	stg storage.Storage,
+	it chunksIter,
+	from,
+	to primitive.Timestamp,
+	allowGaps bool,
+	visit func(pbm.OplogChunk),
+) (pbm.ChunksSummary, []pbm.OplogGap, error) {
+	var (
+		sum  pbm.ChunksSummary
+		gaps []pbm.OplogGap
+		cc   compressionCheck
+		last pbm.OplogChunk
+	)
+	tl := newChunksTimeline(from, to, allowGaps)
+	for it.Next() {
+		c := it.Chunk()
+		gap, err := tl.add(c)
+		if err != nil {
+			return sum, nil, err
+		}
+		if gap != nil {
+			gaps = append(gaps, *gap)
+		}
+
+		_, err = stg.FileStat(c.FName)
+		if err != nil {
+			return sum, nil, errors.Wrapf(ErrMissingChunk,
+				"failed to ensure chunk %v.%v on the storage, file: %s, error: %v",
+				c.StartTS, c.EndTS, c.FName, err)
+		}
+		cc.add(c)
+
+		if sum.Count == 0 || c.StartTS.Before(sum.From) {
+			sum.From = c.StartTS
+		}
+		if c.EndTS.After(sum.To) {
+			sum.To = c.EndTS
+		}
+		sum.Count++
+		sum.TotalBytes += c.Size
+		last = c
+
+		if visit != nil {
+			visit(c)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return sum, nil, errors.Wrap(err, "get chunks index")
+	}
+
+	if sum.Count == 0 {
+		return sum, nil, errors.Wrap(ErrMissingChunk, "no chunks found")
+	}
+	if !to.IsZero() && primitive.CompareTimestamp(last.EndTS, to) == -1 {
+		return sum, nil, errors.Wrapf(ErrMissingChunk,
+			"no chunk with the target time, the last chunk ends on %v", last.EndTS)
+	}
+
+	return sum, gaps, cc.err()
+}
+
+// maxListedChunks is the max num of chunks listed in the error
+const maxListedChunks = 10
+
+// compressionCheck collects chunks compressed with codecs unknown to this
+// version, so the replay doesn't fail on them halfway. Empty compression
+// is of old chunks and means none.
+type compressionCheck struct {
+	bad []string
+	n   int
+}
+
+func (cc *compressionCheck) add(c pbm.OplogChunk) {
+	if c.Compression == "" || compress.IsValidCompressionType(string(c.Compression)) {
+		return
+	}
+	cc.n++
+	if cc.n <= maxListedChunks {
+		cc.bad = append(cc.bad, c.FName+" ("+string(c.Compression)+")")
+	}
+}
 
-	err = waitForStatus(cn, bcp, status)
-	if err != nil {
-		return errors.Wrapf(err, "waiting for %s", status)
+func (cc *compressionCheck) err() error {
+	if cc.n == 0 {
+		return nil
+	}
+	bad := cc.bad
+	if cc.n > maxListedChunks {
+		bad = append(bad, "and "+strconv.Itoa(cc.n-maxListedChunks)+" more")
 	}
 
-	return nil
+	return errors.Wrapf(ErrUnsupportedCompression,
+		"oplog chunks are compressed with codecs unknown to this PBM version, "+
+			"restore them with the PBM version that made them: %s", strings.Join(bad, ", "))
 }
 
-type reconcileStatus func(status pbm.Status, timeout *time.Duration) error
+// lockHBInterval is how often the lock heartbeat is refreshed during
+// the oplog replay. Should be well below pbm.StaleFrameSec.
+const lockHBInterval = time.Second * 5
 
-// convergeCluster waits until all participating shards reached `status` and updates a cluster status
-func convergeCluster(cn *pbm.PBM, name, opid string, shards []pbm.Shard, status pbm.Status) error {
-	tk := time.NewTicker(time.Second * 1)
-	defer tk.Stop()
+// roleCheckInterval is how often the node role is checked during
+// the oplog replay, see roleGuard
+const roleCheckInterval = time.Second * 5
 
-	for {
-		select {
-		case <-tk.C:
-			ok, err := converged(cn, name, opid, shards, status)
-			if err != nil {
-				return err
-			}
-			if ok {
-				return nil
+// startHeartbeat calls beat every interval of the clock in the background
+// until the returned stop func is called
+func startHeartbeat(clk Clock, interval time.Duration, beat func() error, l *log.Event) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		tk := clk.NewTicker(interval)
+		defer tk.Stop()
+
+		for {
+			select {
+			case <-tk.C():
+				if err := beat(); err != nil {
+					l.Warning("refresh lock heartbeat: %v", err)
+				}
+			case <-done:
+				return
 			}
-		case <-cn.Context().Done():
-			return nil
 		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
 	}
 }
 
-var errConvergeTimeOut = errors.New("reached converge timeout")
+type applyOplogOption struct {
+	start  *primitive.Timestamp
+	end    *primitive.Timestamp
+	nss    []string
+	unsafe bool
+	filter oplog.OpFilter
+	// opsPerSec and bytesPerSec limit the apply rate of ops and
+	// decompressed oplog respectively. Zero means no limit.
+	opsPerSec   int64
+	bytesPerSec int64
+	// maxDecompressMem limits the memory of the chunk decompressor.
+	// Zero means codec defaults
+	maxDecompressMem int64
+	// readBuffer is the size of the buffer the chunk is read through.
+	// Zero means no extra buffering
+	readBuffer int
+	// prefetch is the num of chunks to download ahead within
+	// prefetchBudget. Zero disables prefetch
+	prefetch       int
+	prefetchBudget *MemBudget
+	// preDownload downloads all chunks to a temp dir in preDownloadDir
+	// before the replay. It takes precedence over prefetch
+	preDownload    bool
+	preDownloadDir string
+	// downloaded, if set, are the chunks already downloaded by the
+	// caller (see preDownload). They're cleaned up by the caller too
+	downloaded *localStorage
+	// downloadLimit, if set, limits the download rate of oplog chunks.
+	// It may be shared with other downloads to bound the total rate
+	downloadLimit *storage.RateLimiter
+	// srcVersion is the mongo version the oplog was made on. If set,
+	// the replay fails unless it's compatible with the target version
+	srcVersion string
+	// srcFCV is the featureCompatibilityVersion the oplog was made with.
+	// If set, the replay fails unless dstFCV, the one of the target, is
+	// the same or newer
+	srcFCV string
+	dstFCV string
+	// indexBuilder, if set, builds indexes as their ops are replayed.
+	// Otherwise, indexes are only collected in the catalog
+	indexBuilder oplog.IndexBuilder
+	// aborted, if set, is checked before each chunk. Replay stops
+	// with the returned error
+	aborted func() error
+	// progress, if set, is called after each replayed chunk
+	progress progressFn
+	// events, if set, gets ChunkApplied after each replayed chunk
+	events *EventBus
+	// txnRetention is the num of the last committed dist txns kept
+	// for the cross-shard sync. Zero means the default
+	txnRetention int
+	// writeConcern of the applied ops. Nil means the server default
+	writeConcern *writeconcern.WriteConcern
+	// resume, if set, continues the replay after the checkpoint. Its
+	// indexes are added to the catalog and earlier chunks are skipped
+	resume *pbm.ReplayCheckpoint
+	// checkpoint, if set, saves the replay checkpoint once per
+	// checkpointEvery (see checkpointer). Zero means the default
+	checkpoint      checkpointFn
+	checkpointEvery time.Duration
+	// skipSystemNS filters out ops of system namespaces (see
+	// oplog.IsSystemOp) along with the filter and nss
+	skipSystemNS bool
+	// remapUUID makes collection UUIDs of ops match the ones on the
+	// node. It's needed if collections weren't restored from the backup.
+	remapUUID bool
+	// slowChunk, if set, warns on chunks that take longer to apply
+	slowChunk time.Duration
+	// clock times the slow chunks. Nil means the real one
+	clock Clock
+	// stopBefore, if set, stops the replay right before the op within
+	// the last timestamp of the range
+	stopBefore *oplog.StopBefore
+	// continueOnApplyError skips ops that fail to apply instead of
+	// failing the replay. They are logged and kept in the stat
+	continueOnApplyError bool
+	// runner, if set, runs the commands applying ops instead of the node
+	runner oplog.CommandRunner
+}
 
-// convergeClusterWithTimeout waits up to the geiven timeout until all participating shards reached
-// `status` and then updates the cluster status
-func convergeClusterWithTimeout(
-	cn *pbm.PBM,
-	name,
-	opid string,
-	shards []pbm.Shard,
-	status pbm.Status,
-	t time.Duration,
-) error {
-	tk := time.NewTicker(time.Second * 1)
-	defer tk.Stop()
+// maxApplyErrors is the num of skipped ops kept in the restore stat
+const maxApplyErrors = 100
 
-	tout := time.NewTicker(t)
-	defer tout.Stop()
+// txnSyncRetries and txnSyncBackoff define retries of the cross-shard
+// transactions sync on transient errors. The delay doubles on each retry.
+var (
+	txnSyncRetries = 5
+	txnSyncBackoff = time.Second
+	// txnSyncPoll is how often committed txns of other shards are checked
+	// first. The interval doubles on each check up to txnSyncPollMax.
+	txnSyncPoll    = time.Second
+	txnSyncPollMax = 10 * time.Second
+)
 
-	for {
-		select {
-		case <-tk.C:
-			var ok bool
-			ok, err := converged(cn, name, opid, shards, status)
-			if err != nil {
-				return err
-			}
-			if ok {
-				return nil
-			}
-		case <-tout.C:
-			return errConvergeTimeOut
-		case <-cn.Context().Done():
-			return nil
-		}
-	}
+var errTxnSyncTimeout = errors.New("timeout waiting for committed txns of other shards")
+
+// txnSyncTimeoutError reports shards that didn't share their committed
+// txns in time. `pending` are names of such shards out of `total`.
+func txnSyncTimeoutError(pending []string, total int, t time.Duration) error {
+	sort.Strings(pending)
+	return errors.Wrapf(errTxnSyncTimeout, "%d of %d shards reported after %v, waiting for: %s. "+
+		"Check these shards' restore logs or increase `restore.txnSyncTimeoutSec`",
+		total-len(pending), total, t, strings.Join(pending, ", "))
 }
 
-func converged(cn *pbm.PBM, name, opid string, shards []pbm.Shard, status pbm.Status) (bool, error) {
-	shardsToFinish := len(shards)
-	bmeta, err := cn.GetRestoreMeta(name)
-	if err != nil {
-		return false, errors.Wrap(err, "get backup metadata")
-	}
+// txnBarrier is the sync point of the cross-shard transactions. Shards
+// publish their committed txns and read the ones of the others only
+// after all shards have published, so no commit is missed regardless of
+// the order shards finish the replay in.
+type txnBarrier struct {
+	pending map[string]struct{}
+	total   int
+	commits map[string]primitive.Timestamp
+	sleep   func(time.Duration)
+}
 
-	clusterTime, err := cn.ClusterTime()
-	if err != nil {
-		return false, errors.Wrap(err, "read cluster time")
+func newTxnBarrier(shards []string) *txnBarrier {
+	b := &txnBarrier{
+		pending: make(map[string]struct{}, len(shards)),
+		total:   len(shards),
+		commits: make(map[string]primitive.Timestamp),
+		sleep:   time.Sleep,
+	}
+	for _, s := range shards {
+		b.pending[s] = struct{}{}
 	}
 
-	for _, sh := range shards {
-		for _, shard := range bmeta.Replsets {
-			if shard.Name == sh.RS {
-				// check if node alive
-				lock, err := cn.GetLockData(&pbm.LockHeader{
-					Type:    pbm.CmdRestore,
-					OPID:    opid,
-					Replset: shard.Name,
-				})
-
-				// nodes are cleaning its locks moving to the done status
-				// so no lock is ok and not need to ckech the heartbeats
-				if status != pbm.StatusDone && !errors.Is(err, mongo.ErrNoDocuments) {
-					if err != nil {
-						return false, errors.Wrapf(err, "unable to read lock for shard %s", shard.Name)
-					}
-					if lock.Heartbeat.T+pbm.StaleFrameSec < clusterTime.T {
-						return false, errors.Errorf("lost shard %s, last beat ts: %d", shard.Name, lock.Heartbeat.T)
-					}
-				}
+	return b
+}
 
-				// check status
-				switch shard.Status {
-				case status:
-					shardsToFinish--
-				case pbm.StatusError:
-					bmeta.Status = pbm.StatusError
-					bmeta.Error = shard.Error
-					return false, errors.Errorf("restore on the shard %s failed with: %s", shard.Name, shard.Error)
-				}
-			}
+// publish marks the shard as published with the given txns
+func (b *txnBarrier) publish(rs string, txns []pbm.RestoreTxn) {
+	if _, ok := b.pending[rs]; !ok {
+		return
+	}
+	for _, t := range txns {
+		if t.State == pbm.TxnCommit {
+			b.commits[t.ID] = t.Ctime
 		}
 	}
+	delete(b.pending, rs)
+}
 
-	if shardsToFinish == 0 {
-		err := cn.ChangeRestoreState(name, status, "")
-		if err != nil {
-			return false, errors.Wrapf(err, "update backup meta with %s", status)
+// wait calls `poll` until all shards have published and returns committed
+// txns of all shards, so the leftovers are reconciled by the complete view.
+// Polls start `every` and back off doubling up to `max`. It fails with
+// errTxnSyncTimeout naming the shards which haven't published in `t`.
+// Zero `t` means no timeout.
+func (b *txnBarrier) wait(t, every, max time.Duration, poll func() error) (map[string]primitive.Timestamp, error) {
+	deadline := time.Now().Add(t)
+	for {
+		if err := poll(); err != nil {
+			return nil, err
+		}
+		if len(b.pending) == 0 {
+			return b.commits, nil
+		}
+		if t > 0 && time.Now().After(deadline) {
+			return nil, txnSyncTimeoutError(mapKeys(b.pending), b.total, t)
+		}
+		b.sleep(every)
+		if every *= 2; every > max {
+			every = max
 		}
-		return true, nil
 	}
+}
 
-	return false, nil
+// isTransient returns true if the err is a network or timeout db error
+func isTransient(err error) bool {
+	return mongo.IsNetworkError(err) || mongo.IsTimeout(err)
 }
 
-func waitForStatus(cn *pbm.PBM, name string, status pbm.Status) error {
-	tk := time.NewTicker(time.Second * 1)
-	defer tk.Stop()
+// retryTransient calls fn until it succeeds, fails with a non-transient
+// error or retries are exhausted
+func retryTransient(ctx context.Context, l *log.Event, op string, fn func() error) error {
+	delay := txnSyncBackoff
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || !isTransient(err) || i >= txnSyncRetries {
+			return err
+		}
 
-	for {
+		l.Warning("%s: %v. Retry in %v", op, err, delay)
 		select {
-		case <-tk.C:
-			meta, err := cn.GetRestoreMeta(name)
-			if errors.Is(err, pbm.ErrNotFound) {
-				continue
-			}
-			if err != nil {
-				return errors.Wrap(err, "get restore metadata")
-			}
-
-			clusterTime, err := cn.ClusterTime()
-			if err != nil {
-				return errors.Wrap(err, "read cluster time")
-			}
-
-			if meta.Hb.T+pbm.StaleFrameSec < clusterTime.T {
-				return errors.Errorf("restore stuck, last beat ts: %d", meta.Hb.T)
-			}
-
-			switch meta.Status {
-			case status:
-				return nil
-			case pbm.StatusError:
-				return errors.Errorf("cluster failed: %s", meta.Error)
-			}
-		case <-cn.Context().Done():
-			return nil
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+		delay *= 2
 	}
 }
 
-// chunks defines chunks of oplog slice in given range, ensures its integrity (timeline
-// is contiguous - there are no gaps), checks for respective files on storage and returns
-// chunks list if all checks passed
-func chunks(
-	cn *pbm.PBM,
-	stg storage.Storage,
-	from,
-	to primitive.Timestamp,
-	rsName string,
-	rsMap map[string]string,
-) ([]pbm.OplogChunk, error) {
-	mapRevRS := pbm.MakeReverseRSMapFunc(rsMap)
-	chunks, err := cn.PITRGetChunksSlice(mapRevRS(rsName), from, to)
-	if err != nil {
-		return nil, errors.Wrap(err, "get chunks index")
-	}
-
-	if len(chunks) == 0 {
-		return nil, errors.New("no chunks found")
-	}
+// mongoReleases are mongo releases in the upgrade order
+var mongoReleases = []string{"v4.0", "v4.2", "v4.4", "v5.0", "v6.0", "v7.0"}
 
-	if primitive.CompareTimestamp(chunks[len(chunks)-1].EndTS, to) == -1 {
-		return nil, errors.Errorf(
-			"no chunk with the target time, the last chunk ends on %v",
-			chunks[len(chunks)-1].EndTS)
+// checkOplogVersion checks if the oplog made on mongo `src` version can be
+// replayed onto mongo `dst` version. It's allowed for the same release and
+// the next one (an upgrade path). Empty or unparsable versions are not checked.
+func checkOplogVersion(src, dst string) error {
+	s, d := majmin(src), majmin(dst)
+	if s == "" || d == "" || s == d {
+		return nil
 	}
 
-	last := from
-	for _, c := range chunks {
-		if primitive.CompareTimestamp(last, c.StartTS) == -1 {
-			return nil, errors.Errorf(
-				"integrity vilolated, expect chunk with start_ts %v, but got %v",
-				last, c.StartTS)
+	si, di := -1, -1
+	for i, r := range mongoReleases {
+		switch r {
+		case s:
+			si = i
+		case d:
+			di = i
 		}
-		last = c.EndTS
+	}
 
-		_, err := stg.FileStat(c.FName)
-		if err != nil {
-			return nil, errors.Errorf(
-				"failed to ensure chunk %v.%v on the storage, file: %s, error: %v",
-				c.StartTS, c.EndTS, c.FName, err)
-		}
+	ok := di == si+1
+	if si == -1 || di == -1 {
+		ok = semver.Compare(d, s) > 0
+	}
+	if !ok {
+		return errors.Wrapf(ErrIncompatibleVersion, "cannot restore %s oplog onto %s. "+
+			"Use --skip-version-check to restore anyway", src, dst)
 	}
 
-	return chunks, nil
+	return nil
 }
 
-type applyOplogOption struct {
-	start  *primitive.Timestamp
-	end    *primitive.Timestamp
-	nss    []string
-	unsafe bool
-	filter oplog.OpFilter
+// checkOplogFCV checks if the oplog made with `src` featureCompatibilityVersion
+// can be replayed onto a node with `dst` one. Ops of the newer FCV may be
+// invalid for the older one, so the target can't be behind the source.
+// Empty or unparsable FCVs are not checked.
+func checkOplogFCV(src, dst string) error {
+	s, d := majmin(src), majmin(dst)
+	if s == "" || d == "" || semver.Compare(d, s) >= 0 {
+		return nil
+	}
+
+	return errors.Wrapf(ErrIncompatibleVersion, "cannot restore oplog made with FCV %s onto FCV %s. "+
+		"Set FCV to %s or use --skip-version-check to restore anyway", src, dst, src)
 }
 
 type (
 	setcommittedTxnFn func(txn []pbm.RestoreTxn) error
 	getcommittedTxnFn func() (map[string]primitive.Timestamp, error)
+	progressFn        func(p replayProgress)
 )
 
+// retainTxn returns the last n of the committed txns (in the order of
+// commits) to share with other shards. Not set n is the default retention.
+func retainTxn(txn []pbm.RestoreTxn, n int) []pbm.RestoreTxn {
+	if n <= 0 {
+		n = oplog.DefaultDistTxnRetention
+	}
+	if len(txn) > n {
+		txn = txn[len(txn)-n:]
+	}
+	return txn
+}
+
+// replayProgress is the oplog replay state after a chunk
+type replayProgress struct {
+	// lts is the last applied timestamp
+	lts primitive.Timestamp
+	// eta is the estimated time left (zero if can't be estimated yet)
+	eta time.Duration
+	// chunk is the num of replayed chunks out of chunks
+	chunk  int
+	chunks int
+	// ops is the total num of ops so far
+	ops pbm.OplogOpsStat
+}
+
 // By looking at just transactions in the oplog we can't tell which shards
 // were participating in it. But we can assume that if there is
 // commitTransaction at least on one shard then the transaction is committed
@@ -284,23 +1451,41 @@ type (
 // It might happen that by the end of the oplog there are some distributed txns
 // without commit messages. We should commit such transactions only if the data is
 // full (all prepared statements observed) and this txn was committed at least by
-// one other shard. For that, each shard saves the last 100 dist transactions
-// that were committed, so other shards can check if they should commit their
-// leftovers. We store the last 100, as prepared statements and commits might be
-// separated by other oplog events so it might happen that several commit messages
-// can be cut away on some shards but present on other(s). Given oplog events of
-// dist txns are more or less aligned in [cluster]time, checking the last 100
-// should be more than enough.
+// one other shard. For that, each shard saves the last N (100 by default, see
+// `restore.distTxnRetention`) dist transactions that were committed, so other
+// shards can check if they should commit their leftovers. We store the last N,
+// as prepared statements and commits might be separated by other oplog events
+// so it might happen that several commit messages can be cut away on some shards
+// but present on other(s). Given oplog events of dist txns are more or less
+// aligned in [cluster]time, checking the last 100 should be more than enough.
+// If more commits were seen, older ones are evicted and we warn about it.
 // If the transaction is more than 16Mb it will be split into several prepared
 // messages. So it might happen that one shard committed the txn but another has
 // observed not all prepared messages by the end of the oplog. In such a case we
 // should report it in logs and describe-restore.
 //
 //nolint:nonamedreturns
-func applyOplog(node *mongo.Client, chunks []pbm.OplogChunk, options *applyOplogOption, sharded bool,
-	ic *idx.IndexCatalog, setTxn setcommittedTxnFn, getTxn getcommittedTxnFn, stat *pbm.DistTxnStat,
+func applyOplog(ctx context.Context, node *mongo.Client, chunks oplogChunks, options *applyOplogOption, sharded bool,
+	ic *idx.IndexCatalog, setTxn setcommittedTxnFn, getTxn getcommittedTxnFn, stat *pbm.RestoreShardStat,
 	mgoV *pbm.MongoVersion, stg storage.Storage, log *log.Event,
 ) (partial []oplog.Txn, err error) {
+	ctx, span := startSpan(ctx, "applyOplog")
+	defer func() {
+		span.SetAttributes(statAttrs(stat)...)
+		endSpan(span, err)
+	}()
+
+	if options.srcVersion != "" {
+		if err := checkOplogVersion(options.srcVersion, mgoV.VersionString); err != nil {
+			return nil, err
+		}
+	}
+	if options.srcFCV != "" {
+		if err := checkOplogFCV(options.srcFCV, options.dstFCV); err != nil {
+			return nil, err
+		}
+	}
+
 	log.Info("starting oplog replay")
 
 	var (
@@ -313,20 +1498,116 @@ func applyOplog(node *mongo.Client, chunks []pbm.OplogChunk, options *applyOplog
 		return nil, errors.Wrap(err, "create oplog")
 	}
 
-	oplogRestore.SetOpFilter(options.filter)
+	// set if the replay failed too, so it tells what got applied
+	defer func() { stat.NSOps = oplogRestore.NSOps() }()
+
+	oplogRestore.SetOpFilter(options.opFilter())
+	oplogRestore.SetIndexBuilder(options.indexBuilder)
+	oplogRestore.SetDistTxnRetention(options.txnRetention)
+	oplogRestore.SetWriteConcern(options.writeConcern)
+	if options.runner != nil {
+		oplogRestore.SetCommandRunner(options.runner)
+	}
+	if options.continueOnApplyError {
+		oplogRestore.SetApplyErrorHandler(func(op *db.Oplog, err error) {
+			log.Warning("skip op %v (%s on %s): %v", op.Timestamp, op.Operation, op.Namespace, err)
+			if len(stat.ApplyErrors) < maxApplyErrors {
+				stat.ApplyErrors = append(stat.ApplyErrors, pbm.ApplyError{
+					TS:    op.Timestamp,
+					NS:    op.Namespace,
+					Op:    op.Operation,
+					Error: err.Error(),
+				})
+			}
+		})
+	}
+	if options.remapUUID {
+		oplogRestore.SetUUIDLookup(oplog.NewMongoUUIDLookup(ctx, node))
+	}
+
+	if options.opsPerSec > 0 {
+		oplogRestore.SetOpLimiter(storage.NewRateLimiter(options.opsPerSec))
+	}
+	var bytesLimit *storage.RateLimiter
+	if options.bytesPerSec > 0 {
+		bytesLimit = storage.NewRateLimiter(options.bytesPerSec)
+	}
+
+	// throttle downloads beneath the prefetch, so prefetched
+	// chunks served from memory aren't throttled again
+	stg = storage.NewThrottled(stg, options.downloadLimit)
+	if f, ok := chunks.(*fanInChunks); ok {
+		stg = f.over(stg)
+	}
+	var it chunksIter
+	if options.downloaded != nil {
+		stg = options.downloaded.over(stg)
+	} else if options.preDownload {
+		ls, err := preDownload(ctx, stg, chunks, options.preDownloadDir)
+		if err != nil {
+			return nil, errors.Wrap(err, "pre-download chunks")
+		}
+		defer ls.cleanup(log)
+		log.Info("%d chunks are downloaded to %s", len(ls.files), ls.dir)
+		stg = ls
+	} else if options.prefetch > 0 {
+		budget := options.prefetchBudget
+		if budget == nil {
+			budget = NewMemBudget(0)
+		}
+		pf := newPrefetchStorage(ctx, stg, chunks.iter(), options.prefetch, budget)
+		defer pf.stop()
+		stg = pf
+		it = pf.chunks()
+	}
+	if it == nil {
+		it = chunks.iter()
+	}
+	sum := chunks.summary()
 
 	var startTS, endTS primitive.Timestamp
 	if options.start != nil {
 		startTS = *options.start
 	}
+	var resumed *resumeIter
+	if options.resume != nil {
+		var from primitive.Timestamp
+		resumed, from = resumeChunks(it, options.resume)
+		it = resumed
+		if primitive.CompareTimestamp(from, startTS) == 1 {
+			startTS = from
+		}
+		loadCatalog(ic, options.resume.Indexes)
+		log.Info("resuming oplog replay after %v", options.resume.LastTS)
+	}
 	if options.end != nil {
 		endTS = *options.end
 	}
 	oplogRestore.SetTimeframe(startTS, endTS)
+	oplogRestore.SetStopBefore(options.stopBefore)
 	oplogRestore.SetIncludeNS(options.nss)
 
+	if startTS.IsZero() {
+		startTS = sum.From
+	}
+	if endTS.IsZero() {
+		endTS = sum.To
+	}
+	est := newETAEstimator(startTS, endTS, time.Now())
+	dicts := newChunkDicts(stg)
+	cpr := newCheckpointer(options.checkpoint, ic, wallClock, options.checkpointEvery)
+	// the failed replay resumes right after the last replayed chunk
+	defer cpr.flush()
+
 	var lts primitive.Timestamp
-	for _, chnk := range chunks {
+	for i := 0; it.Next(); i++ {
+		chnk := it.Chunk()
+		if options.aborted != nil {
+			if err := options.aborted(); err != nil {
+				return nil, err
+			}
+		}
+
 		log.Debug("+ applying %v", chnk)
 
 		// If the compression is Snappy and it failed we try S2.
@@ -339,67 +1620,412 @@ func applyOplog(node *mongo.Client, chunks []pbm.OplogChunk, options *applyOplog
 		// PBM versions) won’t be compatible - during the restore, PBM will treat such
 		// files as Snappy (judging by its suffix) but in fact, they are s2 files
 		// and restore will fail with snappy: corrupt input. So we try S2 in such a case.
-		lts, err = replayChunk(chnk.FName, oplogRestore, stg, chnk.Compression)
+		_, cspan := startSpan(ctx, "replayChunk",
+			attrRS.String(chnk.RS),
+			attribute.String("pbm.chunk.file", chnk.FName),
+			attribute.String("pbm.chunk.compression", string(chnk.Compression)))
+		stopWatchdog := chunkWatchdog(options.clock, options.slowChunk, func(elapsed time.Duration) {
+			log.Warning("chunk %v.%v - %v.%v is being applied for more than %v",
+				chnk.StartTS.T, chnk.StartTS.I, chnk.EndTS.T, chnk.EndTS.I, elapsed)
+			cspan.AddEvent("slow chunk")
+			options.events.Publish(ChunkSlow{
+				RS:      chnk.RS,
+				StartTS: chnk.StartTS,
+				EndTS:   chnk.EndTS,
+				Elapsed: elapsed,
+			})
+		})
+		var ops oplog.ApplyStat
+		var tm chunkTiming
+		var dict []byte
+		dict, err = dicts.get(&chnk)
+		if err == nil {
+			lts, ops, err = replayChunk(ctx, chnk.FName, chnk.Checksum, oplogRestore, stg, chnk.Compression,
+				dict, options.maxDecompressMem, options.readBuffer, bytesLimit, &tm)
+		}
 		if err != nil && errors.Is(err, snappy.ErrCorrupt) {
-			lts, err = replayChunk(chnk.FName, oplogRestore, stg, compress.CompressionTypeS2)
+			lts, ops, err = replayChunk(ctx, chnk.FName, chnk.Checksum, oplogRestore, stg, compress.CompressionTypeS2,
+				nil, options.maxDecompressMem, options.readBuffer, bytesLimit, &tm)
 		}
+		stopWatchdog()
+		cspan.SetAttributes(
+			attribute.Int64("pbm.ops.applied", ops.Applied),
+			attribute.Int64("pbm.ops.filtered", ops.Filtered))
+		endSpan(cspan, err)
 		if err != nil {
 			return nil, errors.Wrapf(err, "replay chunk %v.%v", chnk.StartTS.T, chnk.EndTS.T)
 		}
+		stat.Ops.Applied += ops.Applied
+		stat.Ops.Filtered += ops.Filtered
+		stat.Ops.Failed += ops.Failed
+		stat.Chunks = i + 1
+		if !lts.IsZero() {
+			stat.LastTS = lts
+		}
+		stat.Timing.Add(tm.read, tm.apply(), tm.bytes)
+		options.events.Publish(ChunkApplied{
+			RS:         chnk.RS,
+			StartTS:    chnk.StartTS,
+			EndTS:      chnk.EndTS,
+			OpsApplied: ops.Applied,
+		})
+		log.Debug("applied %d ops (%d filtered) from chunk %s: %d bytes, read %v, apply %v",
+			ops.Applied, ops.Filtered, chnk.FName, tm.bytes, tm.read, tm.apply())
+
+		eta, ok := est.observe(lts, time.Now())
+		if ok {
+			log.Debug("applied up to %v, eta %v", lts, eta.Round(time.Second))
+		}
+		cpr.chunkDone(lts, oplogRestore.OpenTxns())
+		if options.progress != nil {
+			total := sum.Count
+			if resumed != nil {
+				total -= resumed.skipped
+			}
+			options.progress(replayProgress{
+				lts:    lts,
+				eta:    eta,
+				chunk:  i + 1,
+				chunks: total,
+				ops:    stat.Ops,
+			})
+		}
+		if oplogRestore.Stopped() {
+			log.Info("replay stopped before op %v, last applied %v", options.stopBefore.TS, lts)
+			break
+		}
+	}
+	if err = it.Err(); err != nil {
+		return nil, errors.Wrap(err, "read chunks")
 	}
 
 	// dealing with dist txns
 	if sharded {
-		uc, c := oplogRestore.TxnLeftovers()
-		stat.ShardUncommitted = len(uc)
-		go func() {
-			err := setTxn(c)
-			if err != nil {
-				log.Error("write last committed txns %v", err)
-			}
-		}()
+		uc, c, overflow := oplogRestore.TxnLeftovers()
+		stat.Txn.ShardUncommitted = len(uc)
+		if overflow {
+			log.Warning("more than %d dist txns were committed, older commits are not shared "+
+				"with other shards and their txns might be left uncommitted there. "+
+				"Consider increasing `restore.distTxnRetention`", len(c))
+		}
+		// other shards rely on these to commit their leftovers,
+		// so the restore can't proceed without it
+		err = retryTransient(ctx, log, "write last committed txns", func() error {
+			return setTxn(c)
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "write last committed txns")
+		}
 		if len(uc) > 0 {
-			commits, err := getTxn()
+			var commits map[string]primitive.Timestamp
+			err = retryTransient(ctx, log, "get committed txns", func() error {
+				var err error
+				commits, err = getTxn()
+				return err
+			})
 			if err != nil {
 				return nil, errors.Wrap(err, "get committed txns on other shards")
 			}
 			var uncomm []oplog.Txn
-			partial, uncomm, err = oplogRestore.HandleUncommittedTxn(commits)
+			var decisions []pbm.TxnDecision
+			partial, uncomm, decisions, err = oplogRestore.HandleUncommittedTxn(commits)
 			if err != nil {
 				return nil, errors.Wrap(err, "handle ucommitted transactions")
 			}
 			if len(uncomm) > 0 {
 				log.Info("uncommitted txns %d", len(uncomm))
 			}
-			stat.Partial = len(partial)
-			stat.LeftUncommitted = len(uncomm)
+			for _, d := range decisions {
+				log.Debug("uncommitted txn %s: %s, %d prepared message(s)", d.ID, d.Decision, d.Parts)
+			}
+			stat.Txn.Partial = len(partial)
+			stat.Txn.LeftUncommitted = len(uncomm)
+			stat.Txn.Decisions = truncTxnDecisions(decisions, maxTxnDecisions)
+		}
+	}
+	stat.Txn.Split = oplogRestore.SplitTxns()
+	for _, t := range stat.Txn.Split {
+		exp := "unknown"
+		if t.Expected > 0 {
+			exp = strconv.Itoa(t.Expected)
 		}
+		log.Warning("uncommitted txn %s is split: seen %d of %s prepared messages in %d chunk(s)",
+			t.ID, t.Seen, exp, t.Chunks)
 	}
-	log.Info("oplog replay finished on %v", lts)
+
+	log.Info("oplog replay finished on %v, applied %d ops (%d filtered)", lts, stat.Ops.Applied, stat.Ops.Filtered)
+	if stat.Ops.Failed > 0 {
+		log.Warning("%d ops failed to apply and were skipped", stat.Ops.Failed)
+	}
+	log.Debug("applied ops by namespace: %v", oplogRestore.NSOps())
 
 	return partial, nil
 }
 
+// maxTxnDecisions is the max num of txn decisions saved in the restore
+// stat. Counters have the totals anyway.
+const maxTxnDecisions = 100
+
+// truncTxnDecisions keeps up to n decisions. Partial and dropped txns
+// go first as they're the ones to look into.
+func truncTxnDecisions(d []pbm.TxnDecision, n int) []pbm.TxnDecision {
+	if len(d) <= n {
+		return d
+	}
+
+	rv := make([]pbm.TxnDecision, 0, n)
+	for _, committed := range []bool{false, true} {
+		for _, t := range d {
+			if len(rv) == n {
+				return rv
+			}
+			if (t.Decision == pbm.TxnCommitted) == committed {
+				rv = append(rv, t)
+			}
+		}
+	}
+
+	return rv
+}
+
+// setConf sets options that aren't set yet from the restore config
+func (o *applyOplogOption) setConf(c *pbm.RestoreConf) error {
+	if o.opsPerSec == 0 {
+		o.opsPerSec = c.OplogOpsPerSec
+	}
+	if o.bytesPerSec == 0 {
+		o.bytesPerSec = c.OplogBytesPerSec
+	}
+	if o.writeConcern == nil {
+		var err error
+		o.writeConcern, err = c.OplogWriteConcern.WriteConcern()
+		if err != nil {
+			return errors.Wrap(err, "oplog write concern")
+		}
+	}
+	if o.maxDecompressMem == 0 {
+		o.maxDecompressMem = int64(c.MaxDecompressBufferMb) << 20
+	}
+	if o.readBuffer == 0 {
+		o.readBuffer = c.OplogReadBufferKb << 10
+	}
+	if o.txnRetention == 0 {
+		o.txnRetention = c.DistTxnRetention
+	}
+	if o.slowChunk == 0 {
+		o.slowChunk = time.Duration(c.SlowChunkWarnSec) * time.Second
+	}
+	if o.downloadLimit == nil {
+		o.downloadLimit = sharedDownloadLimit(c.DownloadBytesPerSec)
+	}
+	if c.OplogContinueOnApplyError {
+		o.continueOnApplyError = true
+	}
+	if !o.preDownload && o.downloaded == nil && c.OplogPreDownload {
+		o.preDownload = true
+		o.preDownloadDir = c.OplogPreDownloadDir
+	}
+
+	return nil
+}
+
+// opFilter returns the filter of all enabled options. System ops are
+// checked first as the cheapest one.
+func (o *applyOplogOption) opFilter() oplog.OpFilter {
+	var filters []oplog.OpFilter
+	if o.skipSystemNS {
+		filters = append(filters, notSystemOp)
+	}
+
+	return oplog.CombineFilters(append(filters, o.filter)...)
+}
+
+func notSystemOp(r *oplog.Record) bool { return !oplog.IsSystemOp(r) }
+
+// chunkWatchdog calls warn once if the chunk isn't applied within
+// `after`. The returned func stops the watchdog and has to be called
+// when the chunk is done, no warn is called once it returns. Zero
+// `after` disables the watchdog. Nil clk means the real clock.
+func chunkWatchdog(clk Clock, after time.Duration, warn func(elapsed time.Duration)) func() {
+	if after <= 0 {
+		return func() {}
+	}
+	if clk == nil {
+		clk = wallClock
+	}
+
+	tk := clk.NewTicker(after)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer tk.Stop()
+
+		select {
+		case <-tk.C():
+			warn(after)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// replayChunk opens the chunk object on the storage and applies it,
+// see replayChunkReader. The open (e.g. S3 request latency) is counted as
+// the read time of the chunk.
+//
+//nolint:nonamedreturns
 func replayChunk(
-	file string,
+	ctx context.Context,
+	file,
+	sum string,
 	oplog *oplog.OplogRestore,
 	stg storage.Storage,
 	c compress.CompressionType,
-) (primitive.Timestamp, error) {
-	or, err := stg.SourceReader(file)
+	dict []byte,
+	maxMem int64,
+	bufSize int,
+	limit *storage.RateLimiter,
+	tm *chunkTiming,
+) (lts primitive.Timestamp, stat oplog.ApplyStat, err error) {
+	start := time.Now()
+	r, err := openChunkObject(ctx, stg, file, sum, bufSize)
+	open := time.Since(start)
+	tm.read += open
+	tm.total += open
+	if err != nil {
+		return lts, stat, err
+	}
+
+	return replayChunkReader(r, file, oplog, c, dict, maxMem, limit, tm)
+}
+
+// openChunkObject opens the chunk object on the storage. The checksum
+// (if any) of the whole object is verified on close.
+func openChunkObject(ctx context.Context, stg storage.Storage, file, sum string, bufSize int) (io.ReadCloser, error) {
+	// fails on empty objects as well, in one round trip where possible
+	sr, _, err := storage.SourceReaderWithStatContext(ctx, stg, file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get object %s form the storage", file)
+	}
+	or, err := storage.VerifyReader(sr, sum)
+	if err != nil {
+		sr.Close()
+		return nil, errors.Wrapf(err, "object %s", file)
+	}
+
+	var chunk io.Reader = or
+	if bufSize > 0 {
+		chunk = bufio.NewReaderSize(or, bufSize)
+	}
+
+	return &chunkReadCloser{Reader: chunk, closers: []io.Closer{or}, name: file}, nil
+}
+
+// decompressChunk returns the decompressed oplog of the chunk read from r.
+// r is closed along with the returned reader.
+func decompressChunk(
+	r io.ReadCloser,
+	name string,
+	c compress.CompressionType,
+	dict []byte,
+	maxMem int64,
+) (io.ReadCloser, error) {
+	dr, err := compress.DecompressWithDict(r, c, maxMem, dict)
 	if err != nil {
-		lts := primitive.Timestamp{}
-		return lts, errors.Wrapf(err, "get object %s form the storage", file)
+		r.Close()
+		return nil, errors.Wrapf(err, "decompress object %s", name)
 	}
-	defer or.Close()
 
-	oplogReader, err := compress.Decompress(or, c)
+	return &decompressedChunk{ReadCloser: dr, chunk: r}, nil
+}
+
+// decompressedChunk closes the decompressor along with the chunk. The
+// chunk Close error (like the checksum mismatch) is returned.
+type decompressedChunk struct {
+	io.ReadCloser
+	chunk io.Closer
+}
+
+func (d *decompressedChunk) Close() error {
+	d.ReadCloser.Close()
+	return d.chunk.Close()
+}
+
+// replayChunkReader applies the chunk read from r. The chunk is compressed
+// with `c`, a reader that is already decompressed goes with the none
+// compression. So the chunk can be opened (and decompressed)
+// ahead, e.g. by the prefetch. r is closed when the chunk is applied and
+// its Close error (like the checksum mismatch) fails the chunk.
+// The time spent is added to tm.
+//
+//nolint:nonamedreturns
+func replayChunkReader(
+	r io.ReadCloser,
+	name string,
+	oplog *oplog.OplogRestore,
+	c compress.CompressionType,
+	dict []byte,
+	maxMem int64,
+	limit *storage.RateLimiter,
+	tm *chunkTiming,
+) (lts primitive.Timestamp, stat oplog.ApplyStat, err error) {
+	start := time.Now()
+	defer func() { tm.total += time.Since(start) }()
+
+	oplogReader, err := decompressChunk(r, name, c, dict, maxMem)
 	if err != nil {
-		lts := primitive.Timestamp{}
-		return lts, errors.Wrapf(err, "decompress object %s", file)
+		return lts, stat, err
+	}
+	defer func() {
+		if cerr := oplogReader.Close(); err == nil && cerr != nil {
+			err = cerr
+		}
+	}()
+
+	// the oplog is read op by op, the buffer keeps the clock off the ops
+	var src io.Reader = bufio.NewReaderSize(timedReader{r: oplogReader, t: tm}, timedReadSize)
+	if limit != nil {
+		src = storage.NewThrottledReader(src, limit)
+	}
+
+	lts, stat, err = oplog.Apply(io.NopCloser(src))
+	return lts, stat, errors.Wrap(err, "apply oplog for chunk")
+}
+
+const timedReadSize = 32 << 10
+
+// chunkTiming is the wall-clock time spent on the chunk replay
+type chunkTiming struct {
+	// read is the time of reading and decompressing the chunk,
+	// the rest of the total is applying it
+	read  time.Duration
+	total time.Duration
+	// bytes is the size of the decompressed oplog
+	bytes int64
+}
+
+func (t *chunkTiming) apply() time.Duration {
+	if t.read > t.total {
+		return 0
 	}
-	defer oplogReader.Close()
+	return t.total - t.read
+}
+
+// timedReader sums up the time spent in reads and the bytes read
+type timedReader struct {
+	r io.Reader
+	t *chunkTiming
+}
 
-	lts, err := oplog.Apply(oplogReader)
-	return lts, errors.Wrap(err, "apply oplog for chunk")
+func (r timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := r.r.Read(p)
+	r.t.read += time.Since(start)
+	r.t.bytes += int64(n)
+	return n, err
 }
@@ -0,0 +1,107 @@
+package restore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// nodeRoleChanged returns ErrRoleChanged if the node with the `was` info
+// is no longer the same restore target. The oplog is replayed on the
+// primary, so a step down (or a step up of the secondary) or moving to
+// another replset invalidates the replay.
+func nodeRoleChanged(was, now *pbm.NodeInfo) error {
+	switch {
+	case now.SetName != was.SetName:
+		return errors.Wrapf(ErrRoleChanged, "replset %s -> %s", was.SetName, now.SetName)
+	case was.IsPrimary && !now.IsPrimary:
+		return errors.Wrapf(ErrRoleChanged, "%s stepped down, the primary is %q", was.Me, now.Primary)
+	case !was.IsPrimary && now.IsPrimary:
+		return errors.Wrapf(ErrRoleChanged, "%s became primary", was.Me)
+	}
+
+	return nil
+}
+
+// roleGuard cancels the replay once the node is no longer a valid
+// restore target. The role is checked periodically, see watch.
+type roleGuard struct {
+	check  func() error
+	cancel context.CancelFunc
+
+	mu  sync.Mutex
+	err error
+}
+
+// newRoleGuard returns the guard and the ctx for the replay canceled on
+// the first error of `check`. The guard has to be stopped by the caller.
+func newRoleGuard(ctx context.Context, check func() error) (context.Context, *roleGuard) {
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, &roleGuard{check: check, cancel: cancel}
+}
+
+// watch checks the role every interval of the clock in the background
+// until the returned stop func is called or the replay is canceled
+func (g *roleGuard) watch(clk Clock, interval time.Duration) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		tk := clk.NewTicker(interval)
+		defer tk.Stop()
+
+		for {
+			select {
+			case <-tk.C():
+				if !g.poll() {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// poll checks the role and cancels the replay if it has changed.
+// It returns false once the replay is canceled.
+func (g *roleGuard) poll() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.err != nil {
+		return false
+	}
+	if err := g.check(); err != nil {
+		g.err = err
+		g.cancel()
+		return false
+	}
+
+	return true
+}
+
+// wrap returns the role change error instead of err if the replay was
+// canceled by the guard, so the caller gets the cause rather than
+// the ctx cancellation.
+func (g *roleGuard) wrap(err error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err != nil && g.err != nil {
+		return g.err
+	}
+	return err
+}
+
+func (g *roleGuard) stop() { g.cancel() }
@@ -0,0 +1,106 @@
+package restore
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+)
+
+func TestNodeRoleChanged(t *testing.T) {
+	primary := &pbm.NodeInfo{SetName: "rs0", Me: "rs0-1:27017", IsPrimary: true}
+
+	cases := []struct {
+		name    string
+		was     *pbm.NodeInfo
+		now     *pbm.NodeInfo
+		changed bool
+	}{
+		{"same", primary, &pbm.NodeInfo{SetName: "rs0", IsPrimary: true}, false},
+		{"step down", primary, &pbm.NodeInfo{SetName: "rs0", Primary: "rs0-2:27017", Secondary: true}, true},
+		{"step up", &pbm.NodeInfo{SetName: "rs0", Secondary: true}, &pbm.NodeInfo{SetName: "rs0", IsPrimary: true}, true},
+		{"replset", primary, &pbm.NodeInfo{SetName: "rs1", IsPrimary: true}, true},
+	}
+	for _, c := range cases {
+		err := nodeRoleChanged(c.was, c.now)
+		if c.changed != errors.Is(err, ErrRoleChanged) {
+			t.Errorf("%s: expected changed %v, got %v", c.name, c.changed, err)
+		}
+	}
+}
+
+func TestReplayAbortOnRoleChange(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone, StartTS: ts(1), EndTS: ts(5)},
+		{RS: "rs0", FName: "c2", Compression: compress.CompressionTypeNone, StartTS: ts(5), EndTS: ts(10)},
+		{RS: "rs0", FName: "c3", Compression: compress.CompressionTypeNone, StartTS: ts(10), EndTS: ts(15)},
+	}
+	stg := memStorage{
+		"c1": noopChunk(t, 1, 2, 3, 4, 5),
+		"c2": noopChunk(t, 6, 7, 8, 9, 10),
+		"c3": noopChunk(t, 11, 12, 13, 14, 15),
+	}
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+
+	// the role is checked once after each chunk, `changed` tells
+	// if the check is expected to abort the replay
+	run := func(check func() error, changed func() bool) (int, error) {
+		clk := newTickClock()
+		ctx, guard := newRoleGuard(context.Background(), check)
+		defer guard.stop()
+
+		stop := guard.watch(clk, roleCheckInterval)
+		var done int
+		_, err := applyOplog(ctx, nil, chunkList(chunks), &applyOplogOption{
+			progress: func(p replayProgress) {
+				done = p.chunk
+				clk.tick()
+				if changed() {
+					<-ctx.Done()
+				}
+			},
+		}, false, nil, nil, nil, &pbm.RestoreShardStat{},
+			&pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+		stop()
+
+		return done, guard.wrap(err)
+	}
+
+	// steps down after the second chunk
+	var checks int32
+	var progressed int
+	done, err := run(func() error {
+		if atomic.AddInt32(&checks, 1) == 2 {
+			return nodeRoleChanged(&pbm.NodeInfo{SetName: "rs0", Me: "rs0-1:27017", IsPrimary: true},
+				&pbm.NodeInfo{SetName: "rs0", Primary: "rs0-2:27017", Secondary: true})
+		}
+		return nil
+	}, func() bool {
+		progressed++
+		return progressed == 2
+	})
+	if !errors.Is(err, ErrRoleChanged) {
+		t.Fatalf("expected role change error, got %v", err)
+	}
+	if done != 2 {
+		t.Errorf("expected the replay to stop after the second chunk, done %d", done)
+	}
+	if n := atomic.LoadInt32(&checks); n != 2 {
+		t.Errorf("expected no role checks after the abort, got %d checks", n)
+	}
+
+	done, err = run(func() error { return nil }, func() bool { return false })
+	if err != nil {
+		t.Errorf("unexpected error with the same role: %v", err)
+	}
+	if done != len(chunks) {
+		t.Errorf("expected all chunks replayed, done %d", done)
+	}
+}
@@ -0,0 +1,150 @@
+package restore
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+)
+
+// slowStorage delays each read so chunk apply takes a while
+type slowStorage struct {
+	memStorage
+	delay time.Duration
+}
+
+func (s slowStorage) SourceReader(name string) (io.ReadCloser, error) {
+	r, err := s.memStorage.SourceReader(name)
+	if err != nil {
+		return nil, err
+	}
+	return slowReader{r, s.delay}, nil
+}
+
+type slowReader struct {
+	io.ReadCloser
+	delay time.Duration
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	if len(p) > 16 {
+		p = p[:16]
+	}
+	return r.ReadCloser.Read(p)
+}
+
+// tickStorage ticks the clock on each open, so the chunk is applied
+// for a tick at least
+type tickStorage struct {
+	memStorage
+	clk *tickClock
+}
+
+func (s tickStorage) SourceReader(name string) (io.ReadCloser, error) {
+	s.clk.tick()
+	return s.memStorage.SourceReader(name)
+}
+
+func TestHeartbeatDuringSlowReplay(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone, StartTS: ts(1), EndTS: ts(5)},
+		{RS: "rs0", FName: "c2", Compression: compress.CompressionTypeNone, StartTS: ts(5), EndTS: ts(10)},
+		{RS: "rs0", FName: "c3", Compression: compress.CompressionTypeNone, StartTS: ts(10), EndTS: ts(15)},
+	}
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+
+	// each chunk takes a heartbeat interval to apply
+	clk := newTickClock()
+	stg := tickStorage{
+		memStorage: memStorage{
+			"c1": noopChunk(t, 1, 2, 3, 4, 5),
+			"c2": noopChunk(t, 6, 7, 8, 9, 10),
+			"c3": noopChunk(t, 11, 12, 13, 14, 15),
+		},
+		clk: clk,
+	}
+
+	var beats int32
+	stop := startHeartbeat(clk, lockHBInterval, func() error {
+		atomic.AddInt32(&beats, 1)
+		return nil
+	}, l)
+
+	_, err := applyOplog(context.Background(), nil, chunkList(chunks), &applyOplogOption{}, false,
+		nil, nil, nil, &pbm.RestoreShardStat{},
+		&pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+	stop()
+	if err != nil {
+		t.Fatalf("apply oplog: %v", err)
+	}
+
+	if n := atomic.LoadInt32(&beats); n != int32(len(chunks)) {
+		t.Errorf("expected a heartbeat per slow chunk (%d), got %d", len(chunks), n)
+	}
+
+	// no beats after stop
+	select {
+	case clk.c <- clk.Now():
+		t.Errorf("heartbeat continued after stop")
+	default:
+	}
+}
+
+func TestSlowChunkWarning(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone, StartTS: ts(1), EndTS: ts(5)},
+	}
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+	const threshold = 20 * time.Second
+
+	run := func(long bool) []ChunkSlow {
+		clk := newTickClock()
+		var stg storage.Storage = memStorage{"c1": noopChunk(t, 1, 2, 3, 4, 5)}
+		if long {
+			stg = tickStorage{memStorage: stg.(memStorage), clk: clk}
+		}
+		bus := NewEventBus()
+		events, unsubscribe := bus.Subscribe(16)
+
+		_, err := applyOplog(context.Background(), nil, chunkList(chunks),
+			&applyOplogOption{events: bus, slowChunk: threshold, clock: clk}, false,
+			nil, nil, nil, &pbm.RestoreShardStat{},
+			&pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+		if err != nil {
+			t.Fatalf("apply oplog: %v", err)
+		}
+		// the watchdog is stopped by now
+		unsubscribe()
+
+		var slow []ChunkSlow
+		for e := range events {
+			if s, ok := e.(ChunkSlow); ok {
+				slow = append(slow, s)
+			}
+		}
+		return slow
+	}
+
+	slow := run(true)
+	if len(slow) != 1 {
+		t.Fatalf("expected 1 slow chunk warning, got %d", len(slow))
+	}
+	if slow[0].StartTS != ts(1) || slow[0].EndTS != ts(5) || slow[0].Elapsed != threshold {
+		t.Errorf("unexpected warning %+v", slow[0])
+	}
+
+	if slow := run(false); len(slow) != 0 {
+		t.Errorf("expected no warnings for a fast chunk, got %v", slow)
+	}
+}
@@ -0,0 +1,241 @@
+package restore
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/mongodb/mongo-tools/common/idx"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+	"github.com/percona/percona-backup-mongodb/pbm/oplog"
+	"github.com/percona/percona-backup-mongodb/pbm/sel"
+	"github.com/percona/percona-backup-mongodb/pbm/snapshot"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+)
+
+// StandaloneOptions are options of the restore onto a standalone mongod
+type StandaloneOptions struct {
+	// Replset is the backup's replset to restore. It's required
+	// if the backup has more than one replset (sharded cluster).
+	Replset string
+	// Namespaces to restore. Empty means all namespaces of the backup
+	Namespaces []string
+	// SkipVersionCheck skips the mongo version compatibility check of the oplog
+	SkipVersionCheck bool
+}
+
+// RestoreStandalone restores the logical backup of a replset onto the
+// standalone mongod. There is only one node, so there is no cluster
+// convergence, no restore metadata and no distributed transactions sync.
+// Transactions are applied as if the replset was the whole cluster.
+func RestoreStandalone(
+	ctx context.Context,
+	node *pbm.Node,
+	cfg pbm.Config,
+	bcp *pbm.BackupMeta,
+	opts StandaloneOptions,
+	l *log.Event,
+) error {
+	inf, err := node.GetInfo()
+	if err != nil {
+		return errors.Wrap(err, "get node info")
+	}
+	if inf.SetName != "" {
+		return errors.Errorf("node is a member of the replica set %q, not a standalone", inf.SetName)
+	}
+
+	stg, err := pbm.Storage(cfg, l)
+	if err != nil {
+		return errors.Wrap(err, "get storage")
+	}
+
+	s := &standalone{
+		stg: stg,
+		ic:  idx.NewIndexCatalog(),
+		log: l,
+	}
+	s.restoreDump = func(bcp *pbm.BackupMeta, rs *pbm.BackupReplset, nss []string) error {
+		return s.runDump(ctx, node, cfg, bcp, rs, nss)
+	}
+	s.applyOplog = func(chunks []pbm.OplogChunk, o *applyOplogOption) error {
+		mgoV, err := node.GetMongoVersion()
+		if err != nil || len(mgoV.Version) < 1 {
+			return errors.Wrap(err, "define mongo version")
+		}
+
+		if o.srcFCV != "" {
+			o.dstFCV, err = node.GetFeatureCompatibilityVersion()
+			if err != nil {
+				return errors.Wrap(err, "get featureCompatibilityVersion")
+			}
+		}
+
+		err = o.setConf(&cfg.Restore)
+		if err != nil {
+			return err
+		}
+
+		return s.apply(ctx, node.Session(), chunks, o, mgoV)
+	}
+	s.buildIndexes = func(nss []string) error {
+		b := oplog.NewIncompatibleIndexes(oplog.NewMongoIndexBuilder(ctx, node.Session(), nil),
+			cfg.Restore.SkipIncompatibleIndexes)
+		err := buildIndexes(ctx, s.ic, nss, cfg.Restore.IndexBuildConcurrency, b, l)
+		for _, i := range b.List() {
+			l.Warning("incompatible index %q on %s: %s", i.Name, i.NS, i.Reason)
+		}
+		return err
+	}
+
+	return s.run(bcp, opts)
+}
+
+// standalone restore steps. They are set by RestoreStandalone and
+// replaced in tests.
+type standalone struct {
+	stg storage.Storage
+	ic  *idx.IndexCatalog
+	log *log.Event
+
+	restoreDump  func(bcp *pbm.BackupMeta, rs *pbm.BackupReplset, nss []string) error
+	applyOplog   func(chunks []pbm.OplogChunk, o *applyOplogOption) error
+	buildIndexes func(nss []string) error
+}
+
+func (s *standalone) run(bcp *pbm.BackupMeta, opts StandaloneOptions) error {
+	if bcp.Status != pbm.StatusDone {
+		return errors.Errorf("backup wasn't successful: status: %s, error: %s",
+			bcp.Status, bcp.Error())
+	}
+	if bcp.Type != pbm.LogicalBackup {
+		return errors.Errorf("%s backup can't be restored onto a standalone", bcp.Type)
+	}
+
+	rs, err := standaloneSource(bcp, opts.Replset)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.stg.FileStat(rs.DumpName)
+	if err != nil {
+		return errors.Errorf("failed to ensure snapshot file %s: %v", rs.DumpName, err)
+	}
+	_, err = s.stg.FileStat(rs.OplogName)
+	if err != nil {
+		return errors.Errorf("failed to ensure oplog file %s: %v", rs.OplogName, err)
+	}
+
+	nss := opts.Namespaces
+	if !sel.IsSelective(nss) {
+		nss = bcp.Namespaces
+	}
+
+	s.log.Info("restoring replset %q of %q onto the standalone", rs.Name, bcp.Name)
+	err = s.restoreDump(bcp, rs, nss)
+	if err != nil {
+		return errors.Wrap(err, "restore dump")
+	}
+
+	o := &applyOplogOption{nss: nss}
+	if !opts.SkipVersionCheck {
+		o.srcVersion = bcp.MongoVersion
+		o.srcFCV = bcp.FCV
+	}
+	err = s.applyOplog([]pbm.OplogChunk{{
+		RS:          rs.Name,
+		FName:       rs.OplogName,
+		Compression: bcp.Compression,
+		StartTS:     rs.FirstWriteTS,
+		EndTS:       rs.LastWriteTS,
+		Checksum:    rs.OplogChecksum,
+	}}, o)
+	if err != nil {
+		return errors.Wrap(err, "apply oplog")
+	}
+
+	return errors.WithMessage(s.buildIndexes(nss), "restore indexes")
+}
+
+// standaloneSource returns the backup's replset to restore. The backup of
+// a sharded cluster has many replsets, so the one has to be selected.
+func standaloneSource(bcp *pbm.BackupMeta, name string) (*pbm.BackupReplset, error) {
+	if name == "" {
+		if len(bcp.Replsets) != 1 {
+			names := make([]string, len(bcp.Replsets))
+			for i := range bcp.Replsets {
+				names[i] = bcp.Replsets[i].Name
+			}
+			return nil, errors.Errorf("backup has %d replsets (%s), select one to restore onto the standalone",
+				len(bcp.Replsets), strings.Join(names, ", "))
+		}
+
+		return &bcp.Replsets[0], nil
+	}
+
+	for i := range bcp.Replsets {
+		if bcp.Replsets[i].Name == name {
+			return &bcp.Replsets[i], nil
+		}
+	}
+
+	return nil, errors.Errorf("replset %q not found in the backup", name)
+}
+
+func (s *standalone) runDump(
+	ctx context.Context,
+	node *pbm.Node,
+	cfg pbm.Config,
+	bcp *pbm.BackupMeta,
+	rs *pbm.BackupReplset,
+	nss []string,
+) error {
+	rdr, err := downloadDump(cfg, bcp, rs.Name, rs.DumpName, nss, func(r io.Reader) error {
+		return loadIndexes(s.ic, r)
+	}, s.log)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+
+	rf, err := snapshot.NewRestore(node.ConnURI(), &cfg)
+	if err != nil {
+		return err
+	}
+	_, err = rf.ReadFrom(rdr)
+	if err != nil {
+		return errors.Wrap(err, "mongorestore")
+	}
+
+	if sel.IsSelective(nss) {
+		return nil
+	}
+
+	return restoreUsers(ctx, node, s.log)
+}
+
+// apply replays the oplog as on the unsharded replset, so distributed
+// transactions are committed right away with no cross-shard sync
+func (s *standalone) apply(
+	ctx context.Context,
+	m *mongo.Client,
+	chunks []pbm.OplogChunk,
+	o *applyOplogOption,
+	mgoV *pbm.MongoVersion,
+) error {
+	stat := pbm.RestoreShardStat{}
+	partial, err := applyOplog(ctx, m, chunkList(chunks), o, false,
+		s.ic, nil, nil, &stat, mgoV, s.stg, s.log)
+	if err != nil {
+		return errors.Wrap(err, "reply oplog")
+	}
+
+	if len(partial) > 0 {
+		s.log.Warning("%d transactions weren't committed by the end of the oplog", len(partial))
+	}
+
+	return nil
+}
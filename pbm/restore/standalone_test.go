@@ -0,0 +1,97 @@
+package restore
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mongodb/mongo-tools/common/idx"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+)
+
+func standaloneBackup(rs ...string) *pbm.BackupMeta {
+	bcp := &pbm.BackupMeta{
+		Name:        "bcp",
+		Type:        pbm.LogicalBackup,
+		Status:      pbm.StatusDone,
+		Compression: compress.CompressionTypeNone,
+	}
+	for _, name := range rs {
+		bcp.Replsets = append(bcp.Replsets, pbm.BackupReplset{
+			Name:      name,
+			DumpName:  name + ".dump",
+			OplogName: name + ".oplog",
+		})
+	}
+
+	return bcp
+}
+
+func TestStandaloneRestore(t *testing.T) {
+	stg := memStorage{
+		"rs0.dump":  []byte("dump"),
+		"rs0.oplog": noopChunk(t, 1, 2, 3),
+	}
+
+	var dumped string
+	var applied []pbm.OplogChunk
+	indexes := false
+	s := &standalone{
+		stg: stg,
+		ic:  idx.NewIndexCatalog(),
+		log: log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{}),
+	}
+	s.restoreDump = func(_ *pbm.BackupMeta, rs *pbm.BackupReplset, _ []string) error {
+		dumped = rs.Name
+		return nil
+	}
+	s.applyOplog = func(chunks []pbm.OplogChunk, o *applyOplogOption) error {
+		applied = chunks
+		// no cross-shard txn sync: set/get txn fns are nil
+		return s.apply(context.Background(), nil, chunks, o, &pbm.MongoVersion{Version: []int{6, 0, 0}})
+	}
+	s.buildIndexes = func([]string) error {
+		indexes = true
+		return nil
+	}
+
+	err := s.run(standaloneBackup("rs0"), StandaloneOptions{SkipVersionCheck: true})
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if dumped != "rs0" {
+		t.Errorf("expected rs0 dump to be restored, got %q", dumped)
+	}
+	if len(applied) != 1 || applied[0].FName != "rs0.oplog" {
+		t.Errorf("expected the rs0 oplog to be applied, got %v", applied)
+	}
+	if !indexes {
+		t.Errorf("expected indexes to be built")
+	}
+}
+
+func TestStandaloneSource(t *testing.T) {
+	_, err := standaloneSource(standaloneBackup("rs0", "rs1", "cfg"), "")
+	if err == nil || !strings.Contains(err.Error(), "select one") {
+		t.Errorf("expected sharded backup to be refused, got %v", err)
+	}
+
+	rs, err := standaloneSource(standaloneBackup("rs0", "rs1", "cfg"), "rs1")
+	if err != nil || rs.Name != "rs1" {
+		t.Errorf("expected selected rs1, got %v, %v", rs, err)
+	}
+
+	_, err = standaloneSource(standaloneBackup("rs0"), "rs5")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected unknown replset error, got %v", err)
+	}
+
+	rs, err = standaloneSource(standaloneBackup("rs0"), "")
+	if err != nil || rs.Name != "rs0" {
+		t.Errorf("expected the sole rs0, got %v, %v", rs, err)
+	}
+}
@@ -0,0 +1,121 @@
+package restore
+
+import (
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// statusOrder is the order of the statuses the logical restore moves through
+var statusOrder = []pbm.Status{pbm.StatusStarting, pbm.StatusRunning, pbm.StatusDumpDone, pbm.StatusDone}
+
+func statusRank(s pbm.Status) int {
+	for i, o := range statusOrder {
+		if o == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// ClusterState is the state of the restore across the cluster
+// for external coordinators, see ClusterRestoreState
+type ClusterState struct {
+	Name   string     `json:"name"`
+	Status pbm.Status `json:"status"`
+	Error  string     `json:"error,omitempty"`
+	// Target is the status the shards converge to. It's the cluster
+	// status if there is no transition in progress
+	Target pbm.Status `json:"target"`
+	// Waiting is true while the leader waits for the shards to reach Target
+	Waiting     bool                `json:"waiting"`
+	ClusterTime primitive.Timestamp `json:"clusterTime"`
+	Shards      []ShardState        `json:"shards"`
+}
+
+// ShardState is the state of the restore on the shard
+type ShardState struct {
+	Name   string     `json:"name"`
+	Status pbm.Status `json:"status"`
+	Error  string     `json:"error,omitempty"`
+	// Heartbeat is the last beat of the shard's lock. It's zero if
+	// there is no lock, e.g. the shard has finished and cleaned it
+	Heartbeat primitive.Timestamp `json:"heartbeat"`
+	Stale     bool                `json:"stale"`
+	// AppliedTS is the last op applied by the oplog replay
+	AppliedTS primitive.Timestamp `json:"appliedTS"`
+	// Behind is true if the shard hasn't reached the Target yet
+	Behind bool `json:"behind"`
+}
+
+// ClusterRestoreState returns the state of the restore `name` across the
+// cluster in one read: the statuses and heartbeats of the shards and the
+// status they converge to.
+func ClusterRestoreState(cn *pbm.PBM, name string) (*ClusterState, error) {
+	meta, err := cn.GetRestoreMeta(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "get restore metadata")
+	}
+
+	clusterTime, err := cn.ClusterTime()
+	if err != nil {
+		return nil, errors.Wrap(err, "read cluster time")
+	}
+
+	rss := make([]string, len(meta.Replsets))
+	for i, rs := range meta.Replsets {
+		rss[i] = rs.Name
+	}
+	beats, err := shardsBeats(cn, meta.OPID, rss)
+	if err != nil {
+		return nil, err
+	}
+
+	return clusterState(meta, beats, clusterTime), nil
+}
+
+func clusterState(meta *pbm.RestoreMeta, beats []shardBeat, clusterTime primitive.Timestamp) *ClusterState {
+	s := &ClusterState{
+		Name:        meta.Name,
+		Status:      meta.Status,
+		Error:       meta.Error,
+		Target:      meta.Status,
+		ClusterTime: clusterTime,
+	}
+
+	// shards move to the next status first and then the leader moves
+	// the cluster, so the most advanced shard shows the target
+	if statusRank(meta.Status) >= 0 && meta.Status != pbm.StatusDone {
+		for _, rs := range meta.Replsets {
+			if statusRank(rs.Status) > statusRank(s.Target) {
+				s.Target = rs.Status
+			}
+		}
+	}
+	s.Waiting = s.Target != meta.Status
+
+	hbs := make(map[string]shardBeat, len(beats))
+	for _, b := range beats {
+		hbs[b.rs] = b
+	}
+	for _, rs := range meta.Replsets {
+		sh := ShardState{
+			Name:      rs.Name,
+			Status:    rs.Status,
+			Error:     rs.Error,
+			AppliedTS: rs.CurrentOp,
+		}
+		if b, ok := hbs[rs.Name]; ok {
+			sh.Heartbeat = b.hb
+			sh.Stale = b.stale(clusterTime, pbm.StaleFrameSec)
+		}
+		if s.Waiting {
+			r := statusRank(rs.Status)
+			sh.Behind = r >= 0 && r < statusRank(s.Target)
+		}
+		s.Shards = append(s.Shards, sh)
+	}
+
+	return s
+}
@@ -0,0 +1,179 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+	"github.com/percona/percona-backup-mongodb/pbm/pitr"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+)
+
+func TestStorageOverride(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: 1594828700 + t, I: 1} }
+	c1 := pitr.ChunkName("rs0", ts(1), ts(10), compress.CompressionTypeNone)
+	c2 := pitr.ChunkName("rs0", ts(10), ts(20), compress.CompressionTypeS2)
+	override := memStorage{
+		"bcp" + pbm.MetadataFileSuffix: []byte(`{"schema_version":1,"name":"bcp","type":"logical","status":"done"}`),
+		c1:                             noopChunk(t, ts(1).T, ts(5).T, ts(10).T),
+		c2:                             rsNoopChunk(t, "rs0", compress.CompressionTypeS2, ts(10).T, ts(20).T),
+	}
+
+	// no cluster connection: with the override, neither the meta nor
+	// the chunks are looked up in the db
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+	r := &Restore{
+		stg:      override,
+		stgConf:  &pbm.StorageConf{},
+		ctx:      context.Background(),
+		nodeInfo: &pbm.NodeInfo{SetName: "rs0"},
+		log:      l,
+	}
+	bcp, err := r.snapshotMeta("bcp")
+	if err != nil {
+		t.Fatalf("get meta from the override: %v", err)
+	}
+	if bcp.Name != "bcp" || bcp.Status != pbm.StatusDone {
+		t.Errorf("unexpected meta %+v", bcp)
+	}
+
+	chunks, err := r.chunks(ts(5), ts(20))
+	if err != nil {
+		t.Fatalf("get chunks from the override: %v", err)
+	}
+	if s := chunks.summary(); s.Count != 2 || s.From != ts(1) || s.To != ts(20) {
+		t.Errorf("expected 2 chunks 1 - 20 of the override, got %+v", s)
+	}
+
+	stat := pbm.RestoreShardStat{}
+	_, err = applyOplog(context.Background(), nil, chunks, &applyOplogOption{}, false,
+		nil, nil, nil, &stat, &pbm.MongoVersion{Version: []int{6, 0, 0}}, r.stg, l)
+	if err != nil {
+		t.Errorf("replay chunks from the override: %v", err)
+	}
+	if stat.Chunks != 2 || stat.LastTS != ts(20) {
+		t.Errorf("expected 2 chunks replayed up to %v, got %d up to %v", ts(20), stat.Chunks, stat.LastTS)
+	}
+
+	// a chunk gone from the override is missing, not looked up elsewhere
+	delete(override, c2)
+	if _, err = r.chunks(ts(5), ts(20)); err == nil {
+		t.Errorf("expected the replay range not covered without the chunk")
+	}
+}
+
+func TestReplayChunkChecksum(t *testing.T) {
+	data := noopChunk(t, 1, 2, 3)
+	h := storage.NewChecksum()
+	h.Write(data)
+	sum := storage.FormatChecksum(h)
+
+	// still a valid oplog, so the mismatch is the only reason to fail
+	stg := memStorage{"ok": data, "bad": noopChunk(t, 1, 2, 4)}
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+	replay := func(name string) error {
+		chunks := []pbm.OplogChunk{{
+			RS: "rs0", FName: name, Compression: compress.CompressionTypeNone, Checksum: sum,
+		}}
+		_, err := applyOplog(context.Background(), nil, chunkList(chunks), &applyOplogOption{unsafe: true}, false,
+			nil, nil, nil, &pbm.RestoreShardStat{}, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+		return err
+	}
+
+	if err := replay("ok"); err != nil {
+		t.Errorf("expected matching checksum, got %v", err)
+	}
+	if err := replay("bad"); !errors.Is(err, storage.ErrChecksumMismatch) {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func compressedChunk(t *testing.T, c compress.CompressionType, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := compress.Compress(&buf, c, nil)
+	if err != nil {
+		t.Fatalf("compress %s: %v", c, err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("compress %s: %v", c, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("compress %s: %v", c, err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestReplayMixedCompression(t *testing.T) {
+	// chunks of two backups made with different codecs
+	stg := memStorage{
+		"nightly":  compressedChunk(t, compress.CompressionTypeLZ4, indexOpsChunkAt(t, 1, createIndexOp("c", "a"))),
+		"archival": compressedChunk(t, compress.CompressionTypeZstandard, indexOpsChunkAt(t, 10, dropIndexOp("c", "a"))),
+	}
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "nightly", Compression: compress.CompressionTypeLZ4},
+		{RS: "rs0", FName: "archival", Compression: compress.CompressionTypeZstandard},
+	}
+
+	bus := NewEventBus()
+	events, unsubscribe := bus.Subscribe(len(chunks))
+
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+	_, err := applyOplog(context.Background(), nil, chunkList(chunks), &applyOplogOption{unsafe: true, events: bus}, false,
+		nil, nil, nil, &pbm.RestoreShardStat{}, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+	if err != nil {
+		t.Fatalf("replay mixed codecs: %v", err)
+	}
+	unsubscribe()
+
+	var applied int64
+	for e := range events {
+		if c, ok := e.(ChunkApplied); ok {
+			applied += c.OpsApplied
+		}
+	}
+	if applied != 2 {
+		t.Errorf("expected ops of both chunks to be applied, got %d", applied)
+	}
+}
+
+func TestWarnManyChunks(t *testing.T) {
+	index := func(n int) pbm.ChunksSummary {
+		c := make([]pbm.OplogChunk, n)
+		for i := range c {
+			c[i] = pbm.OplogChunk{
+				RS:      "rs0",
+				StartTS: primitive.Timestamp{T: uint32(i)},
+				EndTS:   primitive.Timestamp{T: uint32(i + 1)},
+			}
+		}
+		return pbm.SummarizeChunks(c)
+	}
+
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+	warnAt := pbm.RestoreConf{}.ChunksWarnAt()
+	if !warnManyChunks(index(warnAt+1), warnAt, l) {
+		t.Errorf("expected warning on %d chunks", warnAt+1)
+	}
+	if warnManyChunks(index(100), warnAt, l) {
+		t.Errorf("expected no warning on 100 chunks")
+	}
+
+	warnAt = pbm.RestoreConf{ChunksWarnThreshold: 50}.ChunksWarnAt()
+	if !warnManyChunks(index(100), warnAt, l) {
+		t.Errorf("expected warning on 100 chunks with the threshold of 50")
+	}
+
+	warnAt = pbm.RestoreConf{ChunksWarnThreshold: -1}.ChunksWarnAt()
+	if warnManyChunks(index(100000), warnAt, l) {
+		t.Errorf("expected warning to be suppressed")
+	}
+}
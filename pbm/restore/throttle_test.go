@@ -0,0 +1,43 @@
+package restore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+)
+
+func TestOpsRateLimit(t *testing.T) {
+	const (
+		ops   = 60
+		limit = 200 // ops per second
+	)
+
+	ts := make([]uint32, ops)
+	for i := range ts {
+		ts[i] = uint32(i + 1)
+	}
+	stg := memStorage{"c1": noopChunk(t, ts...)}
+	chunks := []pbm.OplogChunk{{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone}}
+
+	start := time.Now()
+	_, err := applyOplog(context.Background(), nil, chunkList(chunks), &applyOplogOption{opsPerSec: limit}, false,
+		nil, nil, nil, &pbm.RestoreShardStat{},
+		&pbm.MongoVersion{Version: []int{6, 0, 0}}, stg,
+		log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{}))
+	if err != nil {
+		t.Fatalf("apply oplog: %v", err)
+	}
+	took := time.Since(start)
+
+	// the bucket allows an initial burst of limit/10 ops
+	least := time.Duration(float64(ops-limit/10) / limit * float64(time.Second))
+	if took < least*9/10 {
+		t.Errorf("applied %d ops in %v, expected at least %v with %d ops/sec limit", ops, took, least, limit)
+	}
+}
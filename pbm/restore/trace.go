@@ -0,0 +1,67 @@
+package restore
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+)
+
+// tracerName is the name of the restore spans tracer. Until a TracerProvider
+// with an exporter is registered via otel.SetTracerProvider (see
+// agent.SetupTracing), all spans are no-op. The tracer is taken from
+// the current provider on each span.
+const tracerName = "github.com/percona/percona-backup-mongodb/pbm/restore"
+
+const (
+	attrOPID   = attribute.Key("pbm.opid")
+	attrStatus = attribute.Key("pbm.restore.status")
+	attrRS     = attribute.Key("pbm.rs")
+)
+
+type opidCtxKey struct{}
+
+// withOPID stores the restore OPID in the context so every span started
+// with startSpan carries it. Spans from all shards of the same restore
+// can be correlated by this attribute.
+func withOPID(ctx context.Context, opid string) context.Context {
+	return context.WithValue(ctx, opidCtxKey{}, opid)
+}
+
+func startSpan(
+	ctx context.Context,
+	name string,
+	attrs ...attribute.KeyValue,
+) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opid, ok := ctx.Value(opidCtxKey{}).(string); ok {
+		attrs = append(attrs, attrOPID.String(opid))
+	}
+
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records the err (if any) and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func statAttrs(s *pbm.RestoreShardStat) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int("pbm.txn.partial", s.Txn.Partial),
+		attribute.Int("pbm.txn.shard_uncommitted", s.Txn.ShardUncommitted),
+		attribute.Int("pbm.txn.left_uncommitted", s.Txn.LeftUncommitted),
+		attribute.Int64("pbm.ops.applied", s.Ops.Applied),
+		attribute.Int64("pbm.ops.filtered", s.Ops.Filtered),
+	}
+}
@@ -0,0 +1,234 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+)
+
+// memStorage is an in-memory storage.Storage for tests
+type memStorage map[string][]byte
+
+func (memStorage) Type() storage.Type { return storage.Undef }
+
+func (s memStorage) Save(name string, data io.Reader, _ int64) error {
+	b, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	s[name] = b
+	return nil
+}
+
+func (s memStorage) SourceReader(name string) (io.ReadCloser, error) {
+	b, ok := s[name]
+	if !ok {
+		return nil, storage.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s memStorage) FileStat(name string) (storage.FileInfo, error) {
+	b, ok := s[name]
+	if !ok {
+		return storage.FileInfo{}, storage.ErrNotExist
+	}
+	if len(b) == 0 {
+		return storage.FileInfo{}, storage.ErrEmpty
+	}
+	return storage.FileInfo{Name: name, Size: int64(len(b))}, nil
+}
+
+func (s memStorage) List(prefix, suffix string) ([]storage.FileInfo, error) {
+	var files []storage.FileInfo
+	for name, b := range s {
+		if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix) {
+			files = append(files, storage.FileInfo{Name: strings.TrimPrefix(name, prefix), Size: int64(len(b))})
+		}
+	}
+	return files, nil
+}
+
+func (s memStorage) Delete(name string) error {
+	if _, ok := s[name]; !ok {
+		return storage.ErrNotExist
+	}
+	delete(s, name)
+	return nil
+}
+
+func (s memStorage) Copy(src, dst string) error {
+	b, ok := s[src]
+	if !ok {
+		return storage.ErrNotExist
+	}
+	s[dst] = b
+	return nil
+}
+
+// noopChunk returns uncompressed oplog chunk with noop entries for each given ts
+func noopChunk(t *testing.T, ts ...uint32) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	for _, s := range ts {
+		b, err := bson.Marshal(bson.M{
+			"ts": primitive.Timestamp{T: s, I: 1},
+			"op": "n",
+			"ns": "",
+			"o":  bson.M{"msg": "periodic noop"},
+		})
+		if err != nil {
+			t.Fatalf("marshal oplog entry: %v", err)
+		}
+		buf.Write(b)
+	}
+
+	return buf.Bytes()
+}
+
+func TestApplyOplogSpans(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	defer func() { _ = tp.Shutdown(context.Background()) }()
+
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+
+	stg := memStorage{
+		"c1": noopChunk(t, 1, 2, 3),
+		"c2": noopChunk(t, 4, 5),
+	}
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone},
+		{RS: "rs0", FName: "c2", Compression: compress.CompressionTypeNone},
+	}
+
+	ctx := withOPID(context.Background(), "test-opid")
+	_, err := applyOplog(ctx, nil, chunkList(chunks), &applyOplogOption{}, false,
+		nil, nil, nil, &pbm.RestoreShardStat{},
+		&pbm.MongoVersion{Version: []int{6, 0, 0}}, stg,
+		log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{}))
+	if err != nil {
+		t.Fatalf("apply oplog: %v", err)
+	}
+
+	spans := sr.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+
+	root := spans[len(spans)-1]
+	if root.Name() != "applyOplog" {
+		t.Fatalf("expected last ended span to be applyOplog, got %s", root.Name())
+	}
+	if !hasAttr(root.Attributes(), attrOPID.String("test-opid")) {
+		t.Errorf("applyOplog span has no opid attribute: %v", root.Attributes())
+	}
+	if !hasAttr(root.Attributes(), attribute.Int("pbm.txn.partial", 0)) {
+		t.Errorf("applyOplog span has no txn stat attributes: %v", root.Attributes())
+	}
+
+	for i, s := range spans[:2] {
+		if s.Name() != "replayChunk" {
+			t.Errorf("span %d: expected replayChunk, got %s", i, s.Name())
+		}
+		if s.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("span %d: expected to be a child of applyOplog", i)
+		}
+		if !hasAttr(s.Attributes(), attribute.String("pbm.chunk.file", chunks[i].FName)) {
+			t.Errorf("span %d: no chunk file attribute: %v", i, s.Attributes())
+		}
+	}
+}
+
+func TestRestoreSpans(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	defer func() { _ = tp.Shutdown(context.Background()) }()
+
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	stg := memStorage{"c1": noopChunk(t, 1, 2, 3)}
+	idx := func(string, primitive.Timestamp, primitive.Timestamp) chunksIter {
+		return &sliceChunksIter{chunks: []pbm.OplogChunk{
+			{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone, StartTS: ts(1), EndTS: ts(3)},
+		}}
+	}
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+
+	// the leader of a non-sharded cluster reconciles and waits
+	ctx, span := startSpan(withOPID(context.Background(), "test-opid"), "restore")
+	err := traceState(ctx, pbm.StatusRunning, &pbm.NodeInfo{SetName: "rs0"}, nil,
+		func() error { return nil },
+		func(pbm.Status, *time.Duration) error { return nil },
+		func() error { return nil })
+	if err != nil {
+		t.Fatalf("to state: %v", err)
+	}
+	_, _, err = chunks(ctx, idx, stg, ts(1), ts(3), "rs0", nil, 0, false, l)
+	if err != nil {
+		t.Fatalf("chunks: %v", err)
+	}
+	span.End()
+
+	byName := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range sr.Ended() {
+		byName[s.Name()] = s
+		if !hasAttr(s.Attributes(), attrOPID.String("test-opid")) {
+			t.Errorf("%s span has no opid attribute: %v", s.Name(), s.Attributes())
+		}
+	}
+
+	parents := map[string]string{
+		"toState":         "restore",
+		"convergeCluster": "toState",
+		"waitForStatus":   "toState",
+		"chunks":          "restore",
+	}
+	for name, parent := range parents {
+		s, ok := byName[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		p, ok := byName[parent]
+		if !ok {
+			t.Fatalf("no %s span", parent)
+		}
+		if s.Parent().SpanID() != p.SpanContext().SpanID() {
+			t.Errorf("expected %s to be a child of %s", name, parent)
+		}
+	}
+	if !hasAttr(byName["toState"].Attributes(), attrStatus.String(string(pbm.StatusRunning))) {
+		t.Errorf("toState span has no status attribute: %v", byName["toState"].Attributes())
+	}
+}
+
+func hasAttr(attrs []attribute.KeyValue, a attribute.KeyValue) bool {
+	for _, kv := range attrs {
+		if kv == a {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,461 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/percona/percona-backup-mongodb/pbm"
+	"github.com/percona/percona-backup-mongodb/pbm/compress"
+	"github.com/percona/percona-backup-mongodb/pbm/log"
+)
+
+var errNetwork = mongo.CommandError{Message: "connection reset", Labels: []string{"NetworkError"}}
+
+// flakyTxnStore fails the first setFails writes and getFails reads
+type flakyTxnStore struct {
+	setFails int
+	getFails int
+	failErr  error
+	sets     int
+	gets     int
+	commits  map[string]primitive.Timestamp
+}
+
+func (s *flakyTxnStore) set([]pbm.RestoreTxn) error {
+	s.sets++
+	if s.sets <= s.setFails {
+		return errors.Wrap(s.failErr, "update restore meta")
+	}
+	return nil
+}
+
+func (s *flakyTxnStore) get() (map[string]primitive.Timestamp, error) {
+	s.gets++
+	if s.gets <= s.getFails {
+		return nil, errors.Wrap(s.failErr, "get restore meta")
+	}
+	return s.commits, nil
+}
+
+// partialTxnChunk returns a chunk with the first part of a txn and its id
+func partialTxnChunk(t *testing.T) ([]byte, string) {
+	t.Helper()
+
+	lsid, err := bson.Marshal(bson.M{"id": "session"})
+	if err != nil {
+		t.Fatalf("marshal lsid: %v", err)
+	}
+
+	b, err := bson.Marshal(bson.M{
+		"ts":        primitive.Timestamp{T: 10, I: 1},
+		"op":        "c",
+		"ns":        "admin.$cmd",
+		"lsid":      bson.Raw(lsid),
+		"txnNumber": int64(1),
+		"o": bson.D{
+			{Key: "applyOps", Value: bson.A{bson.D{
+				{Key: "op", Value: "i"},
+				{Key: "ns", Value: "test.c"},
+				{Key: "o", Value: bson.D{{Key: "_id", Value: 1}}},
+			}}},
+			{Key: "partialTxn", Value: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("marshal oplog entry: %v", err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(b)
+	buf.Write(noopChunk(t, 11, 12))
+
+	return buf.Bytes(), fmt.Sprintf("%s-%d", base64.RawStdEncoding.EncodeToString(lsid), 1)
+}
+
+func TestTxnSyncRetry(t *testing.T) {
+	defer func(b time.Duration) { txnSyncBackoff = b }(txnSyncBackoff)
+	txnSyncBackoff = time.Millisecond
+
+	data, id := partialTxnChunk(t)
+	stg := memStorage{"c1": data}
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone,
+			StartTS: primitive.Timestamp{T: 10, I: 1}, EndTS: primitive.Timestamp{T: 12, I: 1}},
+	}
+	l := log.New(nil, "rs0", "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+
+	replay := func(s *flakyTxnStore) (*pbm.RestoreShardStat, error) {
+		stat := &pbm.RestoreShardStat{}
+		_, err := applyOplog(context.Background(), nil, chunkList(chunks),
+			&applyOplogOption{unsafe: true}, true,
+			nil, s.set, s.get, stat,
+			&pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+		return stat, err
+	}
+
+	t.Run("transient", func(t *testing.T) {
+		s := &flakyTxnStore{
+			setFails: 2,
+			getFails: 2,
+			failErr:  errNetwork,
+			commits:  map[string]primitive.Timestamp{id: {T: 10, I: 1}},
+		}
+		stat, err := replay(s)
+		if err != nil {
+			t.Fatalf("replay: %v", err)
+		}
+		if s.sets != 3 || s.gets != 3 {
+			t.Errorf("expected 3 calls in each direction, got %d sets, %d gets", s.sets, s.gets)
+		}
+		if stat.Txn.Partial != 1 {
+			t.Errorf("expected the txn committed on other shard to be partial, got %+v", stat.Txn)
+		}
+	})
+
+	t.Run("set exhausted", func(t *testing.T) {
+		s := &flakyTxnStore{setFails: txnSyncRetries + 1, failErr: errNetwork}
+		_, err := replay(s)
+		if err == nil {
+			t.Fatal("expected set failure to fail the replay")
+		}
+		if s.sets != txnSyncRetries+1 {
+			t.Errorf("expected %d set attempts, got %d", txnSyncRetries+1, s.sets)
+		}
+		if s.gets != 0 {
+			t.Errorf("expected no get after failed set, got %d", s.gets)
+		}
+	})
+
+	t.Run("set permanent", func(t *testing.T) {
+		s := &flakyTxnStore{setFails: 1, failErr: errors.New("not authorized")}
+		_, err := replay(s)
+		if err == nil {
+			t.Fatal("expected set failure to fail the replay")
+		}
+		if s.sets != 1 {
+			t.Errorf("expected no retries on permanent error, got %d attempts", s.sets)
+		}
+	})
+
+	t.Run("get exhausted", func(t *testing.T) {
+		s := &flakyTxnStore{getFails: txnSyncRetries + 1, failErr: errNetwork}
+		_, err := replay(s)
+		if err == nil {
+			t.Fatal("expected get failure to fail the replay")
+		}
+		if s.gets != txnSyncRetries+1 {
+			t.Errorf("expected %d get attempts, got %d", txnSyncRetries+1, s.gets)
+		}
+	})
+}
+
+// txnBoard is the committed txns the shards publish to the restore
+// meta, see setcommittedTxn
+type txnBoard struct {
+	mu        sync.Mutex
+	published map[string][]pbm.RestoreTxn
+}
+
+func (b *txnBoard) set(rs string, txn []pbm.RestoreTxn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.published[rs] = txn
+}
+
+// get waits on the barrier for all shards to publish, the way
+// getcommittedTxn does
+func (b *txnBoard) get(shards []string) (map[string]primitive.Timestamp, error) {
+	br := newTxnBarrier(shards)
+	return br.wait(5*time.Second, time.Millisecond, time.Millisecond, func() error {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		for rs, txn := range b.published {
+			br.publish(rs, txn)
+		}
+		return nil
+	})
+}
+
+func TestTxnSyncBarrier(t *testing.T) {
+	data, id := partialTxnChunk(t)
+	commit := pbm.RestoreTxn{ID: id, Ctime: primitive.Timestamp{T: 10, I: 1}, State: pbm.TxnCommit}
+	shards := []string{"rs0", "rs1", "rs2"}
+	chunks := []pbm.OplogChunk{
+		{RS: "rs0", FName: "c1", Compression: compress.CompressionTypeNone,
+			StartTS: primitive.Timestamp{T: 10, I: 1}, EndTS: primitive.Timestamp{T: 12, I: 1}},
+	}
+
+	// rs0 and rs2 have parts of the txn left uncommitted and wait for
+	// the others at the same time. The commit is on rs1, which finishes
+	// the replay in between or after them.
+	for i := 0; i < 10; i++ {
+		b := &txnBoard{published: make(map[string][]pbm.RestoreTxn)}
+		delays := map[string]time.Duration{
+			"rs0": time.Duration(i%3) * time.Millisecond,
+			"rs1": time.Duration(i%5) * time.Millisecond,
+			"rs2": time.Duration(i%2) * time.Millisecond,
+		}
+		stats := make(map[string]*pbm.RestoreShardStat)
+		errs := make(map[string]error)
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, rs := range shards {
+			rs := rs
+			stg := slowStorage{memStorage: memStorage{"c1": data}, delay: delays[rs]}
+			if rs == "rs1" {
+				stg.memStorage = memStorage{"c1": noopChunk(t, 10, 11, 12)}
+			}
+			l := log.New(nil, rs, "node").NewEvent("restore", "test", "", primitive.Timestamp{})
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				stat := &pbm.RestoreShardStat{}
+				_, err := applyOplog(context.Background(), nil, chunkList(chunks),
+					&applyOplogOption{unsafe: true}, true, nil,
+					func(txn []pbm.RestoreTxn) error {
+						if rs == "rs1" {
+							txn = append(txn, commit)
+						}
+						b.set(rs, txn)
+						return nil
+					},
+					func() (map[string]primitive.Timestamp, error) { return b.get(shards) },
+					stat, &pbm.MongoVersion{Version: []int{6, 0, 0}}, stg, l)
+
+				mu.Lock()
+				stats[rs], errs[rs] = stat, err
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		for _, rs := range []string{"rs0", "rs2"} {
+			if errs[rs] != nil {
+				t.Fatalf("%d: %s: replay: %v", i, rs, errs[rs])
+			}
+			if st := stats[rs].Txn; st.Partial != 1 || len(st.Decisions) != 1 || st.Decisions[0].Decision != pbm.TxnPartial {
+				t.Errorf("%d: %s: expected the txn committed on rs1 to be seen, got %+v", i, rs, st)
+			}
+		}
+		if errs["rs1"] != nil {
+			t.Fatalf("%d: rs1: replay: %v", i, errs["rs1"])
+		}
+	}
+}
+
+func TestTxnSyncTimeout(t *testing.T) {
+	defer func(p time.Duration) { physTxnSyncPoll = p }(physTxnSyncPoll)
+	physTxnSyncPoll = 10 * time.Millisecond
+
+	rs0 := "pbmPhysRestores/restore/rs.rs0/rs"
+	rs1 := "pbmPhysRestores/restore/rs.rs1/rs"
+	stg := memStorage{}
+	r := &PhysRestore{
+		stg:            stg,
+		syncPathShards: map[string]struct{}{rs0: {}, rs1: {}},
+		confOpts:       pbm.RestoreConf{TxnSyncTimeoutSec: 1},
+	}
+
+	// rs0 shares its commits, rs1 never does
+	r.syncPathRS = rs0
+	if err := r.setcommittedTxn([]pbm.RestoreTxn{{ID: "t1", State: pbm.TxnCommit}}); err != nil {
+		t.Fatalf("set txn: %v", err)
+	}
+
+	_, err := r.getcommittedTxn()
+	if !errors.Is(err, errTxnSyncTimeout) {
+		t.Fatalf("expected txn sync timeout, got %v", err)
+	}
+	for _, s := range []string{"1 of 2 shards", "waiting for: rs1."} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected %q in the error, got %q", s, err)
+		}
+	}
+}
+
+func TestTruncTxnDecisions(t *testing.T) {
+	d := []pbm.TxnDecision{
+		{ID: "a", Decision: pbm.TxnCommitted},
+		{ID: "b", Decision: pbm.TxnDropped},
+		{ID: "c", Decision: pbm.TxnCommitted},
+		{ID: "d", Decision: pbm.TxnPartial},
+	}
+
+	if got := truncTxnDecisions(d, 10); len(got) != len(d) {
+		t.Errorf("expected all decisions, got %v", got)
+	}
+
+	got := truncTxnDecisions(d, 3)
+	ids := make([]string, 0, len(got))
+	for _, t := range got {
+		ids = append(ids, t.ID)
+	}
+	if strings.Join(ids, ",") != "b,d,a" {
+		t.Errorf("expected not committed txns first, got %v", ids)
+	}
+}
+
+func TestTxnBarrierWait(t *testing.T) {
+	// shards publish one per poll, rs2 the last
+	published := [][]string{{"rs0"}, {"rs0", "rs1"}, {"rs0", "rs1", "rs2"}}
+	txns := map[string][]pbm.RestoreTxn{
+		"rs0": {{ID: "t0", Ctime: primitive.Timestamp{T: 1}, State: pbm.TxnCommit}},
+		"rs1": {{ID: "t1", State: pbm.TxnAbort}},
+		"rs2": {{ID: "t2", Ctime: primitive.Timestamp{T: 2}, State: pbm.TxnCommit}},
+	}
+
+	t.Run("all published", func(t *testing.T) {
+		b := newTxnBarrier([]string{"rs0", "rs1", "rs2"})
+		polls := 0
+		commits, err := b.wait(time.Second, time.Millisecond, time.Millisecond, func() error {
+			for _, rs := range published[polls] {
+				b.publish(rs, txns[rs])
+			}
+			polls++
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("wait: %v", err)
+		}
+		if polls != 3 {
+			t.Errorf("expected to wait for all shards, returned after %d polls", polls)
+		}
+		if len(commits) != 2 || commits["t0"].T != 1 || commits["t2"].T != 2 {
+			t.Errorf("expected commits of rs0 and rs2, got %v", commits)
+		}
+	})
+
+	t.Run("missing shard", func(t *testing.T) {
+		b := newTxnBarrier([]string{"rs0", "rs1", "rs2"})
+		_, err := b.wait(50*time.Millisecond, time.Millisecond, time.Millisecond, func() error {
+			b.publish("rs0", txns["rs0"])
+			b.publish("rs2", txns["rs2"])
+			return nil
+		})
+		if !errors.Is(err, errTxnSyncTimeout) {
+			t.Fatalf("expected txn sync timeout, got %v", err)
+		}
+		for _, s := range []string{"2 of 3 shards", "waiting for: rs1."} {
+			if !strings.Contains(err.Error(), s) {
+				t.Errorf("expected %q in the error, got %q", s, err)
+			}
+		}
+	})
+
+	t.Run("late peer", func(t *testing.T) {
+		b := newTxnBarrier([]string{"rs0", "rs1"})
+		var delays []time.Duration
+		b.sleep = func(d time.Duration) { delays = append(delays, d) }
+
+		polls := 0
+		commits, err := b.wait(time.Minute, time.Second, 4*time.Second, func() error {
+			polls++
+			b.publish("rs0", txns["rs0"])
+			// rs1 publishes on the 6th poll only
+			if polls == 6 {
+				b.publish("rs2", txns["rs2"])
+				b.publish("rs1", []pbm.RestoreTxn{{ID: "t3", Ctime: primitive.Timestamp{T: 3}, State: pbm.TxnCommit}})
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("wait: %v", err)
+		}
+		if len(commits) != 2 || commits["t0"].T != 1 || commits["t3"].T != 3 {
+			t.Errorf("expected commits of rs0 and the late rs1, got %v", commits)
+		}
+		expect := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second, 4 * time.Second}
+		if !reflect.DeepEqual(delays, expect) {
+			t.Errorf("expected backoff %v, got %v", expect, delays)
+		}
+	})
+
+	t.Run("poll error", func(t *testing.T) {
+		b := newTxnBarrier([]string{"rs0"})
+		_, err := b.wait(0, time.Millisecond, time.Millisecond, func() error { return ErrAborted })
+		if !errors.Is(err, ErrAborted) {
+			t.Errorf("expected the poll error, got %v", err)
+		}
+	})
+}
+
+func TestCommittedTxnRetention(t *testing.T) {
+	txns := func(from, n int) []pbm.RestoreTxn {
+		var rv []pbm.RestoreTxn
+		for i := from; i < from+n; i++ {
+			rv = append(rv, pbm.RestoreTxn{
+				ID:    fmt.Sprintf("t%d", i),
+				Ctime: primitive.Timestamp{T: uint32(i), I: 1},
+				State: pbm.TxnCommit,
+			})
+		}
+		return rv
+	}
+	read := func(t *testing.T, stg memStorage, f string) []pbm.RestoreTxn {
+		t.Helper()
+
+		var rv []pbm.RestoreTxn
+		if err := json.Unmarshal(stg[f], &rv); err != nil {
+			t.Fatalf("decode %s: %v", f, err)
+		}
+		return rv
+	}
+
+	stg := memStorage{}
+	r1 := &PhysRestore{
+		stg:        stg,
+		syncPathRS: "pbmPhysRestores/restore1/rs.rs0/rs",
+		confOpts:   pbm.RestoreConf{DistTxnRetention: 10},
+	}
+	r2 := &PhysRestore{
+		stg:        stg,
+		syncPathRS: "pbmPhysRestores/restore2/rs.rs0/rs",
+	}
+
+	if err := r1.setcommittedTxn(txns(1, 150)); err != nil {
+		t.Fatalf("set txn: %v", err)
+	}
+	if err := r2.setcommittedTxn(txns(1000, 150)); err != nil {
+		t.Fatalf("set txn: %v", err)
+	}
+
+	if got := read(t, stg, r1.syncPathRS+".txn"); !reflect.DeepEqual(got, txns(141, 10)) {
+		t.Errorf("expected the last 10 commits of restore1, got %v", got)
+	}
+	// the default retention
+	if got := read(t, stg, r2.syncPathRS+".txn"); !reflect.DeepEqual(got, txns(1050, 100)) {
+		t.Errorf("expected the last 100 commits of restore2, got %d of them", len(got))
+	}
+
+	if err := r1.clearcommittedTxn(); err != nil {
+		t.Fatalf("clear txn: %v", err)
+	}
+	if _, ok := stg[r1.syncPathRS+".txn"]; ok {
+		t.Error("expected the commits of restore1 removed")
+	}
+	if _, ok := stg[r2.syncPathRS+".txn"]; !ok {
+		t.Error("expected the commits of restore2 kept")
+	}
+	// already removed
+	if err := r1.clearcommittedTxn(); err != nil {
+		t.Errorf("clear txn again: %v", err)
+	}
+}
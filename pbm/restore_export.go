@@ -0,0 +1,196 @@
+package pbm
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RestoreExportVersion is the version of the RestoreExport schema.
+// Fields may be added within a version, readers should ignore unknown ones.
+// Renamed or removed fields bump the version.
+const RestoreExportVersion = 1
+
+// RestoreExport is the restore metadata for the external tools. Unlike
+// RestoreMeta, its shape doesn't follow the internal documents.
+type RestoreExport struct {
+	Version          int                  `json:"version"`
+	Name             string               `json:"name"`
+	OPID             string               `json:"opid"`
+	Backup           string               `json:"backup,omitempty"`
+	Type             BackupType           `json:"type,omitempty"`
+	Status           Status               `json:"status"`
+	Error            string               `json:"error,omitempty"`
+	StartTS          int64                `json:"startTS"`
+	LastTransitionTS int64                `json:"lastTransitionTS"`
+	Range            *RestoreExportRange  `json:"range,omitempty"`
+	Shards           []RestoreExportShard `json:"shards"`
+}
+
+// RestoreExportRange is the resolved time range of the oplog replay
+type RestoreExportRange struct {
+	From RestoreExportTS `json:"from"`
+	To   RestoreExportTS `json:"to"`
+}
+
+type RestoreExportTS struct {
+	T uint32 `json:"t"`
+	I uint32 `json:"i"`
+}
+
+type RestoreExportShard struct {
+	Name             string                 `json:"name"`
+	Status           Status                 `json:"status"`
+	Node             string                 `json:"node,omitempty"`
+	Error            string                 `json:"error,omitempty"`
+	LastTransitionTS int64                  `json:"lastTransitionTS"`
+	LastWriteTS      RestoreExportTS        `json:"lastWriteTS"`
+	CurrentOp        RestoreExportTS        `json:"currentOp"`
+	Progress         *RestoreExportProgress `json:"progress,omitempty"`
+	DistTxn          RestoreExportTxn       `json:"distTxn"`
+	// Coverage are the segments of the replay range covered by oplog
+	// chunks of the shard and gaps between them
+	Coverage []RestoreExportSegment `json:"coverage,omitempty"`
+}
+
+type RestoreExportProgress struct {
+	Chunk    int   `json:"chunk"`
+	Chunks   int   `json:"chunks"`
+	Applied  int64 `json:"applied"`
+	Filtered int64 `json:"filtered"`
+}
+
+type RestoreExportTxn struct {
+	Partial          int `json:"partial"`
+	ShardUncommitted int `json:"shardUncommitted"`
+	LeftUncommitted  int `json:"leftUncommitted"`
+	Split            int `json:"split"`
+}
+
+type RestoreExportSegment struct {
+	From RestoreExportTS `json:"from"`
+	To   RestoreExportTS `json:"to"`
+	Gap  bool            `json:"gap"`
+}
+
+// ExportRestoreMeta returns the current metadata of the restore as JSON,
+// see RestoreExport.
+func (p *PBM) ExportRestoreMeta(name string) ([]byte, error) {
+	meta, err := p.GetRestoreMeta(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "get restore meta")
+	}
+
+	rng, err := p.restoreRange(meta)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve time range")
+	}
+
+	var chunks []OplogChunk
+	if !rng.to.IsZero() {
+		chunks, err = p.PITRGetChunksSlice("", rng.from, rng.to)
+		if err != nil {
+			return nil, errors.Wrap(err, "get chunks")
+		}
+	}
+
+	return encodeRestoreExport(meta, rng, chunks)
+}
+
+type restoreRange struct {
+	from, to primitive.Timestamp
+}
+
+// restoreRange returns the oplog range replayed by the restore.
+// The range is zero if there is no oplog replay.
+func (p *PBM) restoreRange(meta *RestoreMeta) (restoreRange, error) {
+	r := restoreRange{}
+	if meta.PITR == 0 {
+		return r, nil
+	}
+
+	r = restoreRange{
+		from: primitive.Timestamp{T: uint32(meta.StartPITR)},
+		to:   primitive.Timestamp{T: uint32(meta.PITR)},
+	}
+	// point-in-time restore replays the oplog from the backup
+	if meta.StartPITR == 0 && meta.Backup != "" {
+		bcp, err := p.GetBackupMeta(meta.Backup)
+		if err != nil {
+			return r, errors.Wrapf(err, "get backup %s", meta.Backup)
+		}
+		r.from = bcp.LastWriteTS
+	}
+
+	return r, nil
+}
+
+func encodeRestoreExport(meta *RestoreMeta, rng restoreRange, chunks []OplogChunk) ([]byte, error) {
+	exp := RestoreExport{
+		Version:          RestoreExportVersion,
+		Name:             meta.Name,
+		OPID:             meta.OPID,
+		Backup:           meta.Backup,
+		Type:             meta.Type,
+		Status:           meta.Status,
+		Error:            meta.Error,
+		StartTS:          meta.StartTS,
+		LastTransitionTS: meta.LastTransitionTS,
+		Shards:           make([]RestoreExportShard, 0, len(meta.Replsets)),
+	}
+	byRS := make(map[string][]OplogChunk)
+	if !rng.to.IsZero() {
+		exp.Range = &RestoreExportRange{From: exportTS(rng.from), To: exportTS(rng.to)}
+		// chunks are named after the backup replsets
+		mapRS := MakeRSMapFunc(meta.RSMap)
+		for _, c := range chunks {
+			rs := mapRS(c.RS)
+			byRS[rs] = append(byRS[rs], c)
+		}
+	}
+
+	for _, rs := range meta.Replsets {
+		s := RestoreExportShard{
+			Name:             rs.Name,
+			Status:           rs.Status,
+			Node:             rs.Node,
+			Error:            rs.Error,
+			LastTransitionTS: rs.LastTransitionTS,
+			LastWriteTS:      exportTS(rs.LastWriteTS),
+			CurrentOp:        exportTS(rs.CurrentOp),
+			DistTxn: RestoreExportTxn{
+				Partial:          rs.Stat.Txn.Partial,
+				ShardUncommitted: rs.Stat.Txn.ShardUncommitted,
+				LeftUncommitted:  rs.Stat.Txn.LeftUncommitted,
+				Split:            len(rs.Stat.Txn.Split),
+			},
+		}
+		if p := rs.Progress; p != nil {
+			s.Progress = &RestoreExportProgress{
+				Chunk:    p.Chunk,
+				Chunks:   p.Chunks,
+				Applied:  p.Ops.Applied,
+				Filtered: p.Ops.Filtered,
+			}
+		}
+		if !rng.to.IsZero() {
+			for _, seg := range ChunksTimeline(byRS[rs.Name], rng.from, rng.to) {
+				s.Coverage = append(s.Coverage, RestoreExportSegment{
+					From: exportTS(seg.Start),
+					To:   exportTS(seg.End),
+					Gap:  seg.Gap,
+				})
+			}
+		}
+
+		exp.Shards = append(exp.Shards, s)
+	}
+
+	b, err := json.Marshal(exp)
+	return b, errors.Wrap(err, "marshal")
+}
+
+func exportTS(ts primitive.Timestamp) RestoreExportTS {
+	return RestoreExportTS{T: ts.T, I: ts.I}
+}
@@ -0,0 +1,139 @@
+package pbm
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func testRestoreExport(t *testing.T) []byte {
+	t.Helper()
+
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	meta := &RestoreMeta{
+		Name:      "2023-01-01T00:00:00Z",
+		OPID:      "63b0cd2b5e5d6a4b1c9e2a1f",
+		Backup:    "2022-12-31T00:00:00Z",
+		Type:      LogicalBackup,
+		Status:    StatusRunning,
+		StartTS:   100,
+		StartPITR: 10,
+		PITR:      40,
+		RSMap:     map[string]string{"src1": "rs1"},
+		Replsets: []RestoreReplset{
+			{
+				Name:     "rs0",
+				Status:   StatusRunning,
+				Node:     "rs0-1:27017",
+				Progress: &RestoreProgress{Chunk: 1, Chunks: 2, Ops: OplogOpsStat{Applied: 42, Filtered: 3}},
+				Stat: RestoreShardStat{Txn: DistTxnStat{
+					ShardUncommitted: 2,
+					Split:            []SplitTxn{{ID: "t1", Seen: 1, Expected: 2, Chunks: 1}},
+				}},
+			},
+			{Name: "rs1", Status: StatusError, Error: "oops"},
+		},
+	}
+	chunks := []OplogChunk{
+		{RS: "rs0", StartTS: ts(5), EndTS: ts(25)},
+		{RS: "rs0", StartTS: ts(25), EndTS: ts(50)},
+		{RS: "src1", StartTS: ts(5), EndTS: ts(20)},
+	}
+	rng := restoreRange{from: primitive.Timestamp{T: 10}, to: primitive.Timestamp{T: 40}}
+
+	b, err := encodeRestoreExport(meta, rng, chunks)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	return b
+}
+
+func TestExportRestoreMeta(t *testing.T) {
+	var exp RestoreExport
+	if err := json.Unmarshal(testRestoreExport(t), &exp); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	if exp.Version != RestoreExportVersion || exp.Name != "2023-01-01T00:00:00Z" ||
+		exp.Status != StatusRunning || exp.Type != LogicalBackup {
+		t.Errorf("unexpected restore fields %+v", exp)
+	}
+	wantRange := RestoreExportRange{From: RestoreExportTS{T: 10}, To: RestoreExportTS{T: 40}}
+	if exp.Range == nil || *exp.Range != wantRange {
+		t.Errorf("expected range %+v, got %+v", wantRange, exp.Range)
+	}
+	if len(exp.Shards) != 2 {
+		t.Fatalf("expected 2 shards, got %d", len(exp.Shards))
+	}
+
+	rs0 := exp.Shards[0]
+	if rs0.Node != "rs0-1:27017" {
+		t.Errorf("expected rs0 restored by rs0-1:27017, got %q", rs0.Node)
+	}
+	if rs0.Progress == nil || *rs0.Progress != (RestoreExportProgress{Chunk: 1, Chunks: 2, Applied: 42, Filtered: 3}) {
+		t.Errorf("unexpected rs0 progress %+v", rs0.Progress)
+	}
+	if rs0.DistTxn != (RestoreExportTxn{ShardUncommitted: 2, Split: 1}) {
+		t.Errorf("unexpected rs0 txn stat %+v", rs0.DistTxn)
+	}
+	wantCov := []RestoreExportSegment{{From: RestoreExportTS{T: 10}, To: RestoreExportTS{T: 40}}}
+	if !reflect.DeepEqual(rs0.Coverage, wantCov) {
+		t.Errorf("expected rs0 coverage %+v, got %+v", wantCov, rs0.Coverage)
+	}
+
+	rs1 := exp.Shards[1]
+	if rs1.Status != StatusError || rs1.Error != "oops" || rs1.Progress != nil {
+		t.Errorf("unexpected rs1 fields %+v", rs1)
+	}
+	wantCov = []RestoreExportSegment{
+		{From: RestoreExportTS{T: 10}, To: RestoreExportTS{T: 20, I: 1}},
+		{From: RestoreExportTS{T: 20, I: 1}, To: RestoreExportTS{T: 40}, Gap: true},
+	}
+	if !reflect.DeepEqual(rs1.Coverage, wantCov) {
+		t.Errorf("expected rs1 coverage %+v, got %+v", wantCov, rs1.Coverage)
+	}
+}
+
+func TestExportRestoreMetaCompat(t *testing.T) {
+	b := testRestoreExport(t)
+
+	// a newer export with an extra field is still readable
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	m["newField"] = map[string]interface{}{"x": 1}
+	m["shards"].([]interface{})[0].(map[string]interface{})["newShardField"] = true
+	nb, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	var exp RestoreExport
+	if err := json.Unmarshal(nb, &exp); err != nil {
+		t.Fatalf("read export with an extra field: %v", err)
+	}
+	if exp.Name != "2023-01-01T00:00:00Z" || len(exp.Shards) != 2 || exp.Shards[0].Progress.Applied != 42 {
+		t.Errorf("unexpected export %+v", exp)
+	}
+
+	// an older reader that knows only some fields
+	var old struct {
+		Version int    `json:"version"`
+		Name    string `json:"name"`
+		Status  Status `json:"status"`
+		Shards  []struct {
+			Name   string `json:"name"`
+			Status Status `json:"status"`
+		} `json:"shards"`
+	}
+	if err := json.Unmarshal(b, &old); err != nil {
+		t.Fatalf("read export with an older reader: %v", err)
+	}
+	if old.Version != RestoreExportVersion || old.Status != StatusRunning ||
+		len(old.Shards) != 2 || old.Shards[1].Status != StatusError {
+		t.Errorf("unexpected export read by an older reader %+v", old)
+	}
+}
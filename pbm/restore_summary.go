@@ -0,0 +1,117 @@
+package pbm
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RestoreSummary is the outcome of the restore per replset
+type RestoreSummary struct {
+	Name     string             `json:"name"`
+	Status   Status             `json:"status"`
+	Error    string             `json:"error,omitempty"`
+	Replsets []RestoreRSSummary `json:"replsets"`
+	// Warning tells the summary is incomplete, e.g. the start of
+	// the replayed oplog is unknown
+	Warning string `json:"warning,omitempty"`
+}
+
+// RestoreRSSummary is the outcome of the restore on the replset
+type RestoreRSSummary struct {
+	Name   string `json:"name"`
+	Status Status `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Node is the node that restored the replset, see RestoreReplset.Node
+	Node string `json:"node,omitempty"`
+	// From and To are the range of the replayed oplog, To is the last
+	// applied op. Zero if no oplog was replayed (yet).
+	From primitive.Timestamp `json:"from"`
+	To   primitive.Timestamp `json:"to"`
+	Ops  OplogOpsStat        `json:"ops"`
+	Txn  RestoreTxnSummary   `json:"txn"`
+}
+
+// RestoreTxnSummary are the counters of DistTxnStat
+type RestoreTxnSummary struct {
+	Partial          int `json:"partial"`
+	ShardUncommitted int `json:"shardUncommitted"`
+	LeftUncommitted  int `json:"leftUncommitted"`
+	Split            int `json:"split"`
+}
+
+// RestoreSummary returns the outcome of the restore per replset
+func (p *PBM) RestoreSummary(name string) (*RestoreSummary, error) {
+	meta, err := p.GetRestoreMeta(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "get restore meta")
+	}
+
+	return p.SummarizeRestore(meta)
+}
+
+// SummarizeRestore returns the outcome of the restore per replset
+// by its meta, see RestoreSummary. If the base backup is gone, the start
+// of the replayed oplog is unknown, so it's left out with the warning.
+func (p *PBM) SummarizeRestore(meta *RestoreMeta) (*RestoreSummary, error) {
+	rng, err := p.restoreRange(meta)
+	return summarizeRestoreRange(meta, rng, err)
+}
+
+// summarizeRestoreRange is summarizeRestore that tolerates the range
+// resolved without the base backup (rerr is ErrNotFound)
+func summarizeRestoreRange(meta *RestoreMeta, rng restoreRange, rerr error) (*RestoreSummary, error) {
+	if rerr != nil && !errors.Is(rerr, ErrNotFound) {
+		return nil, errors.Wrap(rerr, "resolve time range")
+	}
+
+	s := summarizeRestore(meta, rng)
+	if rerr != nil {
+		s.Warning = fmt.Sprintf("the start of the replayed oplog is unknown: %v", rerr)
+	}
+
+	return s, nil
+}
+
+func summarizeRestore(meta *RestoreMeta, rng restoreRange) *RestoreSummary {
+	s := &RestoreSummary{
+		Name:     meta.Name,
+		Status:   meta.Status,
+		Error:    meta.Error,
+		Replsets: make([]RestoreRSSummary, 0, len(meta.Replsets)),
+	}
+
+	for _, rs := range meta.Replsets {
+		rss := RestoreRSSummary{
+			Name:   rs.Name,
+			Status: rs.Status,
+			Error:  rs.Error,
+			Node:   rs.Node,
+			Ops:    rs.Stat.Ops,
+			Txn: RestoreTxnSummary{
+				Partial:          rs.Stat.Txn.Partial,
+				ShardUncommitted: rs.Stat.Txn.ShardUncommitted,
+				LeftUncommitted:  rs.Stat.Txn.LeftUncommitted,
+				Split:            len(rs.Stat.Txn.Split),
+			},
+		}
+		// the stat is written at the end of the replay (or on failure),
+		// the progress is all there is while it's running
+		if rs.Stat.Chunks == 0 && rs.Progress != nil {
+			rss.Ops = rs.Progress.Ops
+		}
+
+		rss.To = rs.Stat.LastTS
+		if rss.To.IsZero() {
+			rss.To = rs.CurrentOp
+		}
+		if !rss.To.IsZero() {
+			rss.From = rng.from
+		}
+
+		s.Replsets = append(s.Replsets, rss)
+	}
+
+	return s
+}
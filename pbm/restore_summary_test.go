@@ -0,0 +1,101 @@
+package pbm
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSummarizeRestore(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t, I: 1} }
+	meta := &RestoreMeta{
+		Name:   "2023-01-01T00:00:00Z",
+		Status: StatusDone,
+		Replsets: []RestoreReplset{
+			{
+				Name:   "rs0",
+				Status: StatusDone,
+				Node:   "rs0-1:27017",
+				Stat: RestoreShardStat{
+					Ops:    OplogOpsStat{Applied: 100, Filtered: 5},
+					Chunks: 3,
+					LastTS: ts(40),
+				},
+			},
+			{
+				Name:      "rs1",
+				Status:    StatusDone,
+				Node:      "rs1-2:27017",
+				CurrentOp: ts(38),
+				Stat: RestoreShardStat{
+					Ops: OplogOpsStat{Applied: 7},
+					Txn: DistTxnStat{
+						ShardUncommitted: 3,
+						LeftUncommitted:  1,
+						Split:            []SplitTxn{{ID: "t1", Seen: 1, Expected: 2, Chunks: 1}},
+					},
+				},
+			},
+			{
+				Name:     "rs2",
+				Status:   StatusRunning,
+				Progress: &RestoreProgress{Chunk: 1, Chunks: 2, Ops: OplogOpsStat{Applied: 42}},
+			},
+		},
+	}
+
+	s := summarizeRestore(meta, restoreRange{from: ts(10), to: ts(40)})
+	if s.Name != meta.Name || s.Status != StatusDone || len(s.Replsets) != 3 {
+		t.Fatalf("unexpected summary %+v", s)
+	}
+
+	rs0, rs1, rs2 := s.Replsets[0], s.Replsets[1], s.Replsets[2]
+	if rs0.Node != "rs0-1:27017" || rs0.From != ts(10) || rs0.To != ts(40) || rs0.Ops.Applied != 100 {
+		t.Errorf("unexpected rs0 summary %+v", rs0)
+	}
+	if rs0.Txn != (RestoreTxnSummary{}) {
+		t.Errorf("expected no txn leftovers on rs0, got %+v", rs0.Txn)
+	}
+
+	expect := RestoreTxnSummary{ShardUncommitted: 3, LeftUncommitted: 1, Split: 1}
+	if rs1.Txn != expect {
+		t.Errorf("expected rs1 txn leftovers %+v, got %+v", expect, rs1.Txn)
+	}
+	if rs1.Node != "rs1-2:27017" || rs1.To != ts(38) {
+		t.Errorf("unexpected rs1 summary %+v", rs1)
+	}
+
+	if rs2.Ops.Applied != 42 || !rs2.To.IsZero() || !rs2.From.IsZero() {
+		t.Errorf("expected the running rs2 summary by the progress, got %+v", rs2)
+	}
+}
+
+func TestSummarizeRestoreNoBackup(t *testing.T) {
+	ts := func(t uint32) primitive.Timestamp { return primitive.Timestamp{T: t} }
+	meta := &RestoreMeta{
+		Name:     "2023-01-01T00:00:00Z",
+		Backup:   "2022-12-31T00:00:00Z",
+		Status:   StatusDone,
+		PITR:     40,
+		Replsets: []RestoreReplset{{Name: "rs0", Status: StatusDone, Stat: RestoreShardStat{LastTS: ts(40)}}},
+	}
+
+	// the backup is deleted, so only the end of the range is known
+	rerr := errors.Wrap(ErrNotFound, "get backup 2022-12-31T00:00:00Z")
+	s, err := summarizeRestoreRange(meta, restoreRange{to: ts(40)}, rerr)
+	if err != nil {
+		t.Fatalf("summarize: %v", err)
+	}
+	if s.Warning == "" {
+		t.Error("expected a warning on the unknown range start")
+	}
+	if rs := s.Replsets[0]; !rs.From.IsZero() || rs.To != ts(40) {
+		t.Errorf("expected the range without the start, got %v - %v", rs.From, rs.To)
+	}
+
+	if _, err := summarizeRestoreRange(meta, restoreRange{}, errors.New("connection refused")); err == nil {
+		t.Error("expected other errors to fail the summary")
+	}
+}
@@ -1,5 +1,13 @@
 package pbm
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
 type RSMapFunc func(string) string
 
 func identity(a string) string { return a }
@@ -35,3 +43,94 @@ func swapSSMap(m map[string]string) map[string]string {
 
 	return rv
 }
+
+// ValidateRSMap checks the replset names mapping `m` (source -> target)
+// against the source (backup/oplog) and target (cluster) replsets.
+// It detects:
+//   - several source replsets mapped onto the same target;
+//   - mapped targets that don't exist in the cluster;
+//   - source replsets without mapping whose names aren't in the cluster.
+func ValidateRSMap(m map[string]string, sourceRSets, targetRSets []string) error {
+	return validateRSMap(m, sourceRSets, targetRSets, false)
+}
+
+// ValidateRSMapFanIn is ValidateRSMap that allows several source replsets
+// mapped onto the same target (see RSMapSources).
+func ValidateRSMapFanIn(m map[string]string, sourceRSets, targetRSets []string) error {
+	return validateRSMap(m, sourceRSets, targetRSets, true)
+}
+
+// RSMapSources returns sorted source replsets mapped onto the target
+func RSMapSources(m map[string]string, sourceRSets []string, target string) []string {
+	mapRS := MakeRSMapFunc(m)
+
+	var rv []string
+	for _, rs := range sourceRSets {
+		if mapRS(rs) == target {
+			rv = append(rv, rs)
+		}
+	}
+	sort.Strings(rv)
+
+	return rv
+}
+
+func validateRSMap(m map[string]string, sourceRSets, targetRSets []string, fanIn bool) error {
+	mapRS := MakeRSMapFunc(m)
+
+	targets := make(map[string]bool, len(targetRSets))
+	for _, rs := range targetRSets {
+		targets[rs] = true
+	}
+
+	sources := append([]string(nil), sourceRSets...)
+	sort.Strings(sources)
+
+	mapped := make(map[string][]string)
+	var unknown, unmapped []string
+	for _, rs := range sources {
+		t := mapRS(rs)
+		mapped[t] = append(mapped[t], rs)
+
+		if targets[t] {
+			continue
+		}
+		if _, ok := m[rs]; ok {
+			unknown = append(unknown, fmt.Sprintf("%q (from %q)", t, rs))
+		} else {
+			unmapped = append(unmapped, fmt.Sprintf("%q", rs))
+		}
+	}
+
+	var errs []string
+	for _, t := range sortedKeys(mapped) {
+		if len(mapped[t]) > 1 && !fanIn {
+			errs = append(errs, fmt.Sprintf("replsets %s are mapped onto the same target %q",
+				strings.Join(mapped[t], ", "), t))
+		}
+	}
+	if len(unknown) > 0 {
+		errs = append(errs, "mapped target replsets not found in the cluster: "+
+			strings.Join(unknown, ", "))
+	}
+	if len(unmapped) > 0 {
+		errs = append(errs, "replsets not found in the cluster and have no mapping: "+
+			strings.Join(unmapped, ", ")+". Use --replset-remapping to map them")
+	}
+
+	if len(errs) > 0 {
+		return errors.Errorf("invalid replset mapping: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
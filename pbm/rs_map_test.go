@@ -0,0 +1,93 @@
+package pbm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRSMap(t *testing.T) {
+	cluster := []string{"rsA", "rsB", "cfg"}
+
+	cases := []struct {
+		name    string
+		rsMap   map[string]string
+		sources []string
+		errs    []string
+	}{
+		{
+			name:    "bijective",
+			rsMap:   map[string]string{"rs0": "rsA", "rs1": "rsB"},
+			sources: []string{"rs0", "rs1", "cfg"},
+		},
+		{
+			name:    "identity",
+			sources: []string{"rsA", "cfg"},
+		},
+		{
+			name:    "many to one",
+			rsMap:   map[string]string{"rs0": "rsA", "rs1": "rsA"},
+			sources: []string{"rs0", "rs1"},
+			errs:    []string{`replsets rs0, rs1 are mapped onto the same target "rsA"`},
+		},
+		{
+			name:    "mapped onto unmapped source name",
+			rsMap:   map[string]string{"rs0": "rsB"},
+			sources: []string{"rs0", "rsB"},
+			errs:    []string{`replsets rs0, rsB are mapped onto the same target "rsB"`},
+		},
+		{
+			name:    "unknown target",
+			rsMap:   map[string]string{"rs0": "rsX", "rs1": "rsB"},
+			sources: []string{"rs0", "rs1"},
+			errs:    []string{`mapped target replsets not found in the cluster: "rsX" (from "rs0")`},
+		},
+		{
+			name:    "unmapped",
+			rsMap:   map[string]string{"rs0": "rsA"},
+			sources: []string{"rs0", "rs1"},
+			errs:    []string{`have no mapping: "rs1"`, "--replset-remapping"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := ValidateRSMap(c.rsMap, c.sources, cluster)
+			if len(c.errs) == 0 {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("expected error")
+			}
+			for _, e := range c.errs {
+				if !strings.Contains(err.Error(), e) {
+					t.Errorf("expected %q in error, got %q", e, err)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateRSMapFanIn(t *testing.T) {
+	cluster := []string{"rsA", "cfg"}
+	m := map[string]string{"rs0": "rsA", "rs1": "rsA"}
+
+	if err := ValidateRSMapFanIn(m, []string{"rs0", "rs1", "cfg"}, cluster); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err := ValidateRSMapFanIn(m, []string{"rs0", "rs1", "rs2"}, cluster)
+	if err == nil || !strings.Contains(err.Error(), `have no mapping: "rs2"`) {
+		t.Errorf("expected unmapped replset error, got %v", err)
+	}
+
+	got := RSMapSources(m, []string{"rs1", "cfg", "rs0"}, "rsA")
+	if strings.Join(got, ",") != "rs0,rs1" {
+		t.Errorf("expected rs0,rs1 mapped onto rsA, got %v", got)
+	}
+	if got := RSMapSources(m, []string{"rs0", "rs1", "cfg"}, "cfg"); strings.Join(got, ",") != "cfg" {
+		t.Errorf("expected cfg onto itself, got %v", got)
+	}
+}
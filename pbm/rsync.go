@@ -93,12 +93,16 @@ func (p *PBM) ResyncStorage(l *log.Event) error {
 			return errors.Wrapf(err, "read meta for %v", b.Name)
 		}
 
-		v := BackupMeta{}
-		err = json.NewDecoder(d).Decode(&v)
+		m, err := DecodeBackupMeta(d)
 		d.Close()
 		if err != nil {
 			return errors.Wrapf(err, "unmarshal backup meta [%s]", b.Name)
 		}
+		if err = UpgradeBackupMeta(m); err != nil {
+			l.Warning("skip snapshot %s: %v", m.Name, err)
+			continue
+		}
+		v := *m
 		err = checkBackupFiles(p.ctx, &v, stg)
 		if err != nil {
 			l.Warning("skip snapshot %s: %v", v.Name, err)
@@ -131,10 +135,18 @@ func (p *PBM) ResyncStorage(l *log.Event) error {
 			continue
 		}
 		chnk := PITRmetaFromFName(f.Name)
-		if chnk != nil {
-			chnk.Size = stat.Size
-			pitr = append(pitr, chnk)
+		if chnk == nil {
+			if path.Ext(f.Name) != zstdDictExt {
+				l.Warning("skip %s/%s: not an oplog chunk name or unknown compression", PITRfsPrefix, f.Name)
+			}
+			continue
+		}
+		if err := SetChunkDict(stg, chnk); err != nil {
+			l.Warning("skip pitr chunk %s/%s because of %v", PITRfsPrefix, f.Name, err)
+			continue
 		}
+		chnk.Size = stat.Size
+		pitr = append(pitr, chnk)
 	}
 
 	if len(pitr) == 0 {
@@ -383,6 +395,9 @@ func ParsePhysRestoreStatus(restore string, stg storage.Storage, l *log.Event) (
 				lstat.DistTxn.Partial += st.Txn.Partial
 				lstat.DistTxn.ShardUncommitted += st.Txn.ShardUncommitted
 				lstat.DistTxn.LeftUncommitted += st.Txn.LeftUncommitted
+				lstat.DistTxn.Split = append(lstat.DistTxn.Split, st.Txn.Split...)
+				lstat.Ops.Applied += st.Ops.Applied
+				lstat.Ops.Filtered += st.Ops.Filtered
 				if st.D != nil {
 					lstat.Download = *st.D
 				}
@@ -16,6 +16,7 @@ const (
 
 	batchSizeDefault           = 100
 	numInsertionWorkersDefault = 5
+	numParallelCollsDefault    = 1
 )
 
 var ExcludeFromRestore = []string{
@@ -84,6 +85,12 @@ func NewRestore(uri string, cfg *pbm.Config) (io.ReaderFrom, error) {
 	if cfg.Restore.NumInsertionWorkers > 0 {
 		numInsertionWorkers = cfg.Restore.NumInsertionWorkers
 	}
+	// mongorestore raises it up to the archive's concurrency anyway,
+	// otherwise interleaved namespaces would block each other
+	numParallelColls := numParallelCollsDefault
+	if cfg.Restore.NumParallelCollections > 0 {
+		numParallelColls = cfg.Restore.NumParallelCollections
+	}
 
 	mopts := mongorestore.Options{}
 	mopts.ToolOptions = topts
@@ -95,7 +102,7 @@ func NewRestore(uri string, cfg *pbm.Config) (io.ReaderFrom, error) {
 		BypassDocumentValidation: true,
 		Drop:                     true,
 		NumInsertionWorkers:      numInsertionWorkers,
-		NumParallelCollections:   1,
+		NumParallelCollections:   numParallelColls,
 		PreserveUUID:             preserveUUID,
 		StopOnError:              true,
 		WriteConcern:             "majority",
@@ -220,6 +220,21 @@ func (b *Blob) SourceReader(name string) (io.ReadCloser, error) {
 	return o.Body, nil
 }
 
+// SourceHead requests only the first `size` bytes of the blob,
+// see storage.HeadReader
+func (b *Blob) SourceHead(name string, size int64) (io.ReadCloser, error) {
+	o, err := b.c.DownloadStream(context.TODO(), b.opts.Container, path.Join(b.opts.Prefix, name),
+		&azblob.DownloadStreamOptions{Range: blob.HTTPRange{Count: size}})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, storage.ErrNotExist
+		}
+		return nil, errors.Wrap(err, "download object head")
+	}
+
+	return o.Body, nil
+}
+
 func (b *Blob) Delete(name string) error {
 	_, err := b.c.DeleteBlob(context.TODO(), b.opts.Container, path.Join(b.opts.Prefix, name), nil)
 	if err != nil {
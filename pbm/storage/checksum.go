@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// checksumCRC32C is the prefix of CRC32 (Castagnoli) checksums
+const checksumCRC32C = "crc32c:"
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrChecksumMismatch means the read data doesn't match the stored checksum
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// NewChecksum returns the hash to compute checksums of stored files
+func NewChecksum() hash.Hash32 {
+	return crc32.New(crc32cTable)
+}
+
+// FormatChecksum returns the checksum of the hash with the algorithm prefix
+func FormatChecksum(h hash.Hash32) string {
+	return fmt.Sprintf("%s%08x", checksumCRC32C, h.Sum32())
+}
+
+// VerifyReader returns a reader that computes the checksum while reading
+// and compares it to `want` on Close. Bytes left unread are read on Close,
+// so the whole file is verified. Empty `want` means no verification.
+func VerifyReader(r io.ReadCloser, want string) (io.ReadCloser, error) {
+	if want == "" {
+		return r, nil
+	}
+	if !strings.HasPrefix(want, checksumCRC32C) {
+		return nil, errors.Errorf("unsupported checksum %q", want)
+	}
+
+	h := NewChecksum()
+	return &verifyReader{Reader: io.TeeReader(r, h), c: r, h: h, want: want}, nil
+}
+
+type verifyReader struct {
+	io.Reader
+	c    io.Closer
+	h    hash.Hash32
+	want string
+}
+
+func (v *verifyReader) Close() error {
+	_, err := io.Copy(io.Discard, v.Reader)
+	cerr := v.c.Close()
+	if err != nil {
+		return errors.Wrap(err, "read the rest to verify checksum")
+	}
+	if cerr != nil {
+		return cerr
+	}
+
+	if got := FormatChecksum(v.h); got != v.want {
+		return errors.Wrapf(ErrChecksumMismatch, "expected %s, got %s", v.want, got)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func checksumOf(b []byte) string {
+	h := NewChecksum()
+	h.Write(b)
+	return FormatChecksum(h)
+}
+
+func TestVerifyReader(t *testing.T) {
+	data := bytes.Repeat([]byte("oplog chunk "), 1000)
+	sum := checksumOf(data)
+
+	r, err := VerifyReader(io.NopCloser(bytes.NewReader(data)), sum)
+	if err != nil {
+		t.Fatalf("verify reader: %v", err)
+	}
+	if _, err = io.Copy(io.Discard, r); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err = r.Close(); err != nil {
+		t.Errorf("expected matching checksum, got %v", err)
+	}
+
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)/2] ^= 0x01
+	r, _ = VerifyReader(io.NopCloser(bytes.NewReader(corrupted)), sum)
+	if _, err = io.Copy(io.Discard, r); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err = r.Close(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+
+	// the reader isn't read till the end, the rest is read on close
+	r, _ = VerifyReader(io.NopCloser(bytes.NewReader(corrupted)), sum)
+	if _, err = r.Read(make([]byte, 10)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err = r.Close(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected checksum mismatch on partial read, got %v", err)
+	}
+
+	r, err = VerifyReader(io.NopCloser(bytes.NewReader(data)), "")
+	if err != nil {
+		t.Fatalf("verify reader: %v", err)
+	}
+	if err = r.Close(); err != nil {
+		t.Errorf("expected no verification without checksum, got %v", err)
+	}
+
+	if _, err = VerifyReader(io.NopCloser(bytes.NewReader(data)), "md5:abc"); err == nil {
+		t.Errorf("expected unsupported checksum error")
+	}
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// SourceReaderContext is Storage.SourceReader that respects the ctx. It
+// returns the ctx error if the ctx is done before the object is opened.
+// The returned reader is closed once the ctx is done, so a read hung on
+// the storage is interrupted, and reads fail with the ctx error.
+func SourceReaderContext(ctx context.Context, stg Storage, name string) (io.ReadCloser, error) {
+	r, _, err := openContext(ctx, name, func() (io.ReadCloser, FileInfo, error) {
+		r, err := stg.SourceReader(name)
+		return r, FileInfo{}, err
+	})
+	return r, err
+}
+
+// SourceReaderWithStatContext is SourceReaderWithStat that respects the ctx
+// the same way as SourceReaderContext
+func SourceReaderWithStatContext(ctx context.Context, stg Storage, name string) (io.ReadCloser, FileInfo, error) {
+	return openContext(ctx, name, func() (io.ReadCloser, FileInfo, error) {
+		return SourceReaderWithStat(stg, name)
+	})
+}
+
+func openContext(
+	ctx context.Context,
+	name string,
+	open func() (io.ReadCloser, FileInfo, error),
+) (io.ReadCloser, FileInfo, error) {
+	type opened struct {
+		r   io.ReadCloser
+		fi  FileInfo
+		err error
+	}
+	res := make(chan opened, 1)
+	go func() {
+		r, fi, err := open()
+		res <- opened{r, fi, err}
+	}()
+
+	select {
+	case o := <-res:
+		if o.err != nil {
+			return nil, o.fi, o.err
+		}
+		return NewContextReader(ctx, o.r), o.fi, nil
+	case <-ctx.Done():
+		// the reader isn't needed anymore, close it once opened
+		go func() {
+			if o := <-res; o.err == nil {
+				o.r.Close()
+			}
+		}()
+		return nil, FileInfo{}, errors.Wrapf(ctx.Err(), "open %s", name)
+	}
+}
+
+// ContextReader closes the underlying reader once the ctx is done
+// and fails reads with the ctx error since then
+type ContextReader struct {
+	r    io.ReadCloser
+	ctx  context.Context
+	done chan struct{}
+	stop sync.Once
+	once sync.Once
+	cerr error
+}
+
+// NewContextReader returns the reader of r bound to the ctx.
+// The reader should be closed to release the ctx watcher.
+func NewContextReader(ctx context.Context, r io.ReadCloser) *ContextReader {
+	c := &ContextReader{r: r, ctx: ctx, done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.close()
+		case <-c.done:
+		}
+	}()
+
+	return c
+}
+
+func (c *ContextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, errors.Wrap(err, "read")
+	}
+
+	n, err := c.r.Read(p)
+	if err != nil && c.ctx.Err() != nil {
+		return n, errors.Wrap(c.ctx.Err(), "read")
+	}
+	return n, err
+}
+
+// Close closes the underlying reader
+func (c *ContextReader) Close() error {
+	c.stop.Do(func() { close(c.done) })
+	return c.close()
+}
+
+func (c *ContextReader) close() error {
+	c.once.Do(func() { c.cerr = c.r.Close() })
+	return c.cerr
+}
@@ -100,6 +100,43 @@ func (fs *FS) SourceReader(name string) (io.ReadCloser, error) {
 	return fr, errors.Wrapf(err, "open file '%s'", filepath)
 }
 
+// SourceReaderWithStat opens the file and returns its info, see storage.StatReader
+func (fs *FS) SourceReaderWithStat(name string) (io.ReadCloser, storage.FileInfo, error) {
+	inf := storage.FileInfo{}
+
+	filepath := path.Join(fs.root, name)
+	fr, err := os.Open(filepath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, inf, storage.ErrNotExist
+	}
+	if err != nil {
+		return nil, inf, errors.Wrapf(err, "open file '%s'", filepath)
+	}
+
+	f, err := fr.Stat()
+	if err != nil {
+		fr.Close()
+		return nil, inf, errors.Wrapf(err, "stat file '%s'", filepath)
+	}
+	if f.Size() == 0 {
+		fr.Close()
+		return nil, inf, storage.ErrEmpty
+	}
+
+	inf.Size = f.Size()
+	return fr, inf, nil
+}
+
+// SourceHead opens the first `size` bytes of the file, see storage.HeadReader
+func (fs *FS) SourceHead(name string, size int64) (io.ReadCloser, error) {
+	r, err := fs.SourceReader(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.LimitReadCloser(r, size), nil
+}
+
 func (fs *FS) FileStat(name string) (storage.FileInfo, error) {
 	inf := storage.FileInfo{}
 
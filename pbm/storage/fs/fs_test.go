@@ -0,0 +1,82 @@
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
+)
+
+func TestSourceReaderWithStat(t *testing.T) {
+	stg, err := New(Conf{Path: t.TempDir()})
+	if err != nil {
+		t.Fatalf("create storage: %v", err)
+	}
+
+	data := []byte("oplog chunk data")
+	if err := stg.Save("rs0/c1", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if err := stg.Save("rs0/empty", bytes.NewReader(nil), 0); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	r, fi, err := storage.SourceReaderWithStat(stg, "rs0/c1")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer r.Close()
+
+	stat, err := stg.FileStat("rs0/c1")
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if fi.Size != stat.Size || fi.Size != int64(len(data)) {
+		t.Errorf("expected size %d as of FileStat, got %d", stat.Size, fi.Size)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("expected %q, got %q", data, b)
+	}
+
+	if _, _, err := stg.SourceReaderWithStat("rs0/none"); !errors.Is(err, storage.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+	if _, _, err := stg.SourceReaderWithStat("rs0/empty"); !errors.Is(err, storage.ErrEmpty) {
+		t.Errorf("expected ErrEmpty, got %v", err)
+	}
+}
+
+func TestSourceHead(t *testing.T) {
+	stg, err := New(Conf{Path: t.TempDir()})
+	if err != nil {
+		t.Fatalf("create storage: %v", err)
+	}
+
+	data := []byte("oplog chunk data")
+	if err := stg.Save("rs0/c1", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	r, err := stg.SourceHead("rs0/c1", 5)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(b, data[:5]) {
+		t.Errorf("expected %q, got %q", data[:5], b)
+	}
+
+	if _, err := stg.SourceHead("rs0/none", 5); !errors.Is(err, storage.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// healthCheckObject is the name of the probe object written by HealthCheck
+const healthCheckObject = ".pbm.healthcheck.%d"
+
+// HealthCheckResult is the time each step of HealthCheck took.
+// Steps that weren't done are zero.
+type HealthCheckResult struct {
+	Object string        `json:"object"`
+	Write  time.Duration `json:"write"`
+	Read   time.Duration `json:"read"`
+	Delete time.Duration `json:"delete"`
+}
+
+// Latency is the time of the whole round trip
+func (r HealthCheckResult) Latency() time.Duration {
+	return r.Write + r.Read + r.Delete
+}
+
+// HealthCheck checks the storage is reachable, writable and readable
+// without touching the backups. It writes a small probe object, reads it
+// back and compares with the written, and deletes it afterwards.
+func HealthCheck(stg Storage) (HealthCheckResult, error) {
+	r := HealthCheckResult{Object: fmt.Sprintf(healthCheckObject, time.Now().UnixNano())}
+	data := []byte("pbm storage health check " + r.Object)
+
+	start := time.Now()
+	err := stg.Save(r.Object, bytes.NewReader(data), int64(len(data)))
+	r.Write = time.Since(start)
+	if err != nil {
+		return r, errors.Wrapf(err, "write %s", r.Object)
+	}
+
+	start = time.Now()
+	err = readBack(stg, r.Object, data)
+	r.Read = time.Since(start)
+
+	start = time.Now()
+	derr := stg.Delete(r.Object)
+	r.Delete = time.Since(start)
+
+	if err != nil {
+		if derr != nil {
+			err = errors.Wrapf(err, "remove %s: %v", r.Object, derr)
+		}
+		return r, err
+	}
+	return r, errors.Wrapf(derr, "delete %s", r.Object)
+}
+
+func readBack(stg Storage, name string, data []byte) error {
+	rd, err := stg.SourceReader(name)
+	if err != nil {
+		return errors.Wrapf(err, "read %s", name)
+	}
+	defer rd.Close()
+
+	// some storages (e.g. blackhole) never end the read
+	b, err := io.ReadAll(io.LimitReader(rd, int64(len(data))+1))
+	if err != nil {
+		return errors.Wrapf(err, "read %s", name)
+	}
+	if !bytes.Equal(b, data) {
+		return errors.Errorf("read %s: got %d bytes that don't match the written %d", name, len(b), len(data))
+	}
+
+	return nil
+}
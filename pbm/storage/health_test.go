@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// rwStorage keeps saved objects in memory. If corrupt is set, the
+// objects are read back with the last byte changed.
+type rwStorage struct {
+	memStorage
+	corrupt bool
+}
+
+func (s rwStorage) Save(name string, data io.Reader, _ int64) error {
+	b, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	s.memStorage[name] = b
+	return nil
+}
+
+func (s rwStorage) SourceReader(name string) (io.ReadCloser, error) {
+	b, ok := s.memStorage[name]
+	if !ok {
+		return nil, ErrNotExist
+	}
+	if s.corrupt && len(b) > 0 {
+		b = append(append([]byte{}, b[:len(b)-1]...), b[len(b)-1]+1)
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s rwStorage) Delete(name string) error {
+	if _, ok := s.memStorage[name]; !ok {
+		return ErrNotExist
+	}
+	delete(s.memStorage, name)
+	return nil
+}
+
+func TestHealthCheck(t *testing.T) {
+	t.Run("passed", func(t *testing.T) {
+		stg := rwStorage{memStorage: memStorage{}}
+
+		r, err := HealthCheck(stg)
+		if err != nil {
+			t.Fatalf("health check: %v", err)
+		}
+		if r.Object == "" || r.Write < 0 || r.Read < 0 || r.Delete < 0 || r.Latency() <= 0 {
+			t.Errorf("expected all steps timed, got %+v", r)
+		}
+		if r.Latency() != r.Write+r.Read+r.Delete {
+			t.Errorf("expected latency %v, got %v", r.Write+r.Read+r.Delete, r.Latency())
+		}
+		if len(stg.memStorage) != 0 {
+			t.Errorf("expected the probe deleted, left %v", stg.memStorage)
+		}
+	})
+
+	t.Run("read back mismatch", func(t *testing.T) {
+		stg := rwStorage{memStorage: memStorage{}, corrupt: true}
+
+		r, err := HealthCheck(stg)
+		if err == nil || !strings.Contains(err.Error(), "match") {
+			t.Fatalf("expected a mismatch error, got %v", err)
+		}
+		if len(stg.memStorage) != 0 {
+			t.Errorf("expected the probe deleted, left %v", stg.memStorage)
+		}
+		if r.Write < 0 || r.Read < 0 || r.Delete < 0 {
+			t.Errorf("expected non-negative timings, got %+v", r)
+		}
+	})
+}
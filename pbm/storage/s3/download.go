@@ -18,6 +18,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/percona/percona-backup-mongodb/pbm/log"
+	"github.com/percona/percona-backup-mongodb/pbm/storage"
 )
 
 // Downloading objects from the storage.
@@ -144,6 +145,12 @@ func downloadOpts(cc, bufMaxMb, spanSizeMb int) (arenaSize, span, c int) {
 }
 
 func (d *Download) SourceReader(name string) (io.ReadCloser, error) {
+	r, _, err := d.s3.sourceReader(name, d.arenas, d.cc, d.spanSize)
+	return r, err
+}
+
+// SourceReaderWithStat opens the object and returns its info, see storage.StatReader
+func (d *Download) SourceReaderWithStat(name string) (io.ReadCloser, storage.FileInfo, error) {
 	return d.s3.sourceReader(name, d.arenas, d.cc, d.spanSize)
 }
 
@@ -160,6 +167,12 @@ func (s *S3) SourceReader(name string) (io.ReadCloser, error) {
 	return s.d.SourceReader(name)
 }
 
+// SourceReaderWithStat returns the info of the object the reader gets
+// anyway to download it in parts, so there is no extra request
+func (s *S3) SourceReaderWithStat(name string) (io.ReadCloser, storage.FileInfo, error) {
+	return s.d.SourceReaderWithStat(name)
+}
+
 type getObjError struct {
 	Err error
 }
@@ -243,17 +256,22 @@ func (b *chunksQueue) Pop() any {
 	return x
 }
 
-func (s *S3) sourceReader(fname string, arenas []*arena, cc, downloadChuckSize int) (io.ReadCloser, error) {
+func (s *S3) sourceReader(
+	fname string,
+	arenas []*arena,
+	cc,
+	downloadChuckSize int,
+) (io.ReadCloser, storage.FileInfo, error) {
 	if cc < 1 {
-		return nil, errors.Errorf("num of workers shuld be at least 1 (got %d)", cc)
+		return nil, storage.FileInfo{}, errors.Errorf("num of workers shuld be at least 1 (got %d)", cc)
 	}
 	if len(arenas) < cc {
-		return nil, errors.Errorf("num of arenas (%d) less then workers (%d)", len(arenas), cc)
+		return nil, storage.FileInfo{}, errors.Errorf("num of arenas (%d) less then workers (%d)", len(arenas), cc)
 	}
 
 	fstat, err := s.FileStat(fname)
 	if err != nil {
-		return nil, errors.Wrap(err, "get file stat")
+		return nil, fstat, errors.Wrap(err, "get file stat")
 	}
 
 	r, w := io.Pipe()
@@ -313,7 +331,7 @@ func (s *S3) sourceReader(fname string, arenas []*arena, cc, downloadChuckSize i
 		}
 	}()
 
-	return r, nil
+	return r, fstat, nil
 }
 
 func (pr *partReader) Run(concurrency int, arenas []*arena) {
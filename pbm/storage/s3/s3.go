@@ -499,6 +499,45 @@ func (s *S3) FileStat(name string) (storage.FileInfo, error) {
 
 // Delete deletes given file.
 // It returns storage.ErrNotExist if a file isn't exists
+// SourceHead requests only the first `size` bytes of the object,
+// see storage.HeadReader
+func (s *S3) SourceHead(name string, size int64) (io.ReadCloser, error) {
+	getOpts := &s3.GetObjectInput{
+		Bucket: aws.String(s.opts.Bucket),
+		Key:    aws.String(path.Join(s.opts.Prefix, name)),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", size-1)),
+	}
+
+	sse := s.opts.ServerSideEncryption
+	if sse != nil && sse.SseCustomerAlgorithm != "" {
+		getOpts.SSECustomerAlgorithm = aws.String(sse.SseCustomerAlgorithm)
+		decodedKey, err := base64.StdEncoding.DecodeString(sse.SseCustomerKey)
+		getOpts.SSECustomerKey = aws.String(string(decodedKey))
+		if err != nil {
+			return nil, errors.Wrap(err, "SseCustomerAlgorithm specified with invalid SseCustomerKey")
+		}
+		keyMD5 := md5.Sum(decodedKey)
+		getOpts.SSECustomerKeyMD5 = aws.String(base64.StdEncoding.EncodeToString(keyMD5[:]))
+	}
+
+	o, err := s.s3s.GetObject(getOpts)
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, storage.ErrNotExist
+		}
+		// the range of the empty object is unsatisfiable
+		var rerr awserr.RequestFailure
+		if errors.As(err, &rerr) && rerr.StatusCode() == http.StatusRequestedRangeNotSatisfiable {
+			return nil, storage.ErrEmpty
+		}
+
+		return nil, errors.Wrap(err, "get S3 object head")
+	}
+
+	return o.Body, nil
+}
+
 func (s *S3) Delete(name string) error {
 	_, err := s.s3s.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: aws.String(s.opts.Bucket),
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Prefixes of the config values that reference a secret stored
+// outside of the config. Values without a prefix are used as is.
+const (
+	// SecretEnv is the name of the environment variable, `env:AWS_SECRET`
+	SecretEnv = "env:"
+	// SecretFile is the path of the file with the secret, `file:/run/secrets/key`
+	SecretFile = "file:"
+	// SecretVault is the path and the field of the Vault KV secret,
+	// `vault:secret/data/pbm#secret-access-key`. The Vault server
+	// and token are taken from VAULT_ADDR and VAULT_TOKEN.
+	SecretVault = "vault:"
+)
+
+var vaultClient = &http.Client{Timeout: 30 * time.Second}
+
+// IsSecretRef returns true if the value references an external secret
+func IsSecretRef(v string) bool {
+	return strings.HasPrefix(v, SecretEnv) ||
+		strings.HasPrefix(v, SecretFile) ||
+		strings.HasPrefix(v, SecretVault)
+}
+
+// ResolveSecret returns the secret referenced by the value.
+// Inline values are returned as is.
+func ResolveSecret(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, SecretEnv):
+		name := strings.TrimPrefix(v, SecretEnv)
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.Errorf("env var %q is not set", name)
+		}
+		return s, nil
+	case strings.HasPrefix(v, SecretFile):
+		name := strings.TrimPrefix(v, SecretFile)
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return "", errors.Wrapf(err, "read secret file %q", name)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case strings.HasPrefix(v, SecretVault):
+		return vaultSecret(strings.TrimPrefix(v, SecretVault))
+	}
+
+	return v, nil
+}
+
+func vaultSecret(ref string) (string, error) {
+	p, field, ok := strings.Cut(ref, "#")
+	if !ok || p == "" || field == "" {
+		return "", errors.Errorf("invalid vault reference %q, expected `path#field`", ref)
+	}
+
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+
+	req, err := http.NewRequest(http.MethodGet,
+		strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(p, "/"), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "create vault request")
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+
+	res, err := vaultClient.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "get vault secret %q", p)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", errors.Errorf("get vault secret %q: %s", p, res.Status)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", errors.Wrapf(err, "decode vault secret %q", p)
+	}
+
+	data := body.Data
+	// KV v2 wraps the secret into one more `data`
+	if d, ok := data["data"].(map[string]interface{}); ok {
+		data = d
+	}
+
+	s, ok := data[field].(string)
+	if !ok {
+		return "", errors.Errorf("field %q not found in vault secret %q", field, p)
+	}
+
+	return s, nil
+}
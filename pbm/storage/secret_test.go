@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("PBM_TEST_SECRET", "from-env")
+
+	file := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "tkn" || r.URL.Path != "/v1/secret/data/pbm" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"data":{"key":"from-vault"}}}`))
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "tkn")
+
+	cases := map[string]string{
+		"inline":                     "inline",
+		"env:PBM_TEST_SECRET":        "from-env",
+		"file:" + file:               "from-file",
+		"vault:secret/data/pbm#key":  "from-vault",
+		"vault:/secret/data/pbm#key": "from-vault",
+	}
+	for ref, want := range cases {
+		got, err := ResolveSecret(ref)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", ref, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: expected %q, got %q", ref, want, got)
+		}
+	}
+
+	missing := map[string]string{
+		"env:PBM_TEST_NO_SUCH_SECRET": "PBM_TEST_NO_SUCH_SECRET",
+		"file:/no/such/secret":        "/no/such/secret",
+		"vault:secret/data/pbm#nope":  `field "nope"`,
+		"vault:secret/data/other#key": "403",
+		"vault:secret/data/pbm":       "path#field",
+	}
+	for ref, want := range missing {
+		_, err := ResolveSecret(ref)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected error mentioning %q, got %v", ref, want, err)
+		}
+	}
+}
@@ -43,6 +43,66 @@ type Storage interface {
 	Copy(src, dst string) error
 }
 
+// StatReader is implemented by the storages that get the file info along
+// with opening the file, see SourceReaderWithStat.
+type StatReader interface {
+	SourceReaderWithStat(name string) (io.ReadCloser, FileInfo, error)
+}
+
+// SourceReaderWithStat opens the file and returns its info. Storages that
+// implement StatReader do it in one round trip, others make FileStat and
+// then SourceReader. Like FileStat, it fails if the file is empty or not
+// exists.
+func SourceReaderWithStat(stg Storage, name string) (io.ReadCloser, FileInfo, error) {
+	if s, ok := stg.(StatReader); ok {
+		return s.SourceReaderWithStat(name)
+	}
+
+	fi, err := stg.FileStat(name)
+	if err != nil {
+		return nil, fi, err
+	}
+	r, err := stg.SourceReader(name)
+	if err != nil {
+		return nil, fi, err
+	}
+
+	return r, fi, nil
+}
+
+// HeadReader is implemented by the storages that can read the beginning
+// of the file without downloading the whole file, see SourceHead.
+type HeadReader interface {
+	SourceHead(name string, size int64) (io.ReadCloser, error)
+}
+
+// SourceHead opens the first `size` bytes of the file. Storages that
+// implement HeadReader request only these bytes, others open the whole
+// file and stop reading after `size` bytes.
+func SourceHead(stg Storage, name string, size int64) (io.ReadCloser, error) {
+	if s, ok := stg.(HeadReader); ok {
+		return s.SourceHead(name, size)
+	}
+
+	r, err := stg.SourceReader(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return LimitReadCloser(r, size), nil
+}
+
+type limitReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// LimitReadCloser returns the ReadCloser that reads up to n bytes from r
+// and closes r
+func LimitReadCloser(r io.ReadCloser, n int64) io.ReadCloser {
+	return limitReadCloser{Reader: io.LimitReader(r, n), Closer: r}
+}
+
 // ParseType parses string and returns storage type
 func ParseType(s string) Type {
 	switch s {
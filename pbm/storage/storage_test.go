@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+// statReaderStorage counts the calls of the separate FileStat and the
+// combined SourceReaderWithStat
+type statReaderStorage struct {
+	memStorage
+	stats, combined int
+}
+
+func (s *statReaderStorage) FileStat(name string) (FileInfo, error) {
+	s.stats++
+	return s.memStorage.FileStat(name)
+}
+
+func (s *statReaderStorage) SourceReaderWithStat(name string) (io.ReadCloser, FileInfo, error) {
+	s.combined++
+	fi, err := s.memStorage.FileStat(name)
+	if err != nil {
+		return nil, fi, err
+	}
+	r, err := s.memStorage.SourceReader(name)
+	return r, fi, err
+}
+
+func TestSourceReaderWithStat(t *testing.T) {
+	data := []byte("oplog chunk data")
+
+	check := func(t *testing.T, stg Storage) {
+		t.Helper()
+
+		r, fi, err := SourceReaderWithStat(stg, "c1")
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		defer r.Close()
+		if fi.Size != int64(len(data)) {
+			t.Errorf("expected size %d, got %d", len(data), fi.Size)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if string(b) != string(data) {
+			t.Errorf("expected %q, got %q", data, b)
+		}
+
+		if _, _, err := SourceReaderWithStat(stg, "none"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("expected ErrNotExist, got %v", err)
+		}
+	}
+
+	t.Run("default", func(t *testing.T) {
+		check(t, memStorage{"c1": data})
+	})
+
+	t.Run("stat reader", func(t *testing.T) {
+		stg := &statReaderStorage{memStorage: memStorage{"c1": data}}
+		check(t, stg)
+		if stg.stats != 0 || stg.combined != 2 {
+			t.Errorf("expected only the combined calls, got %d stats and %d combined", stg.stats, stg.combined)
+		}
+	})
+
+	t.Run("throttled stat reader", func(t *testing.T) {
+		stg := &statReaderStorage{memStorage: memStorage{"c1": data}}
+		check(t, NewThrottled(stg, NewRateLimiter(1<<20)))
+		if stg.stats != 0 || stg.combined != 2 {
+			t.Errorf("expected only the combined calls, got %d stats and %d combined", stg.stats, stg.combined)
+		}
+	})
+
+	t.Run("context", func(t *testing.T) {
+		stg := &statReaderStorage{memStorage: memStorage{"c1": data}}
+		r, fi, err := SourceReaderWithStatContext(context.Background(), stg, "c1")
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		r.Close()
+		if fi.Size != int64(len(data)) || stg.stats != 0 {
+			t.Errorf("expected size %d in the combined call, got %d with %d stats", len(data), fi.Size, stg.stats)
+		}
+	})
+}
+
+// headReaderStorage counts the calls of the whole file SourceReader and
+// the ranged SourceHead
+type headReaderStorage struct {
+	memStorage
+	full, heads int
+}
+
+func (s *headReaderStorage) SourceReader(name string) (io.ReadCloser, error) {
+	s.full++
+	return s.memStorage.SourceReader(name)
+}
+
+func (s *headReaderStorage) SourceHead(name string, size int64) (io.ReadCloser, error) {
+	s.heads++
+	b, ok := s.memStorage[name]
+	if !ok {
+		return nil, ErrNotExist
+	}
+	if int64(len(b)) > size {
+		b = b[:size]
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func TestSourceHead(t *testing.T) {
+	data := []byte("oplog chunk data")
+
+	check := func(t *testing.T, stg Storage) {
+		t.Helper()
+
+		r, err := SourceHead(stg, "c1", 5)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		defer r.Close()
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if string(b) != "oplog" {
+			t.Errorf("expected %q, got %q", "oplog", b)
+		}
+
+		if _, err := SourceHead(stg, "none", 5); !errors.Is(err, ErrNotExist) {
+			t.Errorf("expected ErrNotExist, got %v", err)
+		}
+	}
+
+	t.Run("default", func(t *testing.T) {
+		check(t, memStorage{"c1": data})
+	})
+
+	t.Run("head reader", func(t *testing.T) {
+		stg := &headReaderStorage{memStorage: memStorage{"c1": data}}
+		check(t, NewThrottled(stg, NewRateLimiter(1<<20)))
+		if stg.full != 0 || stg.heads != 2 {
+			t.Errorf("expected only the ranged reads, got %d full and %d ranged", stg.full, stg.heads)
+		}
+	})
+}
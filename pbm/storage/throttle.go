@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a simple token bucket rate limiter. The bucket holds up to
+// 100ms worth of tokens (but at least one) so the rate stays smooth.
+// It's safe for concurrent use, so it can bound the aggregate rate of
+// many readers.
+type RateLimiter struct {
+	mx     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(perSec int64) *RateLimiter {
+	burst := float64(perSec) / 10
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		rate:   float64(perSec),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until n tokens are taken. Requests bigger than the bucket
+// are taken in parts, so it never waits for more tokens than the bucket
+// can hold.
+func (b *RateLimiter) Wait(n int) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	need := float64(n)
+	for need > 0 {
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+
+		take := need
+		if take > b.tokens {
+			take = b.tokens
+		}
+		if take > 0 {
+			b.tokens -= take
+			need -= take
+		}
+		if need <= 0 {
+			return
+		}
+
+		lack := need
+		if lack > b.burst {
+			lack = b.burst
+		}
+		time.Sleep(time.Duration((lack - b.tokens) / b.rate * float64(time.Second)))
+	}
+}
+
+// ThrottledReader limits reads from the underlying reader to the rate of
+// the limiter (bytes per second)
+type ThrottledReader struct {
+	r io.Reader
+	l *RateLimiter
+}
+
+func NewThrottledReader(r io.Reader, l *RateLimiter) *ThrottledReader {
+	return &ThrottledReader{r: r, l: l}
+}
+
+func (t *ThrottledReader) Read(p []byte) (int, error) {
+	if len(p) > int(t.l.burst) {
+		p = p[:int(t.l.burst)]
+	}
+
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.l.Wait(n)
+	}
+
+	return n, err
+}
+
+// ThrottledStorage limits the download rate of the underlying storage.
+// Readers share the limiter, so their aggregate rate stays bounded.
+type ThrottledStorage struct {
+	Storage
+	l *RateLimiter
+}
+
+// NewThrottled wraps the storage with the download limiter.
+// Nil limiter means no limit and the storage is returned as is.
+func NewThrottled(s Storage, l *RateLimiter) Storage {
+	if l == nil {
+		return s
+	}
+
+	return &ThrottledStorage{Storage: s, l: l}
+}
+
+func (t *ThrottledStorage) SourceReader(name string) (io.ReadCloser, error) {
+	r, err := t.Storage.SourceReader(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &throttledReadCloser{ThrottledReader: NewThrottledReader(r, t.l), c: r}, nil
+}
+
+func (t *ThrottledStorage) SourceReaderWithStat(name string) (io.ReadCloser, FileInfo, error) {
+	r, fi, err := SourceReaderWithStat(t.Storage, name)
+	if err != nil {
+		return nil, fi, err
+	}
+
+	return &throttledReadCloser{ThrottledReader: NewThrottledReader(r, t.l), c: r}, fi, nil
+}
+
+func (t *ThrottledStorage) SourceHead(name string, size int64) (io.ReadCloser, error) {
+	r, err := SourceHead(t.Storage, name, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &throttledReadCloser{ThrottledReader: NewThrottledReader(r, t.l), c: r}, nil
+}
+
+type throttledReadCloser struct {
+	*ThrottledReader
+	c io.Closer
+}
+
+func (t *throttledReadCloser) Close() error {
+	return t.c.Close()
+}
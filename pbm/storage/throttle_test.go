@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memStorage map[string][]byte
+
+func (m memStorage) Type() Type                              { return Undef }
+func (m memStorage) Save(string, io.Reader, int64) error     { return nil }
+func (m memStorage) List(string, string) ([]FileInfo, error) { return nil, nil }
+func (m memStorage) Delete(string) error                     { return nil }
+func (m memStorage) Copy(string, string) error               { return nil }
+
+func (m memStorage) SourceReader(name string) (io.ReadCloser, error) {
+	b, ok := m[name]
+	if !ok {
+		return nil, ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (m memStorage) FileStat(name string) (FileInfo, error) {
+	b, ok := m[name]
+	if !ok {
+		return FileInfo{}, ErrNotExist
+	}
+	return FileInfo{Name: name, Size: int64(len(b))}, nil
+}
+
+func TestThrottledReader(t *testing.T) {
+	const (
+		size  = 30 << 10
+		limit = 100 << 10 // bytes per second
+	)
+
+	r := NewThrottledReader(bytes.NewReader(make([]byte, size)), NewRateLimiter(limit))
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, r)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	took := time.Since(start)
+	if n != size {
+		t.Fatalf("expected %d bytes, got %d", size, n)
+	}
+
+	least := time.Duration(float64(size-limit/10) / limit * float64(time.Second))
+	if took < least*9/10 {
+		t.Errorf("read %d bytes in %v, expected at least %v with %d bytes/sec limit", size, took, least, limit)
+	}
+}
+
+func TestRateLimiterSmallRequests(t *testing.T) {
+	// requests smaller than a refill and bigger than the bucket
+	// must not deadlock
+	b := NewRateLimiter(5)
+	done := make(chan struct{})
+	go func() {
+		b.Wait(1)
+		b.Wait(3)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("rate limiter deadlocked")
+	}
+}
+
+func TestThrottledStorageAggregate(t *testing.T) {
+	const (
+		readers = 4
+		size    = 20 << 10
+		limit   = 100 << 10 // bytes per second
+	)
+
+	mem := memStorage{}
+	for i := 0; i < readers; i++ {
+		mem[string(rune('a'+i))] = make([]byte, size)
+	}
+	stg := NewThrottled(mem, NewRateLimiter(limit))
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, readers)
+	for name := range mem {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			r, err := stg.SourceReader(name)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer r.Close()
+			_, err = io.Copy(io.Discard, r)
+			errs <- err
+		}(name)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	}
+	took := time.Since(start)
+
+	total := readers * size
+	least := time.Duration(float64(total-limit/10) / limit * float64(time.Second))
+	if took < least*9/10 {
+		t.Errorf("read %d bytes by %d readers in %v, expected at least %v with %d bytes/sec limit",
+			total, readers, took, least, limit)
+	}
+
+	if NewThrottled(mem, nil) == nil {
+		t.Error("expected the storage as is with no limit")
+	}
+	if _, ok := NewThrottled(mem, nil).(memStorage); !ok {
+		t.Error("expected no wrapping with no limit")
+	}
+}